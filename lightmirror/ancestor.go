@@ -0,0 +1,88 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// IsAncestor returns whether the block a is an ancestor of the block b, a
+// block being its own ancestor.  Both may be on the best chain or on side
+// branches, and pruned or header-only, the chain keeping their headers.  It
+// returns an error wrapping ErrUnknownBlock when either block is not known.
+//
+// The query takes the time of walking the side branches of a and b down to
+// the best chain, found in its height index from there.
+func (c *MirrorChain) IsAncestor(a, b chainhash.Hash) (bool, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	ea, eb, err := c.entries(a, b)
+	if err != nil {
+		return false, err
+	}
+	if ea.height > eb.height {
+		return false, nil
+	}
+	return c.ancestorAt(eb, ea.height) == ea, nil
+}
+
+// CommonAncestor returns the most recent block which is an ancestor of both
+// the blocks a and b, as IsAncestor tells, in the time of walking their
+// side branches.  It returns an error wrapping ErrUnknownBlock when either
+// block is not known, and ErrPruned or ErrHeaderOnly, telling the hash and
+// height of the common ancestor, when it has no mirror.
+func (c *MirrorChain) CommonAncestor(a, b chainhash.Hash) (*BtcLightMirrorV2, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	ea, eb, err := c.entries(a, b)
+	if err != nil {
+		return nil, err
+	}
+	if ea.height > eb.height {
+		ea = c.ancestorAt(ea, eb.height)
+	} else {
+		eb = c.ancestorAt(eb, ea.height)
+	}
+	// The blocks are at the same height, which they keep down to the
+	// common ancestor, the first block of the best chain they meet at the
+	// latest.
+	for ea != eb {
+		ea, eb = ea.parent, eb.parent
+	}
+	if err := ea.bodyErr(); err != nil {
+		return nil, fmt.Errorf("common ancestor %v at height %d: %w",
+			ea.hash, ea.height, err)
+	}
+	return ea.mirror.Clone(), nil
+}
+
+// entries returns the entries of the blocks a and b.
+func (c *MirrorChain) entries(a, b chainhash.Hash) (*chainEntry, *chainEntry, error) {
+	ea, ok := c.index[a]
+	if !ok {
+		return nil, nil, fmt.Errorf("block %v: %w", a, ErrUnknownBlock)
+	}
+	eb, ok := c.index[b]
+	if !ok {
+		return nil, nil, fmt.Errorf("block %v: %w", b, ErrUnknownBlock)
+	}
+	return ea, eb, nil
+}
+
+// ancestorAt returns the ancestor of e at height, no higher than e and no
+// lower than the anchor.  The side branch of e is walked down to the best
+// chain, whose height index gives the rest of the way.
+func (c *MirrorChain) ancestorAt(e *chainEntry, height int64) *chainEntry {
+	for e.height > height && !c.inBestChain(e) {
+		e = e.parent
+	}
+	if e.height == height {
+		return e
+	}
+	hash, _ := c.best.HashAtHeight(height)
+	return c.index[hash]
+}
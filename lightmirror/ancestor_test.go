@@ -0,0 +1,120 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// newForkedChain returns a chain of 10 blocks on the best chain with two
+// live side branches: a of 3 blocks building on the block at index 4, with
+// a branch fork of 1 block building on its first block, and b of 2 blocks
+// building on the block at index 6.
+func newForkedChain(t *testing.T, opts ...ChainOption) (c *MirrorChain, main, a, b, fork []*BtcLightMirrorV2) {
+	t.Helper()
+	main = newTestMirrors(10)
+	c = newTestChain(t, main, opts...)
+	a = newTestBranch(main[4], 1000, 3)
+	b = newTestBranch(main[6], 2000, 2)
+	fork = newTestBranch(a[0], 3000, 1)
+	for _, m := range append(append(append([]*BtcLightMirrorV2{}, a...), b...), fork...) {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	if tip, _ := c.Tip(); tip.BtcHeader.BlockHash() != main[9].BtcHeader.BlockHash() {
+		t.Fatalf("Tip: got %v, want the end of the best chain", tip.BtcHeader.BlockHash())
+	}
+	return c, main, a, b, fork
+}
+
+func TestIsAncestor(t *testing.T) {
+	c, main, a, b, fork := newForkedChain(t)
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash { return m.BtcHeader.BlockHash() }
+	tests := []struct {
+		name string
+		a, b *BtcLightMirrorV2
+		want bool
+	}{
+		{"itself", main[3], main[3], true},
+		{"best chain", main[2], main[8], true},
+		{"best chain, reversed", main[8], main[2], false},
+		{"anchor", main[0], fork[0], true},
+		{"fork point", main[4], a[2], true},
+		{"above the fork point", main[5], a[2], false},
+		{"same height on another branch", main[6], a[1], false},
+		{"side branch", a[0], a[2], true},
+		{"fork on a fork", a[0], fork[0], true},
+		{"sibling branches", a[1], fork[0], false},
+		{"other side branch", a[0], b[1], false},
+		{"best chain of a side branch", main[6], b[1], true},
+		{"side branch of the best chain", b[0], main[9], false},
+	}
+	for _, test := range tests {
+		got, err := c.IsAncestor(hash(test.a), hash(test.b))
+		if err != nil || got != test.want {
+			t.Errorf("IsAncestor (%s): got %v, error %v, want %v", test.name, got, err, test.want)
+		}
+	}
+
+	unknown := chainhash.Hash{1}
+	if _, err := c.IsAncestor(unknown, hash(main[1])); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("IsAncestor: got error %v, want %v", err, ErrUnknownBlock)
+	}
+	if _, err := c.IsAncestor(hash(main[1]), unknown); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("IsAncestor: got error %v, want %v", err, ErrUnknownBlock)
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	c, main, a, b, fork := newForkedChain(t)
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash { return m.BtcHeader.BlockHash() }
+	tests := []struct {
+		name       string
+		a, b, want *BtcLightMirrorV2
+	}{
+		{"itself", main[3], main[3], main[3]},
+		{"best chain", main[2], main[8], main[2]},
+		{"best chain and side branch", main[9], a[2], main[4]},
+		{"side branch and best chain", a[2], main[9], main[4]},
+		{"below the fork point", main[3], a[2], main[3]},
+		{"two side branches", a[2], b[1], main[4]},
+		{"fork on a fork", a[2], fork[0], a[0]},
+		{"side branch and its ancestor", a[1], a[0], a[0]},
+		{"other side branch and best chain", b[1], main[7], main[6]},
+	}
+	for _, test := range tests {
+		got, err := c.CommonAncestor(hash(test.a), hash(test.b))
+		if err != nil {
+			t.Errorf("CommonAncestor (%s) error %v", test.name, err)
+		} else if hash(got) != hash(test.want) {
+			t.Errorf("CommonAncestor (%s): got %v, want %v", test.name, hash(got), hash(test.want))
+		}
+	}
+
+	if _, err := c.CommonAncestor(hash(main[1]), chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("CommonAncestor: got error %v, want %v", err, ErrUnknownBlock)
+	}
+}
+
+func TestCommonAncestorPruned(t *testing.T) {
+	c, main, a, b, _ := newForkedChain(t, WithStore(newMemStore()), WithPruneDepth(4))
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash { return m.BtcHeader.BlockHash() }
+
+	// The blocks up to height 5 are pruned: they are still known, unlike
+	// an unknown block.
+	if ok, err := c.IsAncestor(hash(main[4]), hash(b[1])); err != nil || !ok {
+		t.Errorf("IsAncestor of a pruned block: got %v, error %v", ok, err)
+	}
+	if _, err := c.CommonAncestor(hash(a[2]), hash(b[1])); !errors.Is(err, ErrPruned) {
+		t.Errorf("CommonAncestor: got error %v, want %v", err, ErrPruned)
+	}
+	if m, err := c.CommonAncestor(hash(b[1]), hash(main[9])); err != nil || hash(m) != hash(main[6]) {
+		t.Errorf("CommonAncestor: got error %v, want %v", err, hash(main[6]))
+	}
+}
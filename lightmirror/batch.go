@@ -0,0 +1,115 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxBatchSize bounds the mirror count read by DeserializeBatch, so that a
+// corrupt count can not make us allocate gigabytes.
+const maxBatchSize = 10000
+
+// SerializeBatch writes the mirrors as a varint count followed by the
+// canonical serialization of every mirror.
+func SerializeBatch(w io.Writer, mirrors []*BtcLightMirrorV2) error {
+	if len(mirrors) > maxBatchSize {
+		return fmt.Errorf("too many mirrors in batch [count %d, max %d]",
+			len(mirrors), maxBatchSize)
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(mirrors))); err != nil {
+		return err
+	}
+	for _, m := range mirrors {
+		if err := m.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeserializeBatch reads mirrors written by SerializeBatch.
+func DeserializeBatch(r io.Reader) ([]*BtcLightMirrorV2, error) {
+	return DeserializeBatchWith(r, DeserializeOptions{})
+}
+
+// DeserializeBatchWith is DeserializeBatch with the options opts.  With
+// opts.RejectTrailingBytes, it fails if r holds more than the batch.
+func DeserializeBatchWith(r io.Reader, opts DeserializeOptions) ([]*BtcLightMirrorV2, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxBatchSize {
+		return nil, fmt.Errorf("too many mirrors in batch [count %d, max %d]",
+			count, maxBatchSize)
+	}
+
+	// Every mirror but the last is followed by the next one, so trailing
+	// bytes are only checked for after the batch.
+	mirrorOpts := opts
+	mirrorOpts.RejectTrailingBytes = false
+	mirrors := make([]*BtcLightMirrorV2, 0, count)
+	for i := uint64(0); i < count; i++ {
+		m := new(BtcLightMirrorV2)
+		if err := m.DeserializeWith(r, mirrorOpts); err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, m)
+	}
+	if opts.RejectTrailingBytes {
+		if err := checkTrailing(r); err != nil {
+			return nil, err
+		}
+	}
+	return mirrors, nil
+}
+
+// SerializeCompressedBatch writes the Compression tag of the options,
+// CompressionNone without them, followed by the batch SerializeBatch writes
+// compressed accordingly.
+func SerializeCompressedBatch(w io.Writer, mirrors []*BtcLightMirrorV2, opts ...CompressionOption) error {
+	cfg := newCompressionConfig(opts)
+	if _, err := w.Write([]byte{byte(cfg.compression)}); err != nil {
+		return err
+	}
+	cw, err := cfg.compressor(w)
+	if err != nil {
+		return err
+	}
+	if err := SerializeBatch(cw, mirrors); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// DeserializeCompressedBatch reads mirrors written by
+// SerializeCompressedBatch, decompressing them as the tag tells.  A
+// compressed batch may decompress to at most 64 times its size plus a
+// megabyte, and fails with ErrDecompressionLimit past that.  Unless r is an
+// io.ByteReader, it is buffered, and bytes following the batch may be
+// consumed.
+func DeserializeCompressedBatch(r io.Reader) ([]*BtcLightMirrorV2, error) {
+	fr := byteReader(r)
+	tag, err := fr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	dr, err := decompressor(fr, Compression(tag))
+	if err != nil {
+		return nil, err
+	}
+	mirrors, err := DeserializeBatch(dr)
+	if err != nil {
+		return nil, err
+	}
+	if err := finishDecompressed(dr, Compression(tag)); err != nil {
+		return nil, err
+	}
+	return mirrors, nil
+}
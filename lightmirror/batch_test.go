@@ -0,0 +1,67 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestBatch(t *testing.T) {
+	tests := [][]*BtcLightMirrorV2{
+		nil,
+		newTestMirrors(1),
+		newTestMirrors(7),
+	}
+	for i, mirrors := range tests {
+		var buf bytes.Buffer
+		if err := SerializeBatch(&buf, mirrors); err != nil {
+			t.Errorf("SerializeBatch #%d error %v", i, err)
+			continue
+		}
+		got, err := DeserializeBatch(&buf)
+		if err != nil {
+			t.Errorf("DeserializeBatch #%d error %v", i, err)
+			continue
+		}
+		if len(got) != len(mirrors) {
+			t.Errorf("DeserializeBatch #%d: got %d mirrors, want %d", i,
+				len(got), len(mirrors))
+			continue
+		}
+		for j := range got {
+			if !bytes.Equal(serializeMirror(t, got[j]), serializeMirror(t, mirrors[j])) {
+				t.Errorf("DeserializeBatch #%d: mirror #%d differs", i, j)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("DeserializeBatch #%d: %d bytes left", i, buf.Len())
+		}
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := wire.WriteVarInt(&buf, 0, maxBatchSize+1); err != nil {
+		t.Fatalf("WriteVarInt error %v", err)
+	}
+	if _, err := DeserializeBatch(&buf); err == nil {
+		t.Errorf("DeserializeBatch: expected error for an oversized count")
+	}
+	if err := SerializeBatch(&buf, make([]*BtcLightMirrorV2, maxBatchSize+1)); err == nil {
+		t.Errorf("SerializeBatch: expected error for an oversized batch")
+	}
+
+	// A truncated batch.
+	buf.Reset()
+	if err := SerializeBatch(&buf, newTestMirrors(2)); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+	if _, err := DeserializeBatch(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Errorf("DeserializeBatch: expected error for a truncated batch")
+	}
+}
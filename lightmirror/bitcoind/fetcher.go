@@ -0,0 +1,311 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package bitcoind provides a lightmirror.Fetcher building mirrors from the
+// blocks of a bitcoind node, read over its JSON-RPC interface, and a
+// lightmirror.BlockSource of the block notifications the node publishes over
+// ZeroMQ.
+package bitcoind
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// maxResponseSize bounds the body of an answer of the node: the hex of the
+// largest block with room for the JSON around it.
+const maxResponseSize = 2*wire.MaxBlockPayload + 1024
+
+// The RPC error codes of bitcoind the fetcher tells apart.
+const (
+	// errCodeInvalidAddressOrKey is returned by getblock for an unknown
+	// block.
+	errCodeInvalidAddressOrKey = -5
+
+	// errCodeInvalidParameter is returned by getblockhash for a height
+	// above the tip.
+	errCodeInvalidParameter = -8
+)
+
+// RPCError is an error returned by the node for a call.
+type RPCError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("bitcoind %s: %s (code %d)", e.Method, e.Message, e.Code)
+}
+
+// Config configures a Fetcher.
+type Config struct {
+	// URL is the address of the RPC server of the node, such as
+	// http://127.0.0.1:8332.  A wallet path is not needed.
+	URL string
+
+	// User and Password are the RPC credentials of the node.  Without a
+	// user, the credentials are read from CookieFile on every call, so
+	// that the fetcher follows the new cookie of a restarted node.
+	User     string
+	Password string
+
+	// CookieFile is the .cookie file of the data directory of the node.
+	CookieFile string
+
+	// Client sends the calls, http.DefaultClient if nil.
+	Client *http.Client
+
+	// MirrorOptions are passed to lightmirror.New for every mirror built.
+	// By default, New checks the merkle branch against the header.
+	MirrorOptions []lightmirror.MirrorOption
+}
+
+// Fetcher is a lightmirror.Fetcher reading blocks from a bitcoind node with
+// getblockhash and getblock.  Blocks the node does not have, or heights
+// above its tip, are reported as lightmirror.ErrNotFound.  It is a
+// lightmirror.HealthChecker.
+type Fetcher struct {
+	// id is the ID of the last call, first for its 64-bit alignment.
+	id uint64
+
+	cfg Config
+	url string
+
+	mtx       sync.Mutex
+	lastBlock time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+var (
+	_ lightmirror.Fetcher       = (*Fetcher)(nil)
+	_ lightmirror.HealthChecker = (*Fetcher)(nil)
+)
+
+// NewFetcher returns a fetcher reading blocks from the node of cfg.
+func NewFetcher(cfg Config) (*Fetcher, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("bitcoind URL %q is not an HTTP URL", cfg.URL)
+	}
+	if cfg.User == "" && cfg.CookieFile == "" {
+		return nil, errors.New("bitcoind fetcher needs a user or a cookie file")
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &Fetcher{cfg: cfg, url: u.String(), lastBlock: time.Now()}, nil
+}
+
+// FetchByHash returns the mirror of the block with the given hash.
+func (f *Fetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	m, err := f.fetchByHash(ctx, hash)
+	f.record(err)
+	return m, err
+}
+
+// FetchByHeight returns the mirror of the block the node has at the given
+// height on its best chain.
+func (f *Fetcher) FetchByHeight(ctx context.Context, height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	var hashStr string
+	err := f.call(ctx, "getblockhash", []interface{}{height}, &hashStr)
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == errCodeInvalidParameter {
+		return nil, fmt.Errorf("block at height %d: %w", height, lightmirror.ErrNotFound)
+	}
+	if err != nil {
+		f.record(err)
+		return nil, err
+	}
+	hash, err := lightmirror.ParseDisplayHex(hashStr)
+	if err != nil {
+		err = fmt.Errorf("bitcoind getblockhash: %w", err)
+		f.record(err)
+		return nil, err
+	}
+	return f.FetchByHash(ctx, hash)
+}
+
+func (f *Fetcher) fetchByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	var blockHex string
+	err := f.call(ctx, "getblock", []interface{}{hash.String(), 0}, &blockHex)
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == errCodeInvalidAddressOrKey {
+		return nil, fmt.Errorf("block %v: %w", hash, lightmirror.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, fmt.Errorf("bitcoind getblock %v: %w", hash, err)
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("bitcoind getblock %v: %w", hash, err)
+	}
+	if got := block.BlockHash(); got != hash {
+		return nil, fmt.Errorf("bitcoind getblock %v: got block %v", hash, got)
+	}
+	return blockMirror(&block, f.cfg.MirrorOptions)
+}
+
+// blockMirror returns the mirror of block built with opts.
+func blockMirror(block *wire.MsgBlock, opts []lightmirror.MirrorOption) (*lightmirror.BtcLightMirrorV2, error) {
+	hash := block.BlockHash()
+	if len(block.Transactions) == 0 {
+		return nil, fmt.Errorf("block %v has no transactions", hash)
+	}
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	m, err := lightmirror.New(&block.Header, block.Transactions[0], txids, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("block %v: %w", hash, err)
+	}
+	return m, nil
+}
+
+// record records the outcome of a fetch for the health of the fetcher.  A
+// block the node does not have is no failure.
+func (f *Fetcher) record(err error) {
+	if errors.Is(err, lightmirror.ErrNotFound) {
+		return
+	}
+	now := time.Now()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err != nil {
+		f.lastErr, f.lastErrAt = err, now
+		return
+	}
+	f.lastBlock = now
+}
+
+// Ping asks the node for its block count.
+func (f *Fetcher) Ping(ctx context.Context) error {
+	var count int64
+	return f.call(ctx, "getblockcount", nil, &count)
+}
+
+// LastBlockAge returns the time elapsed since the fetcher last fetched a
+// block, or since it was created if it fetched none.
+func (f *Fetcher) LastBlockAge() time.Duration {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return time.Since(f.lastBlock)
+}
+
+// LastError returns the last error of a fetch and when.
+func (f *Fetcher) LastError() (error, time.Time) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.lastErr, f.lastErrAt
+}
+
+// request and response are the JSON-RPC 1.0 messages of bitcoind.
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	ID uint64 `json:"id"`
+}
+
+// call calls method with params on the node, decoding its result into
+// result.
+func (f *Fetcher) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	id := atomic.AddUint64(&f.id, 1)
+	body, err := json.Marshal(request{JSONRPC: "1.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	user, password, err := f.credentials()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, password)
+
+	resp, err := f.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// bitcoind answers the calls failing with an error object with a
+	// status of 404 or 500, but not an authentication failure.
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		return fmt.Errorf("bitcoind %s: %s", method, resp.Status)
+	}
+	var res response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&res); err != nil {
+		return fmt.Errorf("bitcoind %s: %s: %v", method, resp.Status, err)
+	}
+	if res.Error != nil {
+		return &RPCError{Method: method, Code: res.Error.Code, Message: res.Error.Message}
+	}
+	if res.ID != id {
+		return fmt.Errorf("bitcoind %s: got the answer to call %d, want %d",
+			method, res.ID, id)
+	}
+	if err := json.Unmarshal(res.Result, result); err != nil {
+		return fmt.Errorf("bitcoind %s: %v", method, err)
+	}
+	return nil
+}
+
+// credentials returns the RPC credentials of the node.
+func (f *Fetcher) credentials() (string, string, error) {
+	if f.cfg.User != "" {
+		return f.cfg.User, f.cfg.Password, nil
+	}
+	data, err := ioutil.ReadFile(f.cfg.CookieFile)
+	if err != nil {
+		return "", "", err
+	}
+	cookie := strings.TrimSpace(string(data))
+	i := strings.IndexByte(cookie, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("bitcoind cookie file %s is malformed", f.cfg.CookieFile)
+	}
+	return cookie[:i], cookie[i+1:], nil
+}
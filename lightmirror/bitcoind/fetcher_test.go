@@ -0,0 +1,260 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bitcoind
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// testBlock returns a block building on prev with a coinbase made unique by
+// seed and n more transactions.
+func testBlock(prev chainhash.Hash, seed uint32, n int) *wire.MsgBlock {
+	block := &wire.MsgBlock{Header: wire.BlockHeader{
+		Version:   1,
+		PrevBlock: prev,
+		Timestamp: time.Unix(1600000000+int64(seed)*600, 0),
+		Bits:      0x207fffff,
+	}}
+	for i := 0; i <= n; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{0x04, byte(seed), byte(seed >> 8), byte(i), 0},
+			Sequence:         0xffffffff,
+		})
+		tx.AddTxOut(&wire.TxOut{Value: 5000000000, PkScript: []byte{0x51}})
+		block.AddTransaction(tx)
+	}
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	merkles := lightmirror.BuildMerkleTreeStore(&txids[0], txids[1:])
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return block
+}
+
+// node is a fake bitcoind serving the blocks of its best chain.
+type node struct {
+	t      *testing.T
+	user   string
+	pass   string
+	blocks []*wire.MsgBlock
+}
+
+func (n *node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != n.user || pass != n.pass {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		ID     uint64            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		n.t.Errorf("Decode error %v", err)
+		return
+	}
+	fail := func(code int, message string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": nil,
+			"error":  map[string]interface{}{"code": code, "message": message},
+			"id":     req.ID,
+		})
+	}
+	var result interface{}
+	switch req.Method {
+	case "getblockcount":
+		result = len(n.blocks) - 1
+	case "getblockhash":
+		var height int
+		json.Unmarshal(req.Params[0], &height)
+		if height < 0 || height >= len(n.blocks) {
+			fail(errCodeInvalidParameter, "Block height out of range")
+			return
+		}
+		result = n.blocks[height].BlockHash().String()
+	case "getblock":
+		var hash string
+		var verbosity int
+		json.Unmarshal(req.Params[0], &hash)
+		json.Unmarshal(req.Params[1], &verbosity)
+		if verbosity != 0 {
+			n.t.Errorf("getblock: got verbosity %d", verbosity)
+		}
+		for _, b := range n.blocks {
+			if b.BlockHash().String() == hash {
+				var buf bytes.Buffer
+				b.Serialize(&buf)
+				result = hex.EncodeToString(buf.Bytes())
+			}
+		}
+		if result == nil {
+			fail(errCodeInvalidAddressOrKey, "Block not found")
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": nil,
+			"error":  map[string]interface{}{"code": -32601, "message": "Method not found"},
+			"id":     req.ID,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": nil, "id": req.ID})
+}
+
+// newNode returns a node of n blocks and a fetcher of it.
+func newNode(t *testing.T, n int) (*node, *Fetcher) {
+	t.Helper()
+	nd := &node{t: t, user: "user", pass: "pass"}
+	var prev chainhash.Hash
+	for i := 0; i < n; i++ {
+		b := testBlock(prev, uint32(i), i)
+		nd.blocks = append(nd.blocks, b)
+		prev = b.BlockHash()
+	}
+	srv := httptest.NewServer(nd)
+	t.Cleanup(srv.Close)
+	f, err := NewFetcher(Config{URL: srv.URL, User: nd.user, Password: nd.pass, Client: srv.Client()})
+	if err != nil {
+		t.Fatalf("NewFetcher error %v", err)
+	}
+	return nd, f
+}
+
+func TestFetcher(t *testing.T) {
+	nd, f := newNode(t, 4)
+	ctx := context.Background()
+	for height, b := range nd.blocks {
+		m, err := f.FetchByHeight(ctx, int64(height))
+		if err != nil {
+			t.Fatalf("FetchByHeight #%d error %v", height, err)
+		}
+		if m.BtcHeader.BlockHash() != b.BlockHash() || m.CoinBaseTx.TxHash() != b.Transactions[0].TxHash() {
+			t.Errorf("FetchByHeight #%d: got mirror %v", height, m)
+		}
+		if err := m.CheckMerkle(); err != nil {
+			t.Errorf("CheckMerkle #%d error %v", height, err)
+		}
+		byHash, err := f.FetchByHash(ctx, b.BlockHash())
+		if err != nil || !byHash.Equal(m) {
+			t.Errorf("FetchByHash #%d: got %v, error %v", height, byHash, err)
+		}
+	}
+
+	if _, err := f.FetchByHeight(ctx, 4); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHeight above the tip: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if _, err := f.FetchByHash(ctx, chainhash.Hash{1}); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHash of an unknown block: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if err, _ := f.LastError(); err != nil {
+		t.Errorf("LastError: got %v after missing blocks", err)
+	}
+	if err := f.Ping(ctx); err != nil {
+		t.Errorf("Ping error %v", err)
+	}
+	if age := f.LastBlockAge(); age > time.Minute {
+		t.Errorf("LastBlockAge: got %v", age)
+	}
+}
+
+func TestFetcherErrors(t *testing.T) {
+	nd, f := newNode(t, 2)
+	ctx := context.Background()
+
+	nd.blocks[1].Header.MerkleRoot = chainhash.Hash{}
+	if _, err := f.FetchByHeight(ctx, 1); err == nil {
+		t.Errorf("FetchByHeight of a block with a wrong merkle root: expected error")
+	}
+	if err, at := f.LastError(); err == nil || at.IsZero() {
+		t.Errorf("LastError: got %v at %v", err, at)
+	}
+
+	var rpcErr *RPCError
+	if err := f.call(ctx, "getnetworkinfo", nil, new(interface{})); !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Errorf("call of an unknown method: got error %v", err)
+	}
+
+	bad, err := NewFetcher(Config{URL: f.cfg.URL, User: "user", Password: "wrong", Client: f.cfg.Client})
+	if err != nil {
+		t.Fatalf("NewFetcher error %v", err)
+	}
+	if err := bad.Ping(ctx); err == nil {
+		t.Errorf("Ping with wrong credentials: expected error")
+	}
+
+	for _, cfg := range []Config{
+		{URL: "ftp://localhost", User: "user"},
+		{URL: "http://localhost"},
+		{URL: ":"},
+	} {
+		if _, err := NewFetcher(cfg); err == nil {
+			t.Errorf("NewFetcher (%+v): expected error", cfg)
+		}
+	}
+}
+
+func TestFetcherCookie(t *testing.T) {
+	nd, f := newNode(t, 1)
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	cf, err := NewFetcher(Config{URL: f.cfg.URL, CookieFile: cookie, Client: f.cfg.Client})
+	if err != nil {
+		t.Fatalf("NewFetcher error %v", err)
+	}
+	ctx := context.Background()
+	if err := cf.Ping(ctx); err == nil {
+		t.Errorf("Ping without a cookie file: expected error")
+	}
+	nd.user, nd.pass = "__cookie__", "abc:def"
+	if err := ioutil.WriteFile(cookie, []byte("__cookie__:abc:def\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Ping(ctx); err != nil {
+		t.Errorf("Ping error %v", err)
+	}
+
+	// The cookie is read again after a restart of the node.
+	nd.pass = "ghi"
+	ioutil.WriteFile(cookie, []byte("__cookie__:ghi"), 0600)
+	if err := cf.Ping(ctx); err != nil {
+		t.Errorf("Ping after a new cookie error %v", err)
+	}
+	ioutil.WriteFile(cookie, []byte("malformed"), 0600)
+	if err := cf.Ping(ctx); err == nil {
+		t.Errorf("Ping with a malformed cookie: expected error")
+	}
+}
+
+func TestFetcherGenesis(t *testing.T) {
+	nd, f := newNode(t, 0)
+	nd.blocks = []*wire.MsgBlock{chaincfg.MainNetParams.GenesisBlock}
+	m, err := f.FetchByHeight(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("FetchByHeight error %v", err)
+	}
+	if want := lightmirror.GenesisMirror(&chaincfg.MainNetParams); !m.Equal(want) {
+		t.Errorf("FetchByHeight: got %v, want %v", m, want)
+	}
+}
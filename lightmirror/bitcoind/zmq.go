@@ -0,0 +1,583 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bitcoind
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// The topics of the block notifications of bitcoind.
+const (
+	// TopicRawBlock is the topic of zmqpubrawblock, publishing the
+	// serialized blocks.
+	TopicRawBlock = "rawblock"
+
+	// TopicHashBlock is the topic of zmqpubhashblock, publishing the
+	// hashes of the blocks.
+	TopicHashBlock = "hashblock"
+)
+
+const (
+	// defaultZMQBuffer is the default capacity of the Blocks channel of a
+	// ZMQSource.
+	defaultZMQBuffer = 16
+
+	// defaultZMQReconnect is the default time a ZMQSource waits before
+	// connecting again to the node.
+	defaultZMQReconnect = 5 * time.Second
+
+	// zmqHandshakeTimeout bounds the time a ZMQSource waits for the node
+	// to complete the ZMTP handshake.
+	zmqHandshakeTimeout = 10 * time.Second
+
+	// maxZMQFrameSize bounds the size of a frame read from the node: the
+	// largest block.
+	maxZMQFrameSize = wire.MaxBlockPayload
+
+	// maxZMQFrames bounds the number of frames of a message read from the
+	// node, where bitcoind sends 3.
+	maxZMQFrames = 16
+)
+
+// ZMTP frame flags.
+const (
+	zmqFlagMore    = 0x01
+	zmqFlagLong    = 0x02
+	zmqFlagCommand = 0x04
+)
+
+// ErrNotConnected is returned by the Ping method of a ZMQSource which runs
+// but is not connected to the node.
+var ErrNotConnected = errors.New("not connected to the node")
+
+// ZMQConfig configures a ZMQSource.
+type ZMQConfig struct {
+	// Address is the endpoint the node publishes the topic on, as given
+	// to its zmqpubrawblock or zmqpubhashblock option, such as
+	// tcp://127.0.0.1:28332.
+	Address string
+
+	// Topic is TopicRawBlock, the default, or TopicHashBlock.
+	Topic string
+
+	// Fetcher fetches the blocks announced by hash.  It is required for
+	// TopicHashBlock.
+	Fetcher lightmirror.Fetcher
+
+	// MirrorOptions are passed to lightmirror.New for every mirror built
+	// from a raw block.
+	MirrorOptions []lightmirror.MirrorOption
+
+	// Buffer is the capacity of the Blocks channel.  It defaults to 16.
+	Buffer int
+
+	// ReconnectInterval is the time the source waits before connecting
+	// again after it could not connect or lost its connection.  It
+	// defaults to five seconds.
+	ReconnectInterval time.Duration
+
+	// Logger receives the connections of the source, the notifications
+	// it missed and its errors.  Nothing is logged by default.
+	Logger lightmirror.Logger
+}
+
+// ZMQSource is a lightmirror.BlockSource subscribing to the block
+// notifications bitcoind publishes over ZeroMQ.  It speaks ZMTP 3.0 with
+// the NULL security mechanism, the one of bitcoind, and connects again
+// whenever the connection is lost.
+//
+// The mirrors of TopicRawBlock are built from the notifications alone; with
+// TopicHashBlock the blocks are fetched.  A notification which cannot be
+// turned into a mirror is reported through LastError and skipped.  The
+// source blocks while the Blocks channel is full, leaving the node to drop
+// the notifications it cannot send beyond its high-water mark; the
+// notifications found missing from their sequence numbers are logged.
+//
+// A ZMQSource is a lightmirror.HealthChecker.
+type ZMQSource struct {
+	cfg     ZMQConfig
+	address string
+	blocks  chan *lightmirror.BtcLightMirrorV2
+
+	mtx       sync.Mutex
+	started   bool
+	stopped   bool
+	quit      chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+	connected bool
+	lastBlock time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+var (
+	_ lightmirror.BlockSource   = (*ZMQSource)(nil)
+	_ lightmirror.HealthChecker = (*ZMQSource)(nil)
+)
+
+// NewZMQSource returns a source of the notifications of cfg.
+func NewZMQSource(cfg ZMQConfig) (*ZMQSource, error) {
+	address := cfg.Address
+	if i := strings.Index(address, "://"); i >= 0 {
+		if address[:i] != "tcp" {
+			return nil, fmt.Errorf("zmq address %q is not a TCP address", cfg.Address)
+		}
+		address = address[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("zmq address %q: %w", cfg.Address, err)
+	}
+	switch cfg.Topic {
+	case "":
+		cfg.Topic = TopicRawBlock
+	case TopicRawBlock:
+	case TopicHashBlock:
+		if cfg.Fetcher == nil {
+			return nil, errors.New("zmq source of block hashes needs a fetcher")
+		}
+	default:
+		return nil, fmt.Errorf("unknown zmq topic %q", cfg.Topic)
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = defaultZMQBuffer
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = defaultZMQReconnect
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = lightmirror.NopLogger{}
+	}
+	return &ZMQSource{
+		cfg:       cfg,
+		address:   address,
+		blocks:    make(chan *lightmirror.BtcLightMirrorV2, cfg.Buffer),
+		lastBlock: time.Now(),
+	}, nil
+}
+
+// Blocks returns the channel of the mirrors of the blocks announced, closed
+// once the source is stopped.
+func (s *ZMQSource) Blocks() <-chan *lightmirror.BtcLightMirrorV2 {
+	return s.blocks
+}
+
+// Start connects to the node and subscribes to the topic in a new goroutine
+// until Stop is called or ctx is done.  A source can only be started once.
+func (s *ZMQSource) Start(ctx context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.started || s.stopped {
+		return lightmirror.ErrAlreadyStarted
+	}
+	s.started = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.quit, s.cancel, s.done = make(chan struct{}), cancel, make(chan struct{})
+	go func() {
+		defer close(s.done)
+		defer close(s.blocks)
+		defer cancel()
+		s.run(ctx, s.quit)
+	}()
+	return nil
+}
+
+// Stop disconnects from the node, waiting until ctx is done for the block
+// being fetched, if any, then cancelling it.  It returns once the source
+// goroutine returned and the Blocks channel is closed.
+func (s *ZMQSource) Stop(ctx context.Context) error {
+	s.mtx.Lock()
+	switch {
+	case !s.started && !s.stopped:
+		close(s.blocks)
+	case s.started && !s.stopped:
+		close(s.quit)
+	}
+	s.stopped = true
+	done, cancel := s.done, s.cancel
+	s.mtx.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	cancel()
+	<-done
+	return ctx.Err()
+}
+
+// Ping returns lightmirror.ErrNotRunning unless the source runs, and
+// ErrNotConnected while it is not connected to the node.
+func (s *ZMQSource) Ping(ctx context.Context) error {
+	s.mtx.Lock()
+	running, connected, done := s.started && !s.stopped, s.connected, s.done
+	s.mtx.Unlock()
+	if !running {
+		return lightmirror.ErrNotRunning
+	}
+	select {
+	case <-done:
+		return lightmirror.ErrNotRunning
+	default:
+	}
+	if !connected {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// LastBlockAge returns the time elapsed since the source last announced a
+// block, or since it was created if it announced none.
+func (s *ZMQSource) LastBlockAge() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return time.Since(s.lastBlock)
+}
+
+// LastError returns the last error the source met and when.
+func (s *ZMQSource) LastError() (error, time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lastErr, s.lastErrAt
+}
+
+// record records the outcome of a connection or of a notification.
+func (s *ZMQSource) record(err error) {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err != nil {
+		s.lastErr, s.lastErrAt = err, now
+		return
+	}
+	s.lastBlock = now
+}
+
+func (s *ZMQSource) setConnected(connected bool) {
+	s.mtx.Lock()
+	s.connected = connected
+	s.mtx.Unlock()
+}
+
+// run subscribes to the topic, connecting again after every failure, until
+// quit is closed or ctx is done.
+func (s *ZMQSource) run(ctx context.Context, quit <-chan struct{}) {
+	for {
+		err := s.subscribe(ctx, quit)
+		select {
+		case <-ctx.Done():
+			return
+		case <-quit:
+			return
+		default:
+		}
+		s.record(err)
+		s.cfg.Logger.Errorf("zmq %s: %v", s.cfg.Address, err)
+
+		timer := time.NewTimer(s.cfg.ReconnectInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// subscribe connects to the node and announces the blocks it publishes
+// until the connection fails, quit is closed or ctx is done.
+func (s *ZMQSource) subscribe(ctx context.Context, quit <-chan struct{}) error {
+	c, err := dialZMQ(ctx, s.address, s.cfg.Topic)
+	if err != nil {
+		return err
+	}
+	s.setConnected(true)
+	defer s.setConnected(false)
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-quit:
+		case <-closed:
+		}
+		c.conn.Close()
+	}()
+	s.cfg.Logger.Infof("zmq %s: subscribed to %s", s.cfg.Address, s.cfg.Topic)
+
+	var seq uint32
+	first := true
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if len(msg) != 3 || string(msg[0]) != s.cfg.Topic || len(msg[2]) != 4 {
+			return fmt.Errorf("malformed %s notification of %d frames",
+				s.cfg.Topic, len(msg))
+		}
+		n := binary.LittleEndian.Uint32(msg[2])
+		if !first && n != seq+1 {
+			s.cfg.Logger.Warnf("zmq %s: missed %d %s notifications",
+				s.cfg.Address, n-seq-1, s.cfg.Topic)
+		}
+		first, seq = false, n
+
+		m, err := s.mirror(ctx, msg[1])
+		s.record(err)
+		if err != nil {
+			s.cfg.Logger.Errorf("zmq %s: %v", s.cfg.Address, err)
+			continue
+		}
+		select {
+		case s.blocks <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// mirror returns the mirror of the block of the body of a notification.
+func (s *ZMQSource) mirror(ctx context.Context, body []byte) (*lightmirror.BtcLightMirrorV2, error) {
+	if s.cfg.Topic == TopicHashBlock {
+		if len(body) != chainhash.HashSize {
+			return nil, fmt.Errorf("hashblock notification of %d bytes", len(body))
+		}
+		// bitcoind publishes the hash in display order.
+		var hash chainhash.Hash
+		for i, b := range body {
+			hash[chainhash.HashSize-1-i] = b
+		}
+		return s.cfg.Fetcher.FetchByHash(ctx, hash)
+	}
+
+	var block wire.MsgBlock
+	r := bytes.NewReader(body)
+	if err := block.Deserialize(r); err != nil {
+		return nil, fmt.Errorf("rawblock notification: %w", err)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("rawblock notification: %w", lightmirror.ErrTrailingData)
+	}
+	return blockMirror(&block, s.cfg.MirrorOptions)
+}
+
+// zmqConn is a ZMTP 3.0 connection.
+type zmqConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialZMQ connects to the PUB socket at address and subscribes to topic.
+func dialZMQ(ctx context.Context, address, topic string) (*zmqConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &zmqConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(zmqHandshakeTimeout))
+	if err := c.handshake("SUB", "PUB"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	// A ZMTP 3.0 subscription is a message of a 1 byte followed by the
+	// topic.
+	if err := c.writeFrame(0, append([]byte{1}, topic...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake exchanges the greetings and the READY commands of a socket of
+// type socketType with a peer of type peerType.
+func (c *zmqConn) handshake(socketType, peerType string) error {
+	var greeting [64]byte
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10], greeting[11] = 3, 0
+	copy(greeting[12:32], "NULL")
+	if _, err := c.conn.Write(greeting[:]); err != nil {
+		return err
+	}
+	var peer [64]byte
+	if _, err := io.ReadFull(c.r, peer[:]); err != nil {
+		return fmt.Errorf("zmq greeting: %w", err)
+	}
+	if peer[0] != 0xff || peer[9] != 0x7f {
+		return errors.New("zmq greeting: peer does not speak ZMTP")
+	}
+	if peer[10] < 3 {
+		return fmt.Errorf("zmq greeting: unsupported ZMTP version %d.%d", peer[10], peer[11])
+	}
+	if mechanism := string(bytes.TrimRight(peer[12:32], "\x00")); mechanism != "NULL" {
+		return fmt.Errorf("zmq greeting: unsupported mechanism %q", mechanism)
+	}
+
+	if err := c.writeFrame(zmqFlagCommand, zmqCommand("READY", "Socket-Type", socketType)); err != nil {
+		return err
+	}
+	flags, body, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if flags&zmqFlagCommand == 0 {
+		return errors.New("zmq handshake: got a message, want READY")
+	}
+	name, props, err := parseZMQCommand(body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case name == "ERROR":
+		return fmt.Errorf("zmq handshake: peer error %q", props[""])
+	case name != "READY":
+		return fmt.Errorf("zmq handshake: got command %s, want READY", name)
+	case props["Socket-Type"] != peerType:
+		return fmt.Errorf("zmq handshake: peer socket is a %s, want a %s",
+			props["Socket-Type"], peerType)
+	}
+	return nil
+}
+
+// zmqCommand returns the body of the command name with the properties of
+// the name and value pairs of props.
+func zmqCommand(name string, props ...string) []byte {
+	body := append([]byte{byte(len(name))}, name...)
+	for i := 0; i+1 < len(props); i += 2 {
+		body = append(body, byte(len(props[i])))
+		body = append(body, props[i]...)
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(props[i+1])))
+		body = append(body, size[:]...)
+		body = append(body, props[i+1]...)
+	}
+	return body
+}
+
+// parseZMQCommand returns the name and the properties of the command body.
+// The reason of an ERROR command is returned as the property of the empty
+// name.
+func parseZMQCommand(body []byte) (string, map[string]string, error) {
+	errMalformed := errors.New("zmq handshake: malformed command")
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", nil, errMalformed
+	}
+	name, body := string(body[1:1+body[0]]), body[1+body[0]:]
+	props := make(map[string]string)
+	if name == "ERROR" {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return "", nil, errMalformed
+		}
+		props[""] = string(body[1 : 1+body[0]])
+		return name, props, nil
+	}
+	for len(body) > 0 {
+		if len(body) < 1+int(body[0])+4 {
+			return "", nil, errMalformed
+		}
+		key, rest := string(body[1:1+body[0]]), body[1+body[0]:]
+		size := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)-4) < uint64(size) {
+			return "", nil, errMalformed
+		}
+		props[key], body = string(rest[4:4+size]), rest[4+size:]
+	}
+	return name, props, nil
+}
+
+// writeFrame writes a frame of body with the given flags, setting the long
+// flag as needed.
+func (c *zmqConn) writeFrame(flags byte, body []byte) error {
+	var head []byte
+	if len(body) > 0xff {
+		head = make([]byte, 9)
+		head[0] = flags | zmqFlagLong
+		binary.BigEndian.PutUint64(head[1:], uint64(len(body)))
+	} else {
+		head = []byte{flags, byte(len(body))}
+	}
+	if _, err := c.conn.Write(append(head, body...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame reads a frame and returns its flags and its body.
+func (c *zmqConn) readFrame() (byte, []byte, error) {
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmqFlagLong != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > maxZMQFrameSize {
+		return 0, nil, fmt.Errorf("zmq frame of %d bytes exceeds the limit of %d",
+			size, maxZMQFrameSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// readMessage reads the frames of the next message, skipping the commands.
+func (c *zmqConn) readMessage() ([][]byte, error) {
+	var msg [][]byte
+	for {
+		flags, body, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmqFlagCommand != 0 {
+			continue
+		}
+		if len(msg) == maxZMQFrames {
+			return nil, fmt.Errorf("zmq message exceeds %d frames", maxZMQFrames)
+		}
+		msg = append(msg, body)
+		if flags&zmqFlagMore == 0 {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bitcoind
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// publisher is a fake ZeroMQ PUB socket of bitcoind.
+type publisher struct {
+	t     *testing.T
+	ln    net.Listener
+	topic string
+}
+
+func newPublisher(t *testing.T, topic string) *publisher {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &publisher{t: t, ln: ln, topic: topic}
+}
+
+// address returns the endpoint of the publisher in the format of bitcoind.
+func (p *publisher) address() string {
+	return "tcp://" + p.ln.Addr().String()
+}
+
+// accept accepts a subscriber as a socket of type socketType and returns
+// the connection with its subscription read.
+func (p *publisher) accept(socketType string) *zmqConn {
+	p.t.Helper()
+	conn, err := p.ln.Accept()
+	if err != nil {
+		p.t.Fatalf("Accept error %v", err)
+	}
+	p.t.Cleanup(func() { conn.Close() })
+	c := &zmqConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.handshake(socketType, "SUB"); err != nil {
+		p.t.Fatalf("handshake error %v", err)
+	}
+	if socketType != "PUB" {
+		return c
+	}
+	if _, body, err := c.readFrame(); err != nil || string(body) != "\x01"+p.topic {
+		p.t.Fatalf("subscription: got %q, error %v", body, err)
+	}
+	return c
+}
+
+// publish sends a notification of body with the sequence number seq.
+func (p *publisher) publish(c *zmqConn, body []byte, seq uint32) {
+	p.t.Helper()
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], seq)
+	for i, frame := range [][]byte{[]byte(p.topic), body, n[:]} {
+		flags := byte(zmqFlagMore)
+		if i == 2 {
+			flags = 0
+		}
+		if err := c.writeFrame(flags, frame); err != nil {
+			p.t.Fatalf("writeFrame error %v", err)
+		}
+	}
+}
+
+// receive returns the next mirror the source announces.
+func receive(t *testing.T, s *ZMQSource) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	select {
+	case m, ok := <-s.Blocks():
+		if !ok {
+			t.Fatalf("Blocks closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no block announced")
+	}
+	return nil
+}
+
+// waitFor waits for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func serialize(b *wire.MsgBlock) []byte {
+	var buf bytes.Buffer
+	b.Serialize(&buf)
+	return buf.Bytes()
+}
+
+func TestZMQSource(t *testing.T) {
+	var blocks []*wire.MsgBlock
+	var prev chainhash.Hash
+	for i := 0; i < 3; i++ {
+		b := testBlock(prev, uint32(i), 2*i)
+		blocks = append(blocks, b)
+		prev = b.BlockHash()
+	}
+	p := newPublisher(t, TopicRawBlock)
+	s, err := NewZMQSource(ZMQConfig{Address: p.address(), ReconnectInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewZMQSource error %v", err)
+	}
+	ctx := context.Background()
+	if err := s.Ping(ctx); !errors.Is(err, lightmirror.ErrNotRunning) {
+		t.Errorf("Ping before Start: got error %v, want %v", err, lightmirror.ErrNotRunning)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	defer s.Stop(ctx)
+
+	c := p.accept("PUB")
+	for i, b := range blocks[:2] {
+		p.publish(c, serialize(b), uint32(i))
+		m := receive(t, s)
+		if m.BtcHeader.BlockHash() != b.BlockHash() || m.CheckMerkle() != nil {
+			t.Errorf("Blocks #%d: got mirror %v", i, m)
+		}
+	}
+	if err := s.Ping(ctx); err != nil {
+		t.Errorf("Ping error %v", err)
+	}
+
+	// A notification which is no block is skipped.
+	p.publish(c, []byte{1, 2, 3}, 2)
+	p.publish(c, serialize(blocks[2]), 3)
+	if m := receive(t, s); m.BtcHeader.BlockHash() != blocks[2].BlockHash() {
+		t.Errorf("Blocks after a malformed notification: got mirror %v", m)
+	}
+	if err, _ := s.LastError(); err == nil {
+		t.Errorf("LastError: got nil after a malformed notification")
+	}
+
+	// The source connects again after losing its connection.
+	c.conn.Close()
+	c = p.accept("PUB")
+	p.publish(c, serialize(blocks[0]), 0)
+	if m := receive(t, s); m.BtcHeader.BlockHash() != blocks[0].BlockHash() {
+		t.Errorf("Blocks after a reconnection: got mirror %v", m)
+	}
+
+	if err := s.Stop(ctx); err != nil {
+		t.Errorf("Stop error %v", err)
+	}
+	if _, ok := <-s.Blocks(); ok {
+		t.Errorf("Blocks: not closed after Stop")
+	}
+	if err := s.Ping(ctx); !errors.Is(err, lightmirror.ErrNotRunning) {
+		t.Errorf("Ping after Stop: got error %v, want %v", err, lightmirror.ErrNotRunning)
+	}
+	if err := s.Start(ctx); !errors.Is(err, lightmirror.ErrAlreadyStarted) {
+		t.Errorf("Start after Stop: got error %v, want %v", err, lightmirror.ErrAlreadyStarted)
+	}
+}
+
+func TestZMQSourceHashBlock(t *testing.T) {
+	nd, f := newNode(t, 3)
+	p := newPublisher(t, TopicHashBlock)
+	s, err := NewZMQSource(ZMQConfig{Address: p.address(), Topic: TopicHashBlock, Fetcher: f})
+	if err != nil {
+		t.Fatalf("NewZMQSource error %v", err)
+	}
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	defer s.Stop(ctx)
+
+	c := p.accept("PUB")
+	for i, b := range nd.blocks {
+		hash := b.BlockHash()
+		display := make([]byte, chainhash.HashSize)
+		for j := range hash {
+			display[chainhash.HashSize-1-j] = hash[j]
+		}
+		p.publish(c, display, uint32(i))
+		if m := receive(t, s); m.BtcHeader.BlockHash() != hash {
+			t.Errorf("Blocks #%d: got mirror %v, want block %v", i, m, hash)
+		}
+	}
+}
+
+func TestZMQSourceErrors(t *testing.T) {
+	for _, cfg := range []ZMQConfig{
+		{Address: "ipc:///tmp/bitcoind"},
+		{Address: "tcp://localhost"},
+		{Address: "tcp://localhost:28332", Topic: "rawtx"},
+		{Address: "tcp://localhost:28332", Topic: TopicHashBlock},
+	} {
+		if _, err := NewZMQSource(cfg); err == nil {
+			t.Errorf("NewZMQSource (%+v): expected error", cfg)
+		}
+	}
+
+	s, err := NewZMQSource(ZMQConfig{Address: "127.0.0.1:28332"})
+	if err != nil {
+		t.Fatalf("NewZMQSource error %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("Stop before Start error %v", err)
+	}
+	if _, ok := <-s.Blocks(); ok {
+		t.Errorf("Blocks: not closed after Stop")
+	}
+
+	// A peer which is not a PUB socket is rejected.
+	p := newPublisher(t, TopicRawBlock)
+	s, err = NewZMQSource(ZMQConfig{Address: p.address(), ReconnectInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewZMQSource error %v", err)
+	}
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	defer s.Stop(ctx)
+	p.accept("REP")
+	waitFor(t, "the handshake error", func() bool {
+		err, _ := s.LastError()
+		return err != nil
+	})
+	if err, _ := s.LastError(); !strings.Contains(err.Error(), "REP") {
+		t.Errorf("LastError: got %v", err)
+	}
+	if err := s.Ping(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Ping: got error %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestParseZMQCommand(t *testing.T) {
+	name, props, err := parseZMQCommand(zmqCommand("READY", "Socket-Type", "PUB", "Identity", ""))
+	if err != nil || name != "READY" || len(props) != 2 || props["Socket-Type"] != "PUB" {
+		t.Errorf("parseZMQCommand: got %s %v, error %v", name, props, err)
+	}
+	name, props, err = parseZMQCommand([]byte("\x05ERROR\x06denied"))
+	if err != nil || name != "ERROR" || props[""] != "denied" {
+		t.Errorf("parseZMQCommand of an error: got %s %v, error %v", name, props, err)
+	}
+	for _, body := range []string{"", "\x05READ", "\x05READY\x0bSocket-Type\x00\x00\x00\x04PUB", "\x05ERROR"} {
+		if _, _, err := parseZMQCommand([]byte(body)); err == nil {
+			t.Errorf("parseZMQCommand (%q): expected error", body)
+		}
+	}
+}
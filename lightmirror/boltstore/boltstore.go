@@ -0,0 +1,554 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package boltstore implements lightmirror.Store on top of a single bbolt
+// database file.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// byHashBucket maps a block hash to the height followed by the
+	// serialized mirror, or by the serialized lightmirror.PrunedMirror
+	// once pruned.
+	byHashBucket = []byte("byhash")
+
+	// byHeightBucket maps a big endian height to the block hash stored
+	// there.
+	byHeightBucket = []byte("byheight")
+
+	// byCandidateBucket maps a candidate address followed by a big
+	// endian height to the hash of the block delegating to it there.
+	byCandidateBucket = []byte("bycandidate")
+
+	// candidateOfBucket maps the hash of an indexed block to its
+	// candidate address.
+	candidateOfBucket = []byte("candidateof")
+
+	// metaBucket holds the tip height under tipKey, and a set
+	// candidateIndexKey once the candidate index covers every mirror.
+	metaBucket        = []byte("meta")
+	tipKey            = []byte("tip")
+	candidateIndexKey = []byte("candidateindex")
+)
+
+// Store is a lightmirror.Store backed by a bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+var (
+	_ lightmirror.PruningStore        = (*Store)(nil)
+	_ lightmirror.CandidateIndexStore = (*Store)(nil)
+	_ lightmirror.BatchStore          = (*Store)(nil)
+)
+
+// Open opens, creating it if necessary, the bbolt database file at path.  A
+// database holding mirrors put before the candidate index existed needs
+// ReindexCandidates before BlocksByCandidate serves it.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{byHashBucket, byHeightBucket, metaBucket,
+			byCandidateBucket, candidateOfBucket} {
+
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if key, _ := tx.Bucket(byHeightBucket).Cursor().First(); key == nil {
+			return tx.Bucket(metaBucket).Put(candidateIndexKey, []byte{1})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func heightKey(height int64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], uint64(height))
+	return key[:]
+}
+
+func candidateKey(addr common.Address, height int64) []byte {
+	return append(addr.Bytes(), heightKey(height)...)
+}
+
+// Put stores the mirror at the given height.  The by-hash, by-height, tip and
+// candidate entries are all updated in one transaction.
+func (s *Store) Put(m *lightmirror.BtcLightMirrorV2, height int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, m, height)
+	})
+}
+
+// put stores the mirror at the given height in tx.
+func put(tx *bolt.Tx, m *lightmirror.BtcLightMirrorV2, height int64) error {
+	if height < 0 {
+		return fmt.Errorf("invalid height %d", height)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(heightKey(height))
+	if err := m.Serialize(&buf); err != nil {
+		return err
+	}
+	hash := m.BtcHeader.BlockHash()
+
+	byHash := tx.Bucket(byHashBucket)
+	byHeight := tx.Bucket(byHeightBucket)
+
+	// Drop whatever currently occupies the height.
+	if old := byHeight.Get(heightKey(height)); old != nil &&
+		!bytes.Equal(old, hash[:]) {
+
+		if err := unindexCandidate(tx, old, height); err != nil {
+			return err
+		}
+		if err := byHash.Delete(old); err != nil {
+			return err
+		}
+	}
+
+	// Drop the height index entry if the mirror moves to a new height.
+	if old := byHash.Get(hash[:]); len(old) >= 8 {
+		oldHeight := int64(binary.BigEndian.Uint64(old))
+		if err := unindexCandidate(tx, hash[:], oldHeight); err != nil {
+			return err
+		}
+		if oldHeight != height {
+			if err := byHeight.Delete(heightKey(oldHeight)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := byHash.Put(hash[:], buf.Bytes()); err != nil {
+		return err
+	}
+	if err := byHeight.Put(heightKey(height), hash[:]); err != nil {
+		return err
+	}
+	if addr, ok := lightmirror.IndexedCandidate(m); ok {
+		if err := indexCandidate(tx, hash[:], addr, height); err != nil {
+			return err
+		}
+	}
+	return updateTip(tx)
+}
+
+// updateTip rewrites the tip entry from the greatest key of the height index.
+func updateTip(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	key, _ := tx.Bucket(byHeightBucket).Cursor().Last()
+	if key == nil {
+		return meta.Delete(tipKey)
+	}
+	return meta.Put(tipKey, key)
+}
+
+// ByHash returns the mirror with the given block hash and its height.
+func (s *Store) ByHash(hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, int64, error) {
+	var (
+		m      *lightmirror.BtcLightMirrorV2
+		height int64
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, height, err = mirror(tx, hash[:])
+		return err
+	})
+	if err != nil {
+		return nil, height, err
+	}
+	return m, height, nil
+}
+
+// ByHeight returns the mirror stored at the given height.
+func (s *Store) ByHeight(height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	if height < 0 {
+		return nil, lightmirror.ErrNotFound
+	}
+	var m *lightmirror.BtcLightMirrorV2
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = mirrorAtHeight(tx, heightKey(height))
+		return err
+	})
+	return m, err
+}
+
+// Tip returns the mirror with the greatest height and that height.
+func (s *Store) Tip() (*lightmirror.BtcLightMirrorV2, int64, error) {
+	var (
+		m      *lightmirror.BtcLightMirrorV2
+		height int64
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(metaBucket).Get(tipKey)
+		if key == nil {
+			return lightmirror.ErrNotFound
+		}
+		if len(key) != 8 {
+			return &lightmirror.CorruptRecordError{
+				Key: append([]byte(nil), tipKey...),
+				Err: fmt.Errorf("height of %d bytes", len(key)),
+			}
+		}
+		height = int64(binary.BigEndian.Uint64(key))
+
+		var err error
+		m, err = mirrorAtHeight(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, height, err
+	}
+	return m, height, nil
+}
+
+// Delete removes the mirror with the given block hash.
+func (s *Store) Delete(hash chainhash.Hash) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteMirror(tx, hash)
+	})
+}
+
+// deleteMirror removes the mirror with the given block hash in tx.
+func deleteMirror(tx *bolt.Tx, hash chainhash.Hash) error {
+	byHash := tx.Bucket(byHashBucket)
+	value := byHash.Get(hash[:])
+	if value == nil {
+		return lightmirror.ErrNotFound
+	}
+	if len(value) < 8 {
+		return &lightmirror.CorruptRecordError{
+			Key: append([]byte(nil), hash[:]...),
+			Err: errors.New("missing height"),
+		}
+	}
+	height := heightKey(int64(binary.BigEndian.Uint64(value)))
+
+	err := unindexCandidate(tx, hash[:], int64(binary.BigEndian.Uint64(value)))
+	if err != nil {
+		return err
+	}
+	if err := byHash.Delete(hash[:]); err != nil {
+		return err
+	}
+	if err := tx.Bucket(byHeightBucket).Delete(height); err != nil {
+		return err
+	}
+	return updateTip(tx)
+}
+
+// WriteBatch deletes the mirrors with the block hashes of deletes, skipping
+// those the store does not hold, then puts the mirrors at their heights, all
+// in one transaction.
+func (s *Store) WriteBatch(deletes []chainhash.Hash, mirrors []*lightmirror.BtcLightMirrorV2, heights []int64) error {
+	if len(mirrors) != len(heights) {
+		return fmt.Errorf("%d mirrors for %d heights", len(mirrors), len(heights))
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, hash := range deletes {
+			err := deleteMirror(tx, hash)
+			if err != nil && !errors.Is(err, lightmirror.ErrNotFound) {
+				return err
+			}
+		}
+		for i, m := range mirrors {
+			if err := put(tx, m, heights[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate calls fn for every mirror stored at a height in [start, end], in
+// height order.  The scan runs in a single read transaction, which provides
+// the snapshot.  Writes needing to grow the database file wait for the scan
+// to end, so fn should not write to the store itself.
+func (s *Store) Iterate(start, end int64, fn func(height int64, m *lightmirror.BtcLightMirrorV2) error) error {
+	if start < 0 {
+		start = 0
+	}
+	if end < start {
+		return nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(byHeightBucket).Cursor()
+		for key, hash := c.Seek(heightKey(start)); key != nil; key, hash = c.Next() {
+			height := int64(binary.BigEndian.Uint64(key))
+			if height > end {
+				break
+			}
+			m, _, err := mirror(tx, hash)
+			if errors.Is(err, lightmirror.ErrPruned) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(height, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, lightmirror.ErrStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// Prune replaces the mirror with the given block hash by its header.
+func (s *Store) Prune(hash chainhash.Hash) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pruned, height, err := prunedMirror(tx, hash[:])
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		buf.Write(heightKey(height))
+		if err := pruned.Serialize(&buf); err != nil {
+			return err
+		}
+		return tx.Bucket(byHashBucket).Put(hash[:], buf.Bytes())
+	})
+}
+
+// PrunedByHeight returns the header of the mirror stored at the given height.
+func (s *Store) PrunedByHeight(height int64) (*lightmirror.PrunedMirror, error) {
+	if height < 0 {
+		return nil, lightmirror.ErrNotFound
+	}
+	var pruned *lightmirror.PrunedMirror
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(byHeightBucket).Get(heightKey(height))
+		if hash == nil {
+			return lightmirror.ErrNotFound
+		}
+		var err error
+		pruned, _, err = prunedMirror(tx, hash)
+		return err
+	})
+	return pruned, err
+}
+
+// BlocksByCandidate returns the hashes of the mirrors delegating to addr
+// stored below beforeHeight, greatest height first, at most limit of them
+// unless limit is not positive.
+func (s *Store) BlocksByCandidate(addr common.Address, limit int, beforeHeight int64) ([]chainhash.Hash, error) {
+	var hashes []chainhash.Hash
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(metaBucket).Get(candidateIndexKey) == nil {
+			return lightmirror.ErrNoCandidateIndex
+		}
+		if beforeHeight <= 0 {
+			return nil
+		}
+		prefix := addr.Bytes()
+		c := tx.Bucket(byCandidateBucket).Cursor()
+		key, value := c.Seek(candidateKey(addr, beforeHeight))
+		if key == nil {
+			key, value = c.Last()
+		} else {
+			key, value = c.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, value = c.Prev() {
+			if len(value) != chainhash.HashSize {
+				return &lightmirror.CorruptRecordError{
+					Key: append([]byte(nil), key...),
+					Err: fmt.Errorf("block hash of %d bytes", len(value)),
+				}
+			}
+			var hash chainhash.Hash
+			copy(hash[:], value)
+			hashes = append(hashes, hash)
+			if len(hashes) == limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// ReindexCandidates rebuilds the candidate index from the stored mirrors in
+// one transaction.  Pruned mirrors keep the candidate they were indexed
+// under, if any.
+func (s *Store) ReindexCandidates() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		previous := make(map[chainhash.Hash]common.Address)
+		err := tx.Bucket(candidateOfBucket).ForEach(func(hash, addr []byte) error {
+			var h chainhash.Hash
+			copy(h[:], hash)
+			previous[h] = common.BytesToAddress(addr)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{byCandidateBucket, candidateOfBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		c := tx.Bucket(byHeightBucket).Cursor()
+		for key, hash := c.First(); key != nil; key, hash = c.Next() {
+			height := int64(binary.BigEndian.Uint64(key))
+			m, _, err := mirror(tx, hash)
+			var (
+				addr common.Address
+				ok   bool
+			)
+			switch {
+			case errors.Is(err, lightmirror.ErrPruned):
+				var h chainhash.Hash
+				copy(h[:], hash)
+				addr, ok = previous[h]
+			case err != nil:
+				return err
+			default:
+				addr, ok = lightmirror.IndexedCandidate(m)
+			}
+			if !ok {
+				continue
+			}
+			if err := indexCandidate(tx, hash, addr, height); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(candidateIndexKey, []byte{1})
+	})
+}
+
+// indexCandidate adds the block hash at height to the candidate index under
+// addr.
+func indexCandidate(tx *bolt.Tx, hash []byte, addr common.Address, height int64) error {
+	if err := tx.Bucket(byCandidateBucket).Put(candidateKey(addr, height), hash); err != nil {
+		return err
+	}
+	return tx.Bucket(candidateOfBucket).Put(hash, addr.Bytes())
+}
+
+// unindexCandidate removes the block hash at height from the candidate
+// index, if it is there.
+func unindexCandidate(tx *bolt.Tx, hash []byte, height int64) error {
+	candidateOf := tx.Bucket(candidateOfBucket)
+	addr := candidateOf.Get(hash)
+	if addr == nil {
+		return nil
+	}
+	key := candidateKey(common.BytesToAddress(addr), height)
+	byCandidate := tx.Bucket(byCandidateBucket)
+	if bytes.Equal(byCandidate.Get(key), hash) {
+		if err := byCandidate.Delete(key); err != nil {
+			return err
+		}
+	}
+	return candidateOf.Delete(hash)
+}
+
+// Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func mirrorAtHeight(tx *bolt.Tx, key []byte) (*lightmirror.BtcLightMirrorV2, error) {
+	hash := tx.Bucket(byHeightBucket).Get(key)
+	if hash == nil {
+		return nil, lightmirror.ErrNotFound
+	}
+	m, _, err := mirror(tx, hash)
+	return m, err
+}
+
+// mirror decodes the by-hash record of hash.  The record is copied out of the
+// mmap by decoding it, so the result stays valid after tx ends.
+func mirror(tx *bolt.Tx, hash []byte) (*lightmirror.BtcLightMirrorV2, int64, error) {
+	value := tx.Bucket(byHashBucket).Get(hash)
+	if value == nil {
+		return nil, 0, lightmirror.ErrNotFound
+	}
+
+	key := append([]byte(nil), hash...)
+	if len(value) < 8 {
+		return nil, 0, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: errors.New("missing height"),
+		}
+	}
+	height := int64(binary.BigEndian.Uint64(value))
+	if len(value[8:]) == lightmirror.PrunedMirrorSize {
+		return nil, height, lightmirror.ErrPruned
+	}
+
+	m, err := lightmirror.DeserializeBytes(value[8:])
+	if err != nil {
+		return nil, 0, &lightmirror.CorruptRecordError{Key: key, Err: err}
+	}
+	if blockHash := m.BtcHeader.BlockHash(); !bytes.Equal(blockHash[:], hash) {
+		return nil, 0, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("record hashes to %v", blockHash),
+		}
+	}
+	return m, height, nil
+}
+
+// prunedMirror decodes the header at the start of the by-hash record of hash.
+// Both encodings of a mirror start with the 80 byte header.
+func prunedMirror(tx *bolt.Tx, hash []byte) (*lightmirror.PrunedMirror, int64, error) {
+	value := tx.Bucket(byHashBucket).Get(hash)
+	if value == nil {
+		return nil, 0, lightmirror.ErrNotFound
+	}
+
+	key := append([]byte(nil), hash...)
+	if len(value) < 8 {
+		return nil, 0, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: errors.New("missing height"),
+		}
+	}
+	height := int64(binary.BigEndian.Uint64(value))
+
+	pruned := new(lightmirror.PrunedMirror)
+	if err := pruned.Deserialize(bytes.NewReader(value[8:])); err != nil {
+		return nil, 0, &lightmirror.CorruptRecordError{Key: key, Err: err}
+	}
+	if blockHash := pruned.BtcHeader.BlockHash(); !bytes.Equal(blockHash[:], hash) {
+		return nil, 0, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("record hashes to %v", blockHash),
+		}
+	}
+	return pruned, height, nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltstore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+func open(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "mirrors.db"))
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) lightmirror.Store {
+		return open(t)
+	})
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	mirrors := storetest.Mirrors(4)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != 3 || tip.BtcHeader.BlockHash() != mirrors[3].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d, want %v at height 3",
+			tip.BtcHeader.BlockHash(), height, mirrors[3].BtcHeader.BlockHash())
+	}
+}
+
+func TestTruncatedValue(t *testing.T) {
+	s := open(t)
+	defer s.Close()
+
+	m := storetest.Mirrors(1)[0]
+	if err := s.Put(m, 0); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	hash := m.BtcHeader.BlockHash()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(byHashBucket)
+		value := append([]byte(nil), b.Get(hash[:])...)
+		return b.Put(hash[:], value[:50])
+	})
+	if err != nil {
+		t.Fatalf("Update error %v", err)
+	}
+
+	_, _, err = s.ByHash(hash)
+	var corrupt *lightmirror.CorruptRecordError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("ByHash: got error %v, want CorruptRecordError", err)
+	}
+	if string(corrupt.Key) != string(hash[:]) {
+		t.Errorf("ByHash: got key %x, want %x", corrupt.Key, hash[:])
+	}
+}
+
+// TestReindexCandidates checks that a database written before the candidate
+// index existed is served once reindexed.
+func TestReindexCandidates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	mirrors := mirrortest.GenerateChain(t, 3, mirrortest.WithPowerParams(candidate, candidate))
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// Drop the index as a database of an older version lacks it.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{byCandidateBucket, candidateOfBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Delete(candidateIndexKey)
+	})
+	if err != nil {
+		t.Fatalf("Update error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+	if _, err := s.BlocksByCandidate(candidate, 0, 10); !errors.Is(err, lightmirror.ErrNoCandidateIndex) {
+		t.Errorf("BlocksByCandidate: got error %v, want %v", err, lightmirror.ErrNoCandidateIndex)
+	}
+	if err := s.ReindexCandidates(); err != nil {
+		t.Fatalf("ReindexCandidates error %v", err)
+	}
+	hashes, err := s.BlocksByCandidate(candidate, 0, 10)
+	if err != nil || len(hashes) != 3 || hashes[0] != mirrors[2].BtcHeader.BlockHash() {
+		t.Errorf("BlocksByCandidate after ReindexCandidates: got %v, error %v", hashes, err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// GenesisMirror returns the mirror of the genesis block of the network.
+func GenesisMirror(params *chaincfg.Params) *BtcLightMirrorV2 {
+	genesis := params.GenesisBlock
+	coinBaseTx := genesis.Transactions[0]
+	transactions := make([]chainhash.Hash, 0, len(genesis.Transactions))
+	for _, tx := range genesis.Transactions {
+		transactions = append(transactions, tx.TxHash())
+	}
+	return CreateBtcLightMirrorV2(&genesis.Header, coinBaseTx, transactions)
+}
+
+// NewChainFromGenesis returns a chain of the network anchored at its genesis
+// block, at height 0.  The chain parameters are set to params, after which
+// opts are applied.
+func NewChainFromGenesis(params *chaincfg.Params, opts ...ChainOption) (*MirrorChain, error) {
+	opts = append([]ChainOption{WithChainParams(params)}, opts...)
+	return NewMirrorChain(GenesisMirror(params), 0, opts...)
+}
+
+// NewChainFromAnchor returns a chain anchored at a trusted checkpoint known
+// by its header alone, such as a block deep in the chain whose cumulative
+// work up to and including it is known.  Its parent is never required.
+//
+// The anchor has no mirror: Anchor, and Tip until a block is appended,
+// return a nil mirror, and ByHash and ByHeight return ErrPruned for it, as
+// for a pruned block.  The anchor is not written to the store of the chain.
+func NewChainFromAnchor(header wire.BlockHeader, height int64, cumulativeWork *big.Int, opts ...ChainOption) (*MirrorChain, error) {
+	if cumulativeWork == nil || cumulativeWork.Sign() <= 0 {
+		return nil, errors.New("anchor cumulative work must be positive")
+	}
+	return newChain(&chainEntry{
+		hash:   header.BlockHash(),
+		height: height,
+		header: header,
+		pruned: true,
+		work:   new(big.Int).Set(cumulativeWork),
+	}, opts)
+}
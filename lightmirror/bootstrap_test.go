@@ -0,0 +1,212 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// mainNetBlock1 returns the mirror of the first block after the main network
+// genesis block.
+func mainNetBlock1(t testing.TB) *BtcLightMirrorV2 {
+	t.Helper()
+	pkScript, err := hex.DecodeString("410496b538e853519c726a2c91e61ec11600" +
+		"ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294" +
+		"721166bf621e73a82cbf2342c858eeac")
+	if err != nil {
+		t.Fatalf("DecodeString error %v", err)
+	}
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{
+			{
+				PreviousOutPoint: wire.OutPoint{
+					Index: 0xffffffff,
+				},
+				SignatureScript: []byte{0x04, 0xff, 0xff, 0x00, 0x1d, 0x01, 0x04},
+				Sequence:        0xffffffff,
+			},
+		},
+		TxOut: []*wire.TxOut{
+			{
+				Value:    5000000000,
+				PkScript: pkScript,
+			},
+		},
+	}
+	header := &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  mainNetGenesisHash,
+		MerkleRoot: coinBaseTx.TxHash(),
+		Timestamp:  time.Unix(1231469665, 0),
+		Bits:       0x1d00ffff,
+		Nonce:      2573394689,
+	}
+	return CreateBtcLightMirrorV2(header, coinBaseTx,
+		[]chainhash.Hash{coinBaseTx.TxHash()})
+}
+
+func TestNewChainFromGenesis(t *testing.T) {
+	tests := []*chaincfg.Params{
+		&chaincfg.MainNetParams,
+		&chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams,
+		&chaincfg.SimNetParams,
+	}
+
+	for i, params := range tests {
+		c, err := NewChainFromGenesis(params)
+		if err != nil {
+			t.Errorf("NewChainFromGenesis #%d (%s) error %v", i, params.Name, err)
+			continue
+		}
+		anchor, height := c.Anchor()
+		if height != 0 || anchor.BtcHeader.BlockHash() != *params.GenesisHash {
+			t.Errorf("Anchor #%d (%s): got %v at height %d, want %v at 0", i,
+				params.Name, anchor.BtcHeader.BlockHash(), height,
+				params.GenesisHash)
+		}
+	}
+
+	// The first block of the main network validates against the genesis
+	// block, under the main network proof of work limit.
+	c, err := NewChainFromGenesis(&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("NewChainFromGenesis error %v", err)
+	}
+	bad := mainNetBlock1(t)
+	bad.BtcHeader.Nonce++
+	if _, err := c.Append(bad); err == nil {
+		t.Errorf("Append: expected proof of work error")
+	}
+	block1 := mainNetBlock1(t)
+	if _, err := c.Append(block1); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if tip, height := c.Tip(); height != 1 ||
+		tip.BtcHeader.BlockHash() != block1.BtcHeader.BlockHash() {
+
+		t.Errorf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+
+	// Options apply on top of the network parameters.
+	store := newMemStore()
+	c, err = NewChainFromGenesis(&chaincfg.RegressionNetParams, WithStore(store))
+	if err != nil {
+		t.Fatalf("NewChainFromGenesis error %v", err)
+	}
+	m := newTestMirror(*chaincfg.RegressionNetParams.GenesisHash, 1, 1)
+	if _, err := c.Append(m); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if _, height, err := store.Tip(); err != nil || height != 1 {
+		t.Errorf("store.Tip: got height %d, error %v", height, err)
+	}
+}
+
+func TestNewChainFromAnchor(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	anchor := mirrors[0].BtcHeader
+	anchorHash := anchor.BlockHash()
+	work := new(big.Int).Lsh(big.NewInt(1), 80)
+	store := newMemStore()
+
+	c, err := NewChainFromAnchor(anchor, testAnchorHeight, work,
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewChainFromAnchor error %v", err)
+	}
+	work.SetInt64(0)
+
+	if m, height := c.Anchor(); m != nil || height != testAnchorHeight {
+		t.Errorf("Anchor: got %v at height %d, want no mirror at %d", m,
+			height, testAnchorHeight)
+	}
+	if m, height := c.Tip(); m != nil || height != testAnchorHeight {
+		t.Errorf("Tip: got %v at height %d, want no mirror at %d", m, height,
+			testAnchorHeight)
+	}
+	if _, height, err := c.ByHash(anchorHash); !errors.Is(err, ErrPruned) ||
+		height != testAnchorHeight {
+
+		t.Errorf("ByHash anchor: got height %d, error %v, want %v", height,
+			err, ErrPruned)
+	}
+	if header, err := c.HeaderByHeight(testAnchorHeight); err != nil ||
+		header.BlockHash() != anchorHash {
+
+		t.Errorf("HeaderByHeight anchor: got error %v or wrong header", err)
+	}
+	if _, _, err := store.ByHash(anchorHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("store.ByHash anchor: got error %v, want %v", err, ErrNotFound)
+	}
+
+	// The first mirror must build on the anchor and pass validation.
+	orphan := newTestMirror(mirrors[1].BtcHeader.BlockHash(), 1000, 1)
+	if _, err := c.Append(orphan); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("Append orphan: got error %v, want %v", err, ErrUnknownParent)
+	}
+	bad := mirrors[1].Clone()
+	bad.BtcHeader.Bits = 0x1d00ffff
+	if _, err := c.Append(bad); err == nil {
+		t.Errorf("Append: expected proof of work error")
+	}
+	for i, m := range mirrors[1:] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i+1, err)
+		}
+	}
+	if tip, height := c.Tip(); height != testAnchorHeight+4 ||
+		tip.BtcHeader.BlockHash() != mirrors[4].BtcHeader.BlockHash() {
+
+		t.Errorf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+
+	// The anchor can not be exported, nor rolled back past.
+	if err := c.ExportSnapshot(new(bytes.Buffer)); !errors.Is(err, ErrPruned) {
+		t.Errorf("ExportSnapshot: got error %v, want %v", err, ErrPruned)
+	}
+	if _, err := c.Rollback(5); !errors.Is(err, ErrRollbackPastAnchor) {
+		t.Errorf("Rollback: got error %v, want %v", err, ErrRollbackPastAnchor)
+	}
+
+	// The stored mirrors are loaded back on top of the anchor.
+	c, err = NewChainFromAnchor(anchor, testAnchorHeight, big.NewInt(1),
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewChainFromAnchor error %v", err)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+4 {
+		t.Errorf("Tip: got height %d after reload", height)
+	}
+}
+
+func TestNewChainFromAnchorInvalid(t *testing.T) {
+	header := newTestMirrors(1)[0].BtcHeader
+	tests := []struct {
+		height int64
+		work   *big.Int
+	}{
+		{testAnchorHeight, nil},
+		{testAnchorHeight, big.NewInt(0)},
+		{testAnchorHeight, big.NewInt(-1)},
+		{-1, big.NewInt(1)},
+	}
+
+	for i, test := range tests {
+		if _, err := NewChainFromAnchor(header, test.height, test.work); err == nil {
+			t.Errorf("NewChainFromAnchor #%d: expected error", i)
+		}
+	}
+}
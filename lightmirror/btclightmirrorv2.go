@@ -5,62 +5,203 @@
 package lightmirror
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/ethereum/go-ethereum/common"
 )
 
 const (
 	powerMagicString = "CORE"
-	maxMerkleNode    = 20
+
+	// maxMerkleNode is the depth of the merkle tree of a block of
+	// maxTxPerBlock transactions, getExponent(maxTxPerBlock).  No block
+	// has a longer merkle branch.
+	maxMerkleNode = 19
+
+	// DefaultMaxTxCount is the most transactions a block holds unless
+	// DeserializeOptions.MaxTxCount says otherwise: the number of minimal
+	// transactions which fit in a Bitcoin block.
+	DefaultMaxTxCount = maxTxPerBlock
 )
 
+// ErrNotCoinbase is returned by CheckCoinbase, and the checks running it,
+// when the coinbase of a mirror is not shaped like one.
+var ErrNotCoinbase = errors.New("transaction is not a coinbase")
+
+// DeserializeOptions configures the decoding of mirrors for networks whose
+// blocks are larger than Bitcoin's.  The zero value decodes Bitcoin mirrors.
+type DeserializeOptions struct {
+	// MaxTxCount is the most transactions a block of the network holds,
+	// DefaultMaxTxCount when not positive.  The merkle branch of a decoded
+	// mirror is no deeper than the tree of a block of MaxTxCount
+	// transactions, which bounds what decoding allocates.
+	MaxTxCount int
+
+	// RejectTrailingBytes makes a decode fail with a *TrailingDataError
+	// when its input holds more than the data decoded, rather than leaving
+	// the rest unread.  It is off for the reader-based decodes, unless set,
+	// and on for DeserializeBytes.
+	RejectTrailingBytes bool
+
+	// RetainRawCoinbase keeps the bytes the coinbase was decoded from,
+	// which Serialize then writes back, so that a mirror serialized with
+	// another encoding of its coinbase, such as one with variable length
+	// integers which are not canonically encoded, is reproduced byte for
+	// byte.  Such a coinbase is only decoded with RetainRawCoinbase.  The
+	// coinbase is only scanned: CoinBaseTx is left empty until Coinbase,
+	// or a method reading the coinbase, decodes it from the bytes kept.
+	RetainRawCoinbase bool
+}
+
+// maxTxCount returns MaxTxCount, or its default.
+func (o DeserializeOptions) maxTxCount() int {
+	if o.MaxTxCount <= 0 {
+		return DefaultMaxTxCount
+	}
+	return o.MaxTxCount
+}
+
+// maxMerkleNodes returns the depth of the merkle tree of a block of
+// maxTxCount transactions, the longest merkle branch of a mirror.
+func (o DeserializeOptions) maxMerkleNodes() uint64 {
+	if o.MaxTxCount <= 0 {
+		return maxMerkleNode
+	}
+	return uint64(getExponent(o.MaxTxCount))
+}
+
 // BtcLightMirrorV2 defines information about a block and is used in the bitcoin
 // block (BtcBlock) and headers (MsgHeaders) messages.
 type BtcLightMirrorV2 struct {
 	BtcHeader wire.BlockHeader
 
+	// CoinBaseTx is the coinbase of the block.  It is empty in a mirror
+	// decoded with DeserializeOptions.RetainRawCoinbase until Coinbase
+	// decodes it.
 	CoinBaseTx wire.MsgTx
 
+	// rawCoinbase holds the serialization of the coinbase the mirror was
+	// decoded from with DeserializeOptions.RetainRawCoinbase, nil
+	// otherwise.  While coinbasePending is set, CoinBaseTx is not decoded
+	// from it yet.
+	rawCoinbase     []byte
+	coinbasePending bool
+
+	// MerkleNodes is the merkle branch of the coinbase, from the leaves
+	// up.
 	MerkleNodes []chainhash.Hash
+
+	// WitnessMerkleNodes is the merkle branch of the coinbase in the
+	// witness tree of the block, captured by New with WithWitnessBranch.
+	// It is not serialized, so decoding leaves it nil, and Equal ignores
+	// it; BtcLightMirrorV3 serializes it.
+	WitnessMerkleNodes []chainhash.Hash
 }
 
+// CreateBtcLightMirrorV2 returns the mirror of the block with the header,
+// the coinbase and the hashes of all transactions of the block, coinbase
+// first.  It panics if transactions is empty.
+//
+// The mirror owns its data: the coinbase is deep-copied, scripts and
+// witnesses included, so the caller may modify or reuse btcHeader, coinBaseTx
+// and transactions once the mirror is created.
+//
+// Deprecated: use New, which returns an error rather than panicking and
+// takes options.  CreateBtcLightMirrorV2(h, tx, txids) is
+// New(h, tx, txids, WithValidation(ValidateNone)); New validates the merkle
+// branch by default.
 func CreateBtcLightMirrorV2(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx, transactions []chainhash.Hash) *BtcLightMirrorV2 {
-
-	merkles := BuildMerkleTreeStore(&transactions[0], transactions[1:])
-
-	exponent := getExponent(len(transactions))
-	merkleNodes := make([]chainhash.Hash, 0, exponent)
-	offset := 1 << exponent
-	lastIndex := 1
-	for i := 0; i < exponent; i++ {
-		merkleNodes = append(merkleNodes, *merkles[lastIndex])
-		lastIndex += offset
-		offset >>= 1
-	}
-
-	return &BtcLightMirrorV2{
-		*btcHeader,
-		*coinBaseTx,
-		merkleNodes,
+	light, err := New(btcHeader, coinBaseTx, transactions, WithValidation(ValidateNone))
+	if err != nil {
+		panic(err)
 	}
+	return light
 }
 
 // Deserialize decodes a block header from r into the receiver using a format.
+// A decoded mirror satisfies VerifyInvariants.
 func (light *BtcLightMirrorV2) Deserialize(r io.Reader) error {
+	return light.DeserializeWith(r, DeserializeOptions{})
+}
+
+// DeserializeWith is Deserialize with the limits of opts.  A decoded mirror
+// satisfies VerifyInvariantsWith(opts).
+func (light *BtcLightMirrorV2) DeserializeWith(r io.Reader, opts DeserializeOptions) error {
 	err := light.BtcHeader.Deserialize(r)
 	if err != nil {
 		return err
 	}
+	if err := light.decodeBody(r, opts); err != nil {
+		return err
+	}
+	if err := verifyHeader(&light.BtcHeader); err != nil {
+		return err
+	}
+	if opts.RejectTrailingBytes {
+		return checkTrailing(r)
+	}
+	return nil
+}
 
-	err = light.CoinBaseTx.Deserialize(r)
-	if err != nil {
+// PeekHeader decodes the block header at the start of a serialized mirror.
+// It consumes exactly wire.MaxBlockHeaderPayload bytes of r, leaving r at
+// the body, which DecodeBody completes the mirror from.
+func PeekHeader(r io.Reader) (wire.BlockHeader, error) {
+	var header wire.BlockHeader
+	err := header.Deserialize(r)
+	return header, err
+}
+
+// DecodeBody decodes the coinbase and the merkle nodes of a serialized mirror
+// from r, positioned right after the block header, into the receiver.  With
+// the header from PeekHeader, it decodes the mirror in two steps, the same
+// or another reader being positioned at the body.  The decoded body
+// satisfies the invariants of VerifyInvariants which do not involve the
+// header.
+func (light *BtcLightMirrorV2) DecodeBody(r io.Reader) error {
+	return light.decodeBody(r, DeserializeOptions{})
+}
+
+// DeserializeProofSection decodes the proof section SerializeProofSection
+// wrote for the mirror of the given header.  The reconstructed mirror is
+// checked against the header: an error wrapping ErrBranchMismatch is
+// returned when the coinbase and the merkle nodes do not hash to its merkle
+// root.
+func DeserializeProofSection(r io.Reader, header wire.BlockHeader) (*BtcLightMirrorV2, error) {
+	light := &BtcLightMirrorV2{BtcHeader: header}
+	if err := verifyHeader(&light.BtcHeader); err != nil {
+		return nil, err
+	}
+	if err := light.DecodeBody(r); err != nil {
+		return nil, err
+	}
+	if err := light.CheckMerkle(); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrBranchMismatch)
+	}
+	return light, nil
+}
+
+// decodeBody is DecodeBody with the limits of opts.
+func (light *BtcLightMirrorV2) decodeBody(r io.Reader, opts DeserializeOptions) error {
+	light.rawCoinbase, light.coinbasePending = nil, false
+	if opts.RetainRawCoinbase {
+		raw, err := scanCoinbase(r, nil)
+		if err != nil {
+			return err
+		}
+		light.CoinBaseTx = wire.MsgTx{}
+		light.rawCoinbase, light.coinbasePending = raw, true
+	} else if err := light.CoinBaseTx.Deserialize(r); err != nil {
 		return err
 	}
 
@@ -69,12 +210,13 @@ func (light *BtcLightMirrorV2) Deserialize(r io.Reader) error {
 		return err
 	}
 
-	if merkleNodeSize > maxMerkleNode {
+	if max := opts.maxMerkleNodes(); merkleNodeSize > max {
 		return fmt.Errorf("BtcLightMirrorV2.Deserialize too many merkle node to fit "+
-			"into a block [count %d, max %d]", merkleNodeSize, maxMerkleNode)
+			"into a block [count %d, max %d]", merkleNodeSize, max)
 	}
 
-	light.MerkleNodes = make([]chainhash.Hash, merkleNodeSize, merkleNodeSize)
+	light.MerkleNodes = make([]chainhash.Hash, merkleNodeSize)
+	light.WitnessMerkleNodes = nil
 	for i := uint64(0); i < merkleNodeSize; i++ {
 		_, err := io.ReadFull(r, light.MerkleNodes[i][:])
 		if err != nil {
@@ -82,17 +224,98 @@ func (light *BtcLightMirrorV2) Deserialize(r io.Reader) error {
 		}
 	}
 
-	return nil
+	return light.verifyBody(opts)
+}
+
+// serializeBufferPool holds the buffers Serialize encodes mirrors into
+// before writing them out.
+var serializeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// SerializeSize returns the number of bytes Serialize writes for the mirror.
+func (light *BtcLightMirrorV2) SerializeSize() int {
+	return wire.MaxBlockHeaderPayload + light.coinbaseSize() +
+		wire.VarIntSerializeSize(uint64(len(light.MerkleNodes))) +
+		len(light.MerkleNodes)*chainhash.HashSize
+}
+
+// ToBytes returns the serialization of the mirror, encoded into a single
+// allocation of SerializeSize bytes.
+func (light *BtcLightMirrorV2) ToBytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, light.SerializeSize()))
+	if err := light.serialize(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // Serialize encodes a block header to w from the receiver using a format.
+// The mirror is encoded into a pooled buffer and written to w at once.
 func (light *BtcLightMirrorV2) Serialize(w io.Writer) error {
+	buf := serializeBufferPool.Get().(*bytes.Buffer)
+	defer serializeBufferPool.Put(buf)
+	buf.Reset()
+	buf.Grow(light.SerializeSize())
+
+	if err := light.serialize(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// serialize encodes the mirror to w field by field.
+func (light *BtcLightMirrorV2) serialize(w io.Writer) error {
 	err := light.BtcHeader.Serialize(w)
 	if err != nil {
 		return err
 	}
+	return light.serializeProofSection(w)
+}
 
-	err = light.CoinBaseTx.Serialize(w)
+// SerializeProofSection writes the serialization of the mirror without its
+// header: the coinbase and the merkle nodes, the bytes DecodeBody and
+// DeserializeProofSection decode.  It is meant for consumers which already
+// hold the header, such as a contract tracking the header chain.
+func (light *BtcLightMirrorV2) SerializeProofSection(w io.Writer) error {
+	buf := serializeBufferPool.Get().(*bytes.Buffer)
+	defer serializeBufferPool.Put(buf)
+	buf.Reset()
+	buf.Grow(light.ProofSectionSize())
+
+	if err := light.serializeProofSection(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ProofSectionSize returns the number of bytes SerializeProofSection writes
+// for the mirror.
+func (light *BtcLightMirrorV2) ProofSectionSize() int {
+	return light.SerializeSize() - wire.MaxBlockHeaderPayload
+}
+
+// coinbaseSize returns the size of the coinbase serialization, that of
+// RawCoinbase when it is set.
+func (light *BtcLightMirrorV2) coinbaseSize() int {
+	if raw := light.RawCoinbase(); raw != nil {
+		return len(raw)
+	}
+	return light.CoinBaseTx.SerializeSize()
+}
+
+// serializeProofSection encodes the coinbase and the merkle nodes to w.
+func (light *BtcLightMirrorV2) serializeProofSection(w io.Writer) error {
+	var err error
+	if raw := light.RawCoinbase(); raw != nil {
+		_, err = w.Write(raw)
+	} else {
+		err = light.CoinBaseTx.Serialize(w)
+	}
 	if err != nil {
 		return err
 	}
@@ -112,23 +335,153 @@ func (light *BtcLightMirrorV2) Serialize(w io.Writer) error {
 	return nil
 }
 
+// ParsePowerParams returns the power parameters ParseDelegation returns under
+// PreferOutput, or zero values when the coinbase has none, which
+// ParsePowerParamsStrict reports as an error.  ParseAllPowerParams returns
+// those of every CORE output.  blockHash is the Core block hash in its
+// canonical form, see PowerParams.
 func (light *BtcLightMirrorV2) ParsePowerParams() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash) {
-	for _, txout := range light.CoinBaseTx.TxOut[1:] {
-		pkScript := txout.PkScript
-		if len(pkScript) >= 1+1+4+1+20+20 && pkScript[0] == txscript.OP_RETURN && string(pkScript[2:6]) == powerMagicString && pkScript[6] == txscript.OP_DATA_1 {
-			candidateAddr = common.BytesToAddress(pkScript[7:27])
-			rewardAddr = common.BytesToAddress(pkScript[27:47])
-			if len(pkScript) >= 47+32 {
-				blockHash = common.BytesToHash(pkScript[47 : 47+32])
-			}
-			return
+	candidateAddr, rewardAddr, blockHash, _ = light.powerParams()
+	return
+}
+
+// powerParams returns the power parameters of the coinbase under
+// PreferOutput, and whether there are some: those of its first CORE output
+// following the first output or else of its first CORE witness item.
+func (light *BtcLightMirrorV2) powerParams() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, ok bool) {
+	d, err := light.ParseDelegation(PreferOutput)
+	if err != nil {
+		return
+	}
+	return d.Candidate, d.Reward, d.CoreBlockHash, true
+}
+
+// String returns a multi-line summary of the mirror for logs.  The number of
+// transactions of the block is the range the depth of the merkle branch
+// allows.  The CORE parameters are only shown when the coinbase has a CORE
+// output.  String does not panic on a nil or partially populated mirror.
+func (light *BtcLightMirrorV2) String() string {
+	if light == nil {
+		return "<nil>"
+	}
+	header := &light.BtcHeader
+	var b strings.Builder
+	fmt.Fprintf(&b, "hash:         %v\n", header.BlockHash())
+	fmt.Fprintf(&b, "prev:         %v\n", header.PrevBlock)
+	fmt.Fprintf(&b, "time:         %s\n", header.Timestamp.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "bits:         %08x (difficulty %s)\n", header.Bits,
+		difficulty(header.Bits))
+
+	n := len(light.MerkleNodes)
+	fmt.Fprintf(&b, "transactions: %s\n", txCountRange(n))
+	fmt.Fprintf(&b, "merkle nodes: %d\n", n)
+
+	if tx := light.Coinbase(); coinbaseComplete(tx) {
+		fmt.Fprintf(&b, "coinbase:     %v", tx.TxHash())
+	} else {
+		b.WriteString("coinbase:     incomplete")
+	}
+	if candidate, reward, _, ok := light.powerParams(); ok {
+		fmt.Fprintf(&b, "\ncandidate:    %v\nreward:       %v", candidate.Hex(),
+			reward.Hex())
+	}
+	return b.String()
+}
+
+// txCountRange returns the range of the transaction count of a block whose
+// merkle branch has n nodes.
+func txCountRange(n int) string {
+	switch {
+	case n == 0:
+		return "1"
+	case n == 1:
+		return "2"
+	case n < 63:
+		return fmt.Sprintf("%d-%d", uint64(1)<<(n-1)+1, uint64(1)<<n)
+	default:
+		return fmt.Sprintf("over 2^%d", n-1)
+	}
+}
+
+// coinbaseComplete returns whether tx has no nil input or output, so that it
+// can be serialized.
+func coinbaseComplete(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn == nil {
+			return false
 		}
 	}
-	return
+	for _, txOut := range tx.TxOut {
+		if txOut == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// difficulty returns the difficulty of the target encoded in bits, relative
+// to the target of difficulty 1 of the main network, with three decimals.
+func difficulty(bits uint32) string {
+	target := blockchain.CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return "n/a"
+	}
+	ratio := new(big.Float).SetInt(blockchain.CompactToBig(0x1d00ffff))
+	ratio.Quo(ratio, new(big.Float).SetInt(target))
+	return ratio.Text('f', 3)
+}
+
+// Coinbase returns CoinBaseTx, first decoding it from the bytes kept by
+// DeserializeOptions.RetainRawCoinbase if it is not decoded yet.  The
+// methods of the mirror read the coinbase through it; code reading
+// CoinBaseTx directly from a mirror decoded with RetainRawCoinbase calls it
+// first.  As the decode writes the mirror, the first call must not race
+// with other uses of it.
+func (light *BtcLightMirrorV2) Coinbase() *wire.MsgTx {
+	if light.coinbasePending {
+		_, canonical, err := scanTx(bytes.NewReader(light.rawCoinbase), nil, nil)
+		if err == nil {
+			err = light.CoinBaseTx.Deserialize(bytes.NewReader(canonical))
+		}
+		if err != nil {
+			// scanCoinbase accepted the bytes, and scanTx accepts
+			// nothing MsgTx.Deserialize rejects.
+			panic(fmt.Sprintf("lightmirror: retained coinbase does not decode: %v", err))
+		}
+		light.coinbasePending = false
+	}
+	return &light.CoinBaseTx
 }
 
+// RawCoinbase returns the bytes of the coinbase Serialize writes in place of
+// the serialization of CoinBaseTx: those the coinbase was decoded from with
+// DeserializeOptions.RetainRawCoinbase, as long as CoinBaseTx is not
+// modified to a transaction they do not encode.  It returns nil otherwise,
+// and for a mirror decoded without RetainRawCoinbase.
+func (light *BtcLightMirrorV2) RawCoinbase() []byte {
+	if light.rawCoinbase == nil || light.coinbasePending {
+		return light.rawCoinbase
+	}
+	_, canonical, err := scanTx(bytes.NewReader(light.rawCoinbase), nil, nil)
+	if err != nil || !coinbaseComplete(&light.CoinBaseTx) ||
+		light.CoinBaseTx.SerializeSize() != len(canonical) {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(canonical))
+	if err := light.CoinBaseTx.Serialize(&buf); err != nil || !bytes.Equal(buf.Bytes(), canonical) {
+		return nil
+	}
+	return light.rawCoinbase
+}
+
+// CheckMerkle checks that CoinBaseTx is a coinbase, by CheckCoinbase, and
+// that its merkle branch leads to the merkle root of the header.
 func (light *BtcLightMirrorV2) CheckMerkle() error {
-	coinbaseHash := light.CoinBaseTx.TxHash()
+	if err := light.CheckCoinbase(); err != nil {
+		return err
+	}
+	coinbaseHash := light.Coinbase().TxHash()
 	root := calculateMerkleRoot(&coinbaseHash, light.MerkleNodes)
 	if !light.BtcHeader.MerkleRoot.IsEqual(&root) {
 		str := fmt.Sprintf("block merkle root is invalid - block "+
@@ -139,13 +492,39 @@ func (light *BtcLightMirrorV2) CheckMerkle() error {
 	return nil
 }
 
+// CheckCoinbase checks that CoinBaseTx has the shape of a coinbase: a
+// single input, spending the null outpoint.  Otherwise the merkle branch of
+// the mirror would prove an ordinary transaction of the block, which the
+// mirror would pass for its coinbase.  The sequence of the input is not
+// checked, as consensus lets a coinbase carry any.  The errors wrap
+// ErrNotCoinbase.
+func (light *BtcLightMirrorV2) CheckCoinbase() error {
+	tx := light.Coinbase()
+	if len(tx.TxIn) != 1 {
+		return fmt.Errorf("coinbase has %d inputs: %w", len(tx.TxIn), ErrNotCoinbase)
+	}
+	if tx.TxIn[0] == nil {
+		return fmt.Errorf("coinbase has a nil input: %w", ErrNotCoinbase)
+	}
+	prevOut := &tx.TxIn[0].PreviousOutPoint
+	if prevOut.Index != wire.MaxPrevOutIndex || prevOut.Hash != (chainhash.Hash{}) {
+		return fmt.Errorf("coinbase spends %v, not the null outpoint: %w", prevOut, ErrNotCoinbase)
+	}
+	return nil
+}
+
+// calculateMerkleRoot returns the root of the merkle branch from the
+// coinbase, the leftmost leaf, through merkleNodes.  It gives the result of
+// chaining blockchain.HashMerkleBranches without allocating per level.
 func calculateMerkleRoot(coinbaseHash *chainhash.Hash, merkleNodes []chainhash.Hash) chainhash.Hash {
-	res := coinbaseHash
-	for _, node := range merkleNodes {
-		branches := blockchain.HashMerkleBranches(res, &node)
-		res = &branches
+	var scratch [chainhash.HashSize * 2]byte
+	res := *coinbaseHash
+	for i := range merkleNodes {
+		copy(scratch[:chainhash.HashSize], res[:])
+		copy(scratch[chainhash.HashSize:], merkleNodes[i][:])
+		res = chainhash.DoubleHashH(scratch[:])
 	}
-	return *res
+	return res
 }
 
 func getExponent(v int) int {
@@ -154,3 +533,28 @@ func getExponent(v int) int {
 	}
 	return res
 }
+
+// Clone returns a deep copy of the mirror, which shares no memory with it:
+// the header, the coinbase with its inputs, outputs, scripts and witnesses,
+// its raw bytes, and the merkle nodes, witness branch included, are all
+// copied.  A value copy of a BtcLightMirrorV2 shares the inputs and outputs
+// of the coinbase instead.  A coinbase not decoded yet is left so.
+func (light *BtcLightMirrorV2) Clone() *BtcLightMirrorV2 {
+	res := &BtcLightMirrorV2{
+		BtcHeader:       light.BtcHeader,
+		CoinBaseTx:      *light.CoinBaseTx.Copy(),
+		coinbasePending: light.coinbasePending,
+	}
+	if light.rawCoinbase != nil {
+		res.rawCoinbase = append([]byte{}, light.rawCoinbase...)
+	}
+	if light.MerkleNodes != nil {
+		res.MerkleNodes = make([]chainhash.Hash, len(light.MerkleNodes))
+		copy(res.MerkleNodes, light.MerkleNodes)
+	}
+	if light.WitnessMerkleNodes != nil {
+		res.WitnessMerkleNodes = make([]chainhash.Hash, len(light.WitnessMerkleNodes))
+		copy(res.WitnessMerkleNodes, light.WitnessMerkleNodes)
+	}
+	return res
+}
@@ -6,9 +6,13 @@ package lightmirror
 
 import (
 	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ethereum/go-ethereum/common"
+	"io"
 	"reflect"
 	"testing"
 	"time"
@@ -171,3 +175,396 @@ func TestBtcLightMirrorV2Serialize(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateBtcLightMirrorV2Ownership(t *testing.T) {
+	coinBaseTx := &wire.MsgTx{
+		Version: 2,
+		TxIn: []*wire.TxIn{
+			{
+				PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+				SignatureScript:  []byte{0x03, 0x01, 0x02, 0x03},
+				Witness:          wire.TxWitness{make([]byte, 32)},
+				Sequence:         0xffffffff,
+			},
+		},
+		TxOut: []*wire.TxOut{
+			{Value: 5000000000, PkScript: []byte{0x51}},
+		},
+	}
+	transactions := []chainhash.Hash{coinBaseTx.TxHash(), {0x01}, {0x02}}
+	merkles := BuildMerkleTreeStore(&transactions[0], transactions[1:])
+	header := &wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1231006505, 0),
+		Bits:       0x207fffff,
+	}
+
+	m := CreateBtcLightMirrorV2(header, coinBaseTx, transactions)
+	want, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+
+	// The mirror does not change with the arguments it was created from.
+	header.Nonce++
+	coinBaseTx.TxIn[0].SignatureScript[1] = 0xff
+	coinBaseTx.TxIn[0].Witness[0][0] = 0xff
+	coinBaseTx.TxIn[0].Sequence = 0
+	coinBaseTx.TxOut[0].Value = 0
+	coinBaseTx.TxOut[0].PkScript[0] = 0x00
+	coinBaseTx.TxOut = append(coinBaseTx.TxOut, &wire.TxOut{})
+	transactions[1][0] = 0xff
+
+	got, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("mirror changed with its coinbase: got %x, want %x", got, want)
+	}
+	if err := m.CheckMerkle(); err != nil {
+		t.Errorf("CheckMerkle error %v", err)
+	}
+	if m.CoinBaseTx.TxIn[0] == coinBaseTx.TxIn[0] ||
+		m.CoinBaseTx.TxOut[0] == coinBaseTx.TxOut[0] {
+		t.Errorf("mirror shares its inputs and outputs with the coinbase")
+	}
+}
+
+func TestPeekHeaderDecodeBody(t *testing.T) {
+	for i, m := range decoderMirrors() {
+		data, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes #%d error %v", i, err)
+		}
+		var want BtcLightMirrorV2
+		if err := want.Deserialize(bytes.NewReader(data)); err != nil {
+			t.Fatalf("Deserialize #%d error %v", i, err)
+		}
+
+		// From the same reader.
+		r := bytes.NewReader(data)
+		header, err := PeekHeader(r)
+		if err != nil {
+			t.Fatalf("PeekHeader #%d error %v", i, err)
+		}
+		if r.Len() != len(data)-wire.MaxBlockHeaderPayload {
+			t.Errorf("PeekHeader #%d: %d bytes left, want %d", i, r.Len(),
+				len(data)-wire.MaxBlockHeaderPayload)
+		}
+		got := BtcLightMirrorV2{BtcHeader: header}
+		if err := got.DecodeBody(r); err != nil {
+			t.Fatalf("DecodeBody #%d error %v", i, err)
+		}
+		if !reflect.DeepEqual(&got, &want) {
+			t.Errorf("two-step decode #%d: got %v, want %v", i,
+				spew.Sdump(&got), spew.Sdump(&want))
+		}
+
+		// From a reader re-opened at the body.
+		reopened := BtcLightMirrorV2{BtcHeader: header}
+		if err := reopened.DecodeBody(bytes.NewReader(data[wire.MaxBlockHeaderPayload:])); err != nil {
+			t.Fatalf("DecodeBody #%d error %v", i, err)
+		}
+		if !reflect.DeepEqual(&reopened, &want) {
+			t.Errorf("two-step decode #%d from a re-opened reader: got %v, "+
+				"want %v", i, spew.Sdump(&reopened), spew.Sdump(&want))
+		}
+	}
+
+	if _, err := PeekHeader(bytes.NewReader(make([]byte, 79))); err == nil {
+		t.Errorf("PeekHeader: expected error for a short header")
+	}
+}
+
+func TestProofSection(t *testing.T) {
+	for i, extraTxs := range []int{0, 1, 6} {
+		m := newTestMirror(chainhash.Hash{}, uint32(i+1), extraTxs)
+		var buf bytes.Buffer
+		if err := m.SerializeProofSection(&buf); err != nil {
+			t.Fatalf("SerializeProofSection #%d error %v", i, err)
+		}
+		data, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes #%d error %v", i, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[wire.MaxBlockHeaderPayload:]) || buf.Len() != m.ProofSectionSize() {
+			t.Errorf("SerializeProofSection #%d: got %x, want %x", i, buf.Bytes(),
+				data[wire.MaxBlockHeaderPayload:])
+		}
+
+		got, err := DeserializeProofSection(bytes.NewReader(buf.Bytes()), m.BtcHeader)
+		if err != nil {
+			t.Fatalf("DeserializeProofSection #%d error %v", i, err)
+		}
+		if !got.Equal(m) {
+			t.Errorf("DeserializeProofSection #%d: got %v, want %v", i, got, m)
+		}
+
+		// The section of a mirror does not match the header of another.
+		other := newTestMirror(chainhash.Hash{}, uint32(i+100), extraTxs)
+		_, err = DeserializeProofSection(bytes.NewReader(buf.Bytes()), other.BtcHeader)
+		if !errors.Is(err, ErrBranchMismatch) {
+			t.Errorf("DeserializeProofSection #%d: got error %v, want %v", i, err, ErrBranchMismatch)
+		}
+		if _, err := DeserializeProofSection(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), m.BtcHeader); err == nil {
+			t.Errorf("DeserializeProofSection #%d: expected error for a truncated section", i)
+		}
+	}
+}
+
+func TestBtcLightMirrorV2String(t *testing.T) {
+	core := mainNetBlock1(t)
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	core.CoinBaseTx.TxOut = append(core.CoinBaseTx.TxOut,
+		&wire.TxOut{PkScript: corePkScript(candidate, reward, nil)})
+	core.MerkleNodes = make([]chainhash.Hash, 3)
+
+	partial := &BtcLightMirrorV2{}
+	partial.CoinBaseTx.TxIn = []*wire.TxIn{nil}
+	partial.CoinBaseTx.TxOut = []*wire.TxOut{nil, nil}
+
+	tests := []struct {
+		name   string
+		mirror *BtcLightMirrorV2
+		want   string
+	}{
+		{"main network block 1", mainNetBlock1(t), "" +
+			"hash:         00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048\n" +
+			"prev:         000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f\n" +
+			"time:         2009-01-09T02:54:25Z\n" +
+			"bits:         1d00ffff (difficulty 1.000)\n" +
+			"transactions: 1\n" +
+			"merkle nodes: 0\n" +
+			"coinbase:     0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"},
+		{"CORE output", core, "" +
+			"hash:         00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048\n" +
+			"prev:         000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f\n" +
+			"time:         2009-01-09T02:54:25Z\n" +
+			"bits:         1d00ffff (difficulty 1.000)\n" +
+			"transactions: 5-8\n" +
+			"merkle nodes: 3\n" +
+			"coinbase:     " + core.CoinBaseTx.TxHash().String() + "\n" +
+			"candidate:    0x5B38Da6a701c568545dCfcB03FcB875f56beddC4\n" +
+			"reward:       0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2"},
+		{"zero value", &BtcLightMirrorV2{}, "" +
+			"hash:         64f0387fc6daa6555c013e1e78c775f75b51149d948d0f681554705b791116ce\n" +
+			"prev:         0000000000000000000000000000000000000000000000000000000000000000\n" +
+			"time:         0001-01-01T00:00:00Z\n" +
+			"bits:         00000000 (difficulty n/a)\n" +
+			"transactions: 1\n" +
+			"merkle nodes: 0\n" +
+			"coinbase:     f702453dd03b0f055e5437d76128141803984fb10acb85fc3b2184fae2f3fa78"},
+		{"nil inputs and outputs", partial, "" +
+			"hash:         64f0387fc6daa6555c013e1e78c775f75b51149d948d0f681554705b791116ce\n" +
+			"prev:         0000000000000000000000000000000000000000000000000000000000000000\n" +
+			"time:         0001-01-01T00:00:00Z\n" +
+			"bits:         00000000 (difficulty n/a)\n" +
+			"transactions: 1\n" +
+			"merkle nodes: 0\n" +
+			"coinbase:     incomplete"},
+		{"nil", nil, "<nil>"},
+	}
+	for _, test := range tests {
+		if got := test.mirror.String(); got != test.want {
+			t.Errorf("String (%s): got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBtcLightMirrorV2Clone(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{0x01}, 1, 5)
+	m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32), {0x01, 0x02}}
+	m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut,
+		&wire.TxOut{Value: 1, PkScript: []byte{0x6a, 0x01, 0x02}})
+	want, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+
+	clone := m.Clone()
+	got, err := clone.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Clone: got %x, want %x", got, want)
+	}
+
+	clone.BtcHeader.Version++
+	clone.BtcHeader.PrevBlock[0] ^= 0xff
+	clone.BtcHeader.MerkleRoot[0] ^= 0xff
+	clone.BtcHeader.Timestamp = clone.BtcHeader.Timestamp.Add(time.Second)
+	clone.BtcHeader.Bits++
+	clone.BtcHeader.Nonce++
+	clone.CoinBaseTx.Version++
+	clone.CoinBaseTx.LockTime++
+	txIn := clone.CoinBaseTx.TxIn[0]
+	txIn.PreviousOutPoint.Hash[0] ^= 0xff
+	txIn.PreviousOutPoint.Index++
+	txIn.SignatureScript[0] ^= 0xff
+	txIn.Witness[0][0] ^= 0xff
+	txIn.Witness[1][1] ^= 0xff
+	txIn.Witness = append(txIn.Witness, []byte{0x03})
+	txIn.Sequence++
+	for _, txOut := range clone.CoinBaseTx.TxOut {
+		txOut.Value++
+		txOut.PkScript[0] ^= 0xff
+	}
+	clone.CoinBaseTx.TxIn = append(clone.CoinBaseTx.TxIn, &wire.TxIn{})
+	clone.CoinBaseTx.TxOut = append(clone.CoinBaseTx.TxOut, &wire.TxOut{})
+	for i := range clone.MerkleNodes {
+		clone.MerkleNodes[i][0] ^= 0xff
+	}
+	clone.MerkleNodes = append(clone.MerkleNodes, chainhash.Hash{})
+
+	got, err = m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("original changed with its clone: got %x, want %x", got, want)
+	}
+}
+
+func TestBtcLightMirrorV2ToBytes(t *testing.T) {
+	tests := []*BtcLightMirrorV2{
+		newTestMirror(chainhash.Hash{}, 1, 0),
+		newTestMirror(chainhash.Hash{}, 2, 1),
+		newTestMirror(chainhash.Hash{}, 3, 300),
+	}
+	for i, m := range tests {
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil {
+			t.Errorf("Serialize #%d error %v", i, err)
+			continue
+		}
+		b, err := m.ToBytes()
+		if err != nil {
+			t.Errorf("ToBytes #%d error %v", i, err)
+			continue
+		}
+		if !bytes.Equal(b, buf.Bytes()) {
+			t.Errorf("ToBytes #%d: got %x, want %x", i, b, buf.Bytes())
+		}
+		if size := m.SerializeSize(); size != len(b) || cap(b) != size {
+			t.Errorf("SerializeSize #%d: got %d, want %d (cap %d)", i, size,
+				len(b), cap(b))
+		}
+	}
+}
+
+// BenchmarkSerialize compares encoding a mirror field by field into a
+// growing buffer with Serialize and ToBytes.
+func BenchmarkSerialize(b *testing.B) {
+	m := newTestMirror(chainhash.Hash{}, 1, 1000)
+
+	b.Run("fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := m.serialize(&buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Serialize", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := m.Serialize(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ToBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.ToBytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCheckCoinbase(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(tx *wire.MsgTx)
+		valid  bool
+	}{
+		{"coinbase", func(tx *wire.MsgTx) {}, true},
+		{"any sequence", func(tx *wire.MsgTx) { tx.TxIn[0].Sequence = 0 }, true},
+		{"no input", func(tx *wire.MsgTx) { tx.TxIn = nil }, false},
+		{"two inputs", func(tx *wire.MsgTx) { tx.TxIn = append(tx.TxIn, tx.TxIn[0]) }, false},
+		{"nil input", func(tx *wire.MsgTx) { tx.TxIn[0] = nil }, false},
+		{"output index", func(tx *wire.MsgTx) { tx.TxIn[0].PreviousOutPoint.Index = 0 }, false},
+		{"output hash", func(tx *wire.MsgTx) { tx.TxIn[0].PreviousOutPoint.Hash[31] = 1 }, false},
+	}
+	for _, test := range tests {
+		m := newTestMirror(chainhash.Hash{}, 1, 3)
+		test.modify(&m.CoinBaseTx)
+		err := m.CheckCoinbase()
+		if test.valid && err != nil {
+			t.Errorf("CheckCoinbase (%s) error %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrNotCoinbase) {
+			t.Errorf("CheckCoinbase (%s): got error %v, want %v", test.name, err, ErrNotCoinbase)
+		}
+	}
+
+	// A mirror proving an ordinary transaction of its block, under a
+	// merkle root matching its branch, fails CheckMerkle.
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	m.CoinBaseTx.TxIn[0].PreviousOutPoint = wire.OutPoint{Hash: chainhash.Hash{1}}
+	txid := m.CoinBaseTx.TxHash()
+	m.BtcHeader.MerkleRoot = calculateMerkleRoot(&txid, m.MerkleNodes)
+	if err := m.CheckMerkle(); !errors.Is(err, ErrNotCoinbase) {
+		t.Errorf("CheckMerkle of an ordinary transaction: got error %v, want %v", err, ErrNotCoinbase)
+	}
+}
+
+// BenchmarkCheckMerkle checks the merkle branch of a mirror of a block with
+// four thousand transactions.
+func BenchmarkCheckMerkle(b *testing.B) {
+	m := newTestMirror(chainhash.Hash{}, 1, 4000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.CheckMerkle(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// branchMerkleRoot is the reference calculateMerkleRoot, chaining
+// blockchain.HashMerkleBranches.
+func branchMerkleRoot(coinbaseHash *chainhash.Hash, merkleNodes []chainhash.Hash) chainhash.Hash {
+	res := coinbaseHash
+	for _, node := range merkleNodes {
+		branches := blockchain.HashMerkleBranches(res, &node)
+		res = &branches
+	}
+	return *res
+}
+
+func FuzzCalculateMerkleRoot(f *testing.F) {
+	f.Add([]byte{}, []byte{})
+	f.Add(make([]byte, chainhash.HashSize), make([]byte, 3*chainhash.HashSize))
+	f.Add([]byte{0x01, 0x02}, bytes.Repeat([]byte{0xab}, 12*chainhash.HashSize+5))
+	f.Fuzz(func(t *testing.T, coinbase []byte, nodes []byte) {
+		coinbaseHash := chainhash.DoubleHashH(coinbase)
+		var merkleNodes []chainhash.Hash
+		for ; len(nodes) >= chainhash.HashSize; nodes = nodes[chainhash.HashSize:] {
+			var node chainhash.Hash
+			copy(node[:], nodes)
+			merkleNodes = append(merkleNodes, node)
+		}
+
+		got := calculateMerkleRoot(&coinbaseHash, merkleNodes)
+		want := branchMerkleRoot(&coinbaseHash, merkleNodes)
+		if got != want {
+			t.Errorf("calculateMerkleRoot: got %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BtcLightMirrorV3 is a mirror which also proves the witness data of the
+// block: it serializes, after the fields of a BtcLightMirrorV2, the merkle
+// branch of the coinbase in the witness tree of the block, WitnessMerkleNodes.
+// With the witness nonce of the coinbase, the branch gives the witness root
+// the coinbase commits to in its witness commitment output, which
+// CheckWitnessCommitment verifies.
+//
+// The serialization starts with that of the BtcLightMirrorV2 of the same
+// block: the V2 decoders read a V3 mirror as its V2 mirror followed by
+// trailing bytes, which only RejectTrailingBytes refuses.  The methods of
+// BtcLightMirrorV2 which serialize the mirror, such as MirrorHash or
+// SerializeProofSection, are those of the V2 mirror.
+type BtcLightMirrorV3 struct {
+	BtcLightMirrorV2
+}
+
+// NewV3 returns the V3 mirror of the block with the header, the coinbase,
+// and the hashes and witness hashes of all transactions of the block,
+// coinbase first, as New does with WithWitnessBranch(wtxids).  ValidateFull
+// checks the witness commitment of the coinbase.
+func NewV3(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx, txids, wtxids []chainhash.Hash, opts ...MirrorOption) (*BtcLightMirrorV3, error) {
+	opts = append(opts[:len(opts):len(opts)], WithWitnessBranch(wtxids))
+	light, err := New(btcHeader, coinBaseTx, txids, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &BtcLightMirrorV3{BtcLightMirrorV2: *light}, nil
+}
+
+// Deserialize decodes a V3 mirror from r into the receiver.  A decoded
+// mirror satisfies VerifyInvariants, and has a witness branch as deep as
+// its merkle branch.
+func (light *BtcLightMirrorV3) Deserialize(r io.Reader) error {
+	return light.DeserializeWith(r, DeserializeOptions{})
+}
+
+// DeserializeWith is Deserialize with the limits of opts.
+func (light *BtcLightMirrorV3) DeserializeWith(r io.Reader, opts DeserializeOptions) error {
+	if err := light.BtcHeader.Deserialize(r); err != nil {
+		return err
+	}
+	if err := light.decodeBody(r, opts); err != nil {
+		return err
+	}
+
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if n := uint64(len(light.MerkleNodes)); count != n {
+		return fmt.Errorf("witness branch of %d nodes for a merkle branch of "+
+			"%d: %w", count, n, ErrInvalidMirror)
+	}
+	light.WitnessMerkleNodes = make([]chainhash.Hash, count)
+	for i := range light.WitnessMerkleNodes {
+		if _, err := io.ReadFull(r, light.WitnessMerkleNodes[i][:]); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyHeader(&light.BtcHeader); err != nil {
+		return err
+	}
+	if opts.RejectTrailingBytes {
+		return checkTrailing(r)
+	}
+	return nil
+}
+
+// SerializeSize returns the number of bytes Serialize writes for the mirror.
+func (light *BtcLightMirrorV3) SerializeSize() int {
+	return light.BtcLightMirrorV2.SerializeSize() +
+		wire.VarIntSerializeSize(uint64(len(light.WitnessMerkleNodes))) +
+		len(light.WitnessMerkleNodes)*chainhash.HashSize
+}
+
+// Serialize encodes the mirror to w, the serialization of its V2 mirror
+// followed by the witness branch.
+func (light *BtcLightMirrorV3) Serialize(w io.Writer) error {
+	buf := serializeBufferPool.Get().(*bytes.Buffer)
+	defer serializeBufferPool.Put(buf)
+	buf.Reset()
+	buf.Grow(light.SerializeSize())
+
+	if err := light.serialize(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ToBytes returns the serialization of the mirror, encoded into a single
+// allocation of SerializeSize bytes.
+func (light *BtcLightMirrorV3) ToBytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, light.SerializeSize()))
+	if err := light.serialize(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serialize encodes the mirror to w field by field.
+func (light *BtcLightMirrorV3) serialize(w io.Writer) error {
+	if err := light.BtcLightMirrorV2.serialize(w); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(light.WitnessMerkleNodes))); err != nil {
+		return err
+	}
+	for i := range light.WitnessMerkleNodes {
+		if _, err := w.Write(light.WitnessMerkleNodes[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WitnessRoot returns the witness root of the block the witness branch
+// proves, the root of the witness tree whose coinbase leaf is the zero hash.
+func (light *BtcLightMirrorV3) WitnessRoot() chainhash.Hash {
+	return calculateMerkleRoot(&chainhash.Hash{}, light.WitnessMerkleNodes)
+}
+
+// CheckWitnessCommitment checks the witness branch against the witness
+// commitment of the coinbase: the last output of the coinbase committing to
+// a witness root must hold the hash of WitnessRoot and of the witness nonce,
+// the only item of the witness of the coinbase input.  The errors wrap
+// ErrWitnessCommitment; the coinbase of a block without segregated witness
+// has no commitment.
+func (light *BtcLightMirrorV3) CheckWitnessCommitment() error {
+	if len(light.WitnessMerkleNodes) != len(light.MerkleNodes) {
+		return fmt.Errorf("witness branch of %d nodes for a merkle branch of "+
+			"%d: %w", len(light.WitnessMerkleNodes), len(light.MerkleNodes),
+			ErrWitnessCommitment)
+	}
+	if tx := light.Coinbase(); len(tx.TxIn) == 0 || tx.TxIn[0] == nil {
+		return fmt.Errorf("coinbase has no input: %w", ErrWitnessCommitment)
+	}
+	return light.checkWitnessCommitment()
+}
+
+// Validate runs the checks of BtcLightMirrorV2.Validate on the mirror, then
+// CheckWitnessCommitment.
+func (light *BtcLightMirrorV3) Validate(params *chaincfg.Params) error {
+	if err := light.BtcLightMirrorV2.Validate(params); err != nil {
+		return err
+	}
+	return light.CheckWitnessCommitment()
+}
+
+// Clone returns a deep copy of the mirror.
+func (light *BtcLightMirrorV3) Clone() *BtcLightMirrorV3 {
+	return &BtcLightMirrorV3{BtcLightMirrorV2: *light.BtcLightMirrorV2.Clone()}
+}
+
+// Equal returns whether the mirror and other are equal as V2 mirrors, and
+// have the same witness branch, nil and empty ones being equal.
+func (light *BtcLightMirrorV3) Equal(other *BtcLightMirrorV3) bool {
+	if light == nil || other == nil {
+		return light == other
+	}
+	if !light.BtcLightMirrorV2.Equal(&other.BtcLightMirrorV2) ||
+		len(light.WitnessMerkleNodes) != len(other.WitnessMerkleNodes) {
+		return false
+	}
+	for i := range light.WitnessMerkleNodes {
+		if light.WitnessMerkleNodes[i] != other.WitnessMerkleNodes[i] {
+			return false
+		}
+	}
+	return true
+}
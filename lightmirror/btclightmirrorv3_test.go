@@ -0,0 +1,132 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestBtcLightMirrorV3(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 16, 33} {
+		header, coinBaseTx, txids, wtxids := newTestBlock(n)
+		m, err := NewV3(header, coinBaseTx, txids, wtxids, WithValidation(ValidateFull))
+		if err != nil {
+			t.Fatalf("NewV3 #%d error %v", n, err)
+		}
+		if err := m.CheckWitnessCommitment(); err != nil {
+			t.Errorf("CheckWitnessCommitment #%d error %v", n, err)
+		}
+		merkles := BuildMerkleTreeStore(&chainhash.Hash{}, wtxids[1:])
+		if root := m.WitnessRoot(); root != *merkles[len(merkles)-1] {
+			t.Errorf("WitnessRoot #%d: got %v, want %v", n, root, merkles[len(merkles)-1])
+		}
+
+		b, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes #%d error %v", n, err)
+		}
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil || !bytes.Equal(buf.Bytes(), b) ||
+			len(b) != m.SerializeSize() {
+			t.Errorf("Serialize #%d: got %d bytes, error %v, want the %d of ToBytes",
+				n, buf.Len(), err, len(b))
+		}
+		var decoded BtcLightMirrorV3
+		err = decoded.DeserializeWith(bytes.NewReader(b), DeserializeOptions{RejectTrailingBytes: true})
+		if err != nil || !decoded.Equal(m) {
+			t.Fatalf("Deserialize #%d: got error %v, diff %v", n, err, decoded.Diff(&m.BtcLightMirrorV2))
+		}
+		if err := decoded.CheckWitnessCommitment(); err != nil {
+			t.Errorf("CheckWitnessCommitment #%d of the decoded mirror error %v", n, err)
+		}
+
+		// A V2 decoder reads the V2 mirror, the witness branch trailing.
+		v2, err := m.BtcLightMirrorV2.ToBytes()
+		if err != nil || !bytes.HasPrefix(b, v2) {
+			t.Errorf("ToBytes #%d: the V2 serialization is not a prefix", n)
+		}
+		var old BtcLightMirrorV2
+		if err := old.Deserialize(bytes.NewReader(b)); err != nil || !old.Equal(&m.BtcLightMirrorV2) {
+			t.Errorf("BtcLightMirrorV2.Deserialize #%d error %v", n, err)
+		}
+	}
+}
+
+func TestBtcLightMirrorV3WitnessCommitment(t *testing.T) {
+	header, coinBaseTx, txids, wtxids := newTestBlock(5)
+	for checkProofOfWork(header, chaincfg.RegressionNetParams.PowLimit, nil) != nil {
+		header.Nonce++
+	}
+	m, err := NewV3(header, coinBaseTx, txids, wtxids)
+	if err != nil {
+		t.Fatalf("NewV3 error %v", err)
+	}
+	if err := m.Validate(&chaincfg.RegressionNetParams); err != nil {
+		t.Errorf("Validate error %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(m *BtcLightMirrorV3)
+	}{
+		{"witness node", func(m *BtcLightMirrorV3) {
+			m.WitnessMerkleNodes[1][0] ^= 1
+		}},
+		{"short witness branch", func(m *BtcLightMirrorV3) {
+			m.WitnessMerkleNodes = m.WitnessMerkleNodes[1:]
+		}},
+		{"witness nonce", func(m *BtcLightMirrorV3) {
+			m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+		}},
+		{"stripped witness", func(m *BtcLightMirrorV3) {
+			m.CoinBaseTx.TxIn[0].Witness = nil
+		}},
+		{"commitment", func(m *BtcLightMirrorV3) {
+			m.CoinBaseTx.TxOut[1].PkScript[len(witnessCommitmentHeader)] ^= 1
+		}},
+		{"no commitment", func(m *BtcLightMirrorV3) {
+			m.CoinBaseTx.TxOut = m.CoinBaseTx.TxOut[:1]
+		}},
+		{"no input", func(m *BtcLightMirrorV3) {
+			m.CoinBaseTx.TxIn = nil
+		}},
+	}
+	for _, test := range tests {
+		bad := m.Clone()
+		test.modify(bad)
+		if err := bad.CheckWitnessCommitment(); !errors.Is(err, ErrWitnessCommitment) {
+			t.Errorf("CheckWitnessCommitment (%s): got error %v, want %v", test.name,
+				err, ErrWitnessCommitment)
+		}
+		if err := bad.Validate(&chaincfg.RegressionNetParams); err == nil {
+			t.Errorf("Validate (%s): expected error", test.name)
+		}
+		if bad.Equal(m) {
+			t.Errorf("Equal (%s): got equal mirrors", test.name)
+		}
+	}
+	if !m.Clone().Equal(m) || m.Equal(nil) {
+		t.Errorf("Equal: got a mismatch")
+	}
+
+	// The decoder requires a witness branch as deep as the merkle branch.
+	short := m.Clone()
+	short.WitnessMerkleNodes = short.WitnessMerkleNodes[1:]
+	b, _ := short.ToBytes()
+	var decoded BtcLightMirrorV3
+	if err := decoded.Deserialize(bytes.NewReader(b)); !errors.Is(err, ErrInvalidMirror) {
+		t.Errorf("Deserialize: got error %v, want %v", err, ErrInvalidMirror)
+	}
+	b, _ = m.ToBytes()
+	if err := decoded.Deserialize(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Errorf("Deserialize of a truncated mirror: expected error")
+	}
+}
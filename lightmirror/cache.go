@@ -0,0 +1,433 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CacheStats reports the lookups served by a cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// cacheEntry is the value of an element of mirrorCache.lru.  height is -1
+// when the height of the mirror is not known.
+type cacheEntry struct {
+	hash   chainhash.Hash
+	height int64
+	mirror *BtcLightMirrorV2
+}
+
+// mirrorCache is a fixed size LRU cache of decoded mirrors keyed by block
+// hash.  The cached mirrors are never handed out: add stores a copy and get
+// returns one, so callers can not alter the cache content.
+type mirrorCache struct {
+	size int
+
+	mtx      sync.Mutex
+	lru      *list.List
+	byHash   map[chainhash.Hash]*list.Element
+	byHeight map[int64]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+func newMirrorCache(size int) *mirrorCache {
+	if size < 1 {
+		size = 1
+	}
+	return &mirrorCache{
+		size:     size,
+		lru:      list.New(),
+		byHash:   make(map[chainhash.Hash]*list.Element),
+		byHeight: make(map[int64]*list.Element),
+	}
+}
+
+// lookup returns a copy of the entry found by find, counting the hit or
+// miss.
+func (c *mirrorCache) lookup(find func() *list.Element) (*BtcLightMirrorV2, int64, bool) {
+	c.mtx.Lock()
+	elem := find()
+	if elem == nil {
+		c.mtx.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	c.mtx.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	return entry.mirror.Clone(), entry.height, true
+}
+
+func (c *mirrorCache) get(hash chainhash.Hash) (*BtcLightMirrorV2, int64, bool) {
+	return c.lookup(func() *list.Element {
+		return c.byHash[hash]
+	})
+}
+
+func (c *mirrorCache) getHeight(height int64) (*BtcLightMirrorV2, bool) {
+	m, _, ok := c.lookup(func() *list.Element {
+		return c.byHeight[height]
+	})
+	return m, ok
+}
+
+// add caches a copy of m.  A known height replaces whatever mirror was
+// cached at that height.
+func (c *mirrorCache) add(m *BtcLightMirrorV2, height int64) {
+	hash := m.BtcHeader.BlockHash()
+	entry := &cacheEntry{hash: hash, height: height, mirror: m.Clone()}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.removeLocked(hash)
+	if height >= 0 {
+		if elem, ok := c.byHeight[height]; ok {
+			c.removeLocked(elem.Value.(*cacheEntry).hash)
+		}
+		c.byHeight[height] = c.lru.PushFront(entry)
+		c.byHash[hash] = c.byHeight[height]
+	} else {
+		c.byHash[hash] = c.lru.PushFront(entry)
+	}
+
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).hash)
+	}
+}
+
+func (c *mirrorCache) remove(hash chainhash.Hash) {
+	c.mtx.Lock()
+	c.removeLocked(hash)
+	c.mtx.Unlock()
+}
+
+func (c *mirrorCache) removeLocked(hash chainhash.Hash) {
+	elem, ok := c.byHash[hash]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.height >= 0 && c.byHeight[entry.height] == elem {
+		delete(c.byHeight, entry.height)
+	}
+	delete(c.byHash, hash)
+	c.lru.Remove(elem)
+}
+
+func (c *mirrorCache) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// CachingStore is a Store that keeps the most recently used mirrors of an
+// underlying store decoded in memory.  All writes to the underlying store
+// must go through the CachingStore for the cache to stay coherent.
+//
+// Mirrors returned by a CachingStore are private copies that the caller may
+// modify freely.
+type CachingStore struct {
+	Store
+	cache *mirrorCache
+}
+
+// CachedStore is a Store reporting the lookups its cache served, as the
+// stores NewCachingStore returns do.
+type CachedStore interface {
+	Store
+	Stats() CacheStats
+}
+
+// NewCachingStore returns a CachingStore holding up to size mirrors of
+// store.  When store is a PruningStore, a BatchStore or a
+// CandidateIndexStore, the returned store embeds the CachingStore and is
+// one too, forwarding to store and dropping the mirrors Prune and
+// WriteBatch change from the cache.  A MigratableStore is not forwarded, as
+// its migrated records would bypass the cache: MigrateStore migrates the
+// underlying store.
+func NewCachingStore(store Store, size int) CachedStore {
+	s := &CachingStore{
+		Store: store,
+		cache: newMirrorCache(size),
+	}
+	p, pruning := store.(PruningStore)
+	b, batch := store.(BatchStore)
+	i, indexed := store.(CandidateIndexStore)
+	pruner := cachePruner{s, p}
+	batcher := cacheBatcher{s, b}
+	indexer := cacheIndexer{i}
+	switch {
+	case pruning && batch && indexed:
+		return &struct {
+			*CachingStore
+			cachePruner
+			cacheBatcher
+			cacheIndexer
+		}{s, pruner, batcher, indexer}
+	case pruning && batch:
+		return &struct {
+			*CachingStore
+			cachePruner
+			cacheBatcher
+		}{s, pruner, batcher}
+	case pruning && indexed:
+		return &struct {
+			*CachingStore
+			cachePruner
+			cacheIndexer
+		}{s, pruner, indexer}
+	case batch && indexed:
+		return &struct {
+			*CachingStore
+			cacheBatcher
+			cacheIndexer
+		}{s, batcher, indexer}
+	case pruning:
+		return &struct {
+			*CachingStore
+			cachePruner
+		}{s, pruner}
+	case batch:
+		return &struct {
+			*CachingStore
+			cacheBatcher
+		}{s, batcher}
+	case indexed:
+		return &struct {
+			*CachingStore
+			cacheIndexer
+		}{s, indexer}
+	}
+	return s
+}
+
+// cachePruner forwards the methods of PruningStore to the underlying store
+// of a CachingStore.
+type cachePruner struct {
+	s     *CachingStore
+	store PruningStore
+}
+
+// Prune drops the mirror from the cache and prunes it in the underlying
+// store.
+func (p cachePruner) Prune(hash chainhash.Hash) error {
+	p.s.cache.remove(hash)
+	return p.store.Prune(hash)
+}
+
+// PrunedByHeight returns the header-only form of the mirror stored at the
+// given height, from the underlying store.
+func (p cachePruner) PrunedByHeight(height int64) (*PrunedMirror, error) {
+	return p.store.PrunedByHeight(height)
+}
+
+// cacheBatcher forwards the method of BatchStore to the underlying store of
+// a CachingStore.
+type cacheBatcher struct {
+	s     *CachingStore
+	store BatchStore
+}
+
+// WriteBatch drops the mirrors it deletes and those at the heights it puts
+// mirrors at from the cache, writes the batch to the underlying store, and
+// caches the mirrors put once it succeeds.
+func (b cacheBatcher) WriteBatch(deletes []chainhash.Hash, mirrors []*BtcLightMirrorV2, heights []int64) error {
+	for _, hash := range deletes {
+		b.s.cache.remove(hash)
+	}
+	for _, height := range heights {
+		b.s.dropHeight(height)
+	}
+	if err := b.store.WriteBatch(deletes, mirrors, heights); err != nil {
+		return err
+	}
+	for i, m := range mirrors {
+		b.s.cache.add(m, heights[i])
+	}
+	return nil
+}
+
+// cacheIndexer forwards the methods of CandidateIndexStore, which do not
+// return mirrors, to the underlying store of a CachingStore.
+type cacheIndexer struct {
+	store CandidateIndexStore
+}
+
+// BlocksByCandidate returns the hashes of the mirrors delegating to addr,
+// from the underlying store.
+func (i cacheIndexer) BlocksByCandidate(addr common.Address, limit int, beforeHeight int64) ([]chainhash.Hash, error) {
+	return i.store.BlocksByCandidate(addr, limit, beforeHeight)
+}
+
+// ReindexCandidates rebuilds the index of the underlying store.
+func (i cacheIndexer) ReindexCandidates() error {
+	return i.store.ReindexCandidates()
+}
+
+// Put stores the mirror in the underlying store and caches it.
+func (s *CachingStore) Put(m *BtcLightMirrorV2, height int64) error {
+	if err := s.Store.Put(m, height); err != nil {
+		// The underlying store may have dropped the mirror that was
+		// at this height, so forget about it too.
+		s.dropHeight(height)
+		return err
+	}
+	s.cache.add(m, height)
+	return nil
+}
+
+func (s *CachingStore) dropHeight(height int64) {
+	s.cache.mtx.Lock()
+	if elem, ok := s.cache.byHeight[height]; ok {
+		s.cache.removeLocked(elem.Value.(*cacheEntry).hash)
+	}
+	s.cache.mtx.Unlock()
+}
+
+// ByHash returns the mirror with the given block hash and its height.
+func (s *CachingStore) ByHash(hash chainhash.Hash) (*BtcLightMirrorV2, int64, error) {
+	if m, height, ok := s.cache.get(hash); ok {
+		return m, height, nil
+	}
+	m, height, err := s.Store.ByHash(hash)
+	if err != nil {
+		// The height of a pruned mirror comes with ErrPruned.
+		return nil, height, err
+	}
+	s.cache.add(m, height)
+	return m, height, nil
+}
+
+// ByHeight returns the mirror stored at the given height.
+func (s *CachingStore) ByHeight(height int64) (*BtcLightMirrorV2, error) {
+	if m, ok := s.cache.getHeight(height); ok {
+		return m, nil
+	}
+	m, err := s.Store.ByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.add(m, height)
+	return m, nil
+}
+
+// Tip returns the mirror with the greatest height and that height.  The tip
+// is always looked up in the underlying store, the mirror is then cached.
+func (s *CachingStore) Tip() (*BtcLightMirrorV2, int64, error) {
+	m, height, err := s.Store.Tip()
+	if err != nil {
+		return nil, height, err
+	}
+	s.cache.add(m, height)
+	return m, height, nil
+}
+
+// Delete removes the mirror from the cache and the underlying store.
+func (s *CachingStore) Delete(hash chainhash.Hash) error {
+	s.cache.remove(hash)
+	return s.Store.Delete(hash)
+}
+
+// Stats returns the number of lookups served from and missing the cache.
+func (s *CachingStore) Stats() CacheStats {
+	return s.cache.stats()
+}
+
+// CachingFetcher is a Fetcher that keeps the most recently fetched mirrors in
+// memory.  Only lookups by hash are served from the cache since the block at
+// a given height changes with reorganizations; mirrors fetched by height are
+// still cached for later lookups by hash.
+//
+// Mirrors returned by a CachingFetcher are private copies that the caller may
+// modify freely.
+type CachingFetcher struct {
+	Fetcher
+	cache  *mirrorCache
+	logger Logger
+	health *healthState
+}
+
+// NewCachingFetcher returns a CachingFetcher holding up to size mirrors
+// fetched through f.
+func NewCachingFetcher(f Fetcher, size int, opts ...FetcherOption) *CachingFetcher {
+	return &CachingFetcher{
+		Fetcher: f,
+		cache:   newMirrorCache(size),
+		logger:  newFetcherConfig(opts).logger,
+		health:  newHealthState(),
+	}
+}
+
+// FetchByHash returns the cached mirror of the block or fetches it.
+func (f *CachingFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	if m, _, ok := f.cache.get(hash); ok {
+		return m, nil
+	}
+	start := time.Now()
+	m, err := f.Fetcher.FetchByHash(ctx, hash)
+	logFetch(f.logger, hash.String(), start, err)
+	f.health.fetched(err)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.add(m, -1)
+	return m, nil
+}
+
+// FetchByHeight fetches the mirror at the given height and caches it.
+func (f *CachingFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	start := time.Now()
+	m, err := f.Fetcher.FetchByHeight(ctx, height)
+	logFetch(f.logger, heightBlock(height), start, err)
+	f.health.fetched(err)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.add(m, -1)
+	return m, nil
+}
+
+// Forget drops the mirror with the given block hash from the cache.
+func (f *CachingFetcher) Forget(hash chainhash.Hash) {
+	f.cache.remove(hash)
+}
+
+// Ping pings the underlying fetcher if it can be pinged.
+func (f *CachingFetcher) Ping(ctx context.Context) error {
+	return pingFetcher(ctx, f.Fetcher)
+}
+
+// LastBlockAge returns the time elapsed since the last upstream fetch which
+// returned a block.  Blocks served from the cache do not count.
+func (f *CachingFetcher) LastBlockAge() time.Duration {
+	return f.health.LastBlockAge()
+}
+
+// LastError returns the last error of an upstream fetch, but ErrNotFound and
+// cancellations, and when it failed.
+func (f *CachingFetcher) LastError() (error, time.Time) {
+	return f.health.LastError()
+}
+
+// Stats returns the number of lookups served from and missing the cache.
+func (f *CachingFetcher) Stats() CacheStats {
+	return f.cache.stats()
+}
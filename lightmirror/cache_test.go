@@ -0,0 +1,330 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func serializeMirror(t *testing.T, m *BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	return buf.Bytes()
+}
+
+// poison alters every nested field of m.
+func poison(m *BtcLightMirrorV2) {
+	m.BtcHeader.Nonce++
+	m.BtcHeader.PrevBlock[0] ^= 0xff
+	m.CoinBaseTx.TxIn[0].SignatureScript[0] ^= 0xff
+	m.CoinBaseTx.TxOut[0].PkScript[0] ^= 0xff
+	m.CoinBaseTx.TxOut[0].Value++
+	if len(m.MerkleNodes) > 0 {
+		m.MerkleNodes[0][0] ^= 0xff
+	}
+}
+
+func TestCachingStore(t *testing.T) {
+	mirrors := newTestMirrors(4)
+	backing := newMemStore()
+	s := NewCachingStore(backing, 2)
+
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// Only the last two mirrors are cached.
+	tests := []struct {
+		height int64
+		hit    bool
+	}{
+		{3, true},
+		{2, true},
+		{0, false},
+		// Looking up 0 evicted 3.
+		{3, false},
+	}
+	for i, test := range tests {
+		before := backing.lookups
+		hash := mirrors[test.height].BtcHeader.BlockHash()
+		m, height, err := s.ByHash(hash)
+		if err != nil {
+			t.Errorf("ByHash #%d error %v", i, err)
+			continue
+		}
+		if height != test.height || m.BtcHeader.BlockHash() != hash {
+			t.Errorf("ByHash #%d: got %v at height %d", i,
+				m.BtcHeader.BlockHash(), height)
+		}
+		if hit := backing.lookups == before; hit != test.hit {
+			t.Errorf("ByHash #%d: got hit %v, want %v", i, hit, test.hit)
+		}
+	}
+
+	stats := s.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("Stats: got %+v, want 2 hits and 2 misses", stats)
+	}
+
+	// Height lookups are served from the cache too.
+	before := backing.lookups
+	if _, err := s.ByHeight(3); err != nil {
+		t.Fatalf("ByHeight error %v", err)
+	}
+	if backing.lookups != before {
+		t.Errorf("ByHeight: cached mirror looked up in the store")
+	}
+}
+
+func TestCachingStoreInvalidation(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	s := NewCachingStore(newMemStore(), 10)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	hash := mirrors[2].BtcHeader.BlockHash()
+	if err := s.Delete(hash); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	if _, _, err := s.ByHash(hash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByHash deleted: got error %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.ByHeight(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByHeight deleted: got error %v, want %v", err, ErrNotFound)
+	}
+
+	// Replacing the mirror at a height drops the old one.
+	replacement := newTestMirror(mirrors[0].BtcHeader.BlockHash(), 100, 1)
+	if err := s.Put(replacement, 1); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	m, err := s.ByHeight(1)
+	if err != nil {
+		t.Fatalf("ByHeight error %v", err)
+	}
+	if m.BtcHeader.BlockHash() != replacement.BtcHeader.BlockHash() {
+		t.Errorf("ByHeight: got %v, want %v", m.BtcHeader.BlockHash(),
+			replacement.BtcHeader.BlockHash())
+	}
+	_, _, err = s.ByHash(mirrors[1].BtcHeader.BlockHash())
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByHash replaced: got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCachingStoreInterfaces(t *testing.T) {
+	backing := newMemStore()
+	tests := []struct {
+		name                    string
+		store                   Store
+		pruning, batch, indexed bool
+	}{
+		{"plain", struct{ Store }{backing}, false, false, false},
+		{"pruning", backing, true, false, false},
+		{"batch", &batchMemStore{memStore: backing}, true, true, false},
+		{"indexed", struct{ CandidateIndexStore }{}, false, false, true},
+	}
+	for _, test := range tests {
+		s := NewCachingStore(test.store, 1)
+		_, pruning := s.(PruningStore)
+		_, batch := s.(BatchStore)
+		_, indexed := s.(CandidateIndexStore)
+		_, migratable := s.(MigratableStore)
+		if pruning != test.pruning || batch != test.batch || indexed != test.indexed || migratable {
+			t.Errorf("NewCachingStore (%s): got pruning %v, batch %v, candidate index %v, "+
+				"migratable %v", test.name, pruning, batch, indexed, migratable)
+		}
+	}
+}
+
+func TestCachingStorePruneAndBatch(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	backing := newMemStore()
+	s := NewCachingStore(&batchMemStore{memStore: backing}, 10)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// A pruned mirror is no longer served from the cache.
+	hash := mirrors[0].BtcHeader.BlockHash()
+	if err := s.(PruningStore).Prune(hash); err != nil {
+		t.Fatalf("Prune error %v", err)
+	}
+	if _, _, err := s.ByHash(hash); !errors.Is(err, ErrPruned) {
+		t.Errorf("ByHash pruned: got error %v, want %v", err, ErrPruned)
+	}
+
+	// A batch replacing the mirror at a height and deleting another drops
+	// both from the cache.
+	replacement := newTestMirror(mirrors[0].BtcHeader.BlockHash(), 100, 1)
+	deleted := mirrors[2].BtcHeader.BlockHash()
+	err := s.(BatchStore).WriteBatch([]chainhash.Hash{deleted},
+		[]*BtcLightMirrorV2{replacement}, []int64{1})
+	if err != nil {
+		t.Fatalf("WriteBatch error %v", err)
+	}
+	before := backing.lookups
+	if m, err := s.ByHeight(1); err != nil ||
+		m.BtcHeader.BlockHash() != replacement.BtcHeader.BlockHash() {
+		t.Errorf("ByHeight after WriteBatch: got %v, error %v", m, err)
+	}
+	if backing.lookups != before {
+		t.Errorf("ByHeight: mirror put by WriteBatch looked up in the store")
+	}
+	for _, hash := range []chainhash.Hash{deleted, mirrors[1].BtcHeader.BlockHash()} {
+		if _, _, err := s.ByHash(hash); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ByHash %v after WriteBatch: got error %v, want %v", hash, err, ErrNotFound)
+		}
+	}
+
+	// A chain prunes through the cache.
+	backing = newMemStore()
+	chainMirrors := newTestMirrors(6)
+	c := newTestChain(t, chainMirrors, WithStore(NewCachingStore(backing, 4)), WithPruneDepth(2))
+	checkStorePruned(t, c, backing)
+}
+
+// TestCachingStoreNoPoisoning checks that neither the mirror passed to Put
+// nor the ones returned by lookups share memory with the cache.
+func TestCachingStoreNoPoisoning(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	want := serializeMirror(t, m)
+	hash := m.BtcHeader.BlockHash()
+
+	s := NewCachingStore(newMemStore(), 10)
+	if err := s.Put(m, 0); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	poison(m)
+
+	lookups := []struct {
+		name string
+		fn   func() (*BtcLightMirrorV2, error)
+	}{
+		{"ByHash", func() (*BtcLightMirrorV2, error) {
+			m, _, err := s.ByHash(hash)
+			return m, err
+		}},
+		{"ByHeight", func() (*BtcLightMirrorV2, error) {
+			return s.ByHeight(0)
+		}},
+	}
+	for _, lookup := range lookups {
+		for i := 0; i < 2; i++ {
+			got, err := lookup.fn()
+			if err != nil {
+				t.Fatalf("%s error %v", lookup.name, err)
+			}
+			if !bytes.Equal(serializeMirror(t, got), want) {
+				t.Fatalf("%s #%d: cached mirror was modified", lookup.name, i)
+			}
+			poison(got)
+		}
+	}
+	if s.Stats().Misses != 0 {
+		t.Errorf("Stats: got %d misses, want 0", s.Stats().Misses)
+	}
+}
+
+// countingFetcher serves mirrors from a map and counts upstream calls.
+type countingFetcher struct {
+	byHash   map[chainhash.Hash]*BtcLightMirrorV2
+	byHeight map[int64]*BtcLightMirrorV2
+	calls    int
+}
+
+func newCountingFetcher(mirrors []*BtcLightMirrorV2) *countingFetcher {
+	f := &countingFetcher{
+		byHash:   make(map[chainhash.Hash]*BtcLightMirrorV2),
+		byHeight: make(map[int64]*BtcLightMirrorV2),
+	}
+	for i, m := range mirrors {
+		f.byHash[m.BtcHeader.BlockHash()] = m
+		f.byHeight[int64(i)] = m
+	}
+	return f
+}
+
+func (f *countingFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	f.calls++
+	m, ok := f.byHash[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m.Clone(), nil
+}
+
+func (f *countingFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	f.calls++
+	m, ok := f.byHeight[height]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m.Clone(), nil
+}
+
+func TestCachingFetcher(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	upstream := newCountingFetcher(mirrors)
+	f := NewCachingFetcher(upstream, 10)
+	ctx := context.Background()
+
+	// Heights always go upstream but fill the cache for hash lookups.
+	for i := 0; i < 2; i++ {
+		if _, err := f.FetchByHeight(ctx, 1); err != nil {
+			t.Fatalf("FetchByHeight error %v", err)
+		}
+	}
+	if upstream.calls != 2 {
+		t.Errorf("FetchByHeight: got %d upstream calls, want 2", upstream.calls)
+	}
+
+	want := serializeMirror(t, mirrors[1])
+	for i := 0; i < 3; i++ {
+		m, err := f.FetchByHash(ctx, mirrors[1].BtcHeader.BlockHash())
+		if err != nil {
+			t.Fatalf("FetchByHash error %v", err)
+		}
+		if !bytes.Equal(serializeMirror(t, m), want) {
+			t.Fatalf("FetchByHash #%d: cached mirror was modified", i)
+		}
+		poison(m)
+	}
+	if upstream.calls != 2 {
+		t.Errorf("FetchByHash: got %d upstream calls, want 2", upstream.calls)
+	}
+
+	f.Forget(mirrors[1].BtcHeader.BlockHash())
+	if _, err := f.FetchByHash(ctx, mirrors[1].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("FetchByHash error %v", err)
+	}
+	if upstream.calls != 3 {
+		t.Errorf("FetchByHash after Forget: got %d upstream calls, want 3",
+			upstream.calls)
+	}
+
+	if _, err := f.FetchByHash(ctx, chainhash.Hash{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FetchByHash unknown: got error %v, want %v", err, ErrNotFound)
+	}
+	stats := f.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 {
+		t.Errorf("Stats: got %+v, want 3 hits and 2 misses", stats)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNoCandidateIndex is returned by CandidateIndexStore.BlocksByCandidate
+// when the store holds mirrors put before it indexed them, until
+// ReindexCandidates is run.
+var ErrNoCandidateIndex = errors.New("candidate index not built")
+
+// CandidateIndexStore is a Store also indexing its mirrors by the candidate
+// they delegate to, as IndexedCandidate tells.  Put and Delete update the
+// index atomically with the mirrors, so the chain disconnecting blocks on a
+// reorganization removes them from the index as well.  Pruning a mirror
+// keeps it in the index.
+type CandidateIndexStore interface {
+	Store
+
+	// BlocksByCandidate returns the hashes of the mirrors delegating to
+	// addr stored below beforeHeight, greatest height first, at most
+	// limit of them unless limit is not positive.
+	BlocksByCandidate(addr common.Address, limit int, beforeHeight int64) ([]chainhash.Hash, error)
+
+	// ReindexCandidates rebuilds the index from the stored mirrors.
+	// Pruned mirrors keep the entry they have, if any.
+	ReindexCandidates() error
+}
+
+// IndexedCandidate returns the candidate a CandidateIndexStore indexes the
+// mirror under: the one of the power parameters ParsePowerParams returns,
+// which the statistics also count.  It returns false if the mirror has
+// none.
+func IndexedCandidate(m *BtcLightMirrorV2) (common.Address, bool) {
+	d, _ := m.powerStatus()
+	if d == nil {
+		return common.Address{}, false
+	}
+	return d.Candidate, true
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestIndexedCandidate(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	other := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+
+	// Of two CORE outputs, the first one is indexed.
+	multiple := newDelegatingMirror(chainhash.Hash{}, 1, candidate, candidate)
+	multiple.CoinBaseTx.AddTxOut(wire.NewTxOut(0, corePkScript(other, other, nil)))
+
+	tests := []struct {
+		name string
+		m    *BtcLightMirrorV2
+		want common.Address
+		ok   bool
+	}{
+		{"delegating", newDelegatingMirror(chainhash.Hash{}, 1, candidate, other), candidate, true},
+		{"multiple", multiple, candidate, true},
+		{"none", newTestMirror(chainhash.Hash{}, 1, 0), common.Address{}, false},
+	}
+	for _, test := range tests {
+		got, ok := IndexedCandidate(test.m)
+		if got != test.want || ok != test.ok {
+			t.Errorf("IndexedCandidate (%s): got %v %v, want %v %v", test.name,
+				got, ok, test.want, test.ok)
+		}
+	}
+}
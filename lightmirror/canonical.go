@@ -0,0 +1,62 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNonCanonical is wrapped by the NonCanonicalError of CheckCanonical.
+var ErrNonCanonical = errors.New("non-canonical mirror serialization")
+
+// NonCanonicalError is returned by CheckCanonical for bytes which encode a
+// mirror otherwise than Serialize does, with the offset of the first byte
+// differing from its serialization.  It wraps ErrNonCanonical.
+type NonCanonicalError struct {
+	Offset int
+}
+
+func (e *NonCanonicalError) Error() string {
+	return fmt.Sprintf("byte %d differs from the serialization of the "+
+		"decoded mirror: %v", e.Offset, ErrNonCanonical)
+}
+
+func (e *NonCanonicalError) Unwrap() error {
+	return ErrNonCanonical
+}
+
+// CheckCanonical returns nil when data is exactly the serialization of a
+// mirror, as Serialize writes it, so that hashes of data commit to the
+// mirror and to nothing else.  Deserialize only decodes canonical mirrors,
+// and Serialize reproduces their bytes.  CheckCanonical fails with a
+// *NonCanonicalError for data decoding only with
+// DeserializeOptions.RetainRawCoinbase, whose coinbase is not canonically
+// encoded, and with the decoding error, such as a *TrailingDataError, for
+// data which is not a mirror of a Bitcoin block.
+func CheckCanonical(data []byte) error {
+	m, err := DeserializeBytesWith(data, DeserializeOptions{
+		RetainRawCoinbase:   true,
+		RejectTrailingBytes: true,
+	})
+	if err != nil {
+		return err
+	}
+	m.Coinbase()
+	m.rawCoinbase = nil
+	canonical, err := m.ToBytes()
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		if i == len(canonical) || data[i] != canonical[i] {
+			return &NonCanonicalError{Offset: i}
+		}
+	}
+	if len(canonical) != len(data) {
+		return &NonCanonicalError{Offset: len(data)}
+	}
+	return nil
+}
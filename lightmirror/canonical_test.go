@@ -0,0 +1,164 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// randomBytes returns n random bytes of r.
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// randomScriptSize returns a script size, often at a boundary of the
+// variable length integer encoding.
+func randomScriptSize(r *rand.Rand) int {
+	sizes := []int{0, 1, 0xfc, 0xfd, 0xffff, 0x10000}
+	if r.Intn(2) == 0 {
+		return sizes[r.Intn(len(sizes))]
+	}
+	return r.Intn(100)
+}
+
+// randomMirror returns a mirror of random content satisfying
+// VerifyInvariants: its coinbase has up to three inputs, some of them with
+// witnesses, which may hold empty items, and up to three outputs.
+func randomMirror(r *rand.Rand) *BtcLightMirrorV2 {
+	m := &BtcLightMirrorV2{BtcHeader: wire.BlockHeader{
+		Version:   r.Int31(),
+		Timestamp: time.Unix(1+r.Int63n(1<<32-1), 0),
+		Bits:      r.Uint32(),
+		Nonce:     r.Uint32(),
+	}}
+	r.Read(m.BtcHeader.PrevBlock[:])
+	r.Read(m.BtcHeader.MerkleRoot[:])
+
+	tx := &m.CoinBaseTx
+	tx.Version = r.Int31()
+	tx.LockTime = r.Uint32()
+	for i := 1 + r.Intn(3); i > 0; i-- {
+		txIn := &wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: r.Uint32()},
+			SignatureScript:  randomBytes(r, randomScriptSize(r)),
+			Sequence:         r.Uint32(),
+		}
+		r.Read(txIn.PreviousOutPoint.Hash[:])
+		for j := r.Intn(3); j > 0; j-- {
+			txIn.Witness = append(txIn.Witness, randomBytes(r, r.Intn(40)))
+		}
+		tx.AddTxIn(txIn)
+	}
+	for i := 1 + r.Intn(3); i > 0; i-- {
+		tx.AddTxOut(wire.NewTxOut(r.Int63(), randomBytes(r, randomScriptSize(r))))
+	}
+
+	m.MerkleNodes = make([]chainhash.Hash, r.Intn(maxMerkleNode+1))
+	for i := range m.MerkleNodes {
+		r.Read(m.MerkleNodes[i][:])
+	}
+	return m
+}
+
+// canonicalMirrors returns the mirrors of the test vectors and random
+// mirrors.
+func canonicalMirrors(t *testing.T) map[string]*BtcLightMirrorV2 {
+	t.Helper()
+	mirrors := make(map[string]*BtcLightMirrorV2)
+	for _, name := range VectorNames() {
+		_, m, err := LoadVector(name)
+		if err != nil {
+			t.Fatalf("LoadVector error %v", err)
+		}
+		mirrors[name] = m
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		mirrors[fmt.Sprintf("random #%d", i)] = randomMirror(r)
+	}
+	return mirrors
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	for name, m := range canonicalMirrors(t) {
+		data, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes (%s) error %v", name, err)
+		}
+		if err := CheckCanonical(data); err != nil {
+			t.Errorf("CheckCanonical (%s) error %v", name, err)
+		}
+		for _, opts := range []DeserializeOptions{{}, {RetainRawCoinbase: true}} {
+			decoded, err := DeserializeBytesWith(data, opts)
+			if err != nil {
+				t.Fatalf("DeserializeBytesWith (%s, %+v) error %v", name, opts, err)
+			}
+			var buf bytes.Buffer
+			if err := decoded.Serialize(&buf); err != nil {
+				t.Fatalf("Serialize (%s) error %v", name, err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("Serialize (%s, %+v): got %x, want %x", name, opts, buf.Bytes(), data)
+			}
+			if !decoded.Equal(m) {
+				t.Errorf("DeserializeBytesWith (%s, %+v): got %v", name, opts, decoded.Diff(m))
+			}
+		}
+	}
+}
+
+func TestCheckCanonical(t *testing.T) {
+	canonical, nonCanonical := nonCanonicalMirror(t)
+	var nce *NonCanonicalError
+	if err := CheckCanonical(nonCanonical); !errors.As(err, &nce) || nce.Offset != 84 ||
+		!errors.Is(err, ErrNonCanonical) {
+		t.Errorf("CheckCanonical: got error %v, want a non canonical byte 84", err)
+	}
+
+	// A witness flag with an empty witness for every input is not decoded
+	// at all: the single input has its item replaced by none.
+	m := newTestMirror(chainhash.Hash{0x01}, 1, 5)
+	m.CoinBaseTx.TxIn = m.CoinBaseTx.TxIn[:1]
+	m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{{}}
+	withWitness, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	end := 80 + m.CoinBaseTx.SerializeSize()
+	var flagged []byte
+	flagged = append(flagged, withWitness[:end-6]...)
+	flagged = append(flagged, 0x00)
+	flagged = append(flagged, withWitness[end-4:]...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"trailing", append(append([]byte{}, canonical...), 0)},
+		{"truncated", canonical[:len(canonical)-1]},
+		{"empty", nil},
+		{"superfluous witness flag", flagged},
+	}
+	for _, test := range tests {
+		err := CheckCanonical(test.data)
+		if err == nil || errors.Is(err, ErrNonCanonical) {
+			t.Errorf("CheckCanonical (%s): got error %v, want a decoding error", test.name, err)
+		}
+	}
+	var tde *TrailingDataError
+	if err := CheckCanonical(tests[0].data); !errors.As(err, &tde) {
+		t.Errorf("CheckCanonical (trailing): got error %v, want %T", err, tde)
+	}
+}
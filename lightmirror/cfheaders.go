@@ -0,0 +1,365 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+var (
+	// ErrCFHeadersLinkage is wrapped by the errors of a source whose
+	// filter headers do not link to the ones it served before.
+	ErrCFHeadersLinkage = errors.New("filter header chain does not link")
+
+	// ErrNoCFHeadersSource is returned by CFHeadersCrossCheck.Check when
+	// no source served the range.
+	ErrNoCFHeadersSource = errors.New("no filter header source answered")
+)
+
+// CFHeaders are the BIP 157 regular filter headers of a range of blocks of
+// the best chain, as a cfheaders message carries them: the filter header of
+// the block before StartHeight, and the filter hash of every block from
+// StartHeight on.
+type CFHeaders struct {
+	StartHeight      int64
+	PrevFilterHeader chainhash.Hash
+	FilterHashes     []chainhash.Hash
+}
+
+// FilterHeader returns the BIP 157 filter header of a block whose filter
+// hashes to filterHash, the parent of the block having the filter header
+// prevHeader: the double SHA-256 of filterHash and prevHeader.
+func FilterHeader(filterHash, prevHeader chainhash.Hash) chainhash.Hash {
+	var buf [2 * chainhash.HashSize]byte
+	copy(buf[:chainhash.HashSize], filterHash[:])
+	copy(buf[chainhash.HashSize:], prevHeader[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// Headers returns the filter headers of the blocks of the range, those of
+// FilterHashes chained from PrevFilterHeader.
+func (h *CFHeaders) Headers() []chainhash.Hash {
+	headers := make([]chainhash.Hash, len(h.FilterHashes))
+	prev := h.PrevFilterHeader
+	for i, filterHash := range h.FilterHashes {
+		prev = FilterHeader(filterHash, prev)
+		headers[i] = prev
+	}
+	return headers
+}
+
+// CFHeadersSource serves the regular filter headers of the best chain of an
+// upstream source, a BIP 157 peer for instance.
+type CFHeadersSource interface {
+	// FetchCFHeaders returns the filter headers of the blocks from start
+	// to stop, inclusive.
+	FetchCFHeaders(ctx context.Context, start, stop int64) (*CFHeaders, error)
+}
+
+// CFHeaderDisagreement is a height at which the sources of a
+// CFHeadersCrossCheck served different filter headers, keyed by source
+// name.
+type CFHeaderDisagreement struct {
+	Height  int64
+	Headers map[string]chainhash.Hash
+}
+
+// CFHeadersCheck is the outcome of CFHeadersCrossCheck.Check on a range of
+// heights.  It is advisory: filter headers are not part of the mirrors, and
+// a source lying about them says nothing of the mirrors themselves, but a
+// disagreement is a sign that some of the sources of block data do not
+// follow the same chain.
+type CFHeadersCheck struct {
+	Start, Stop int64
+
+	// Headers are the filter headers of the range the sources agreed on,
+	// zero at the heights they disagreed on.
+	Headers []chainhash.Hash
+
+	// Disagreements are the heights at which the sources answering
+	// disagreed, in increasing order.
+	Disagreements []CFHeaderDisagreement
+
+	// SourceErrs are the errors of the sources which did not answer, or
+	// whose answer was inconsistent, keyed by source name.  Such sources
+	// take no part in the comparison.
+	SourceErrs map[string]error
+}
+
+// Agree reports whether every source answered and no two disagreed.
+func (c *CFHeadersCheck) Agree() bool {
+	return len(c.Disagreements) == 0 && len(c.SourceErrs) == 0
+}
+
+// cfHeaderKey identifies the filter header a source served for a height.
+type cfHeaderKey struct {
+	source string
+	height int64
+}
+
+// cfHeaderEntry is the value of an element of cfHeaderCache.lru.
+type cfHeaderEntry struct {
+	key    cfHeaderKey
+	header chainhash.Hash
+}
+
+// cfHeaderCache is a fixed size LRU cache of the filter headers served by
+// each source.
+type cfHeaderCache struct {
+	size int
+
+	mtx   sync.Mutex
+	lru   *list.List
+	byKey map[cfHeaderKey]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+func newCFHeaderCache(size int) *cfHeaderCache {
+	if size < 1 {
+		size = 1
+	}
+	return &cfHeaderCache{
+		size:  size,
+		lru:   list.New(),
+		byKey: make(map[cfHeaderKey]*list.Element),
+	}
+}
+
+// get returns the header cached for key, without counting the lookup.
+func (c *cfHeaderCache) get(key cfHeaderKey) (chainhash.Hash, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elem, ok := c.byKey[key]
+	if !ok {
+		return chainhash.Hash{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cfHeaderEntry).header, true
+}
+
+// getRange returns the headers cached for source from start to stop,
+// counting a hit if they all are and a miss otherwise.
+func (c *cfHeaderCache) getRange(source string, start, stop int64) ([]chainhash.Hash, bool) {
+	headers := make([]chainhash.Hash, 0, stop-start+1)
+	for height := start; height <= stop; height++ {
+		header, ok := c.get(cfHeaderKey{source, height})
+		if !ok {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, false
+		}
+		headers = append(headers, header)
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return headers, true
+}
+
+func (c *cfHeaderCache) add(key cfHeaderKey, header chainhash.Hash) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.byKey[key]; ok {
+		elem.Value.(*cfHeaderEntry).header = header
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.byKey[key] = c.lru.PushFront(&cfHeaderEntry{key, header})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*cfHeaderEntry).key)
+	}
+}
+
+// namedCFSource is a source of a CFHeadersCrossCheck.
+type namedCFSource struct {
+	name   string
+	source CFHeadersSource
+}
+
+// CFHeadersCrossCheck compares the BIP 157 filter headers served by a set of
+// sources, independent of the ones the mirrors are fetched from, as a
+// consistency check of block data coming from untrusted sources such as
+// public Esplora instances or random peers.
+//
+// The filter headers each source served are cached, so that checking a
+// range again, or a block of a range already checked, does not query the
+// sources.  The cache also checks the linkage of the filter header chain of
+// each source: the filter header preceding a range must be the one the
+// source served for the previous height, if cached.  Invalidate drops the
+// headers of the blocks a reorganization disconnected.
+type CFHeadersCrossCheck struct {
+	cache *cfHeaderCache
+
+	mtx     sync.RWMutex
+	sources []namedCFSource
+}
+
+// NewCFHeadersCrossCheck returns a CFHeadersCrossCheck without sources
+// caching up to cacheSize filter headers across them.
+func NewCFHeadersCrossCheck(cacheSize int) *CFHeadersCrossCheck {
+	return &CFHeadersCrossCheck{cache: newCFHeaderCache(cacheSize)}
+}
+
+// AddSource adds the source src under name.
+func (cc *CFHeadersCrossCheck) AddSource(name string, src CFHeadersSource) {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	cc.sources = append(cc.sources, namedCFSource{name, src})
+}
+
+// CacheStats returns the lookups of ranges served by the cache.
+func (cc *CFHeadersCrossCheck) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&cc.cache.hits),
+		Misses: atomic.LoadUint64(&cc.cache.misses),
+	}
+}
+
+// Check fetches the filter headers from start to stop, inclusive, from every
+// source and compares them.  The sources are queried concurrently.  It
+// fails with ErrNoCFHeadersSource when none answered; the errors of the
+// others are in the check.
+func (cc *CFHeadersCrossCheck) Check(ctx context.Context, start, stop int64) (*CFHeadersCheck, error) {
+	if start < 0 || stop < start {
+		return nil, fmt.Errorf("invalid filter header range %d to %d", start, stop)
+	}
+	cc.mtx.RLock()
+	sources := append([]namedCFSource(nil), cc.sources...)
+	cc.mtx.RUnlock()
+
+	headers := make([][]chainhash.Hash, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, s := range sources {
+		wg.Add(1)
+		go func(i int, s namedCFSource) {
+			defer wg.Done()
+			headers[i], errs[i] = cc.fetch(ctx, s, start, stop)
+		}(i, s)
+	}
+	wg.Wait()
+
+	check := &CFHeadersCheck{
+		Start:      start,
+		Stop:       stop,
+		Headers:    make([]chainhash.Hash, stop-start+1),
+		SourceErrs: make(map[string]error),
+	}
+	answered := 0
+	for i, s := range sources {
+		if errs[i] != nil {
+			check.SourceErrs[s.name] = errs[i]
+		} else {
+			answered++
+		}
+	}
+	if answered == 0 {
+		return check, ErrNoCFHeadersSource
+	}
+
+	for j := range check.Headers {
+		byName := make(map[string]chainhash.Hash, answered)
+		var (
+			first    chainhash.Hash
+			disagree bool
+		)
+		for i, s := range sources {
+			if errs[i] != nil {
+				continue
+			}
+			header := headers[i][j]
+			if len(byName) == 0 {
+				first = header
+			} else if header != first {
+				disagree = true
+			}
+			byName[s.name] = header
+		}
+		if disagree {
+			check.Disagreements = append(check.Disagreements, CFHeaderDisagreement{
+				Height:  start + int64(j),
+				Headers: byName,
+			})
+			continue
+		}
+		check.Headers[j] = first
+	}
+	return check, nil
+}
+
+// fetch returns the filter headers s serves from start to stop, from the
+// cache if it holds them all.
+func (cc *CFHeadersCrossCheck) fetch(ctx context.Context, s namedCFSource, start, stop int64) ([]chainhash.Hash, error) {
+	if headers, ok := cc.cache.getRange(s.name, start, stop); ok {
+		return headers, nil
+	}
+	resp, err := s.source.FetchCFHeaders(ctx, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StartHeight != start || int64(len(resp.FilterHashes)) != stop-start+1 {
+		return nil, fmt.Errorf("got %d filter hashes from height %d, want "+
+			"%d from height %d", len(resp.FilterHashes), resp.StartHeight,
+			stop-start+1, start)
+	}
+
+	// The filter header chain starts from the zero hash, and goes on from
+	// the header served for the previous height.
+	if start == 0 && resp.PrevFilterHeader != (chainhash.Hash{}) {
+		return nil, fmt.Errorf("filter header before the genesis block is "+
+			"%v: %w", resp.PrevFilterHeader, ErrCFHeadersLinkage)
+	}
+	if prev, ok := cc.cache.get(cfHeaderKey{s.name, start - 1}); ok && start > 0 && prev != resp.PrevFilterHeader {
+		return nil, fmt.Errorf("filter header at height %d is %v, was %v: %w",
+			start-1, resp.PrevFilterHeader, prev, ErrCFHeadersLinkage)
+	}
+
+	headers := resp.Headers()
+	for i, header := range headers {
+		cc.cache.add(cfHeaderKey{s.name, start + int64(i)}, header)
+	}
+	return headers, nil
+}
+
+// Invalidate drops the filter headers cached at and above height, those of
+// blocks a reorganization disconnected, so that the sources are queried
+// for them again and their new headers are not taken for a broken linkage.
+func (cc *CFHeadersCrossCheck) Invalidate(height int64) {
+	c := cc.cache
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, elem := range c.byKey {
+		if key.height >= height {
+			c.lru.Remove(elem)
+			delete(c.byKey, key)
+		}
+	}
+}
+
+// Annotate runs Check on the height of the block of r, or the height it
+// would connect at, and sets r.CFHeaders to the result.  It does nothing
+// for a block the chain of r does not place.
+func (cc *CFHeadersCrossCheck) Annotate(ctx context.Context, r *ValidationReport) error {
+	var height int64
+	switch {
+	case r.Known:
+		height = r.Height
+	case r.ParentKnown:
+		height = r.ParentHeight + 1
+	default:
+		return nil
+	}
+	check, err := cc.Check(ctx, height, height)
+	r.CFHeaders = check
+	return err
+}
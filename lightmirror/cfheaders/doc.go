@@ -0,0 +1,8 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package cfheaders holds the sources of BIP 157 filter headers a
+// lightmirror.CFHeadersCrossCheck compares: a BIP 157 peer spoken to over
+// the Bitcoin P2P protocol, and a URL serving the headers as JSON.
+package cfheaders
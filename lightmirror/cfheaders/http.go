@@ -0,0 +1,143 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package cfheaders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// maxResponseSize bounds the body of an answer to HTTPSource: the hex of
+// wire.MaxCFHeadersPerMsg hashes with room for the JSON around them.
+const maxResponseSize = (wire.MaxCFHeadersPerMsg + 1) * (2*chainhash.HashSize + 4) * 2
+
+// cfHeadersJSON is the answer of a URL serving filter headers.
+type cfHeadersJSON struct {
+	StartHeight      int64    `json:"start_height"`
+	PrevFilterHeader string   `json:"prev_filter_header"`
+	FilterHashes     []string `json:"filter_hashes"`
+}
+
+// HTTPSource is a lightmirror.CFHeadersSource fetching filter headers from a
+// URL configured by the operator, typically a service in front of a BIP
+// 157 node of their own.  A range is fetched with
+//
+//	GET <url>?start=<start>&stop=<stop>
+//
+// answered with a JSON object whose hashes are hex in the byte order
+// bitcoind prints them in, as for getblockfilter:
+//
+//	{"start_height": 100, "prev_filter_header": "...", "filter_hashes": ["...", ...]}
+//
+// A range is fetched in requests of up to wire.MaxCFHeadersPerMsg blocks.
+type HTTPSource struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// NewHTTPSource returns an HTTPSource fetching the filter headers from
+// rawURL with client, http.DefaultClient if nil.
+func NewHTTPSource(rawURL string, client *http.Client) (*HTTPSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("filter header URL %q is not an HTTP URL", rawURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSource{url: u, client: client}, nil
+}
+
+// FetchCFHeaders returns the regular filter headers of the blocks from start
+// to stop, inclusive.
+func (s *HTTPSource) FetchCFHeaders(ctx context.Context, start, stop int64) (*lightmirror.CFHeaders, error) {
+	if start < 0 || stop < start {
+		return nil, fmt.Errorf("invalid filter header range %d to %d", start, stop)
+	}
+	res := &lightmirror.CFHeaders{StartHeight: start}
+	var last chainhash.Hash
+	for from := start; from <= stop; {
+		to := from + wire.MaxCFHeadersPerMsg - 1
+		if to > stop {
+			to = stop
+		}
+		part, err := s.get(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if from == start {
+			res.PrevFilterHeader = part.PrevFilterHeader
+		} else if part.PrevFilterHeader != last {
+			return nil, fmt.Errorf("%s: filter header at height %d is %v, "+
+				"was %v: %w", s.url.Redacted(), from-1, part.PrevFilterHeader,
+				last, lightmirror.ErrCFHeadersLinkage)
+		}
+		last = part.PrevFilterHeader
+		for _, h := range part.FilterHashes {
+			res.FilterHashes = append(res.FilterHashes, h)
+			last = lightmirror.FilterHeader(h, last)
+		}
+		from = to + 1
+	}
+	return res, nil
+}
+
+// get fetches the range from start to stop in a single request.
+func (s *HTTPSource) get(ctx context.Context, start, stop int64) (*lightmirror.CFHeaders, error) {
+	u := *s.url
+	q := u.Query()
+	q.Set("start", strconv.FormatInt(start, 10))
+	q.Set("stop", strconv.FormatInt(stop, 10))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		return nil, fmt.Errorf("%s: %s", s.url.Redacted(), resp.Status)
+	}
+
+	var body cfHeadersJSON
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.url.Redacted(), err)
+	}
+	if body.StartHeight != start || int64(len(body.FilterHashes)) != stop-start+1 {
+		return nil, fmt.Errorf("%s: got %d filter hashes from height %d, want "+
+			"%d from height %d", s.url.Redacted(), len(body.FilterHashes),
+			body.StartHeight, stop-start+1, start)
+	}
+	res := &lightmirror.CFHeaders{
+		StartHeight:  start,
+		FilterHashes: make([]chainhash.Hash, len(body.FilterHashes)),
+	}
+	if res.PrevFilterHeader, err = lightmirror.ParseDisplayHex(body.PrevFilterHeader); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.url.Redacted(), err)
+	}
+	for i, h := range body.FilterHashes {
+		if res.FilterHashes[i], err = lightmirror.ParseDisplayHex(h); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.url.Redacted(), err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package cfheaders
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// newTestServer returns a server of the filter headers of chain, closed at
+// the end of the test.
+func newTestServer(t *testing.T, chain testChain) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(cfHeadersHandler(chain, nil))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// cfHeadersHandler serves the filter headers of chain, counting the requests
+// in requests if not nil.
+func cfHeadersHandler(chain testChain, requests *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			atomic.AddInt32(requests, 1)
+		}
+		start, err1 := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		stop, err2 := strconv.ParseInt(r.URL.Query().Get("stop"), 10, 64)
+		if err1 != nil || err2 != nil || stop >= chain.n || stop-start+1 > wire.MaxCFHeadersPerMsg {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		headers := chain.cfHeaders(start, stop)
+		body := cfHeadersJSON{
+			StartHeight:      start,
+			PrevFilterHeader: headers.PrevFilterHeader.String(),
+		}
+		for _, h := range headers.FilterHashes {
+			body.FilterHashes = append(body.FilterHashes, h.String())
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func TestHTTPSource(t *testing.T) {
+	chain := testChain{n: 3000}
+	var requests int32
+	srv := httptest.NewServer(cfHeadersHandler(chain, &requests))
+	defer srv.Close()
+	s, err := NewHTTPSource(srv.URL+"/cfheaders?network=test", srv.Client())
+	if err != nil {
+		t.Fatalf("NewHTTPSource error %v", err)
+	}
+
+	tests := []struct {
+		start, stop int64
+		requests    int32
+	}{
+		{0, 0, 1},
+		{10, 20, 1},
+		{100, 2500, 2},
+	}
+	for i, test := range tests {
+		atomic.StoreInt32(&requests, 0)
+		got, err := s.FetchCFHeaders(context.Background(), test.start, test.stop)
+		if err != nil {
+			t.Fatalf("FetchCFHeaders #%d error %v", i, err)
+		}
+		want := chain.cfHeaders(test.start, test.stop).Headers()
+		headers := got.Headers()
+		if len(headers) != len(want) || headers[0] != want[0] || headers[len(want)-1] != want[len(want)-1] {
+			t.Errorf("FetchCFHeaders #%d: got %d headers, want %d", i, len(headers), len(want))
+		}
+		if n := atomic.LoadInt32(&requests); n != test.requests {
+			t.Errorf("FetchCFHeaders #%d: got %d requests, want %d", i, n, test.requests)
+		}
+	}
+
+	if _, err := s.FetchCFHeaders(context.Background(), 10, 3000); err == nil {
+		t.Errorf("FetchCFHeaders beyond the tip: expected error")
+	}
+	if _, err := NewHTTPSource("ftp://example.com", nil); err == nil {
+		t.Errorf("NewHTTPSource: expected error for a non HTTP URL")
+	}
+}
+
+func TestHTTPSourceInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body cfHeadersJSON
+	}{
+		{"wrong start", cfHeadersJSON{StartHeight: 1, PrevFilterHeader: zeroHex, FilterHashes: []string{zeroHex}}},
+		{"short", cfHeadersJSON{PrevFilterHeader: zeroHex}},
+		{"bad hash", cfHeadersJSON{PrevFilterHeader: zeroHex, FilterHashes: []string{"00"}}},
+	}
+	for _, test := range tests {
+		body := test.body
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(body)
+		}))
+		s, err := NewHTTPSource(srv.URL, nil)
+		if err != nil {
+			t.Fatalf("NewHTTPSource (%s) error %v", test.name, err)
+		}
+		if _, err := s.FetchCFHeaders(context.Background(), 0, 0); err == nil {
+			t.Errorf("FetchCFHeaders (%s): expected error", test.name)
+		}
+		srv.Close()
+	}
+
+	// A response not linking to the previous one of the same range.
+	chain := testChain{n: 3000}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("start") != "0" {
+			chain = testChain{n: 3000, fork: 1000}
+		}
+		cfHeadersHandler(chain, nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	s, _ := NewHTTPSource(srv.URL, nil)
+	if _, err := s.FetchCFHeaders(context.Background(), 0, 2500); !errors.Is(err, lightmirror.ErrCFHeadersLinkage) {
+		t.Errorf("FetchCFHeaders: got error %v, want %v", err, lightmirror.ErrCFHeadersLinkage)
+	}
+}
+
+// zeroHex is the hex of the zero hash.
+const zeroHex = "0000000000000000000000000000000000000000000000000000000000000000"
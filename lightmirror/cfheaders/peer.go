@@ -0,0 +1,231 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package cfheaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// ErrNoFilterService is returned by PeerSource when the peer does not
+// advertise the compact filter service of BIP 157.
+var ErrNoFilterService = errors.New("peer does not serve compact filters")
+
+// maxHandshakeMessages bounds the messages read before the handshake with a
+// peer completes, or before it answers a request.
+const maxHandshakeMessages = 100
+
+// PeerConfig configures a PeerSource.
+type PeerConfig struct {
+	// Addr is the host:port of the peer.
+	Addr string
+
+	// Net is the network of the peer, wire.MainNet if zero.
+	Net wire.BitcoinNet
+
+	// HashAtHeight returns the hash of the block at a height of the best
+	// chain, which getcfheaders requests are made up to; typically the
+	// HashAtHeight of a lightmirror.MirrorChain.
+	HashAtHeight func(height int64) (chainhash.Hash, error)
+
+	// Dial opens the connection to Addr, the DialContext of a zero
+	// net.Dialer if nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// PeerSource is a lightmirror.CFHeadersSource fetching filter headers from
+// a BIP 157 peer.  Each fetch opens its own connection, shakes hands and
+// requests the range in getcfheaders requests of up to
+// wire.MaxCFHeadersPerMsg blocks.
+type PeerSource struct {
+	cfg PeerConfig
+}
+
+// NewPeerSource returns a PeerSource configured by cfg.
+func NewPeerSource(cfg PeerConfig) (*PeerSource, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("no peer address")
+	}
+	if cfg.HashAtHeight == nil {
+		return nil, errors.New("no block hash lookup")
+	}
+	if cfg.Net == 0 {
+		cfg.Net = wire.MainNet
+	}
+	if cfg.Dial == nil {
+		var d net.Dialer
+		cfg.Dial = d.DialContext
+	}
+	return &PeerSource{cfg: cfg}, nil
+}
+
+// FetchCFHeaders returns the regular filter headers of the blocks from start
+// to stop, inclusive.
+func (s *PeerSource) FetchCFHeaders(ctx context.Context, start, stop int64) (*lightmirror.CFHeaders, error) {
+	if start < 0 || stop < start || stop > int64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid filter header range %d to %d", start, stop)
+	}
+	conn, err := s.cfg.Dial(ctx, "tcp", s.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The connection is closed on cancellation, failing the read or
+	// write in progress.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	p := &peerConn{conn: conn, net: s.cfg.Net}
+	res, err := s.fetch(p, start, stop)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+func (s *PeerSource) fetch(p *peerConn, start, stop int64) (*lightmirror.CFHeaders, error) {
+	if err := p.handshake(); err != nil {
+		return nil, fmt.Errorf("peer %s: %w", s.cfg.Addr, err)
+	}
+
+	res := &lightmirror.CFHeaders{StartHeight: start}
+	var last chainhash.Hash
+	for from := start; from <= stop; {
+		to := from + wire.MaxCFHeadersPerMsg - 1
+		if to > stop {
+			to = stop
+		}
+		stopHash, err := s.cfg.HashAtHeight(to)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := p.getCFHeaders(uint32(from), stopHash)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", s.cfg.Addr, err)
+		}
+		if n := int64(len(msg.FilterHashes)); n != to-from+1 {
+			return nil, fmt.Errorf("peer %s: got %d filter hashes, want %d",
+				s.cfg.Addr, n, to-from+1)
+		}
+
+		// Each response goes on from the last header of the previous
+		// one.
+		if from == start {
+			res.PrevFilterHeader = msg.PrevFilterHeader
+		} else if msg.PrevFilterHeader != last {
+			return nil, fmt.Errorf("peer %s: filter header at height %d is "+
+				"%v, was %v: %w", s.cfg.Addr, from-1, msg.PrevFilterHeader,
+				last, lightmirror.ErrCFHeadersLinkage)
+		}
+		last = msg.PrevFilterHeader
+		for _, h := range msg.FilterHashes {
+			res.FilterHashes = append(res.FilterHashes, *h)
+			last = lightmirror.FilterHeader(*h, last)
+		}
+		from = to + 1
+	}
+	return res, nil
+}
+
+// peerConn is a connection to a peer speaking the Bitcoin P2P protocol.
+type peerConn struct {
+	conn net.Conn
+	net  wire.BitcoinNet
+}
+
+func (p *peerConn) write(msg wire.Message) error {
+	return wire.WriteMessage(p.conn, msg, wire.ProtocolVersion, p.net)
+}
+
+// read returns the next message of the peer, answering the pings and
+// skipping the messages of unknown commands.
+func (p *peerConn) read() (wire.Message, error) {
+	for i := 0; i < maxHandshakeMessages; i++ {
+		msg, _, err := wire.ReadMessage(p.conn, wire.ProtocolVersion, p.net)
+		var msgErr *wire.MessageError
+		if errors.As(err, &msgErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ping, ok := msg.(*wire.MsgPing); ok {
+			if err := p.write(wire.NewMsgPong(ping.Nonce)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+	return nil, errors.New("too many unexpected messages")
+}
+
+// handshake exchanges version and verack messages with the peer, which
+// must advertise wire.SFNodeCF.
+func (p *peerConn) handshake() error {
+	me := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+	you := wire.NewNetAddressIPPort(net.IPv4zero, 0, wire.SFNodeCF)
+	version := wire.NewMsgVersion(me, you, rand.Uint64(), 0)
+	version.DisableRelayTx = true
+	if err := p.write(version); err != nil {
+		return err
+	}
+
+	var gotVersion, gotVerAck bool
+	for !gotVersion || !gotVerAck {
+		msg, err := p.read()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			if msg.Services&wire.SFNodeCF == 0 {
+				return ErrNoFilterService
+			}
+			gotVersion = true
+			if err := p.write(wire.NewMsgVerAck()); err != nil {
+				return err
+			}
+		case *wire.MsgVerAck:
+			gotVerAck = true
+		}
+	}
+	return nil
+}
+
+// getCFHeaders requests the regular filter headers from the block at start
+// to the block stopHash and returns the answer of the peer.
+func (p *peerConn) getCFHeaders(start uint32, stopHash chainhash.Hash) (*wire.MsgCFHeaders, error) {
+	err := p.write(wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, start, &stopHash))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < maxHandshakeMessages; i++ {
+		msg, err := p.read()
+		if err != nil {
+			return nil, err
+		}
+		if cf, ok := msg.(*wire.MsgCFHeaders); ok && cf.StopHash == stopHash &&
+			cf.FilterType == wire.GCSFilterRegular {
+			return cf, nil
+		}
+	}
+	return nil, errors.New("no cfheaders answer")
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package cfheaders
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// testChain is a chain of n blocks whose block hashes and filter hashes are
+// derived from their height.
+type testChain struct {
+	n    int64
+	fork int64
+}
+
+func (c testChain) blockHash(height int64) chainhash.Hash {
+	return chainhash.DoubleHashH([]byte{'b', byte(height), byte(height >> 8)})
+}
+
+func (c testChain) hashAtHeight(height int64) (chainhash.Hash, error) {
+	if height >= c.n {
+		return chainhash.Hash{}, lightmirror.ErrHeightBeyondTip
+	}
+	return c.blockHash(height), nil
+}
+
+// filterHash returns the filter hash of the block at height, another one
+// from the height of the fork on, if any.
+func (c testChain) filterHash(height int64) chainhash.Hash {
+	h := chainhash.DoubleHashH([]byte{'f', byte(height), byte(height >> 8)})
+	if c.fork > 0 && height >= c.fork {
+		h[0] ^= 0xff
+	}
+	return h
+}
+
+// cfHeaders returns the filter headers of the chain from start to stop.
+func (c testChain) cfHeaders(start, stop int64) *lightmirror.CFHeaders {
+	res := &lightmirror.CFHeaders{StartHeight: start}
+	for height := int64(0); height <= stop; height++ {
+		if height < start {
+			res.PrevFilterHeader = lightmirror.FilterHeader(c.filterHash(height), res.PrevFilterHeader)
+			continue
+		}
+		res.FilterHashes = append(res.FilterHashes, c.filterHash(height))
+	}
+	return res
+}
+
+// servePeer plays a BIP 157 peer of chain on conn, advertising services.
+func servePeer(conn net.Conn, chain testChain, services wire.ServiceFlag) {
+	defer conn.Close()
+	write := func(msg wire.Message) error {
+		return wire.WriteMessage(conn, msg, wire.ProtocolVersion, wire.SimNet)
+	}
+	heights := make(map[chainhash.Hash]int64)
+	for height := int64(0); height < chain.n; height++ {
+		heights[chain.blockHash(height)] = height
+	}
+	for {
+		msg, _, err := wire.ReadMessage(conn, wire.ProtocolVersion, wire.SimNet)
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			you := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+			version := wire.NewMsgVersion(you, you, 1, int32(chain.n-1))
+			version.Services = services
+			// A ping comes first, which must be answered.
+			if write(wire.NewMsgPing(7)) != nil || write(version) != nil || write(wire.NewMsgVerAck()) != nil {
+				return
+			}
+		case *wire.MsgGetCFHeaders:
+			stop, ok := heights[msg.StopHash]
+			if !ok {
+				return
+			}
+			headers := chain.cfHeaders(int64(msg.StartHeight), stop)
+			resp := &wire.MsgCFHeaders{
+				FilterType:       msg.FilterType,
+				StopHash:         msg.StopHash,
+				PrevFilterHeader: headers.PrevFilterHeader,
+			}
+			for i := range headers.FilterHashes {
+				resp.AddCFHash(&headers.FilterHashes[i])
+			}
+			if write(resp) != nil {
+				return
+			}
+		}
+	}
+}
+
+// newTestPeerSource returns a PeerSource talking to a peer of chain, which
+// listens on the loopback interface until the end of the test.
+func newTestPeerSource(t *testing.T, chain testChain, services wire.ServiceFlag) *PeerSource {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go servePeer(conn, chain, services)
+		}
+	}()
+
+	s, err := NewPeerSource(PeerConfig{
+		Addr:         l.Addr().String(),
+		Net:          wire.SimNet,
+		HashAtHeight: chain.hashAtHeight,
+	})
+	if err != nil {
+		t.Fatalf("NewPeerSource error %v", err)
+	}
+	return s
+}
+
+func TestPeerSource(t *testing.T) {
+	chain := testChain{n: 2500}
+	s := newTestPeerSource(t, chain, wire.SFNodeNetwork|wire.SFNodeCF)
+	tests := []struct {
+		start, stop int64
+	}{
+		{0, 0},
+		{10, 20},
+		// More than a cfheaders message carries.
+		{100, 2400},
+	}
+	for i, test := range tests {
+		got, err := s.FetchCFHeaders(context.Background(), test.start, test.stop)
+		if err != nil {
+			t.Fatalf("FetchCFHeaders #%d error %v", i, err)
+		}
+		want := chain.cfHeaders(test.start, test.stop)
+		if got.StartHeight != want.StartHeight || got.PrevFilterHeader != want.PrevFilterHeader ||
+			len(got.FilterHashes) != len(want.FilterHashes) {
+			t.Fatalf("FetchCFHeaders #%d: got %d hashes from %d, want %d from %d", i,
+				len(got.FilterHashes), got.StartHeight, len(want.FilterHashes), want.StartHeight)
+		}
+		for j := range want.FilterHashes {
+			if got.FilterHashes[j] != want.FilterHashes[j] {
+				t.Fatalf("FetchCFHeaders #%d: hash %d is %v, want %v", i, j,
+					got.FilterHashes[j], want.FilterHashes[j])
+			}
+		}
+	}
+
+	if _, err := s.FetchCFHeaders(context.Background(), 10, 3000); !errors.Is(err, lightmirror.ErrHeightBeyondTip) {
+		t.Errorf("FetchCFHeaders beyond the tip: got error %v, want %v", err, lightmirror.ErrHeightBeyondTip)
+	}
+	s = newTestPeerSource(t, chain, wire.SFNodeNetwork)
+	if _, err := s.FetchCFHeaders(context.Background(), 0, 1); !errors.Is(err, ErrNoFilterService) {
+		t.Errorf("FetchCFHeaders: got error %v, want %v", err, ErrNoFilterService)
+	}
+	if _, err := NewPeerSource(PeerConfig{Addr: "peer:18555"}); err == nil {
+		t.Errorf("NewPeerSource: expected error without a block hash lookup")
+	}
+}
+
+func TestPeerSourceCancel(t *testing.T) {
+	chain := testChain{n: 10}
+	s, err := NewPeerSource(PeerConfig{
+		Addr:         "peer:18555",
+		HashAtHeight: chain.hashAtHeight,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// The peer never answers.
+			client, server := net.Pipe()
+			go func() {
+				var buf [1024]byte
+				for {
+					if _, err := server.Read(buf[:]); err != nil {
+						return
+					}
+				}
+			}()
+			return client, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPeerSource error %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	if _, err := s.FetchCFHeaders(ctx, 0, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("FetchCFHeaders: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCrossCheckSources(t *testing.T) {
+	// A peer and a URL following the same chain agree, a peer on a fork
+	// disagrees from the fork on.
+	chain := testChain{n: 50}
+	srv := newTestServer(t, chain)
+	h, err := NewHTTPSource(srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("NewHTTPSource error %v", err)
+	}
+	cc := lightmirror.NewCFHeadersCrossCheck(100)
+	cc.AddSource("peer", newTestPeerSource(t, chain, wire.SFNodeCF))
+	cc.AddSource("url", h)
+	cc.AddSource("fork", newTestPeerSource(t, testChain{n: 50, fork: 40}, wire.SFNodeCF))
+
+	check, err := cc.Check(context.Background(), 30, 49)
+	if err != nil {
+		t.Fatalf("Check error %v", err)
+	}
+	if len(check.SourceErrs) != 0 || len(check.Disagreements) != 10 || check.Disagreements[0].Height != 40 {
+		t.Fatalf("Check: got %+v, want disagreements from height 40", check)
+	}
+	d := check.Disagreements[0]
+	if d.Headers["peer"] != d.Headers["url"] || d.Headers["peer"] == d.Headers["fork"] {
+		t.Errorf("disagreement: got %+v", d)
+	}
+	want := chain.cfHeaders(30, 39).Headers()
+	for i := range want {
+		if check.Headers[i] != want[i] {
+			t.Errorf("Headers #%d: got %v, want %v", i, check.Headers[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// mockCFSource serves the filter headers of a chain whose filter hashes
+// are those of mockFilterHash.  Heights in fork are served with another
+// filter hash, and prev, when set, replaces the filter header preceding a
+// range.
+type mockCFSource struct {
+	fork map[int64]bool
+	prev *chainhash.Hash
+	fail error
+
+	mtx   sync.Mutex
+	calls int
+}
+
+// mockFilterHash returns the filter hash of the block at height.
+func mockFilterHash(height int64) chainhash.Hash {
+	return chainhash.DoubleHashH([]byte{byte(height), byte(height >> 8)})
+}
+
+func (s *mockCFSource) filterHash(height int64) chainhash.Hash {
+	h := mockFilterHash(height)
+	if s.fork[height] {
+		h[0] ^= 0xff
+	}
+	return h
+}
+
+func (s *mockCFSource) FetchCFHeaders(ctx context.Context, start, stop int64) (*CFHeaders, error) {
+	s.mtx.Lock()
+	s.calls++
+	s.mtx.Unlock()
+	if s.fail != nil {
+		return nil, s.fail
+	}
+	resp := &CFHeaders{StartHeight: start}
+	for height := int64(0); height <= stop; height++ {
+		if height < start {
+			resp.PrevFilterHeader = FilterHeader(s.filterHash(height), resp.PrevFilterHeader)
+			continue
+		}
+		resp.FilterHashes = append(resp.FilterHashes, s.filterHash(height))
+	}
+	if s.prev != nil {
+		resp.PrevFilterHeader = *s.prev
+	}
+	return resp, nil
+}
+
+func TestCFHeadersHeaders(t *testing.T) {
+	s := &mockCFSource{}
+	all, _ := s.FetchCFHeaders(context.Background(), 0, 3)
+	part, _ := s.FetchCFHeaders(context.Background(), 2, 3)
+	headers, partHeaders := all.Headers(), part.Headers()
+	if headers[0] != FilterHeader(mockFilterHash(0), chainhash.Hash{}) {
+		t.Errorf("Headers: got %v, want the genesis filter header", headers[0])
+	}
+	for i := range partHeaders {
+		if partHeaders[i] != headers[2+i] {
+			t.Errorf("Headers #%d: got %v, want %v", i, partHeaders[i], headers[2+i])
+		}
+	}
+}
+
+func TestCFHeadersCrossCheck(t *testing.T) {
+	ctx := context.Background()
+	errDown := errors.New("connection refused")
+	a, b, c := &mockCFSource{}, &mockCFSource{}, &mockCFSource{}
+	c.fork = map[int64]bool{7: true}
+	cc := NewCFHeadersCrossCheck(100)
+	cc.AddSource("a", a)
+	cc.AddSource("b", b)
+	cc.AddSource("c", c)
+
+	// The sources agree up to the fork of c, which also changes every
+	// header above it.
+	check, err := cc.Check(ctx, 0, 9)
+	if err != nil {
+		t.Fatalf("Check error %v", err)
+	}
+	if check.Agree() || len(check.SourceErrs) != 0 || len(check.Disagreements) != 3 {
+		t.Fatalf("Check: got %+v, want disagreements from height 7", check)
+	}
+	for i, d := range check.Disagreements {
+		if d.Height != int64(7+i) || d.Headers["a"] != d.Headers["b"] || d.Headers["a"] == d.Headers["c"] {
+			t.Errorf("disagreement #%d: got %+v", i, d)
+		}
+	}
+	if check.Headers[0] != FilterHeader(mockFilterHash(0), chainhash.Hash{}) || check.Headers[8] != (chainhash.Hash{}) {
+		t.Errorf("Headers: got %v", check.Headers)
+	}
+
+	// A range checked already is served by the cache.
+	calls := a.calls
+	if check, err := cc.Check(ctx, 2, 5); err != nil || !check.Agree() {
+		t.Errorf("Check cached: got %+v, error %v", check, err)
+	}
+	if a.calls != calls {
+		t.Errorf("Check cached: got %d calls, want %d", a.calls, calls)
+	}
+	if stats := cc.CacheStats(); stats.Hits != 3 || stats.Misses != 3 {
+		t.Errorf("CacheStats: got %+v, want 3 hits and 3 misses", stats)
+	}
+
+	// A source down, or serving headers which do not link, takes no part.
+	cc.Invalidate(5)
+	a.fail = errDown
+	wrong := chainhash.Hash{1}
+	b.prev = &wrong
+	check, err = cc.Check(ctx, 5, 6)
+	if err != nil {
+		t.Fatalf("Check error %v", err)
+	}
+	if !errors.Is(check.SourceErrs["a"], errDown) || !errors.Is(check.SourceErrs["b"], ErrCFHeadersLinkage) ||
+		check.Agree() || len(check.Disagreements) != 0 {
+		t.Errorf("Check: got %+v", check)
+	}
+	if want, _ := cc.cache.get(cfHeaderKey{"c", 5}); check.Headers[0] != want {
+		t.Errorf("Headers: got %v, want the headers of c", check.Headers)
+	}
+
+	cc.Invalidate(5)
+	c.fail = errDown
+	if _, err := cc.Check(ctx, 5, 6); !errors.Is(err, ErrNoCFHeadersSource) {
+		t.Errorf("Check: got error %v, want %v", err, ErrNoCFHeadersSource)
+	}
+	if _, err := cc.Check(ctx, 6, 5); err == nil {
+		t.Errorf("Check: expected error for an empty range")
+	}
+}
+
+func TestCFHeadersGenesisLinkage(t *testing.T) {
+	s := &mockCFSource{}
+	wrong := chainhash.Hash{1}
+	s.prev = &wrong
+	cc := NewCFHeadersCrossCheck(10)
+	cc.AddSource("s", s)
+	if _, err := cc.Check(context.Background(), 0, 2); !errors.Is(err, ErrNoCFHeadersSource) {
+		t.Errorf("Check: got error %v, want %v", err, ErrNoCFHeadersSource)
+	}
+}
+
+func TestCFHeadersAnnotate(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors[:2])
+	_, height := c.Tip()
+	s := &mockCFSource{}
+	forked := &mockCFSource{fork: map[int64]bool{height + 1: true}}
+	cc := NewCFHeadersCrossCheck(10)
+	cc.AddSource("s", s)
+	cc.AddSource("forked", forked)
+
+	tests := []struct {
+		name  string
+		m     *BtcLightMirrorV2
+		agree bool
+	}{
+		{"known", mirrors[1], true},
+		{"next", mirrors[2], false},
+		{"unknown", newTestMirror(chainhash.Hash{1}, 9, 0), true},
+	}
+	for _, test := range tests {
+		r := c.ValidateMirror(test.m)
+		if err := cc.Annotate(context.Background(), r); err != nil {
+			t.Fatalf("Annotate (%s) error %v", test.name, err)
+		}
+		if test.name == "unknown" {
+			if r.CFHeaders != nil {
+				t.Errorf("Annotate (%s): got %+v, want none", test.name, r.CFHeaders)
+			}
+			continue
+		}
+		if r.CFHeaders == nil || r.CFHeaders.Agree() != test.agree {
+			t.Errorf("Annotate (%s): got %+v, want agreement %v", test.name, r.CFHeaders, test.agree)
+		}
+		if r.Err() != nil {
+			t.Errorf("Err (%s): got %v, the check being advisory", test.name, r.Err())
+		}
+	}
+}
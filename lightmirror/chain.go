@@ -0,0 +1,796 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrDuplicateBlock is returned when appending a block the chain
+	// already knows.
+	ErrDuplicateBlock = errors.New("block already known")
+
+	// ErrUnknownParent is returned when appending a block whose parent
+	// the chain does not know.
+	ErrUnknownParent = errors.New("parent block is unknown")
+)
+
+// chainEntry is a block known to a MirrorChain, on the best chain or on a
+// side branch.
+type chainEntry struct {
+	hash   chainhash.Hash
+	height int64
+	header wire.BlockHeader
+	parent *chainEntry
+
+	// mirror is nil once the block is pruned, and until the body of a
+	// header-only block is attached.  An anchor created from a header
+	// alone has no mirror and counts as pruned.
+	mirror     *BtcLightMirrorV2
+	pruned     bool
+	headerOnly bool
+
+	// work is the cumulative work of the chain ending at this block,
+	// counted from the anchor, or from the work given to
+	// NewChainFromAnchor.
+	work *big.Int
+
+	// children holds the known blocks building on this one.
+	children []*chainEntry
+
+	// invalid is set on blocks marked invalid by InvalidateBlock and on
+	// all their descendants.
+	invalid bool
+
+	// seq orders the entries by arrival, to break ties between branches
+	// of equal work in favour of the first seen.
+	seq uint64
+}
+
+// mirrorCopy returns a copy of the mirror of the block, or nil if it has none.
+func (e *chainEntry) mirrorCopy() *BtcLightMirrorV2 {
+	if e.mirror == nil {
+		return nil
+	}
+	return e.mirror.Clone()
+}
+
+// bodyErr returns the error reported when the mirror of the block is asked
+// for: ErrPruned or ErrHeaderOnly if the block has no mirror, nil otherwise.
+func (e *chainEntry) bodyErr() error {
+	switch {
+	case e.pruned:
+		return ErrPruned
+	case e.headerOnly:
+		return ErrHeaderOnly
+	}
+	return nil
+}
+
+// ReorgEvent describes a switch of the best chain to another branch.
+type ReorgEvent struct {
+	// ForkHeight is the height of the last block shared by the old and
+	// the new best chain.
+	ForkHeight int64
+
+	// Disconnected holds the blocks removed from the best chain, newest
+	// first.  Header-only blocks are nil.
+	Disconnected []*BtcLightMirrorV2
+
+	// Connected holds the blocks added to the best chain, oldest first.
+	// Header-only blocks are nil.
+	Connected []*BtcLightMirrorV2
+
+	// Conflicts holds the blocks replaced by a block of the same height
+	// delegating differently, lowest first.
+	Conflicts []DelegationConflict
+}
+
+// ChainOption configures a MirrorChain.
+type ChainOption func(*chainConfig)
+
+type chainConfig struct {
+	params             *chaincfg.Params
+	powHash            PowHashFunc
+	signetChallenge    []byte
+	store              Store
+	pruneDepth         int64
+	subscriptionBuffer int
+	orphanPoolSize     int
+	orphanMaxAge       time.Duration
+	maxTipAge          time.Duration
+	timestampSkew      time.Duration
+	decode             DeserializeOptions
+	logger             Logger
+}
+
+// WithChainParams sets the network whose proof of work limit and difficulty
+// adjustment the chain enforces.  The default is the Bitcoin main network.
+func WithChainParams(params *chaincfg.Params) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.params = params
+	}
+}
+
+// WithMaxTxCount sets the most transactions a block of the network holds,
+// DefaultMaxTxCount by default, for networks with larger blocks than
+// Bitcoin's.  The chain decodes its snapshots with it, and DeserializeOptions
+// returns it for the decoding of its mirrors elsewhere.
+func WithMaxTxCount(n int) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.decode.MaxTxCount = n
+	}
+}
+
+// WithStore makes the chain persist its best chain in store, and resume from
+// the mirrors already stored there.
+func WithStore(store Store) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.store = store
+	}
+}
+
+// MirrorChain tracks the chain of mirrors with the most cumulative proof of
+// work building on a trusted anchor block, along with the side branches it
+// has seen.  It is safe for concurrent use: any number of readers may run
+// while one goroutine modifies the chain.
+type MirrorChain struct {
+	cfg  chainConfig
+	subs subscribers
+
+	// mtx protects all the fields below.
+	mtx    sync.RWMutex
+	anchor *chainEntry
+	tip    *chainEntry
+	index  map[chainhash.Hash]*chainEntry
+	best   *HeightIndex
+	seq    uint64
+
+	// pruneHeight is the height up to which the best chain is pruned.
+	pruneHeight int64
+
+	// conflicts are the last delegation conflicts of the best chain.
+	conflicts []DelegationConflict
+
+	orphans orphanPool
+}
+
+// NewMirrorChain returns a chain whose best chain starts at anchor, which is
+// trusted without validation of its proof of work.
+//
+// When the chain is configured with a store, the anchor is stored and the
+// mirrors stored above it are loaded back as long as they build on each
+// other.  Stored mirrors above the first gap or broken link are deleted.
+func NewMirrorChain(anchor *BtcLightMirrorV2, anchorHeight int64, opts ...ChainOption) (*MirrorChain, error) {
+	if err := anchor.CheckMerkle(); err != nil {
+		return nil, err
+	}
+	return newChain(&chainEntry{
+		hash:   anchor.BtcHeader.BlockHash(),
+		height: anchorHeight,
+		header: anchor.BtcHeader,
+		mirror: anchor.Clone(),
+		work:   blockchain.CalcWork(anchor.BtcHeader.Bits),
+	}, opts)
+}
+
+// newChain returns a chain anchored at entry, configured by opts.
+func newChain(entry *chainEntry, opts []ChainOption) (*MirrorChain, error) {
+	cfg := chainConfig{
+		params:             &chaincfg.MainNetParams,
+		subscriptionBuffer: defaultSubscriptionBuffer,
+		timestampSkew:      DefaultTimestampSkew,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.logger = orNopLogger(cfg.logger)
+	challenge, err := signetChallenge(cfg.params, cfg.signetChallenge)
+	if err != nil {
+		return nil, err
+	}
+	cfg.signetChallenge = challenge
+
+	anchorHeight := entry.height
+	if anchorHeight < 0 {
+		return nil, fmt.Errorf("invalid anchor height %d", anchorHeight)
+	}
+	if cfg.pruneDepth < 0 {
+		return nil, fmt.Errorf("invalid prune depth %d", cfg.pruneDepth)
+	}
+	if cfg.maxTipAge < 0 || cfg.timestampSkew < 0 {
+		return nil, fmt.Errorf("invalid maximum tip age %v or timestamp skew %v",
+			cfg.maxTipAge, cfg.timestampSkew)
+	}
+	if _, ok := cfg.store.(PruningStore); cfg.pruneDepth > 0 && cfg.store != nil && !ok {
+		return nil, errors.New("pruning requires a PruningStore")
+	}
+
+	c := &MirrorChain{
+		cfg:         cfg,
+		anchor:      entry,
+		tip:         entry,
+		index:       map[chainhash.Hash]*chainEntry{entry.hash: entry},
+		best:        newHeightIndex(anchorHeight),
+		pruneHeight: anchorHeight,
+		orphans:     newOrphanPool(cfg.orphanPoolSize, cfg.orphanMaxAge),
+	}
+	c.best.connect(entry.hash)
+
+	if cfg.store != nil {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.prune(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load stores the anchor and connects the stored mirrors building on it.
+// Pruned mirrors are loaded as pruned blocks, after checking their proof of
+// work.  An anchor created from a header alone is not stored.
+func (c *MirrorChain) load() error {
+	store := c.cfg.store
+	if c.anchor.mirror != nil {
+		_, _, err := store.ByHash(c.anchor.hash)
+		if errors.Is(err, ErrNotFound) {
+			err = store.Put(c.anchor.mirror, c.anchor.height)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for height := c.anchor.height + 1; ; height++ {
+		m, err := store.ByHeight(height)
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		var entry *chainEntry
+		switch {
+		case errors.Is(err, ErrPruned):
+			pruned, err := c.storedPruned(height)
+			if err != nil {
+				return err
+			}
+			header := &pruned.BtcHeader
+			hash := header.BlockHash()
+			if header.PrevBlock == c.tip.hash && c.checkProofOfWork(header, hash) == nil {
+				entry = c.newEntry(header, hash, nil, c.tip)
+				entry.pruned = true
+			}
+		case err != nil:
+			return err
+		case m.BtcHeader.PrevBlock == c.tip.hash:
+			hash := m.BtcHeader.BlockHash()
+			if c.checkMirror(m, hash) == nil {
+				entry = c.newEntry(&m.BtcHeader, hash, m, c.tip)
+			}
+		}
+		if entry == nil {
+			break
+		}
+		c.addEntry(entry)
+		c.best.connect(entry.hash)
+		c.tip = entry
+		if entry.pruned && c.pruneHeight == entry.height-1 {
+			c.pruneHeight = entry.height
+		}
+	}
+
+	// Drop whatever is stored above the loaded tip.  The store is empty
+	// if the anchor is not stored and nothing was appended yet.
+	_, storeTip, err := store.Tip()
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrPruned) {
+		return err
+	}
+	for height := storeTip; height > c.tip.height; height-- {
+		var hash chainhash.Hash
+		m, err := store.ByHeight(height)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			continue
+		case errors.Is(err, ErrPruned):
+			pruned, err := c.storedPruned(height)
+			if err != nil {
+				return err
+			}
+			hash = pruned.BtcHeader.BlockHash()
+		case err != nil:
+			return err
+		default:
+			hash = m.BtcHeader.BlockHash()
+		}
+		if err := store.Delete(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedPruned returns the pruned mirror the store holds at height.
+func (c *MirrorChain) storedPruned(height int64) (*PrunedMirror, error) {
+	store, ok := c.cfg.store.(PruningStore)
+	if !ok {
+		return nil, fmt.Errorf("store returned a pruned mirror at height "+
+			"%d but is not a PruningStore", height)
+	}
+	return store.PrunedByHeight(height)
+}
+
+// checkProofOfWork ensures the target encoded in the header bits is within
+// range and that the proof of work hash of the header under powHash, or its
+// block hash if powHash is nil, satisfies it.
+func checkProofOfWork(header *wire.BlockHeader, powLimit *big.Int, powHash PowHashFunc) error {
+	var hash chainhash.Hash
+	if powHash == nil {
+		hash = header.BlockHash()
+	} else {
+		hash = powHash(header)
+	}
+	return checkProofOfWorkHash(header, hash, powLimit)
+}
+
+// checkProofOfWork is checkProofOfWork under the parameters of the chain, for
+// a header whose block hash is known.
+func (c *MirrorChain) checkProofOfWork(header *wire.BlockHeader, hash chainhash.Hash) error {
+	return checkProofOfWorkHash(header, powHashOf(c.cfg.powHash, header, hash),
+		c.cfg.params.PowLimit)
+}
+
+// checkProofOfWorkHash is checkProofOfWork for a header whose proof of work
+// hash is known.
+func checkProofOfWorkHash(header *wire.BlockHeader, hash chainhash.Hash, powLimit *big.Int) error {
+	target, err := checkTarget(header, powLimit)
+	if err != nil {
+		return err
+	}
+	hashNum := blockchain.HashToBig(&hash)
+	if hashNum.Cmp(target) > 0 {
+		return fmt.Errorf("block hash of %064x is higher than "+
+			"expected max of %064x: %w", hashNum, target, ErrHashAboveTarget)
+	}
+	return nil
+}
+
+// checkTarget ensures the header bits are the canonical encoding of a
+// target within range, as CheckBitsCanonical does, and returns the target.
+func checkTarget(header *wire.BlockHeader, powLimit *big.Int) (*big.Int, error) {
+	if err := CheckBitsCanonical(header.Bits, powLimit); err != nil {
+		return nil, err
+	}
+	return blockchain.CompactToBig(header.Bits), nil
+}
+
+// checkMirror runs the context free validation of a mirror to append, whose
+// block hash is hash.
+func (c *MirrorChain) checkMirror(m *BtcLightMirrorV2, hash chainhash.Hash) error {
+	if err := c.checkMirrorWork(m, hash); err != nil {
+		return err
+	}
+	return m.CheckMerkle()
+}
+
+// checkMirrorWork checks the work of a mirror to append, whose block hash is
+// hash: its proof of work, or its solution on a signet.
+func (c *MirrorChain) checkMirrorWork(m *BtcLightMirrorV2, hash chainhash.Hash) error {
+	if c.cfg.signetChallenge != nil {
+		return checkSignet(m, hash, c.cfg.params, c.cfg.signetChallenge)
+	}
+	return c.checkProofOfWork(&m.BtcHeader, hash)
+}
+
+// newEntry returns the entry of a block with the given header and hash
+// building on parent.  A nil mirror makes an entry without body, which the
+// caller marks pruned or header-only.
+func (c *MirrorChain) newEntry(header *wire.BlockHeader, hash chainhash.Hash, m *BtcLightMirrorV2, parent *chainEntry) *chainEntry {
+	e := &chainEntry{
+		hash:    hash,
+		height:  parent.height + 1,
+		header:  *header,
+		parent:  parent,
+		work:    new(big.Int).Add(parent.work, blockchain.CalcWork(header.Bits)),
+		invalid: parent.invalid,
+	}
+	if m != nil {
+		e.mirror = m.Clone()
+	}
+	return e
+}
+
+// addEntry registers entry in the block index and with its parent.
+func (c *MirrorChain) addEntry(entry *chainEntry) {
+	c.seq++
+	entry.seq = c.seq
+	c.index[entry.hash] = entry
+	entry.parent.children = append(entry.parent.children, entry)
+}
+
+// Append validates the mirror and adds it to the chain.  The mirror becomes
+// the new tip when the chain ending at it has more cumulative work than the
+// current best chain; if that requires switching branches the returned
+// ReorgEvent describes the switch, otherwise it is nil.
+//
+// The chain keeps its own copy of the mirror.  When pruning is enabled, the
+// blocks going past the pruning depth are pruned once the mirror is added; if
+// that fails the error is returned along with the event of the append, which
+// did take effect, and pruning resumes with the next Append.
+//
+// With an orphan pool, a mirror whose parent is unknown is held in the pool
+// and ErrOrphan is returned instead of ErrUnknownParent.  The orphans
+// building on an appended block are appended right after it; the returned
+// ReorgEvent then describes the whole switch.
+func (c *MirrorChain) Append(m *BtcLightMirrorV2) (*ReorgEvent, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.append(m)
+}
+
+// AppendBatch appends the mirrors in order, as Append does, holding the lock
+// of the chain once for the whole batch.  It returns the ReorgEvents of the
+// appends that switched branches, in order.  Appending stops at the first
+// failing mirror; the mirrors before it remain appended.
+func (c *MirrorChain) AppendBatch(mirrors []*BtcLightMirrorV2) ([]*ReorgEvent, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var events []*ReorgEvent
+	for i, m := range mirrors {
+		event, err := c.append(m)
+		if event != nil {
+			events = append(events, event)
+		}
+		if err != nil {
+			return events, fmt.Errorf("mirror %d of batch: %w", i, err)
+		}
+	}
+	return events, nil
+}
+
+func (c *MirrorChain) append(m *BtcLightMirrorV2) (*ReorgEvent, error) {
+	return c.appendHeader(&m.BtcHeader, m)
+}
+
+// appendHeader adds the block with the given header to the chain, as a
+// header-only block if m is nil, along with the orphans waiting for it, then
+// prunes the chain.  The block hash is computed once here and reused by all
+// the steps of the append.
+func (c *MirrorChain) appendHeader(header *wire.BlockHeader, m *BtcLightMirrorV2) (*ReorgEvent, error) {
+	hash := header.BlockHash()
+	if _, ok := c.index[header.PrevBlock]; !ok && m != nil && c.orphans.enabled() {
+		if _, ok := c.index[hash]; !ok {
+			return nil, c.addOrphan(m, hash)
+		}
+	}
+
+	tip := c.tip
+	event, err := c.connect(header, hash, m)
+	if err != nil {
+		return nil, err
+	}
+	if c.adoptOrphans(hash) {
+		event = c.switchEvent(tip)
+	}
+	if err := c.prune(); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+// connect validates the block with the given header and hash and adds it to
+// the block index, switching the best chain to it if it has more work.
+func (c *MirrorChain) connect(header *wire.BlockHeader, hash chainhash.Hash, m *BtcLightMirrorV2) (*ReorgEvent, error) {
+	if e, ok := c.index[hash]; ok {
+		if e.invalid {
+			return nil, ErrInvalidBlock
+		}
+		return nil, ErrDuplicateBlock
+	}
+	parent, ok := c.index[header.PrevBlock]
+	if !ok {
+		return nil, ErrUnknownParent
+	}
+	if parent.invalid {
+		return nil, ErrInvalidBlock
+	}
+	if err := c.checkDifficulty(header, parent); err != nil {
+		c.cfg.logger.Warnf("rejected header %v: %v", hash, err)
+		return nil, err
+	}
+	if m != nil {
+		if err := c.checkMirror(m, hash); err != nil {
+			c.cfg.logger.Warnf("rejected block %v: %v", hash, err)
+			return nil, err
+		}
+	} else if err := c.checkProofOfWork(header, hash); err != nil {
+		c.cfg.logger.Warnf("rejected header %v: %v", hash, err)
+		return nil, err
+	}
+
+	entry := c.newEntry(header, hash, m, parent)
+	entry.headerOnly = m == nil
+	if entry.work.Cmp(c.tip.work) <= 0 {
+		// Side branch with no more work than the best chain.
+		c.addEntry(entry)
+		return nil, nil
+	}
+
+	event, err := c.setTip(entry)
+	if err != nil {
+		return nil, err
+	}
+	c.addEntry(entry)
+	return event, nil
+}
+
+// setTip makes entry the tip of the best chain, disconnecting the blocks of
+// the current best chain that are not its ancestors.  The store is updated
+// first so that a failing store leaves the in-memory chain untouched.
+func (c *MirrorChain) setTip(entry *chainEntry) (*ReorgEvent, error) {
+	// attach is ordered oldest first, detach newest first.
+	var attach []*chainEntry
+	fork := entry
+	for !c.inBestChain(fork) {
+		attach = append(attach, fork)
+		fork = fork.parent
+	}
+	for i, j := 0, len(attach)-1; i < j; i, j = i+1, j-1 {
+		attach[i], attach[j] = attach[j], attach[i]
+	}
+
+	var detach []*chainEntry
+	for e := c.tip; e != fork; e = e.parent {
+		if e.pruned {
+			return nil, fmt.Errorf("switching to block %v would "+
+				"disconnect block %v: %w", entry.hash, e.hash, ErrPruned)
+		}
+		detach = append(detach, e)
+	}
+
+	if err := c.switchStore(detach, attach); err != nil {
+		return nil, err
+	}
+
+	for range detach {
+		c.best.disconnect()
+	}
+	for _, e := range attach {
+		c.best.connect(e.hash)
+	}
+	c.tip = entry
+	conflicts := c.recordConflicts(detach, attach)
+	c.notifyTipChange(detach, attach, conflicts)
+
+	if len(detach) == 0 {
+		return nil, nil
+	}
+	c.cfg.logger.Infof("reorganized %d blocks at fork height %d, new tip %v "+
+		"at height %d", len(detach), fork.height, entry.hash, entry.height)
+	event := &ReorgEvent{ForkHeight: fork.height, Conflicts: conflicts}
+	for _, e := range detach {
+		event.Disconnected = append(event.Disconnected, e.mirrorCopy())
+	}
+	for _, e := range attach {
+		event.Connected = append(event.Connected, e.mirrorCopy())
+	}
+	return event, nil
+}
+
+// switchStore updates the store of the chain, if any, for a switch of the
+// best chain from the blocks of detach to those of attach.  A BatchStore
+// applies the switch in one transaction.  Any other store is written one
+// mirror at a time, and the writes already made are undone when one fails.
+func (c *MirrorChain) switchStore(detach, attach []*chainEntry) error {
+	store := c.cfg.store
+	if store == nil {
+		return nil
+	}
+	deletes := make([]chainhash.Hash, 0, len(detach))
+	for _, e := range detach {
+		deletes = append(deletes, e.hash)
+	}
+	var (
+		mirrors []*BtcLightMirrorV2
+		heights []int64
+	)
+	for _, e := range attach {
+		if e.headerOnly {
+			continue
+		}
+		mirrors = append(mirrors, e.mirror)
+		heights = append(heights, e.height)
+	}
+	if batch, ok := store.(BatchStore); ok {
+		return batch.WriteBatch(deletes, mirrors, heights)
+	}
+
+	var deleted []*chainEntry
+	for _, e := range detach {
+		err := store.Delete(e.hash)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			c.undoSwitch(deleted, nil)
+			return err
+		}
+		deleted = append(deleted, e)
+	}
+	for i, m := range mirrors {
+		if err := store.Put(m, heights[i]); err != nil {
+			c.undoSwitch(deleted, mirrors[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// undoSwitch undoes the writes of a failed switchStore: it deletes the
+// mirrors it put, then puts back the blocks it deleted, but for pruned
+// ones, whose mirror is gone.  Failures are only logged, as the error of the
+// switch is the one returned.
+func (c *MirrorChain) undoSwitch(deleted []*chainEntry, put []*BtcLightMirrorV2) {
+	store := c.cfg.store
+	for i := len(put) - 1; i >= 0; i-- {
+		hash := put[i].BtcHeader.BlockHash()
+		if err := store.Delete(hash); err != nil {
+			c.cfg.logger.Warnf("failed to undo the store write of block %v: %v", hash, err)
+		}
+	}
+	for _, e := range deleted {
+		if e.mirror == nil {
+			c.cfg.logger.Warnf("can not restore pruned block %v to the store", e.hash)
+			continue
+		}
+		if err := store.Put(e.mirror, e.height); err != nil {
+			c.cfg.logger.Warnf("failed to restore block %v to the store: %v", e.hash, err)
+		}
+	}
+}
+
+func (c *MirrorChain) inBestChain(e *chainEntry) bool {
+	height, err := c.best.HeightOfHash(e.hash)
+	return err == nil && height == e.height
+}
+
+// Anchor returns the anchor of the chain and its height.  The mirror is nil
+// for a chain created by NewChainFromAnchor.
+func (c *MirrorChain) Anchor() (*BtcLightMirrorV2, int64) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.anchor.mirrorCopy(), c.anchor.height
+}
+
+// Tip returns the tip of the best chain and its height.  The mirror is nil
+// while the tip is an anchor created by NewChainFromAnchor.
+func (c *MirrorChain) Tip() (*BtcLightMirrorV2, int64) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.tip.mirrorCopy(), c.tip.height
+}
+
+// ByHash returns the block with the given hash and its height, whether it is
+// on the best chain or on a side branch.  It returns ErrPruned or
+// ErrHeaderOnly, along with the height, for pruned and header-only blocks.
+func (c *MirrorChain) ByHash(hash chainhash.Hash) (*BtcLightMirrorV2, int64, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return nil, 0, ErrUnknownBlock
+	}
+	if err := e.bodyErr(); err != nil {
+		return nil, e.height, err
+	}
+	return e.mirror.Clone(), e.height, nil
+}
+
+// ByHeight returns the best chain block at the given height.  It returns
+// ErrPruned and ErrHeaderOnly for pruned and header-only blocks.
+func (c *MirrorChain) ByHeight(height int64) (*BtcLightMirrorV2, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	hash, err := c.best.HashAtHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	e := c.index[hash]
+	if err := e.bodyErr(); err != nil {
+		return nil, err
+	}
+	return e.mirror.Clone(), nil
+}
+
+// Iterate calls fn for every best chain block at a height in [start, end],
+// in height order, skipping pruned and header-only blocks.  The scan sees
+// the best chain as it was when Iterate was called, and fn may use the
+// chain.  Iteration stops at the first error returned by fn, which Iterate
+// returns unless it is ErrStopIteration.
+func (c *MirrorChain) Iterate(start, end int64, fn func(height int64, m *BtcLightMirrorV2) error) error {
+	type located struct {
+		height int64
+		mirror *BtcLightMirrorV2
+	}
+	var blocks []located
+	c.mtx.RLock()
+	if start < c.anchor.height {
+		start = c.anchor.height
+	}
+	if end > c.tip.height {
+		end = c.tip.height
+	}
+	for height := start; height <= end; height++ {
+		hash, _ := c.best.HashAtHeight(height)
+		if e := c.index[hash]; e.mirror != nil {
+			blocks = append(blocks, located{height, e.mirror})
+		}
+	}
+	c.mtx.RUnlock()
+
+	for _, b := range blocks {
+		if err := fn(b.height, b.mirror.Clone()); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// HashAtHeight returns the hash of the best chain block at height h.
+func (c *MirrorChain) HashAtHeight(h int64) (chainhash.Hash, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.best.HashAtHeight(h)
+}
+
+// HeightOfHash returns the height of the best chain block with the given
+// hash.  It returns ErrNotInBestChain for blocks only known on a side branch
+// and ErrUnknownBlock for blocks not known at all.
+func (c *MirrorChain) HeightOfHash(hash chainhash.Hash) (int64, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	height, err := c.best.HeightOfHash(hash)
+	if err != nil {
+		if _, ok := c.index[hash]; ok {
+			return 0, ErrNotInBestChain
+		}
+		return 0, err
+	}
+	return height, nil
+}
+
+// DeserializeOptions returns the options decoding the mirrors of the
+// network of the chain, as set by WithMaxTxCount.
+func (c *MirrorChain) DeserializeOptions() DeserializeOptions {
+	return c.cfg.decode
+}
+
+// HeightIndex returns a snapshot of the index of the best chain, which the
+// chain does not modify as blocks are appended: it is safe to use
+// concurrently with the chain, and describes the best chain as it was when
+// HeightIndex was called.  The copy takes time and memory linear in the
+// length of the chain; HashAtHeight and HeightOfHash look up a single block.
+func (c *MirrorChain) HeightIndex() *HeightIndex {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.best.clone()
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const testAnchorHeight = 100
+
+// newTestChain returns a regression test chain anchored at the first of the
+// mirrors, with the remaining mirrors appended.
+func newTestChain(t *testing.T, mirrors []*BtcLightMirrorV2, opts ...ChainOption) *MirrorChain {
+	t.Helper()
+	opts = append([]ChainOption{WithChainParams(&chaincfg.RegressionNetParams)}, opts...)
+	c, err := NewMirrorChain(mirrors[0], testAnchorHeight, opts...)
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	for i, m := range mirrors[1:] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i+1, err)
+		}
+	}
+	return c
+}
+
+// newTestBranch returns n linked mirrors building on parent, distinct from
+// any other branch created with a different seed.
+func newTestBranch(parent *BtcLightMirrorV2, seed uint32, n int) []*BtcLightMirrorV2 {
+	branch := make([]*BtcLightMirrorV2, 0, n)
+	prev := parent.BtcHeader.BlockHash()
+	for i := 0; i < n; i++ {
+		m := newTestMirror(prev, seed+uint32(i), 1)
+		branch = append(branch, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+	return branch
+}
+
+func TestChainAppend(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	c := newTestChain(t, mirrors)
+
+	tip, height := c.Tip()
+	if height != testAnchorHeight+4 || tip.BtcHeader.BlockHash() != mirrors[4].BtcHeader.BlockHash() {
+		t.Fatalf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+
+	tests := []struct {
+		name string
+		m    *BtcLightMirrorV2
+		err  error
+	}{
+		{"duplicate", mirrors[3], ErrDuplicateBlock},
+		{"unknown parent", newTestMirror(chainhash.Hash{1}, 50, 0), ErrUnknownParent},
+	}
+	for _, test := range tests {
+		if _, err := c.Append(test.m); !errors.Is(err, test.err) {
+			t.Errorf("Append %s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// Merkle and proof of work failures.
+	badMerkle := newTestMirror(mirrors[4].BtcHeader.BlockHash(), 60, 2)
+	badMerkle.MerkleNodes[0][0] ^= 0xff
+	if _, err := c.Append(badMerkle); err == nil {
+		t.Errorf("Append bad merkle: expected error")
+	}
+	badPow := newTestMirror(mirrors[4].BtcHeader.BlockHash(), 61, 0)
+	for {
+		badPow.BtcHeader.Nonce++
+		if checkProofOfWork(&badPow.BtcHeader, chaincfg.RegressionNetParams.PowLimit, nil) != nil {
+			break
+		}
+	}
+	if _, err := c.Append(badPow); err == nil {
+		t.Errorf("Append bad proof of work: expected error")
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+4 {
+		t.Errorf("Tip: got height %d after rejected appends", height)
+	}
+
+	// The chain keeps its own copy.
+	mirrors[4].CoinBaseTx.TxOut[0].Value++
+	tip, _ = c.Tip()
+	if tip.CoinBaseTx.TxOut[0].Value == mirrors[4].CoinBaseTx.TxOut[0].Value {
+		t.Errorf("Tip: mirror shares memory with the appended one")
+	}
+}
+
+func TestChainHeightIndex(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	c := newTestChain(t, mirrors)
+
+	for i, m := range mirrors {
+		hash := m.BtcHeader.BlockHash()
+		got, err := c.HashAtHeight(testAnchorHeight + int64(i))
+		if err != nil || got != hash {
+			t.Errorf("HashAtHeight #%d: got %v, %v, want %v", i, got, err, hash)
+		}
+		height, err := c.HeightOfHash(hash)
+		if err != nil || height != testAnchorHeight+int64(i) {
+			t.Errorf("HeightOfHash #%d: got %d, %v", i, height, err)
+		}
+		byHeight, err := c.ByHeight(height)
+		if err != nil || byHeight.BtcHeader.BlockHash() != hash {
+			t.Errorf("ByHeight #%d: got error %v", i, err)
+		}
+	}
+
+	if _, err := c.HashAtHeight(testAnchorHeight + 5); !errors.Is(err, ErrHeightBeyondTip) {
+		t.Errorf("HashAtHeight beyond tip: got error %v, want %v", err,
+			ErrHeightBeyondTip)
+	}
+	if _, err := c.HashAtHeight(testAnchorHeight - 1); !errors.Is(err, ErrHeightBeforeAnchor) {
+		t.Errorf("HashAtHeight before anchor: got error %v, want %v", err,
+			ErrHeightBeforeAnchor)
+	}
+	if _, err := c.HeightOfHash(chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("HeightOfHash unknown: got error %v, want %v", err,
+			ErrUnknownBlock)
+	}
+
+	// A side branch with less work is stored but not indexed.
+	side := newTestBranch(mirrors[2], 1000, 1)[0]
+	event, err := c.Append(side)
+	if err != nil || event != nil {
+		t.Fatalf("Append side branch: got %v, %v", event, err)
+	}
+	if _, err := c.HeightOfHash(side.BtcHeader.BlockHash()); !errors.Is(err, ErrNotInBestChain) {
+		t.Errorf("HeightOfHash side branch: got error %v, want %v", err,
+			ErrNotInBestChain)
+	}
+	if _, height, err := c.ByHash(side.BtcHeader.BlockHash()); err != nil || height != testAnchorHeight+3 {
+		t.Errorf("ByHash side branch: got height %d, error %v", height, err)
+	}
+
+	// The index handed out is a snapshot the chain does not modify.
+	idx := c.HeightIndex()
+	next := newTestBranch(mirrors[4], 2000, 1)[0]
+	if _, err := c.Append(next); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if got := idx.TipHeight(); got != testAnchorHeight+4 {
+		t.Errorf("HeightIndex snapshot: got tip height %d, want %d", got, testAnchorHeight+4)
+	}
+	if _, err := idx.HeightOfHash(next.BtcHeader.BlockHash()); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("HeightIndex snapshot: got error %v for a later block, want %v", err, ErrUnknownBlock)
+	}
+	if got := c.HeightIndex().TipHeight(); got != testAnchorHeight+5 {
+		t.Errorf("HeightIndex: got tip height %d, want %d", got, testAnchorHeight+5)
+	}
+}
+
+func TestChainReorg(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	store := newMemStore()
+	c := newTestChain(t, mirrors, WithStore(store))
+
+	// A branch forking after mirrors[2] that overtakes the best chain with
+	// its third block.
+	branch := newTestBranch(mirrors[2], 1000, 3)
+	for i, m := range branch[:2] {
+		event, err := c.Append(m)
+		if err != nil || event != nil {
+			t.Fatalf("Append branch #%d: got %v, %v", i, event, err)
+		}
+	}
+	event, err := c.Append(branch[2])
+	if err != nil {
+		t.Fatalf("Append branch #2 error %v", err)
+	}
+	if event == nil {
+		t.Fatalf("Append branch #2: expected a reorg event")
+	}
+
+	if event.ForkHeight != testAnchorHeight+2 {
+		t.Errorf("ReorgEvent: got fork height %d", event.ForkHeight)
+	}
+	if len(event.Disconnected) != 2 ||
+		event.Disconnected[0].BtcHeader.BlockHash() != mirrors[4].BtcHeader.BlockHash() ||
+		event.Disconnected[1].BtcHeader.BlockHash() != mirrors[3].BtcHeader.BlockHash() {
+
+		t.Errorf("ReorgEvent: wrong disconnected blocks")
+	}
+	if len(event.Connected) != 3 {
+		t.Fatalf("ReorgEvent: got %d connected blocks", len(event.Connected))
+	}
+	for i, m := range event.Connected {
+		if m.BtcHeader.BlockHash() != branch[i].BtcHeader.BlockHash() {
+			t.Errorf("ReorgEvent: wrong connected block #%d", i)
+		}
+	}
+
+	// The height index follows the new branch.
+	for i, m := range branch {
+		height := testAnchorHeight + 3 + int64(i)
+		hash, err := c.HashAtHeight(height)
+		if err != nil || hash != m.BtcHeader.BlockHash() {
+			t.Errorf("HashAtHeight(%d): got %v, %v", height, hash, err)
+		}
+		stored, err := store.ByHeight(height)
+		if err != nil || stored.BtcHeader.BlockHash() != m.BtcHeader.BlockHash() {
+			t.Errorf("store.ByHeight(%d): got error %v", height, err)
+		}
+	}
+	for _, m := range mirrors[3:] {
+		hash := m.BtcHeader.BlockHash()
+		if _, err := c.HeightOfHash(hash); !errors.Is(err, ErrNotInBestChain) {
+			t.Errorf("HeightOfHash disconnected: got error %v, want %v",
+				err, ErrNotInBestChain)
+		}
+		if _, _, err := store.ByHash(hash); !errors.Is(err, ErrNotFound) {
+			t.Errorf("store.ByHash disconnected: got error %v, want %v",
+				err, ErrNotFound)
+		}
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+5 {
+		t.Errorf("Tip: got height %d", height)
+	}
+}
+
+// TestChainReorgStoreFailure checks that a store failing in the middle of a
+// reorganization is left on the previous best chain, as the chain is.
+func TestChainReorgStoreFailure(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	store := newMemStore()
+	c := newTestChain(t, mirrors, WithStore(store))
+
+	branch := newTestBranch(mirrors[2], 1000, 3)
+	for i, m := range branch[:2] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append branch #%d error %v", i, err)
+		}
+	}
+	errPut := errors.New("put failed")
+	store.putErr, store.putsLeft = errPut, 1
+	if _, err := c.Append(branch[2]); !errors.Is(err, errPut) {
+		t.Fatalf("Append branch #2: got error %v, want %v", err, errPut)
+	}
+
+	if _, height := c.Tip(); height != testAnchorHeight+4 {
+		t.Errorf("Tip: got height %d, want %d", height, testAnchorHeight+4)
+	}
+	for i, m := range mirrors {
+		height := testAnchorHeight + int64(i)
+		stored, err := store.ByHeight(height)
+		if err != nil || stored.BtcHeader.BlockHash() != m.BtcHeader.BlockHash() {
+			t.Errorf("store.ByHeight(%d): got %v, error %v, want %v", height,
+				stored, err, m.BtcHeader.BlockHash())
+		}
+	}
+	if _, _, err := store.ByHash(branch[0].BtcHeader.BlockHash()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("store.ByHash of the branch: got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestChainReload(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	store := newMemStore()
+	newTestChain(t, mirrors, WithStore(store))
+
+	// Leave a stale mirror above a gap in the store.
+	stale := newTestMirror(chainhash.Hash{1}, 500, 0)
+	if err := store.Put(stale, testAnchorHeight+7); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+
+	c, err := NewMirrorChain(mirrors[0], testAnchorHeight,
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	tip, height := c.Tip()
+	if height != testAnchorHeight+4 || tip.BtcHeader.BlockHash() != mirrors[4].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+	if _, _, err := store.ByHash(stale.BtcHeader.BlockHash()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("store.ByHash stale: got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestChainAppendBatch(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	c := newTestChain(t, mirrors[:3])
+
+	// The batch overtakes the best chain with a branch, then fails on a
+	// mirror with an unknown parent.
+	branch := newTestBranch(mirrors[1], 1000, 3)
+	batch := append(branch, newTestMirror(chainhash.Hash{1}, 50, 0), mirrors[3])
+	events, err := c.AppendBatch(batch)
+	if !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("AppendBatch: got error %v, want %v", err, ErrUnknownParent)
+	}
+	if len(events) != 1 || events[0].ForkHeight != testAnchorHeight+1 {
+		t.Errorf("AppendBatch: got events %v", events)
+	}
+	tip, height := c.Tip()
+	if height != testAnchorHeight+4 || tip.BtcHeader.BlockHash() != branch[2].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+
+	if events, err := c.AppendBatch(mirrors[3:]); err != nil || len(events) != 1 {
+		t.Errorf("AppendBatch: got events %v, error %v", events, err)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+5 {
+		t.Errorf("Tip: got height %d", height)
+	}
+}
+
+func TestChainIterate(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	c := newTestChain(t, mirrors, WithPruneDepth(4))
+
+	var got []int64
+	err := c.Iterate(0, 1000, func(height int64, m *BtcLightMirrorV2) error {
+		if m.BtcHeader.BlockHash() != mirrors[height-testAnchorHeight].BtcHeader.BlockHash() {
+			t.Errorf("Iterate: wrong mirror at height %d", height)
+		}
+		got = append(got, height)
+		// The chain can be modified from fn.
+		if height == testAnchorHeight+2 {
+			if _, err := c.Rollback(2); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate error %v", err)
+	}
+	// Block 1 is pruned.
+	want := []int64{testAnchorHeight, testAnchorHeight + 2, testAnchorHeight + 3,
+		testAnchorHeight + 4, testAnchorHeight + 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Iterate: got heights %v, want %v", got, want)
+	}
+
+	calls := 0
+	err = c.Iterate(testAnchorHeight, testAnchorHeight+3, func(int64, *BtcLightMirrorV2) error {
+		calls++
+		return ErrStopIteration
+	})
+	if err != nil || calls != 1 {
+		t.Errorf("Iterate: got error %v after %d calls", err, calls)
+	}
+}
+
+// TestChainConcurrent runs readers against an appender, and is meant to be
+// run with the race detector.
+func TestChainConcurrent(t *testing.T) {
+	mirrors := newTestMirrors(200)
+	c := newTestChain(t, mirrors[:1], WithStore(newMemStore()), WithPruneDepth(50))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tip, height := c.Tip()
+				hash := tip.BtcHeader.BlockHash()
+				if _, got, err := c.ByHash(hash); err != nil || got != height {
+					// The tip may have been rolled back and
+					// forgotten, or pruned, meanwhile.
+					if !errors.Is(err, ErrUnknownBlock) && !errors.Is(err, ErrPruned) {
+						t.Errorf("ByHash tip: got height %d, error %v",
+							got, err)
+						return
+					}
+				}
+				c.ByHeight(height - 1)
+				c.HeightOfHash(hash)
+				c.FindForkPoint(c.BlockLocator())
+				c.Iterate(height-5, height, func(int64, *BtcLightMirrorV2) error {
+					return nil
+				})
+			}
+		}()
+	}
+
+	for i := 1; i < len(mirrors); i += 10 {
+		end := i + 10
+		if end > len(mirrors) {
+			end = len(mirrors)
+		}
+		for _, m := range mirrors[i:end] {
+			if _, err := c.Append(m); err != nil {
+				t.Errorf("Append error %v", err)
+			}
+		}
+		if _, err := c.Rollback(3); err != nil {
+			t.Errorf("Rollback error %v", err)
+		}
+		if _, err := c.AppendBatch(mirrors[end-3 : end]); err != nil {
+			t.Errorf("AppendBatch error %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if _, height := c.Tip(); height != testAnchorHeight+int64(len(mirrors))-1 {
+		t.Errorf("Tip: got height %d", height)
+	}
+}
+
+// BenchmarkChainAppend appends a thousand mirrors to a new chain.
+func BenchmarkChainAppend(b *testing.B) {
+	mirrors := newTestMirrors(1001)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, err := NewMirrorChain(mirrors[0], testAnchorHeight,
+			WithChainParams(&chaincfg.RegressionNetParams))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
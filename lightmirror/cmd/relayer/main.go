@@ -0,0 +1,263 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// relayer follows the best chain of a bitcoind node and submits the mirror
+// of every new block to the mirror registry contract of the Core chain:
+//
+//	relayer -bitcoind http://127.0.0.1:8332 -bitcoind-cookie ~/.bitcoin/.cookie \
+//	    -core https://rpc.coredao.org -contract 0x... -key relayer.key \
+//	    -state relayer.state -start 800000
+//
+// The key file holds the hex private key of the account paying for the
+// submissions, which the relayer must be the only one to use.  The state
+// file records the last mirror submitted, so that after a restart the
+// relayer goes on from there; -start is the height of the first mirror to
+// submit when it does not exist yet.  The relayer keeps its mirror chain in
+// memory, rebuilt on start from the block below -start on.
+//
+// With -peer, the relayer reads the blocks from a Bitcoin node over the
+// peer-to-peer protocol instead, with no bitcoind of its own; it first syncs
+// the headers of the whole chain from the node.
+//
+// With -zmq, the relayer also subscribes to the zmqpubrawblock
+// notifications of the node, relaying a block as soon as it is announced
+// rather than at the next poll.
+//
+// The relayer runs until it receives an interrupt or a SIGTERM.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/bitcoind"
+	"github.com/coredao-org/btcpowermirror/lightmirror/contract"
+	"github.com/coredao-org/btcpowermirror/lightmirror/p2p"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// stopTimeout is the time the relayer is given to complete its round when
+// it is stopped.
+const stopTimeout = 30 * time.Second
+
+// networks are the Bitcoin networks the relayer follows, by name.
+var networks = map[string]*chaincfg.Params{
+	"mainnet":  &chaincfg.MainNetParams,
+	"testnet3": &chaincfg.TestNet3Params,
+	"signet":   &chaincfg.SigNetParams,
+	"regtest":  &chaincfg.RegressionNetParams,
+}
+
+// config holds the command line flags.
+type config struct {
+	network string
+
+	bitcoindURL    string
+	bitcoindUser   string
+	bitcoindPass   string
+	bitcoindCookie string
+	zmq            string
+	peer           string
+
+	coreURL  string
+	contract string
+	keyFile  string
+	chainID  int64
+
+	statePath     string
+	start         int64
+	confirmations int64
+	maxPending    int
+	interval      time.Duration
+	maxBackoff    time.Duration
+	gasPrice      int64
+	debug         bool
+}
+
+func parseFlags() *config {
+	var cfg config
+	flag.StringVar(&cfg.network, "network", "mainnet", "Bitcoin network: mainnet, testnet3, signet or regtest")
+	flag.StringVar(&cfg.bitcoindURL, "bitcoind", "http://127.0.0.1:8332", "RPC URL of the bitcoind node")
+	flag.StringVar(&cfg.bitcoindUser, "bitcoind-user", "", "RPC user of the bitcoind node")
+	flag.StringVar(&cfg.bitcoindPass, "bitcoind-pass", "", "RPC password of the bitcoind node")
+	flag.StringVar(&cfg.bitcoindCookie, "bitcoind-cookie", "", "RPC cookie file of the bitcoind node, used without -bitcoind-user")
+	flag.StringVar(&cfg.peer, "peer", "", "address of a Bitcoin node to read the blocks from over the peer-to-peer protocol, instead of -bitcoind")
+	flag.StringVar(&cfg.zmq, "zmq", "", "zmqpubrawblock endpoint of the bitcoind node, such as tcp://127.0.0.1:28332")
+	flag.StringVar(&cfg.coreURL, "core", "", "RPC URL of the Core chain node")
+	flag.StringVar(&cfg.contract, "contract", "", "address of the mirror registry contract")
+	flag.StringVar(&cfg.keyFile, "key", "", "file of the hex private key paying for the submissions")
+	flag.Int64Var(&cfg.chainID, "chain-id", 0, "chain ID of the Core chain, asked to the node if 0")
+	flag.StringVar(&cfg.statePath, "state", "relayer.state", "file of the state of the relayer")
+	flag.Int64Var(&cfg.start, "start", 0, "height of the first mirror to submit without a state file")
+	flag.Int64Var(&cfg.confirmations, "confirmations", 1, "confirmations a block needs to be submitted, 1 for the tip")
+	flag.IntVar(&cfg.maxPending, "max-pending", 1, "submissions which may wait to be mined at once")
+	flag.DurationVar(&cfg.interval, "interval", 10*time.Second, "time between two rounds")
+	flag.DurationVar(&cfg.maxBackoff, "max-backoff", 5*time.Minute, "longest time between two rounds while rounds fail")
+	flag.Int64Var(&cfg.gasPrice, "gas-price", 0, "gas price in wei, the one suggested by the node if 0")
+	flag.BoolVar(&cfg.debug, "debug", false, "log every block fetched")
+	flag.Parse()
+	return &cfg
+}
+
+// quietLogger is a Logger dropping the debug events.
+type quietLogger struct {
+	lightmirror.Logger
+}
+
+func (quietLogger) Debugf(string, ...interface{}) {}
+
+func main() {
+	cfg := parseFlags()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, cfg *config) error {
+	logger := lightmirror.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags))
+	if !cfg.debug {
+		logger = quietLogger{logger}
+	}
+	params, ok := networks[cfg.network]
+	if !ok {
+		return fmt.Errorf("unknown network %q", cfg.network)
+	}
+	if cfg.start < 1 {
+		return errors.New("-start must be a positive height")
+	}
+	if !common.IsHexAddress(cfg.contract) {
+		return fmt.Errorf("invalid contract address %q", cfg.contract)
+	}
+
+	fetcher, err := newFetcher(cfg, params)
+	if err != nil {
+		return err
+	}
+	anchor, err := fetcher.FetchByHeight(ctx, cfg.start-1)
+	if err != nil {
+		return fmt.Errorf("anchor at height %d: %w", cfg.start-1, err)
+	}
+	chain, err := lightmirror.NewMirrorChain(anchor, cfg.start-1,
+		lightmirror.WithChainParams(params), lightmirror.WithLogger(logger))
+	if err != nil {
+		return err
+	}
+
+	backend, err := ethclient.DialContext(ctx, cfg.coreURL)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	opts, err := transactor(ctx, cfg, backend)
+	if err != nil {
+		return err
+	}
+	gasPrice := contract.SuggestedGasPrice
+	if cfg.gasPrice > 0 {
+		gasPrice = contract.FixedGasPrice(big.NewInt(cfg.gasPrice))
+	}
+
+	var source *bitcoind.ZMQSource
+	if cfg.zmq != "" {
+		source, err = bitcoind.NewZMQSource(bitcoind.ZMQConfig{Address: cfg.zmq, Logger: logger})
+		if err != nil {
+			return err
+		}
+		if err := source.Start(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancel()
+			source.Stop(stopCtx)
+		}()
+	}
+
+	rcfg := contract.RelayerConfig{
+		Fetcher:       lightmirror.NewCachingFetcher(fetcher, 100),
+		Chain:         chain,
+		Backend:       backend,
+		Contract:      common.HexToAddress(cfg.contract),
+		Opts:          opts,
+		StartHeight:   cfg.start,
+		StatePath:     cfg.statePath,
+		Confirmations: cfg.confirmations,
+		GasPrice:      gasPrice,
+		MaxPending:    cfg.maxPending,
+		Interval:      cfg.interval,
+		MaxBackoff:    cfg.maxBackoff,
+		Logger:        logger,
+	}
+	if source != nil {
+		rcfg.Source = source
+	}
+	r, err := contract.NewRelayer(rcfg)
+	if err != nil {
+		return err
+	}
+	if err := r.Start(ctx); err != nil {
+		return err
+	}
+	logger.Infof("relaying %s blocks from height %d to contract %s from %s",
+		params.Name, r.LastSubmitted()+1, cfg.contract, opts.From.Hex())
+
+	<-ctx.Done()
+	logger.Infof("stopping")
+	stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return r.Stop(stopCtx)
+}
+
+// newFetcher returns the fetcher of the blocks of -peer, or else of
+// -bitcoind.
+func newFetcher(cfg *config, params *chaincfg.Params) (lightmirror.Fetcher, error) {
+	if cfg.peer != "" {
+		return p2p.NewFetcher(p2p.Config{Address: cfg.peer, Params: params})
+	}
+	return bitcoind.NewFetcher(bitcoind.Config{
+		URL:        cfg.bitcoindURL,
+		User:       cfg.bitcoindUser,
+		Password:   cfg.bitcoindPass,
+		CookieFile: cfg.bitcoindCookie,
+	})
+}
+
+// transactor returns the transactor of the key of -key on the Core chain.
+func transactor(ctx context.Context, cfg *config, backend *ethclient.Client) (*bind.TransactOpts, error) {
+	if cfg.keyFile == "" {
+		return nil, errors.New("-key is required")
+	}
+	data, err := ioutil.ReadFile(cfg.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", cfg.keyFile, err)
+	}
+	chainID := big.NewInt(cfg.chainID)
+	if cfg.chainID == 0 {
+		if chainID, err = backend.ChainID(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return bind.NewKeyedTransactorWithChainID(key, chainID)
+}
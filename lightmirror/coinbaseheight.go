@@ -0,0 +1,74 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// maxHeightPushSize is the size of the longest push of a block height, a
+// positive script number of 4 bytes followed by a sign byte.
+const maxHeightPushSize = 5
+
+// ErrInvalidCoinbaseHeight is wrapped by the errors of CoinbaseHeight for a
+// coinbase whose input script does not start with a block height encoded as
+// BIP 34 requires.
+var ErrInvalidCoinbaseHeight = errors.New("invalid coinbase height")
+
+// CoinbaseHeight returns the height of the block of the mirror, which BIP 34
+// requires the input script of the coinbase to start with.  The height is
+// pushed the way Bitcoin Core serializes it: OP_0 for 0, OP_1 to OP_16 for
+// 1 to 16, and otherwise a push of its shortest little-endian script number
+// encoding.  Any other encoding, which a block enforcing BIP 34 can not
+// carry, fails with ErrInvalidCoinbaseHeight.  The blocks mined before
+// BIP 34 activated may carry anything there.
+func (light *BtcLightMirrorV2) CoinbaseHeight() (int64, error) {
+	tx := light.Coinbase()
+	if len(tx.TxIn) == 0 || tx.TxIn[0] == nil {
+		return 0, fmt.Errorf("coinbase has no input: %w", ErrInvalidCoinbaseHeight)
+	}
+	script := tx.TxIn[0].SignatureScript
+	if len(script) == 0 {
+		return 0, fmt.Errorf("empty input script: %w", ErrInvalidCoinbaseHeight)
+	}
+
+	op := script[0]
+	switch {
+	case op == txscript.OP_0:
+		return 0, nil
+	case op >= txscript.OP_1 && op <= txscript.OP_16:
+		return int64(op - (txscript.OP_1 - 1)), nil
+	case op > maxHeightPushSize:
+		return 0, fmt.Errorf("input script starts with opcode 0x%02x: %w",
+			op, ErrInvalidCoinbaseHeight)
+	}
+	data := script[1:]
+	if len(data) < int(op) {
+		return 0, fmt.Errorf("push of %d bytes truncated to %d: %w",
+			op, len(data), ErrInvalidCoinbaseHeight)
+	}
+	data = data[:op]
+
+	last := data[len(data)-1]
+	if last&0x80 != 0 {
+		return 0, fmt.Errorf("negative height %x: %w", data, ErrInvalidCoinbaseHeight)
+	}
+	// The shortest encoding ends with a zero byte only when it holds the
+	// sign bit of the byte before.
+	if last == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("height %x not minimally encoded: %w", data, ErrInvalidCoinbaseHeight)
+	}
+	var height int64
+	for i := len(data) - 1; i >= 0; i-- {
+		height = height<<8 | int64(data[i])
+	}
+	if height <= 16 {
+		return 0, fmt.Errorf("height %d pushed as data: %w", height, ErrInvalidCoinbaseHeight)
+	}
+	return height, nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestCoinbaseHeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []byte
+		height int64
+		valid  bool
+	}{
+		{"zero", []byte{0x00}, 0, true},
+		{"one", []byte{0x51, 0x00}, 1, true},
+		{"sixteen", []byte{0x60}, 16, true},
+		{"seventeen", []byte{0x01, 0x11}, 17, true},
+		{"sign byte", []byte{0x02, 0xff, 0x00}, 255, true},
+		{"mainnet 840000", []byte{0x03, 0x40, 0xd1, 0x0c, 0xde, 0xad, 0xbe, 0xef}, 840000, true},
+		{"four bytes", []byte{0x04, 0x00, 0x00, 0x00, 0x40}, 1 << 30, true},
+		{"five bytes", []byte{0x05, 0x00, 0x00, 0x00, 0x80, 0x00}, 1 << 31, true},
+		{"empty", nil, 0, false},
+		{"small pushed", []byte{0x01, 0x05}, 0, false},
+		{"zero pushed", []byte{0x01, 0x00}, 0, false},
+		{"not minimal", []byte{0x02, 0x11, 0x00}, 0, false},
+		{"negative", []byte{0x01, 0x91}, 0, false},
+		{"truncated", []byte{0x03, 0x40, 0xd1}, 0, false},
+		{"too long", []byte{0x06, 1, 2, 3, 4, 5, 6}, 0, false},
+		{"OP_1NEGATE", []byte{0x4f}, 0, false},
+		{"OP_PUSHDATA1", []byte{0x4c, 0x01, 0x11}, 0, false},
+	}
+	for _, test := range tests {
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		m.CoinBaseTx.TxIn[0].SignatureScript = test.script
+		height, err := m.CoinbaseHeight()
+		if !test.valid {
+			if !errors.Is(err, ErrInvalidCoinbaseHeight) {
+				t.Errorf("CoinbaseHeight (%s): got %d, error %v, want %v", test.name,
+					height, err, ErrInvalidCoinbaseHeight)
+			}
+			continue
+		}
+		if err != nil || height != test.height {
+			t.Errorf("CoinbaseHeight (%s): got %d, error %v, want %d", test.name,
+				height, err, test.height)
+		}
+	}
+
+	m := &BtcLightMirrorV2{CoinBaseTx: wire.MsgTx{TxIn: []*wire.TxIn{nil}}}
+	if _, err := m.CoinbaseHeight(); !errors.Is(err, ErrInvalidCoinbaseHeight) {
+		t.Errorf("CoinbaseHeight of a nil input: got error %v, want %v", err, ErrInvalidCoinbaseHeight)
+	}
+	if _, err := new(BtcLightMirrorV2).CoinbaseHeight(); !errors.Is(err, ErrInvalidCoinbaseHeight) {
+		t.Errorf("CoinbaseHeight without input: got error %v, want %v", err, ErrInvalidCoinbaseHeight)
+	}
+
+	_, v, err := LoadVector("regtest-core")
+	if err != nil {
+		t.Fatalf("LoadVector error %v", err)
+	}
+	if height, err := v.CoinbaseHeight(); err != nil || height != 1 {
+		t.Errorf("CoinbaseHeight of the regtest-core vector: got %d, error %v, want 1", height, err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// commitmentSize is the size of the packed commitment fields.
+const commitmentSize = 32 + common.AddressLength + common.AddressLength + 32
+
+// ErrNoPowerParams is returned when the coinbase of a mirror carries no
+// CORE output nor CORE witness item.
+var ErrNoPowerParams = errors.New("coinbase has no power parameters")
+
+// CommitmentHash returns the key under which the registry contract stores
+// the mirror, computed as the contract does:
+//
+//	keccak256(abi.encodePacked(headerHash, candidate, reward, coreBlockHash))
+//
+// The fields are packed in this order without padding, 104 bytes in all:
+//
+//	headerHash     bytes32, the double SHA-256 of the header as Solidity
+//	               computes it, which is the internal byte order of
+//	               chainhash.Hash and the reverse of the displayed hash
+//	candidate      address, the 20 bytes of the coinbase as is
+//	reward         address, the 20 bytes of the coinbase as is
+//	coreBlockHash  bytes32, the 32 bytes of the coinbase as is, zero when
+//	               the CORE output does not carry it
+//
+// The power parameters are those ParsePowerParams returns.  It returns
+// ErrNoPowerParams when the coinbase has none.
+func (light *BtcLightMirrorV2) CommitmentHash() (common.Hash, error) {
+	candidate, reward, coreBlockHash, ok := light.powerParams()
+	if !ok {
+		return common.Hash{}, ErrNoPowerParams
+	}
+	headerHash := light.BtcHeader.BlockHash()
+
+	packed := make([]byte, 0, commitmentSize)
+	packed = append(packed, headerHash[:]...)
+	packed = append(packed, candidate[:]...)
+	packed = append(packed, reward[:]...)
+	packed = append(packed, coreBlockHash[:]...)
+	return crypto.Keccak256Hash(packed), nil
+}
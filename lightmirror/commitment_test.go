@@ -0,0 +1,93 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// corePkScript returns the pkScript of a CORE output carrying the given
+// power parameters.
+func corePkScript(candidate, reward common.Address, coreBlockHash []byte) []byte {
+	script := []byte{0x6a, byte(5 + 2*common.AddressLength + len(coreBlockHash))}
+	script = append(script, powerMagicString...)
+	script = append(script, 0x01)
+	script = append(script, candidate[:]...)
+	script = append(script, reward[:]...)
+	return append(script, coreBlockHash...)
+}
+
+func TestCommitmentHash(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.FromHex("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f" +
+		"8091a2b3c4d5e6f708192a3b4c5d6e7f")
+
+	// The expected hashes are the storage keys the registry contract
+	// computes for the first block after the main network genesis block
+	// carrying these power parameters.
+	tests := []struct {
+		name   string
+		txOuts []*wire.TxOut
+		want   string
+		err    error
+	}{
+		{
+			name: "core block hash",
+			txOuts: []*wire.TxOut{
+				{Value: 5000000000, PkScript: []byte{0x51}},
+				{PkScript: []byte{0x6a, 0x04, 0xde, 0xad, 0xbe, 0xef}},
+				{PkScript: corePkScript(candidate, reward, coreBlockHash)},
+			},
+			want: "0x30618e5905b30f055141da413b76f8584fa279433caa8d3f9075bbf7dc9111a6",
+		},
+		{
+			name: "no core block hash",
+			txOuts: []*wire.TxOut{
+				{Value: 5000000000, PkScript: []byte{0x51}},
+				{PkScript: corePkScript(candidate, reward, nil)},
+			},
+			want: "0xc83726c3fe1f4bb426b067a79355aa1f28b04116e43d194fbcd849b666e0f0ff",
+		},
+		{
+			name: "core output first",
+			txOuts: []*wire.TxOut{
+				{PkScript: corePkScript(candidate, reward, coreBlockHash)},
+			},
+			err: ErrNoPowerParams,
+		},
+		{
+			name: "truncated core output",
+			txOuts: []*wire.TxOut{
+				{Value: 5000000000, PkScript: []byte{0x51}},
+				{PkScript: corePkScript(candidate, reward, nil)[:40]},
+			},
+			err: ErrNoPowerParams,
+		},
+		{
+			name: "no outputs",
+			err:  ErrNoPowerParams,
+		},
+	}
+
+	for _, test := range tests {
+		m := mainNetBlock1(t)
+		m.CoinBaseTx.TxOut = test.txOuts
+		got, err := m.CommitmentHash()
+		if !errors.Is(err, test.err) {
+			t.Errorf("CommitmentHash (%s): got error %v, want %v", test.name,
+				err, test.err)
+			continue
+		}
+		if test.err == nil && got != common.HexToHash(test.want) {
+			t.Errorf("CommitmentHash (%s): got %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// newTestMirror returns a mirror building on prev whose coinbase is made
+// unique by seed.  The block carries extraTxs transactions besides the
+// coinbase.  The mirror is valid on the regression test network.
+func newTestMirror(prev chainhash.Hash, seed uint32, extraTxs int) *BtcLightMirrorV2 {
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{
+			{
+				PreviousOutPoint: wire.OutPoint{
+					Index: 0xffffffff,
+				},
+				SignatureScript: []byte{
+					0x04, byte(seed), byte(seed >> 8),
+					byte(seed >> 16), byte(seed >> 24),
+				},
+				Sequence: 0xffffffff,
+			},
+		},
+		TxOut: []*wire.TxOut{
+			{
+				Value:    5000000000,
+				PkScript: []byte{0x51}, // OP_TRUE
+			},
+		},
+	}
+
+	transactions := []chainhash.Hash{coinBaseTx.TxHash()}
+	for i := 0; i < extraTxs; i++ {
+		var tx chainhash.Hash
+		tx[0] = byte(i + 1)
+		tx[1] = byte(seed)
+		transactions = append(transactions, tx)
+	}
+	merkles := BuildMerkleTreeStore(&transactions[0], transactions[1:])
+
+	header := &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  prev,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1231006505+int64(seed)*600, 0),
+		Bits:       0x207fffff,
+	}
+	solveTestHeader(header)
+	return CreateBtcLightMirrorV2(header, coinBaseTx, transactions)
+}
+
+// newDelegatingMirror returns a mirror building on prev whose coinbase
+// delegates to candidate, its rewards going to reward.
+func newDelegatingMirror(prev chainhash.Hash, seed uint32, candidate, reward common.Address) *BtcLightMirrorV2 {
+	m := newTestMirror(prev, seed, 0)
+	m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, corePkScript(candidate, reward, nil)))
+	m.BtcHeader.MerkleRoot = m.CoinBaseTx.TxHash()
+	solveTestHeader(&m.BtcHeader)
+	return m
+}
+
+// solveTestHeader searches a nonce satisfying the proof of work of header.
+// On the regression test network every other nonce does.
+func solveTestHeader(header *wire.BlockHeader) {
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+		header.Nonce++
+	}
+}
+
+// newTestMirrors returns n linked mirrors, the first one building on the zero
+// hash.
+func newTestMirrors(n int) []*BtcLightMirrorV2 {
+	mirrors := make([]*BtcLightMirrorV2, 0, n)
+	var prev chainhash.Hash
+	for i := 0; i < n; i++ {
+		m := newTestMirror(prev, uint32(i), i%4)
+		mirrors = append(mirrors, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+	return mirrors
+}
+
+// memStore is a minimal PruningStore and MigratableStore used by the tests.
+// Like the real stores it keeps serialized mirrors, so every lookup returns a
+// fresh struct.
+type memStore struct {
+	mtx      sync.Mutex
+	byHash   map[chainhash.Hash][]byte
+	heights  map[chainhash.Hash]int64
+	byHeight map[int64]chainhash.Hash
+
+	// lookups counts the calls to ByHash, ByHeight and Tip.
+	lookups int
+
+	// pruneErr, when set, is returned by Prune.
+	pruneErr error
+
+	// putErr, when set, is returned once by Put, after putsLeft more
+	// calls have succeeded.
+	putErr   error
+	putsLeft int
+
+	// progress is the migration progress, if hasProgress.
+	progress    int64
+	hasProgress bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		byHash:   make(map[chainhash.Hash][]byte),
+		heights:  make(map[chainhash.Hash]int64),
+		byHeight: make(map[int64]chainhash.Hash),
+	}
+}
+
+func (s *memStore) Put(m *BtcLightMirrorV2, height int64) error {
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		return err
+	}
+	hash := m.BtcHeader.BlockHash()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.putErr != nil {
+		if s.putsLeft == 0 {
+			err := s.putErr
+			s.putErr = nil
+			return err
+		}
+		s.putsLeft--
+	}
+	if old, ok := s.byHeight[height]; ok && old != hash {
+		delete(s.byHash, old)
+		delete(s.heights, old)
+	}
+	if old, ok := s.heights[hash]; ok && old != height {
+		delete(s.byHeight, old)
+	}
+	s.byHash[hash] = buf.Bytes()
+	s.heights[hash] = height
+	s.byHeight[height] = hash
+	return nil
+}
+
+func (s *memStore) decode(hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	data, ok := s.byHash[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if len(data) == PrunedMirrorSize {
+		return nil, ErrPruned
+	}
+	m := new(BtcLightMirrorV2)
+	if err := m.Deserialize(bytes.NewReader(data)); err != nil {
+		return nil, &CorruptRecordError{Key: hash[:], Err: err}
+	}
+	return m, nil
+}
+
+func (s *memStore) ByHash(hash chainhash.Hash) (*BtcLightMirrorV2, int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lookups++
+	m, err := s.decode(hash)
+	if err != nil {
+		return nil, s.heights[hash], err
+	}
+	return m, s.heights[hash], nil
+}
+
+func (s *memStore) ByHeight(height int64) (*BtcLightMirrorV2, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lookups++
+	hash, ok := s.byHeight[height]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.decode(hash)
+}
+
+func (s *memStore) Tip() (*BtcLightMirrorV2, int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lookups++
+	if len(s.byHeight) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	tip := int64(-1)
+	for height := range s.byHeight {
+		if height > tip {
+			tip = height
+		}
+	}
+	m, err := s.decode(s.byHeight[tip])
+	if err != nil {
+		return nil, tip, err
+	}
+	return m, tip, nil
+}
+
+func (s *memStore) Delete(hash chainhash.Hash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	height, ok := s.heights[hash]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.byHash, hash)
+	delete(s.heights, hash)
+	delete(s.byHeight, height)
+	return nil
+}
+
+func (s *memStore) Iterate(start, end int64, fn func(height int64, m *BtcLightMirrorV2) error) error {
+	var heights []int64
+	var mirrors []*BtcLightMirrorV2
+	s.mtx.Lock()
+	for height, hash := range s.byHeight {
+		if height < start || height > end {
+			continue
+		}
+		m, err := s.decode(hash)
+		if errors.Is(err, ErrPruned) {
+			continue
+		}
+		if err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+		heights = append(heights, height)
+		mirrors = append(mirrors, m)
+	}
+	s.mtx.Unlock()
+
+	sort.Sort(byHeight{heights, mirrors})
+	for i, m := range mirrors {
+		if err := fn(heights[i], m); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// byHeight sorts mirrors along with their heights.
+type byHeight struct {
+	heights []int64
+	mirrors []*BtcLightMirrorV2
+}
+
+func (s byHeight) Len() int           { return len(s.heights) }
+func (s byHeight) Less(i, j int) bool { return s.heights[i] < s.heights[j] }
+func (s byHeight) Swap(i, j int) {
+	s.heights[i], s.heights[j] = s.heights[j], s.heights[i]
+	s.mirrors[i], s.mirrors[j] = s.mirrors[j], s.mirrors[i]
+}
+
+func (s *memStore) Prune(hash chainhash.Hash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.pruneErr != nil {
+		return s.pruneErr
+	}
+	data, ok := s.byHash[hash]
+	if !ok {
+		return ErrNotFound
+	}
+	s.byHash[hash] = data[:PrunedMirrorSize]
+	return nil
+}
+
+func (s *memStore) PrunedByHeight(height int64) (*PrunedMirror, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	hash, ok := s.byHeight[height]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	pruned := new(PrunedMirror)
+	if err := pruned.Deserialize(bytes.NewReader(s.byHash[hash])); err != nil {
+		return nil, &CorruptRecordError{Key: hash[:], Err: err}
+	}
+	return pruned, nil
+}
+
+func (s *memStore) IterateRecords(start, end int64, fn func(height int64, hash chainhash.Hash, record []byte) error) error {
+	s.mtx.Lock()
+	var heights []int64
+	for height := range s.byHeight {
+		if height >= start && height <= end {
+			heights = append(heights, height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	hashes := make([]chainhash.Hash, len(heights))
+	records := make([][]byte, len(heights))
+	for i, height := range heights {
+		hashes[i] = s.byHeight[height]
+		records[i] = s.byHash[hashes[i]]
+	}
+	s.mtx.Unlock()
+
+	for i, height := range heights {
+		if err := fn(height, hashes[i], records[i]); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) PutMigrated(mirrors []*BtcLightMirrorV2, heights []int64, progress int64) error {
+	records := make([][]byte, len(mirrors))
+	for i, m := range mirrors {
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil {
+			return err
+		}
+		records[i] = buf.Bytes()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, m := range mirrors {
+		if s.byHeight[heights[i]] != m.BtcHeader.BlockHash() {
+			return ErrNotFound
+		}
+	}
+	for i, m := range mirrors {
+		s.byHash[m.BtcHeader.BlockHash()] = records[i]
+	}
+	s.progress, s.hasProgress = progress, true
+	return nil
+}
+
+func (s *memStore) MigrationProgress() (int64, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.progress, s.hasProgress, nil
+}
+
+// putRecord stores record, undecoded, as the mirror of hash at height.
+func (s *memStore) putRecord(hash chainhash.Hash, height int64, record []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.byHash[hash] = record
+	s.heights[hash] = height
+	s.byHeight[height] = hash
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// batchMemStore is a memStore which is also a BatchStore.  A batch reaching
+// the Put failure of the memStore fails as a whole, leaving it unchanged.
+type batchMemStore struct {
+	*memStore
+
+	// batches counts the calls to WriteBatch.
+	batches int
+}
+
+func (s *batchMemStore) WriteBatch(deletes []chainhash.Hash, mirrors []*BtcLightMirrorV2, heights []int64) error {
+	s.mtx.Lock()
+	s.batches++
+	if s.putErr != nil && s.putsLeft < len(mirrors) {
+		err := s.putErr
+		s.putErr = nil
+		s.mtx.Unlock()
+		return err
+	}
+	s.mtx.Unlock()
+
+	for _, hash := range deletes {
+		if err := s.Delete(hash); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	for i, m := range mirrors {
+		if err := s.Put(m, heights[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
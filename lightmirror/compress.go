@@ -0,0 +1,359 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxDecompressionRatio and decompressionAllowance bound the output
+	// of a decompressor to maxDecompressionRatio times the compressed
+	// bytes it read, plus decompressionAllowance.  Mirrors compress
+	// about tenfold; a stream outgrowing the bound is a decompression
+	// bomb.
+	maxDecompressionRatio  = 64
+	decompressionAllowance = 1 << 20
+)
+
+var (
+	// ErrUnsupportedCompression is returned for a compression tag this
+	// build can not read or write.
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+
+	// ErrDecompressionLimit is returned when a compressed stream
+	// decompresses to more than its size allows.
+	ErrDecompressionLimit = errors.New("decompressed size exceeds the limit")
+)
+
+// Compression is the one byte tag naming the compression of framed data.
+type Compression byte
+
+const (
+	// CompressionNone leaves the data as it is.
+	CompressionNone Compression = iota
+
+	// CompressionGzip compresses the data with gzip.
+	CompressionGzip
+
+	// CompressionZstd compresses the data with zstd, as a single frame.
+	CompressionZstd
+)
+
+var compressionStrings = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+	CompressionZstd: "zstd",
+}
+
+// String returns the Compression in human-readable form.
+func (c Compression) String() string {
+	if s, ok := compressionStrings[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown Compression (%d)", byte(c))
+}
+
+// CompressionOption configures the compression of written data.
+type CompressionOption func(*compressionConfig)
+
+type compressionConfig struct {
+	compression Compression
+	level       int
+}
+
+// WithCompression compresses the written data with c at level, whose
+// meaning is that of the codec, as gzip.BestSpeed or the zstd levels 1 to
+// 22; zero picks the default level of the codec.
+func WithCompression(c Compression, level int) CompressionOption {
+	return func(cfg *compressionConfig) {
+		cfg.compression = c
+		cfg.level = level
+	}
+}
+
+func newCompressionConfig(opts []CompressionOption) compressionConfig {
+	cfg := compressionConfig{compression: CompressionNone}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// byteReader returns r as a flate.Reader, buffering it if it is not one.
+func byteReader(r io.Reader) flate.Reader {
+	if fr, ok := r.(flate.Reader); ok {
+		return fr
+	}
+	return bufio.NewReader(r)
+}
+
+// nopWriteCloser is the compressor of CompressionNone.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressor returns a writer compressing to w as cfg tells.  Closing it
+// flushes the compressed stream, not w.
+func (cfg compressionConfig) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch cfg.compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		level := cfg.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if cfg.level != 0 {
+			level = zstd.EncoderLevelFromZstd(cfg.level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level),
+			zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("compression %v: %w", cfg.compression, ErrUnsupportedCompression)
+}
+
+// countingReader counts the bytes read from r.  It is an io.ByteReader, so
+// that decompressors read no further than the end of their stream.
+type countingReader struct {
+	r flate.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// limitedReader reads a decompressed stream, failing with
+// ErrDecompressionLimit once it outgrows the compressed bytes read.
+type limitedReader struct {
+	r   io.Reader
+	in  *countingReader
+	out int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.out += int64(n)
+	if r.out > decompressionAllowance+maxDecompressionRatio*r.in.n {
+		return n, fmt.Errorf("%d bytes from %d compressed bytes: %w",
+			r.out, r.in.n, ErrDecompressionLimit)
+	}
+	return n, err
+}
+
+// decompressor returns a reader of the data compressed by c read from r.  It
+// reads no byte of r past the compressed stream.
+func decompressor(r flate.Reader, c Compression) (io.Reader, error) {
+	if c == CompressionNone {
+		return r, nil
+	}
+	in := &countingReader{r: r}
+	switch c {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		return &limitedReader{r: zr, in: in}, nil
+	case CompressionZstd:
+		frame := &zstdFrameReader{r: in}
+		zr, err := zstd.NewReader(frame, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{r: &zstdReader{zr, frame}, in: in}, nil
+	}
+	return nil, fmt.Errorf("compression %v: %w", c, ErrUnsupportedCompression)
+}
+
+// finishDecompressed reads the end of the stream dr compressed by c
+// decompresses, so that its trailer is checked and r is left past it.  It
+// fails if data follows what was read.
+func finishDecompressed(dr io.Reader, c Compression) error {
+	if c == CompressionNone {
+		return nil
+	}
+	var b [1]byte
+	n, err := io.ReadFull(dr, b[:])
+	if n != 0 {
+		return fmt.Errorf("data follows the end of the %v stream", c)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// zstdMagic starts every zstd frame.
+const zstdMagic = 0xfd2fb528
+
+// zstdReader reads the data decompressed from a zstd frame.  The decoder
+// takes a stream ending before the end of a frame header for an empty one,
+// so the end of the data is only reported once the frame was read whole.
+type zstdReader struct {
+	dec   *zstd.Decoder
+	frame *zstdFrameReader
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.dec.Read(p)
+	if err == io.EOF && !r.frame.done() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// zstdFrameReader passes on the zstd frame at the start of r, then reports
+// io.EOF.  The zstd decoder reads on to the next frame once one ends, but
+// not past the end of a frame it is decoding, so a decoder reading the frame
+// reader reads no byte after the frame.
+type zstdFrameReader struct {
+	r io.Reader
+
+	// pending holds the header bytes read and not yet passed on, and left
+	// the count of the block bytes after them.
+	pending []byte
+	left    int64
+
+	started  bool
+	checksum bool
+	last     bool
+}
+
+func (f *zstdFrameReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 && f.left == 0 {
+		if f.last {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= int64(n)
+	if err == io.EOF {
+		if f.left == 0 {
+			return n, nil
+		}
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the next header of the frame into pending: the frame header,
+// then that of each block, whose size it sets left to.
+func (f *zstdFrameReader) next() error {
+	if !f.started {
+		f.started = true
+		header, err := f.read(5)
+		if err != nil {
+			return err
+		}
+		if magic := binary.LittleEndian.Uint32(header); magic != zstdMagic {
+			return fmt.Errorf("zstd frame starts with %08x", magic)
+		}
+
+		// The frame header descriptor sizes the rest of the header: the
+		// window descriptor, the dictionary id and the content size.
+		descriptor := header[4]
+		singleSegment := descriptor&0x20 != 0
+		size := [4]int{0, 1, 2, 4}[descriptor&0x03]
+		if !singleSegment {
+			size++
+		}
+		switch descriptor >> 6 {
+		case 0:
+			if singleSegment {
+				size++
+			}
+		case 1:
+			size += 2
+		case 2:
+			size += 4
+		case 3:
+			size += 8
+		}
+		f.checksum = descriptor&0x04 != 0
+		rest, err := f.read(size)
+		if err != nil {
+			return err
+		}
+		f.pending = append(header, rest...)
+		return nil
+	}
+
+	header, err := f.read(3)
+	if err != nil {
+		return err
+	}
+	v := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	switch v >> 1 & 0x03 {
+	case 0, 2:
+		// Raw and compressed blocks carry their size in bytes.
+		f.left = int64(v >> 3)
+	case 1:
+		// A run length block repeats a single byte.
+		f.left = 1
+	default:
+		return errors.New("reserved zstd block type")
+	}
+	if v&1 != 0 {
+		f.last = true
+		if f.checksum {
+			f.left += 4
+		}
+	}
+	f.pending = header
+	return nil
+}
+
+// done reports whether the whole frame was passed on.
+func (f *zstdFrameReader) done() bool {
+	return f.last && f.left == 0 && len(f.pending) == 0
+}
+
+// read reads the next n bytes of the frame.
+func (f *zstdFrameReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(f.r, b); err != nil {
+		return nil, noEOF(err)
+	}
+	return b, nil
+}
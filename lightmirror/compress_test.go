@@ -0,0 +1,190 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestCompressedBatch(t *testing.T) {
+	mirrors := newTestMirrors(50)
+	var plain bytes.Buffer
+	if err := SerializeBatch(&plain, mirrors); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+
+	tests := []struct {
+		opts []CompressionOption
+		tag  Compression
+	}{
+		{nil, CompressionNone},
+		{[]CompressionOption{WithCompression(CompressionGzip, 0)}, CompressionGzip},
+		{[]CompressionOption{WithCompression(CompressionGzip, gzip.BestCompression)}, CompressionGzip},
+		{[]CompressionOption{WithCompression(CompressionZstd, 0)}, CompressionZstd},
+		{[]CompressionOption{WithCompression(CompressionZstd, 19)}, CompressionZstd},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		if err := SerializeCompressedBatch(&buf, mirrors, test.opts...); err != nil {
+			t.Fatalf("SerializeCompressedBatch #%d error %v", i, err)
+		}
+		data := buf.Bytes()
+		if Compression(data[0]) != test.tag {
+			t.Errorf("SerializeCompressedBatch #%d: got tag %v, want %v", i, Compression(data[0]), test.tag)
+		}
+		if test.tag != CompressionNone && len(data) >= plain.Len() {
+			t.Errorf("SerializeCompressedBatch #%d: %d bytes, uncompressed %d", i, len(data), plain.Len())
+		}
+
+		// The reader stops at the end of the batch.
+		r := bufio.NewReader(bytes.NewReader(append(data, 0xff)))
+		got, err := DeserializeCompressedBatch(r)
+		if err != nil {
+			t.Fatalf("DeserializeCompressedBatch #%d error %v", i, err)
+		}
+		if len(got) != len(mirrors) {
+			t.Fatalf("DeserializeCompressedBatch #%d: got %d mirrors, want %d", i, len(got), len(mirrors))
+		}
+		for j, m := range got {
+			if !m.Equal(mirrors[j]) {
+				t.Errorf("DeserializeCompressedBatch #%d: mirror %d differs", i, j)
+			}
+		}
+		if b, err := r.ReadByte(); err != nil || b != 0xff {
+			t.Errorf("DeserializeCompressedBatch #%d: next byte %x, error %v", i, b, err)
+		}
+	}
+
+	err := SerializeCompressedBatch(ioutil.Discard, mirrors, WithCompression(0xff, 0))
+	if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("SerializeCompressedBatch unknown: got error %v, want %v", err, ErrUnsupportedCompression)
+	}
+	for _, tag := range []Compression{3, 0xff} {
+		_, err := DeserializeCompressedBatch(bytes.NewReader([]byte{byte(tag), 0}))
+		if !errors.Is(err, ErrUnsupportedCompression) {
+			t.Errorf("DeserializeCompressedBatch %v: got error %v, want %v", tag, err,
+				ErrUnsupportedCompression)
+		}
+	}
+}
+
+// compressed returns data compressed with c at its default level.
+func compressed(t *testing.T, c Compression, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw, err := compressionConfig{compression: c}.compressor(&buf)
+	if err != nil {
+		t.Fatalf("compressor error %v", err)
+	}
+	if _, err := cw.Write(data); err != nil {
+		t.Fatalf("Write error %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	// Random data barely compresses and is read whole, zeros are past
+	// the bound as soon as the allowance is used up.
+	random := make([]byte, 4*decompressionAllowance)
+	rand.New(rand.NewSource(1)).Read(random)
+	zeros := make([]byte, 64*decompressionAllowance)
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		for _, test := range []struct {
+			name string
+			data []byte
+			err  error
+		}{
+			{"random", random, nil},
+			{"zeros", zeros, ErrDecompressionLimit},
+		} {
+			data := compressed(t, c, test.data)
+			dr, err := decompressor(bufio.NewReader(bytes.NewReader(data)), c)
+			if err != nil {
+				t.Fatalf("decompressor (%v) error %v", c, err)
+			}
+			n, err := io.Copy(ioutil.Discard, dr)
+			if !errors.Is(err, test.err) || test.err == nil && n != int64(len(test.data)) {
+				t.Errorf("decompress %s (%v): got %d bytes, error %v, want %v", test.name, c, n, err, test.err)
+			}
+			if test.err != nil && n > decompressionAllowance+maxDecompressionRatio*int64(len(data))+128<<10 {
+				t.Errorf("decompress %s (%v): read %d bytes past the bound", test.name, c, n)
+			}
+		}
+
+		// A batch of a mirror with a coinbase script of zeros, as an
+		// untrusted snapshot could carry, is refused.
+		bomb := newTestMirror(chainhash.Hash{}, 1, 0)
+		bomb.CoinBaseTx.TxOut = append(bomb.CoinBaseTx.TxOut, wire.NewTxOut(0, zeros[:3*decompressionAllowance]))
+		var buf bytes.Buffer
+		if err := SerializeCompressedBatch(&buf, []*BtcLightMirrorV2{bomb}, WithCompression(c, 0)); err != nil {
+			t.Fatalf("SerializeCompressedBatch (%v) error %v", c, err)
+		}
+		if _, err := DeserializeCompressedBatch(&buf); !errors.Is(err, ErrDecompressionLimit) {
+			t.Errorf("DeserializeCompressedBatch bomb (%v): got error %v, want %v", c, err, ErrDecompressionLimit)
+		}
+	}
+}
+
+// TestZstdFrameReader checks that a zstd stream is read up to the end of its
+// frame, whatever follows, and that a truncated frame fails.
+func TestZstdFrameReader(t *testing.T) {
+	data := make([]byte, 3*decompressionAllowance)
+	rand.New(rand.NewSource(1)).Read(data[:decompressionAllowance])
+	frame := compressed(t, CompressionZstd, data)
+	next := compressed(t, CompressionZstd, []byte("next"))
+
+	r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), frame...), next...)))
+	dr, err := decompressor(r, CompressionZstd)
+	if err != nil {
+		t.Fatalf("decompressor error %v", err)
+	}
+	got, err := ioutil.ReadAll(dr)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decompress: got %d bytes, error %v, want %d", len(got), err, len(data))
+	}
+	if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, next) {
+		t.Errorf("decompress: left %d bytes, want the %d of the next frame", len(rest), len(next))
+	}
+
+	for _, n := range []int{0, 3, 8, len(frame) / 2, len(frame) - 1} {
+		dr, err := decompressor(bufio.NewReader(bytes.NewReader(frame[:n])), CompressionZstd)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, dr)
+		}
+		if err == nil {
+			t.Errorf("decompress %d of %d bytes: expected error", n, len(frame))
+		}
+	}
+}
+
+func TestCompressionStringer(t *testing.T) {
+	tests := []struct {
+		in   Compression
+		want string
+	}{
+		{CompressionNone, "none"},
+		{CompressionGzip, "gzip"},
+		{CompressionZstd, "zstd"},
+		{0xff, "Unknown Compression (255)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, got, test.want)
+		}
+	}
+}
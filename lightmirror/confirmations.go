@@ -0,0 +1,83 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Confirmations returns the number of confirmations of the best chain block
+// with the given hash: 1 for the tip, N for the block N-1 below it.  It
+// returns ErrNotInBestChain for blocks only known on a side branch and
+// ErrUnknownBlock for blocks not known at all.
+func (c *MirrorChain) Confirmations(hash chainhash.Hash) (int64, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.confirmations(hash)
+}
+
+func (c *MirrorChain) confirmations(hash chainhash.Hash) (int64, error) {
+	height, err := c.best.HeightOfHash(hash)
+	if err != nil {
+		if _, ok := c.index[hash]; ok {
+			return 0, ErrNotInBestChain
+		}
+		return 0, err
+	}
+	return c.tip.height - height + 1, nil
+}
+
+// WaitForConfirmations blocks until the best chain block with the given hash
+// has at least n confirmations, in which case it returns true, or leaves the
+// best chain, in which case it returns false.  It fails with the errors of
+// Confirmations when the block is not in the best chain to begin with, and
+// with the error of ctx when ctx is done first.
+func (c *MirrorChain) WaitForConfirmations(ctx context.Context, hash chainhash.Hash, n int64) (bool, error) {
+	events, cancel := c.Subscribe()
+	defer func() { cancel() }()
+
+	// The subscription is taken first so that no change is missed between
+	// this check and the first event.
+	confirmations, err := c.Confirmations(hash)
+	if err != nil {
+		return false, err
+	}
+	if confirmations >= n {
+		return true, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+
+		case event, ok := <-events:
+			switch {
+			case !ok || event.Type == SubscriptionOverflow:
+				// Events were lost: subscribe again and look
+				// at the chain itself.
+				cancel()
+				events, cancel = c.Subscribe()
+
+			case event.Type == BlockDisconnected && event.Hash == hash:
+				return false, nil
+
+			case event.Type != BlockConnected:
+				continue
+			}
+
+			confirmations, err := c.Confirmations(hash)
+			if err != nil {
+				// Forgotten or moved to a side branch.
+				return false, nil
+			}
+			if confirmations >= n {
+				return true, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestConfirmations(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	c := newTestChain(t, mirrors)
+	side := newTestBranch(mirrors[2], 1000, 1)[0]
+	if _, err := c.Append(side); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+
+	tests := []struct {
+		hash chainhash.Hash
+		want int64
+		err  error
+	}{
+		{mirrors[4].BtcHeader.BlockHash(), 1, nil},
+		{mirrors[3].BtcHeader.BlockHash(), 2, nil},
+		{mirrors[0].BtcHeader.BlockHash(), 5, nil},
+		{side.BtcHeader.BlockHash(), 0, ErrNotInBestChain},
+		{chainhash.Hash{1}, 0, ErrUnknownBlock},
+	}
+	for i, test := range tests {
+		got, err := c.Confirmations(test.hash)
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("Confirmations #%d: got %d, %v, want %d, %v", i, got,
+				err, test.want, test.err)
+		}
+	}
+}
+
+// waitSubscribers waits for c to have n subscribers, to let waiting
+// goroutines subscribe before the chain changes.
+func waitSubscribers(c *MirrorChain, n int) {
+	for {
+		c.subs.mtx.Lock()
+		subs := len(c.subs.subs)
+		c.subs.mtx.Unlock()
+		if subs == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitForConfirmations(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	c := newTestChain(t, mirrors[:3])
+	ctx := context.Background()
+
+	type result struct {
+		confirmed bool
+		err       error
+	}
+	wait := func(hash chainhash.Hash, n int64) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			confirmed, err := c.WaitForConfirmations(ctx, hash, n)
+			done <- result{confirmed, err}
+		}()
+		return done
+	}
+
+	// Already confirmed.
+	if confirmed, err := c.WaitForConfirmations(ctx, mirrors[0].BtcHeader.BlockHash(), 3); !confirmed || err != nil {
+		t.Errorf("WaitForConfirmations: got %v, %v", confirmed, err)
+	}
+	if _, err := c.WaitForConfirmations(ctx, chainhash.Hash{1}, 1); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("WaitForConfirmations unknown: got error %v, want %v", err,
+			ErrUnknownBlock)
+	}
+
+	// Confirmed by later appends.
+	done := wait(mirrors[2].BtcHeader.BlockHash(), 3)
+	waitSubscribers(c, 1)
+	for _, m := range mirrors[3:5] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	if r := <-done; !r.confirmed || r.err != nil {
+		t.Errorf("WaitForConfirmations: got %v, %v", r.confirmed, r.err)
+	}
+
+	// Reorged out.
+	done = wait(mirrors[4].BtcHeader.BlockHash(), 10)
+	waitSubscribers(c, 1)
+	for _, m := range newTestBranch(mirrors[2], 1000, 3) {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	if r := <-done; r.confirmed || r.err != nil {
+		t.Errorf("WaitForConfirmations reorged out: got %v, %v", r.confirmed,
+			r.err)
+	}
+
+	// Cancelled.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := c.WaitForConfirmations(cancelled, mirrors[2].BtcHeader.BlockHash(), 100)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForConfirmations cancelled: got error %v, want %v", err,
+			context.Canceled)
+	}
+	waitSubscribers(c, 0)
+}
+
+// TestWaitForConfirmationsOverflow checks that a waiter resubscribes when it
+// falls behind.
+func TestWaitForConfirmationsOverflow(t *testing.T) {
+	mirrors := newTestMirrors(10)
+	c := newTestChain(t, mirrors[:2], WithSubscriptionBuffer(2))
+
+	done := make(chan error, 1)
+	go func() {
+		confirmed, err := c.WaitForConfirmations(context.Background(),
+			mirrors[1].BtcHeader.BlockHash(), 8)
+		if err == nil && !confirmed {
+			err = errors.New("not confirmed")
+		}
+		done <- err
+	}()
+	waitSubscribers(c, 1)
+
+	if _, err := c.AppendBatch(mirrors[2:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitForConfirmations error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WaitForConfirmations did not return")
+	}
+}
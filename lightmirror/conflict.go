@@ -0,0 +1,111 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxDelegationConflicts is the number of delegation conflicts a chain
+// keeps, the oldest being dropped first.
+const maxDelegationConflicts = 1024
+
+// ConflictingBlock is a block of a DelegationConflict and the power
+// parameters it carries, those ParsePowerParams returns.
+type ConflictingBlock struct {
+	Hash      chainhash.Hash
+	Candidate common.Address
+	Reward    common.Address
+}
+
+// DelegationConflict records a block of the best chain replaced, in a
+// reorganization, by a block of the same height delegating to another
+// candidate or reward address.  Blocks without power parameters never
+// conflict.
+type DelegationConflict struct {
+	Height       int64
+	Disconnected ConflictingBlock
+	Connected    ConflictingBlock
+}
+
+// conflictingBlock returns the ConflictingBlock of e, and false if e has no
+// power parameters.
+func conflictingBlock(e *chainEntry) (ConflictingBlock, bool) {
+	if e.mirror == nil {
+		return ConflictingBlock{}, false
+	}
+	d, err := e.mirror.ParseDelegation(PreferOutput)
+	if err != nil {
+		return ConflictingBlock{}, false
+	}
+	return ConflictingBlock{Hash: e.hash, Candidate: d.Candidate, Reward: d.Reward}, true
+}
+
+// delegationConflicts returns the conflicts between the blocks of detach,
+// newest first, and the blocks of attach, oldest first, replacing them.
+func delegationConflicts(detach, attach []*chainEntry) []DelegationConflict {
+	replacing := make(map[int64]*chainEntry, len(attach))
+	for _, e := range attach {
+		replacing[e.height] = e
+	}
+	var conflicts []DelegationConflict
+	for i := len(detach) - 1; i >= 0; i-- {
+		old := detach[i]
+		e, ok := replacing[old.height]
+		if !ok {
+			continue
+		}
+		disconnected, ok := conflictingBlock(old)
+		if !ok {
+			continue
+		}
+		connected, ok := conflictingBlock(e)
+		if !ok {
+			continue
+		}
+		if disconnected.Candidate != connected.Candidate || disconnected.Reward != connected.Reward {
+			conflicts = append(conflicts, DelegationConflict{
+				Height:       old.height,
+				Disconnected: disconnected,
+				Connected:    connected,
+			})
+		}
+	}
+	return conflicts
+}
+
+// recordConflicts keeps the conflicts of the best chain switch from detach
+// to attach, and returns them.  The chain must be locked for writing.
+func (c *MirrorChain) recordConflicts(detach, attach []*chainEntry) []DelegationConflict {
+	conflicts := delegationConflicts(detach, attach)
+	for _, conflict := range conflicts {
+		c.cfg.logger.Warnf("delegation conflict at height %d: block %v "+
+			"delegating to %v replaced by block %v delegating to %v",
+			conflict.Height, conflict.Disconnected.Hash,
+			conflict.Disconnected.Candidate, conflict.Connected.Hash,
+			conflict.Connected.Candidate)
+	}
+	c.conflicts = append(c.conflicts, conflicts...)
+	if n := len(c.conflicts) - maxDelegationConflicts; n > 0 {
+		c.conflicts = append(c.conflicts[:0:0], c.conflicts[n:]...)
+	}
+	return conflicts
+}
+
+// DelegationConflicts returns the delegation conflicts at heights in
+// [start, end] detected by the chain, in the order they were detected.  The
+// chain keeps the last 1024 it detected.
+func (c *MirrorChain) DelegationConflicts(start, end int64) []DelegationConflict {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var conflicts []DelegationConflict
+	for _, conflict := range c.conflicts {
+		if conflict.Height >= start && conflict.Height <= end {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDelegationConflicts(t *testing.T) {
+	candidateA := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	candidateB := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	rewardA := common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db")
+	rewardB := common.HexToAddress("0x78731D3Ca6b7E34aC0F824c42a7cC18A495cabaB")
+
+	// The best chain delegates to A at both heights above the anchor.
+	anchor := newTestMirrors(1)[0]
+	main1 := newDelegatingMirror(anchor.BtcHeader.BlockHash(), 1, candidateA, rewardA)
+	main2 := newDelegatingMirror(main1.BtcHeader.BlockHash(), 2, candidateA, rewardA)
+	c := newTestChain(t, []*BtcLightMirrorV2{anchor, main1, main2})
+	events, cancel := c.Subscribe()
+	defer cancel()
+
+	// The branch replacing them delegates to B at the first height, to A
+	// with another reward at the second, and does not delegate at the
+	// third.
+	branch1 := newDelegatingMirror(anchor.BtcHeader.BlockHash(), 11, candidateB, rewardB)
+	branch2 := newDelegatingMirror(branch1.BtcHeader.BlockHash(), 12, candidateA, rewardB)
+	branch3 := newTestMirror(branch2.BtcHeader.BlockHash(), 13, 0)
+	if _, err := c.AppendBatch([]*BtcLightMirrorV2{branch1, branch2}); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	if got := c.DelegationConflicts(0, 1000); len(got) != 0 {
+		t.Fatalf("DelegationConflicts before the reorg: got %+v", got)
+	}
+	reorg, err := c.Append(branch3)
+	if err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+
+	want := []DelegationConflict{
+		{
+			Height:       testAnchorHeight + 1,
+			Disconnected: ConflictingBlock{main1.BtcHeader.BlockHash(), candidateA, rewardA},
+			Connected:    ConflictingBlock{branch1.BtcHeader.BlockHash(), candidateB, rewardB},
+		},
+		{
+			Height:       testAnchorHeight + 2,
+			Disconnected: ConflictingBlock{main2.BtcHeader.BlockHash(), candidateA, rewardA},
+			Connected:    ConflictingBlock{branch2.BtcHeader.BlockHash(), candidateA, rewardB},
+		},
+	}
+	if reorg == nil || !reflect.DeepEqual(reorg.Conflicts, want) {
+		t.Errorf("ReorgEvent conflicts: got %+v, want %+v", reorg, want)
+	}
+	if got := c.DelegationConflicts(0, 1000); !reflect.DeepEqual(got, want) {
+		t.Errorf("DelegationConflicts: got %+v, want %+v", got, want)
+	}
+	if got := c.DelegationConflicts(testAnchorHeight+2, testAnchorHeight+2); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("DelegationConflicts at %d: got %+v, want %+v", testAnchorHeight+2, got, want[1:])
+	}
+
+	// The conflicts follow the events of the reorganization.
+	var conflicts []DelegationConflict
+	var types []ChainEventType
+	for _, event := range drain(events) {
+		types = append(types, event.Type)
+		if event.Type == DelegationConflictDetected {
+			if event.Hash != event.Conflict.Connected.Hash || event.Height != event.Conflict.Height {
+				t.Errorf("conflict event %v at %d for %+v", event.Hash, event.Height, event.Conflict)
+			}
+			conflicts = append(conflicts, *event.Conflict)
+		}
+	}
+	wantTypes := []ChainEventType{BlockDisconnected, BlockDisconnected, BlockConnected,
+		BlockConnected, BlockConnected, DelegationConflictDetected, DelegationConflictDetected}
+	if !reflect.DeepEqual(types, wantTypes) || !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("events: got %v with conflicts %+v, want %v with %+v", types,
+			conflicts, wantTypes, want)
+	}
+}
+
+func TestDelegationConflictsSameDelegation(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	anchor := newTestMirrors(1)[0]
+	main1 := newDelegatingMirror(anchor.BtcHeader.BlockHash(), 1, candidate, candidate)
+	main2 := newTestMirror(main1.BtcHeader.BlockHash(), 2, 0)
+	c := newTestChain(t, []*BtcLightMirrorV2{anchor, main1, main2})
+
+	// Replacing a block with one delegating alike, or a block without
+	// delegation, is no conflict.
+	branch := []*BtcLightMirrorV2{newDelegatingMirror(anchor.BtcHeader.BlockHash(), 11, candidate, candidate)}
+	branch = append(branch, newDelegatingMirror(branch[0].BtcHeader.BlockHash(), 12, candidate, candidate))
+	branch = append(branch, newTestMirror(branch[1].BtcHeader.BlockHash(), 13, 0))
+	reorgs, err := c.AppendBatch(branch)
+	if err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	if len(reorgs) != 1 || len(reorgs[0].Disconnected) != 2 || len(reorgs[0].Conflicts) != 0 {
+		t.Errorf("AppendBatch: got reorgs %+v", reorgs)
+	}
+	if got := c.DelegationConflicts(0, 1000); len(got) != 0 {
+		t.Errorf("DelegationConflicts: got %+v", got)
+	}
+}
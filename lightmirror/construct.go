@@ -0,0 +1,262 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrWitnessCommitment is returned by New under ValidateFull when the
+// witness branch does not match the witness commitment of the coinbase.
+var ErrWitnessCommitment = errors.New("witness commitment mismatch")
+
+// witnessCommitmentHeader starts the output script of the witness
+// commitment of a coinbase: OP_RETURN, a push of 36 bytes and the
+// commitment magic 0xaa21a9ed, before the 32 bytes of the commitment.
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// ValidationLevel sets the checks New runs on the mirror it builds.
+type ValidationLevel int
+
+const (
+	// ValidateNone runs no check, for blocks validated beforehand.
+	ValidateNone ValidationLevel = iota
+
+	// ValidateMerkle checks the merkle branch against the header with
+	// CheckMerkle.  It is the default.
+	ValidateMerkle
+
+	// ValidateFull adds to ValidateMerkle the checks of VerifyInvariants
+	// and, with WithWitnessBranch, the check of the witness branch against
+	// the witness commitment of the coinbase.
+	ValidateFull
+)
+
+// MirrorOption configures New.
+type MirrorOption func(*mirrorConfig)
+
+type mirrorConfig struct {
+	workers    int
+	wtxids     []chainhash.Hash
+	validation ValidationLevel
+	invariants DeserializeOptions
+	deepCopy   bool
+}
+
+// WithParallelHashing makes New hash each level of the merkle tree on n
+// goroutines.  It pays off for blocks of thousands of transactions; a value
+// of n below 2, the default being 1, hashes on the calling goroutine.
+func WithParallelHashing(n int) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.workers = n
+	}
+}
+
+// WithWitnessBranch makes New also capture in WitnessMerkleNodes the merkle
+// branch of the coinbase in the witness tree of the block, built from the
+// witness hashes of all its transactions, coinbase first.  As in the
+// witness commitment, the coinbase leaf is the zero hash whatever wtxids[0]
+// holds.
+func WithWitnessBranch(wtxids []chainhash.Hash) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.wtxids = wtxids
+	}
+}
+
+// WithValidation sets the checks New runs on the mirror, ValidateMerkle by
+// default.
+func WithValidation(level ValidationLevel) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.validation = level
+	}
+}
+
+// WithInvariants sets the limits of the VerifyInvariants check of
+// ValidateFull, for networks with larger blocks than Bitcoin's.
+func WithInvariants(opts DeserializeOptions) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.invariants = opts
+	}
+}
+
+// WithDeepCopy sets whether the mirror gets a deep copy of the coinbase, the
+// default, or shares its inputs, outputs, scripts and witnesses with the
+// coinbase passed to New, which the caller must then leave untouched.
+func WithDeepCopy(deepCopy bool) MirrorOption {
+	return func(cfg *mirrorConfig) {
+		cfg.deepCopy = deepCopy
+	}
+}
+
+// New returns the mirror of the block with the header, the coinbase and the
+// hashes of all transactions of the block, coinbase first.  It fails if
+// txids is empty, or if the mirror does not pass the checks set by
+// WithValidation.
+//
+// The mirror owns its header, merkle nodes and, unless WithDeepCopy(false),
+// coinbase: the caller may modify or reuse header, coinbase and txids once
+// the mirror is created.
+func New(header *wire.BlockHeader, coinbase *wire.MsgTx, txids []chainhash.Hash, opts ...MirrorOption) (*BtcLightMirrorV2, error) {
+	cfg := mirrorConfig{
+		workers:    1,
+		validation: ValidateMerkle,
+		deepCopy:   true,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if len(txids) == 0 {
+		return nil, errors.New("block has no transaction")
+	}
+	if cfg.wtxids != nil && len(cfg.wtxids) != len(txids) {
+		return nil, fmt.Errorf("witness branch of %d transactions for a "+
+			"block of %d", len(cfg.wtxids), len(txids))
+	}
+
+	light := &BtcLightMirrorV2{
+		BtcHeader:   *header,
+		MerkleNodes: merkleBranch(txids, cfg.workers),
+	}
+	if cfg.deepCopy {
+		light.CoinBaseTx = *coinbase.Copy()
+	} else {
+		light.CoinBaseTx = *coinbase
+	}
+	if cfg.wtxids != nil {
+		leaves := make([]chainhash.Hash, len(cfg.wtxids))
+		copy(leaves[1:], cfg.wtxids[1:])
+		light.WitnessMerkleNodes = merkleBranch(leaves, cfg.workers)
+	}
+
+	if cfg.validation >= ValidateMerkle {
+		if err := light.CheckMerkle(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.validation >= ValidateFull {
+		if err := light.VerifyInvariantsWith(cfg.invariants); err != nil {
+			return nil, err
+		}
+		if cfg.wtxids != nil {
+			if err := light.checkWitnessCommitment(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return light, nil
+}
+
+// merkleBranch returns the merkle branch of the first of leaves, the hashes
+// of the block transactions, as CreateBtcLightMirrorV2 takes it from
+// BuildMerkleTreeStore.  The levels of the tree are hashed in turn, each on
+// up to workers goroutines.
+func merkleBranch(leaves []chainhash.Hash, workers int) []chainhash.Hash {
+	exponent := getExponent(len(leaves))
+	branch := make([]chainhash.Hash, 0, exponent)
+	if exponent == 0 {
+		return branch
+	}
+
+	// The levels above the leaves alternate between the two halves of
+	// buf, so that a level is never written while it is read.
+	half := (len(leaves) + 1) / 2
+	buf := make([]chainhash.Hash, 2*half)
+	level := leaves
+	for i := 0; i < exponent; i++ {
+		branch = append(branch, level[1])
+		next := buf[(i%2)*half:][:(len(level)+1)/2]
+		hashLevel(next, level, workers)
+		level = next
+	}
+	return branch
+}
+
+// hashLevel sets parents to the hashes of the pairs of children, the last
+// child being paired with itself when alone, on up to workers goroutines.
+func hashLevel(parents, children []chainhash.Hash, workers int) {
+	hash := func(from, to int) {
+		for i := from; i < to; i++ {
+			left := &children[2*i]
+			right := left
+			if 2*i+1 < len(children) {
+				right = &children[2*i+1]
+			}
+			parents[i] = blockchain.HashMerkleBranches(left, right)
+		}
+	}
+	if workers > len(parents) {
+		workers = len(parents)
+	}
+	if workers < 2 {
+		hash(0, len(parents))
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (len(parents) + workers - 1) / workers
+	for from := 0; from < len(parents); from += chunk {
+		to := from + chunk
+		if to > len(parents) {
+			to = len(parents)
+		}
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			hash(from, to)
+		}(from, to)
+	}
+	wg.Wait()
+}
+
+// checkWitnessCommitment checks WitnessMerkleNodes against the witness
+// commitment of the coinbase, the hash of the witness root and of the
+// witness nonce in the last output committing to it.
+func (light *BtcLightMirrorV2) checkWitnessCommitment() error {
+	tx := light.Coinbase()
+	i := witnessCommitmentIndex(tx)
+	if i < 0 {
+		return fmt.Errorf("coinbase has no witness commitment: %w",
+			ErrWitnessCommitment)
+	}
+	commitment := tx.TxOut[i].PkScript[len(witnessCommitmentHeader):][:chainhash.HashSize]
+	witness := tx.TxIn[0].Witness
+	if len(witness) != 1 || len(witness[0]) != chainhash.HashSize {
+		return fmt.Errorf("coinbase witness is not a witness nonce: %w",
+			ErrWitnessCommitment)
+	}
+
+	root := calculateMerkleRoot(&chainhash.Hash{}, light.WitnessMerkleNodes)
+	hash := chainhash.DoubleHashH(append(root[:], witness[0]...))
+	if !bytes.Equal(hash[:], commitment) {
+		return fmt.Errorf("coinbase commits to %x, witness branch to %x: %w",
+			commitment, hash[:], ErrWitnessCommitment)
+	}
+	return nil
+}
+
+// witnessCommitmentIndex returns the index of the output of the coinbase
+// holding its witness commitment, the last one starting with
+// witnessCommitmentHeader, or -1 if there is none.
+func witnessCommitmentIndex(tx *wire.MsgTx) int {
+	for i := len(tx.TxOut) - 1; i >= 0; i-- {
+		if tx.TxOut[i] == nil {
+			continue
+		}
+		script := tx.TxOut[i].PkScript
+		if len(script) >= len(witnessCommitmentHeader)+chainhash.HashSize &&
+			bytes.HasPrefix(script, witnessCommitmentHeader) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newTestBlock returns the header, coinbase and transaction hashes of a
+// block of n transactions, with a witness coinbase committing to the
+// witness hashes wtxids.
+func newTestBlock(n int) (*wire.BlockHeader, *wire.MsgTx, []chainhash.Hash, []chainhash.Hash) {
+	txids := make([]chainhash.Hash, n)
+	wtxids := make([]chainhash.Hash, n)
+	for i := 1; i < n; i++ {
+		txids[i] = chainhash.Hash{byte(i), byte(i >> 8), 0x01}
+		wtxids[i] = chainhash.Hash{byte(i), byte(i >> 8), 0x02}
+	}
+
+	nonce := chainhash.Hash{0xab}
+	merkles := BuildMerkleTreeStore(&chainhash.Hash{}, wtxids[1:])
+	witnessRoot := merkles[len(merkles)-1]
+	commitment := chainhash.DoubleHashH(append(witnessRoot[:], nonce[:]...))
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{0x01, 0x02},
+			Witness:          wire.TxWitness{nonce[:]},
+			Sequence:         0xffffffff,
+		}},
+		TxOut: []*wire.TxOut{
+			{Value: 5000000000, PkScript: []byte{0x51}},
+			{PkScript: append(append([]byte(nil), witnessCommitmentHeader...),
+				commitment[:]...)},
+		},
+	}
+	txids[0] = coinBaseTx.TxHash()
+	wtxids[0] = coinBaseTx.WitnessHash()
+
+	merkles = BuildMerkleTreeStore(&txids[0], txids[1:])
+	header := &wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1231006505, 0),
+		Bits:       0x207fffff,
+	}
+	return header, coinBaseTx, txids, wtxids
+}
+
+// wantBranch returns the merkle branch of the first of leaves, taken from
+// the tree of BuildMerkleTreeStore.
+func wantBranch(leaves []chainhash.Hash) []chainhash.Hash {
+	merkles := BuildMerkleTreeStore(&leaves[0], leaves[1:])
+	exponent := getExponent(len(leaves))
+	branch := []chainhash.Hash{}
+	offset := 1 << exponent
+	lastIndex := 1
+	for i := 0; i < exponent; i++ {
+		branch = append(branch, *merkles[lastIndex])
+		lastIndex += offset
+		offset >>= 1
+	}
+	return branch
+}
+
+func TestNew(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9, 33, 100} {
+		header, coinBaseTx, txids, _ := newTestBlock(n)
+		m, err := New(header, coinBaseTx, txids)
+		if err != nil {
+			t.Fatalf("New #%d error %v", n, err)
+		}
+		if want := wantBranch(txids); !reflect.DeepEqual(m.MerkleNodes, want) {
+			t.Errorf("New #%d: got branch %v, want %v", n, m.MerkleNodes, want)
+		}
+		if m.WitnessMerkleNodes != nil {
+			t.Errorf("New #%d: got witness branch %v without WithWitnessBranch",
+				n, m.WitnessMerkleNodes)
+		}
+		if old := CreateBtcLightMirrorV2(header, coinBaseTx, txids); !old.Equal(m) {
+			t.Errorf("New #%d: differs from CreateBtcLightMirrorV2: %v", n, old.Diff(m))
+		}
+	}
+
+	header, coinBaseTx, _, _ := newTestBlock(1)
+	if _, err := New(header, coinBaseTx, nil); err == nil {
+		t.Errorf("New: expected error for no transaction")
+	}
+}
+
+func TestWithParallelHashing(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 6, 17, 100, 1000} {
+		header, coinBaseTx, txids, wtxids := newTestBlock(n)
+		for _, workers := range []int{-1, 0, 2, 3, 8, 2000} {
+			m, err := New(header, coinBaseTx, txids, WithWitnessBranch(wtxids),
+				WithParallelHashing(workers), WithValidation(ValidateFull))
+			if err != nil {
+				t.Fatalf("New #%d (%d workers) error %v", n, workers, err)
+			}
+			if want := wantBranch(txids); !reflect.DeepEqual(m.MerkleNodes, want) {
+				t.Errorf("New #%d (%d workers): got branch %v, want %v", n,
+					workers, m.MerkleNodes, want)
+			}
+		}
+	}
+}
+
+func TestWithWitnessBranch(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 16} {
+		header, coinBaseTx, txids, wtxids := newTestBlock(n)
+		m, err := New(header, coinBaseTx, txids, WithWitnessBranch(wtxids),
+			WithValidation(ValidateFull))
+		if err != nil {
+			t.Fatalf("New #%d error %v", n, err)
+		}
+		leaves := append([]chainhash.Hash{{}}, wtxids[1:]...)
+		if want := wantBranch(leaves); !reflect.DeepEqual(m.WitnessMerkleNodes, want) {
+			t.Errorf("New #%d: got witness branch %v, want %v", n,
+				m.WitnessMerkleNodes, want)
+		}
+		if c := m.Clone(); !reflect.DeepEqual(c.WitnessMerkleNodes, m.WitnessMerkleNodes) {
+			t.Errorf("Clone #%d: got witness branch %v, want %v", n,
+				c.WitnessMerkleNodes, m.WitnessMerkleNodes)
+		}
+		b, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes #%d error %v", n, err)
+		}
+		var decoded BtcLightMirrorV2
+		if err := decoded.Deserialize(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Deserialize #%d error %v", n, err)
+		}
+		if decoded.WitnessMerkleNodes != nil || !decoded.Equal(m) {
+			t.Errorf("Deserialize #%d: got %v, want the mirror without witness "+
+				"branch", n, decoded.WitnessMerkleNodes)
+		}
+	}
+
+	header, coinBaseTx, txids, wtxids := newTestBlock(5)
+	wtxids[3][0] ^= 1
+	_, err := New(header, coinBaseTx, txids, WithWitnessBranch(wtxids),
+		WithValidation(ValidateFull))
+	if !errors.Is(err, ErrWitnessCommitment) {
+		t.Errorf("New: got error %v, want %v", err, ErrWitnessCommitment)
+	}
+	// Only ValidateFull checks the witness commitment.
+	if _, err := New(header, coinBaseTx, txids, WithWitnessBranch(wtxids)); err != nil {
+		t.Errorf("New error %v", err)
+	}
+	if _, err := New(header, coinBaseTx, txids, WithWitnessBranch(wtxids[1:])); err == nil {
+		t.Errorf("New: expected error for a witness branch of 4 transactions")
+	}
+
+	coinBaseTx.TxOut = coinBaseTx.TxOut[:1]
+	txids[0] = coinBaseTx.TxHash()
+	merkles := BuildMerkleTreeStore(&txids[0], txids[1:])
+	header.MerkleRoot = *merkles[len(merkles)-1]
+	_, err = New(header, coinBaseTx, txids, WithWitnessBranch(wtxids),
+		WithValidation(ValidateFull))
+	if !errors.Is(err, ErrWitnessCommitment) {
+		t.Errorf("New: got error %v, want %v without commitment", err,
+			ErrWitnessCommitment)
+	}
+}
+
+func TestWithValidation(t *testing.T) {
+	header, coinBaseTx, txids, _ := newTestBlock(3)
+	badRoot := *header
+	badRoot.MerkleRoot[0] ^= 1
+	epoch := *header
+	epoch.Timestamp = time.Unix(0, 0)
+
+	tests := []struct {
+		name   string
+		header *wire.BlockHeader
+		level  ValidationLevel
+		valid  bool
+	}{
+		{"none, bad merkle root", &badRoot, ValidateNone, true},
+		{"merkle, bad merkle root", &badRoot, ValidateMerkle, false},
+		{"full, bad merkle root", &badRoot, ValidateFull, false},
+		{"merkle, epoch timestamp", &epoch, ValidateMerkle, true},
+		{"full, epoch timestamp", &epoch, ValidateFull, false},
+		{"full", header, ValidateFull, true},
+	}
+	for _, test := range tests {
+		_, err := New(test.header, coinBaseTx, txids, WithValidation(test.level))
+		if test.valid && err != nil {
+			t.Errorf("New (%s) error %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("New (%s): expected error", test.name)
+		}
+	}
+	if _, err := New(&epoch, coinBaseTx, txids, WithValidation(ValidateFull)); !errors.Is(err, ErrInvalidMirror) {
+		t.Errorf("New: got error %v, want %v", err, ErrInvalidMirror)
+	}
+}
+
+func TestWithDeepCopy(t *testing.T) {
+	header, coinBaseTx, txids, _ := newTestBlock(2)
+	shared, err := New(header, coinBaseTx, txids, WithDeepCopy(false))
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+	copied, err := New(header, coinBaseTx, txids, WithDeepCopy(true))
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+
+	coinBaseTx.TxIn[0].SignatureScript[0] = 0xff
+	if shared.CoinBaseTx.TxIn[0].SignatureScript[0] != 0xff {
+		t.Errorf("WithDeepCopy(false): coinbase not shared")
+	}
+	if copied.CoinBaseTx.TxIn[0].SignatureScript[0] == 0xff {
+		t.Errorf("WithDeepCopy(true): coinbase shared")
+	}
+	if shared.CoinBaseTx.TxIn[0] != coinBaseTx.TxIn[0] {
+		t.Errorf("WithDeepCopy(false): inputs not shared")
+	}
+
+	// The header is copied either way.
+	header.Nonce++
+	if shared.BtcHeader.Nonce == header.Nonce {
+		t.Errorf("WithDeepCopy(false): header shared")
+	}
+}
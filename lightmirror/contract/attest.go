@@ -0,0 +1,157 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	// attestationDomainName and attestationDomainVersion are the name and
+	// version of the EIP-712 signing domain of mirror attestations.
+	attestationDomainName    = "MirrorRegistry"
+	attestationDomainVersion = "1"
+
+	// attestationType is the EIP-712 primary type of mirror attestations.
+	attestationType = "Mirror"
+)
+
+// attestationTypes are the EIP-712 types of mirror attestations:
+//
+//	EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)
+//	Mirror(bytes32 headerHash,address candidate,address reward,bytes32 coreBlockHash,uint64 height)
+//
+// The Mirror fields are those of the commitment of the mirror, see
+// lightmirror.BtcLightMirrorV2.CommitmentHash, along with its height.
+var attestationTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+	},
+	attestationType: {
+		{Name: "headerHash", Type: "bytes32"},
+		{Name: "candidate", Type: "address"},
+		{Name: "reward", Type: "address"},
+		{Name: "coreBlockHash", Type: "bytes32"},
+		{Name: "height", Type: "uint64"},
+	},
+}
+
+// Attestation is the statement of a validator that a mirror is the one of
+// the Bitcoin block at Height, signed off-chain as EIP-712 typed data.  The
+// signing domain binds the signature to the registry contract at
+// VerifyingContract on the Core chain with ID ChainID, so it can not be
+// replayed against another deployment.
+type Attestation struct {
+	ChainID           *big.Int
+	VerifyingContract common.Address
+
+	Mirror *lightmirror.BtcLightMirrorV2
+	Height int64
+}
+
+// TypedData returns the EIP-712 typed data signed for the attestation.  It
+// returns lightmirror.ErrNoPowerParams when the coinbase of the mirror has
+// no CORE output.
+func (a *Attestation) TypedData() (apitypes.TypedData, error) {
+	if a.ChainID == nil || a.ChainID.Sign() < 0 {
+		return apitypes.TypedData{}, errors.New("invalid chain ID")
+	}
+	if a.Height < 0 {
+		return apitypes.TypedData{}, fmt.Errorf("invalid height %d", a.Height)
+	}
+	candidate, reward, coreBlockHash := a.Mirror.ParsePowerParams()
+	if _, err := a.Mirror.CommitmentHash(); err != nil {
+		return apitypes.TypedData{}, err
+	}
+	headerHash := a.Mirror.BtcHeader.BlockHash()
+
+	return apitypes.TypedData{
+		Types:       attestationTypes,
+		PrimaryType: attestationType,
+		Domain: apitypes.TypedDataDomain{
+			Name:              attestationDomainName,
+			Version:           attestationDomainVersion,
+			ChainId:           (*math.HexOrDecimal256)(new(big.Int).Set(a.ChainID)),
+			VerifyingContract: a.VerifyingContract.Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"headerHash":    hexutil.Encode(headerHash[:]),
+			"candidate":     candidate.Hex(),
+			"reward":        reward.Hex(),
+			"coreBlockHash": coreBlockHash.Hex(),
+			"height":        fmt.Sprint(a.Height),
+		},
+	}, nil
+}
+
+// HashTypedData returns the EIP-712 hash of the attestation, the digest
+// validators sign:
+//
+//	keccak256("\x19\x01" || domainSeparator || hashStruct(message))
+func (a *Attestation) HashTypedData() (common.Hash, error) {
+	typedData, err := a.TypedData()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	domainSeparator, err := typedData.HashStruct("EIP712Domain", typedData.Domain.Map())
+	if err != nil {
+		return common.Hash{}, err
+	}
+	messageHash, err := typedData.HashStruct(typedData.PrimaryType, typedData.Message)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash([]byte("\x19\x01"), domainSeparator, messageHash), nil
+}
+
+// SignMirror signs the attestation with key.  The signature is the 65 byte
+// r || s || v with v 27 or 28, as eth_signTypedData returns it.
+func SignMirror(a *Attestation, key *ecdsa.PrivateKey) ([]byte, error) {
+	hash, err := a.HashTypedData()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(hash[:], key)
+	if err != nil {
+		return nil, err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
+
+// RecoverSigner returns the address of the key that produced the signature
+// of the attestation.  It accepts v as 27 or 28, and as 0 or 1.
+func RecoverSigner(a *Attestation, sig []byte) (common.Address, error) {
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("signature of %d bytes, want %d",
+			len(sig), crypto.SignatureLength)
+	}
+	hash, err := a.HashTypedData()
+	if err != nil {
+		return common.Address{}, err
+	}
+	sig = append([]byte(nil), sig...)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(hash[:], sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
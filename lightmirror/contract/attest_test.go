@@ -0,0 +1,160 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// attestationMirror returns a fixed mirror carrying power parameters.
+func attestationMirror() *lightmirror.BtcLightMirrorV2 {
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{0x01, 0x64},
+			Sequence:         0xffffffff,
+		}},
+		TxOut: []*wire.TxOut{
+			{Value: 5000000000, PkScript: []byte{0x51}},
+			{PkScript: corePkScript(
+				common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4"),
+				common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2"),
+				common.FromHex("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f"+
+					"8091a2b3c4d5e6f708192a3b4c5d6e7f"))},
+		},
+	}
+	coinBaseHash := coinBaseTx.TxHash()
+	header := &wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: coinBaseHash,
+		Timestamp:  time.Unix(1600000000, 0),
+		Bits:       0x207fffff,
+	}
+	return lightmirror.CreateBtcLightMirrorV2(header, coinBaseTx,
+		[]chainhash.Hash{coinBaseHash})
+}
+
+// attestationKey is the key of the attestation test vector.
+const attestationKey = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+// testAttestation returns the attestation of the test vector.
+func testAttestation() *Attestation {
+	return &Attestation{
+		ChainID:           big.NewInt(1116),
+		VerifyingContract: common.HexToAddress("0x0000000000000000000000000000000000001003"),
+		Mirror:            attestationMirror(),
+		Height:            100,
+	}
+}
+
+func TestSignMirror(t *testing.T) {
+	key, err := crypto.HexToECDSA(attestationKey)
+	if err != nil {
+		t.Fatalf("HexToECDSA error %v", err)
+	}
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	// The digest and signature of the attestation, computed outside of
+	// go-ethereum with the EIP-712 encoding and the deterministic RFC 6979
+	// low-s signing of ethers.js Wallet.signTypedData.
+	const (
+		wantSigner = "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+		wantHash   = "0xe8dabc7360624d2685d862aace8e8483d09019e7db89f8c528ed5af00ec221a7"
+		wantSig    = "0x83c3507275df0239c565b9553e2fd2939515bd12ad9ebed46a9131bb2c7312cc" +
+			"7ecf3d866bc2549b2c7cc816f23ecefc69551300776d1cd8551a459b059706f51b"
+	)
+	a := testAttestation()
+	if signer != common.HexToAddress(wantSigner) {
+		t.Fatalf("signer: got %v, want %v", signer, wantSigner)
+	}
+	hash, err := a.HashTypedData()
+	if err != nil || hash != common.HexToHash(wantHash) {
+		t.Errorf("HashTypedData: got %v, error %v, want %v", hash, err, wantHash)
+	}
+	sig, err := SignMirror(a, key)
+	if err != nil || !bytes.Equal(sig, common.FromHex(wantSig)) {
+		t.Errorf("SignMirror: got %x, error %v, want %v", sig, err, wantSig)
+	}
+
+	got, err := RecoverSigner(a, sig)
+	if err != nil || got != signer {
+		t.Errorf("RecoverSigner: got %v, error %v, want %v", got, err, signer)
+	}
+	raw := append([]byte(nil), sig...)
+	raw[crypto.RecoveryIDOffset] -= 27
+	if got, err := RecoverSigner(a, raw); err != nil || got != signer {
+		t.Errorf("RecoverSigner with v of %d: got %v, error %v, want %v",
+			raw[crypto.RecoveryIDOffset], got, err, signer)
+	}
+	if _, err := RecoverSigner(a, sig[:64]); err == nil {
+		t.Errorf("RecoverSigner: expected short signature error")
+	}
+
+	// The signature does not carry over to another domain or message.
+	otherChain := testAttestation()
+	otherChain.ChainID = big.NewInt(1115)
+	otherContract := testAttestation()
+	otherContract.VerifyingContract = common.Address{1}
+	otherHeight := testAttestation()
+	otherHeight.Height++
+	otherMirror := testAttestation()
+	otherMirror.Mirror.BtcHeader.Nonce++
+	tests := []struct {
+		name string
+		a    *Attestation
+	}{
+		{"chain ID", otherChain},
+		{"verifying contract", otherContract},
+		{"height", otherHeight},
+		{"mirror", otherMirror},
+	}
+	for _, test := range tests {
+		got, err := RecoverSigner(test.a, sig)
+		if err == nil && got == signer {
+			t.Errorf("RecoverSigner (other %s): recovered the signer", test.name)
+		}
+	}
+}
+
+func TestSignMirrorInvalid(t *testing.T) {
+	key, err := crypto.HexToECDSA(attestationKey)
+	if err != nil {
+		t.Fatalf("HexToECDSA error %v", err)
+	}
+	noParams := testAttestation()
+	noParams.Mirror.CoinBaseTx.TxOut = noParams.Mirror.CoinBaseTx.TxOut[:1]
+	noChain := testAttestation()
+	noChain.ChainID = nil
+	negative := testAttestation()
+	negative.Height = -1
+
+	tests := []struct {
+		name string
+		a    *Attestation
+		want error
+	}{
+		{"no power parameters", noParams, lightmirror.ErrNoPowerParams},
+		{"no chain ID", noChain, nil},
+		{"negative height", negative, nil},
+	}
+	for _, test := range tests {
+		_, err := SignMirror(test.a, key)
+		if err == nil || (test.want != nil && !errors.Is(err, test.want)) {
+			t.Errorf("SignMirror (%s): got error %v, want %v", test.name, err,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// batchCalldataBase is the size of the calldata of submitBatch for no
+	// mirrors: the method selector, the offset and the length of the
+	// array.
+	batchCalldataBase = 4 + 32 + 32
+
+	// batchMirrorOverhead is the calldata added for every mirror on top
+	// of its padded bytes: its offset in the array and its length.
+	batchMirrorOverhead = 32 + 32
+)
+
+// batchMirrorSize returns the calldata size taken by a mirror of n bytes in
+// a submitBatch call.
+func batchMirrorSize(n int) int {
+	return batchMirrorOverhead + (n+31)/32*32
+}
+
+// batchGroups splits the serialized mirrors into the groups which must be
+// submitted in the same transaction: a mirror which does not build on the
+// mirror before it replaces some of the preceding mirrors after a reorg, and
+// joins the group of the mirror before it.
+func batchGroups(mirrors []*lightmirror.BtcLightMirrorV2, data [][]byte) [][][]byte {
+	var groups [][][]byte
+	for i, m := range mirrors {
+		if i > 0 && m.BtcHeader.PrevBlock != mirrors[i-1].BtcHeader.BlockHash() {
+			last := len(groups) - 1
+			groups[last] = append(groups[last], data[i])
+			continue
+		}
+		groups = append(groups, [][]byte{data[i]})
+	}
+	return groups
+}
+
+// BuildSubmitBatchTx returns the transactions submitting the mirrors to the
+// contract through submitBatch, signed by opts.Signer but not sent.  Each
+// mirror is passed as its Serialize bytes and must pass the merkle check.
+//
+// The mirrors are submitted in the given order: every transaction carries
+// as many consecutive mirrors as fit in maxCalldataBytes of calldata, and
+// the transactions take consecutive nonces from the one of opts, or from
+// the pending nonce of the sender if opts sets none.  A mirror which does
+// not build on the mirror before it replaces mirrors after a reorg, and is
+// never split from the mirror before it.
+//
+// The gas limit of every transaction is estimated against the current state
+// of the contract unless opts sets one, so it does not account for the
+// mirrors of the preceding transactions.
+func (r *MirrorRegistryTransactor) BuildSubmitBatchTx(mirrors []*lightmirror.BtcLightMirrorV2, maxCalldataBytes int,
+	opts *bind.TransactOpts) ([]*types.Transaction, error) {
+
+	if len(mirrors) == 0 {
+		return nil, errors.New("no mirrors to submit")
+	}
+	data := make([][]byte, 0, len(mirrors))
+	for i, m := range mirrors {
+		if err := m.CheckMerkle(); err != nil {
+			return nil, fmt.Errorf("mirror #%d: %w", i, err)
+		}
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil {
+			return nil, fmt.Errorf("mirror #%d: %w", i, err)
+		}
+		data = append(data, buf.Bytes())
+	}
+
+	var batches [][][]byte
+	size := 0
+	for _, group := range batchGroups(mirrors, data) {
+		groupSize := 0
+		for _, mirror := range group {
+			groupSize += batchMirrorSize(len(mirror))
+		}
+		if batchCalldataBase+groupSize > maxCalldataBytes {
+			return nil, fmt.Errorf("%d mirrors which must be submitted "+
+				"together take %d bytes of calldata, over the budget of %d",
+				len(group), batchCalldataBase+groupSize, maxCalldataBytes)
+		}
+		if len(batches) == 0 || size+groupSize > maxCalldataBytes {
+			batches = append(batches, nil)
+			size = batchCalldataBase
+		}
+		last := len(batches) - 1
+		batches[last] = append(batches[last], group...)
+		size += groupSize
+	}
+
+	noSend := *opts
+	noSend.NoSend = true
+	txs := make([]*types.Transaction, 0, len(batches))
+	for i, batch := range batches {
+		if i > 0 {
+			noSend.Nonce = new(big.Int).SetUint64(txs[0].Nonce() + uint64(i))
+		}
+		tx, err := r.SubmitBatch(&noSend, batch)
+		if err != nil {
+			return nil, fmt.Errorf("batch #%d: %w", i, err)
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
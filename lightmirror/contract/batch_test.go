@@ -0,0 +1,162 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// decodeBatch returns the mirrors passed to submitBatch in data.
+func decodeBatch(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	parsed := registryABI(t)
+	method, err := parsed.MethodById(data)
+	if err != nil || method.Name != "submitBatch" {
+		t.Fatalf("MethodById: got %v, error %v", method, err)
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		t.Fatalf("Unpack error %v", err)
+	}
+	return args[0].([][]byte)
+}
+
+// replacement returns a mirror of another block with the parent of m.
+func replacement(t *testing.T, m *lightmirror.BtcLightMirrorV2) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	res := copyMirror(t, m)
+	res.BtcHeader.Nonce++
+	return res
+}
+
+func TestBuildSubmitBatchTx(t *testing.T) {
+	const budget = 2000
+	sim, registry, opts := simulatedRegistry(t)
+	ctx := context.Background()
+
+	// The last mirror replaces the one before it.
+	mirrors := storetest.Mirrors(49)
+	mirrors = append(mirrors, replacement(t, mirrors[48]))
+
+	txs, err := registry.BuildSubmitBatchTx(mirrors, budget, opts)
+	if err != nil {
+		t.Fatalf("BuildSubmitBatchTx error %v", err)
+	}
+	if len(txs) < 2 {
+		t.Fatalf("BuildSubmitBatchTx: got %d transactions, want several", len(txs))
+	}
+
+	var submitted [][]byte
+	for i, tx := range txs {
+		if len(tx.Data()) > budget {
+			t.Errorf("transaction #%d: got %d bytes of calldata, over %d", i,
+				len(tx.Data()), budget)
+		}
+		if tx.Nonce() != txs[0].Nonce()+uint64(i) {
+			t.Errorf("transaction #%d: got nonce %d after %d", i, tx.Nonce(),
+				txs[0].Nonce())
+		}
+		if tx.Gas() <= 21000 {
+			t.Errorf("transaction #%d: got gas limit %d", i, tx.Gas())
+		}
+		submitted = append(submitted, decodeBatch(t, tx.Data())...)
+
+		if err := sim.SendTransaction(ctx, tx); err != nil {
+			t.Fatalf("SendTransaction #%d error %v", i, err)
+		}
+	}
+	sim.Commit()
+
+	// The contract received the mirrors in order.
+	var received [][]byte
+	for i, tx := range txs {
+		receipt, err := sim.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			t.Fatalf("TransactionReceipt #%d error %v", i, err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful || len(receipt.Logs) != 1 {
+			t.Fatalf("TransactionReceipt #%d: got status %d with %d logs", i,
+				receipt.Status, len(receipt.Logs))
+		}
+		received = append(received, decodeBatch(t, receipt.Logs[0].Data)...)
+	}
+	if len(received) != len(mirrors) || len(submitted) != len(mirrors) {
+		t.Fatalf("got %d mirrors received, %d submitted, want %d",
+			len(received), len(submitted), len(mirrors))
+	}
+	for i, m := range mirrors {
+		if !bytes.Equal(received[i], serialize(t, m)) {
+			t.Errorf("received mirror #%d differs from the submitted one", i)
+		}
+	}
+	last := decodeBatch(t, txs[len(txs)-1].Data())
+	if len(last) < 2 || !bytes.Equal(last[len(last)-2], serialize(t, mirrors[48])) {
+		t.Errorf("replaced mirror was not submitted with its replacement")
+	}
+}
+
+func TestBuildSubmitBatchTxReplacement(t *testing.T) {
+	_, registry, opts := simulatedRegistry(t)
+	mirrors := storetest.Mirrors(3)
+	mirrors = append(mirrors, replacement(t, mirrors[2]))
+
+	// The budget fits the first three mirrors, which would split the
+	// replacement from the mirror it replaces.
+	budget := batchCalldataBase
+	for _, m := range mirrors[:3] {
+		budget += batchMirrorSize(len(serialize(t, m)))
+	}
+	txs, err := registry.BuildSubmitBatchTx(mirrors, budget, opts)
+	if err != nil {
+		t.Fatalf("BuildSubmitBatchTx error %v", err)
+	}
+	want := [][]*lightmirror.BtcLightMirrorV2{mirrors[:2], mirrors[2:]}
+	if len(txs) != len(want) {
+		t.Fatalf("BuildSubmitBatchTx: got %d transactions, want %d", len(txs),
+			len(want))
+	}
+	for i, tx := range txs {
+		batch := decodeBatch(t, tx.Data())
+		if len(batch) != len(want[i]) {
+			t.Fatalf("transaction #%d: got %d mirrors, want %d", i, len(batch),
+				len(want[i]))
+		}
+		for j, m := range want[i] {
+			if !bytes.Equal(batch[j], serialize(t, m)) {
+				t.Errorf("transaction #%d: mirror #%d differs", i, j)
+			}
+		}
+	}
+
+	// The calldata size is exact.
+	if size := len(txs[0].Data()); size != budget-batchMirrorSize(len(serialize(t, mirrors[2]))) {
+		t.Errorf("transaction #0: got %d bytes of calldata", size)
+	}
+
+	// A replacement pair over the budget can not be submitted.
+	pair := batchCalldataBase + batchMirrorSize(len(serialize(t, mirrors[2]))) +
+		batchMirrorSize(len(serialize(t, mirrors[3])))
+	if _, err := registry.BuildSubmitBatchTx(mirrors, pair-1, opts); err == nil {
+		t.Errorf("BuildSubmitBatchTx: expected budget error")
+	}
+}
+
+func TestBuildSubmitBatchTxInvalid(t *testing.T) {
+	_, registry, opts := simulatedRegistry(t)
+	mirrors := storetest.Mirrors(3)
+	mirrors[1].CoinBaseTx.LockTime++
+	if _, err := registry.BuildSubmitBatchTx(mirrors, 10000, opts); err == nil {
+		t.Errorf("BuildSubmitBatchTx: expected merkle error")
+	}
+	if _, err := registry.BuildSubmitBatchTx(nil, 10000, opts); err == nil {
+		t.Errorf("BuildSubmitBatchTx: expected error for no mirrors")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// stubCommitmentCode is the creation code of a stub contract computing the
+// registry storage key from its abi-encoded (bytes32 headerHash, address
+// candidate, address reward, bytes32 coreBlockHash) calldata, the way
+// keccak256(abi.encodePacked(...)) does:
+//
+//	init:    PUSH1 0x2b PUSH1 0x0c PUSH1 0 CODECOPY PUSH1 0x2b PUSH1 0 RETURN
+//	runtime: PUSH1 0 CALLDATALOAD PUSH1 0 MSTORE
+//	         PUSH1 0x20 CALLDATALOAD PUSH1 0x60 SHL PUSH1 0x20 MSTORE
+//	         PUSH1 0x40 CALLDATALOAD PUSH1 0x60 SHL PUSH1 0x34 MSTORE
+//	         PUSH1 0x60 CALLDATALOAD PUSH1 0x48 MSTORE
+//	         PUSH1 0x68 PUSH1 0 SHA3 PUSH1 0 MSTORE PUSH1 0x20 PUSH1 0 RETURN
+var stubCommitmentCode = common.FromHex("602b600c600039602b6000f3" +
+	"600035600052" + "60203560601b602052" + "60403560601b603452" +
+	"606035604852" + "606860002060005260206000f3")
+
+// corePkScript returns the pkScript of a CORE output carrying the given
+// power parameters.
+func corePkScript(candidate, reward common.Address, coreBlockHash []byte) []byte {
+	script := []byte{0x6a, byte(5 + 2*common.AddressLength + len(coreBlockHash))}
+	script = append(script, "CORE"...)
+	script = append(script, 0x01)
+	script = append(script, candidate[:]...)
+	script = append(script, reward[:]...)
+	return append(script, coreBlockHash...)
+}
+
+func TestCommitmentHash(t *testing.T) {
+	sim, opts := simulatedChain(t)
+	addr := deployStub(t, sim, opts, stubCommitmentCode)
+
+	mirrors := storetest.Mirrors(4)
+	for i, m := range mirrors {
+		candidate := common.BytesToAddress([]byte{byte(i + 1), 0xca})
+		reward := common.BytesToAddress([]byte{byte(i + 1), 0xee})
+		// Odd mirrors carry no Core block hash, which packs as zero.
+		var coreBlockHash common.Hash
+		pkScript := corePkScript(candidate, reward, nil)
+		if i%2 == 0 {
+			coreBlockHash = common.BytesToHash([]byte{byte(i + 1), 0xbb})
+			pkScript = corePkScript(candidate, reward, coreBlockHash[:])
+		}
+		m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut, &wire.TxOut{
+			PkScript: pkScript,
+		})
+
+		got, err := m.CommitmentHash()
+		if err != nil {
+			t.Fatalf("CommitmentHash #%d error %v", i, err)
+		}
+		headerHash := m.BtcHeader.BlockHash()
+		calldata := append([]byte(nil), headerHash[:]...)
+		calldata = append(calldata, common.LeftPadBytes(candidate[:], 32)...)
+		calldata = append(calldata, common.LeftPadBytes(reward[:], 32)...)
+		calldata = append(calldata, coreBlockHash[:]...)
+		want, err := sim.CallContract(context.Background(), ethereum.CallMsg{
+			To:   &addr,
+			Data: calldata,
+		}, nil)
+		if err != nil {
+			t.Fatalf("CallContract #%d error %v", i, err)
+		}
+		if got != common.BytesToHash(want) {
+			t.Errorf("CommitmentHash #%d: got %v, contract computes %x", i,
+				got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// CostReport describes the calldata of the submitMirror call for a mirror.
+// Gas amounts cover the calldata only, priced as of EIP-2028, and exclude
+// the base cost of the transaction and the execution of the contract.
+type CostReport struct {
+	// CalldataBytes is the size of the calldata, the method selector
+	// included.  It is the sum of ZeroBytes and NonZeroBytes.
+	CalldataBytes int
+	ZeroBytes     int
+	NonZeroBytes  int
+
+	// CalldataGas is the intrinsic gas charged for the calldata.
+	CalldataGas uint64
+
+	// StrippedBytesSaved and StrippedGasSaved are the calldata bytes and
+	// gas saved by submitting the coinbase without its witness data.  Both
+	// are zero when the coinbase has no witness.
+	StrippedBytesSaved int
+	StrippedGasSaved   uint64
+}
+
+// calldataGas returns the intrinsic gas charged for data along with its
+// zero byte count.
+func calldataGas(data []byte) (uint64, int) {
+	zeros := 0
+	for _, b := range data {
+		if b == 0 {
+			zeros++
+		}
+	}
+	nonZeros := uint64(len(data) - zeros)
+	return uint64(zeros)*params.TxDataZeroGas +
+		nonZeros*params.TxDataNonZeroGasEIP2028, zeros
+}
+
+// submitCalldata returns the calldata of submitMirror for m, with the
+// coinbase serialized with its witness data or without.
+func submitCalldata(m *lightmirror.BtcLightMirrorV2, stripWitness bool) ([]byte, error) {
+	header, coinbase, txCount, merkleNodes, err := submitArgs(m)
+	if err != nil {
+		return nil, err
+	}
+	if stripWitness {
+		var buf bytes.Buffer
+		if err := m.Coinbase().SerializeNoWitness(&buf); err != nil {
+			return nil, err
+		}
+		coinbase = buf.Bytes()
+	}
+	parsed, err := MirrorRegistryMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Pack("submitMirror", header, coinbase, txCount, merkleNodes)
+}
+
+// EstimateSubmissionCost returns the calldata cost of submitting the mirror
+// with BuildSubmitTx, and the savings of the witness-stripped coinbase
+// encoding.  The mirror is not verified.  The report is zero for a mirror
+// whose merkle branch is too long to submit.
+func EstimateSubmissionCost(m *lightmirror.BtcLightMirrorV2) CostReport {
+	data, err := submitCalldata(m, false)
+	if err != nil {
+		return CostReport{}
+	}
+	stripped, err := submitCalldata(m, true)
+	if err != nil {
+		return CostReport{}
+	}
+
+	gas, zeros := calldataGas(data)
+	strippedGas, _ := calldataGas(stripped)
+	return CostReport{
+		CalldataBytes:      len(data),
+		ZeroBytes:          zeros,
+		NonZeroBytes:       len(data) - zeros,
+		CalldataGas:        gas,
+		StrippedBytesSaved: len(data) - len(stripped),
+		StrippedGasSaved:   gas - strippedGas,
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// segwitMirror returns a copy of m whose coinbase carries the witness
+// reserved value, as in blocks since segwit.  The witness leaves the
+// transaction hash, hence the merkle branch, unchanged.
+func segwitMirror(t *testing.T, m *lightmirror.BtcLightMirrorV2) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	res := copyMirror(t, m)
+	res.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	return res
+}
+
+func TestEstimateSubmissionCost(t *testing.T) {
+	_, registry, opts := simulatedRegistry(t)
+	legacy := storetest.Mirrors(3)[2]
+	segwit := segwitMirror(t, legacy)
+
+	// Stripping the witness of a segwit coinbase saves the marker, flag,
+	// item count, item length and the 32 byte reserved value, 36 bytes
+	// which shorten the padded coinbase of this mirror by one 32 byte word.
+	stripped := copyMirror(t, segwit)
+	stripped.CoinBaseTx.TxIn[0].Witness = nil
+
+	tests := []struct {
+		name       string
+		mirror     *lightmirror.BtcLightMirrorV2
+		savedBytes int
+		savedGas   uint64
+		savedFrom  *lightmirror.BtcLightMirrorV2
+	}{
+		{"pre-segwit", legacy, 0, 0, legacy},
+		{"segwit", segwit, 32, 164, stripped},
+	}
+
+	for _, test := range tests {
+		got := EstimateSubmissionCost(test.mirror)
+
+		// The report matches the transaction BuildSubmitTx builds.
+		tx, err := registry.BuildSubmitTx(test.mirror, opts)
+		if err != nil {
+			t.Fatalf("BuildSubmitTx (%s) error %v", test.name, err)
+		}
+		data := tx.Data()
+		zeros := 0
+		for _, b := range data {
+			if b == 0 {
+				zeros++
+			}
+		}
+		intrinsic, err := core.IntrinsicGas(data, nil, false, true, true)
+		if err != nil {
+			t.Fatalf("IntrinsicGas (%s) error %v", test.name, err)
+		}
+		if got.CalldataBytes != len(data) || got.ZeroBytes != zeros ||
+			got.NonZeroBytes != len(data)-zeros ||
+			got.CalldataGas != intrinsic-params.TxGas {
+
+			t.Errorf("EstimateSubmissionCost (%s): got %+v, want %d bytes, "+
+				"%d zero, gas %d", test.name, got, len(data), zeros,
+				intrinsic-params.TxGas)
+		}
+
+		// The savings are those of submitting the stripped coinbase.
+		want := EstimateSubmissionCost(test.savedFrom)
+		if got.StrippedBytesSaved != test.savedBytes ||
+			got.StrippedGasSaved != test.savedGas ||
+			got.StrippedBytesSaved != got.CalldataBytes-want.CalldataBytes ||
+			got.StrippedGasSaved != got.CalldataGas-want.CalldataGas {
+
+			t.Errorf("EstimateSubmissionCost (%s): got savings of %d bytes, "+
+				"gas %d, want %d bytes, gas %d", test.name,
+				got.StrippedBytesSaved, got.StrippedGasSaved,
+				got.CalldataBytes-want.CalldataBytes,
+				got.CalldataGas-want.CalldataGas)
+		}
+		if want.StrippedBytesSaved != 0 || want.StrippedGasSaved != 0 {
+			t.Errorf("EstimateSubmissionCost (%s stripped): got %+v", test.name,
+				want)
+		}
+	}
+}
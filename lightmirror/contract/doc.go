@@ -0,0 +1,10 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package contract holds the Go bindings of the mirror registry contract of
+// the Core chain, generated from MirrorRegistry.abi, and builds the
+// transactions submitting mirrors to it.
+package contract
+
+//go:generate abigen --abi MirrorRegistry.abi --pkg contract --type MirrorRegistry --out registry.go
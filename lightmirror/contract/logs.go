@@ -0,0 +1,169 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// mirrorStoredEvent is the name of the event the registry emits for every
+// stored mirror:
+//
+//	event MirrorStored(bytes32 indexed blockHash, uint64 height, bytes mirror)
+//
+// blockHash is the block hash in the internal byte order of chainhash.Hash
+// and mirror the Serialize bytes of the mirror.  Before the migration to the
+// current layout blockHash was not indexed and sat first in the log data.
+// Both layouts share the event signature, hence its topic.
+const mirrorStoredEvent = "MirrorStored"
+
+// scanLogsRange is the number of blocks ScanLogs asks logs for at once, as
+// most nodes bound the range of a log query.
+const scanLogsRange = 2000
+
+// VerificationError is returned for a MirrorStored log that decodes to a
+// mirror which does not pass verification.
+type VerificationError struct {
+	BlockHash chainhash.Hash
+	Err       error
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("mirror %v: %v", e.BlockHash, e.Err)
+}
+
+// Unwrap returns the underlying verification error.
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMirrorFromLog decodes the mirror carried by a MirrorStored log of the
+// contract described by contractABI, in either event layout, then checks
+// that its hash matches the logged one and runs CheckMerkle.  When the
+// mirror decodes but fails these checks, it is returned along with a
+// *VerificationError.
+func ParseMirrorFromLog(log types.Log, contractABI abi.ABI) (*lightmirror.BtcLightMirrorV2, error) {
+	_, m, err := parseMirrorStored(log, contractABI)
+	return m, err
+}
+
+// parseMirrorStored is ParseMirrorFromLog, also returning the logged height
+// once it is decoded.
+func parseMirrorStored(log types.Log, contractABI abi.ABI) (int64, *lightmirror.BtcLightMirrorV2, error) {
+	if len(log.Topics) == 0 {
+		return 0, nil, errors.New("anonymous log")
+	}
+	event, err := contractABI.EventByID(log.Topics[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	if event.Name != mirrorStoredEvent {
+		return 0, nil, fmt.Errorf("log of event %s, want %s", event.Name,
+			mirrorStoredEvent)
+	}
+
+	inputs := event.Inputs.NonIndexed()
+	switch len(log.Topics) {
+	case 1:
+		// Legacy layout: everything is in the data.
+		inputs = make(abi.Arguments, 0, len(event.Inputs))
+		for _, input := range event.Inputs {
+			input.Indexed = false
+			inputs = append(inputs, input)
+		}
+	case 2:
+	default:
+		return 0, nil, fmt.Errorf("%s log with %d topics", mirrorStoredEvent,
+			len(log.Topics))
+	}
+	values := make(map[string]interface{})
+	if err := inputs.UnpackIntoMap(values, log.Data); err != nil {
+		return 0, nil, err
+	}
+
+	logged, ok := values["blockHash"].([32]byte)
+	if len(log.Topics) == 2 {
+		logged, ok = log.Topics[1], true
+	}
+	height, heightOK := values["height"].(uint64)
+	data, dataOK := values["mirror"].([]byte)
+	if !ok || !heightOK || !dataOK {
+		return 0, nil, fmt.Errorf("%s event does not match the expected "+
+			"layout", mirrorStoredEvent)
+	}
+
+	m := new(lightmirror.BtcLightMirrorV2)
+	if err := m.Deserialize(bytes.NewReader(data)); err != nil {
+		return int64(height), nil, err
+	}
+	hash := m.BtcHeader.BlockHash()
+	if hash != chainhash.Hash(logged) {
+		return int64(height), m, &VerificationError{
+			BlockHash: chainhash.Hash(logged),
+			Err:       fmt.Errorf("logged mirror hashes to %v", hash),
+		}
+	}
+	if err := m.CheckMerkle(); err != nil {
+		return int64(height), m, &VerificationError{BlockHash: hash, Err: err}
+	}
+	return int64(height), m, nil
+}
+
+// ScanLogs calls fn for every MirrorStored log the contract at contractAddr
+// emitted in the Core chain blocks [start, end], in log order, with the
+// logged height and the result of ParseMirrorFromLog.  Logs that do not
+// decode are passed with a nil mirror, and a height of zero when it could
+// not be decoded either.  client is typically an *ethclient.Client.
+//
+// Scanning stops at the first error of the client or of fn, which ScanLogs
+// returns unless it is lightmirror.ErrStopIteration.
+func ScanLogs(ctx context.Context, client ethereum.LogFilterer, contractAddr common.Address, contractABI abi.ABI,
+	start, end uint64, fn func(height int64, m *lightmirror.BtcLightMirrorV2, verifyErr error) error) error {
+
+	event, ok := contractABI.Events[mirrorStoredEvent]
+	if !ok {
+		return fmt.Errorf("ABI has no %s event", mirrorStoredEvent)
+	}
+	for from := start; from <= end; from += scanLogsRange {
+		to := from + scanLogsRange - 1
+		if to > end || to < from {
+			to = end
+		}
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{contractAddr},
+			Topics:    [][]common.Hash{{event.ID}},
+		})
+		if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			height, m, verifyErr := parseMirrorStored(log, contractABI)
+			if err := fn(height, m, verifyErr); err != nil {
+				if errors.Is(err, lightmirror.ErrStopIteration) {
+					return nil
+				}
+				return err
+			}
+		}
+		if to == end {
+			break
+		}
+	}
+	return nil
+}
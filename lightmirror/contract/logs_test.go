@@ -0,0 +1,182 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// stubEmitterCode is the creation code of a stub contract emitting a log
+// for every call.  The calldata holds two topics followed by the log data;
+// the log carries only the first topic when the second one is zero:
+//
+//	init:    PUSH1 0x24 PUSH1 0x0c PUSH1 0 CODECOPY PUSH1 0x24 PUSH1 0 RETURN
+//	runtime: PUSH1 0x40 CALLDATASIZE SUB DUP1 PUSH1 0x40 PUSH1 0
+//	         CALLDATACOPY PUSH1 0x20 CALLDATALOAD DUP1 PUSH1 0x1a JUMPI
+//	         POP PUSH1 0 CALLDATALOAD SWAP1 PUSH1 0 LOG1 STOP
+//	         JUMPDEST SWAP1 PUSH1 0 CALLDATALOAD SWAP1 PUSH1 0 LOG2 STOP
+var stubEmitterCode = common.FromHex("6024600c60003960246000f3" +
+	"604036038060406000376020358060" + "1a5750600035906000a100" +
+	"5b90600035906000a200")
+
+// mirrorStoredLog returns the topics and data of a MirrorStored log for m,
+// in the legacy layout or the current one.
+func mirrorStoredLog(t *testing.T, m *lightmirror.BtcLightMirrorV2, height uint64, legacy bool) ([]common.Hash, []byte) {
+	t.Helper()
+	event := registryABI(t).Events[mirrorStoredEvent]
+	hash := common.Hash(m.BtcHeader.BlockHash())
+	mirror := serialize(t, m)
+
+	if legacy {
+		var inputs abi.Arguments
+		for _, input := range event.Inputs {
+			input.Indexed = false
+			inputs = append(inputs, input)
+		}
+		data, err := inputs.Pack([32]byte(hash), height, mirror)
+		if err != nil {
+			t.Fatalf("Pack error %v", err)
+		}
+		return []common.Hash{event.ID}, data
+	}
+	data, err := event.Inputs.NonIndexed().Pack(height, mirror)
+	if err != nil {
+		t.Fatalf("Pack error %v", err)
+	}
+	return []common.Hash{event.ID, hash}, data
+}
+
+func TestParseMirrorFromLog(t *testing.T) {
+	parsed := registryABI(t)
+	mirrors := storetest.Mirrors(3)
+	m := mirrors[2]
+
+	indexedTopics, indexedData := mirrorStoredLog(t, m, 7, false)
+	legacyTopics, legacyData := mirrorStoredLog(t, m, 7, true)
+	otherTopics, _ := mirrorStoredLog(t, mirrors[1], 7, false)
+	badMerkle := copyMirror(t, m)
+	badMerkle.MerkleNodes[0][0] ^= 1
+	badMerkleTopics, badMerkleData := mirrorStoredLog(t, badMerkle, 7, false)
+
+	tests := []struct {
+		name         string
+		topics       []common.Hash
+		data         []byte
+		wantMirror   bool
+		verification bool
+	}{
+		{"indexed", indexedTopics, indexedData, true, false},
+		{"legacy", legacyTopics, legacyData, true, false},
+		{"hash mismatch", []common.Hash{indexedTopics[0], otherTopics[1]}, indexedData, true, true},
+		{"merkle failure", badMerkleTopics, badMerkleData, true, true},
+		{"truncated", indexedTopics, indexedData[:len(indexedData)-64], false, false},
+		{"no topics", nil, indexedData, false, false},
+		{"other event", []common.Hash{{1}, indexedTopics[1]}, indexedData, false, false},
+		{"extra topic", append(indexedTopics[:2:2], common.Hash{}), indexedData, false, false},
+	}
+
+	for _, test := range tests {
+		got, err := ParseMirrorFromLog(types.Log{Topics: test.topics, Data: test.data}, parsed)
+		if !test.wantMirror {
+			if err == nil || got != nil {
+				t.Errorf("ParseMirrorFromLog (%s): got %v, error %v, want error",
+					test.name, got, err)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("ParseMirrorFromLog (%s): got error %v, want mirror",
+				test.name, err)
+			continue
+		}
+		var verr *VerificationError
+		if errors.As(err, &verr) != test.verification || (!test.verification && err != nil) {
+			t.Errorf("ParseMirrorFromLog (%s): got error %v", test.name, err)
+		}
+		if !test.verification && got.BtcHeader.BlockHash() != m.BtcHeader.BlockHash() {
+			t.Errorf("ParseMirrorFromLog (%s): got mirror %v, want %v", test.name,
+				got.BtcHeader.BlockHash(), m.BtcHeader.BlockHash())
+		}
+	}
+}
+
+func TestScanLogs(t *testing.T) {
+	sim, opts := simulatedChain(t)
+	addr := deployStub(t, sim, opts, stubEmitterCode)
+	emitter := bind.NewBoundContract(addr, abi.ABI{}, sim, sim, sim)
+	start := sim.Blockchain().CurrentBlock().NumberU64() + 1
+
+	// The contract migrated to the indexed layout after the first mirrors.
+	mirrors := storetest.Mirrors(6)
+	corrupt := copyMirror(t, mirrors[4])
+	corrupt.CoinBaseTx.LockTime++
+	submitted := append(mirrors[:4:4], corrupt, mirrors[5])
+	for i, m := range submitted {
+		topics, data := mirrorStoredLog(t, m, uint64(100+i), i < 2)
+		calldata := append(topics[0].Bytes(), make([]byte, 32)...)
+		if len(topics) == 2 {
+			calldata = append(topics[0].Bytes(), topics[1].Bytes()...)
+		}
+		if _, err := emitter.RawTransact(opts, append(calldata, data...)); err != nil {
+			t.Fatalf("RawTransact #%d error %v", i, err)
+		}
+		sim.Commit()
+	}
+	end := sim.Blockchain().CurrentBlock().NumberU64()
+
+	var heights []int64
+	var failed []int64
+	err := ScanLogs(context.Background(), sim, addr, registryABI(t), start, end,
+		func(height int64, m *lightmirror.BtcLightMirrorV2, verifyErr error) error {
+			heights = append(heights, height)
+			i := height - 100
+			if verifyErr != nil {
+				failed = append(failed, height)
+				return nil
+			}
+			if m.BtcHeader.BlockHash() != submitted[i].BtcHeader.BlockHash() {
+				t.Errorf("ScanLogs at height %d: got mirror %v", height,
+					m.BtcHeader.BlockHash())
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("ScanLogs error %v", err)
+	}
+	if len(heights) != len(submitted) {
+		t.Fatalf("ScanLogs: got heights %v, want %d logs", heights, len(submitted))
+	}
+	for i, height := range heights {
+		if height != int64(100+i) {
+			t.Errorf("ScanLogs #%d: got height %d, want %d", i, height, 100+i)
+		}
+	}
+	if len(failed) != 1 || failed[0] != 104 {
+		t.Errorf("ScanLogs: got verification failures at %v, want [104]", failed)
+	}
+
+	// Scanning stops early on ErrStopIteration, and covers only the range.
+	calls := 0
+	err = ScanLogs(context.Background(), sim, addr, registryABI(t), start+1, end,
+		func(height int64, m *lightmirror.BtcLightMirrorV2, verifyErr error) error {
+			calls++
+			if height != 101 {
+				t.Errorf("ScanLogs from %d: got first height %d", start+1, height)
+			}
+			return lightmirror.ErrStopIteration
+		})
+	if err != nil || calls != 1 {
+		t.Errorf("ScanLogs: got error %v after %d calls, want nil after 1", err, calls)
+	}
+}
@@ -0,0 +1,489 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package contract
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+)
+
+// MirrorRegistryMetaData contains all meta data concerning the MirrorRegistry contract.
+var MirrorRegistryMetaData = &bind.MetaData{
+	ABI: "[{\"type\":\"function\",\"name\":\"submitMirror\",\"stateMutability\":\"nonpayable\",\"inputs\":[{\"name\":\"header\",\"type\":\"bytes\"},{\"name\":\"coinbase\",\"type\":\"bytes\"},{\"name\":\"txCount\",\"type\":\"uint32\"},{\"name\":\"merkleNodes\",\"type\":\"bytes32[]\"}],\"outputs\":[]},{\"type\":\"function\",\"name\":\"submitBatch\",\"stateMutability\":\"nonpayable\",\"inputs\":[{\"name\":\"mirrors\",\"type\":\"bytes[]\"}],\"outputs\":[]},{\"type\":\"function\",\"name\":\"tip\",\"stateMutability\":\"view\",\"inputs\":[],\"outputs\":[{\"name\":\"height\",\"type\":\"uint64\"},{\"name\":\"blockHash\",\"type\":\"bytes32\"}]},{\"type\":\"function\",\"name\":\"mirrorAt\",\"stateMutability\":\"view\",\"inputs\":[{\"name\":\"height\",\"type\":\"uint64\"}],\"outputs\":[{\"name\":\"blockHash\",\"type\":\"bytes32\"},{\"name\":\"commitment\",\"type\":\"bytes32\"}]},{\"type\":\"function\",\"name\":\"hasMirror\",\"stateMutability\":\"view\",\"inputs\":[{\"name\":\"blockHash\",\"type\":\"bytes32\"}],\"outputs\":[{\"name\":\"\",\"type\":\"bool\"}]},{\"type\":\"event\",\"name\":\"MirrorStored\",\"anonymous\":false,\"inputs\":[{\"name\":\"blockHash\",\"type\":\"bytes32\",\"indexed\":true},{\"name\":\"height\",\"type\":\"uint64\",\"indexed\":false},{\"name\":\"mirror\",\"type\":\"bytes\",\"indexed\":false}]}]",
+}
+
+// MirrorRegistryABI is the input ABI used to generate the binding from.
+// Deprecated: Use MirrorRegistryMetaData.ABI instead.
+var MirrorRegistryABI = MirrorRegistryMetaData.ABI
+
+// MirrorRegistry is an auto generated Go binding around an Ethereum contract.
+type MirrorRegistry struct {
+	MirrorRegistryCaller     // Read-only binding to the contract
+	MirrorRegistryTransactor // Write-only binding to the contract
+	MirrorRegistryFilterer   // Log filterer for contract events
+}
+
+// MirrorRegistryCaller is an auto generated read-only Go binding around an Ethereum contract.
+type MirrorRegistryCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// MirrorRegistryTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type MirrorRegistryTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// MirrorRegistryFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type MirrorRegistryFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// MirrorRegistrySession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type MirrorRegistrySession struct {
+	Contract     *MirrorRegistry   // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// MirrorRegistryCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type MirrorRegistryCallerSession struct {
+	Contract *MirrorRegistryCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts         // Call options to use throughout this session
+}
+
+// MirrorRegistryTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type MirrorRegistryTransactorSession struct {
+	Contract     *MirrorRegistryTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts         // Transaction auth options to use throughout this session
+}
+
+// MirrorRegistryRaw is an auto generated low-level Go binding around an Ethereum contract.
+type MirrorRegistryRaw struct {
+	Contract *MirrorRegistry // Generic contract binding to access the raw methods on
+}
+
+// MirrorRegistryCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type MirrorRegistryCallerRaw struct {
+	Contract *MirrorRegistryCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// MirrorRegistryTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type MirrorRegistryTransactorRaw struct {
+	Contract *MirrorRegistryTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewMirrorRegistry creates a new instance of MirrorRegistry, bound to a specific deployed contract.
+func NewMirrorRegistry(address common.Address, backend bind.ContractBackend) (*MirrorRegistry, error) {
+	contract, err := bindMirrorRegistry(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorRegistry{MirrorRegistryCaller: MirrorRegistryCaller{contract: contract}, MirrorRegistryTransactor: MirrorRegistryTransactor{contract: contract}, MirrorRegistryFilterer: MirrorRegistryFilterer{contract: contract}}, nil
+}
+
+// NewMirrorRegistryCaller creates a new read-only instance of MirrorRegistry, bound to a specific deployed contract.
+func NewMirrorRegistryCaller(address common.Address, caller bind.ContractCaller) (*MirrorRegistryCaller, error) {
+	contract, err := bindMirrorRegistry(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorRegistryCaller{contract: contract}, nil
+}
+
+// NewMirrorRegistryTransactor creates a new write-only instance of MirrorRegistry, bound to a specific deployed contract.
+func NewMirrorRegistryTransactor(address common.Address, transactor bind.ContractTransactor) (*MirrorRegistryTransactor, error) {
+	contract, err := bindMirrorRegistry(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorRegistryTransactor{contract: contract}, nil
+}
+
+// NewMirrorRegistryFilterer creates a new log filterer instance of MirrorRegistry, bound to a specific deployed contract.
+func NewMirrorRegistryFilterer(address common.Address, filterer bind.ContractFilterer) (*MirrorRegistryFilterer, error) {
+	contract, err := bindMirrorRegistry(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorRegistryFilterer{contract: contract}, nil
+}
+
+// bindMirrorRegistry binds a generic wrapper to an already deployed contract.
+func bindMirrorRegistry(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := abi.JSON(strings.NewReader(MirrorRegistryABI))
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_MirrorRegistry *MirrorRegistryRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _MirrorRegistry.Contract.MirrorRegistryCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_MirrorRegistry *MirrorRegistryRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.MirrorRegistryTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_MirrorRegistry *MirrorRegistryRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.MirrorRegistryTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_MirrorRegistry *MirrorRegistryCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _MirrorRegistry.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_MirrorRegistry *MirrorRegistryTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_MirrorRegistry *MirrorRegistryTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.contract.Transact(opts, method, params...)
+}
+
+// HasMirror is a free data retrieval call binding the contract method 0x2408ab7d.
+//
+// Solidity: function hasMirror(bytes32 blockHash) view returns(bool)
+func (_MirrorRegistry *MirrorRegistryCaller) HasMirror(opts *bind.CallOpts, blockHash [32]byte) (bool, error) {
+	var out []interface{}
+	err := _MirrorRegistry.contract.Call(opts, &out, "hasMirror", blockHash)
+
+	if err != nil {
+		return *new(bool), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(bool)).(*bool)
+
+	return out0, err
+
+}
+
+// HasMirror is a free data retrieval call binding the contract method 0x2408ab7d.
+//
+// Solidity: function hasMirror(bytes32 blockHash) view returns(bool)
+func (_MirrorRegistry *MirrorRegistrySession) HasMirror(blockHash [32]byte) (bool, error) {
+	return _MirrorRegistry.Contract.HasMirror(&_MirrorRegistry.CallOpts, blockHash)
+}
+
+// HasMirror is a free data retrieval call binding the contract method 0x2408ab7d.
+//
+// Solidity: function hasMirror(bytes32 blockHash) view returns(bool)
+func (_MirrorRegistry *MirrorRegistryCallerSession) HasMirror(blockHash [32]byte) (bool, error) {
+	return _MirrorRegistry.Contract.HasMirror(&_MirrorRegistry.CallOpts, blockHash)
+}
+
+// MirrorAt is a free data retrieval call binding the contract method 0x957fa3fc.
+//
+// Solidity: function mirrorAt(uint64 height) view returns(bytes32 blockHash, bytes32 commitment)
+func (_MirrorRegistry *MirrorRegistryCaller) MirrorAt(opts *bind.CallOpts, height uint64) (struct {
+	BlockHash  [32]byte
+	Commitment [32]byte
+}, error) {
+	var out []interface{}
+	err := _MirrorRegistry.contract.Call(opts, &out, "mirrorAt", height)
+
+	outstruct := new(struct {
+		BlockHash  [32]byte
+		Commitment [32]byte
+	})
+	if err != nil {
+		return *outstruct, err
+	}
+
+	outstruct.BlockHash = *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+	outstruct.Commitment = *abi.ConvertType(out[1], new([32]byte)).(*[32]byte)
+
+	return *outstruct, err
+
+}
+
+// MirrorAt is a free data retrieval call binding the contract method 0x957fa3fc.
+//
+// Solidity: function mirrorAt(uint64 height) view returns(bytes32 blockHash, bytes32 commitment)
+func (_MirrorRegistry *MirrorRegistrySession) MirrorAt(height uint64) (struct {
+	BlockHash  [32]byte
+	Commitment [32]byte
+}, error) {
+	return _MirrorRegistry.Contract.MirrorAt(&_MirrorRegistry.CallOpts, height)
+}
+
+// MirrorAt is a free data retrieval call binding the contract method 0x957fa3fc.
+//
+// Solidity: function mirrorAt(uint64 height) view returns(bytes32 blockHash, bytes32 commitment)
+func (_MirrorRegistry *MirrorRegistryCallerSession) MirrorAt(height uint64) (struct {
+	BlockHash  [32]byte
+	Commitment [32]byte
+}, error) {
+	return _MirrorRegistry.Contract.MirrorAt(&_MirrorRegistry.CallOpts, height)
+}
+
+// Tip is a free data retrieval call binding the contract method 0x2755cd2d.
+//
+// Solidity: function tip() view returns(uint64 height, bytes32 blockHash)
+func (_MirrorRegistry *MirrorRegistryCaller) Tip(opts *bind.CallOpts) (struct {
+	Height    uint64
+	BlockHash [32]byte
+}, error) {
+	var out []interface{}
+	err := _MirrorRegistry.contract.Call(opts, &out, "tip")
+
+	outstruct := new(struct {
+		Height    uint64
+		BlockHash [32]byte
+	})
+	if err != nil {
+		return *outstruct, err
+	}
+
+	outstruct.Height = *abi.ConvertType(out[0], new(uint64)).(*uint64)
+	outstruct.BlockHash = *abi.ConvertType(out[1], new([32]byte)).(*[32]byte)
+
+	return *outstruct, err
+
+}
+
+// Tip is a free data retrieval call binding the contract method 0x2755cd2d.
+//
+// Solidity: function tip() view returns(uint64 height, bytes32 blockHash)
+func (_MirrorRegistry *MirrorRegistrySession) Tip() (struct {
+	Height    uint64
+	BlockHash [32]byte
+}, error) {
+	return _MirrorRegistry.Contract.Tip(&_MirrorRegistry.CallOpts)
+}
+
+// Tip is a free data retrieval call binding the contract method 0x2755cd2d.
+//
+// Solidity: function tip() view returns(uint64 height, bytes32 blockHash)
+func (_MirrorRegistry *MirrorRegistryCallerSession) Tip() (struct {
+	Height    uint64
+	BlockHash [32]byte
+}, error) {
+	return _MirrorRegistry.Contract.Tip(&_MirrorRegistry.CallOpts)
+}
+
+// SubmitBatch is a paid mutator transaction binding the contract method 0xda235f17.
+//
+// Solidity: function submitBatch(bytes[] mirrors) returns()
+func (_MirrorRegistry *MirrorRegistryTransactor) SubmitBatch(opts *bind.TransactOpts, mirrors [][]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.contract.Transact(opts, "submitBatch", mirrors)
+}
+
+// SubmitBatch is a paid mutator transaction binding the contract method 0xda235f17.
+//
+// Solidity: function submitBatch(bytes[] mirrors) returns()
+func (_MirrorRegistry *MirrorRegistrySession) SubmitBatch(mirrors [][]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.SubmitBatch(&_MirrorRegistry.TransactOpts, mirrors)
+}
+
+// SubmitBatch is a paid mutator transaction binding the contract method 0xda235f17.
+//
+// Solidity: function submitBatch(bytes[] mirrors) returns()
+func (_MirrorRegistry *MirrorRegistryTransactorSession) SubmitBatch(mirrors [][]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.SubmitBatch(&_MirrorRegistry.TransactOpts, mirrors)
+}
+
+// SubmitMirror is a paid mutator transaction binding the contract method 0x6b0c278e.
+//
+// Solidity: function submitMirror(bytes header, bytes coinbase, uint32 txCount, bytes32[] merkleNodes) returns()
+func (_MirrorRegistry *MirrorRegistryTransactor) SubmitMirror(opts *bind.TransactOpts, header []byte, coinbase []byte, txCount uint32, merkleNodes [][32]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.contract.Transact(opts, "submitMirror", header, coinbase, txCount, merkleNodes)
+}
+
+// SubmitMirror is a paid mutator transaction binding the contract method 0x6b0c278e.
+//
+// Solidity: function submitMirror(bytes header, bytes coinbase, uint32 txCount, bytes32[] merkleNodes) returns()
+func (_MirrorRegistry *MirrorRegistrySession) SubmitMirror(header []byte, coinbase []byte, txCount uint32, merkleNodes [][32]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.SubmitMirror(&_MirrorRegistry.TransactOpts, header, coinbase, txCount, merkleNodes)
+}
+
+// SubmitMirror is a paid mutator transaction binding the contract method 0x6b0c278e.
+//
+// Solidity: function submitMirror(bytes header, bytes coinbase, uint32 txCount, bytes32[] merkleNodes) returns()
+func (_MirrorRegistry *MirrorRegistryTransactorSession) SubmitMirror(header []byte, coinbase []byte, txCount uint32, merkleNodes [][32]byte) (*types.Transaction, error) {
+	return _MirrorRegistry.Contract.SubmitMirror(&_MirrorRegistry.TransactOpts, header, coinbase, txCount, merkleNodes)
+}
+
+// MirrorRegistryMirrorStoredIterator is returned from FilterMirrorStored and is used to iterate over the raw logs and unpacked data for MirrorStored events raised by the MirrorRegistry contract.
+type MirrorRegistryMirrorStoredIterator struct {
+	Event *MirrorRegistryMirrorStored // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *MirrorRegistryMirrorStoredIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(MirrorRegistryMirrorStored)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(MirrorRegistryMirrorStored)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *MirrorRegistryMirrorStoredIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *MirrorRegistryMirrorStoredIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// MirrorRegistryMirrorStored represents a MirrorStored event raised by the MirrorRegistry contract.
+type MirrorRegistryMirrorStored struct {
+	BlockHash [32]byte
+	Height    uint64
+	Mirror    []byte
+	Raw       types.Log // Blockchain specific contextual infos
+}
+
+// FilterMirrorStored is a free log retrieval operation binding the contract event 0xd28f636df1551cafcf0dd611f9d9452ce1d7d72f52963b10ee08f52d01263024.
+//
+// Solidity: event MirrorStored(bytes32 indexed blockHash, uint64 height, bytes mirror)
+func (_MirrorRegistry *MirrorRegistryFilterer) FilterMirrorStored(opts *bind.FilterOpts, blockHash [][32]byte) (*MirrorRegistryMirrorStoredIterator, error) {
+
+	var blockHashRule []interface{}
+	for _, blockHashItem := range blockHash {
+		blockHashRule = append(blockHashRule, blockHashItem)
+	}
+
+	logs, sub, err := _MirrorRegistry.contract.FilterLogs(opts, "MirrorStored", blockHashRule)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorRegistryMirrorStoredIterator{contract: _MirrorRegistry.contract, event: "MirrorStored", logs: logs, sub: sub}, nil
+}
+
+// WatchMirrorStored is a free log subscription operation binding the contract event 0xd28f636df1551cafcf0dd611f9d9452ce1d7d72f52963b10ee08f52d01263024.
+//
+// Solidity: event MirrorStored(bytes32 indexed blockHash, uint64 height, bytes mirror)
+func (_MirrorRegistry *MirrorRegistryFilterer) WatchMirrorStored(opts *bind.WatchOpts, sink chan<- *MirrorRegistryMirrorStored, blockHash [][32]byte) (event.Subscription, error) {
+
+	var blockHashRule []interface{}
+	for _, blockHashItem := range blockHash {
+		blockHashRule = append(blockHashRule, blockHashItem)
+	}
+
+	logs, sub, err := _MirrorRegistry.contract.WatchLogs(opts, "MirrorStored", blockHashRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(MirrorRegistryMirrorStored)
+				if err := _MirrorRegistry.contract.UnpackLog(event, "MirrorStored", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseMirrorStored is a log parse operation binding the contract event 0xd28f636df1551cafcf0dd611f9d9452ce1d7d72f52963b10ee08f52d01263024.
+//
+// Solidity: event MirrorStored(bytes32 indexed blockHash, uint64 height, bytes mirror)
+func (_MirrorRegistry *MirrorRegistryFilterer) ParseMirrorStored(log types.Log) (*MirrorRegistryMirrorStored, error) {
+	event := new(MirrorRegistryMirrorStored)
+	if err := _MirrorRegistry.contract.UnpackLog(event, "MirrorStored", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
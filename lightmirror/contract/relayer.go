@@ -0,0 +1,683 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// defaultRelayInterval is the default time between two rounds of a
+	// Relayer.
+	defaultRelayInterval = 10 * time.Second
+
+	// relayerErrorBuffer is the number of errors a Relayer holds for its
+	// reader before dropping new ones.
+	relayerErrorBuffer = 16
+
+	// maxRelayReorgDepth bounds the number of blocks a Relayer fetches
+	// back to connect a Bitcoin reorg to its chain.
+	maxRelayReorgDepth = 100
+)
+
+// ErrRelayerStarted is returned by Start when the relayer already runs, ran
+// or was stopped.
+var ErrRelayerStarted = errors.New("relayer already started")
+
+// RelayerBackend is the Core chain client of a Relayer.  *ethclient.Client
+// satisfies it.
+type RelayerBackend interface {
+	bind.ContractBackend
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// GasPriceStrategy returns the gas price of the next submission.
+type GasPriceStrategy func(ctx context.Context, backend bind.ContractTransactor) (*big.Int, error)
+
+// SuggestedGasPrice is the GasPriceStrategy paying the gas price suggested
+// by the node.
+func SuggestedGasPrice(ctx context.Context, backend bind.ContractTransactor) (*big.Int, error) {
+	return backend.SuggestGasPrice(ctx)
+}
+
+// FixedGasPrice returns the GasPriceStrategy always paying price.
+func FixedGasPrice(price *big.Int) GasPriceStrategy {
+	price = new(big.Int).Set(price)
+	return func(context.Context, bind.ContractTransactor) (*big.Int, error) {
+		return new(big.Int).Set(price), nil
+	}
+}
+
+// SubmissionError is reported by a Relayer for a submission which was
+// mined but failed.  The relayer submits the mirror again.
+type SubmissionError struct {
+	Height int64
+	Hash   chainhash.Hash
+	TxHash common.Hash
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *SubmissionError) Error() string {
+	return fmt.Sprintf("submission of mirror %v at height %d failed in "+
+		"transaction %v", e.Hash, e.Height, e.TxHash)
+}
+
+// RelayerConfig configures a Relayer.
+type RelayerConfig struct {
+	// Fetcher is the source of Bitcoin blocks.
+	Fetcher lightmirror.Fetcher
+
+	// Source, when set, pushes the new Bitcoin blocks: each block it
+	// announces starts a round at once, and is appended to the chain
+	// without being fetched when its parent is known.  The relayer keeps
+	// polling the fetcher every Interval, catching up with the blocks the
+	// source missed.  The source is started and stopped by the caller.
+	Source lightmirror.BlockSource
+
+	// Chain is the mirror chain the relayer maintains from the fetcher and
+	// submits mirrors from.  Its store is the one of the chain.
+	Chain *lightmirror.MirrorChain
+
+	// Backend, Contract and Opts are the Core chain client, the address of
+	// the registry contract and the transactor paying for submissions.
+	// Opts sets the sender and the signer; its nonce and gas price are
+	// managed by the relayer.
+	Backend  RelayerBackend
+	Contract common.Address
+	Opts     *bind.TransactOpts
+
+	// StartHeight is the height of the first mirror to submit when
+	// StatePath holds no state yet.
+	StartHeight int64
+
+	// StatePath is the file of the state which persists across restarts:
+	// the height and hash of the last mirror submitted.
+	StatePath string
+
+	// Confirmations is the number of confirmations a block needs before
+	// it is submitted, 1 for the tip.  It defaults to 1.
+	Confirmations int64
+
+	// GasPrice is the gas price strategy.  It defaults to
+	// SuggestedGasPrice.
+	GasPrice GasPriceStrategy
+
+	// MaxPending is the number of submissions which may wait to be mined
+	// at once.  It defaults to 1.
+	MaxPending int
+
+	// Interval is the time between two rounds.  It defaults to ten
+	// seconds.
+	Interval time.Duration
+
+	// MaxBackoff is the longest time between two rounds while rounds
+	// fail: after a failed round the relayer waits twice as long as it
+	// waited before the round, up to MaxBackoff, and waits Interval again
+	// once a round succeeds.  It defaults to Interval, retrying at
+	// the pace of the other rounds.
+	MaxBackoff time.Duration
+
+	// MaxBlockAge is the time without a new Bitcoin block after which the
+	// relayer is no longer ready, as reported by Health.  Zero, the
+	// default, keeps it ready as long as its fetcher answers.
+	MaxBlockAge time.Duration
+
+	// Logger receives the fetch latencies, the Bitcoin reorgs, the
+	// submissions and the errors of the relayer.  Nothing is logged by
+	// default.
+	Logger lightmirror.Logger
+}
+
+// pendingSubmission is a submission which was sent but not seen mined.
+type pendingSubmission struct {
+	height int64
+	hash   chainhash.Hash
+	tx     *types.Transaction
+}
+
+// Relayer follows Bitcoin through a fetcher, maintains a mirror chain and
+// submits the mirrors of its best chain to the registry contract in height
+// order, once they have enough confirmations.  After a Bitcoin reorg it
+// submits the mirrors of the new best chain from the fork on.  Mirrors the
+// contract already holds are not submitted.
+//
+// The relayer assigns the nonces of its transactions from the pending nonce
+// of the sender, queried on start and after a failed send, so it must be
+// the only user of the sender account.  Submissions which were not yet
+// mined when the relayer stopped may be submitted again after a restart.
+type Relayer struct {
+	cfg      RelayerConfig
+	registry *MirrorRegistry
+	errs     chan error
+	health   *lightmirror.CompositeHealth
+
+	mtx     sync.Mutex
+	started bool
+	stopped bool
+	quit    chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// lastBlock, lastErr and lastErrAt are the health of the relayer
+	// itself, guarded by mtx.
+	lastBlock time.Time
+	lastErr   error
+	lastErrAt time.Time
+
+	// The state below is only used by the relayer goroutine.
+	announced  *lightmirror.BtcLightMirrorV2
+	lastHeight int64
+	submitted  map[int64]chainhash.Hash
+	pending    []pendingSubmission
+	nonce      uint64
+	nonceKnown bool
+}
+
+// NewRelayer returns a relayer with the given configuration, reading its
+// state from cfg.StatePath when the file exists.
+func NewRelayer(cfg RelayerConfig) (*Relayer, error) {
+	if cfg.Fetcher == nil || cfg.Chain == nil || cfg.Backend == nil || cfg.Opts == nil {
+		return nil, errors.New("relayer needs a fetcher, a chain, a " +
+			"backend and a transactor")
+	}
+	if cfg.StatePath == "" {
+		return nil, errors.New("relayer needs a state path")
+	}
+	if cfg.Confirmations < 1 {
+		cfg.Confirmations = 1
+	}
+	if cfg.GasPrice == nil {
+		cfg.GasPrice = SuggestedGasPrice
+	}
+	if cfg.MaxPending < 1 {
+		cfg.MaxPending = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultRelayInterval
+	}
+	if cfg.MaxBackoff < cfg.Interval {
+		cfg.MaxBackoff = cfg.Interval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = lightmirror.NopLogger{}
+	}
+	registry, err := NewMirrorRegistry(cfg.Contract, cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Relayer{
+		cfg:        cfg,
+		registry:   registry,
+		errs:       make(chan error, relayerErrorBuffer),
+		health:     lightmirror.NewCompositeHealth(cfg.MaxBlockAge),
+		lastBlock:  time.Now(),
+		lastHeight: cfg.StartHeight - 1,
+		submitted:  make(map[int64]chainhash.Hash),
+	}
+	if hc, ok := cfg.Fetcher.(lightmirror.HealthChecker); ok {
+		r.health.Add("fetcher", hc)
+	}
+	if hc, ok := cfg.Source.(lightmirror.HealthChecker); ok {
+		r.health.Add("source", hc)
+	}
+	r.health.Add("relayer", r)
+	height, hash, err := readRelayerState(cfg.StatePath)
+	switch {
+	case err == nil:
+		r.lastHeight = height
+		r.submitted[height] = hash
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return r, nil
+}
+
+// readRelayerState returns the height and hash of the last submitted mirror
+// written to path by writeRelayerState.
+func readRelayerState(path string) (int64, chainhash.Hash, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	var height int64
+	var hashStr string
+	if _, err := fmt.Sscan(string(data), &height, &hashStr); err != nil {
+		return 0, chainhash.Hash{}, fmt.Errorf("relayer state %s: %w", path, err)
+	}
+	hash, err := lightmirror.ParseDisplayHex(hashStr)
+	if err != nil {
+		return 0, chainhash.Hash{}, fmt.Errorf("relayer state %s: %w", path, err)
+	}
+	return height, hash, nil
+}
+
+// writeRelayerState replaces the state at path, through a temporary file so
+// that a crash leaves either state.
+func writeRelayerState(path string, height int64, hash chainhash.Hash) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d %s\n", height, lightmirror.HashToDisplayHex(hash)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Errors returns the channel the relayer reports its errors on, closed once
+// it is stopped.  The relayer keeps running after an error and retries in
+// the next round.  Errors are dropped while the channel is full.
+func (r *Relayer) Errors() <-chan error {
+	return r.errs
+}
+
+// LastSubmitted returns the height of the last mirror submitted, or skipped
+// because the contract holds it.  It must not be called while the relayer
+// runs.
+func (r *Relayer) LastSubmitted() int64 {
+	return r.lastHeight
+}
+
+// Start runs the relayer in a new goroutine until Stop is called or ctx is
+// done.  A relayer can only be started once.
+func (r *Relayer) Start(ctx context.Context) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.started || r.stopped {
+		return ErrRelayerStarted
+	}
+	r.started = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	r.quit, r.cancel, r.done = make(chan struct{}), cancel, make(chan struct{})
+	go func() {
+		defer close(r.done)
+		defer close(r.errs)
+		defer cancel()
+		var blocks <-chan *lightmirror.BtcLightMirrorV2
+		if r.cfg.Source != nil {
+			blocks = r.cfg.Source.Blocks()
+		}
+		wait := r.cfg.Interval
+		for {
+			err := r.step(ctx)
+			if err != nil && ctx.Err() == nil {
+				r.report(err)
+			}
+			wait = r.nextWait(wait, err)
+			timer := time.NewTimer(wait)
+		waitRound:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-r.quit:
+					timer.Stop()
+					return
+				case <-timer.C:
+					break waitRound
+				case m, ok := <-blocks:
+					if !ok {
+						blocks = nil
+						continue
+					}
+					timer.Stop()
+					r.announced = m
+					break waitRound
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop makes the relayer start no new round, waits until ctx is done for
+// the round in progress to complete, then cancels it.  It returns once the
+// relayer goroutine returned and the errors channel is closed, with the
+// error of ctx if it had to cancel the round.
+func (r *Relayer) Stop(ctx context.Context) error {
+	r.mtx.Lock()
+	switch {
+	case !r.started && !r.stopped:
+		close(r.errs)
+	case r.started && !r.stopped:
+		close(r.quit)
+	}
+	r.stopped = true
+	done, cancel := r.done, r.cancel
+	r.mtx.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	cancel()
+	<-done
+	return ctx.Err()
+}
+
+// Health returns the health of the relayer and of its fetcher, when the
+// fetcher is a lightmirror.HealthChecker.
+func (r *Relayer) Health() *lightmirror.CompositeHealth {
+	return r.health
+}
+
+var _ lightmirror.HealthChecker = (*Relayer)(nil)
+
+// Ping returns lightmirror.ErrNotRunning unless the relayer runs.
+func (r *Relayer) Ping(ctx context.Context) error {
+	r.mtx.Lock()
+	running, done := r.started && !r.stopped, r.done
+	r.mtx.Unlock()
+	if !running {
+		return lightmirror.ErrNotRunning
+	}
+	select {
+	case <-done:
+		return lightmirror.ErrNotRunning
+	default:
+		return nil
+	}
+}
+
+// LastBlockAge returns the time elapsed since the relayer last fetched a new
+// Bitcoin block, or since it was created if it fetched none.
+func (r *Relayer) LastBlockAge() time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return time.Since(r.lastBlock)
+}
+
+// LastError returns the last error the relayer reported and when.
+func (r *Relayer) LastError() (error, time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lastErr, r.lastErrAt
+}
+
+func (r *Relayer) report(err error) {
+	r.mtx.Lock()
+	r.lastErr, r.lastErrAt = err, time.Now()
+	r.mtx.Unlock()
+	r.cfg.Logger.Errorf("relayer: %v", err)
+	select {
+	case r.errs <- err:
+	default:
+	}
+}
+
+// nextWait returns the time to wait before the next round, after a round
+// which returned err and followed a wait of wait.
+func (r *Relayer) nextWait(wait time.Duration, err error) time.Duration {
+	if err == nil {
+		return r.cfg.Interval
+	}
+	if wait *= 2; wait > r.cfg.MaxBackoff {
+		wait = r.cfg.MaxBackoff
+	}
+	return wait
+}
+
+// step runs a round of the relayer: it extends the chain with the new
+// Bitcoin blocks, then submits the mirrors which are due.
+func (r *Relayer) step(ctx context.Context) error {
+	if err := r.follow(ctx); err != nil {
+		return err
+	}
+	if err := r.pollPending(ctx); err != nil {
+		return err
+	}
+	if err := r.rewind(ctx); err != nil {
+		return err
+	}
+	return r.submit(ctx)
+}
+
+// follow appends the block last announced by the source, then the blocks
+// the fetcher has above the tip of the chain, along with the blocks of their
+// branch the chain does not know.
+func (r *Relayer) follow(ctx context.Context) error {
+	if m := r.announced; m != nil {
+		r.announced = nil
+		if err := r.appendAnnounced(m); err != nil {
+			return err
+		}
+	}
+	for {
+		_, height := r.cfg.Chain.Tip()
+		start := time.Now()
+		m, err := r.cfg.Fetcher.FetchByHeight(ctx, height+1)
+		if errors.Is(err, lightmirror.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.cfg.Logger.Debugf("fetched block %v at height %d in %v",
+			m.BtcHeader.BlockHash(), height+1, time.Since(start))
+		r.mtx.Lock()
+		r.lastBlock = time.Now()
+		r.mtx.Unlock()
+
+		branch := []*lightmirror.BtcLightMirrorV2{m}
+		for {
+			prev := branch[0].BtcHeader.PrevBlock
+			_, _, err := r.cfg.Chain.ByHash(prev)
+			if !errors.Is(err, lightmirror.ErrUnknownBlock) {
+				break
+			}
+			if len(branch) >= maxRelayReorgDepth {
+				return fmt.Errorf("block %v does not connect to the chain "+
+					"within %d blocks", m.BtcHeader.BlockHash(),
+					maxRelayReorgDepth)
+			}
+			start := time.Now()
+			parent, err := r.cfg.Fetcher.FetchByHash(ctx, prev)
+			if err != nil {
+				return err
+			}
+			r.cfg.Logger.Debugf("fetched block %v of the incoming branch in %v",
+				prev, time.Since(start))
+			branch = append([]*lightmirror.BtcLightMirrorV2{parent}, branch...)
+		}
+		for _, m := range branch {
+			event, err := r.cfg.Chain.Append(m)
+			if err != nil && !errors.Is(err, lightmirror.ErrDuplicateBlock) {
+				return err
+			}
+			if event != nil {
+				r.cfg.Logger.Infof("bitcoin reorg of depth %d at fork height %d",
+					len(event.Disconnected), event.ForkHeight)
+			}
+		}
+	}
+}
+
+// appendAnnounced appends a block announced by the source when the chain
+// knows its parent, leaving the blocks of other branches to follow.
+func (r *Relayer) appendAnnounced(m *lightmirror.BtcLightMirrorV2) error {
+	if _, _, err := r.cfg.Chain.ByHash(m.BtcHeader.PrevBlock); errors.Is(err, lightmirror.ErrUnknownBlock) {
+		return nil
+	}
+	event, err := r.cfg.Chain.Append(m)
+	if errors.Is(err, lightmirror.ErrDuplicateBlock) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.cfg.Logger.Debugf("appended announced block %v", m.BtcHeader.BlockHash())
+	r.mtx.Lock()
+	r.lastBlock = time.Now()
+	r.mtx.Unlock()
+	if event != nil {
+		r.cfg.Logger.Infof("bitcoin reorg of depth %d at fork height %d",
+			len(event.Disconnected), event.ForkHeight)
+	}
+	return nil
+}
+
+// pollPending forgets the pending submissions which were mined, reporting
+// the failed ones and rewinding to submit them again.
+func (r *Relayer) pollPending(ctx context.Context) error {
+	pending := r.pending[:0]
+	for i, p := range r.pending {
+		receipt, err := r.cfg.Backend.TransactionReceipt(ctx, p.tx.Hash())
+		if errors.Is(err, ethereum.NotFound) {
+			pending = append(pending, p)
+			continue
+		}
+		if err != nil {
+			r.pending = append(pending, r.pending[i:]...)
+			return err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			r.report(&SubmissionError{Height: p.height, Hash: p.hash, TxHash: p.tx.Hash()})
+			r.forget(p.height)
+		}
+	}
+	r.pending = pending
+	return nil
+}
+
+// forget rewinds to submit the mirrors from the given height on again.
+func (r *Relayer) forget(height int64) {
+	for h := range r.submitted {
+		if h >= height {
+			delete(r.submitted, h)
+		}
+	}
+	if r.lastHeight >= height {
+		r.lastHeight = height - 1
+	}
+}
+
+// rewind moves the last submitted height back to the fork point when the
+// chain reorganized past it.  Heights submitted before a restart are
+// checked against the contract.
+func (r *Relayer) rewind(ctx context.Context) error {
+	for r.lastHeight >= r.cfg.StartHeight {
+		hash, err := r.cfg.Chain.HashAtHeight(r.lastHeight)
+		if err != nil {
+			return err
+		}
+		if submitted, ok := r.submitted[r.lastHeight]; ok {
+			if submitted == hash {
+				return nil
+			}
+			r.cfg.Logger.Infof("mirror submitted at height %d left the best "+
+				"chain", r.lastHeight)
+		} else {
+			held, err := r.registry.HasMirror(&bind.CallOpts{Context: ctx}, hash)
+			if err != nil {
+				return err
+			}
+			if held {
+				return nil
+			}
+			r.cfg.Logger.Infof("mirror at height %d is not held by the "+
+				"contract", r.lastHeight)
+		}
+		r.forget(r.lastHeight)
+	}
+	return nil
+}
+
+// submit submits the mirrors which have enough confirmations, as long as
+// fewer than MaxPending submissions are pending.
+func (r *Relayer) submit(ctx context.Context) error {
+	_, tipHeight := r.cfg.Chain.Tip()
+	due := tipHeight - r.cfg.Confirmations + 1
+	for height := r.lastHeight + 1; height <= due && len(r.pending) < r.cfg.MaxPending; height++ {
+		m, err := r.cfg.Chain.ByHeight(height)
+		if err != nil {
+			return err
+		}
+		hash := m.BtcHeader.BlockHash()
+		held, err := r.registry.HasMirror(&bind.CallOpts{Context: ctx}, hash)
+		if err != nil {
+			return err
+		}
+		if !held {
+			if err := r.send(ctx, height, m); err != nil {
+				return err
+			}
+		}
+
+		r.submitted[height] = hash
+		r.lastHeight = height
+		if err := writeRelayerState(r.cfg.StatePath, height, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the submission of the mirror at the given height.
+func (r *Relayer) send(ctx context.Context, height int64, m *lightmirror.BtcLightMirrorV2) error {
+	if !r.nonceKnown {
+		nonce, err := r.cfg.Backend.PendingNonceAt(ctx, r.cfg.Opts.From)
+		if err != nil {
+			return err
+		}
+		r.nonce, r.nonceKnown = nonce, true
+	}
+	gasPrice, err := r.cfg.GasPrice(ctx, r.cfg.Backend)
+	if err != nil {
+		return err
+	}
+
+	opts := *r.cfg.Opts
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(r.nonce)
+	opts.GasPrice = gasPrice
+	tx, err := r.registry.BuildSubmitTx(m, &opts)
+	if err != nil {
+		return fmt.Errorf("mirror at height %d: %w", height, err)
+	}
+	if err := r.cfg.Backend.SendTransaction(ctx, tx); err != nil {
+		r.nonceKnown = false
+		return err
+	}
+	r.nonce++
+	r.cfg.Logger.Infof("submitted mirror %v at height %d in transaction %v",
+		m.BtcHeader.BlockHash(), height, tx.Hash())
+	r.pending = append(r.pending, pendingSubmission{
+		height: height,
+		hash:   m.BtcHeader.BlockHash(),
+		tx:     tx,
+	})
+	return nil
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/leaktest"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// relayBaseHeight is the height of the anchor of the relayer tests.
+const relayBaseHeight = 100
+
+// stubStoringRegistryCode returns the creation code of a stub registry
+// answering hasMirror(blockHash) from its storage, where every other call
+// is taken for submitMirror and records the double SHA-256 of its header
+// argument:
+//
+//	init:    PUSH1 0x48 PUSH1 0x0c PUSH1 0 CODECOPY PUSH1 0x48 PUSH1 0 RETURN
+//	runtime: PUSH1 0 CALLDATALOAD PUSH1 0xe0 SHR
+//	         PUSH4 <hasMirror> EQ PUSH1 0x3b JUMPI
+//	         PUSH1 0x50 PUSH1 4 CALLDATALOAD PUSH1 0x24 ADD PUSH1 0 CALLDATACOPY
+//	         PUSH1 0x20 PUSH1 0 PUSH1 0x50 PUSH1 0 PUSH1 2 GAS STATICCALL POP
+//	         PUSH1 0x20 PUSH1 0 PUSH1 0x20 PUSH1 0 PUSH1 2 GAS STATICCALL POP
+//	         PUSH1 1 PUSH1 0 MLOAD SSTORE STOP
+//	         JUMPDEST PUSH1 4 CALLDATALOAD SLOAD PUSH1 0 MSTORE
+//	         PUSH1 0x20 PUSH1 0 RETURN
+func stubStoringRegistryCode(t *testing.T) []byte {
+	t.Helper()
+	parsed := registryABI(t)
+	selector := parsed.Methods["hasMirror"].ID
+	code := common.FromHex("6048600c60003960486000f3" + "60003560e01c63")
+	code = append(code, selector...)
+	return append(code, common.FromHex("14603b57"+
+		"6050600435602401600037"+
+		"602060006050600060025afa50"+
+		"602060006020600060025afa50"+
+		"60016000515500"+
+		"5b6004355460005260206000f3")...)
+}
+
+// solvedMirrors returns a chain of n mirrors building on prev which pass
+// the proof of work check of the regression test network.
+func solvedMirrors(t *testing.T, prev chainhash.Hash, seed, n int) []*lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	return mirrortest.GenerateChain(t, n, mirrortest.WithPrevBlock(prev),
+		mirrortest.WithSeed(int64(seed)))
+}
+
+// bitcoinFetcher serves the blocks of a mutable Bitcoin chain.
+type bitcoinFetcher struct {
+	best   []*lightmirror.BtcLightMirrorV2
+	byHash map[chainhash.Hash]*lightmirror.BtcLightMirrorV2
+}
+
+func newBitcoinFetcher(best []*lightmirror.BtcLightMirrorV2) *bitcoinFetcher {
+	f := &bitcoinFetcher{byHash: make(map[chainhash.Hash]*lightmirror.BtcLightMirrorV2)}
+	f.setBest(best)
+	return f
+}
+
+// setBest makes the blocks the best chain from relayBaseHeight on.
+func (f *bitcoinFetcher) setBest(best []*lightmirror.BtcLightMirrorV2) {
+	f.best = best
+	for _, m := range best {
+		f.byHash[m.BtcHeader.BlockHash()] = m
+	}
+}
+
+func (f *bitcoinFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	if m, ok := f.byHash[hash]; ok {
+		return m, nil
+	}
+	return nil, lightmirror.ErrNotFound
+}
+
+func (f *bitcoinFetcher) FetchByHeight(ctx context.Context, height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	i := height - relayBaseHeight
+	if i < 0 || i >= int64(len(f.best)) {
+		return nil, lightmirror.ErrNotFound
+	}
+	return f.best[i], nil
+}
+
+// captureLogger is a lightmirror.Logger recording the events logged, each
+// formatted and prefixed with its level.
+type captureLogger struct {
+	mtx    sync.Mutex
+	events []string
+}
+
+func (l *captureLogger) logf(level, format string, args []interface{}) {
+	l.mtx.Lock()
+	l.events = append(l.events, level+" "+fmt.Sprintf(format, args...))
+	l.mtx.Unlock()
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.logf("DBG", format, args) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.logf("INF", format, args) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.logf("WRN", format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf("ERR", format, args) }
+
+// count returns the number of events logged at level containing substr.
+func (l *captureLogger) count(level, substr string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for _, event := range l.events {
+		if strings.HasPrefix(event, level+" ") && strings.Contains(event, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// relayFixture holds a relayer along with its chains.
+type relayFixture struct {
+	sim      *backends.SimulatedBackend
+	registry *MirrorRegistry
+	opts     *bind.TransactOpts
+	fetcher  *bitcoinFetcher
+	cfg      RelayerConfig
+}
+
+func newRelayFixture(t *testing.T, best []*lightmirror.BtcLightMirrorV2) *relayFixture {
+	t.Helper()
+	sim, opts := simulatedChain(t)
+	addr := deployStub(t, sim, opts, stubStoringRegistryCode(t))
+	registry, err := NewMirrorRegistry(addr, sim)
+	if err != nil {
+		t.Fatalf("NewMirrorRegistry error %v", err)
+	}
+	chain, err := lightmirror.NewMirrorChain(best[0], relayBaseHeight,
+		lightmirror.WithChainParams(&chaincfg.RegressionNetParams))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	fetcher := newBitcoinFetcher(best)
+	return &relayFixture{
+		sim:      sim,
+		registry: registry,
+		opts:     opts,
+		fetcher:  fetcher,
+		cfg: RelayerConfig{
+			Fetcher:     fetcher,
+			Chain:       chain,
+			Backend:     sim,
+			Contract:    addr,
+			Opts:        opts,
+			StartHeight: relayBaseHeight,
+			StatePath:   filepath.Join(t.TempDir(), "relayer"),
+			GasPrice:    FixedGasPrice(big.NewInt(2000000000)),
+		},
+	}
+}
+
+// step runs a round of r, then mines the submissions.
+func (f *relayFixture) step(t *testing.T, r *Relayer) {
+	t.Helper()
+	if err := r.step(context.Background()); err != nil {
+		t.Fatalf("step error %v", err)
+	}
+	f.sim.Commit()
+}
+
+// checkHeld checks which of the mirrors the contract holds.
+func (f *relayFixture) checkHeld(t *testing.T, mirrors []*lightmirror.BtcLightMirrorV2, want bool) {
+	t.Helper()
+	for i, m := range mirrors {
+		held, err := f.registry.HasMirror(nil, m.BtcHeader.BlockHash())
+		if err != nil {
+			t.Fatalf("HasMirror error %v", err)
+		}
+		if held != want {
+			t.Errorf("HasMirror #%d: got %v, want %v", i, held, want)
+		}
+	}
+}
+
+// nonce returns the nonce of the next transaction of the sender.
+func (f *relayFixture) nonce(t *testing.T) uint64 {
+	t.Helper()
+	nonce, err := f.sim.PendingNonceAt(context.Background(), f.opts.From)
+	if err != nil {
+		t.Fatalf("PendingNonceAt error %v", err)
+	}
+	return nonce
+}
+
+func TestRelayer(t *testing.T) {
+	mirrors := solvedMirrors(t, chainhash.Hash{}, 0, 6)
+	f := newRelayFixture(t, mirrors[:4])
+	f.cfg.Confirmations = 2
+	f.cfg.MaxPending = 2
+
+	// The contract already holds the mirror at the second height.
+	tx, err := f.registry.BuildSubmitTx(mirrors[1], f.opts)
+	if err != nil {
+		t.Fatalf("BuildSubmitTx error %v", err)
+	}
+	if err := f.sim.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatalf("SendTransaction error %v", err)
+	}
+	f.sim.Commit()
+	nonce := f.nonce(t)
+
+	r, err := NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+
+	// Submissions wait for a second confirmation, and for the pending
+	// ones to be mined.
+	if err := r.step(context.Background()); err != nil {
+		t.Fatalf("step error %v", err)
+	}
+	if last := r.LastSubmitted(); last != relayBaseHeight+2 {
+		t.Errorf("LastSubmitted: got %d, want %d", last, relayBaseHeight+2)
+	}
+	f.sim.Commit()
+	f.checkHeld(t, mirrors[:3], true)
+	f.checkHeld(t, mirrors[3:], false)
+	if got := f.nonce(t); got != nonce+2 {
+		t.Errorf("nonce: got %d, want %d after skipping the held mirror",
+			got, nonce+2)
+	}
+
+	f.fetcher.setBest(mirrors)
+	f.step(t, r)
+	f.checkHeld(t, mirrors[:5], true)
+	f.checkHeld(t, mirrors[5:], false)
+
+	// A restarted relayer resumes from its state and the pending nonce.
+	f.fetcher.setBest(append(mirrors, solvedMirrors(t, mirrors[5].BtcHeader.BlockHash(), 6, 1)...))
+	r, err = NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	if last := r.LastSubmitted(); last != relayBaseHeight+4 {
+		t.Errorf("LastSubmitted after restart: got %d, want %d", last,
+			relayBaseHeight+4)
+	}
+	f.step(t, r)
+	f.checkHeld(t, mirrors, true)
+	if got := f.nonce(t); got != nonce+5 {
+		t.Errorf("nonce: got %d, want %d", got, nonce+5)
+	}
+}
+
+func TestRelayerReorg(t *testing.T) {
+	mirrors := solvedMirrors(t, chainhash.Hash{}, 0, 4)
+	f := newRelayFixture(t, mirrors)
+	f.cfg.MaxPending = 2
+	logger := &captureLogger{}
+	f.cfg.Logger = logger
+	r, err := NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+
+	// No more than two submissions are pending at once.
+	for i := 0; i < 2; i++ {
+		if err := r.step(context.Background()); err != nil {
+			t.Fatalf("step error %v", err)
+		}
+		if last := r.LastSubmitted(); last != relayBaseHeight+1 {
+			t.Errorf("LastSubmitted: got %d, want %d", last, relayBaseHeight+1)
+		}
+	}
+	f.sim.Commit()
+	f.step(t, r)
+	f.checkHeld(t, mirrors, true)
+
+	// A longer branch from the second block takes over: the relayer
+	// fetches it back to the fork and submits it.
+	branch := solvedMirrors(t, mirrors[1].BtcHeader.BlockHash(), 10, 3)
+	f.fetcher.setBest(append(mirrors[:2:2], branch...))
+	f.step(t, r)
+	f.step(t, r)
+	f.checkHeld(t, branch, true)
+	if last := r.LastSubmitted(); last != relayBaseHeight+4 {
+		t.Errorf("LastSubmitted: got %d, want %d", last, relayBaseHeight+4)
+	}
+	if logger.count("INF", fmt.Sprintf("bitcoin reorg of depth 2 at fork height %d",
+		relayBaseHeight+1)) != 1 {
+
+		t.Errorf("reorg not logged (%q)", logger.events)
+	}
+	if got := logger.count("INF", "submitted mirror"); got != 7 {
+		t.Errorf("got %d submissions logged, want 7 (%q)", got, logger.events)
+	}
+	if got := logger.count("INF", "left the best chain"); got != 2 {
+		t.Errorf("got %d rewinds logged, want 2 (%q)", got, logger.events)
+	}
+	if logger.count("DBG", "of the incoming branch") != 2 {
+		t.Errorf("branch fetches not logged (%q)", logger.events)
+	}
+
+	// A restarted relayer notices a reorg it missed through the contract.
+	other := solvedMirrors(t, mirrors[1].BtcHeader.BlockHash(), 20, 4)
+	f.fetcher.setBest(append(mirrors[:2:2], other...))
+	for _, m := range other {
+		if _, err := f.cfg.Chain.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	r, err = NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	f.step(t, r)
+	f.step(t, r)
+	f.checkHeld(t, other, true)
+}
+
+func TestRelayerStartStop(t *testing.T) {
+	leaktest.Check(t)
+	mirrors := solvedMirrors(t, chainhash.Hash{}, 0, 3)
+	f := newRelayFixture(t, mirrors)
+	f.cfg.Interval = time.Millisecond
+
+	// Gas price failures surface on the error channel.
+	failure := errors.New("no gas price")
+	f.cfg.GasPrice = func(context.Context, bind.ContractTransactor) (*big.Int, error) {
+		return nil, failure
+	}
+	r, err := NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	if err := r.Ping(context.Background()); !errors.Is(err, lightmirror.ErrNotRunning) {
+		t.Errorf("Ping before Start: got error %v, want %v", err, lightmirror.ErrNotRunning)
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	if err := r.Start(context.Background()); !errors.Is(err, ErrRelayerStarted) {
+		t.Errorf("Start twice: got error %v, want %v", err, ErrRelayerStarted)
+	}
+	select {
+	case err := <-r.Errors():
+		if !errors.Is(err, failure) {
+			t.Errorf("Errors: got %v, want %v", err, failure)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Errors: no error reported")
+	}
+	if err := r.Health().Check(context.Background()).Ready(); err != nil {
+		t.Errorf("Ready: got error %v", err)
+	}
+	if err, _ := r.Health().LastError(); !errors.Is(err, failure) {
+		t.Errorf("LastError: got %v, want %v", err, failure)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Errorf("Stop error %v", err)
+	}
+	for range r.Errors() {
+	}
+	if err := r.Health().Ping(context.Background()); !errors.Is(err, lightmirror.ErrNotRunning) {
+		t.Errorf("Ping after Stop: got error %v, want %v", err, lightmirror.ErrNotRunning)
+	}
+	if last := r.LastSubmitted(); last != relayBaseHeight-1 {
+		t.Errorf("LastSubmitted: got %d, want %d", last, relayBaseHeight-1)
+	}
+
+	if err := r.Start(context.Background()); !errors.Is(err, ErrRelayerStarted) {
+		t.Errorf("Start after Stop: got error %v, want %v", err, ErrRelayerStarted)
+	}
+
+	// A relayer stopped before it started closes its errors channel too.
+	// The health of a fetcher which reports it is part of the relayer's.
+	f.cfg.Fetcher = lightmirror.NewCachingFetcher(f.fetcher, 10)
+	r, err = NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	report := r.Health().Check(context.Background())
+	if len(report.Components) != 2 || report.Components[0].Name != "fetcher" {
+		t.Errorf("Health: got components %+v, want the fetcher and the relayer", report.Components)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Errorf("Stop error %v", err)
+	}
+	if _, ok := <-r.Errors(); ok {
+		t.Errorf("errors of an unstarted relayer not closed by Stop")
+	}
+
+	if _, err := NewRelayer(RelayerConfig{}); err == nil {
+		t.Errorf("NewRelayer: expected error for an empty configuration")
+	}
+}
+
+func TestRelayerBackoff(t *testing.T) {
+	f := newRelayFixture(t, solvedMirrors(t, chainhash.Hash{}, 0, 1))
+	f.cfg.Interval = time.Second
+	f.cfg.MaxBackoff = 5 * time.Second
+	r, err := NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	failure := errors.New("round failed")
+	wait := f.cfg.Interval
+	for i, want := range []time.Duration{2, 4, 5, 5} {
+		if wait = r.nextWait(wait, failure); wait != want*time.Second {
+			t.Errorf("nextWait #%d: got %v, want %v", i, wait, want*time.Second)
+		}
+	}
+	if wait = r.nextWait(wait, nil); wait != time.Second {
+		t.Errorf("nextWait after a successful round: got %v, want %v", wait, time.Second)
+	}
+
+	// Without a maximum, failed rounds are retried at the interval.
+	f.cfg.MaxBackoff = 0
+	if r, err = NewRelayer(f.cfg); err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	if wait := r.nextWait(time.Second, failure); wait != time.Second {
+		t.Errorf("nextWait without backoff: got %v, want %v", wait, time.Second)
+	}
+}
+
+// chanSource is a lightmirror.BlockSource announcing the mirrors sent on
+// its channel.
+type chanSource chan *lightmirror.BtcLightMirrorV2
+
+func (s chanSource) Start(context.Context) error                  { return nil }
+func (s chanSource) Stop(context.Context) error                   { return nil }
+func (s chanSource) Blocks() <-chan *lightmirror.BtcLightMirrorV2 { return s }
+
+func TestRelayerSource(t *testing.T) {
+	leaktest.Check(t)
+	mirrors := solvedMirrors(t, chainhash.Hash{}, 0, 2)
+	f := newRelayFixture(t, mirrors[:1])
+	source := make(chanSource)
+	f.cfg.Source = source
+	f.cfg.Interval = time.Hour
+	r, err := NewRelayer(f.cfg)
+	if err != nil {
+		t.Fatalf("NewRelayer error %v", err)
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	defer r.Stop(context.Background())
+
+	// A block of an unknown branch is left to the fetcher, which does not
+	// have it; the next block extends the chain without being fetched.
+	source <- solvedMirrors(t, chainhash.Hash{1}, 1, 1)[0]
+	source <- mirrors[1]
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, height := f.cfg.Chain.Tip(); height == relayBaseHeight+1 && f.nonce(t) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("announced block not submitted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err, _ := r.LastError(); err != nil {
+		t.Errorf("LastError: got %v", err)
+	}
+
+	// The relayer outlives its source.
+	close(source)
+	if err := r.Ping(context.Background()); err != nil {
+		t.Errorf("Ping after the source closed: got error %v", err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Errorf("Stop error %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/ethabi"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// submitArgs returns the arguments of submitMirror for m:
+//
+//	header       the 80 byte serialized block header
+//	coinbase     the serialized coinbase transaction, as in m.Serialize
+//	txCount      the largest transaction count the merkle branch can
+//	             prove, 2^len(merkleNodes); the mirror does not record the
+//	             exact count and the contract only checks the branch depth
+//	             against it
+//	merkleNodes  the merkle branch of the coinbase, each node in the
+//	             internal byte order of chainhash.Hash
+func submitArgs(m *lightmirror.BtcLightMirrorV2) (header, coinbase []byte, txCount uint32, merkleNodes [][32]byte, err error) {
+	args, err := ethabi.NewMirrorArgs(m)
+	if err != nil {
+		return nil, nil, 0, nil, err
+	}
+	return args.Header, args.Coinbase, args.TxCount, args.MerkleNodes, nil
+}
+
+// proofSectionArgs returns the arguments of submitArgs but the header.
+func proofSectionArgs(m *lightmirror.BtcLightMirrorV2) (coinbase []byte, txCount uint32, merkleNodes [][32]byte, err error) {
+	_, coinbase, txCount, merkleNodes, err = submitArgs(m)
+	return coinbase, txCount, merkleNodes, err
+}
+
+// proofSectionArguments are the ABI types of the proof section of a mirror,
+// the arguments of submitMirror following the header.
+var proofSectionArguments = func() abi.Arguments {
+	newType := func(t string) abi.Type {
+		typ, err := abi.NewType(t, "", nil)
+		if err != nil {
+			panic(err)
+		}
+		return typ
+	}
+	return abi.Arguments{
+		{Name: "coinbase", Type: newType("bytes")},
+		{Name: "txCount", Type: newType("uint32")},
+		{Name: "merkleNodes", Type: newType("bytes32[]")},
+	}
+}()
+
+// PackProofSection returns the ABI encoding of the proof section of m, the
+// coinbase, transaction count and merkle branch submitMirror takes, for
+// contracts which already hold the header of the block.  The mirror must
+// pass the merkle check.
+func PackProofSection(m *lightmirror.BtcLightMirrorV2) ([]byte, error) {
+	if err := m.CheckMerkle(); err != nil {
+		return nil, err
+	}
+	coinbase, txCount, merkleNodes, err := proofSectionArgs(m)
+	if err != nil {
+		return nil, err
+	}
+	return proofSectionArguments.Pack(coinbase, txCount, merkleNodes)
+}
+
+// UnpackProofSection decodes the proof section PackProofSection encoded for
+// the mirror of the given header.  As lightmirror.DeserializeProofSection,
+// it checks the reconstructed mirror against the header, the errors of a
+// mismatch wrapping lightmirror.ErrBranchMismatch, and fails with a
+// *lightmirror.TrailingDataError when the coinbase holds more than a
+// transaction.  The transaction count must be one a branch of that many
+// nodes proves, not only the 2^len(merkleNodes) PackProofSection sets.
+func UnpackProofSection(data []byte, header wire.BlockHeader) (*lightmirror.BtcLightMirrorV2, error) {
+	values, err := proofSectionArguments.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := header.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	args := &ethabi.MirrorArgs{
+		Header:      buf.Bytes(),
+		Coinbase:    values[0].([]byte),
+		TxCount:     values[1].(uint32),
+		MerkleNodes: values[2].([][32]byte),
+	}
+	return args.Mirror()
+}
+
+// BuildSubmitTx returns the transaction submitting the mirror to the
+// contract, signed by opts.Signer but not sent.  The gas limit is estimated
+// against the contract unless opts sets one.  The mirror must pass the
+// merkle check.
+func (r *MirrorRegistryTransactor) BuildSubmitTx(m *lightmirror.BtcLightMirrorV2, opts *bind.TransactOpts) (*types.Transaction, error) {
+	if err := m.CheckMerkle(); err != nil {
+		return nil, err
+	}
+	header, coinbase, txCount, merkleNodes, err := submitArgs(m)
+	if err != nil {
+		return nil, err
+	}
+	noSend := *opts
+	noSend.NoSend = true
+	return r.SubmitMirror(&noSend, header, coinbase, txCount, merkleNodes)
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/ethabi"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// stubRegistryCode is the creation code of a stub registry contract whose
+// every call logs its calldata and succeeds:
+//
+//	init:    PUSH1 0x0b PUSH1 0x0c PUSH1 0 CODECOPY PUSH1 0x0b PUSH1 0 RETURN
+//	runtime: CALLDATASIZE PUSH1 0 PUSH1 0 CALLDATACOPY
+//	         CALLDATASIZE PUSH1 0 LOG0 STOP
+var stubRegistryCode = common.FromHex("600b600c600039600b6000f3" +
+	"3660006000373660" + "00a000")
+
+// simulatedChain returns a simulated chain along with a funded transactor.
+func simulatedChain(t *testing.T) (*backends.SimulatedBackend, *bind.TransactOpts) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey error %v", err)
+	}
+	opts, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	if err != nil {
+		t.Fatalf("NewKeyedTransactorWithChainID error %v", err)
+	}
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		opts.From: {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, 30000000)
+	t.Cleanup(func() { sim.Close() })
+	return sim, opts
+}
+
+// deployStub deploys a contract with the given creation code and the
+// registry ABI.
+func deployStub(t *testing.T, sim *backends.SimulatedBackend, opts *bind.TransactOpts, code []byte) common.Address {
+	t.Helper()
+	addr, _, _, err := bind.DeployContract(opts, registryABI(t), code, sim)
+	if err != nil {
+		t.Fatalf("DeployContract error %v", err)
+	}
+	sim.Commit()
+	return addr
+}
+
+func registryABI(t *testing.T) abi.ABI {
+	t.Helper()
+	parsed, err := abi.JSON(strings.NewReader(MirrorRegistryABI))
+	if err != nil {
+		t.Fatalf("abi.JSON error %v", err)
+	}
+	return parsed
+}
+
+// simulatedRegistry deploys the stub registry on a simulated chain and
+// returns its binding along with a funded transactor.
+func simulatedRegistry(t *testing.T) (*backends.SimulatedBackend, *MirrorRegistry, *bind.TransactOpts) {
+	t.Helper()
+	sim, opts := simulatedChain(t)
+	registry, err := NewMirrorRegistry(deployStub(t, sim, opts, stubRegistryCode), sim)
+	if err != nil {
+		t.Fatalf("NewMirrorRegistry error %v", err)
+	}
+	return sim, registry, opts
+}
+
+// decodeSubmit rebuilds the mirror from the calldata of submitMirror.
+func decodeSubmit(t *testing.T, data []byte) (*lightmirror.BtcLightMirrorV2, uint32) {
+	t.Helper()
+	parsed := registryABI(t)
+	method, err := parsed.MethodById(data)
+	if err != nil || method.Name != "submitMirror" {
+		t.Fatalf("MethodById: got %v, error %v", method, err)
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		t.Fatalf("Unpack error %v", err)
+	}
+
+	m := new(lightmirror.BtcLightMirrorV2)
+	header := args[0].([]byte)
+	if len(header) != wire.MaxBlockHeaderPayload {
+		t.Errorf("header: got %d bytes, want %d", len(header),
+			wire.MaxBlockHeaderPayload)
+	}
+	if err := m.BtcHeader.Deserialize(bytes.NewReader(header)); err != nil {
+		t.Fatalf("header Deserialize error %v", err)
+	}
+	if err := m.CoinBaseTx.Deserialize(bytes.NewReader(args[1].([]byte))); err != nil {
+		t.Fatalf("coinbase Deserialize error %v", err)
+	}
+	for _, node := range args[3].([][32]byte) {
+		m.MerkleNodes = append(m.MerkleNodes, chainhash.Hash(node))
+	}
+	return m, args[2].(uint32)
+}
+
+func serialize(t *testing.T, m *lightmirror.BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	return buf.Bytes()
+}
+
+// copyMirror returns a copy of m sharing no memory with it.
+func copyMirror(t *testing.T, m *lightmirror.BtcLightMirrorV2) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	res := new(lightmirror.BtcLightMirrorV2)
+	if err := res.Deserialize(bytes.NewReader(serialize(t, m))); err != nil {
+		t.Fatalf("Deserialize error %v", err)
+	}
+	return res
+}
+
+func TestBuildSubmitTx(t *testing.T) {
+	sim, registry, opts := simulatedRegistry(t)
+	ctx := context.Background()
+
+	for i, m := range storetest.Mirrors(4) {
+		tx, err := registry.BuildSubmitTx(m, opts)
+		if err != nil {
+			t.Fatalf("BuildSubmitTx #%d error %v", i, err)
+		}
+		if tx.Gas() <= 21000 {
+			t.Errorf("BuildSubmitTx #%d: got gas limit %d", i, tx.Gas())
+		}
+
+		// Building does not send.
+		if _, pending, err := sim.TransactionByHash(ctx, tx.Hash()); err == nil || pending {
+			t.Fatalf("TransactionByHash #%d: transaction was sent", i)
+		}
+		if err := sim.SendTransaction(ctx, tx); err != nil {
+			t.Fatalf("SendTransaction #%d error %v", i, err)
+		}
+		sim.Commit()
+
+		receipt, err := sim.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			t.Fatalf("TransactionReceipt #%d error %v", i, err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful || len(receipt.Logs) != 1 {
+			t.Fatalf("TransactionReceipt #%d: got status %d with %d logs", i,
+				receipt.Status, len(receipt.Logs))
+		}
+
+		// The contract received the mirror.
+		got, txCount := decodeSubmit(t, receipt.Logs[0].Data)
+		if !bytes.Equal(serialize(t, got), serialize(t, m)) {
+			t.Errorf("submitted mirror #%d\n got: %s want: %s", i,
+				spew.Sdump(got), spew.Sdump(m))
+		}
+		if wantCount := uint32(1) << len(m.MerkleNodes); txCount != wantCount {
+			t.Errorf("txCount #%d: got %d, want %d", i, txCount, wantCount)
+		}
+	}
+}
+
+// TestEthabiCalldata checks the calldata of package ethabi against the
+// generated binding.
+func TestEthabiCalldata(t *testing.T) {
+	parsed := registryABI(t)
+	mirrors := storetest.Mirrors(4)
+	for i, m := range mirrors {
+		header, coinbase, txCount, merkleNodes, err := submitArgs(m)
+		if err != nil {
+			t.Fatalf("submitArgs #%d error %v", i, err)
+		}
+		want, err := parsed.Pack("submitMirror", header, coinbase, txCount, merkleNodes)
+		if err != nil {
+			t.Fatalf("Pack #%d error %v", i, err)
+		}
+		if got, err := ethabi.PackSubmitMirror(m); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("PackSubmitMirror #%d: got %x, error %v, want %x", i, got, err, want)
+		}
+	}
+
+	data := make([][]byte, 0, len(mirrors))
+	for _, m := range mirrors {
+		data = append(data, serialize(t, m))
+	}
+	want, err := parsed.Pack("submitBatch", data)
+	if err != nil {
+		t.Fatalf("Pack error %v", err)
+	}
+	if got, err := ethabi.PackSubmitBatch(mirrors); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("PackSubmitBatch: got %x, error %v, want %x", got, err, want)
+	}
+	if want := parsed.Methods["tip"].ID; !bytes.Equal(ethabi.PackTip(), want) {
+		t.Errorf("PackTip: got %x, want %x", ethabi.PackTip(), want)
+	}
+	want, _ = parsed.Pack("mirrorAt", uint64(7))
+	if got, err := ethabi.PackMirrorAt(7); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("PackMirrorAt: got %x, error %v, want %x", got, err, want)
+	}
+	hash := mirrors[0].BtcHeader.BlockHash()
+	want, _ = parsed.Pack("hasMirror", [32]byte(hash))
+	if got, err := ethabi.PackHasMirror(hash); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("PackHasMirror: got %x, error %v, want %x", got, err, want)
+	}
+}
+
+func TestBuildSubmitTxInvalid(t *testing.T) {
+	_, registry, opts := simulatedRegistry(t)
+	m := storetest.Mirrors(2)[1]
+	m.CoinBaseTx.LockTime++
+	if _, err := registry.BuildSubmitTx(m, opts); err == nil {
+		t.Errorf("BuildSubmitTx: expected merkle error")
+	}
+}
+
+func TestPackProofSection(t *testing.T) {
+	mirrors := storetest.Mirrors(4)
+	for i, m := range mirrors {
+		data, err := PackProofSection(m)
+		if err != nil {
+			t.Fatalf("PackProofSection #%d error %v", i, err)
+		}
+
+		// The section packs as the arguments of submitMirror after the
+		// header.
+		_, coinbase, txCount, merkleNodes, err := submitArgs(m)
+		if err != nil {
+			t.Fatalf("submitArgs #%d error %v", i, err)
+		}
+		want, err := proofSectionArguments.Pack(coinbase, txCount, merkleNodes)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("PackProofSection #%d: got %x, want %x", i, data, want)
+		}
+
+		got, err := UnpackProofSection(data, m.BtcHeader)
+		if err != nil {
+			t.Fatalf("UnpackProofSection #%d error %v", i, err)
+		}
+		if !got.Equal(m) {
+			t.Errorf("UnpackProofSection #%d: got %v, want %v", i,
+				spew.Sdump(got), spew.Sdump(m))
+		}
+		other := mirrors[(i+1)%len(mirrors)].BtcHeader
+		if _, err := UnpackProofSection(data, other); !errors.Is(err, lightmirror.ErrBranchMismatch) {
+			t.Errorf("UnpackProofSection #%d: got error %v, want %v", i, err,
+				lightmirror.ErrBranchMismatch)
+		}
+	}
+
+	m := mirrors[1]
+	coinbase, txCount, merkleNodes, err := proofSectionArgs(m)
+	if err != nil {
+		t.Fatalf("proofSectionArgs error %v", err)
+	}
+	tests := []struct {
+		name     string
+		coinbase []byte
+		txCount  uint32
+		want     error
+	}{
+		{"smallest count", coinbase, txCount/2 + 1, nil},
+		{"count too small", coinbase, txCount / 2, lightmirror.ErrBranchMismatch},
+		{"count too large", coinbase, txCount + 1, lightmirror.ErrBranchMismatch},
+		{"trailing bytes", append(append([]byte(nil), coinbase...), 0), txCount, lightmirror.ErrTrailingData},
+	}
+	for _, test := range tests {
+		data, err := proofSectionArguments.Pack(test.coinbase, test.txCount, merkleNodes)
+		if err != nil {
+			t.Fatalf("Pack (%s) error %v", test.name, err)
+		}
+		_, err = UnpackProofSection(data, m.BtcHeader)
+		if !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+			t.Errorf("UnpackProofSection (%s): got error %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	invalid := m.Clone()
+	invalid.CoinBaseTx.LockTime++
+	if _, err := PackProofSection(invalid); err == nil {
+		t.Errorf("PackProofSection: expected merkle error")
+	}
+}
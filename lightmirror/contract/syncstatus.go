@@ -0,0 +1,109 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TipPlacement tells where the tip of the contract is in the local chain.
+type TipPlacement int
+
+const (
+	// TipOnBestChain is the placement of a contract tip in the best chain.
+	TipOnBestChain TipPlacement = iota
+
+	// TipOnStaleFork is the placement of a contract tip the chain knows
+	// on a side branch only: the contract is on a fork which lost.
+	TipOnStaleFork
+
+	// TipUnknown is the placement of a contract tip the chain does not
+	// know, or of the tip of a contract holding no mirror.
+	TipUnknown
+)
+
+// Map of TipPlacement values back to their constant names for pretty
+// printing.
+var tipPlacementStrings = map[TipPlacement]string{
+	TipOnBestChain: "TipOnBestChain",
+	TipOnStaleFork: "TipOnStaleFork",
+	TipUnknown:     "TipUnknown",
+}
+
+// String returns the TipPlacement in human-readable form.
+func (p TipPlacement) String() string {
+	if s, ok := tipPlacementStrings[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown TipPlacement (%d)", int(p))
+}
+
+// Status compares the tip of the local chain with the one of the contract.
+type Status struct {
+	LocalHeight int64
+	LocalHash   chainhash.Hash
+
+	// ContractHeight and ContractHash are those of the last mirror the
+	// contract stored, both zero when it holds none.
+	ContractHeight int64
+	ContractHash   chainhash.Hash
+
+	// Gap is the number of blocks the contract is behind the local tip,
+	// LocalHeight - ContractHeight.  It is negative when the contract is
+	// ahead.
+	Gap int64
+
+	Placement TipPlacement
+}
+
+// SyncStatus reads the tip of the contract at contractAddr and compares it
+// with the tip of the chain.  client is typically an *ethclient.Client.
+func SyncStatus(ctx context.Context, chain *lightmirror.MirrorChain, client bind.ContractCaller,
+	contractAddr common.Address) (Status, error) {
+
+	caller, err := NewMirrorRegistryCaller(contractAddr, client)
+	if err != nil {
+		return Status{}, err
+	}
+	tip, err := caller.Tip(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return Status{}, err
+	}
+
+	var status Status
+	_, status.LocalHeight = chain.Tip()
+	status.LocalHash, err = chain.HashAtHeight(status.LocalHeight)
+	if err != nil {
+		return Status{}, err
+	}
+	status.ContractHeight = int64(tip.Height)
+	status.ContractHash = chainhash.Hash(tip.BlockHash)
+	status.Gap = status.LocalHeight - status.ContractHeight
+
+	status.Placement = TipUnknown
+	if status.ContractHash != (chainhash.Hash{}) {
+		height, err := chain.HeightOfHash(status.ContractHash)
+		switch {
+		case err == nil && height == status.ContractHeight:
+			status.Placement = TipOnBestChain
+		case err == nil:
+			return Status{}, fmt.Errorf("contract tip %v at height %d is "+
+				"at height %d in the chain", status.ContractHash,
+				status.ContractHeight, height)
+		case errors.Is(err, lightmirror.ErrNotInBestChain):
+			status.Placement = TipOnStaleFork
+		case !errors.Is(err, lightmirror.ErrUnknownBlock):
+			return Status{}, err
+		}
+	}
+	return status, nil
+}
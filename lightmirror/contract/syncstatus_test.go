@@ -0,0 +1,127 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+)
+
+// stubTipCode is the runtime code of a stub registry answering tip() with
+// the storage slots 0 and 1:
+//
+//	PUSH1 0 SLOAD PUSH1 0 MSTORE PUSH1 1 SLOAD PUSH1 0x20 MSTORE
+//	PUSH1 0x40 PUSH1 0 RETURN
+var stubTipCode = common.FromHex("600054600052600154602052" + "60406000f3")
+
+// tipRegistry returns a simulated chain holding a stub registry whose tip
+// is the given height and hash.
+func tipRegistry(t *testing.T, height int64, hash chainhash.Hash) (*backends.SimulatedBackend, common.Address) {
+	t.Helper()
+	addr := common.Address{0x43}
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		addr: {
+			Code: stubTipCode,
+			Storage: map[common.Hash]common.Hash{
+				slotHash(0): common.BigToHash(big.NewInt(height)),
+				slotHash(1): common.Hash(hash),
+			},
+			Balance: new(big.Int),
+		},
+	}, 30000000)
+	t.Cleanup(func() { sim.Close() })
+	return sim, addr
+}
+
+func TestSyncStatus(t *testing.T) {
+	const base = relayBaseHeight
+	mirrors := solvedMirrors(t, chainhash.Hash{}, 0, 5)
+	chain, err := lightmirror.NewMirrorChain(mirrors[0], base,
+		lightmirror.WithChainParams(&chaincfg.RegressionNetParams))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	for _, m := range mirrors[1:] {
+		if _, err := chain.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+
+	// A longer branch from the second block takes over, leaving the
+	// mirrors above it on a stale fork.
+	branch := solvedMirrors(t, mirrors[1].BtcHeader.BlockHash(), 10, 5)
+	for _, m := range branch {
+		if _, err := chain.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	tipHash := branch[4].BtcHeader.BlockHash()
+
+	tests := []struct {
+		name      string
+		height    int64
+		hash      chainhash.Hash
+		gap       int64
+		placement TipPlacement
+	}{
+		{"synced", base + 6, tipHash, 0, TipOnBestChain},
+		{"behind", base + 3, branch[1].BtcHeader.BlockHash(), 3, TipOnBestChain},
+		{"below the fork", base + 1, mirrors[1].BtcHeader.BlockHash(), 5, TipOnBestChain},
+		{"stale fork", base + 4, mirrors[4].BtcHeader.BlockHash(), 2, TipOnStaleFork},
+		{"unknown", base + 7, chainhash.Hash{7}, -1, TipUnknown},
+		{"empty", 0, chainhash.Hash{}, base + 6, TipUnknown},
+	}
+
+	for _, test := range tests {
+		sim, addr := tipRegistry(t, test.height, test.hash)
+		status, err := SyncStatus(context.Background(), chain, sim, addr)
+		if err != nil {
+			t.Fatalf("SyncStatus (%s) error %v", test.name, err)
+		}
+		want := Status{
+			LocalHeight:    base + 6,
+			LocalHash:      tipHash,
+			ContractHeight: test.height,
+			ContractHash:   test.hash,
+			Gap:            test.gap,
+			Placement:      test.placement,
+		}
+		if status != want {
+			t.Errorf("SyncStatus (%s): got %+v, want %+v", test.name, status,
+				want)
+		}
+	}
+
+	// A tip at another height than the chain has its block at is an error.
+	sim, addr := tipRegistry(t, base+5, tipHash)
+	if _, err := SyncStatus(context.Background(), chain, sim, addr); err == nil {
+		t.Errorf("SyncStatus: expected height mismatch error")
+	}
+}
+
+func TestTipPlacementStringer(t *testing.T) {
+	tests := []struct {
+		in   TipPlacement
+		want string
+	}{
+		{TipOnBestChain, "TipOnBestChain"},
+		{TipOnStaleFork, "TipOnStaleFork"},
+		{TipUnknown, "TipUnknown"},
+		{0xff, "Unknown TipPlacement (255)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, got, test.want)
+		}
+	}
+}
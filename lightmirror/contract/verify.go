@@ -0,0 +1,235 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// verifyBatchSize is the number of heights VerifyOnChain reads from the
+// contract at once.
+const verifyBatchSize = 100
+
+var (
+	// ErrNotStored is the mismatch of a height the contract holds no
+	// mirror at.
+	ErrNotStored = errors.New("contract holds no mirror at height")
+
+	// ErrHashMismatch is the mismatch of a height the contract holds
+	// another block at than the Bitcoin chain.
+	ErrHashMismatch = errors.New("stored block hash differs from bitcoin")
+
+	// ErrCommitmentMismatch is the mismatch of a block the contract holds
+	// another commitment for than the one of its mirror.
+	ErrCommitmentMismatch = errors.New("stored commitment differs from mirror")
+)
+
+// BatchCaller sends several JSON-RPC requests in a single round trip.  The
+// *rpc.Client of the Core chain node satisfies it.
+type BatchCaller interface {
+	BatchCallContext(ctx context.Context, b []rpc.BatchElem) error
+}
+
+// BatchClient is an ethclient.Client which also sends batches of requests
+// over its RPC connection.
+type BatchClient struct {
+	*ethclient.Client
+	rpc *rpc.Client
+}
+
+// NewBatchClient returns a BatchClient using the given RPC client.
+func NewBatchClient(c *rpc.Client) *BatchClient {
+	return &BatchClient{Client: ethclient.NewClient(c), rpc: c}
+}
+
+// BatchCallContext sends all the given requests as a single batch.
+func (c *BatchClient) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	return c.rpc.BatchCallContext(ctx, b)
+}
+
+// Mismatch describes a height at which the contract disagrees with the
+// Bitcoin chain.
+type Mismatch struct {
+	Height int64
+
+	// StoredHash and StoredCommitment are what the contract holds at
+	// Height, both zero when it holds no mirror.
+	StoredHash       chainhash.Hash
+	StoredCommitment common.Hash
+
+	// BlockHash and Commitment are those of the mirror of the block the
+	// fetcher has at Height.  Commitment is zero when the coinbase has no
+	// power parameters.
+	BlockHash  chainhash.Hash
+	Commitment common.Hash
+
+	// Err is ErrNotStored, ErrHashMismatch or ErrCommitmentMismatch.
+	Err error
+}
+
+// Report is the outcome of VerifyOnChain.
+type Report struct {
+	// Checked is the number of heights checked.
+	Checked int
+
+	// NextHeight is the first height which was not checked, the end
+	// height plus one once the whole range is.
+	NextHeight int64
+
+	Mismatches []Mismatch
+}
+
+// storedMirror is what the contract holds at a height.
+type storedMirror struct {
+	blockHash  [32]byte
+	commitment [32]byte
+}
+
+// VerifyOnChain checks that the contract at contractAddr holds at every
+// height of [startHeight, endHeight] the mirror of the block the fetcher
+// has at that height, comparing block hashes and commitments.  Blocks whose
+// coinbase has no power parameters are compared by hash only.  client is
+// typically an *ethclient.Client, or a *BatchClient to read the contract in
+// batches of mirrorAt calls rather than one call at a time.
+//
+// VerifyOnChain stops at the first error of the client or the fetcher and
+// returns it along with the report of the heights checked so far.
+// Verification resumes with another call starting at the NextHeight of the
+// report.
+func VerifyOnChain(ctx context.Context, client bind.ContractCaller, contractAddr common.Address,
+	fetcher lightmirror.Fetcher, startHeight, endHeight int64) (Report, error) {
+
+	report := Report{NextHeight: startHeight}
+	if startHeight < 0 || endHeight < startHeight {
+		return report, fmt.Errorf("invalid height range [%d, %d]", startHeight,
+			endHeight)
+	}
+	parsed, err := MirrorRegistryMetaData.GetAbi()
+	if err != nil {
+		return report, err
+	}
+
+	for from := startHeight; from <= endHeight; from += verifyBatchSize {
+		to := from + verifyBatchSize - 1
+		if to > endHeight {
+			to = endHeight
+		}
+		stored, err := readMirrors(ctx, client, contractAddr, parsed, from, to)
+		if err != nil {
+			return report, err
+		}
+		for i, s := range stored {
+			height := from + int64(i)
+			m, err := fetcher.FetchByHeight(ctx, height)
+			if err != nil {
+				return report, err
+			}
+			if mismatch := compareMirror(height, s, m); mismatch != nil {
+				report.Mismatches = append(report.Mismatches, *mismatch)
+			}
+			report.Checked++
+			report.NextHeight = height + 1
+		}
+	}
+	return report, nil
+}
+
+// compareMirror returns the mismatch between what the contract holds at the
+// given height and the mirror of the Bitcoin block at that height, or nil.
+func compareMirror(height int64, s storedMirror, m *lightmirror.BtcLightMirrorV2) *Mismatch {
+	mismatch := &Mismatch{
+		Height:           height,
+		StoredHash:       chainhash.Hash(s.blockHash),
+		StoredCommitment: common.Hash(s.commitment),
+		BlockHash:        m.BtcHeader.BlockHash(),
+	}
+	commitment, err := m.CommitmentHash()
+	if err == nil {
+		mismatch.Commitment = commitment
+	}
+
+	switch {
+	case s.blockHash == [32]byte{}:
+		mismatch.Err = ErrNotStored
+	case mismatch.StoredHash != mismatch.BlockHash:
+		mismatch.Err = ErrHashMismatch
+	case err == nil && mismatch.StoredCommitment != commitment:
+		mismatch.Err = ErrCommitmentMismatch
+	default:
+		return nil
+	}
+	return mismatch
+}
+
+// readMirrors returns what the contract holds at the heights [from, to],
+// in a single batch when the client supports it.
+func readMirrors(ctx context.Context, client bind.ContractCaller, contractAddr common.Address, parsed *abi.ABI,
+	from, to int64) ([]storedMirror, error) {
+
+	calls := make([]ethereum.CallMsg, 0, to-from+1)
+	for height := from; height <= to; height++ {
+		data, err := parsed.Pack("mirrorAt", uint64(height))
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, ethereum.CallMsg{To: &contractAddr, Data: data})
+	}
+
+	results := make([][]byte, len(calls))
+	if batcher, ok := client.(BatchCaller); ok {
+		batch := make([]rpc.BatchElem, len(calls))
+		for i, call := range calls {
+			batch[i] = rpc.BatchElem{
+				Method: "eth_call",
+				Args: []interface{}{map[string]interface{}{
+					"to":   call.To,
+					"data": hexutil.Bytes(call.Data),
+				}, "latest"},
+				Result: new(hexutil.Bytes),
+			}
+		}
+		if err := batcher.BatchCallContext(ctx, batch); err != nil {
+			return nil, err
+		}
+		for i, elem := range batch {
+			if elem.Error != nil {
+				return nil, fmt.Errorf("mirrorAt(%d): %w", from+int64(i),
+					elem.Error)
+			}
+			results[i] = *elem.Result.(*hexutil.Bytes)
+		}
+	} else {
+		for i, call := range calls {
+			result, err := client.CallContract(ctx, call, nil)
+			if err != nil {
+				return nil, fmt.Errorf("mirrorAt(%d): %w", from+int64(i), err)
+			}
+			results[i] = result
+		}
+	}
+
+	stored := make([]storedMirror, len(results))
+	for i, result := range results {
+		out, err := parsed.Unpack("mirrorAt", result)
+		if err != nil {
+			return nil, fmt.Errorf("mirrorAt(%d): %w", from+int64(i), err)
+		}
+		stored[i].blockHash = *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+		stored[i].commitment = *abi.ConvertType(out[1], new([32]byte)).(*[32]byte)
+	}
+	return stored, nil
+}
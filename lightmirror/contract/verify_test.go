@@ -0,0 +1,227 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package contract
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// stubMirrorAtCode is the runtime code of a stub registry answering
+// mirrorAt(height) with the storage slots 2*height and 2*height+1:
+//
+//	PUSH1 4 CALLDATALOAD PUSH1 1 SHL DUP1 SLOAD PUSH1 0 MSTORE
+//	PUSH1 1 ADD SLOAD PUSH1 0x20 MSTORE PUSH1 0x40 PUSH1 0 RETURN
+var stubMirrorAtCode = common.FromHex("60043560011b8054600052" +
+	"60010154602052" + "60406000f3")
+
+// verifyBaseHeight is the height of the first mirror of the verify tests.
+const verifyBaseHeight = 100
+
+// heightFetcher serves mirrors by height from verifyBaseHeight on, failing
+// once at failHeight when it is set.
+type heightFetcher struct {
+	mirrors    []*lightmirror.BtcLightMirrorV2
+	failHeight int64
+}
+
+func (f *heightFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	return nil, lightmirror.ErrNotFound
+}
+
+func (f *heightFetcher) FetchByHeight(ctx context.Context, height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	if height == f.failHeight {
+		f.failHeight = 0
+		return nil, errors.New("fetcher interrupted")
+	}
+	i := height - verifyBaseHeight
+	if i < 0 || i >= int64(len(f.mirrors)) {
+		return nil, lightmirror.ErrNotFound
+	}
+	return f.mirrors[i], nil
+}
+
+// slotHash returns the key of the storage slot n.
+func slotHash(n int64) common.Hash {
+	return common.BigToHash(big.NewInt(n))
+}
+
+// verifyFixture returns mirrors of Bitcoin blocks from verifyBaseHeight on,
+// and a simulated chain holding a stub registry which stores them, but for
+// the mismatches returned.
+func verifyFixture(t *testing.T, n int) ([]*lightmirror.BtcLightMirrorV2, *backends.SimulatedBackend, common.Address, []Mismatch) {
+	t.Helper()
+	mirrors := storetest.Mirrors(n)
+	storage := make(map[common.Hash]common.Hash)
+	var mismatches []Mismatch
+	for i, m := range mirrors {
+		height := int64(verifyBaseHeight + i)
+
+		// Every other coinbase has power parameters.
+		if i%2 == 0 {
+			candidate := common.BytesToAddress([]byte{byte(i), 0xca})
+			reward := common.BytesToAddress([]byte{byte(i), 0xee})
+			m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut, &wire.TxOut{
+				PkScript: corePkScript(candidate, reward, nil),
+			})
+		}
+		hash := m.BtcHeader.BlockHash()
+		commitment, err := m.CommitmentHash()
+		if err != nil && !errors.Is(err, lightmirror.ErrNoPowerParams) {
+			t.Fatalf("CommitmentHash #%d error %v", i, err)
+		}
+		mismatch := Mismatch{
+			Height:           height,
+			StoredHash:       hash,
+			StoredCommitment: commitment,
+			BlockHash:        hash,
+			Commitment:       commitment,
+		}
+		switch i {
+		case 2:
+			mismatch.StoredHash = chainhash.Hash{}
+			mismatch.StoredCommitment = common.Hash{}
+			mismatch.Err = ErrNotStored
+		case 3:
+			mismatch.StoredHash = chainhash.Hash{0x03}
+			mismatch.Err = ErrHashMismatch
+		case 4:
+			mismatch.StoredCommitment = common.Hash{0x04}
+			mismatch.Err = ErrCommitmentMismatch
+		case 5:
+			// Blocks without power parameters compare by hash only.
+			mismatch.StoredCommitment = common.Hash{0x05}
+		case n - 1:
+			mismatch.StoredHash = chainhash.Hash{0xff}
+			mismatch.Err = ErrHashMismatch
+		}
+		if mismatch.Err != nil {
+			mismatches = append(mismatches, mismatch)
+		}
+		storage[slotHash(2*height)] = common.Hash(mismatch.StoredHash)
+		storage[slotHash(2*height+1)] = mismatch.StoredCommitment
+	}
+
+	addr := common.Address{0x42}
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		addr: {Code: stubMirrorAtCode, Storage: storage, Balance: new(big.Int)},
+	}, 30000000)
+	t.Cleanup(func() { sim.Close() })
+	return mirrors, sim, addr, mismatches
+}
+
+func checkReport(t *testing.T, name string, got Report, checked int, next int64, want []Mismatch) {
+	t.Helper()
+	if got.Checked != checked || got.NextHeight != next {
+		t.Errorf("VerifyOnChain (%s): checked %d heights up to %d, want %d up to %d",
+			name, got.Checked, got.NextHeight, checked, next)
+	}
+	if len(got.Mismatches) != len(want) {
+		t.Fatalf("VerifyOnChain (%s): got mismatches %+v, want %+v", name,
+			got.Mismatches, want)
+	}
+	for i, mismatch := range got.Mismatches {
+		if mismatch != want[i] {
+			t.Errorf("VerifyOnChain (%s) mismatch #%d: got %+v, want %+v", name,
+				i, mismatch, want[i])
+		}
+	}
+}
+
+func TestVerifyOnChain(t *testing.T) {
+	// The range spans several batches.
+	n := 2*verifyBatchSize + 10
+	mirrors, sim, addr, mismatches := verifyFixture(t, n)
+	end := int64(verifyBaseHeight + n - 1)
+	fetcher := &heightFetcher{mirrors: mirrors}
+	ctx := context.Background()
+
+	report, err := VerifyOnChain(ctx, sim, addr, fetcher, verifyBaseHeight, end)
+	if err != nil {
+		t.Fatalf("VerifyOnChain error %v", err)
+	}
+	checkReport(t, "whole range", report, n, end+1, mismatches)
+
+	// An interrupted verification resumes from the next height.
+	fetcher.failHeight = verifyBaseHeight + 4
+	report, err = VerifyOnChain(ctx, sim, addr, fetcher, verifyBaseHeight, end)
+	if err == nil {
+		t.Fatalf("VerifyOnChain: expected fetcher error")
+	}
+	checkReport(t, "interrupted", report, 4, verifyBaseHeight+4, mismatches[:2])
+	resumed, err := VerifyOnChain(ctx, sim, addr, fetcher, report.NextHeight, end)
+	if err != nil {
+		t.Fatalf("VerifyOnChain error %v", err)
+	}
+	checkReport(t, "resumed", resumed, n-4, end+1, mismatches[2:])
+
+	if _, err := VerifyOnChain(ctx, sim, addr, fetcher, end, end-1); err == nil {
+		t.Errorf("VerifyOnChain: expected invalid range error")
+	}
+}
+
+// ethService serves eth_call from a simulated chain over RPC.
+type ethService struct {
+	sim *backends.SimulatedBackend
+}
+
+type callArgs struct {
+	To   *common.Address `json:"to"`
+	Data hexutil.Bytes   `json:"data"`
+}
+
+func (s *ethService) Call(ctx context.Context, args callArgs, block string) (hexutil.Bytes, error) {
+	return s.sim.CallContract(ctx, ethereum.CallMsg{To: args.To, Data: args.Data}, nil)
+}
+
+// countingBatchClient is a BatchClient counting its batches.
+type countingBatchClient struct {
+	*BatchClient
+	batches []int
+}
+
+func (c *countingBatchClient) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	c.batches = append(c.batches, len(b))
+	return c.BatchClient.BatchCallContext(ctx, b)
+}
+
+func TestVerifyOnChainBatch(t *testing.T) {
+	n := verifyBatchSize + 10
+	mirrors, sim, addr, mismatches := verifyFixture(t, n)
+	end := int64(verifyBaseHeight + n - 1)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &ethService{sim}); err != nil {
+		t.Fatalf("RegisterName error %v", err)
+	}
+	defer server.Stop()
+	client := &countingBatchClient{BatchClient: NewBatchClient(rpc.DialInProc(server))}
+	defer client.Close()
+
+	report, err := VerifyOnChain(context.Background(), client, addr,
+		&heightFetcher{mirrors: mirrors}, verifyBaseHeight, end)
+	if err != nil {
+		t.Fatalf("VerifyOnChain error %v", err)
+	}
+	checkReport(t, "batch", report, n, end+1, mismatches)
+	if len(client.batches) != 2 || client.batches[0] != verifyBatchSize ||
+		client.batches[1] != 10 {
+
+		t.Errorf("VerifyOnChain: got batches of %v calls", client.batches)
+	}
+}
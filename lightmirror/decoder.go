@@ -0,0 +1,424 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// maxDecodeTxIn and maxDecodeTxOut bound the input and output counts
+	// of a decoded coinbase as wire does, by the number of minimal inputs
+	// and outputs fitting in a message.
+	maxDecodeTxIn  = wire.MaxMessagePayload/41 + 1
+	maxDecodeTxOut = wire.MaxMessagePayload/wire.MinTxOutPayload + 1
+
+	// maxDecodeWitnessItems and maxDecodeScriptSize bound the witness
+	// items of an input and the size of a script or witness item.
+	maxDecodeWitnessItems = 4000000
+	maxDecodeScriptSize   = wire.MaxMessagePayload
+)
+
+// mirrorPool holds the mirrors DecodeAll decodes into.
+var mirrorPool = sync.Pool{
+	New: func() interface{} {
+		return new(BtcLightMirrorV2)
+	},
+}
+
+// MirrorDecoder decodes serialized mirrors reusing the memory of the mirrors
+// it decodes into, for bulk reads such as snapshot imports.  The zero value
+// is ready to use, with the limits of the zero DeserializeOptions.  A
+// MirrorDecoder is not safe for concurrent use.
+type MirrorDecoder struct {
+	// Options sets the limits of the decoded mirrors.  With
+	// RejectTrailingBytes, Decode fails if r holds more than the mirror;
+	// DecodeAll and DecodeEach decode until the end of r regardless.
+	Options DeserializeOptions
+
+	buf    [8]byte
+	header [wire.MaxBlockHeaderPayload]byte
+	hr     bytes.Reader
+}
+
+// Decode reads a mirror written by Serialize from r into dst, as Deserialize
+// does.  The merkle nodes, the coinbase inputs and outputs, and their
+// scripts and witnesses reuse the memory dst already holds where it is large
+// enough, so dst must not share it with another mirror.  On error, dst is
+// left partially decoded.
+func (d *MirrorDecoder) Decode(r io.Reader, dst *BtcLightMirrorV2) error {
+	if err := d.decode(r, dst, false); err != nil {
+		return err
+	}
+	if d.Options.RejectTrailingBytes {
+		return checkTrailing(r)
+	}
+	return nil
+}
+
+// decode is Decode leaving the bytes after the mirror unread.  When stream
+// is set, r ending within the header of the mirror, after the mirrors
+// before it, fails with a *TrailingDataError rather than with
+// io.ErrUnexpectedEOF.
+func (d *MirrorDecoder) decode(r io.Reader, dst *BtcLightMirrorV2, stream bool) error {
+	n, err := io.ReadFull(r, d.header[:])
+	if err == io.ErrUnexpectedEOF && stream {
+		return &TrailingDataError{Bytes: int64(n)}
+	}
+	if err != nil {
+		return err
+	}
+	d.hr.Reset(d.header[:])
+	if err := dst.BtcHeader.Deserialize(&d.hr); err != nil {
+		return err
+	}
+	if err := d.decodeCoinbase(r, dst); err != nil {
+		return noEOF(err)
+	}
+
+	count, err := d.readVarInt(r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if max := d.Options.maxMerkleNodes(); count > max {
+		return fmt.Errorf("MirrorDecoder.Decode too many merkle node to fit "+
+			"into a block [count %d, max %d]", count, max)
+	}
+	if uint64(cap(dst.MerkleNodes)) >= count {
+		dst.MerkleNodes = dst.MerkleNodes[:count]
+	} else {
+		dst.MerkleNodes = make([]chainhash.Hash, count)
+	}
+	dst.WitnessMerkleNodes = nil
+	for i := range dst.MerkleNodes {
+		if _, err := io.ReadFull(r, dst.MerkleNodes[i][:]); err != nil {
+			return noEOF(err)
+		}
+	}
+	return dst.verifyInvariants(d.Options)
+}
+
+// DecodeAll decodes the mirrors written one after the other to r by
+// Serialize, until the end of r, and calls fn with every mirror in order.
+// It stops at the first error, of decoding or returned by fn.  Bytes at the
+// end of r too few for a header fail with a *TrailingDataError.
+//
+// The mirrors passed to fn are recycled: fn must not retain the pointer or
+// any memory it references past its return, unless it keeps a Clone.
+func (d *MirrorDecoder) DecodeAll(r io.Reader, fn func(*BtcLightMirrorV2) error) error {
+	m := mirrorPool.Get().(*BtcLightMirrorV2)
+	defer mirrorPool.Put(m)
+
+	for {
+		err := d.decode(r, m, true)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+// MirrorDecodeError is returned by DecodeEach when the mirror at Index of
+// the stream does not decode, as opposed to an error of the callback.
+type MirrorDecodeError struct {
+	Index int
+	Err   error
+}
+
+func (e *MirrorDecodeError) Error() string {
+	return fmt.Sprintf("decode mirror %d: %v", e.Index, e.Err)
+}
+
+func (e *MirrorDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeEach decodes the mirrors written one after the other to r by
+// Serialize, until the end of r, and calls fn with every mirror and its
+// index in the stream.  Every mirror is decoded into the same recycled
+// mirror by a MirrorDecoder, so memory stays flat however long the stream;
+// fn must not retain the mirror past its return, unless it keeps a Clone.
+// Wrapping an unbuffered r in a bufio.Reader saves a read per field.
+//
+// Decoding stops at the first error.  A mirror which does not decode is
+// reported as a *MirrorDecodeError, wrapping a *TrailingDataError when the
+// bytes at the end of r are too few for a header.  An error of fn is returned as is,
+// except ErrStopIteration, which ends decoding without an error.
+func DecodeEach(r io.Reader, fn func(index int, m *BtcLightMirrorV2) error) error {
+	var d MirrorDecoder
+	m := mirrorPool.Get().(*BtcLightMirrorV2)
+	defer mirrorPool.Put(m)
+
+	for index := 0; ; index++ {
+		err := d.decode(r, m, true)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &MirrorDecodeError{Index: index, Err: err}
+		}
+		if err := fn(index, m); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for an EOF within a mirror.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decodeCoinbase reads the coinbase of dst, only keeping its bytes, for
+// Coinbase to decode, with Options.RetainRawCoinbase.
+func (d *MirrorDecoder) decodeCoinbase(r io.Reader, dst *BtcLightMirrorV2) error {
+	if !d.Options.RetainRawCoinbase {
+		dst.rawCoinbase, dst.coinbasePending = nil, false
+		return d.decodeTx(r, &dst.CoinBaseTx)
+	}
+	raw, err := scanCoinbase(r, dst.rawCoinbase[:0])
+	dst.CoinBaseTx = wire.MsgTx{}
+	dst.rawCoinbase, dst.coinbasePending = raw, err == nil
+	return err
+}
+
+// decodeTx reads tx in the witness encoding of MsgTx.Deserialize.
+func (d *MirrorDecoder) decodeTx(r io.Reader, tx *wire.MsgTx) error {
+	version, err := d.readUint32(r)
+	if err != nil {
+		return err
+	}
+	tx.Version = int32(version)
+
+	count, err := d.readVarInt(r)
+	if err != nil {
+		return err
+	}
+	witness := false
+	if count == wire.TxFlagMarker {
+		if _, err := io.ReadFull(r, d.buf[:1]); err != nil {
+			return err
+		}
+		if wire.TxFlag(d.buf[0]) != wire.WitnessFlag {
+			return fmt.Errorf("MirrorDecoder.Decode witness tx but flag "+
+				"byte is %x", d.buf[0])
+		}
+		witness = true
+		if count, err = d.readVarInt(r); err != nil {
+			return err
+		}
+	}
+	if count > maxDecodeTxIn {
+		return fmt.Errorf("MirrorDecoder.Decode too many input "+
+			"transactions to fit into max message size [count %d, max %d]",
+			count, maxDecodeTxIn)
+	}
+	tx.TxIn = reuseTxIns(tx.TxIn, int(count))
+	for _, txIn := range tx.TxIn {
+		if err := d.decodeTxIn(r, txIn); err != nil {
+			return err
+		}
+	}
+
+	if count, err = d.readVarInt(r); err != nil {
+		return err
+	}
+	if count > maxDecodeTxOut {
+		return fmt.Errorf("MirrorDecoder.Decode too many output "+
+			"transactions to fit into max message size [count %d, max %d]",
+			count, maxDecodeTxOut)
+	}
+	tx.TxOut = reuseTxOuts(tx.TxOut, int(count))
+	for _, txOut := range tx.TxOut {
+		value, err := d.readUint64(r)
+		if err != nil {
+			return err
+		}
+		txOut.Value = int64(value)
+		if txOut.PkScript, err = d.readScript(r, txOut.PkScript); err != nil {
+			return err
+		}
+	}
+
+	if witness {
+		for _, txIn := range tx.TxIn {
+			if err := d.decodeWitness(r, txIn); err != nil {
+				return err
+			}
+		}
+		if !tx.HasWitness() {
+			return errors.New("MirrorDecoder.Decode witness flag set " +
+				"but no witnesses")
+		}
+	}
+
+	tx.LockTime, err = d.readUint32(r)
+	return err
+}
+
+// decodeTxIn reads an input without its witness into txIn, which gets no
+// witness.
+func (d *MirrorDecoder) decodeTxIn(r io.Reader, txIn *wire.TxIn) error {
+	if _, err := io.ReadFull(r, txIn.PreviousOutPoint.Hash[:]); err != nil {
+		return err
+	}
+	index, err := d.readUint32(r)
+	if err != nil {
+		return err
+	}
+	txIn.PreviousOutPoint.Index = index
+	if txIn.SignatureScript, err = d.readScript(r, txIn.SignatureScript); err != nil {
+		return err
+	}
+	if txIn.Sequence, err = d.readUint32(r); err != nil {
+		return err
+	}
+	txIn.Witness = txIn.Witness[:0]
+	return nil
+}
+
+// decodeWitness reads the witness stack of txIn.
+func (d *MirrorDecoder) decodeWitness(r io.Reader, txIn *wire.TxIn) error {
+	count, err := d.readVarInt(r)
+	if err != nil {
+		return err
+	}
+	if count > maxDecodeWitnessItems {
+		return fmt.Errorf("MirrorDecoder.Decode too many witness items to "+
+			"fit into max message size [count %d, max %d]", count,
+			maxDecodeWitnessItems)
+	}
+	witness := txIn.Witness[:cap(txIn.Witness)]
+	if uint64(len(witness)) < count {
+		witness = append(witness, make(wire.TxWitness, int(count)-len(witness))...)
+	}
+	txIn.Witness = witness[:count]
+	for i := range txIn.Witness {
+		if txIn.Witness[i], err = d.readScript(r, txIn.Witness[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reuseTxIns returns n inputs, reusing those of txIns.
+func reuseTxIns(txIns []*wire.TxIn, n int) []*wire.TxIn {
+	if cap(txIns) < n {
+		txIns = append(txIns[:cap(txIns)], make([]*wire.TxIn, n-cap(txIns))...)
+	}
+	txIns = txIns[:n]
+	for i := range txIns {
+		if txIns[i] == nil {
+			txIns[i] = new(wire.TxIn)
+		}
+	}
+	return txIns
+}
+
+// reuseTxOuts returns n outputs, reusing those of txOuts.
+func reuseTxOuts(txOuts []*wire.TxOut, n int) []*wire.TxOut {
+	if cap(txOuts) < n {
+		txOuts = append(txOuts[:cap(txOuts)], make([]*wire.TxOut, n-cap(txOuts))...)
+	}
+	txOuts = txOuts[:n]
+	for i := range txOuts {
+		if txOuts[i] == nil {
+			txOuts[i] = new(wire.TxOut)
+		}
+	}
+	return txOuts
+}
+
+// readScript reads a variable length script into the memory of script when
+// it is large enough.
+func (d *MirrorDecoder) readScript(r io.Reader, script []byte) ([]byte, error) {
+	size, err := d.readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxDecodeScriptSize {
+		return nil, fmt.Errorf("MirrorDecoder.Decode script is larger than "+
+			"the max allowed size [count %d, max %d]", size,
+			maxDecodeScriptSize)
+	}
+	if uint64(cap(script)) >= size {
+		script = script[:size]
+	} else {
+		script = make([]byte, size)
+	}
+	if _, err := io.ReadFull(r, script); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func (d *MirrorDecoder) readUint32(r io.Reader) (uint32, error) {
+	if _, err := io.ReadFull(r, d.buf[:4]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(d.buf[:4]), nil
+}
+
+func (d *MirrorDecoder) readUint64(r io.Reader) (uint64, error) {
+	if _, err := io.ReadFull(r, d.buf[:8]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(d.buf[:8]), nil
+}
+
+// readVarInt reads a canonically encoded variable length integer, as
+// wire.ReadVarInt does.
+func (d *MirrorDecoder) readVarInt(r io.Reader) (uint64, error) {
+	if _, err := io.ReadFull(r, d.buf[:1]); err != nil {
+		return 0, err
+	}
+	discriminant := d.buf[0]
+	var n, min uint64
+	switch discriminant {
+	case 0xff:
+		v, err := d.readUint64(r)
+		if err != nil {
+			return 0, err
+		}
+		n, min = v, 0x100000000
+	case 0xfe:
+		v, err := d.readUint32(r)
+		if err != nil {
+			return 0, err
+		}
+		n, min = uint64(v), 0x10000
+	case 0xfd:
+		if _, err := io.ReadFull(r, d.buf[:2]); err != nil {
+			return 0, err
+		}
+		n, min = uint64(binary.LittleEndian.Uint16(d.buf[:2])), 0xfd
+	default:
+		return uint64(discriminant), nil
+	}
+	if n < min {
+		return 0, fmt.Errorf("MirrorDecoder.Decode non-canonical varint "+
+			"%x - discriminant %x must encode a value greater than %x",
+			n, discriminant, min)
+	}
+	return n, nil
+}
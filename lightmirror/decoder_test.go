@@ -0,0 +1,337 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// decoderMirrors returns mirrors of varied shapes, so that decoding them one
+// after the other into the same mirror grows and shrinks every slice.  The
+// mirrors given inputs and outputs do not pass the merkle check.
+func decoderMirrors() []*BtcLightMirrorV2 {
+	mirrors := newTestMirrors(4)
+
+	segwit := newTestMirror(chainhash.Hash{}, 10, 300)
+	segwit.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32), {0x01}}
+	segwit.CoinBaseTx.TxOut = append(segwit.CoinBaseTx.TxOut,
+		&wire.TxOut{PkScript: bytes.Repeat([]byte{0x6a}, 80)},
+		&wire.TxOut{Value: 1, PkScript: []byte{0x51}})
+
+	wide := newTestMirror(chainhash.Hash{}, 11, 0)
+	wide.CoinBaseTx.TxIn = append(wide.CoinBaseTx.TxIn,
+		&wire.TxIn{SignatureScript: bytes.Repeat([]byte{0x01}, 200)},
+		&wire.TxIn{Witness: wire.TxWitness{{0x02}, {0x03}, {0x04}}})
+
+	return append(mirrors, segwit, wide, newTestMirror(chainhash.Hash{}, 12, 1),
+		segwit, newTestMirror(chainhash.Hash{}, 13, 2000))
+}
+
+// serializeMirrors returns the concatenated serializations of the mirrors.
+func serializeMirrors(t *testing.T, mirrors []*BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, m := range mirrors {
+		if err := m.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize error %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestMirrorDecoderDecode(t *testing.T) {
+	mirrors := decoderMirrors()
+	r := bytes.NewReader(serializeMirrors(t, mirrors))
+
+	var d MirrorDecoder
+	var dst BtcLightMirrorV2
+	for i, m := range mirrors {
+		if err := d.Decode(r, &dst); err != nil {
+			t.Fatalf("Decode #%d error %v", i, err)
+		}
+		got, err := dst.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes #%d error %v", i, err)
+		}
+		want, _ := m.ToBytes()
+		if !bytes.Equal(got, want) {
+			t.Errorf("Decode #%d: got %x, want %x", i, got, want)
+		}
+		if dst.CoinBaseTx.WitnessHash() != m.CoinBaseTx.WitnessHash() {
+			t.Errorf("Decode #%d: got witness hash %v, want %v", i,
+				dst.CoinBaseTx.WitnessHash(), m.CoinBaseTx.WitnessHash())
+		}
+	}
+	if err := d.Decode(r, &dst); err != io.EOF {
+		t.Errorf("Decode: got error %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func TestMirrorDecoderReuse(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 300)
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+
+	var d MirrorDecoder
+	dst := new(BtcLightMirrorV2)
+	if err := d.Decode(bytes.NewReader(data), dst); err != nil {
+		t.Fatalf("Decode error %v", err)
+	}
+	txIn, txOut := dst.CoinBaseTx.TxIn[0], dst.CoinBaseTx.TxOut[0]
+	r := bytes.NewReader(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		if err := d.Decode(r, dst); err != nil {
+			t.Fatalf("Decode error %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Decode: got %v allocations decoding into a used mirror", allocs)
+	}
+	if dst.CoinBaseTx.TxIn[0] != txIn || dst.CoinBaseTx.TxOut[0] != txOut {
+		t.Errorf("Decode did not reuse the coinbase inputs and outputs")
+	}
+}
+
+func TestMirrorDecoderDecodeInvalid(t *testing.T) {
+	data, err := newTestMirror(chainhash.Hash{}, 1, 3).ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+
+	tooManyNodes := append([]byte(nil), data...)
+	tooManyNodes[len(data)-1-2*chainhash.HashSize] = maxMerkleNode + 1
+
+	badFlag := append([]byte(nil), data[:wire.MaxBlockHeaderPayload+4]...)
+	badFlag = append(badFlag, wire.TxFlagMarker, 0x02)
+	badFlag = append(badFlag, data[wire.MaxBlockHeaderPayload+4:]...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"truncated header", data[:40], io.ErrUnexpectedEOF},
+		{"truncated coinbase", data[:wire.MaxBlockHeaderPayload], io.ErrUnexpectedEOF},
+		{"truncated merkle nodes", data[:len(data)-1], io.ErrUnexpectedEOF},
+		{"too many merkle nodes", tooManyNodes, nil},
+		{"witness flag", badFlag, nil},
+	}
+	for _, test := range tests {
+		var d MirrorDecoder
+		err := d.Decode(bytes.NewReader(test.data), new(BtcLightMirrorV2))
+		if err == nil {
+			t.Errorf("Decode (%s): expected error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("Decode (%s): got error %v, want %v", test.name, err,
+				test.want)
+		}
+	}
+}
+
+func TestMirrorDecoderDecodeAll(t *testing.T) {
+	mirrors := decoderMirrors()
+	data := serializeMirrors(t, mirrors)
+
+	var d MirrorDecoder
+	var hashes []chainhash.Hash
+	seen := make(map[*BtcLightMirrorV2]bool)
+	err := d.DecodeAll(bytes.NewReader(data), func(m *BtcLightMirrorV2) error {
+		hashes = append(hashes, m.BtcHeader.BlockHash())
+		seen[m] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeAll error %v", err)
+	}
+	if len(hashes) != len(mirrors) {
+		t.Fatalf("DecodeAll: got %d mirrors, want %d", len(hashes), len(mirrors))
+	}
+	for i, m := range mirrors {
+		if hashes[i] != m.BtcHeader.BlockHash() {
+			t.Errorf("DecodeAll #%d: got %v, want %v", i, hashes[i],
+				m.BtcHeader.BlockHash())
+		}
+	}
+	// The callback gets the same recycled mirror every time, so a callback
+	// retaining it would see it overwritten.
+	if len(seen) != 1 {
+		t.Errorf("DecodeAll: got %d distinct mirrors, want 1 recycled", len(seen))
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = d.DecodeAll(bytes.NewReader(data), func(*BtcLightMirrorV2) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("DecodeAll: got error %v after %d calls, want %v after 1",
+			err, calls, stop)
+	}
+
+	err = d.DecodeAll(bytes.NewReader(data[:len(data)-1]), func(*BtcLightMirrorV2) error {
+		return nil
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeAll: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeEach(t *testing.T) {
+	mirrors := decoderMirrors()
+	data := serializeMirrors(t, mirrors)
+
+	var indices []int
+	err := DecodeEach(bytes.NewReader(data), func(index int, m *BtcLightMirrorV2) error {
+		if m.BtcHeader.BlockHash() != mirrors[index].BtcHeader.BlockHash() {
+			t.Errorf("DecodeEach #%d: got %v, want %v", index, m.BtcHeader.BlockHash(),
+				mirrors[index].BtcHeader.BlockHash())
+		}
+		indices = append(indices, index)
+		return nil
+	})
+	if err != nil || len(indices) != len(mirrors) {
+		t.Fatalf("DecodeEach: got %d mirrors, error %v, want %d", len(indices), err, len(mirrors))
+	}
+
+	// ErrStopIteration stops without error, other callback errors are
+	// returned as they are.
+	stop := errors.New("stop")
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{ErrStopIteration, nil},
+		{stop, stop},
+	} {
+		calls := 0
+		err := DecodeEach(bytes.NewReader(data), func(index int, m *BtcLightMirrorV2) error {
+			calls++
+			if index == 1 {
+				return test.err
+			}
+			return nil
+		})
+		if err != test.want || calls != 2 {
+			t.Errorf("DecodeEach stopping with %v: got error %v after %d calls, want %v after 2",
+				test.err, err, calls, test.want)
+		}
+	}
+
+	// A truncated stream fails at the index of the cut mirror.
+	calls := 0
+	err = DecodeEach(bytes.NewReader(data[:len(data)-1]), func(int, *BtcLightMirrorV2) error {
+		calls++
+		return nil
+	})
+	var decodeErr *MirrorDecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Index != len(mirrors)-1 ||
+		!errors.Is(err, io.ErrUnexpectedEOF) || calls != len(mirrors)-1 {
+		t.Errorf("DecodeEach truncated: got error %v after %d calls", err, calls)
+	}
+}
+
+// repeatReader reads data n times over.
+type repeatReader struct {
+	data []byte
+	n    int
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.off:])
+	r.off += n
+	if r.off == len(r.data) {
+		r.off = 0
+		r.n--
+	}
+	return n, nil
+}
+
+// TestDecodeEachMemory decodes a stream of 100000 mirrors, far larger than
+// the heap DecodeEach is allowed to grow by.
+func TestDecodeEachMemory(t *testing.T) {
+	const (
+		count   = 100000
+		ceiling = 8 << 20
+	)
+	data, err := newTestMirror(chainhash.Hash{}, 1, 100).ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	if len(data)*count < 4*ceiling {
+		t.Fatalf("stream of %d bytes too small for the test", len(data)*count)
+	}
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapAlloc, stats.HeapAlloc
+	decoded := 0
+	err = DecodeEach(&repeatReader{data: data, n: count}, func(index int, m *BtcLightMirrorV2) error {
+		decoded++
+		if index%10000 == 0 {
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+		}
+		return nil
+	})
+	if err != nil || decoded != count {
+		t.Fatalf("DecodeEach: got %d mirrors, error %v, want %d", decoded, err, count)
+	}
+	if peak > base && peak-base > ceiling {
+		t.Errorf("DecodeEach: heap grew by %d bytes, ceiling %d", peak-base, ceiling)
+	}
+}
+
+// BenchmarkMirrorDecoder compares decoding mirrors with Deserialize and with
+// a MirrorDecoder into a recycled mirror.
+func BenchmarkMirrorDecoder(b *testing.B) {
+	m := newTestMirror(chainhash.Hash{}, 1, 2000)
+	data, err := m.ToBytes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(nil)
+
+	b.Run("Deserialize", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			if err := new(BtcLightMirrorV2).Deserialize(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Decode", func(b *testing.B) {
+		var d MirrorDecoder
+		dst := new(BtcLightMirrorV2)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			if err := d.Decode(r, dst); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
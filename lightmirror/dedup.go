@@ -0,0 +1,172 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// flight is an upstream fetch shared by the callers asking for the same
+// block at the same time.
+type flight struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// forget removes the flight from its map, with the mutex of the
+	// DedupFetcher held.
+	forget func()
+
+	// waiters counts the callers waiting for the fetch, guarded by the
+	// mutex of the DedupFetcher.
+	waiters int
+
+	// mirror and err are set before done is closed.
+	mirror *BtcLightMirrorV2
+	err    error
+}
+
+// DedupFetcher is a Fetcher that shares one upstream call between the
+// concurrent requests for the same block hash, or for the same height.  A
+// request arriving while the call is in flight waits for its result instead
+// of making its own.
+//
+// The shared call does not run with the context of any caller: a caller
+// whose context is done stops waiting and returns the context error, and the
+// call is only cancelled once every caller waiting for it has gone.  Like
+// CachingFetcher, a DedupFetcher returns private copies of the mirrors.
+type DedupFetcher struct {
+	Fetcher
+
+	logger Logger
+	health *healthState
+
+	mtx      sync.Mutex
+	byHash   map[chainhash.Hash]*flight
+	byHeight map[int64]*flight
+}
+
+// NewDedupFetcher returns a DedupFetcher sharing the concurrent calls to f.
+func NewDedupFetcher(f Fetcher, opts ...FetcherOption) *DedupFetcher {
+	return &DedupFetcher{
+		Fetcher:  f,
+		logger:   newFetcherConfig(opts).logger,
+		health:   newHealthState(),
+		byHash:   make(map[chainhash.Hash]*flight),
+		byHeight: make(map[int64]*flight),
+	}
+}
+
+// FetchByHash returns the mirror of the block with the given hash, joining
+// the fetch of the block in flight if there is one.
+func (f *DedupFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	f.mtx.Lock()
+	fl, ok := f.byHash[hash]
+	if !ok {
+		fl = f.start(hash.String(), func(ctx context.Context) (*BtcLightMirrorV2, error) {
+			return f.Fetcher.FetchByHash(ctx, hash)
+		}, func() {
+			if f.byHash[hash] == fl {
+				delete(f.byHash, hash)
+			}
+		})
+		f.byHash[hash] = fl
+	}
+	fl.waiters++
+	f.mtx.Unlock()
+	return f.wait(ctx, fl)
+}
+
+// FetchByHeight returns the mirror of the block at the given height, joining
+// the fetch of the height in flight if there is one.
+func (f *DedupFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	f.mtx.Lock()
+	fl, ok := f.byHeight[height]
+	if !ok {
+		fl = f.start(heightBlock(height), func(ctx context.Context) (*BtcLightMirrorV2, error) {
+			return f.Fetcher.FetchByHeight(ctx, height)
+		}, func() {
+			if f.byHeight[height] == fl {
+				delete(f.byHeight, height)
+			}
+		})
+		f.byHeight[height] = fl
+	}
+	fl.waiters++
+	f.mtx.Unlock()
+	return f.wait(ctx, fl)
+}
+
+// start runs fetch of the block described by block in a new flight, which
+// forget removes from its map once it lands or is abandoned.  The mutex must
+// be held.
+func (f *DedupFetcher) start(block string, fetch func(context.Context) (*BtcLightMirrorV2, error), forget func()) *flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	fl := &flight{
+		done:   make(chan struct{}),
+		cancel: cancel,
+		forget: forget,
+	}
+	go func() {
+		start := time.Now()
+		m, err := fetch(ctx)
+		logFetch(f.logger, block, start, err)
+		f.health.fetched(err)
+		f.mtx.Lock()
+		fl.forget()
+		f.mtx.Unlock()
+
+		fl.mirror, fl.err = m, err
+		close(fl.done)
+		cancel()
+	}()
+	return fl
+}
+
+// wait returns a copy of the result of fl, or the error of ctx if it is done
+// first.  The last waiter leaving cancels the flight, which is forgotten at
+// once so that later requests start a new one.
+func (f *DedupFetcher) wait(ctx context.Context, fl *flight) (*BtcLightMirrorV2, error) {
+	select {
+	case <-fl.done:
+		if fl.err != nil {
+			return nil, fl.err
+		}
+		return fl.mirror.Clone(), nil
+
+	case <-ctx.Done():
+		f.mtx.Lock()
+		fl.waiters--
+		abandoned := fl.waiters == 0
+		if abandoned {
+			fl.forget()
+		}
+		f.mtx.Unlock()
+		if abandoned {
+			fl.cancel()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Ping pings the underlying fetcher if it can be pinged.
+func (f *DedupFetcher) Ping(ctx context.Context) error {
+	return pingFetcher(ctx, f.Fetcher)
+}
+
+// LastBlockAge returns the time elapsed since the last upstream fetch which
+// returned a block.
+func (f *DedupFetcher) LastBlockAge() time.Duration {
+	return f.health.LastBlockAge()
+}
+
+// LastError returns the last error of an upstream fetch, but ErrNotFound and
+// cancellations, and when it failed.
+func (f *DedupFetcher) LastError() (error, time.Time) {
+	return f.health.LastError()
+}
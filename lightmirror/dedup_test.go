@@ -0,0 +1,191 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// blockingFetcher serves mirrors from a countingFetcher once release is
+// closed, counting the upstream calls and those cancelled.
+type blockingFetcher struct {
+	upstream *countingFetcher
+	release  chan struct{}
+
+	calls     int32
+	cancelled int32
+	mtx       sync.Mutex
+}
+
+func (f *blockingFetcher) block(ctx context.Context) error {
+	atomic.AddInt32(&f.calls, 1)
+	select {
+	case <-f.release:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt32(&f.cancelled, 1)
+		return ctx.Err()
+	}
+}
+
+func (f *blockingFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	if err := f.block(ctx); err != nil {
+		return nil, err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.upstream.FetchByHash(ctx, hash)
+}
+
+func (f *blockingFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	if err := f.block(ctx); err != nil {
+		return nil, err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.upstream.FetchByHeight(ctx, height)
+}
+
+// waitForWaiters waits until n callers wait for the flight of hash.
+func waitForWaiters(t *testing.T, f *DedupFetcher, hash chainhash.Hash, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mtx.Lock()
+		waiters := 0
+		if fl, ok := f.byHash[hash]; ok {
+			waiters = fl.waiters
+		}
+		f.mtx.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d waiters, want %d", waiters, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupFetcher(t *testing.T) {
+	const n = 20
+	mirrors := newTestMirrors(3)
+	upstream := &blockingFetcher{
+		upstream: newCountingFetcher(mirrors),
+		release:  make(chan struct{}),
+	}
+	f := NewDedupFetcher(upstream)
+	hash := mirrors[1].BtcHeader.BlockHash()
+
+	results := make([]*BtcLightMirrorV2, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = f.FetchByHash(context.Background(), hash)
+		}(i)
+	}
+	waitForWaiters(t, f, hash, n)
+	close(upstream.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 1 {
+		t.Errorf("FetchByHash: got %d upstream calls, want 1", calls)
+	}
+	want := serializeMirror(t, mirrors[1])
+	for i := range results {
+		if errs[i] != nil {
+			t.Errorf("FetchByHash #%d error %v", i, errs[i])
+			continue
+		}
+		if !bytes.Equal(serializeMirror(t, results[i]), want) {
+			t.Errorf("FetchByHash #%d: got another mirror", i)
+		}
+		if i > 0 && results[i] == results[0] {
+			t.Errorf("FetchByHash #%d: got a shared mirror", i)
+		}
+	}
+
+	// The landed flight is forgotten: the next request goes upstream.
+	if _, err := f.FetchByHash(context.Background(), hash); err != nil {
+		t.Fatalf("FetchByHash error %v", err)
+	}
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 2 {
+		t.Errorf("FetchByHash: got %d upstream calls, want 2", calls)
+	}
+
+	// Errors are shared too.
+	if _, err := f.FetchByHeight(context.Background(), 7); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FetchByHeight: got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDedupFetcherCancel(t *testing.T) {
+	mirrors := newTestMirrors(2)
+	upstream := &blockingFetcher{
+		upstream: newCountingFetcher(mirrors),
+		release:  make(chan struct{}),
+	}
+	f := NewDedupFetcher(upstream)
+	hash := mirrors[1].BtcHeader.BlockHash()
+
+	// One caller cancelling leaves the flight to the other.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := f.FetchByHash(ctx, hash)
+		cancelled <- err
+	}()
+	waitForWaiters(t, f, hash, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.FetchByHash(context.Background(), hash)
+		done <- err
+	}()
+	waitForWaiters(t, f, hash, 2)
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("FetchByHash: got error %v, want %v", err, context.Canceled)
+	}
+	waitForWaiters(t, f, hash, 1)
+	close(upstream.release)
+	if err := <-done; err != nil {
+		t.Errorf("FetchByHash error %v", err)
+	}
+	if n := atomic.LoadInt32(&upstream.cancelled); n != 0 {
+		t.Errorf("FetchByHash: %d upstream calls cancelled, want 0", n)
+	}
+
+	// The last caller cancelling cancels the flight.
+	upstream.release = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := f.FetchByHash(ctx, hash)
+		cancelled <- err
+	}()
+	waitForWaiters(t, f, hash, 1)
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("FetchByHash: got error %v, want %v", err, context.Canceled)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&upstream.cancelled) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned upstream call was not cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
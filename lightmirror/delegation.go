@@ -0,0 +1,510 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// PowerPayloadV1 and PowerPayloadV3 are the versions of the power
+	// payload, the byte following powerMagicString.  Version 1 carries a
+	// single reward address, version 3 up to MaxWeightedRewards weighted
+	// ones.
+	PowerPayloadV1 = 0x01
+	PowerPayloadV3 = 0x03
+
+	// MaxWeightedRewards is the most reward entries a version 3 payload
+	// carries.
+	MaxWeightedRewards = 8
+
+	// weightedRewardSize is the size of a version 3 reward entry, the
+	// address and its big-endian weight.
+	weightedRewardSize = common.AddressLength + 2
+
+	// fieldActivationHeight is the type of the extension field of a
+	// version 3 payload holding its activation height, 4 bytes little
+	// endian.
+	fieldActivationHeight = 0x01
+)
+
+var (
+	// ErrWitnessStripped is returned when the power parameters of a
+	// coinbase may be carried in its witness, which was stripped.
+	ErrWitnessStripped = errors.New("coinbase witness stripped")
+
+	// ErrDelegationConflict is returned under RequireAgreement when the
+	// CORE output and the witness of a coinbase carry different power
+	// parameters.
+	ErrDelegationConflict = errors.New("conflicting power delegations")
+
+	// ErrInvalidRewards is returned by NewPowerPayload for reward entries
+	// a version 3 payload cannot carry.
+	ErrInvalidRewards = errors.New("invalid weighted rewards")
+)
+
+// DelegationSource tells where the power parameters of a coinbase come from.
+type DelegationSource int
+
+const (
+	// DelegationOutput is a CORE OP_RETURN output of the coinbase.
+	DelegationOutput DelegationSource = iota + 1
+
+	// DelegationWitness is a CORE item of the coinbase input witness,
+	// following the witness reserved value.
+	DelegationWitness
+)
+
+// String returns the name of the source.
+func (s DelegationSource) String() string {
+	switch s {
+	case DelegationOutput:
+		return "output"
+	case DelegationWitness:
+		return "witness"
+	}
+	return fmt.Sprintf("DelegationSource(%d)", int(s))
+}
+
+// DelegationPolicy sets which power parameters ParseDelegation returns when
+// a coinbase carries them both in an output and in its witness.
+type DelegationPolicy int
+
+const (
+	// PreferOutput returns the CORE output, as ParsePowerParams does.
+	PreferOutput DelegationPolicy = iota
+
+	// PreferWitness returns the CORE witness item.
+	PreferWitness
+
+	// RequireAgreement fails with ErrDelegationConflict unless both carry
+	// the same power parameters.
+	RequireAgreement
+)
+
+// DelegationOptions configures ParseDelegationWith.
+type DelegationOptions struct {
+	Policy DelegationPolicy
+
+	// MinimalPush only accepts the CORE outputs whose payload is pushed
+	// with the shortest framing of its length: a direct push up to 75
+	// bytes, then OP_PUSHDATA1, OP_PUSHDATA2 and OP_PUSHDATA4.  Otherwise
+	// any framing is accepted, and the push length of version 1 payloads
+	// is not checked.
+	MinimalPush bool
+
+	// Parser sets the magic tags of the payloads.  The zero value reads
+	// CORE payloads.
+	Parser ParserConfig
+}
+
+// WeightedReward is a reward address of a version 3 payload, receiving a
+// share of the rewards proportional to its weight.
+type WeightedReward struct {
+	Address common.Address
+	Weight  uint16
+}
+
+// Delegation holds the power parameters of a coinbase and their source.
+type Delegation struct {
+	Candidate common.Address
+
+	// Reward is the reward address of a version 1 payload, or the first
+	// of Rewards of a version 3 payload.
+	Reward common.Address
+
+	// Rewards are the reward addresses of a version 3 payload, sorted by
+	// address, or the single Reward of weight 1 of a version 1 payload.
+	Rewards []WeightedReward
+
+	CoreBlockHash common.Hash
+
+	// ActivationHeight is the Core height from which a version 3
+	// payload with HasActivationHeight takes effect.
+	ActivationHeight    uint32
+	HasActivationHeight bool
+
+	Version byte
+	Source  DelegationSource
+
+	// Tag is the magic tag the payload starts with.
+	Tag string
+}
+
+// EffectiveParams reports whether the delegation is in effect at the Core
+// height currentHeight: it has no activation height, or currentHeight is at
+// least its activation height.
+func (d *Delegation) EffectiveParams(currentHeight int64) bool {
+	return !d.HasActivationHeight || currentHeight >= int64(d.ActivationHeight)
+}
+
+// samePower reports whether d and other carry the same candidate, rewards,
+// Core block hash and activation height.
+func (d *Delegation) samePower(other *Delegation) bool {
+	if d.Candidate != other.Candidate || d.CoreBlockHash != other.CoreBlockHash ||
+		d.HasActivationHeight != other.HasActivationHeight ||
+		d.ActivationHeight != other.ActivationHeight ||
+		len(d.Rewards) != len(other.Rewards) {
+		return false
+	}
+	for i := range d.Rewards {
+		if d.Rewards[i] != other.Rewards[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PayloadOption configures NewPowerPayload.
+type PayloadOption func(*payloadConfig)
+
+type payloadConfig struct {
+	activationHeight    uint32
+	hasActivationHeight bool
+}
+
+// WithActivationHeight makes NewPowerPayload add the Core height from which
+// the delegation takes effect, so that a pool can announce it in advance.
+func WithActivationHeight(height uint32) PayloadOption {
+	return func(cfg *payloadConfig) {
+		cfg.activationHeight = height
+		cfg.hasActivationHeight = true
+	}
+}
+
+// NewPowerPayload returns the version 3 power payload of candidate, rewards
+// and coreBlockHash, for PowerScript or AddWitnessPayload.  coreBlockHash is
+// in its canonical form, as PowerParams.CoreBlockHash returns it.  The
+// entries are sorted by address, so that the payload does not depend on
+// their order.
+// It fails with ErrInvalidRewards if there are none or more than
+// MaxWeightedRewards, if an address repeats, or if the weights sum to zero.
+//
+// The optional fields set by the options follow the Core block hash as
+// extension fields, each a type byte, a length byte and the value.  Parsers
+// skip the fields of the types they do not know, and parsers older than the
+// extension fields ignore them altogether.
+func NewPowerPayload(candidate common.Address, rewards []WeightedReward, coreBlockHash common.Hash, opts ...PayloadOption) ([]byte, error) {
+	var cfg payloadConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(rewards) == 0 || len(rewards) > MaxWeightedRewards {
+		return nil, fmt.Errorf("%d reward entries, not 1 to %d: %w",
+			len(rewards), MaxWeightedRewards, ErrInvalidRewards)
+	}
+	sorted := append([]WeightedReward(nil), rewards...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Address[:], sorted[j].Address[:]) < 0
+	})
+	if err := checkWeightedRewards(sorted); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 0, len(powerMagicString)+1+common.AddressLength+1+
+		len(sorted)*weightedRewardSize+common.HashLength+2+4)
+	payload = append(payload, powerMagicString...)
+	payload = append(payload, PowerPayloadV3)
+	payload = append(payload, candidate[:]...)
+	payload = append(payload, byte(len(sorted)))
+	for _, r := range sorted {
+		payload = append(payload, r.Address[:]...)
+		payload = append(payload, byte(r.Weight>>8), byte(r.Weight))
+	}
+	payload = append(payload, coreBlockHash[:]...)
+	if cfg.hasActivationHeight {
+		payload = append(payload, fieldActivationHeight, 4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(payload[len(payload)-4:], cfg.activationHeight)
+	}
+	return payload, nil
+}
+
+// checkWeightedRewards checks the reward entries of a version 3 payload are
+// strictly sorted by address and their weights sum to a nonzero total.
+func checkWeightedRewards(rewards []WeightedReward) error {
+	var total uint32
+	for i, r := range rewards {
+		if i > 0 && bytes.Compare(rewards[i-1].Address[:], r.Address[:]) >= 0 {
+			return fmt.Errorf("reward %v repeated: %w", r.Address, ErrInvalidRewards)
+		}
+		total += uint32(r.Weight)
+	}
+	if total == 0 {
+		return fmt.Errorf("reward weights sum to zero: %w", ErrInvalidRewards)
+	}
+	return nil
+}
+
+// PowerScript returns the CORE output script carrying payload, OP_RETURN
+// followed by its push.
+func PowerScript(payload []byte) []byte {
+	return appendPush([]byte{txscript.OP_RETURN}, payload)
+}
+
+// AddWitnessDelegation appends the version 1 power payload of candidate,
+// reward and coreBlockHash to the witness of the input of coinbase, as
+// AddWitnessPayload does.  The item is the payload of a CORE output:
+// powerMagicString, the version byte, the candidate, the reward and the Core
+// block hash.  coreBlockHash is in its canonical form, see PowerParams; a
+// hash held as a chainhash.Hash is added through PowerParams.SetBtcStyleHash
+// and AddWitnessPayload.
+func AddWitnessDelegation(coinbase *wire.MsgTx, candidate, reward common.Address, coreBlockHash common.Hash) error {
+	p := PowerParams{Candidate: candidate, Reward: reward}
+	p.SetCoreBlockHash(coreBlockHash)
+	return AddWitnessPayload(coinbase, p.Payload())
+}
+
+// AddWitnessPayload appends a power payload to the witness of the input of
+// coinbase, after the witness reserved value of BIP 141, which the witness
+// must already hold.
+//
+// Bitcoin consensus requires the coinbase witness of a block with a witness
+// commitment to be the reserved value alone, so such blocks are only valid
+// on networks relaxing that rule.
+func AddWitnessPayload(coinbase *wire.MsgTx, payload []byte) error {
+	if len(coinbase.TxIn) != 1 || coinbase.TxIn[0] == nil {
+		return errors.New("coinbase does not have a single input")
+	}
+	txIn := coinbase.TxIn[0]
+	if len(txIn.Witness) == 0 || len(txIn.Witness[0]) != chainhash.HashSize {
+		return errors.New("coinbase witness has no witness reserved value")
+	}
+	txIn.Witness = append(txIn.Witness, payload)
+	return nil
+}
+
+// ParseDelegation returns the power parameters of the coinbase, from its
+// first CORE output following the first output or from the first CORE item
+// of its input witness following the reserved value, as policy chooses when
+// there are both.  It returns ErrNoPowerParams when there are none.  The
+// payloads of either version count alike: a version 3 payload following a
+// version 1 one in the outputs, or in the witness, is ignored.
+//
+// A coinbase with a witness commitment but no witness had it stripped, by a
+// serialization without witnesses.  ParseDelegation then fails with
+// ErrWitnessStripped unless its output is all policy needs: under
+// PreferOutput with a CORE output.
+func (light *BtcLightMirrorV2) ParseDelegation(policy DelegationPolicy) (*Delegation, error) {
+	return light.ParseDelegationWith(DelegationOptions{Policy: policy})
+}
+
+// ParseDelegationWith is ParseDelegation under opts.Policy, with the
+// parsing rules of opts.  The CORE outputs and witness items are then those
+// starting with a tag of opts.Parser.
+func (light *BtcLightMirrorV2) ParseDelegationWith(opts DelegationOptions) (*Delegation, error) {
+	policy := opts.Policy
+	output := light.outputDelegation(opts.Parser, opts.MinimalPush)
+	witness, stripped := light.witnessDelegation(opts.Parser)
+	if stripped && (output == nil || policy != PreferOutput) {
+		return nil, ErrWitnessStripped
+	}
+
+	switch {
+	case output == nil && witness == nil:
+		return nil, ErrNoPowerParams
+	case witness == nil:
+		return output, nil
+	case output == nil:
+		return witness, nil
+	}
+	switch policy {
+	case PreferWitness:
+		return witness, nil
+	case RequireAgreement:
+		if !output.samePower(witness) {
+			return nil, ErrDelegationConflict
+		}
+	}
+	return output, nil
+}
+
+// outputDelegation returns the power parameters of the first CORE output of
+// the coinbase following the first output, or nil if there is none.  With
+// minimalPush, the outputs whose payload is not minimally pushed do not
+// count.
+func (light *BtcLightMirrorV2) outputDelegation(parser ParserConfig, minimalPush bool) *Delegation {
+	tx := light.Coinbase()
+	if len(tx.TxOut) == 0 {
+		return nil
+	}
+	for _, txout := range tx.TxOut[1:] {
+		if txout == nil {
+			continue
+		}
+		if d := parser.parseScript(txout.PkScript, minimalPush); d != nil {
+			d.Source = DelegationOutput
+			return d
+		}
+	}
+	return nil
+}
+
+// witnessDelegation returns the power parameters of the first CORE item of
+// the coinbase witness following the reserved value, or nil if there is
+// none, and whether the witness was stripped.
+func (light *BtcLightMirrorV2) witnessDelegation(parser ParserConfig) (*Delegation, bool) {
+	tx := light.Coinbase()
+	if len(tx.TxIn) == 0 || tx.TxIn[0] == nil || len(tx.TxIn[0].Witness) == 0 {
+		return nil, witnessCommitmentIndex(tx) >= 0
+	}
+	for _, item := range tx.TxIn[0].Witness[1:] {
+		if d := parser.parsePayload(item); d != nil {
+			d.Source = DelegationWitness
+			return d, false
+		}
+	}
+	return nil, false
+}
+
+// parsePowerScript returns the power parameters of a CORE output script, or
+// nil if pkScript is not one.  The payload is the data of the push following
+// OP_RETURN, whatever its framing: a direct push, or OP_PUSHDATA1, 2 or 4.
+//
+// Unless minimalPush is set, the payload is first read the way version 1
+// payloads have always been, following the first two bytes whatever the
+// push opcode and its length.  With minimalPush, the push must tokenize and
+// use the shortest framing of its data, as the MINIMALDATA rule of Bitcoin
+// requires.
+func parsePowerScript(pkScript []byte, minimalPush bool) *Delegation {
+	return defaultParser.parseScript(pkScript, minimalPush)
+}
+
+// parseScript is parsePowerScript for the payloads of the tags of c.
+func (c ParserConfig) parseScript(pkScript []byte, minimalPush bool) *Delegation {
+	if len(pkScript) < 2 || pkScript[0] != txscript.OP_RETURN {
+		return nil
+	}
+	if !minimalPush {
+		if d := c.parsePayload(pkScript[2:]); d != nil {
+			return d
+		}
+	}
+	data, opcode, ok := powerPush(pkScript)
+	if !ok || minimalPush && opcode != pushOpcode(len(data)) {
+		return nil
+	}
+	return c.parsePayload(data)
+}
+
+// powerPush returns the data and the opcode of the push following the
+// OP_RETURN starting pkScript, with ok false if pkScript does not start
+// with OP_RETURN and a push of data which tokenizes.
+func powerPush(pkScript []byte) (data []byte, opcode byte, ok bool) {
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript)
+	if !tokenizer.Next() || tokenizer.Opcode() != txscript.OP_RETURN {
+		return nil, 0, false
+	}
+	if !tokenizer.Next() || tokenizer.Opcode() == txscript.OP_0 ||
+		tokenizer.Opcode() > txscript.OP_PUSHDATA4 {
+		return nil, 0, false
+	}
+	return tokenizer.Data(), tokenizer.Opcode(), true
+}
+
+// pushOpcode returns the opcode of the shortest push of n bytes of data, the
+// one appendPush uses.  Pushes of a single byte holding a small integer,
+// which MINIMALDATA requires to be OP_1 to OP_16, are not told apart: no
+// power payload is that short.
+func pushOpcode(n int) byte {
+	switch {
+	case n < txscript.OP_PUSHDATA1:
+		return byte(n)
+	case n <= 0xff:
+		return txscript.OP_PUSHDATA1
+	case n <= 0xffff:
+		return txscript.OP_PUSHDATA2
+	}
+	return txscript.OP_PUSHDATA4
+}
+
+// parsePowerPayload returns the power parameters of the payload of a CORE
+// output, pushed after OP_RETURN, or of a CORE witness item, or nil if
+// payload is not one.
+func parsePowerPayload(payload []byte) *Delegation {
+	return defaultParser.parsePayload(payload)
+}
+
+// parsePowerFields returns the power parameters of the fields of a payload
+// of the given version, those following its version byte, or nil if they
+// do not parse.  The Core block hash is optional, and zero when missing;
+// the extension fields of a version 3 payload follow it.  A version 3
+// payload whose rewards do not pass checkWeightedRewards does not parse.
+func parsePowerFields(version byte, fields []byte) *Delegation {
+	if len(fields) < common.AddressLength {
+		return nil
+	}
+	d := &Delegation{
+		Candidate: common.BytesToAddress(fields[:20]),
+		Version:   version,
+	}
+	var rest []byte
+	switch d.Version {
+	case PowerPayloadV1:
+		if len(fields) < 40 {
+			return nil
+		}
+		d.Reward = common.BytesToAddress(fields[20:40])
+		d.Rewards = []WeightedReward{{Address: d.Reward, Weight: 1}}
+		rest = fields[40:]
+	case PowerPayloadV3:
+		if len(fields) < 21 {
+			return nil
+		}
+		n := int(fields[20])
+		if n == 0 || n > MaxWeightedRewards || len(fields) < 21+n*weightedRewardSize {
+			return nil
+		}
+		d.Rewards = make([]WeightedReward, n)
+		for i := range d.Rewards {
+			entry := fields[21+i*weightedRewardSize:][:weightedRewardSize]
+			d.Rewards[i].Address = common.BytesToAddress(entry[:common.AddressLength])
+			d.Rewards[i].Weight = binary.BigEndian.Uint16(entry[common.AddressLength:])
+		}
+		if checkWeightedRewards(d.Rewards) != nil {
+			return nil
+		}
+		d.Reward = d.Rewards[0].Address
+		rest = fields[21+n*weightedRewardSize:]
+	default:
+		return nil
+	}
+	if len(rest) >= common.HashLength {
+		// The Core block hash is carried in the byte order Ethereum
+		// prints it in, so it is taken without the reversal of
+		// ToCommonHash.
+		copy(d.CoreBlockHash[:], rest[:common.HashLength])
+		if d.Version == PowerPayloadV3 {
+			d.parseFields(rest[common.HashLength:])
+		}
+	}
+	return d
+}
+
+// parseFields sets the extension fields of a version 3 payload from fields,
+// the bytes following its Core block hash.  The fields of unknown type or
+// length, and the fields repeating a type, are skipped, and the bytes left
+// past the last complete field are ignored.
+func (d *Delegation) parseFields(fields []byte) {
+	for len(fields) >= 2 && len(fields) >= 2+int(fields[1]) {
+		value := fields[2 : 2+int(fields[1])]
+		switch fields[0] {
+		case fieldActivationHeight:
+			if len(value) == 4 && !d.HasActivationHeight {
+				d.ActivationHeight = binary.LittleEndian.Uint32(value)
+				d.HasActivationHeight = true
+			}
+		}
+		fields = fields[2+len(value):]
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestAddWitnessDelegation(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f" +
+		"8091a2b3c4d5e6f708192a3b4c5d6e7f")
+
+	tests := []struct {
+		name    string
+		witness wire.TxWitness
+		valid   bool
+	}{
+		{"reserved value", wire.TxWitness{make([]byte, 32)}, true},
+		{"no witness", nil, false},
+		{"short reserved value", wire.TxWitness{make([]byte, 31)}, false},
+	}
+	for _, test := range tests {
+		coinbase := newTestMirror(chainhash.Hash{}, 1, 0).CoinBaseTx.Copy()
+		coinbase.TxIn[0].Witness = test.witness
+		err := AddWitnessDelegation(coinbase, candidate, reward, coreBlockHash)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("AddWitnessDelegation (%s): expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("AddWitnessDelegation (%s) error %v", test.name, err)
+		}
+
+		// The witness item is the payload of the CORE output.
+		witness := coinbase.TxIn[0].Witness
+		want := corePkScript(candidate, reward, coreBlockHash[:])[2:]
+		if len(witness) != 2 || !bytes.Equal(witness[1], want) {
+			t.Errorf("AddWitnessDelegation (%s): got witness %x, want item %x",
+				test.name, witness, want)
+		}
+	}
+}
+
+func TestParseDelegation(t *testing.T) {
+	output := &Delegation{
+		Candidate:     common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4"),
+		Reward:        common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2"),
+		CoreBlockHash: common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f"),
+		Version:       PowerPayloadV1,
+		Source:        DelegationOutput,
+		Tag:           "CORE",
+	}
+	output.Rewards = []WeightedReward{{output.Reward, 1}}
+	witness := &Delegation{
+		Candidate: common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db"),
+		Reward:    common.HexToAddress("0x78731D3Ca6b7E34aC0F824c42a7cC18A495cabaB"),
+		Version:   PowerPayloadV1,
+		Source:    DelegationWitness,
+		Tag:       "CORE",
+	}
+	witness.Rewards = []WeightedReward{{witness.Reward, 1}}
+	agreeing := *output
+	agreeing.Source = DelegationWitness
+	commitment := append(append([]byte(nil), witnessCommitmentHeader...), make([]byte, 32)...)
+
+	// newMirror returns a mirror whose coinbase has a CORE output for
+	// out, a witness commitment if segwit, and the witness reserved value
+	// followed by a CORE item for wit, if any.
+	newMirror := func(out, wit *Delegation, segwit bool) *BtcLightMirrorV2 {
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		tx := &m.CoinBaseTx
+		if out != nil {
+			tx.AddTxOut(wire.NewTxOut(0, corePkScript(out.Candidate, out.Reward,
+				out.CoreBlockHash[:])))
+		}
+		if segwit {
+			tx.AddTxOut(wire.NewTxOut(0, commitment))
+			tx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+		}
+		if wit != nil {
+			if err := AddWitnessDelegation(tx, wit.Candidate, wit.Reward, wit.CoreBlockHash); err != nil {
+				t.Fatalf("AddWitnessDelegation error %v", err)
+			}
+		}
+		return m
+	}
+	// stripped returns m with the witness of its coinbase stripped.
+	stripped := func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+		m.CoinBaseTx.TxIn[0].Witness = nil
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		m      *BtcLightMirrorV2
+		policy DelegationPolicy
+		want   *Delegation
+		err    error
+	}{
+		{"none", newMirror(nil, nil, false), PreferOutput, nil, ErrNoPowerParams},
+		{"segwit none", newMirror(nil, nil, true), RequireAgreement, nil, ErrNoPowerParams},
+		{"output", newMirror(output, nil, false), PreferWitness, output, nil},
+		{"witness", newMirror(nil, witness, true), PreferOutput, witness, nil},
+		{"both prefer output", newMirror(output, witness, true), PreferOutput, output, nil},
+		{"both prefer witness", newMirror(output, witness, true), PreferWitness, witness, nil},
+		{"both conflicting", newMirror(output, witness, true), RequireAgreement, nil, ErrDelegationConflict},
+		{"both agreeing", newMirror(output, &agreeing, true), RequireAgreement, output, nil},
+		{"stripped", stripped(newMirror(nil, witness, true)), PreferOutput, nil, ErrWitnessStripped},
+		{"stripped prefer output", stripped(newMirror(output, witness, true)), PreferOutput, output, nil},
+		{"stripped prefer witness", stripped(newMirror(output, witness, true)), PreferWitness, nil, ErrWitnessStripped},
+		{"stripped agreement", stripped(newMirror(output, witness, true)), RequireAgreement, nil, ErrWitnessStripped},
+	}
+	for _, test := range tests {
+		got, err := test.m.ParseDelegation(test.policy)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParseDelegation (%s): got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if test.want != nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseDelegation (%s): got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// ParsePowerParams and CommitmentHash fall back on the witness.
+	m := newMirror(nil, witness, true)
+	if candidate, reward, _ := m.ParsePowerParams(); candidate != witness.Candidate || reward != witness.Reward {
+		t.Errorf("ParsePowerParams: got %v %v, want %v %v", candidate, reward,
+			witness.Candidate, witness.Reward)
+	}
+	if _, err := m.CommitmentHash(); err != nil {
+		t.Errorf("CommitmentHash error %v", err)
+	}
+
+	// The witness item survives serialization.
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	var decoded BtcLightMirrorV2
+	if err := decoded.Deserialize(&buf); err != nil {
+		t.Fatalf("Deserialize error %v", err)
+	}
+	if got, err := decoded.ParseDelegation(PreferWitness); err != nil || !reflect.DeepEqual(got, witness) {
+		t.Errorf("ParseDelegation: got %+v, error %v after serialization", got, err)
+	}
+}
+
+func TestNewPowerPayload(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f" +
+		"8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	a := WeightedReward{common.Address{1}, 3}
+	b := WeightedReward{common.Address{2}, 0}
+	c := WeightedReward{common.Address{3}, 0xffff}
+	many := make([]WeightedReward, MaxWeightedRewards+1)
+	for i := range many {
+		many[i] = WeightedReward{common.Address{byte(i + 1)}, 1}
+	}
+
+	tests := []struct {
+		name    string
+		rewards []WeightedReward
+		want    []WeightedReward
+	}{
+		{"single", []WeightedReward{c}, []WeightedReward{c}},
+		{"sorted", []WeightedReward{a, b, c}, []WeightedReward{a, b, c}},
+		{"unsorted", []WeightedReward{c, a, b}, []WeightedReward{a, b, c}},
+		{"max", many[:MaxWeightedRewards], many[:MaxWeightedRewards]},
+		{"none", nil, nil},
+		{"too many", many, nil},
+		{"repeated", []WeightedReward{a, c, a}, nil},
+		{"zero weights", []WeightedReward{b}, nil},
+	}
+	for _, test := range tests {
+		payload, err := NewPowerPayload(candidate, test.rewards, coreBlockHash)
+		if test.want == nil {
+			if !errors.Is(err, ErrInvalidRewards) {
+				t.Errorf("NewPowerPayload (%s): got error %v, want %v", test.name,
+					err, ErrInvalidRewards)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewPowerPayload (%s) error %v", test.name, err)
+		}
+
+		// The payload parses back from an output and from the witness.
+		want := &Delegation{
+			Candidate:     candidate,
+			Reward:        test.want[0].Address,
+			Rewards:       test.want,
+			CoreBlockHash: coreBlockHash,
+			Version:       PowerPayloadV3,
+			Tag:           "CORE",
+		}
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, PowerScript(payload)))
+		want.Source = DelegationOutput
+		if got, err := m.ParseDelegation(PreferOutput); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseDelegation (%s): got %+v, error %v, want %+v", test.name,
+				got, err, want)
+		}
+		m = newTestMirror(chainhash.Hash{}, 1, 0)
+		m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+		if err := AddWitnessPayload(&m.CoinBaseTx, payload); err != nil {
+			t.Fatalf("AddWitnessPayload (%s) error %v", test.name, err)
+		}
+		want.Source = DelegationWitness
+		if got, err := m.ParseDelegation(PreferOutput); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseDelegation (%s): got %+v, error %v, want %+v", test.name,
+				got, err, want)
+		}
+	}
+}
+
+func TestParseDelegationVersions(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	v1 := corePkScript(candidate, reward, nil)
+	payload, err := NewPowerPayload(candidate, []WeightedReward{
+		{common.Address{1}, 1}, {common.Address{2}, 2},
+	}, common.Hash{})
+	if err != nil {
+		t.Fatalf("NewPowerPayload error %v", err)
+	}
+	v3 := PowerScript(payload)
+
+	// A payload with weights summing to zero is not a CORE payload.
+	zero := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint16(zero[26+common.AddressLength:], 0)
+	binary.BigEndian.PutUint16(zero[26+weightedRewardSize+common.AddressLength:], 0)
+
+	tests := []struct {
+		name    string
+		scripts [][]byte
+		version byte
+		err     error
+	}{
+		{"v1 then v3", [][]byte{v1, v3}, PowerPayloadV1, nil},
+		{"v3 then v1", [][]byte{v3, v1}, PowerPayloadV3, nil},
+		{"zero weights", [][]byte{PowerScript(zero)}, 0, ErrNoPowerParams},
+		{"zero weights then v1", [][]byte{PowerScript(zero), v1}, PowerPayloadV1, nil},
+	}
+	for _, test := range tests {
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		for _, script := range test.scripts {
+			m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, script))
+		}
+		got, err := m.ParseDelegation(PreferOutput)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParseDelegation (%s): got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && got.Version != test.version {
+			t.Errorf("ParseDelegation (%s): got version %d, want %d", test.name,
+				got.Version, test.version)
+		}
+	}
+
+	// A version 1 output and a version 3 witness item disagree.
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, v1))
+	m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	if err := AddWitnessPayload(&m.CoinBaseTx, payload); err != nil {
+		t.Fatalf("AddWitnessPayload error %v", err)
+	}
+	if got, err := m.ParseDelegation(PreferWitness); err != nil || got.Version != PowerPayloadV3 {
+		t.Errorf("ParseDelegation: got %+v, error %v, want version 3", got, err)
+	}
+	if _, err := m.ParseDelegation(RequireAgreement); !errors.Is(err, ErrDelegationConflict) {
+		t.Errorf("ParseDelegation: got error %v, want %v", err, ErrDelegationConflict)
+	}
+}
+
+func TestActivationHeight(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	rewards := []WeightedReward{{common.Address{1}, 1}, {common.Address{2}, 2}}
+	coreBlockHash := common.Hash{3}
+	base, err := NewPowerPayload(candidate, rewards, coreBlockHash)
+	if err != nil {
+		t.Fatalf("NewPowerPayload error %v", err)
+	}
+	activated, err := NewPowerPayload(candidate, rewards, coreBlockHash,
+		WithActivationHeight(1000))
+	if err != nil {
+		t.Fatalf("NewPowerPayload error %v", err)
+	}
+	activation := activated[len(base):]
+	if want := []byte{0x01, 0x04, 0xe8, 0x03, 0x00, 0x00}; !bytes.Equal(activation, want) {
+		t.Errorf("NewPowerPayload: got activation field %x, want %x", activation, want)
+	}
+
+	// unknown is a field of a type parsers do not know yet.
+	unknown := []byte{0x7f, 0x03, 0xaa, 0xbb, 0xcc}
+	fields := func(fields ...[]byte) []byte {
+		return append(append([]byte(nil), base...), bytes.Join(fields, nil)...)
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		height  uint32
+		has     bool
+	}{
+		{"none", base, 0, false},
+		{"activation", activated, 1000, true},
+		{"unknown then activation", fields(unknown, activation), 1000, true},
+		{"activation then unknown", fields(activation, unknown), 1000, true},
+		{"unknown", fields(unknown), 0, false},
+		{"repeated", fields(activation, []byte{0x01, 0x04, 0, 0, 0, 0}), 1000, true},
+		{"bad length", fields([]byte{0x01, 0x03, 0xe8, 0x03, 0x00}), 0, false},
+		{"truncated", fields([]byte{0x01, 0x04, 0xe8, 0x03}), 0, false},
+		{"after truncated", fields([]byte{0x7f, 0x09}, activation), 0, false},
+	}
+	want := parsePowerPayload(base)
+	if want == nil {
+		t.Fatalf("parsePowerPayload(%x): not a payload", base)
+	}
+	for _, test := range tests {
+		got := parsePowerPayload(test.payload)
+		if got == nil {
+			t.Errorf("parsePowerPayload (%s): not a payload", test.name)
+			continue
+		}
+		if got.ActivationHeight != test.height || got.HasActivationHeight != test.has {
+			t.Errorf("parsePowerPayload (%s): got activation height %d %v, want %d %v",
+				test.name, got.ActivationHeight, got.HasActivationHeight,
+				test.height, test.has)
+		}
+
+		// Apart from the activation height, the extension fields do
+		// not change the parameters, and a parser ignoring them reads
+		// the same payload.
+		got.ActivationHeight, got.HasActivationHeight = 0, false
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parsePowerPayload (%s): got %+v, want %+v", test.name, got, want)
+		}
+	}
+
+	// The fields of version 1 payloads are not read.
+	v1 := corePkScript(candidate, rewards[0].Address, coreBlockHash[:])[2:]
+	if d := parsePowerPayload(append(v1, activation...)); d == nil || d.HasActivationHeight {
+		t.Errorf("parsePowerPayload: got %+v for a version 1 payload", d)
+	}
+}
+
+func TestEffectiveParams(t *testing.T) {
+	tests := []struct {
+		d      Delegation
+		height int64
+		want   bool
+	}{
+		{Delegation{}, 0, true},
+		{Delegation{ActivationHeight: 1000}, 0, true},
+		{Delegation{ActivationHeight: 1000, HasActivationHeight: true}, 999, false},
+		{Delegation{ActivationHeight: 1000, HasActivationHeight: true}, 1000, true},
+		{Delegation{ActivationHeight: 1000, HasActivationHeight: true}, 1001, true},
+		{Delegation{ActivationHeight: 0xffffffff, HasActivationHeight: true}, 0xfffffffe, false},
+		{Delegation{HasActivationHeight: true}, -1, false},
+	}
+	for i, test := range tests {
+		if got := test.d.EffectiveParams(test.height); got != test.want {
+			t.Errorf("EffectiveParams #%d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+// framePush returns OP_RETURN followed by the push of payload with opcode,
+// a direct push or OP_PUSHDATA1, 2 or 4, whether or not it is minimal.
+func framePush(opcode byte, payload []byte) []byte {
+	script := []byte{txscript.OP_RETURN, opcode}
+	n := uint32(len(payload))
+	switch opcode {
+	case txscript.OP_PUSHDATA1:
+		script = append(script, byte(n))
+	case txscript.OP_PUSHDATA2:
+		script = append(script, byte(n), byte(n>>8))
+	case txscript.OP_PUSHDATA4:
+		script = append(script, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(script, payload...)
+}
+
+func TestParsePowerScriptFraming(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	extended, err := NewPowerPayload(candidate, []WeightedReward{
+		{common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2"), 3},
+		{common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db"), 1},
+	}, coreBlockHash, WithActivationHeight(1000))
+	if err != nil {
+		t.Fatalf("NewPowerPayload error %v", err)
+	}
+	legacy := corePkScript(candidate, common.Address{2}, coreBlockHash[:])
+
+	tests := []struct {
+		name    string
+		payload []byte
+		// scripts frame the payload in different ways, the minimal push
+		// first.
+		scripts [][]byte
+	}{
+		{"extended", extended, [][]byte{
+			framePush(txscript.OP_PUSHDATA1, extended),
+			framePush(txscript.OP_PUSHDATA2, extended),
+			framePush(txscript.OP_PUSHDATA4, extended),
+		}},
+		// The length byte of the legacy framing of a version 1 payload
+		// reads as OP_PUSHDATA2.
+		{"version 1", legacy[2:], [][]byte{
+			framePush(txscript.OP_PUSHDATA1, legacy[2:]),
+			framePush(txscript.OP_PUSHDATA4, legacy[2:]),
+			legacy,
+		}},
+	}
+	for _, test := range tests {
+		want := parsePowerPayload(test.payload)
+		if want == nil {
+			t.Fatalf("parsePowerPayload (%s): got nil", test.name)
+		}
+		want.Source = DelegationOutput
+		for i, script := range test.scripts {
+			m := &BtcLightMirrorV2{CoinBaseTx: wire.MsgTx{TxOut: []*wire.TxOut{
+				{}, {PkScript: script},
+			}}}
+			got, err := m.ParseDelegation(PreferOutput)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("ParseDelegation (%s #%d): got %+v, error %v, want %+v",
+					test.name, i, got, err, want)
+			}
+			if c, r, h := m.ParsePowerParams(); c != want.Candidate || r != want.Reward || h != want.CoreBlockHash {
+				t.Errorf("ParsePowerParams (%s #%d): got %v %v %v", test.name, i, c, r, h)
+			}
+
+			// Only the minimal push is accepted with minimal pushes.
+			got, err = m.ParseDelegationWith(DelegationOptions{MinimalPush: true})
+			if i == 0 && (err != nil || !reflect.DeepEqual(got, want)) {
+				t.Errorf("ParseDelegationWith (%s #%d): got %+v, error %v, want %+v",
+					test.name, i, got, err, want)
+			}
+			if i > 0 && !errors.Is(err, ErrNoPowerParams) {
+				t.Errorf("ParseDelegationWith (%s #%d): got error %v, want %v",
+					test.name, i, err, ErrNoPowerParams)
+			}
+		}
+	}
+
+	// A push running past the end of the script is no payload.
+	script := framePush(txscript.OP_PUSHDATA2, extended)
+	if d := parsePowerScript(script[:len(script)-1], false); d != nil {
+		t.Errorf("parsePowerScript of a truncated push: got %+v", d)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Placeholders DiffReport renders for missing values.
+const (
+	diffNil    = "<nil>"
+	diffAbsent = "<absent>"
+	diffEmpty  = "<empty>"
+)
+
+// DiffReport lists every field two mirrors, A and B, differ on, for telling
+// why two sources disagree about a block.  Each difference holds in This the
+// value of the field in A and in Other its value in B, rendered for reading:
+// hashes in display order, timestamps in RFC 3339 in UTC, scripts and
+// witness items in hex, and the coinbase inputs and outputs field by field
+// at each index.
+//
+// Mirrors are compared by the rules of Equal:
+//
+//   - nil and empty slices are equal, be they merkle nodes, scripts,
+//     witnesses or the inputs or outputs of the coinbase;
+//   - timestamps are compared to the second, whatever their location;
+//   - the raw coinbase kept by RetainRawCoinbase is not compared, the
+//     coinbase it decodes to is.
+//
+// Beyond them, an input or output or merkle node on one side only is
+// reported at its index, the other side being <absent>, rather than as a
+// count.  The witness of a coinbase is a field of its own: a coinbase with
+// a witness and the same one stripped of it differ on the witness of each
+// input alone, and WitnessOnly is set, for the coinbases have the same txid
+// and the mirrors prove the same block.
+type DiffReport struct {
+	// A and B are the hashes of the blocks of the mirrors, zero for a nil
+	// mirror.
+	A, B chainhash.Hash
+
+	Fields []FieldDifference
+
+	// WitnessOnly is set when the mirrors differ on coinbase witnesses
+	// alone.
+	WitnessOnly bool
+}
+
+// Diff returns the report of the fields the mirrors a and b differ on.
+// Either may be nil.
+func Diff(a, b *BtcLightMirrorV2) DiffReport {
+	var r DiffReport
+	if a != nil {
+		r.A = a.BtcHeader.BlockHash()
+	}
+	if b != nil {
+		r.B = b.BtcHeader.BlockHash()
+	}
+	d := &differ{r: &r}
+	switch {
+	case a == nil && b == nil:
+	case a == nil || b == nil:
+		d.add("mirror", diffMirror(a, r.A), diffMirror(b, r.B))
+	default:
+		d.header(&a.BtcHeader, &b.BtcHeader)
+		d.coinbase(a.Coinbase(), b.Coinbase())
+		for i := 0; i < len(a.MerkleNodes) || i < len(b.MerkleNodes); i++ {
+			x, y := diffAbsent, diffAbsent
+			if i < len(a.MerkleNodes) {
+				x = a.MerkleNodes[i].String()
+			}
+			if i < len(b.MerkleNodes) {
+				y = b.MerkleNodes[i].String()
+			}
+			d.check(x == y, fmt.Sprintf("MerkleNodes[%d]", i), x, y)
+		}
+	}
+	r.WitnessOnly = len(r.Fields) > 0
+	for _, f := range r.Fields {
+		if !strings.HasSuffix(f.Field, ".Witness") {
+			r.WitnessOnly = false
+		}
+	}
+	return r
+}
+
+// Equal returns whether the report has no differences.
+func (r DiffReport) Equal() bool {
+	return len(r.Fields) == 0
+}
+
+// String returns the report on a line per difference.
+func (r DiffReport) String() string {
+	var b strings.Builder
+	if r.Equal() {
+		fmt.Fprintf(&b, "mirrors of %v and %v are equal", r.A, r.B)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "mirrors of %v and %v differ on %d fields", r.A, r.B, len(r.Fields))
+	if r.WitnessOnly {
+		b.WriteString(", coinbase witnesses only")
+	}
+	b.WriteString(":")
+	for _, f := range r.Fields {
+		fmt.Fprintf(&b, "\n  %v", f)
+	}
+	return b.String()
+}
+
+// diffFieldJSON is the JSON form of a FieldDifference in a DiffReport.
+type diffFieldJSON struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// diffReportJSON is the JSON form of a DiffReport.
+type diffReportJSON struct {
+	A           string          `json:"a"`
+	B           string          `json:"b"`
+	Equal       bool            `json:"equal"`
+	WitnessOnly bool            `json:"witnessOnly"`
+	Fields      []diffFieldJSON `json:"fields"`
+}
+
+// MarshalJSON encodes the report as an object with the hashes of the blocks,
+// in display order, whether the mirrors are equal or differ on witnesses
+// only, and the list of the differing fields with the values of each side.
+func (r DiffReport) MarshalJSON() ([]byte, error) {
+	v := diffReportJSON{
+		A:           r.A.String(),
+		B:           r.B.String(),
+		Equal:       r.Equal(),
+		WitnessOnly: r.WitnessOnly,
+		Fields:      make([]diffFieldJSON, len(r.Fields)),
+	}
+	for i, f := range r.Fields {
+		v.Fields[i] = diffFieldJSON{Field: f.Field, A: f.This, B: f.Other}
+	}
+	return json.Marshal(v)
+}
+
+// differ collects the differences of two mirrors into a report.
+type differ struct {
+	r *DiffReport
+}
+
+func (d *differ) add(field, a, b string) {
+	d.r.Fields = append(d.r.Fields, FieldDifference{Field: field, This: a, Other: b})
+}
+
+// check adds the difference on field unless same.
+func (d *differ) check(same bool, field, a, b string) {
+	if !same {
+		d.add(field, a, b)
+	}
+}
+
+func (d *differ) header(a, b *wire.BlockHeader) {
+	d.check(a.Version == b.Version, "BtcHeader.Version", diffVersion(a.Version),
+		diffVersion(b.Version))
+	d.check(a.PrevBlock == b.PrevBlock, "BtcHeader.PrevBlock", a.PrevBlock.String(),
+		b.PrevBlock.String())
+	d.check(a.MerkleRoot == b.MerkleRoot, "BtcHeader.MerkleRoot", a.MerkleRoot.String(),
+		b.MerkleRoot.String())
+	d.check(a.Timestamp.Unix() == b.Timestamp.Unix(), "BtcHeader.Timestamp",
+		diffTime(a.Timestamp), diffTime(b.Timestamp))
+	d.check(a.Bits == b.Bits, "BtcHeader.Bits", fmt.Sprintf("%08x", a.Bits),
+		fmt.Sprintf("%08x", b.Bits))
+	d.check(a.Nonce == b.Nonce, "BtcHeader.Nonce", fmt.Sprint(a.Nonce), fmt.Sprint(b.Nonce))
+}
+
+func (d *differ) coinbase(a, b *wire.MsgTx) {
+	d.check(a.Version == b.Version, "CoinBaseTx.Version", fmt.Sprint(a.Version),
+		fmt.Sprint(b.Version))
+	for i := 0; i < len(a.TxIn) || i < len(b.TxIn); i++ {
+		field := fmt.Sprintf("CoinBaseTx.TxIn[%d]", i)
+		if i >= len(a.TxIn) || i >= len(b.TxIn) || a.TxIn[i] == nil || b.TxIn[i] == nil {
+			x, y := diffAbsent, diffAbsent
+			if i < len(a.TxIn) {
+				x = diffTxIn(a.TxIn[i])
+			}
+			if i < len(b.TxIn) {
+				y = diffTxIn(b.TxIn[i])
+			}
+			d.check(x == y, field, x, y)
+			continue
+		}
+		x, y := a.TxIn[i], b.TxIn[i]
+		d.check(x.PreviousOutPoint == y.PreviousOutPoint, field+".PreviousOutPoint",
+			x.PreviousOutPoint.String(), y.PreviousOutPoint.String())
+		d.check(bytes.Equal(x.SignatureScript, y.SignatureScript), field+".SignatureScript",
+			diffScript(x.SignatureScript), diffScript(y.SignatureScript))
+		d.check(x.Sequence == y.Sequence, field+".Sequence", diffSequence(x.Sequence),
+			diffSequence(y.Sequence))
+		wx, wy := diffWitness(x.Witness), diffWitness(y.Witness)
+		d.check(wx == wy, field+".Witness", wx, wy)
+	}
+	for i := 0; i < len(a.TxOut) || i < len(b.TxOut); i++ {
+		field := fmt.Sprintf("CoinBaseTx.TxOut[%d]", i)
+		if i >= len(a.TxOut) || i >= len(b.TxOut) || a.TxOut[i] == nil || b.TxOut[i] == nil {
+			x, y := diffAbsent, diffAbsent
+			if i < len(a.TxOut) {
+				x = diffTxOut(a.TxOut[i])
+			}
+			if i < len(b.TxOut) {
+				y = diffTxOut(b.TxOut[i])
+			}
+			d.check(x == y, field, x, y)
+			continue
+		}
+		x, y := a.TxOut[i], b.TxOut[i]
+		d.check(x.Value == y.Value, field+".Value", fmt.Sprint(x.Value), fmt.Sprint(y.Value))
+		d.check(bytes.Equal(x.PkScript, y.PkScript), field+".PkScript",
+			diffScript(x.PkScript), diffScript(y.PkScript))
+	}
+	d.check(a.LockTime == b.LockTime, "CoinBaseTx.LockTime", fmt.Sprint(a.LockTime),
+		fmt.Sprint(b.LockTime))
+}
+
+func diffMirror(m *BtcLightMirrorV2, hash chainhash.Hash) string {
+	if m == nil {
+		return diffNil
+	}
+	return hash.String()
+}
+
+func diffVersion(v int32) string {
+	return fmt.Sprintf("0x%08x", uint32(v))
+}
+
+func diffTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func diffSequence(s uint32) string {
+	return fmt.Sprintf("0x%08x", s)
+}
+
+func diffScript(script []byte) string {
+	if len(script) == 0 {
+		return diffEmpty
+	}
+	return hex.EncodeToString(script)
+}
+
+// diffWitness renders the items of a witness in hex, in brackets.
+func diffWitness(w wire.TxWitness) string {
+	items := make([]string, len(w))
+	for i, item := range w {
+		items[i] = hex.EncodeToString(item)
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+func diffTxIn(in *wire.TxIn) string {
+	if in == nil {
+		return diffNil
+	}
+	return fmt.Sprintf("outpoint %v, script %s, sequence %s, witness %s",
+		in.PreviousOutPoint, diffScript(in.SignatureScript), diffSequence(in.Sequence),
+		diffWitness(in.Witness))
+}
+
+func diffTxOut(out *wire.TxOut) string {
+	if out == nil {
+		return diffNil
+	}
+	return fmt.Sprintf("value %d, script %s", out.Value, diffScript(out.PkScript))
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestDiff(t *testing.T) {
+	base := newTestMirror(chainhash.Hash{}, 1, 5)
+	base.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+
+	tests := []struct {
+		name   string
+		modify func(m *BtcLightMirrorV2)
+		want   []FieldDifference
+	}{
+		{"same", func(m *BtcLightMirrorV2) {}, nil},
+		{"timestamp location", func(m *BtcLightMirrorV2) {
+			m.BtcHeader.Timestamp = m.BtcHeader.Timestamp.In(time.FixedZone("", 3600))
+		}, nil},
+		{"raw coinbase", func(m *BtcLightMirrorV2) {
+			m.rawCoinbase = []byte{1, 2, 3}
+		}, nil},
+		{"timestamp", func(m *BtcLightMirrorV2) {
+			m.BtcHeader.Timestamp = time.Unix(1600000000, 0)
+		}, []FieldDifference{{"BtcHeader.Timestamp",
+			base.BtcHeader.Timestamp.UTC().Format(time.RFC3339), "2020-09-13T12:26:40Z"}}},
+		{"prev block", func(m *BtcLightMirrorV2) {
+			m.BtcHeader.PrevBlock[0] = 1
+			m.BtcHeader.Bits = 0x1d00ffff
+		}, []FieldDifference{
+			{"BtcHeader.PrevBlock", chainhash.Hash{}.String(),
+				"0000000000000000000000000000000000000000000000000000000000000001"},
+			{"BtcHeader.Bits", "207fffff", "1d00ffff"},
+		}},
+		{"pk script", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxOut[0].PkScript = []byte{0x51, 0x52}
+		}, []FieldDifference{{"CoinBaseTx.TxOut[0].PkScript",
+			diffScript(base.CoinBaseTx.TxOut[0].PkScript), "5152"}}},
+		{"extra output", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut, &wire.TxOut{Value: 7})
+		}, []FieldDifference{{"CoinBaseTx.TxOut[1]", "<absent>", "value 7, script <empty>"}}},
+		{"input fields", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxIn[0].Sequence = 1
+			m.CoinBaseTx.TxIn[0].SignatureScript = nil
+		}, []FieldDifference{
+			{"CoinBaseTx.TxIn[0].SignatureScript",
+				diffScript(base.CoinBaseTx.TxIn[0].SignatureScript), "<empty>"},
+			{"CoinBaseTx.TxIn[0].Sequence", "0xffffffff", "0x00000001"},
+		}},
+		{"merkle node", func(m *BtcLightMirrorV2) {
+			m.MerkleNodes = m.MerkleNodes[:2]
+		}, []FieldDifference{{"MerkleNodes[2]", base.MerkleNodes[2].String(), "<absent>"}}},
+	}
+	for _, test := range tests {
+		other := base.Clone()
+		test.modify(other)
+		r := Diff(base, other)
+		if r.A != base.BtcHeader.BlockHash() || r.B != other.BtcHeader.BlockHash() {
+			t.Errorf("Diff (%s): got the hashes %v and %v", test.name, r.A, r.B)
+		}
+		if r.Equal() != (len(test.want) == 0) || r.WitnessOnly {
+			t.Errorf("Diff (%s): got %v", test.name, r)
+		}
+		if len(r.Fields) != len(test.want) {
+			t.Errorf("Diff (%s): got %v, want %v", test.name, r.Fields, test.want)
+			continue
+		}
+		for i, f := range r.Fields {
+			if f != test.want[i] {
+				t.Errorf("Diff (%s) #%d: got %q, want %q", test.name, i, f, test.want[i])
+			}
+		}
+	}
+}
+
+func TestDiffEmpty(t *testing.T) {
+	// Nil and empty slices are equal.
+	empty := &BtcLightMirrorV2{
+		CoinBaseTx: wire.MsgTx{
+			TxIn:  []*wire.TxIn{{SignatureScript: []byte{}, Witness: wire.TxWitness{}}},
+			TxOut: []*wire.TxOut{},
+		},
+		MerkleNodes: []chainhash.Hash{},
+	}
+	zero := &BtcLightMirrorV2{
+		CoinBaseTx: wire.MsgTx{TxIn: []*wire.TxIn{{}}},
+	}
+	if r := Diff(empty, zero); !r.Equal() {
+		t.Errorf("Diff: got %v", r)
+	}
+
+	if r := Diff(nil, nil); !r.Equal() {
+		t.Errorf("Diff of nil mirrors: got %v", r)
+	}
+	r := Diff(zero, nil)
+	want := FieldDifference{"mirror", zero.BtcHeader.BlockHash().String(), "<nil>"}
+	if len(r.Fields) != 1 || r.Fields[0] != want || r.B != (chainhash.Hash{}) {
+		t.Errorf("Diff with a nil mirror: got %v, want %v", r, want)
+	}
+}
+
+func TestDiffWitness(t *testing.T) {
+	// A coinbase stripped of its witness has the same txid, and differs on
+	// the witness alone.
+	stripped := newTestMirror(chainhash.Hash{}, 1, 5)
+	witness := stripped.Clone()
+	witness.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{{0xab}, {}}
+	if stripped.CoinBaseTx.TxHash() != witness.CoinBaseTx.TxHash() {
+		t.Fatalf("TxHash: the witness changes the txid")
+	}
+
+	r := Diff(stripped, witness)
+	want := FieldDifference{"CoinBaseTx.TxIn[0].Witness", "[]", "[ab ]"}
+	if !r.WitnessOnly || len(r.Fields) != 1 || r.Fields[0] != want {
+		t.Errorf("Diff: got %v, want %v", r, want)
+	}
+	if stripped.Equal(witness) {
+		t.Errorf("Equal: got equal mirrors")
+	}
+
+	// Any other difference clears WitnessOnly.
+	witness.CoinBaseTx.LockTime = 1
+	if r := Diff(stripped, witness); r.WitnessOnly || len(r.Fields) != 2 {
+		t.Errorf("Diff: got %v", r)
+	}
+}
+
+func TestDiffReportString(t *testing.T) {
+	a := newTestMirror(chainhash.Hash{}, 1, 5)
+	b := a.Clone()
+	if s := Diff(a, b).String(); !strings.HasSuffix(s, " are equal") {
+		t.Errorf("String: got %q", s)
+	}
+
+	b.BtcHeader.Nonce++
+	b.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{{1}}
+	r := Diff(a, b)
+	lines := strings.Split(r.String(), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "differ on 2 fields") ||
+		lines[1] != "  "+r.Fields[0].String() || lines[2] != "  "+r.Fields[1].String() {
+		t.Errorf("String: got %q", r.String())
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("MarshalJSON error %v", err)
+	}
+	var got struct {
+		A, B        string
+		Equal       bool
+		WitnessOnly bool
+		Fields      []struct{ Field, A, B string }
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal error %v", err)
+	}
+	if got.A != r.A.String() || got.B != r.B.String() || got.Equal || got.WitnessOnly ||
+		len(got.Fields) != 2 || got.Fields[1].Field != "CoinBaseTx.TxIn[0].Witness" ||
+		got.Fields[1].A != "[]" || got.Fields[1].B != "[01]" {
+		t.Errorf("MarshalJSON: got %s", data)
+	}
+}
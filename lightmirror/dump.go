@@ -0,0 +1,321 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// DumpAnnotated writes to w a line per field of the mirror serialized in
+// data: its offset and length in bytes, its name, its raw bytes in hex and
+// its decoded value.  Lines starting with "!!" mark where data does not
+// decode.  The dump goes on past a field it can read but which is invalid,
+// such as a non-canonical varint or too many merkle nodes, and stops at the
+// first field cut short by the end of data.  Bytes left after the mirror are
+// dumped as trailing; the mirror decoders ignore them.
+//
+// It returns the first error writing to w, or else the error decoding data,
+// which is nil for a mirror Deserialize accepts.
+func DumpAnnotated(w io.Writer, data []byte) error {
+	d := &dumper{w: w, data: data}
+	d.dump()
+	if d.writeErr != nil {
+		return d.writeErr
+	}
+	return d.fail
+}
+
+// dumper walks a serialized mirror, writing the fields to w.
+type dumper struct {
+	w    io.Writer
+	data []byte
+	off  int
+
+	// fail is the first decoding failure, writeErr the first error
+	// writing to w.
+	fail     error
+	writeErr error
+}
+
+func (d *dumper) printf(format string, args ...interface{}) {
+	if d.writeErr == nil {
+		_, d.writeErr = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// mark writes and records a decoding failure of the field at offset off.
+func (d *dumper) mark(off int, format string, args ...interface{}) {
+	err := fmt.Errorf("offset %d: "+format, append([]interface{}{off}, args...)...)
+	d.printf("!! %v\n", err)
+	if d.fail == nil {
+		d.fail = err
+	}
+}
+
+// field consumes the next n bytes of data as the field name, written along
+// with value(bytes).  It returns false, having marked the failure, if data
+// ends before the field does.
+func (d *dumper) field(name string, n int, value func(b []byte) string) ([]byte, bool) {
+	if len(d.data)-d.off < n {
+		d.truncated(name, uint64(n))
+		return nil, false
+	}
+	b := d.data[d.off : d.off+n]
+	d.line(name, b, value(b))
+	d.off += n
+	return b, true
+}
+
+// truncated writes what is left of data as the field name of n bytes, and
+// marks it truncated.
+func (d *dumper) truncated(name string, n uint64) {
+	left := d.data[d.off:]
+	d.line(name, left, "")
+	d.mark(d.off, "%s truncated: got %d of %d bytes", name, len(left), n)
+	d.off = len(d.data)
+}
+
+// line writes the line of the field name whose bytes b start at the current
+// offset.
+func (d *dumper) line(name string, b []byte, value string) {
+	raw := hex.EncodeToString(b)
+	if raw == "" {
+		raw = "-"
+	}
+	if value != "" {
+		raw += " = " + value
+	}
+	d.printf("%6d %6d  %-36s %s\n", d.off, len(b), name, raw)
+}
+
+func (d *dumper) uint32(name string, value func(v uint32) string) (uint32, bool) {
+	var v uint32
+	_, ok := d.field(name, 4, func(b []byte) string {
+		v = binary.LittleEndian.Uint32(b)
+		return value(v)
+	})
+	return v, ok
+}
+
+func (d *dumper) hash(name string) bool {
+	_, ok := d.field(name, chainhash.HashSize, func(b []byte) string {
+		var hash chainhash.Hash
+		copy(hash[:], b)
+		return hash.String()
+	})
+	return ok
+}
+
+// varint consumes a varint, marking it if it is not canonical, as the
+// decoders reject it.  The value is written as describe(v), or as is if
+// describe is nil.
+func (d *dumper) varint(name string, describe func(v uint64) string) (uint64, bool) {
+	if d.off >= len(d.data) {
+		_, ok := d.field(name, 1, nil)
+		return 0, ok
+	}
+	n, min := 1, uint64(0)
+	switch d.data[d.off] {
+	case 0xfd:
+		n, min = 3, 0xfd
+	case 0xfe:
+		n, min = 5, 0x10000
+	case 0xff:
+		n, min = 9, 0x100000000
+	}
+	var v uint64
+	start := d.off
+	_, ok := d.field(name, n, func(b []byte) string {
+		switch n {
+		case 1:
+			v = uint64(b[0])
+		case 3:
+			v = uint64(binary.LittleEndian.Uint16(b[1:]))
+		case 5:
+			v = uint64(binary.LittleEndian.Uint32(b[1:]))
+		default:
+			v = binary.LittleEndian.Uint64(b[1:])
+		}
+		if describe != nil {
+			return describe(v)
+		}
+		return fmt.Sprint(v)
+	})
+	if ok && v < min {
+		d.mark(start, "%s is a non-canonical varint", name)
+	}
+	return v, ok
+}
+
+// bytes consumes a varint length followed by that many bytes.
+func (d *dumper) bytes(name string) bool {
+	n, ok := d.varint(name+" length", nil)
+	if !ok {
+		return false
+	}
+	if n > uint64(len(d.data)-d.off) {
+		d.truncated(name, n)
+		return false
+	}
+	_, ok = d.field(name, int(n), func([]byte) string { return "" })
+	return ok
+}
+
+// count consumes a varint count of items, which must not exceed max.
+func (d *dumper) count(name string, max uint64) (uint64, bool) {
+	start := d.off
+	n, ok := d.varint(name, nil)
+	if ok && n > max {
+		d.mark(start, "%s %d is over the maximum of %d", name, n, max)
+		return n, false
+	}
+	return n, ok
+}
+
+func (d *dumper) dump() {
+	if !d.header() || !d.coinbase() {
+		return
+	}
+	start := d.off
+	count, ok := d.varint("merkle node count", func(v uint64) string {
+		if v > maxMerkleNode {
+			return fmt.Sprint(v)
+		}
+		return fmt.Sprintf("%d (transaction count %s)", v, txCountRange(int(v)))
+	})
+	if !ok {
+		return
+	}
+	if count > maxMerkleNode {
+		d.mark(start, "merkle node count %d is over the maximum of %d", count,
+			maxMerkleNode)
+	}
+	for i := uint64(0); i < count; i++ {
+		if !d.hash(fmt.Sprintf("merkle node[%d]", i)) {
+			return
+		}
+	}
+
+	end := d.off
+	if d.off < len(d.data) {
+		d.field("trailing", len(d.data)-d.off, func([]byte) string { return "" })
+	}
+	if d.fail == nil {
+		// The walk found nothing wrong with the encoding, which leaves
+		// the checks of the decoder on the values.
+		var m BtcLightMirrorV2
+		if err := m.Deserialize(bytes.NewReader(d.data[:end])); err != nil {
+			d.printf("!! %v\n", err)
+			d.fail = err
+		}
+	}
+}
+
+func (d *dumper) header() bool {
+	_, ok := d.uint32("header.version", func(v uint32) string {
+		return fmt.Sprint(int32(v))
+	})
+	ok = ok && d.hash("header.prev block") && d.hash("header.merkle root")
+	if !ok {
+		return false
+	}
+	_, ok = d.uint32("header.timestamp", func(v uint32) string {
+		return time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+	})
+	if !ok {
+		return false
+	}
+	_, ok = d.uint32("header.bits", func(v uint32) string {
+		return fmt.Sprintf("%08x (difficulty %s)", v, difficulty(v))
+	})
+	if !ok {
+		return false
+	}
+	_, ok = d.uint32("header.nonce", func(v uint32) string {
+		return fmt.Sprint(v)
+	})
+	return ok
+}
+
+func (d *dumper) coinbase() bool {
+	_, ok := d.uint32("coinbase.version", func(v uint32) string {
+		return fmt.Sprint(int32(v))
+	})
+	if !ok {
+		return false
+	}
+
+	witness := false
+	if d.off+1 < len(d.data) && d.data[d.off] == wire.TxFlagMarker {
+		b, _ := d.field("coinbase.witness marker", 2, func(b []byte) string {
+			return fmt.Sprintf("flag %d", b[1])
+		})
+		if wire.TxFlag(b[1]) != wire.WitnessFlag {
+			d.mark(d.off-2, "coinbase.witness marker has flag %d, not %d",
+				b[1], wire.WitnessFlag)
+		}
+		witness = true
+	}
+
+	txIns, ok := d.count("coinbase.input count", maxDecodeTxIn)
+	if !ok {
+		return false
+	}
+	for i := uint64(0); i < txIns; i++ {
+		name := fmt.Sprintf("coinbase.input[%d]", i)
+		ok := d.hash(name + ".prev hash")
+		ok = ok && d.uint32Value(name+".prev index")
+		ok = ok && d.bytes(name+".script")
+		ok = ok && d.uint32Value(name+".sequence")
+		if !ok {
+			return false
+		}
+	}
+
+	txOuts, ok := d.count("coinbase.output count", maxDecodeTxOut)
+	if !ok {
+		return false
+	}
+	for i := uint64(0); i < txOuts; i++ {
+		name := fmt.Sprintf("coinbase.output[%d]", i)
+		_, ok := d.field(name+".value", 8, func(b []byte) string {
+			return fmt.Sprint(int64(binary.LittleEndian.Uint64(b)))
+		})
+		if !ok || !d.bytes(name+".pk script") {
+			return false
+		}
+	}
+
+	if witness {
+		for i := uint64(0); i < txIns; i++ {
+			name := fmt.Sprintf("coinbase.input[%d].witness", i)
+			items, ok := d.count(name+" count", maxDecodeWitnessItems)
+			if !ok {
+				return false
+			}
+			for j := uint64(0); j < items; j++ {
+				if !d.bytes(fmt.Sprintf("%s[%d]", name, j)) {
+					return false
+				}
+			}
+		}
+	}
+	return d.uint32Value("coinbase.lock time")
+}
+
+func (d *dumper) uint32Value(name string) bool {
+	_, ok := d.uint32(name, func(v uint32) string {
+		return fmt.Sprint(v)
+	})
+	return ok
+}
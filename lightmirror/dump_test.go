@@ -0,0 +1,185 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// dumpMirror returns the serialization of a mirror with a witness and a
+// single merkle node, which dumpGolden is the dump of.
+func dumpMirror(t *testing.T) (*BtcLightMirrorV2, []byte) {
+	t.Helper()
+	m := newTestMirror(chainhash.Hash{}, 1, 1)
+	m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{{1, 2}}
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	return m, data
+}
+
+const dumpGolden = `     0      4  header.version                       01000000 = 1
+     4     32  header.prev block                    0000000000000000000000000000000000000000000000000000000000000000 = 0000000000000000000000000000000000000000000000000000000000000000
+    36     32  header.merkle root                   a7b40acfc7ea7c89d334ac78cedb233e8bbfc5ef9f8d9f122f6bb7a01824f51b = 1bf52418a0b76b2f129f8d9fefc5bf8b3e23dbce78ac34d3897ceac7cf0ab4a7
+    68      4  header.timestamp                     81ad5f49 = 2009-01-03T18:25:05Z
+    72      4  header.bits                          ffff7f20 = 207fffff (difficulty 0.000)
+    76      4  header.nonce                         00000000 = 0
+    80      4  coinbase.version                     01000000 = 1
+    84      2  coinbase.witness marker              0001 = flag 1
+    86      1  coinbase.input count                 01 = 1
+    87     32  coinbase.input[0].prev hash          0000000000000000000000000000000000000000000000000000000000000000 = 0000000000000000000000000000000000000000000000000000000000000000
+   119      4  coinbase.input[0].prev index         ffffffff = 4294967295
+   123      1  coinbase.input[0].script length      05 = 5
+   124      5  coinbase.input[0].script             0401000000
+   129      4  coinbase.input[0].sequence           ffffffff = 4294967295
+   133      1  coinbase.output count                01 = 1
+   134      8  coinbase.output[0].value             00f2052a01000000 = 5000000000
+   142      1  coinbase.output[0].pk script length  01 = 1
+   143      1  coinbase.output[0].pk script         51
+   144      1  coinbase.input[0].witness count      01 = 1
+   145      1  coinbase.input[0].witness[0] length  02 = 2
+   146      2  coinbase.input[0].witness[0]         0102
+   148      4  coinbase.lock time                   00000000 = 0
+   152      1  merkle node count                    01 = 1 (transaction count 2)
+   153     32  merkle node[0]                       0101000000000000000000000000000000000000000000000000000000000000 = 0000000000000000000000000000000000000000000000000000000000000101
+`
+
+func TestDumpAnnotated(t *testing.T) {
+	var buf bytes.Buffer
+	_, data := dumpMirror(t)
+	if err := DumpAnnotated(&buf, data); err != nil {
+		t.Fatalf("DumpAnnotated error %v", err)
+	}
+	if got := buf.String(); got != dumpGolden {
+		t.Errorf("DumpAnnotated: got\n%s\nwant\n%s", got, dumpGolden)
+	}
+}
+
+func TestDumpAnnotatedInvalid(t *testing.T) {
+	m, data := dumpMirror(t)
+	golden := strings.Split(dumpGolden, "\n")
+	splice := func(at int, replace int, with ...byte) []byte {
+		res := append([]byte(nil), data[:at]...)
+		res = append(res, with...)
+		return append(res, data[at+replace:]...)
+	}
+	m.CoinBaseTx.TxOut = nil
+	noOutput, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+
+	// Each dump starts with the lines of the golden dump up to prefix,
+	// then ends with tail.
+	tests := []struct {
+		name   string
+		data   []byte
+		prefix int
+		tail   string
+		err    string
+	}{
+		{"empty", nil, 0, `     0      0  header.version                       -
+!! offset 0: header.version truncated: got 0 of 4 bytes
+`, "offset 0: header.version truncated"},
+		{"truncated header", data[:40], 2, `    36      4  header.merkle root                   a7b40acf
+!! offset 36: header.merkle root truncated: got 4 of 32 bytes
+`, "offset 36: header.merkle root truncated"},
+		{"truncated script", data[:126], 12, `   124      2  coinbase.input[0].script             0401
+!! offset 124: coinbase.input[0].script truncated: got 2 of 5 bytes
+`, "offset 124: coinbase.input[0].script truncated"},
+		{"script length", splice(123, 1, 0xff), 11, `   123      9  coinbase.input[0].script length      ff0401000000ffffff = 18446742974197924100
+   132     53  coinbase.input[0].script             ff0100f2052a0100000001510102010200000000010101000000000000000000000000000000000000000000000000000000000000
+!! offset 132: coinbase.input[0].script truncated: got 53 of 18446742974197924100 bytes
+`, "offset 132: coinbase.input[0].script truncated"},
+		{"bad flag", splice(85, 1, 0x02), 7, `    84      2  coinbase.witness marker              0002 = flag 2
+!! offset 84: coinbase.witness marker has flag 2, not 1
+` + strings.Join(golden[8:], "\n"), "offset 84: coinbase.witness marker has flag 2, not 1"},
+		{"non-canonical varint", splice(152, 1, 0xfd, 0x01, 0x00), 22, `   152      3  merkle node count                    fd0100 = 1 (transaction count 2)
+!! offset 152: merkle node count is a non-canonical varint
+   155     32  merkle node[0]                       0101000000000000000000000000000000000000000000000000000000000000 = 0000000000000000000000000000000000000000000000000000000000000101
+`, "offset 152: merkle node count is a non-canonical varint"},
+		{"too many nodes", splice(152, 33, maxMerkleNode+1, 1, 2), 22, `   152      1  merkle node count                    14 = 20
+!! offset 152: merkle node count 20 is over the maximum of 19
+   153      2  merkle node[0]                       0102
+!! offset 153: merkle node[0] truncated: got 2 of 32 bytes
+`, "offset 152: merkle node count 20 is over the maximum of 19"},
+		{"trailing", append(data[:len(data):len(data)], 0xaa, 0xbb), 24, `   185      2  trailing                             aabb
+`, ""},
+		{"invariant", noOutput, 0, `   133      1  coinbase.output count                00 = 0
+   134      1  coinbase.input[0].witness count      01 = 1
+   135      1  coinbase.input[0].witness[0] length  02 = 2
+   136      2  coinbase.input[0].witness[0]         0102
+   138      4  coinbase.lock time                   00000000 = 0
+   142      1  merkle node count                    01 = 1 (transaction count 2)
+   143     32  merkle node[0]                       0101000000000000000000000000000000000000000000000000000000000000 = 0000000000000000000000000000000000000000000000000000000000000101
+!! coinbase has no output: invalid mirror
+`, "coinbase has no output"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := DumpAnnotated(&buf, test.data)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("DumpAnnotated (%s) error %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("DumpAnnotated (%s): got error %v, want %q", test.name, err, test.err)
+		}
+
+		got := buf.String()
+		prefix := ""
+		if test.prefix > 0 {
+			prefix = strings.Join(golden[:test.prefix], "\n") + "\n"
+		}
+		if !strings.HasPrefix(got, prefix) || !strings.HasSuffix(got, test.tail) ||
+			len(got) < len(prefix)+len(test.tail) {
+
+			t.Errorf("DumpAnnotated (%s): got\n%s\nwant\n%s...\n%s", test.name,
+				got, prefix, test.tail)
+		}
+	}
+}
+
+func TestDumpAnnotatedTruncated(t *testing.T) {
+	_, data := dumpMirror(t)
+	for n := 0; n < len(data); n++ {
+		var buf bytes.Buffer
+		err := DumpAnnotated(&buf, data[:n])
+		if err == nil {
+			t.Fatalf("DumpAnnotated of %d bytes: expected error", n)
+		}
+		if !strings.Contains(buf.String(), "!! "+err.Error()+"\n") {
+			t.Fatalf("DumpAnnotated of %d bytes: failure %v not marked", n, err)
+		}
+		if new(BtcLightMirrorV2).Deserialize(bytes.NewReader(data[:n])) == nil {
+			t.Fatalf("Deserialize of %d bytes: expected error", n)
+		}
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestDumpAnnotatedWriteError(t *testing.T) {
+	_, data := dumpMirror(t)
+	for _, in := range [][]byte{data, data[:10]} {
+		if err := DumpAnnotated(failingWriter{}, in); err != errWrite {
+			t.Errorf("DumpAnnotated: got error %v, want %v", err, errWrite)
+		}
+	}
+}
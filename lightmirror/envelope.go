@@ -0,0 +1,247 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Envelope layout.  An envelope tells the format of the mirror it holds, so
+// that records of several formats can be stored side by side:
+//
+//	magic   4 bytes, "LMIR"
+//	version 1 byte, the MirrorVersion of the payload
+//	length  varint, the length of the payload
+//	payload the serialized mirror
+//
+// Read as the start of a bare mirror, the magic is a block version of
+// 0x52494d4c, which no block carries.  The length lets a reader skip the
+// payload of a version it does not know.
+const envelopeMagic = "LMIR"
+
+// maxEnvelopePayload is the largest payload an envelope may announce, far
+// above that of any mirror of a block of DefaultMaxTxCount transactions.
+const maxEnvelopePayload = 32 << 20
+
+// MirrorVersion is the format of the mirror an envelope holds.
+type MirrorVersion uint8
+
+const (
+	// MirrorV1 is the format of BtcLightMirror, with the hashes of all
+	// transactions of the block.
+	MirrorV1 MirrorVersion = 1
+
+	// MirrorV2 is the format of BtcLightMirrorV2, with the merkle branch
+	// of the coinbase.
+	MirrorV2 MirrorVersion = 2
+
+	// MirrorV3 is the format of BtcLightMirrorV3, with the witness branch
+	// of the coinbase too.
+	MirrorV3 MirrorVersion = 3
+)
+
+var mirrorVersionStrings = map[MirrorVersion]string{
+	MirrorV1: "V1",
+	MirrorV2: "V2",
+	MirrorV3: "V3",
+}
+
+func (v MirrorVersion) String() string {
+	if s, ok := mirrorVersionStrings[v]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown MirrorVersion (%d)", uint8(v))
+}
+
+var (
+	// ErrNoEnvelope is returned when decoding data which does not start
+	// with the magic of an envelope.
+	ErrNoEnvelope = errors.New("not a mirror envelope")
+
+	// ErrUnknownVersion is returned for an envelope of a MirrorVersion
+	// this package does not decode.  DeserializeAny consumes its payload,
+	// so that the next envelope of a stream can still be read.
+	ErrUnknownVersion = errors.New("unknown mirror version")
+)
+
+// AnyMirror is a mirror decoded by DeserializeAny: Version tells which of
+// the fields holds it.
+type AnyMirror struct {
+	Version MirrorVersion
+
+	V1 *BtcLightMirror
+	V2 *BtcLightMirrorV2
+	V3 *BtcLightMirrorV3
+}
+
+// EnvelopeOptions configures DeserializeAnyWith.
+type EnvelopeOptions struct {
+	// Decode holds the limits the V2 and V3 mirrors are decoded with.
+	// RejectTrailingBytes applies after the envelope, not to its payload,
+	// which must always be consumed exactly.
+	Decode DeserializeOptions
+
+	// Legacy, when set, is the version of the bare mirrors, serialized
+	// without an envelope, of records written before envelopes were.
+	// They are decoded as mirrors of that version rather than failing
+	// with ErrNoEnvelope.
+	Legacy MirrorVersion
+}
+
+// SerializeEnvelope writes the mirror to w in an envelope of MirrorV1.
+func (light *BtcLightMirror) SerializeEnvelope(w io.Writer) error {
+	return writeEnvelope(w, MirrorV1, light.Serialize)
+}
+
+// SerializeEnvelope writes the mirror to w in an envelope of MirrorV2.
+func (light *BtcLightMirrorV2) SerializeEnvelope(w io.Writer) error {
+	return writeEnvelope(w, MirrorV2, light.Serialize)
+}
+
+// SerializeEnvelope writes the mirror to w in an envelope of MirrorV3.
+func (light *BtcLightMirrorV3) SerializeEnvelope(w io.Writer) error {
+	return writeEnvelope(w, MirrorV3, light.Serialize)
+}
+
+// writeEnvelope writes to w the envelope of version around the payload
+// serialize writes.
+func writeEnvelope(w io.Writer, version MirrorVersion, serialize func(io.Writer) error) error {
+	var payload bytes.Buffer
+	if err := serialize(&payload); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(envelopeMagic) + 1 + wire.MaxVarIntPayload + payload.Len())
+	buf.WriteString(envelopeMagic)
+	buf.WriteByte(byte(version))
+	if err := wire.WriteVarInt(&buf, 0, uint64(payload.Len())); err != nil {
+		return err
+	}
+	buf.Write(payload.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DetectVersion returns the version of the mirror in the envelope data
+// starts with, failing with ErrNoEnvelope if data does not start with one.
+// The version may be one DeserializeAny does not decode.
+func DetectVersion(data []byte) (MirrorVersion, error) {
+	if len(data) < len(envelopeMagic)+1 || !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return 0, ErrNoEnvelope
+	}
+	return MirrorVersion(data[len(envelopeMagic)]), nil
+}
+
+// DeserializeAny decodes from r the mirror of the envelope r is positioned
+// at, whatever its version, reading the envelope and nothing past it.
+func DeserializeAny(r io.Reader) (*AnyMirror, error) {
+	return DeserializeAnyWith(r, EnvelopeOptions{})
+}
+
+// DeserializeAnyWith is DeserializeAny with opts, which may also decode the
+// bare mirrors of a legacy version.
+func DeserializeAnyWith(r io.Reader, opts EnvelopeOptions) (*AnyMirror, error) {
+	decode := opts.Decode
+	decode.RejectTrailingBytes = false
+
+	var head [len(envelopeMagic) + 1]byte
+	if _, err := io.ReadFull(r, head[:len(envelopeMagic)]); err != nil {
+		return nil, err
+	}
+	var m *AnyMirror
+	if !bytes.Equal(head[:len(envelopeMagic)], []byte(envelopeMagic)) {
+		if opts.Legacy == 0 {
+			return nil, fmt.Errorf("record starting with %x: %w",
+				head[:len(envelopeMagic)], ErrNoEnvelope)
+		}
+		mr := io.MultiReader(bytes.NewReader(head[:len(envelopeMagic)]), r)
+		var err error
+		if m, err = decodeVersion(mr, opts.Legacy, decode); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if m, err = decodeEnvelope(r, head[:], decode); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Decode.RejectTrailingBytes {
+		if err := checkTrailing(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// decodeEnvelope decodes the envelope whose magic was read from r into head,
+// which has room for the version byte.
+func decodeEnvelope(r io.Reader, head []byte, opts DeserializeOptions) (*AnyMirror, error) {
+	if _, err := io.ReadFull(r, head[len(envelopeMagic):]); err != nil {
+		return nil, err
+	}
+	version := MirrorVersion(head[len(envelopeMagic)])
+	length, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxEnvelopePayload {
+		return nil, fmt.Errorf("envelope payload of %d bytes is larger than "+
+			"the %d of a mirror", length, maxEnvelopePayload)
+	}
+
+	payload := &io.LimitedReader{R: r, N: int64(length)}
+	m, err := decodeVersion(payload, version, opts)
+	if errors.Is(err, ErrUnknownVersion) {
+		if _, cerr := io.Copy(ioutil.Discard, payload); cerr != nil {
+			return nil, cerr
+		}
+		if payload.N > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payload.N > 0 {
+		return nil, fmt.Errorf("%v mirror ends %d bytes before the end of "+
+			"its envelope", version, payload.N)
+	}
+	return m, nil
+}
+
+// decodeVersion decodes from r a bare mirror of version with the limits of
+// opts.
+func decodeVersion(r io.Reader, version MirrorVersion, opts DeserializeOptions) (*AnyMirror, error) {
+	res := &AnyMirror{Version: version}
+	var err error
+	switch version {
+	case MirrorV1:
+		res.V1 = new(BtcLightMirror)
+		err = res.V1.Deserialize(r)
+	case MirrorV2:
+		res.V2 = new(BtcLightMirrorV2)
+		err = res.V2.DeserializeWith(r, opts)
+	case MirrorV3:
+		res.V3 = new(BtcLightMirrorV3)
+		err = res.V3.DeserializeWith(r, opts)
+	default:
+		return nil, fmt.Errorf("envelope of version %d: %w", uint8(version),
+			ErrUnknownVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestDeserializeAny(t *testing.T) {
+	header, coinBaseTx, txids, wtxids := newTestBlock(5)
+	v1 := &BtcLightMirror{BtcHeader: *header, CoinBaseTx: *coinBaseTx, TxHashes: txids}
+	v2 := newTestMirror(chainhash.Hash{}, 1, 5)
+	v3, err := NewV3(header, coinBaseTx, txids, wtxids)
+	if err != nil {
+		t.Fatalf("NewV3 error %v", err)
+	}
+
+	// Envelopes of every version follow each other in a stream, with an
+	// envelope of an unknown version in between.
+	var stream bytes.Buffer
+	for _, w := range []func(io.Writer) error{v2.SerializeEnvelope, v1.SerializeEnvelope,
+		v3.SerializeEnvelope} {
+		if err := w(&stream); err != nil {
+			t.Fatalf("SerializeEnvelope error %v", err)
+		}
+	}
+	stream.Write([]byte{'L', 'M', 'I', 'R', 9, 3, 1, 2, 3})
+	if err := v2.SerializeEnvelope(&stream); err != nil {
+		t.Fatalf("SerializeEnvelope error %v", err)
+	}
+
+	data := stream.Bytes()
+	if v, err := DetectVersion(data); err != nil || v != MirrorV2 {
+		t.Errorf("DetectVersion: got %v, error %v, want %v", v, err, MirrorV2)
+	}
+
+	r := bytes.NewReader(data)
+	for i, want := range []MirrorVersion{MirrorV2, MirrorV1, MirrorV3} {
+		m, err := DeserializeAny(r)
+		if err != nil {
+			t.Fatalf("DeserializeAny #%d error %v", i, err)
+		}
+		if m.Version != want {
+			t.Errorf("DeserializeAny #%d: got version %v, want %v", i, m.Version, want)
+		}
+		switch want {
+		case MirrorV1:
+			if !reflect.DeepEqual(m.V1, v1) || m.V2 != nil || m.V3 != nil {
+				t.Errorf("DeserializeAny #%d: got %+v, want %+v", i, m.V1, v1)
+			}
+		case MirrorV2:
+			if !m.V2.Equal(v2) || m.V1 != nil || m.V3 != nil {
+				t.Errorf("DeserializeAny #%d: got %v, want %v", i, m.V2, v2)
+			}
+		case MirrorV3:
+			if !m.V3.Equal(v3) || m.V1 != nil || m.V2 != nil {
+				t.Errorf("DeserializeAny #%d: got %v, want %v", i, m.V3, v3)
+			}
+		}
+	}
+	if _, err := DeserializeAny(r); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("DeserializeAny: got error %v, want %v", err, ErrUnknownVersion)
+	}
+	if m, err := DeserializeAny(r); err != nil || !m.V2.Equal(v2) {
+		t.Errorf("DeserializeAny after an unknown version: got %v, error %v", m, err)
+	}
+	if _, err := DeserializeAny(r); err != io.EOF {
+		t.Errorf("DeserializeAny at the end: got error %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDeserializeAnyLegacy(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 5)
+	bare, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	if _, err := DetectVersion(bare); !errors.Is(err, ErrNoEnvelope) {
+		t.Errorf("DetectVersion: got error %v, want %v", err, ErrNoEnvelope)
+	}
+	if _, err := DeserializeAny(bytes.NewReader(bare)); !errors.Is(err, ErrNoEnvelope) {
+		t.Errorf("DeserializeAny: got error %v, want %v", err, ErrNoEnvelope)
+	}
+
+	// Bare legacy records and envelopes mix.
+	var stream bytes.Buffer
+	stream.Write(bare)
+	m.SerializeEnvelope(&stream)
+	r := bytes.NewReader(stream.Bytes())
+	opts := EnvelopeOptions{Legacy: MirrorV2}
+	for i := 0; i < 2; i++ {
+		got, err := DeserializeAnyWith(r, opts)
+		if err != nil || got.Version != MirrorV2 || !got.V2.Equal(m) {
+			t.Errorf("DeserializeAnyWith #%d: got %v, error %v", i, got, err)
+		}
+	}
+
+	opts.Decode.RejectTrailingBytes = true
+	var trailing *TrailingDataError
+	if _, err := DeserializeAnyWith(bytes.NewReader(stream.Bytes()), opts); !errors.As(err, &trailing) {
+		t.Errorf("DeserializeAnyWith: got error %v, want trailing data", err)
+	}
+}
+
+func TestDeserializeAnyInvalid(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 5)
+	var buf bytes.Buffer
+	if err := m.SerializeEnvelope(&buf); err != nil {
+		t.Fatalf("SerializeEnvelope error %v", err)
+	}
+	envelope := buf.Bytes()
+	payload, _ := m.ToBytes()
+
+	// A payload longer than the mirror, announced in 3 bytes.
+	long := []byte("LMIR\x02\xfd")
+	long = append(long, byte(len(payload)+1), byte((len(payload)+1)>>8))
+	long = append(append(long, payload...), 0)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated magic", envelope[:3]},
+		{"truncated version", envelope[:4]},
+		{"truncated length", envelope[:5]},
+		{"truncated payload", envelope[:len(envelope)-1]},
+		{"payload longer than the mirror", long},
+		{"huge payload", []byte("LMIR\x02\xfe\xff\xff\xff\xff")},
+		{"unknown version, truncated", []byte("LMIR\x07\x05abc")},
+	}
+	for _, test := range tests {
+		if _, err := DeserializeAny(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("DeserializeAny (%s): expected error", test.name)
+		}
+	}
+
+	var v MirrorVersion = 7
+	if v.String() != "Unknown MirrorVersion (7)" || MirrorV3.String() != "V3" {
+		t.Errorf("String: got %s and %s", v, MirrorV3)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// FieldDifference names a field two mirrors disagree on, with the value of
+// each, formatted for logs.
+type FieldDifference struct {
+	Field string
+	This  string
+	Other string
+}
+
+func (d FieldDifference) String() string {
+	return fmt.Sprintf("%s: %s != %s", d.Field, d.This, d.Other)
+}
+
+// Equal returns whether the mirror and other have the same header, coinbase
+// and merkle nodes, the fields it serializes.  The coinbases are equal when
+// their serializations are: nil and empty scripts, witnesses and slices are
+// equal, and the header timestamps are compared to the second.  The mirror
+// does not carry the transaction count of the block beyond the depth of its
+// merkle branch, which the node count compares.
+func (light *BtcLightMirrorV2) Equal(other *BtcLightMirrorV2) bool {
+	return light.compare(other, nil)
+}
+
+// Diff returns the fields the mirror and other differ on, as compared by
+// Equal, which is nil for equal mirrors.  It stops at the first count of
+// inputs, outputs or merkle nodes that differs; the function Diff reports
+// every field, rendered for reading.
+func (light *BtcLightMirrorV2) Diff(other *BtcLightMirrorV2) []FieldDifference {
+	var diff []FieldDifference
+	light.compare(other, &diff)
+	return diff
+}
+
+// mirrorComparison walks two mirrors comparing their fields.  Without diff,
+// it stops at the first difference.
+type mirrorComparison struct {
+	diff  *[]FieldDifference
+	equal bool
+}
+
+// check records a difference on field unless same, and returns whether to
+// go on comparing.
+func (c *mirrorComparison) check(same bool, field string, this, other interface{}) bool {
+	if same {
+		return true
+	}
+	c.equal = false
+	if c.diff == nil {
+		return false
+	}
+	*c.diff = append(*c.diff, FieldDifference{
+		Field: field,
+		This:  fmt.Sprint(this),
+		Other: fmt.Sprint(other),
+	})
+	return true
+}
+
+func (light *BtcLightMirrorV2) compare(other *BtcLightMirrorV2, diff *[]FieldDifference) bool {
+	c := &mirrorComparison{diff: diff, equal: true}
+	if light == nil || other == nil {
+		c.check(light == other, "mirror", light == nil, other == nil)
+		return c.equal
+	}
+
+	h, o := &light.BtcHeader, &other.BtcHeader
+	_ = c.check(h.Version == o.Version, "BtcHeader.Version", h.Version, o.Version) &&
+		c.check(h.PrevBlock == o.PrevBlock, "BtcHeader.PrevBlock", h.PrevBlock, o.PrevBlock) &&
+		c.check(h.MerkleRoot == o.MerkleRoot, "BtcHeader.MerkleRoot", h.MerkleRoot, o.MerkleRoot) &&
+		c.check(h.Timestamp.Unix() == o.Timestamp.Unix(), "BtcHeader.Timestamp",
+			h.Timestamp.Unix(), o.Timestamp.Unix()) &&
+		c.check(h.Bits == o.Bits, "BtcHeader.Bits", h.Bits, o.Bits) &&
+		c.check(h.Nonce == o.Nonce, "BtcHeader.Nonce", h.Nonce, o.Nonce) &&
+		c.compareTx(light.Coinbase(), other.Coinbase()) &&
+		c.check(len(light.MerkleNodes) == len(other.MerkleNodes), "MerkleNodes",
+			len(light.MerkleNodes), len(other.MerkleNodes)) &&
+		c.compareNodes(light, other)
+	return c.equal
+}
+
+func (c *mirrorComparison) compareNodes(light, other *BtcLightMirrorV2) bool {
+	for i := 0; i < len(light.MerkleNodes) && i < len(other.MerkleNodes); i++ {
+		if !c.check(light.MerkleNodes[i] == other.MerkleNodes[i],
+			fmt.Sprintf("MerkleNodes[%d]", i), light.MerkleNodes[i],
+			other.MerkleNodes[i]) {
+
+			return false
+		}
+	}
+	return true
+}
+
+// compareTx compares the fields of the coinbases that make up their
+// serialization.
+func (c *mirrorComparison) compareTx(tx, other *wire.MsgTx) bool {
+	if !c.check(tx.Version == other.Version, "CoinBaseTx.Version", tx.Version, other.Version) ||
+		!c.check(len(tx.TxIn) == len(other.TxIn), "CoinBaseTx.TxIn", len(tx.TxIn), len(other.TxIn)) ||
+		!c.check(len(tx.TxOut) == len(other.TxOut), "CoinBaseTx.TxOut", len(tx.TxOut), len(other.TxOut)) {
+
+		return false
+	}
+	for i := 0; i < len(tx.TxIn) && i < len(other.TxIn); i++ {
+		if !c.compareTxIn(fmt.Sprintf("CoinBaseTx.TxIn[%d]", i), tx.TxIn[i], other.TxIn[i]) {
+			return false
+		}
+	}
+	for i := 0; i < len(tx.TxOut) && i < len(other.TxOut); i++ {
+		field := fmt.Sprintf("CoinBaseTx.TxOut[%d]", i)
+		a, b := tx.TxOut[i], other.TxOut[i]
+		if a == nil || b == nil {
+			if !c.check(a == b, field, a == nil, b == nil) {
+				return false
+			}
+			continue
+		}
+		if !c.check(a.Value == b.Value, field+".Value", a.Value, b.Value) ||
+			!c.check(bytes.Equal(a.PkScript, b.PkScript), field+".PkScript",
+				fmt.Sprintf("%x", a.PkScript), fmt.Sprintf("%x", b.PkScript)) {
+
+			return false
+		}
+	}
+	return c.check(tx.LockTime == other.LockTime, "CoinBaseTx.LockTime", tx.LockTime,
+		other.LockTime)
+}
+
+func (c *mirrorComparison) compareTxIn(field string, a, b *wire.TxIn) bool {
+	if a == nil || b == nil {
+		return c.check(a == b, field, a == nil, b == nil)
+	}
+	if !c.check(a.PreviousOutPoint == b.PreviousOutPoint, field+".PreviousOutPoint",
+		a.PreviousOutPoint, b.PreviousOutPoint) ||
+		!c.check(bytes.Equal(a.SignatureScript, b.SignatureScript), field+".SignatureScript",
+			fmt.Sprintf("%x", a.SignatureScript), fmt.Sprintf("%x", b.SignatureScript)) ||
+		!c.check(a.Sequence == b.Sequence, field+".Sequence", a.Sequence, b.Sequence) ||
+		!c.check(len(a.Witness) == len(b.Witness), field+".Witness", len(a.Witness),
+			len(b.Witness)) {
+
+		return false
+	}
+	for j := 0; j < len(a.Witness) && j < len(b.Witness); j++ {
+		if !c.check(bytes.Equal(a.Witness[j], b.Witness[j]), fmt.Sprintf("%s.Witness[%d]", field, j),
+			fmt.Sprintf("%x", a.Witness[j]), fmt.Sprintf("%x", b.Witness[j])) {
+
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestBtcLightMirrorV2Equal(t *testing.T) {
+	base := newTestMirror(chainhash.Hash{}, 1, 5)
+	base.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+
+	tests := []struct {
+		name   string
+		modify func(m *BtcLightMirrorV2) *BtcLightMirrorV2
+		fields []string
+	}{
+		{"same", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			return m
+		}, nil},
+		{"timestamp location", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.BtcHeader.Timestamp = m.BtcHeader.Timestamp.In(time.FixedZone("", 3600))
+			return m
+		}, nil},
+		{"pk script", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.CoinBaseTx.TxOut[0].PkScript = nil
+			return m
+		}, []string{"CoinBaseTx.TxOut[0].PkScript"}},
+		{"no merkle nodes", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.MerkleNodes = nil
+			return m
+		}, []string{"MerkleNodes"}},
+		{"nonce", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.BtcHeader.Nonce++
+			return m
+		}, []string{"BtcHeader.Nonce"}},
+		{"header", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.BtcHeader.Version++
+			m.BtcHeader.PrevBlock[0] ^= 1
+			m.BtcHeader.Timestamp = m.BtcHeader.Timestamp.Add(time.Second)
+			return m
+		}, []string{"BtcHeader.Version", "BtcHeader.PrevBlock", "BtcHeader.Timestamp"}},
+		{"coinbase", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.CoinBaseTx.TxIn[0].SignatureScript[1] ^= 1
+			m.CoinBaseTx.TxIn[0].Witness[0][0] = 1
+			m.CoinBaseTx.TxOut[0].Value--
+			m.CoinBaseTx.LockTime = 1
+			return m
+		}, []string{"CoinBaseTx.TxIn[0].SignatureScript", "CoinBaseTx.TxIn[0].Witness[0]",
+			"CoinBaseTx.TxOut[0].Value", "CoinBaseTx.LockTime"}},
+		{"coinbase outputs", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut, &wire.TxOut{})
+			return m
+		}, []string{"CoinBaseTx.TxOut"}},
+		{"merkle node", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.MerkleNodes[2][31] ^= 1
+			return m
+		}, []string{"MerkleNodes[2]"}},
+		{"merkle depth", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			m.MerkleNodes = m.MerkleNodes[:2]
+			return m
+		}, []string{"MerkleNodes"}},
+		{"nil", func(m *BtcLightMirrorV2) *BtcLightMirrorV2 {
+			return nil
+		}, []string{"mirror"}},
+	}
+	for _, test := range tests {
+		other := test.modify(base.Clone())
+		if got, want := base.Equal(other), len(test.fields) == 0; got != want {
+			t.Errorf("Equal (%s): got %v, want %v", test.name, got, want)
+		}
+		if other != nil {
+			if got, want := other.Equal(base), len(test.fields) == 0; got != want {
+				t.Errorf("Equal (%s) reversed: got %v, want %v", test.name, got, want)
+			}
+		}
+		diff := base.Diff(other)
+		if len(diff) != len(test.fields) {
+			t.Errorf("Diff (%s): got %v, want fields %v", test.name, diff, test.fields)
+			continue
+		}
+		for i, d := range diff {
+			if d.Field != test.fields[i] {
+				t.Errorf("Diff (%s) #%d: got field %s, want %s", test.name, i,
+					d.Field, test.fields[i])
+			}
+			if d.This == d.Other {
+				t.Errorf("Diff (%s) #%d: got the same values %s", test.name, i, d)
+			}
+		}
+	}
+}
+
+func TestBtcLightMirrorV2EqualEmpty(t *testing.T) {
+	// Nil and empty slices serialize the same.
+	empty := &BtcLightMirrorV2{
+		CoinBaseTx: wire.MsgTx{
+			TxIn:  []*wire.TxIn{{SignatureScript: []byte{}, Witness: wire.TxWitness{}}},
+			TxOut: []*wire.TxOut{},
+		},
+		MerkleNodes: []chainhash.Hash{},
+	}
+	zero := &BtcLightMirrorV2{
+		CoinBaseTx: wire.MsgTx{TxIn: []*wire.TxIn{{}}},
+	}
+	if !empty.Equal(zero) || !zero.Equal(empty) {
+		t.Errorf("Equal: got a mismatch, diff %v", empty.Diff(zero))
+	}
+	var none *BtcLightMirrorV2
+	if !none.Equal(nil) || none.Diff(nil) != nil {
+		t.Errorf("Equal: nil mirrors differ")
+	}
+}
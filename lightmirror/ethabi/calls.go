@@ -0,0 +1,89 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ethabi
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The view methods of the mirror registry contract.
+var (
+	tipMethod = abi.NewMethod("tip", "tip", abi.Function, "view", false, false,
+		nil, abi.Arguments{
+			{Name: "height", Type: newType("uint64")},
+			{Name: "blockHash", Type: newType("bytes32")},
+		})
+
+	mirrorAtMethod = abi.NewMethod("mirrorAt", "mirrorAt", abi.Function, "view",
+		false, false, abi.Arguments{
+			{Name: "height", Type: newType("uint64")},
+		}, abi.Arguments{
+			{Name: "blockHash", Type: newType("bytes32")},
+			{Name: "commitment", Type: newType("bytes32")},
+		})
+
+	hasMirrorMethod = abi.NewMethod("hasMirror", "hasMirror", abi.Function, "view",
+		false, false, abi.Arguments{
+			{Name: "blockHash", Type: newType("bytes32")},
+		}, abi.Arguments{
+			{Name: "", Type: newType("bool")},
+		})
+)
+
+// PackTip returns the calldata of tip.
+func PackTip() []byte {
+	return append([]byte{}, tipMethod.ID...)
+}
+
+// UnpackTip decodes the data tip returns: the height and the hash of the
+// last mirror the contract stores.
+func UnpackTip(data []byte) (height uint64, blockHash chainhash.Hash, err error) {
+	out, err := tipMethod.Outputs.Unpack(data)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	return out[0].(uint64), out[1].([32]byte), nil
+}
+
+// PackMirrorAt returns the calldata of mirrorAt for the height.
+func PackMirrorAt(height uint64) ([]byte, error) {
+	args, err := mirrorAtMethod.Inputs.Pack(height)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, mirrorAtMethod.ID...), args...), nil
+}
+
+// UnpackMirrorAt decodes the data mirrorAt returns: the hash of the block
+// the contract stores at the height and the commitment of its mirror, see
+// lightmirror.BtcLightMirrorV2.CommitmentHash, both zero when it stores
+// none.
+func UnpackMirrorAt(data []byte) (blockHash chainhash.Hash, commitment common.Hash, err error) {
+	out, err := mirrorAtMethod.Outputs.Unpack(data)
+	if err != nil {
+		return chainhash.Hash{}, common.Hash{}, err
+	}
+	return out[0].([32]byte), out[1].([32]byte), nil
+}
+
+// PackHasMirror returns the calldata of hasMirror for the block hash.
+func PackHasMirror(blockHash chainhash.Hash) ([]byte, error) {
+	args, err := hasMirrorMethod.Inputs.Pack([32]byte(blockHash))
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, hasMirrorMethod.ID...), args...), nil
+}
+
+// UnpackHasMirror decodes the data hasMirror returns.
+func UnpackHasMirror(data []byte) (bool, error) {
+	out, err := hasMirrorMethod.Outputs.Unpack(data)
+	if err != nil {
+		return false, err
+	}
+	return out[0].(bool), nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ethabi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestCalls(t *testing.T) {
+	hash := chainhash.DoubleHashH([]byte("block"))
+	commitment := common.HexToHash("0x0102")
+
+	data, err := PackMirrorAt(812)
+	if err != nil || !bytes.Equal(data[:4], crypto.Keccak256([]byte("mirrorAt(uint64)"))[:4]) ||
+		len(data) != 36 || word(data[4:], 0) != 812 {
+		t.Errorf("PackMirrorAt: got %x, error %v", data, err)
+	}
+	data, err = PackHasMirror(hash)
+	if err != nil || !bytes.Equal(data[:4], crypto.Keccak256([]byte("hasMirror(bytes32)"))[:4]) ||
+		!bytes.Equal(data[4:], hash[:]) {
+		t.Errorf("PackHasMirror: got %x, error %v", data, err)
+	}
+
+	// The contract returns the hashes in the byte order of chainhash.Hash.
+	ret := append(common.LeftPadBytes([]byte{0x03, 0x2c}, 32), hash[:]...)
+	height, tip, err := UnpackTip(ret)
+	if err != nil || height != 812 || tip != hash {
+		t.Errorf("UnpackTip: got %d, %v, error %v", height, tip, err)
+	}
+	ret = append(append([]byte{}, hash[:]...), commitment[:]...)
+	blockHash, gotCommitment, err := UnpackMirrorAt(ret)
+	if err != nil || blockHash != hash || gotCommitment != commitment {
+		t.Errorf("UnpackMirrorAt: got %v, %v, error %v", blockHash, gotCommitment, err)
+	}
+	for _, want := range []bool{false, true} {
+		ret := make([]byte, 32)
+		if want {
+			ret[31] = 1
+		}
+		if got, err := UnpackHasMirror(ret); err != nil || got != want {
+			t.Errorf("UnpackHasMirror: got %v, error %v, want %v", got, err, want)
+		}
+	}
+
+	if _, _, err := UnpackTip(ret[:31]); err == nil {
+		t.Errorf("UnpackTip of short data: expected error")
+	}
+	if _, _, err := UnpackMirrorAt(ret[:32]); err == nil {
+		t.Errorf("UnpackMirrorAt of short data: expected error")
+	}
+	if _, err := UnpackHasMirror(nil); err == nil {
+		t.Errorf("UnpackHasMirror of no data: expected error")
+	}
+}
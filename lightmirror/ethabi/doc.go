@@ -0,0 +1,22 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package ethabi encodes mirrors into the calldata of the mirror registry
+// contract of the Core chain, and decodes the data its view methods return,
+// without the bindings and clients of package contract.  It is meant for
+// relayers submitting mirrors through their own transaction pipeline.
+//
+// Mirrors are passed to submitMirror as the tuple
+//
+//	(bytes header, bytes coinbase, uint32 txCount, bytes32[] merkleNodes)
+//
+// where header is the 80 byte serialized block header, coinbase the
+// serialized coinbase transaction in the witness encoding, txCount the
+// largest transaction count the merkle branch proves, 2^len(merkleNodes),
+// and merkleNodes the branch of the coinbase from the leaves up.  Every
+// bytes32 holding a Bitcoin hash, the merkle nodes as the block hashes the
+// view methods return, is in the internal byte order of chainhash.Hash, not
+// in the reversed order block explorers print: chainhash.Hash(b) converts
+// it.
+package ethabi
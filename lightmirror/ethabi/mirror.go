@@ -0,0 +1,251 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ethabi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+// ErrUnknownMethod is returned when decoding calldata of another method
+// than the one expected.
+var ErrUnknownMethod = errors.New("calldata of another method")
+
+// newType returns the ABI type t, which must be valid.
+func newType(t string) abi.Type {
+	typ, err := abi.NewType(t, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}
+
+// The methods of the mirror registry contract, as in MirrorRegistry.abi of
+// package contract.
+var (
+	submitMirrorMethod = abi.NewMethod("submitMirror", "submitMirror", abi.Function,
+		"nonpayable", false, false, abi.Arguments{
+			{Name: "header", Type: newType("bytes")},
+			{Name: "coinbase", Type: newType("bytes")},
+			{Name: "txCount", Type: newType("uint32")},
+			{Name: "merkleNodes", Type: newType("bytes32[]")},
+		}, nil)
+
+	submitBatchMethod = abi.NewMethod("submitBatch", "submitBatch", abi.Function,
+		"nonpayable", false, false, abi.Arguments{
+			{Name: "mirrors", Type: newType("bytes[]")},
+		}, nil)
+)
+
+// SubmitMirrorSelector and SubmitBatchSelector are the 4 byte selectors the
+// calldata of submitMirror and submitBatch start with.
+var (
+	SubmitMirrorSelector = submitMirrorMethod.ID
+	SubmitBatchSelector  = submitBatchMethod.ID
+)
+
+// MirrorArgs are the arguments of submitMirror for a mirror.
+type MirrorArgs struct {
+	Header      []byte
+	Coinbase    []byte
+	TxCount     uint32
+	MerkleNodes [][32]byte
+}
+
+// NewMirrorArgs returns the arguments of submitMirror for m.  It does not
+// check the merkle branch of m.
+func NewMirrorArgs(m *lightmirror.BtcLightMirrorV2) (*MirrorArgs, error) {
+	if len(m.MerkleNodes) >= 32 {
+		return nil, fmt.Errorf("merkle branch of %d nodes does not fit a "+
+			"uint32 transaction count", len(m.MerkleNodes))
+	}
+
+	var header bytes.Buffer
+	if err := m.BtcHeader.Serialize(&header); err != nil {
+		return nil, err
+	}
+	var coinbase bytes.Buffer
+	if err := m.Coinbase().Serialize(&coinbase); err != nil {
+		return nil, err
+	}
+	nodes := make([][32]byte, 0, len(m.MerkleNodes))
+	for _, node := range m.MerkleNodes {
+		nodes = append(nodes, node)
+	}
+	return &MirrorArgs{
+		Header:      header.Bytes(),
+		Coinbase:    coinbase.Bytes(),
+		TxCount:     1 << len(m.MerkleNodes),
+		MerkleNodes: nodes,
+	}, nil
+}
+
+// Pack returns the ABI encoding of the arguments, without selector.
+func (a *MirrorArgs) Pack() ([]byte, error) {
+	return submitMirrorMethod.Inputs.Pack(a.Header, a.Coinbase, a.TxCount, a.MerkleNodes)
+}
+
+// Mirror returns the mirror the arguments encode.  The header must be 80
+// bytes and the coinbase a single transaction, the errors of trailing bytes
+// being *lightmirror.TrailingDataError.  The transaction count must be one
+// a branch of that many nodes proves, and the branch must lead to the
+// merkle root of the header, the errors of a mismatch wrapping
+// lightmirror.ErrBranchMismatch.  The mirror satisfies VerifyInvariants.
+func (a *MirrorArgs) Mirror() (*lightmirror.BtcLightMirrorV2, error) {
+	if len(a.Header) != wire.MaxBlockHeaderPayload {
+		return nil, fmt.Errorf("header of %d bytes, want %d: %w", len(a.Header),
+			wire.MaxBlockHeaderPayload, lightmirror.ErrInvalidMirror)
+	}
+	if max := uint64(1) << len(a.MerkleNodes); uint64(a.TxCount) > max || uint64(a.TxCount)*2 <= max {
+		return nil, fmt.Errorf("transaction count %d does not match a merkle "+
+			"branch of %d nodes: %w", a.TxCount, len(a.MerkleNodes), lightmirror.ErrBranchMismatch)
+	}
+
+	m := new(lightmirror.BtcLightMirrorV2)
+	if err := m.BtcHeader.Deserialize(bytes.NewReader(a.Header)); err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(a.Coinbase)
+	if err := m.CoinBaseTx.Deserialize(r); err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, &lightmirror.TrailingDataError{Bytes: int64(r.Len())}
+	}
+	m.MerkleNodes = make([]chainhash.Hash, len(a.MerkleNodes))
+	for i, node := range a.MerkleNodes {
+		m.MerkleNodes[i] = node
+	}
+	if err := m.VerifyInvariants(); err != nil {
+		return nil, err
+	}
+	if err := m.CheckMerkle(); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, lightmirror.ErrBranchMismatch)
+	}
+	return m, nil
+}
+
+// unpackMirrorArgs decodes the ABI encoding of the arguments of
+// submitMirror, without selector.
+func unpackMirrorArgs(data []byte) (*MirrorArgs, error) {
+	args, err := submitMirrorMethod.Inputs.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorArgs{
+		Header:      args[0].([]byte),
+		Coinbase:    args[1].([]byte),
+		TxCount:     args[2].(uint32),
+		MerkleNodes: args[3].([][32]byte),
+	}, nil
+}
+
+// PackMirror returns the ABI encoding of the arguments of submitMirror for
+// m, without selector.  The mirror must pass the merkle check.
+func PackMirror(m *lightmirror.BtcLightMirrorV2) ([]byte, error) {
+	if err := m.CheckMerkle(); err != nil {
+		return nil, err
+	}
+	args, err := NewMirrorArgs(m)
+	if err != nil {
+		return nil, err
+	}
+	return args.Pack()
+}
+
+// UnpackMirror decodes the mirror PackMirror encoded, as MirrorArgs.Mirror
+// checks it.
+func UnpackMirror(data []byte) (*lightmirror.BtcLightMirrorV2, error) {
+	args, err := unpackMirrorArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	return args.Mirror()
+}
+
+// PackSubmitMirror returns the calldata of submitMirror for m, the selector
+// followed by PackMirror(m).
+func PackSubmitMirror(m *lightmirror.BtcLightMirrorV2) ([]byte, error) {
+	data, err := PackMirror(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, SubmitMirrorSelector...), data...), nil
+}
+
+// UnpackSubmitMirror decodes the mirror of the calldata of submitMirror,
+// failing with ErrUnknownMethod for the calldata of another method.
+func UnpackSubmitMirror(calldata []byte) (*lightmirror.BtcLightMirrorV2, error) {
+	data, err := stripSelector(calldata, SubmitMirrorSelector)
+	if err != nil {
+		return nil, err
+	}
+	return UnpackMirror(data)
+}
+
+// PackSubmitBatch returns the calldata of submitBatch for the mirrors, each
+// passed as its Serialize bytes.  The mirrors must pass the merkle check.
+func PackSubmitBatch(mirrors []*lightmirror.BtcLightMirrorV2) ([]byte, error) {
+	data := make([][]byte, 0, len(mirrors))
+	for i, m := range mirrors {
+		if err := m.CheckMerkle(); err != nil {
+			return nil, fmt.Errorf("mirror #%d: %w", i, err)
+		}
+		b, err := m.ToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("mirror #%d: %w", i, err)
+		}
+		data = append(data, b)
+	}
+	args, err := submitBatchMethod.Inputs.Pack(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, SubmitBatchSelector...), args...), nil
+}
+
+// UnpackSubmitBatch decodes the mirrors of the calldata of submitBatch,
+// failing with ErrUnknownMethod for the calldata of another method.  Every
+// mirror must decode as lightmirror.DeserializeBytes decodes it.
+func UnpackSubmitBatch(calldata []byte) ([]*lightmirror.BtcLightMirrorV2, error) {
+	data, err := stripSelector(calldata, SubmitBatchSelector)
+	if err != nil {
+		return nil, err
+	}
+	args, err := submitBatchMethod.Inputs.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	raw := args[0].([][]byte)
+	mirrors := make([]*lightmirror.BtcLightMirrorV2, 0, len(raw))
+	for i, b := range raw {
+		m, err := lightmirror.DeserializeBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("mirror #%d: %w", i, err)
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
+
+// stripSelector returns the arguments of calldata, which must start with
+// selector.
+func stripSelector(calldata, selector []byte) ([]byte, error) {
+	if len(calldata) < len(selector) || !bytes.Equal(calldata[:len(selector)], selector) {
+		n := len(selector)
+		if len(calldata) < n {
+			n = len(calldata)
+		}
+		return nil, fmt.Errorf("selector %x, want %x: %w", calldata[:n], selector,
+			ErrUnknownMethod)
+	}
+	return calldata[len(selector):], nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ethabi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// word returns the 32 byte word i of data as a number.
+func word(data []byte, i int) uint64 {
+	w := data[32*i : 32*(i+1)]
+	return binary.BigEndian.Uint64(w[24:])
+}
+
+func TestSelectors(t *testing.T) {
+	tests := []struct {
+		signature string
+		selector  []byte
+	}{
+		{"submitMirror(bytes,bytes,uint32,bytes32[])", SubmitMirrorSelector},
+		{"submitBatch(bytes[])", SubmitBatchSelector},
+		{"tip()", PackTip()},
+	}
+	for _, test := range tests {
+		if want := crypto.Keccak256([]byte(test.signature))[:4]; !bytes.Equal(test.selector, want) {
+			t.Errorf("selector (%s): got %x, want %x", test.signature, test.selector, want)
+		}
+	}
+}
+
+func TestPackMirror(t *testing.T) {
+	for i, m := range storetest.Mirrors(4) {
+		data, err := PackMirror(m)
+		if err != nil {
+			t.Fatalf("PackMirror #%d error %v", i, err)
+		}
+
+		// The head holds the offsets of the header, the coinbase and the
+		// merkle nodes, and the transaction count; the header follows as
+		// its length and 3 words.
+		var coinbase bytes.Buffer
+		m.CoinBaseTx.Serialize(&coinbase)
+		coinbaseWords := (coinbase.Len() + 31) / 32
+		var header bytes.Buffer
+		m.BtcHeader.Serialize(&header)
+		if word(data, 0) != 4*32 || word(data, 1) != 8*32 ||
+			word(data, 2) != 1<<len(m.MerkleNodes) ||
+			word(data, 3) != uint64(9+coinbaseWords)*32 ||
+			word(data, 4) != 80 || !bytes.Equal(data[5*32:5*32+80], header.Bytes()) ||
+			word(data, 8) != uint64(coinbase.Len()) ||
+			!bytes.Equal(data[9*32:9*32+coinbase.Len()], coinbase.Bytes()) {
+			t.Errorf("PackMirror #%d: got %x", i, data)
+			continue
+		}
+		nodes := data[(9+coinbaseWords)*32:]
+		if word(nodes, 0) != uint64(len(m.MerkleNodes)) || len(nodes) != 32*(1+len(m.MerkleNodes)) {
+			t.Errorf("PackMirror #%d: got merkle nodes %x", i, nodes)
+			continue
+		}
+		for j, node := range m.MerkleNodes {
+			if !bytes.Equal(nodes[32*(j+1):32*(j+2)], node[:]) {
+				t.Errorf("PackMirror #%d: got node %d %x, want %x", i, j, nodes[32*(j+1):32*(j+2)], node[:])
+			}
+		}
+
+		got, err := UnpackMirror(data)
+		if err != nil || !got.Equal(m) {
+			t.Errorf("UnpackMirror #%d: got %v, error %v", i, got, err)
+		}
+		calldata, err := PackSubmitMirror(m)
+		if err != nil || !bytes.Equal(calldata[:4], SubmitMirrorSelector) || !bytes.Equal(calldata[4:], data) {
+			t.Errorf("PackSubmitMirror #%d: got %x, error %v", i, calldata, err)
+		}
+		if got, err := UnpackSubmitMirror(calldata); err != nil || !got.Equal(m) {
+			t.Errorf("UnpackSubmitMirror #%d: got %v, error %v", i, got, err)
+		}
+	}
+}
+
+func TestUnpackMirrorInvalid(t *testing.T) {
+	mirrors := storetest.Mirrors(2)
+	m := mirrors[1]
+	valid, err := NewMirrorArgs(m)
+	if err != nil {
+		t.Fatalf("NewMirrorArgs error %v", err)
+	}
+
+	other := *valid
+	other.Header = append([]byte{}, valid.Header...)
+	other.Header[36] ^= 1
+	tests := []struct {
+		name string
+		args MirrorArgs
+		want error
+	}{
+		{"smallest count", MirrorArgs{valid.Header, valid.Coinbase, valid.TxCount/2 + 1, valid.MerkleNodes}, nil},
+		{"count too small", MirrorArgs{valid.Header, valid.Coinbase, valid.TxCount / 2, valid.MerkleNodes}, lightmirror.ErrBranchMismatch},
+		{"count too large", MirrorArgs{valid.Header, valid.Coinbase, valid.TxCount + 1, valid.MerkleNodes}, lightmirror.ErrBranchMismatch},
+		{"merkle root", other, lightmirror.ErrBranchMismatch},
+		{"short header", MirrorArgs{valid.Header[:79], valid.Coinbase, valid.TxCount, valid.MerkleNodes}, lightmirror.ErrInvalidMirror},
+		{"trailing coinbase", MirrorArgs{valid.Header, append(append([]byte{}, valid.Coinbase...), 0), valid.TxCount, valid.MerkleNodes}, lightmirror.ErrTrailingData},
+	}
+	for _, test := range tests {
+		data, err := test.args.Pack()
+		if err != nil {
+			t.Fatalf("Pack (%s) error %v", test.name, err)
+		}
+		_, err = UnpackMirror(data)
+		if !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+			t.Errorf("UnpackMirror (%s): got error %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	data, _ := valid.Pack()
+	if _, err := UnpackMirror(data[:len(data)-1]); err == nil {
+		t.Errorf("UnpackMirror of truncated data: expected error")
+	}
+	calldata, _ := PackSubmitBatch(mirrors)
+	if _, err := UnpackSubmitMirror(calldata); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("UnpackSubmitMirror: got error %v, want %v", err, ErrUnknownMethod)
+	}
+	if _, err := UnpackSubmitMirror(calldata[:2]); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("UnpackSubmitMirror of 2 bytes: got error %v, want %v", err, ErrUnknownMethod)
+	}
+
+	invalid := m.Clone()
+	invalid.CoinBaseTx.LockTime++
+	if _, err := PackMirror(invalid); err == nil {
+		t.Errorf("PackMirror: expected merkle error")
+	}
+	if _, err := PackSubmitBatch([]*lightmirror.BtcLightMirrorV2{m, invalid}); err == nil {
+		t.Errorf("PackSubmitBatch: expected merkle error")
+	}
+}
+
+func TestPackSubmitBatch(t *testing.T) {
+	mirrors := storetest.Mirrors(3)
+	calldata, err := PackSubmitBatch(mirrors)
+	if err != nil {
+		t.Fatalf("PackSubmitBatch error %v", err)
+	}
+	data := calldata[4:]
+	if !bytes.Equal(calldata[:4], SubmitBatchSelector) || word(data, 0) != 32 || word(data, 1) != 3 {
+		t.Errorf("PackSubmitBatch: got %x", calldata)
+	}
+	got, err := UnpackSubmitBatch(calldata)
+	if err != nil || len(got) != len(mirrors) {
+		t.Fatalf("UnpackSubmitBatch: got %d mirrors, error %v", len(got), err)
+	}
+	for i := range got {
+		if !got[i].Equal(mirrors[i]) {
+			t.Errorf("UnpackSubmitBatch #%d: got %v, want %v", i, got[i], mirrors[i])
+		}
+	}
+
+	mirror, _ := PackSubmitMirror(mirrors[0])
+	if _, err := UnpackSubmitBatch(mirror); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("UnpackSubmitBatch: got error %v, want %v", err, ErrUnknownMethod)
+	}
+	b, _ := mirrors[0].ToBytes()
+	trailing, _ := submitBatchMethod.Inputs.Pack([][]byte{append(b, 0)})
+	_, err = UnpackSubmitBatch(append(append([]byte{}, SubmitBatchSelector...), trailing...))
+	if !errors.Is(err, lightmirror.ErrTrailingData) {
+		t.Errorf("UnpackSubmitBatch: got error %v, want %v", err, lightmirror.ErrTrailingData)
+	}
+}
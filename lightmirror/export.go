@@ -0,0 +1,149 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// The parse statuses of the rows of ExportPowerParamsCSV.
+const (
+	powerStatusOK        = "ok"
+	powerStatusMultiple  = "multiple"
+	powerStatusNone      = "none"
+	powerStatusMalformed = "malformed"
+	powerStatusStripped  = "stripped"
+)
+
+// powerParamsHeader is the header row of ExportPowerParamsCSV.
+var powerParamsHeader = []string{"height", "block_hash", "timestamp",
+	"candidate", "reward", "core_block_hash", "status"}
+
+// ExportPowerParamsCSV writes to w, as CSV, a row for every mirror of store
+// at a height in [startHeight, endHeight], following a header row.  A row
+// holds the height, the block hash as block explorers print it, the block
+// timestamp in RFC 3339, the power parameters ParsePowerParams returns and
+// the parse status of the coinbase:
+//
+//	ok         the coinbase carries power parameters
+//	multiple   it carries several, the row holding those ParsePowerParams
+//	           returns
+//	none       it carries none
+//	malformed  it carries none, but a CORE output or witness item which
+//	           does not parse
+//	stripped   it carries none in its outputs, and its witness, which may,
+//	           was stripped
+//
+// The address and hash columns are empty unless the status is ok or
+// multiple.  The rows are written as the store is iterated, not gathered
+// first.
+func ExportPowerParamsCSV(w io.Writer, store Store, startHeight, endHeight int64) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(powerParamsHeader); err != nil {
+		return err
+	}
+	err := store.Iterate(startHeight, endHeight, func(height int64, m *BtcLightMirrorV2) error {
+		return cw.Write(powerParamsRow(height, m))
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// powerParamsRow returns the row of ExportPowerParamsCSV of the mirror m at
+// height.
+func powerParamsRow(height int64, m *BtcLightMirrorV2) []string {
+	row := []string{
+		strconv.FormatInt(height, 10),
+		m.BtcHeader.BlockHash().String(),
+		m.BtcHeader.Timestamp.UTC().Format(time.RFC3339),
+		"", "", "", "",
+	}
+	d, status := m.powerStatus()
+	if d != nil {
+		row[3] = d.Candidate.Hex()
+		row[4] = d.Reward.Hex()
+		row[5] = d.CoreBlockHash.Hex()
+	}
+	row[6] = status
+	return row
+}
+
+// powerStatus returns the power parameters ParsePowerParams returns, or nil
+// if the coinbase has none, and the parse status of ExportPowerParamsCSV.
+func (light *BtcLightMirrorV2) powerStatus() (*Delegation, string) {
+	d, err := light.ParseDelegation(PreferOutput)
+	switch {
+	case errors.Is(err, ErrWitnessStripped):
+		return nil, powerStatusStripped
+	case err != nil && light.hasMalformedDelegation():
+		return nil, powerStatusMalformed
+	case err != nil:
+		return nil, powerStatusNone
+	case light.delegationCount() > 1:
+		return d, powerStatusMultiple
+	}
+	return d, powerStatusOK
+}
+
+// delegationCount returns the number of CORE outputs and CORE witness items
+// of the coinbase which parse.
+func (light *BtcLightMirrorV2) delegationCount() int {
+	n := 0
+	light.forEachPowerCandidate(ParserConfig{}, func(d *Delegation) {
+		if d != nil {
+			n++
+		}
+	})
+	return n
+}
+
+// hasMalformedDelegation reports whether the coinbase has a CORE output or
+// CORE witness item, one starting with powerMagicString, which does not
+// parse.
+func (light *BtcLightMirrorV2) hasMalformedDelegation() bool {
+	malformed := false
+	light.forEachPowerCandidate(ParserConfig{}, func(d *Delegation) {
+		malformed = malformed || d == nil
+	})
+	return malformed
+}
+
+// forEachPowerCandidate calls fn for every output following the first
+// output and every witness item following the reserved value of the
+// coinbase whose payload starts with a tag of parser, with its power
+// parameters, or nil if it does not parse.
+func (light *BtcLightMirrorV2) forEachPowerCandidate(parser ParserConfig, fn func(d *Delegation)) {
+	tx := light.Coinbase()
+	for i, txout := range tx.TxOut {
+		if i == 0 || txout == nil {
+			continue
+		}
+		pk := txout.PkScript
+		if len(pk) < 2 || pk[0] != txscript.OP_RETURN {
+			continue
+		}
+		data, _, ok := powerPush(pk)
+		if parser.hasTag(pk[2:]) || ok && parser.hasTag(data) {
+			fn(parser.parseScript(pk, false))
+		}
+	}
+	if len(tx.TxIn) == 0 || tx.TxIn[0] == nil || len(tx.TxIn[0].Witness) == 0 {
+		return
+	}
+	for _, item := range tx.TxIn[0].Witness[1:] {
+		if parser.hasTag(item) {
+			fn(parser.parsePayload(item))
+		}
+	}
+}
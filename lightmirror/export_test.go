@@ -0,0 +1,107 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestExportPowerParamsCSV(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	other := common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	commitment := append(append([]byte(nil), witnessCommitmentHeader...), make([]byte, 32)...)
+
+	// newMirror returns a mirror at seed whose coinbase has the given
+	// extra outputs.
+	newMirror := func(seed uint32, pkScripts ...[]byte) *BtcLightMirrorV2 {
+		m := newTestMirror(chainhash.Hash{}, seed, 1)
+		for _, pk := range pkScripts {
+			m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, pk))
+		}
+		return m
+	}
+	stripped := newMirror(4, commitment)
+	stripped.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	if err := AddWitnessDelegation(&stripped.CoinBaseTx, candidate, reward, coreBlockHash); err != nil {
+		t.Fatalf("AddWitnessDelegation error %v", err)
+	}
+	stripped.CoinBaseTx.TxIn[0].Witness = nil
+	truncated := corePkScript(candidate, reward, nil)[:30]
+
+	tests := []struct {
+		m       *BtcLightMirrorV2
+		height  int64
+		params  []string
+		status  string
+		comment string
+	}{
+		{newMirror(1), 100, []string{"", "", ""}, "none", "no delegation"},
+		{newMirror(2, corePkScript(candidate, reward, coreBlockHash[:])), 101,
+			[]string{candidate.Hex(), reward.Hex(), coreBlockHash.Hex()}, "ok", "one delegation"},
+		{newMirror(3, corePkScript(other, other, nil), corePkScript(candidate, reward, nil)), 102,
+			[]string{other.Hex(), other.Hex(), common.Hash{}.Hex()}, "multiple", "two delegations"},
+		{stripped, 103, []string{"", "", ""}, "stripped", "stripped witness"},
+		{newMirror(5, truncated), 104, []string{"", "", ""}, "malformed", "truncated delegation"},
+		{newMirror(6, truncated, corePkScript(candidate, reward, nil)), 105,
+			[]string{candidate.Hex(), reward.Hex(), common.Hash{}.Hex()}, "ok", "truncated and valid"},
+	}
+	store := newMemStore()
+	for _, test := range tests {
+		if err := store.Put(test.m, test.height); err != nil {
+			t.Fatalf("Put error %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportPowerParamsCSV(&buf, store, 100, 200); err != nil {
+		t.Fatalf("ExportPowerParamsCSV error %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll error %v", err)
+	}
+	if len(records) != len(tests)+1 {
+		t.Fatalf("got %d records, want %d", len(records), len(tests)+1)
+	}
+	if !reflect.DeepEqual(records[0], powerParamsHeader) {
+		t.Errorf("header: got %v, want %v", records[0], powerParamsHeader)
+	}
+	for i, test := range tests {
+		want := append([]string{
+			strconv.FormatInt(test.height, 10),
+			test.m.BtcHeader.BlockHash().String(),
+			test.m.BtcHeader.Timestamp.UTC().Format(time.RFC3339),
+		}, append(test.params, test.status)...)
+		if !reflect.DeepEqual(records[i+1], want) {
+			t.Errorf("row #%d (%s): got %v, want %v", i, test.comment, records[i+1], want)
+		}
+	}
+
+	// The range bounds the rows.
+	buf.Reset()
+	if err := ExportPowerParamsCSV(&buf, store, 101, 102); err != nil {
+		t.Fatalf("ExportPowerParamsCSV error %v", err)
+	}
+	if records, _ := csv.NewReader(&buf).ReadAll(); len(records) != 3 ||
+		records[1][0] != "101" || records[2][0] != "102" {
+		t.Errorf("range: got %v", records)
+	}
+
+	if err := ExportPowerParamsCSV(failingWriter{}, store, 100, 200); !errors.Is(err, errWrite) {
+		t.Errorf("failing writer: got error %v, want %v", err, errWrite)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ExportHeadersFile writes to w the headers of the best chain blocks at the
+// heights in [startHeight, endHeight], in height order, each in its 80 byte
+// serialization: the flat file ImportHeadersFile reads.  The headers come
+// one at a time from the height index of the chain, which also holds those
+// of the pruned and header-only blocks the store iterator skips, so the
+// written range has no gap.
+//
+// It refuses, before writing anything, a range starting before the anchor
+// with ErrHeightBeforeAnchor and one ending past the tip with
+// ErrHeightBeyondTip.  It fails if a reorganization replaces blocks of the
+// range while it runs, rather than writing headers which do not link.
+func ExportHeadersFile(w io.Writer, chain *MirrorChain, startHeight, endHeight int64) error {
+	if endHeight < startHeight {
+		return fmt.Errorf("invalid height range [%d, %d]", startHeight, endHeight)
+	}
+	_, anchor := chain.Anchor()
+	_, tip := chain.Tip()
+	switch {
+	case startHeight < anchor:
+		return fmt.Errorf("start height %d, anchor at %d: %w", startHeight,
+			anchor, ErrHeightBeforeAnchor)
+	case endHeight > tip:
+		return fmt.Errorf("end height %d, tip at %d: %w", endHeight, tip,
+			ErrHeightBeyondTip)
+	}
+
+	bw := bufio.NewWriter(w)
+	var prev chainhash.Hash
+	for height := startHeight; height <= endHeight; height++ {
+		header, err := chain.HeaderByHeight(height)
+		if err != nil {
+			return fmt.Errorf("height %d: %w", height, err)
+		}
+		if height > startHeight && header.PrevBlock != prev {
+			return fmt.Errorf("block at height %d replaced during the export",
+				height-1)
+		}
+		if err := header.Serialize(bw); err != nil {
+			return err
+		}
+		prev = header.BlockHash()
+	}
+	return bw.Flush()
+}
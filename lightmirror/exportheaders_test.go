@@ -0,0 +1,65 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestExportHeadersFile(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	c := newTestChain(t, mirrors[:3])
+	for _, m := range mirrors[3:] {
+		if _, err := c.AppendHeaderOnly(m.BtcHeader); err != nil {
+			t.Fatalf("AppendHeaderOnly error %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportHeadersFile(&buf, c, testAnchorHeight, testAnchorHeight+5); err != nil {
+		t.Fatalf("ExportHeadersFile error %v", err)
+	}
+	if want := headersFile(t, mirrors); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("ExportHeadersFile: got %x, want %x", buf.Bytes(), want)
+	}
+
+	// The export imports into a fresh chain with the same anchor, which
+	// ends up with the same tip.
+	fresh := newTestChain(t, mirrors[:1])
+	n, err := ImportHeadersFile(&buf, fresh)
+	if err != nil || n != 5 {
+		t.Fatalf("ImportHeadersFile: got %d headers, error %v, want 5", n, err)
+	}
+	_, height := c.Tip()
+	_, freshHeight := fresh.Tip()
+	tip, _ := c.HashAtHeight(height)
+	freshTip, _ := fresh.HashAtHeight(freshHeight)
+	if freshTip != tip || freshHeight != height {
+		t.Errorf("imported tip: got %v at %d, want %v at %d", freshTip, freshHeight, tip, height)
+	}
+
+	tests := []struct {
+		start, end int64
+		err        error
+	}{
+		{testAnchorHeight - 1, testAnchorHeight + 2, ErrHeightBeforeAnchor},
+		{testAnchorHeight + 2, testAnchorHeight + 6, ErrHeightBeyondTip},
+		{testAnchorHeight + 2, testAnchorHeight + 1, nil},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		err := ExportHeadersFile(&buf, c, test.start, test.end)
+		if err == nil || test.err != nil && !errors.Is(err, test.err) || buf.Len() != 0 {
+			t.Errorf("ExportHeadersFile [%d, %d]: got error %v after %d bytes, want %v",
+				test.start, test.end, err, buf.Len(), test.err)
+		}
+	}
+
+	if err := ExportHeadersFile(failingWriter{}, c, testAnchorHeight, testAnchorHeight); !errors.Is(err, errWrite) {
+		t.Errorf("ExportHeadersFile to a failing writer: got error %v, want %v", err, errWrite)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Fetcher builds mirrors from an upstream source of Bitcoin block data such
+// as a bitcoind node.
+type Fetcher interface {
+	// FetchByHash returns the mirror of the block with the given hash.
+	FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error)
+
+	// FetchByHeight returns the mirror of the block the upstream source
+	// currently has at the given height on its best chain.
+	FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error)
+}
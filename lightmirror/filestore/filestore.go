@@ -0,0 +1,522 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package filestore implements lightmirror.Store as one append-only data file
+// plus an index file, which suits archival dumps that are copied around with
+// ordinary file tools.
+//
+// The data file is a sequence of records:
+//
+//	length   uint32 little endian, size of the body
+//	checksum uint32 little endian, CRC-32C of the body
+//	body     kind byte, height int64 little endian, payload
+//
+// A put record carries the serialized mirror as payload, a delete record the
+// block hash.  Replaying the records in order yields the store content, so
+// the index file is only a cache: it is rebuilt from the data file whenever
+// it is missing, damaged or does not cover the whole data file.
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+const (
+	dataFileName  = "mirrors.dat"
+	indexFileName = "mirrors.idx"
+
+	recordHeaderSize = 8
+	bodyHeaderSize   = 1 + 8
+
+	// maxRecordSize bounds the body length accepted while scanning, so
+	// that a torn length field can not make us allocate gigabytes.
+	maxRecordSize = bodyHeaderSize + wire.MaxBlockPayload
+
+	kindPut    = 1
+	kindDelete = 2
+
+	indexMagic   = "LMIX"
+	indexVersion = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// entry locates the put record of a live mirror in the data file.
+type entry struct {
+	height int64
+	offset int64
+	length uint32
+}
+
+// Store is a lightmirror.Store kept in an append-only file.  Any number of
+// goroutines may read while one writes.
+type Store struct {
+	dir  string
+	file *os.File
+
+	mtx      sync.RWMutex
+	size     int64
+	byHash   map[chainhash.Hash]entry
+	byHeight map[int64]chainhash.Hash
+	tip      int64
+	closed   bool
+}
+
+var _ lightmirror.Store = (*Store)(nil)
+
+// Open opens, creating it if necessary, the store kept in dir.  A torn final
+// record left behind by a crash is truncated away.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, dataFileName),
+		os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:      dir,
+		file:     file,
+		byHash:   make(map[chainhash.Hash]entry),
+		byHeight: make(map[int64]chainhash.Hash),
+		tip:      -1,
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load restores the index from the index file when it is usable and scans
+// the part of the data file it does not cover.
+func (s *Store) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	dataSize := info.Size()
+
+	from := int64(0)
+	if covered, ok := s.readIndex(); ok && covered <= dataSize {
+		from = covered
+	} else {
+		s.byHash = make(map[chainhash.Hash]entry)
+		s.byHeight = make(map[int64]chainhash.Hash)
+		s.tip = -1
+	}
+
+	end, err := s.scan(from, dataSize)
+	if err != nil {
+		return err
+	}
+	if end != dataSize {
+		if err := s.file.Truncate(end); err != nil {
+			return err
+		}
+	}
+	s.size = end
+	return nil
+}
+
+// scan replays the records in [from, dataSize) and returns the offset just
+// past the last complete record.  A corrupt record that is followed by more
+// data is not a torn write and is reported as an error.
+func (s *Store) scan(from, dataSize int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.file, from, dataSize-from))
+	offset := from
+	var header [recordHeaderSize]byte
+	for offset < dataSize {
+		if dataSize-offset < recordHeaderSize {
+			return offset, nil
+		}
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		end := offset + recordHeaderSize + int64(length)
+		if length > maxRecordSize || end > dataSize {
+			return offset, nil
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return 0, err
+		}
+		if crc32.Checksum(body, castagnoli) != checksum || length < bodyHeaderSize {
+			if end == dataSize {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("corrupt record at offset %d", offset)
+		}
+
+		height := int64(binary.LittleEndian.Uint64(body[1:9]))
+		switch body[0] {
+		case kindPut:
+			m, err := lightmirror.DeserializeBytes(body[bodyHeaderSize:])
+			if err != nil {
+				return 0, fmt.Errorf("corrupt mirror at offset %d: %v",
+					offset, err)
+			}
+			s.applyPut(m.BtcHeader.BlockHash(), entry{
+				height: height,
+				offset: offset,
+				length: length,
+			})
+
+		case kindDelete:
+			var hash chainhash.Hash
+			if len(body) != bodyHeaderSize+chainhash.HashSize {
+				return 0, fmt.Errorf("corrupt delete record at offset %d",
+					offset)
+			}
+			copy(hash[:], body[bodyHeaderSize:])
+			s.applyDelete(hash)
+
+		default:
+			return 0, fmt.Errorf("unknown record kind %d at offset %d",
+				body[0], offset)
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+// applyPut records a put in the in-memory index.
+func (s *Store) applyPut(hash chainhash.Hash, e entry) {
+	if old, ok := s.byHeight[e.height]; ok && old != hash {
+		delete(s.byHash, old)
+	}
+	if old, ok := s.byHash[hash]; ok && old.height != e.height {
+		delete(s.byHeight, old.height)
+	}
+	s.byHash[hash] = e
+	s.byHeight[e.height] = hash
+	if e.height > s.tip {
+		s.tip = e.height
+	} else {
+		s.updateTip()
+	}
+}
+
+// applyDelete records a delete in the in-memory index.
+func (s *Store) applyDelete(hash chainhash.Hash) {
+	e, ok := s.byHash[hash]
+	if !ok {
+		return
+	}
+	delete(s.byHash, hash)
+	delete(s.byHeight, e.height)
+	if e.height == s.tip {
+		s.updateTip()
+	}
+}
+
+func (s *Store) updateTip() {
+	s.tip = -1
+	for height := range s.byHeight {
+		if height > s.tip {
+			s.tip = height
+		}
+	}
+}
+
+// append writes one record at the end of the data file.
+func (s *Store) append(kind byte, height int64, payload []byte) (int64, uint32, error) {
+	length := uint32(bodyHeaderSize + len(payload))
+	record := make([]byte, recordHeaderSize+int(length))
+	body := record[recordHeaderSize:]
+	body[0] = kind
+	binary.LittleEndian.PutUint64(body[1:9], uint64(height))
+	copy(body[bodyHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[0:4], length)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(body, castagnoli))
+
+	offset := s.size
+	if _, err := s.file.WriteAt(record, offset); err != nil {
+		// Drop whatever part of the record made it to the file.
+		s.file.Truncate(offset)
+		return 0, 0, err
+	}
+	s.size += int64(len(record))
+	return offset, length, nil
+}
+
+// Put appends the mirror to the data file at the given height.
+func (s *Store) Put(m *lightmirror.BtcLightMirrorV2, height int64) error {
+	if height < 0 {
+		return fmt.Errorf("invalid height %d", height)
+	}
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	offset, length, err := s.append(kindPut, height, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	s.applyPut(m.BtcHeader.BlockHash(), entry{
+		height: height,
+		offset: offset,
+		length: length,
+	})
+	return nil
+}
+
+// ByHash returns the mirror with the given block hash and its height.
+func (s *Store) ByHash(hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, int64, error) {
+	s.mtx.RLock()
+	e, ok := s.byHash[hash]
+	closed := s.closed
+	s.mtx.RUnlock()
+	if closed {
+		return nil, 0, os.ErrClosed
+	}
+	if !ok {
+		return nil, 0, lightmirror.ErrNotFound
+	}
+	m, err := s.read(hash, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, e.height, nil
+}
+
+// ByHeight returns the mirror stored at the given height.
+func (s *Store) ByHeight(height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	s.mtx.RLock()
+	hash, ok := s.byHeight[height]
+	e := s.byHash[hash]
+	closed := s.closed
+	s.mtx.RUnlock()
+	if closed {
+		return nil, os.ErrClosed
+	}
+	if !ok {
+		return nil, lightmirror.ErrNotFound
+	}
+	return s.read(hash, e)
+}
+
+// Tip returns the mirror with the greatest height and that height.
+func (s *Store) Tip() (*lightmirror.BtcLightMirrorV2, int64, error) {
+	s.mtx.RLock()
+	height := s.tip
+	hash := s.byHeight[height]
+	e := s.byHash[hash]
+	closed := s.closed
+	s.mtx.RUnlock()
+	if closed {
+		return nil, 0, os.ErrClosed
+	}
+	if height < 0 {
+		return nil, 0, lightmirror.ErrNotFound
+	}
+	m, err := s.read(hash, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, height, nil
+}
+
+// Delete appends a delete record for the mirror with the given block hash.
+func (s *Store) Delete(hash chainhash.Hash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	e, ok := s.byHash[hash]
+	if !ok {
+		return lightmirror.ErrNotFound
+	}
+	if _, _, err := s.append(kindDelete, e.height, hash[:]); err != nil {
+		return err
+	}
+	s.applyDelete(hash)
+	return nil
+}
+
+// Iterate calls fn for every mirror stored at a height in [start, end], in
+// height order.  The records in range are located under the lock, then read
+// without it: since records are never rewritten, the scan sees the store as
+// it was when Iterate was called.
+func (s *Store) Iterate(start, end int64, fn func(height int64, m *lightmirror.BtcLightMirrorV2) error) error {
+	if start < 0 {
+		start = 0
+	}
+
+	type located struct {
+		hash chainhash.Hash
+		e    entry
+	}
+	s.mtx.RLock()
+	if s.closed {
+		s.mtx.RUnlock()
+		return os.ErrClosed
+	}
+	if end > s.tip {
+		end = s.tip
+	}
+	var records []located
+	for height := start; height <= end; height++ {
+		if hash, ok := s.byHeight[height]; ok {
+			records = append(records, located{hash, s.byHash[hash]})
+		}
+	}
+	s.mtx.RUnlock()
+
+	for _, r := range records {
+		m, err := s.read(r.hash, r.e)
+		if err != nil {
+			return err
+		}
+		if err := fn(r.e.height, m); err != nil {
+			if errors.Is(err, lightmirror.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// read decodes the put record described by e.  Records are never rewritten,
+// so the read does not need to hold the lock.
+func (s *Store) read(hash chainhash.Hash, e entry) (*lightmirror.BtcLightMirrorV2, error) {
+	record := make([]byte, recordHeaderSize+int(e.length))
+	if _, err := s.file.ReadAt(record, e.offset); err != nil {
+		return nil, &lightmirror.CorruptRecordError{Key: hash[:], Err: err}
+	}
+	body := record[recordHeaderSize:]
+	if binary.LittleEndian.Uint32(record[0:4]) != e.length ||
+		crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(record[4:8]) {
+
+		return nil, &lightmirror.CorruptRecordError{
+			Key: hash[:],
+			Err: fmt.Errorf("checksum mismatch at offset %d", e.offset),
+		}
+	}
+
+	m, err := lightmirror.DeserializeBytes(body[bodyHeaderSize:])
+	if err != nil {
+		return nil, &lightmirror.CorruptRecordError{Key: hash[:], Err: err}
+	}
+	return m, nil
+}
+
+// Close syncs the data file, writes the index file and closes the store.
+func (s *Store) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.file.Sync()
+	if err == nil {
+		err = s.writeIndex()
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeIndex stores the in-memory index next to the data file.  The file is
+// written under a temporary name and renamed so it is never seen half
+// written.
+func (s *Store) writeIndex() error {
+	var buf bytes.Buffer
+	buf.WriteString(indexMagic)
+	buf.WriteByte(indexVersion)
+	binary.Write(&buf, binary.LittleEndian, uint64(s.size))
+	binary.Write(&buf, binary.LittleEndian, uint64(len(s.byHash)))
+	for hash, e := range s.byHash {
+		buf.Write(hash[:])
+		binary.Write(&buf, binary.LittleEndian, e.height)
+		binary.Write(&buf, binary.LittleEndian, e.offset)
+		binary.Write(&buf, binary.LittleEndian, e.length)
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), castagnoli))
+
+	path := filepath.Join(s.dir, indexFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readIndex loads the index file into s and returns the size of the data
+// file it covers.  It reports false when the file is missing or unusable.
+func (s *Store) readIndex() (int64, bool) {
+	data, err := os.ReadFile(filepath.Join(s.dir, indexFileName))
+	if err != nil {
+		return 0, false
+	}
+
+	const (
+		headerSize = len(indexMagic) + 1 + 8 + 8
+		entrySize  = chainhash.HashSize + 8 + 8 + 4
+	)
+	if len(data) < headerSize+4 {
+		return 0, false
+	}
+	payload, checksum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(checksum) {
+		return 0, false
+	}
+	if string(payload[:4]) != indexMagic || payload[4] != indexVersion {
+		return 0, false
+	}
+	covered := int64(binary.LittleEndian.Uint64(payload[5:13]))
+	count := binary.LittleEndian.Uint64(payload[13:21])
+	entries := payload[headerSize:]
+	if uint64(len(entries)) != count*entrySize {
+		return 0, false
+	}
+
+	for len(entries) > 0 {
+		var hash chainhash.Hash
+		copy(hash[:], entries[:32])
+		e := entry{
+			height: int64(binary.LittleEndian.Uint64(entries[32:40])),
+			offset: int64(binary.LittleEndian.Uint64(entries[40:48])),
+			length: binary.LittleEndian.Uint32(entries[48:52]),
+		}
+		s.byHash[hash] = e
+		s.byHeight[e.height] = hash
+		if e.height > s.tip {
+			s.tip = e.height
+		}
+		entries = entries[entrySize:]
+	}
+	return covered, true
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) lightmirror.Store {
+		s, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatalf("Open error %v", err)
+		}
+		return s
+	})
+}
+
+// fill opens a store in dir and puts mirrors at heights 0..n-1.
+func fill(t *testing.T, dir string, mirrors []*lightmirror.BtcLightMirrorV2) *Store {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	return s
+}
+
+// checkTip asserts that the store in dir reopens with the given tip.
+func checkTip(t *testing.T, dir string, want *lightmirror.BtcLightMirrorV2, wantHeight int64) {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != wantHeight || tip.BtcHeader.BlockHash() != want.BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d, want %v at height %d",
+			tip.BtcHeader.BlockHash(), height, want.BtcHeader.BlockHash(),
+			wantHeight)
+	}
+	for h := int64(0); h <= wantHeight; h++ {
+		if _, err := s.ByHeight(h); err != nil {
+			t.Errorf("ByHeight(%d) error %v", h, err)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	mirrors := storetest.Mirrors(5)
+	s := fill(t, dir, mirrors)
+	if err := s.Delete(mirrors[4].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+	checkTip(t, dir, mirrors[3], 3)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	mirrors := storetest.Mirrors(5)
+	s := fill(t, dir, mirrors)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	// Missing index.
+	if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil {
+		t.Fatalf("Remove error %v", err)
+	}
+	checkTip(t, dir, mirrors[4], 4)
+
+	// Damaged index.
+	path := filepath.Join(dir, indexFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile error %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile error %v", err)
+	}
+	checkTip(t, dir, mirrors[4], 4)
+}
+
+func TestStaleIndex(t *testing.T) {
+	dir := t.TempDir()
+	mirrors := storetest.Mirrors(6)
+	s := fill(t, dir, mirrors[:3])
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+	stale, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatalf("ReadFile error %v", err)
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	for i := 3; i < len(mirrors); i++ {
+		if err := s.Put(mirrors[i], int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	// Put back the index written before the last three mirrors, as if
+	// the process had crashed before closing.
+	err = os.WriteFile(filepath.Join(dir, indexFileName), stale, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile error %v", err)
+	}
+	checkTip(t, dir, mirrors[5], 5)
+}
+
+func TestTornWrite(t *testing.T) {
+	mirrors := storetest.Mirrors(4)
+
+	tests := []struct {
+		name  string
+		dirty func(t *testing.T, path string)
+	}{
+		{"PartialHeader", func(t *testing.T, path string) {
+			appendBytes(t, path, []byte{0x10, 0x00, 0x00})
+		}},
+		{"PartialBody", func(t *testing.T, path string) {
+			truncateBy(t, path, 25)
+		}},
+		{"BadChecksum", func(t *testing.T, path string) {
+			flipLastByte(t, path)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := fill(t, dir, mirrors)
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close error %v", err)
+			}
+			os.Remove(filepath.Join(dir, indexFileName))
+			path := filepath.Join(dir, dataFileName)
+			test.dirty(t, path)
+
+			wantTip, wantHeight := mirrors[3], int64(3)
+			if test.name != "PartialHeader" {
+				// The torn record is the last mirror.
+				wantTip, wantHeight = mirrors[2], 2
+			}
+			checkTip(t, dir, wantTip, wantHeight)
+
+			// The store accepts appends after the truncation.
+			s, err := Open(dir)
+			if err != nil {
+				t.Fatalf("Open error %v", err)
+			}
+			if err := s.Put(mirrors[3], 3); err != nil {
+				t.Fatalf("Put error %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close error %v", err)
+			}
+			os.Remove(filepath.Join(dir, indexFileName))
+			checkTip(t, dir, mirrors[3], 3)
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile error %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatalf("Write error %v", err)
+	}
+}
+
+func truncateBy(t *testing.T, path string, n int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat error %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-n); err != nil {
+		t.Fatalf("Truncate error %v", err)
+	}
+}
+
+func flipLastByte(t *testing.T, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile error %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile error %v", err)
+	}
+}
+
+func TestCorruptMiddleRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := fill(t, dir, storetest.Mirrors(3))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+	os.Remove(filepath.Join(dir, indexFileName))
+
+	path := filepath.Join(dir, dataFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile error %v", err)
+	}
+	data[recordHeaderSize+bodyHeaderSize+4] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile error %v", err)
+	}
+
+	if _, err := Open(dir); err == nil {
+		t.Fatalf("Open: expected error for a corrupt record in the middle")
+	}
+}
+
+func TestConcurrentReaders(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	mirrors := storetest.Mirrors(200)
+	if err := s.Put(mirrors[0], 0); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tip, height, err := s.Tip()
+				if err != nil {
+					t.Errorf("Tip error %v", err)
+					return
+				}
+				if tip.BtcHeader.BlockHash() != mirrors[height].BtcHeader.BlockHash() {
+					t.Errorf("Tip: wrong mirror at height %d", height)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < len(mirrors); i++ {
+		if err := s.Put(mirrors[i], int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+)
+
+// DefaultTimestampSkew is the default allowance for the skew of block
+// timestamps, which consensus lets run up to two hours ahead of the network
+// time and miners commonly set behind it.
+const DefaultTimestampSkew = blockchain.MaxTimeOffsetSeconds * time.Second
+
+// ErrStaleTip is returned by TipFreshness when the tip of the chain is older
+// than the maximum age set by WithMaxTipAge, plus the timestamp skew.
+var ErrStaleTip = errors.New("chain tip is stale")
+
+// WithMaxTipAge makes TipFreshness fail with ErrStaleTip when the timestamp
+// of the tip is more than maxAge, plus the timestamp skew, before the time it
+// is given.  A zero maxAge, the default, never fails.
+func WithMaxTipAge(maxAge time.Duration) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.maxTipAge = maxAge
+	}
+}
+
+// WithTimestampSkew sets the allowance for the skew of block timestamps
+// TipFreshness adds to the maximum age of the tip, DefaultTimestampSkew by
+// default.
+func WithTimestampSkew(skew time.Duration) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.timestampSkew = skew
+	}
+}
+
+// IsStale reports whether the timestamp of the header is more than maxAge,
+// plus DefaultTimestampSkew, before now.  A timestamp after now is never
+// stale.
+func (light *BtcLightMirrorV2) IsStale(now time.Time, maxAge time.Duration) bool {
+	return isStale(now.Sub(light.BtcHeader.Timestamp), maxAge, DefaultTimestampSkew)
+}
+
+// isStale reports whether age exceeds maxAge plus skew.
+func isStale(age, maxAge, skew time.Duration) bool {
+	return age > maxAge+skew
+}
+
+// TipFreshness returns the age of the tip at now, the time elapsed since its
+// timestamp, which is negative for a timestamp after now.  With
+// WithMaxTipAge, it fails with ErrStaleTip, along with the age, when the tip
+// is older than the maximum age plus the timestamp skew.
+func (c *MirrorChain) TipFreshness(now time.Time) (time.Duration, error) {
+	c.mtx.RLock()
+	header := c.tip.header
+	c.mtx.RUnlock()
+
+	age := now.Sub(header.Timestamp)
+	if c.cfg.maxTipAge > 0 && isStale(age, c.cfg.maxTipAge, c.cfg.timestampSkew) {
+		return age, fmt.Errorf("tip %v is %v old: %w", header.BlockHash(),
+			age, ErrStaleTip)
+	}
+	return age, nil
+}
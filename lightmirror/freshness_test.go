@@ -0,0 +1,79 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestIsStale(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	stamp := m.BtcHeader.Timestamp
+	maxAge := time.Hour
+	threshold := maxAge + DefaultTimestampSkew
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"at the timestamp", stamp, false},
+		{"timestamp ahead", stamp.Add(-time.Minute), false},
+		{"timestamp far ahead", stamp.Add(-24 * time.Hour), false},
+		{"within max age", stamp.Add(maxAge), false},
+		{"within skew", stamp.Add(maxAge + time.Hour), false},
+		{"at threshold", stamp.Add(threshold), false},
+		{"past threshold", stamp.Add(threshold + time.Second), true},
+		{"day old", stamp.Add(24 * time.Hour), true},
+	}
+	for _, test := range tests {
+		if got := m.IsStale(test.now, maxAge); got != test.want {
+			t.Errorf("IsStale (%s): got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTipFreshness(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	stamp := mirrors[2].BtcHeader.Timestamp
+	maxAge := time.Hour
+
+	tests := []struct {
+		name string
+		opts []ChainOption
+		now  time.Time
+		age  time.Duration
+		err  error
+	}{
+		{"no max age", nil, stamp.Add(24 * time.Hour), 24 * time.Hour, nil},
+		{"fresh", []ChainOption{WithMaxTipAge(maxAge)}, stamp.Add(time.Minute), time.Minute, nil},
+		{"future", []ChainOption{WithMaxTipAge(maxAge)}, stamp.Add(-time.Minute), -time.Minute, nil},
+		{"within skew", []ChainOption{WithMaxTipAge(maxAge)}, stamp.Add(maxAge + DefaultTimestampSkew), maxAge + DefaultTimestampSkew, nil},
+		{"past skew", []ChainOption{WithMaxTipAge(maxAge)}, stamp.Add(maxAge + DefaultTimestampSkew + time.Second), maxAge + DefaultTimestampSkew + time.Second, ErrStaleTip},
+		{"no skew at max age", []ChainOption{WithMaxTipAge(maxAge), WithTimestampSkew(0)}, stamp.Add(maxAge), maxAge, nil},
+		{"no skew past max age", []ChainOption{WithMaxTipAge(maxAge), WithTimestampSkew(0)}, stamp.Add(maxAge + time.Second), maxAge + time.Second, ErrStaleTip},
+		{"custom skew", []ChainOption{WithMaxTipAge(maxAge), WithTimestampSkew(10 * time.Minute)}, stamp.Add(maxAge + 11*time.Minute), maxAge + 11*time.Minute, ErrStaleTip},
+	}
+	for _, test := range tests {
+		c := newTestChain(t, mirrors, test.opts...)
+		age, err := c.TipFreshness(test.now)
+		if !errors.Is(err, test.err) {
+			t.Errorf("TipFreshness (%s): got error %v, want %v", test.name, err, test.err)
+		}
+		if age != test.age {
+			t.Errorf("TipFreshness (%s): got age %v, want %v", test.name, age, test.age)
+		}
+	}
+
+	for _, opt := range []ChainOption{WithMaxTipAge(-time.Second), WithTimestampSkew(-time.Second)} {
+		if _, err := NewMirrorChain(mirrors[0], testAnchorHeight, opt); err == nil {
+			t.Errorf("NewMirrorChain: expected error")
+		}
+	}
+}
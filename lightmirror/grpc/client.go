@@ -0,0 +1,144 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Client is a MirrorServiceClient exchanging lightmirror types.  The chain
+// errors the server reports, lightmirror.ErrUnknownBlock, ErrHeightBeyondTip,
+// ErrHeightBeforeAnchor, ErrPruned and ErrHeaderOnly, are returned as such.
+type Client struct {
+	rpc MirrorServiceClient
+}
+
+// NewClient returns a client of the service served on cc.
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{rpc: NewMirrorServiceClient(cc)}
+}
+
+// ByHash returns the block with the given hash and its height.
+func (c *Client) ByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, int64, error) {
+	resp, err := c.rpc.GetMirrorByHash(ctx, &GetMirrorByHashRequest{Hash: hash[:]})
+	if err != nil {
+		return nil, 0, chainError(err)
+	}
+	m, err := decodeMirror(resp.Mirror)
+	return m, resp.Height, err
+}
+
+// ByHeight returns the block of the best chain at the given height.
+func (c *Client) ByHeight(ctx context.Context, height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	resp, err := c.rpc.GetMirrorByHeight(ctx, &GetMirrorByHeightRequest{Height: height})
+	if err != nil {
+		return nil, chainError(err)
+	}
+	return decodeMirror(resp.Mirror)
+}
+
+// Tip returns the tip of the best chain, nil for a header-only block, and its
+// hash and height.
+func (c *Client) Tip(ctx context.Context) (*lightmirror.BtcLightMirrorV2, chainhash.Hash, int64, error) {
+	resp, err := c.rpc.GetTip(ctx, &GetTipRequest{})
+	if err != nil {
+		return nil, chainhash.Hash{}, 0, chainError(err)
+	}
+	hash, err := chainhash.NewHash(resp.Hash)
+	if err != nil {
+		return nil, chainhash.Hash{}, 0, fmt.Errorf("tip hash: %v", err)
+	}
+	if len(resp.Mirror) == 0 {
+		return nil, *hash, resp.Height, nil
+	}
+	m, err := decodeMirror(resp.Mirror)
+	return m, *hash, resp.Height, err
+}
+
+// Validate returns the report of the checks the chain of the server runs on
+// m.
+func (c *Client) Validate(ctx context.Context, m *lightmirror.BtcLightMirrorV2) (*ValidationReport, error) {
+	b, err := m.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return c.rpc.ValidateMirror(ctx, &ValidateMirrorRequest{Mirror: b})
+}
+
+// Subscribe returns the subscription to the changes of the best chain, which
+// lasts until ctx is done.  It returns once the server subscribed, so that
+// the subscription receives every change made after it returns.
+func (c *Client) Subscribe(ctx context.Context) (*Subscription, error) {
+	stream, err := c.rpc.SubscribeMirrors(ctx, &SubscribeMirrorsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Header(); err != nil {
+		return nil, err
+	}
+	return &Subscription{stream: stream}, nil
+}
+
+// Subscription receives the changes of the best chain of the server.
+type Subscription struct {
+	stream MirrorService_SubscribeMirrorsClient
+}
+
+// Recv returns the next change of the best chain.  It returns io.EOF once the
+// server ends the stream, after a lightmirror.SubscriptionOverflow event.
+func (s *Subscription) Recv() (lightmirror.ChainEvent, error) {
+	msg, err := s.stream.Recv()
+	if err != nil {
+		return lightmirror.ChainEvent{}, err
+	}
+	if msg.Type == EventType_EVENT_TYPE_UNSPECIFIED {
+		return lightmirror.ChainEvent{}, errors.New("event of unspecified type")
+	}
+	hash, err := chainhash.NewHash(msg.Hash)
+	if err != nil {
+		return lightmirror.ChainEvent{}, fmt.Errorf("event hash: %v", err)
+	}
+	event := lightmirror.ChainEvent{
+		Type:   lightmirror.ChainEventType(msg.Type - 1),
+		Hash:   *hash,
+		Height: msg.Height,
+	}
+	if len(msg.Mirror) > 0 {
+		if event.Mirror, err = decodeMirror(msg.Mirror); err != nil {
+			return lightmirror.ChainEvent{}, err
+		}
+	}
+	return event, nil
+}
+
+// decodeMirror decodes a mirror of a response.
+func decodeMirror(b []byte) (*lightmirror.BtcLightMirrorV2, error) {
+	m, err := lightmirror.DeserializeBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %w", err)
+	}
+	return m, nil
+}
+
+// chainError maps the status errors of the chain errors back to them.
+func chainError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, e := range chainErrors {
+		if s.Code() == e.code && s.Message() == e.err.Error() {
+			return e.err
+		}
+	}
+	return err
+}
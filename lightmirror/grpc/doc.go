@@ -0,0 +1,10 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package grpc serves a lightmirror.MirrorChain over gRPC, for components
+// not written in Go, and holds a typed Go client of the service.  The
+// service is defined in mirror.proto, whose Go code is generated.
+package grpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative mirror.proto
@@ -0,0 +1,822 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.30.0
+// 	protoc        (unknown)
+// source: mirror.proto
+
+package grpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// EventType is lightmirror.ChainEventType, shifted by one to leave zero
+// unspecified.
+type EventType int32
+
+const (
+	EventType_EVENT_TYPE_UNSPECIFIED       EventType = 0
+	EventType_BLOCK_CONNECTED              EventType = 1
+	EventType_BLOCK_DISCONNECTED           EventType = 2
+	EventType_SUBSCRIPTION_OVERFLOW        EventType = 3
+	EventType_BODY_ATTACHED                EventType = 4
+	EventType_ORPHAN_ADOPTED               EventType = 5
+	EventType_ORPHAN_EVICTED               EventType = 6
+	EventType_DELEGATION_CONFLICT_DETECTED EventType = 7
+)
+
+// Enum value maps for EventType.
+var (
+	EventType_name = map[int32]string{
+		0: "EVENT_TYPE_UNSPECIFIED",
+		1: "BLOCK_CONNECTED",
+		2: "BLOCK_DISCONNECTED",
+		3: "SUBSCRIPTION_OVERFLOW",
+		4: "BODY_ATTACHED",
+		5: "ORPHAN_ADOPTED",
+		6: "ORPHAN_EVICTED",
+		7: "DELEGATION_CONFLICT_DETECTED",
+	}
+	EventType_value = map[string]int32{
+		"EVENT_TYPE_UNSPECIFIED":       0,
+		"BLOCK_CONNECTED":              1,
+		"BLOCK_DISCONNECTED":           2,
+		"SUBSCRIPTION_OVERFLOW":        3,
+		"BODY_ATTACHED":                4,
+		"ORPHAN_ADOPTED":               5,
+		"ORPHAN_EVICTED":               6,
+		"DELEGATION_CONFLICT_DETECTED": 7,
+	}
+)
+
+func (x EventType) Enum() *EventType {
+	p := new(EventType)
+	*p = x
+	return p
+}
+
+func (x EventType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (EventType) Descriptor() protoreflect.EnumDescriptor {
+	return file_mirror_proto_enumTypes[0].Descriptor()
+}
+
+func (EventType) Type() protoreflect.EnumType {
+	return &file_mirror_proto_enumTypes[0]
+}
+
+func (x EventType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use EventType.Descriptor instead.
+func (EventType) EnumDescriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{0}
+}
+
+type GetMirrorByHashRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Hash []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+}
+
+func (x *GetMirrorByHashRequest) Reset() {
+	*x = GetMirrorByHashRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetMirrorByHashRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetMirrorByHashRequest) ProtoMessage() {}
+
+func (x *GetMirrorByHashRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetMirrorByHashRequest.ProtoReflect.Descriptor instead.
+func (*GetMirrorByHashRequest) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetMirrorByHashRequest) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+type GetMirrorByHeightRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Height int64 `protobuf:"varint,1,opt,name=height,proto3" json:"height,omitempty"`
+}
+
+func (x *GetMirrorByHeightRequest) Reset() {
+	*x = GetMirrorByHeightRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetMirrorByHeightRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetMirrorByHeightRequest) ProtoMessage() {}
+
+func (x *GetMirrorByHeightRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetMirrorByHeightRequest.ProtoReflect.Descriptor instead.
+func (*GetMirrorByHeightRequest) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetMirrorByHeightRequest) GetHeight() int64 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+type GetTipRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *GetTipRequest) Reset() {
+	*x = GetTipRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetTipRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTipRequest) ProtoMessage() {}
+
+func (x *GetTipRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTipRequest.ProtoReflect.Descriptor instead.
+func (*GetTipRequest) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{2}
+}
+
+type MirrorResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Hash   []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	Height int64  `protobuf:"varint,2,opt,name=height,proto3" json:"height,omitempty"`
+	// mirror is empty for a header-only tip.
+	Mirror []byte `protobuf:"bytes,3,opt,name=mirror,proto3" json:"mirror,omitempty"`
+}
+
+func (x *MirrorResponse) Reset() {
+	*x = MirrorResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MirrorResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MirrorResponse) ProtoMessage() {}
+
+func (x *MirrorResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MirrorResponse.ProtoReflect.Descriptor instead.
+func (*MirrorResponse) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *MirrorResponse) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *MirrorResponse) GetHeight() int64 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *MirrorResponse) GetMirror() []byte {
+	if x != nil {
+		return x.Mirror
+	}
+	return nil
+}
+
+type ValidateMirrorRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mirror []byte `protobuf:"bytes,1,opt,name=mirror,proto3" json:"mirror,omitempty"`
+}
+
+func (x *ValidateMirrorRequest) Reset() {
+	*x = ValidateMirrorRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ValidateMirrorRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValidateMirrorRequest) ProtoMessage() {}
+
+func (x *ValidateMirrorRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValidateMirrorRequest.ProtoReflect.Descriptor instead.
+func (*ValidateMirrorRequest) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ValidateMirrorRequest) GetMirror() []byte {
+	if x != nil {
+		return x.Mirror
+	}
+	return nil
+}
+
+// ValidationReport mirrors lightmirror.ValidationReport, with the errors of
+// the failed checks as their messages, empty for the passed ones.
+type ValidationReport struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Hash            []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	Valid           bool   `protobuf:"varint,2,opt,name=valid,proto3" json:"valid,omitempty"`
+	InvariantsError string `protobuf:"bytes,3,opt,name=invariants_error,json=invariantsError,proto3" json:"invariants_error,omitempty"`
+	WorkError       string `protobuf:"bytes,4,opt,name=work_error,json=workError,proto3" json:"work_error,omitempty"`
+	MerkleError     string `protobuf:"bytes,5,opt,name=merkle_error,json=merkleError,proto3" json:"merkle_error,omitempty"`
+	Known           bool   `protobuf:"varint,6,opt,name=known,proto3" json:"known,omitempty"`
+	Height          int64  `protobuf:"varint,7,opt,name=height,proto3" json:"height,omitempty"`
+	ParentKnown     bool   `protobuf:"varint,8,opt,name=parent_known,json=parentKnown,proto3" json:"parent_known,omitempty"`
+	ParentHeight    int64  `protobuf:"varint,9,opt,name=parent_height,json=parentHeight,proto3" json:"parent_height,omitempty"`
+}
+
+func (x *ValidationReport) Reset() {
+	*x = ValidationReport{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ValidationReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValidationReport) ProtoMessage() {}
+
+func (x *ValidationReport) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValidationReport.ProtoReflect.Descriptor instead.
+func (*ValidationReport) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ValidationReport) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *ValidationReport) GetValid() bool {
+	if x != nil {
+		return x.Valid
+	}
+	return false
+}
+
+func (x *ValidationReport) GetInvariantsError() string {
+	if x != nil {
+		return x.InvariantsError
+	}
+	return ""
+}
+
+func (x *ValidationReport) GetWorkError() string {
+	if x != nil {
+		return x.WorkError
+	}
+	return ""
+}
+
+func (x *ValidationReport) GetMerkleError() string {
+	if x != nil {
+		return x.MerkleError
+	}
+	return ""
+}
+
+func (x *ValidationReport) GetKnown() bool {
+	if x != nil {
+		return x.Known
+	}
+	return false
+}
+
+func (x *ValidationReport) GetHeight() int64 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *ValidationReport) GetParentKnown() bool {
+	if x != nil {
+		return x.ParentKnown
+	}
+	return false
+}
+
+func (x *ValidationReport) GetParentHeight() int64 {
+	if x != nil {
+		return x.ParentHeight
+	}
+	return 0
+}
+
+type SubscribeMirrorsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *SubscribeMirrorsRequest) Reset() {
+	*x = SubscribeMirrorsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeMirrorsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeMirrorsRequest) ProtoMessage() {}
+
+func (x *SubscribeMirrorsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeMirrorsRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeMirrorsRequest) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{6}
+}
+
+type MirrorEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type   EventType `protobuf:"varint,1,opt,name=type,proto3,enum=lightmirror.v1.EventType" json:"type,omitempty"`
+	Hash   []byte    `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	Height int64     `protobuf:"varint,3,opt,name=height,proto3" json:"height,omitempty"`
+	// mirror is set as lightmirror.ChainEvent.Mirror is.
+	Mirror []byte `protobuf:"bytes,4,opt,name=mirror,proto3" json:"mirror,omitempty"`
+}
+
+func (x *MirrorEvent) Reset() {
+	*x = MirrorEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mirror_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MirrorEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MirrorEvent) ProtoMessage() {}
+
+func (x *MirrorEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_mirror_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MirrorEvent.ProtoReflect.Descriptor instead.
+func (*MirrorEvent) Descriptor() ([]byte, []int) {
+	return file_mirror_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *MirrorEvent) GetType() EventType {
+	if x != nil {
+		return x.Type
+	}
+	return EventType_EVENT_TYPE_UNSPECIFIED
+}
+
+func (x *MirrorEvent) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *MirrorEvent) GetHeight() int64 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *MirrorEvent) GetMirror() []byte {
+	if x != nil {
+		return x.Mirror
+	}
+	return nil
+}
+
+var File_mirror_proto protoreflect.FileDescriptor
+
+var file_mirror_proto_rawDesc = []byte{
+	0x0a, 0x0c, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e,
+	0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x22, 0x2c,
+	0x0a, 0x16, 0x47, 0x65, 0x74, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x42, 0x79, 0x48, 0x61, 0x73,
+	0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61, 0x73, 0x68,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x22, 0x32, 0x0a, 0x18,
+	0x47, 0x65, 0x74, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x42, 0x79, 0x48, 0x65, 0x69, 0x67, 0x68,
+	0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x65, 0x69, 0x67,
+	0x68, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x68, 0x65, 0x69, 0x67, 0x68, 0x74,
+	0x22, 0x0f, 0x0a, 0x0d, 0x47, 0x65, 0x74, 0x54, 0x69, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x22, 0x54, 0x0a, 0x0e, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x65, 0x69, 0x67, 0x68,
+	0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x68, 0x65, 0x69, 0x67, 0x68, 0x74, 0x12,
+	0x16, 0x0a, 0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x2f, 0x0a, 0x15, 0x56, 0x61, 0x6c, 0x69, 0x64,
+	0x61, 0x74, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x16, 0x0a, 0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x9f, 0x02, 0x0a, 0x10, 0x56, 0x61, 0x6c,
+	0x69, 0x64, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x12, 0x0a,
+	0x04, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x68, 0x61, 0x73,
+	0x68, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x05, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x12, 0x29, 0x0a, 0x10, 0x69, 0x6e, 0x76, 0x61, 0x72,
+	0x69, 0x61, 0x6e, 0x74, 0x73, 0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0f, 0x69, 0x6e, 0x76, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x73, 0x45, 0x72, 0x72,
+	0x6f, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x77, 0x6f, 0x72, 0x6b, 0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x77, 0x6f, 0x72, 0x6b, 0x45, 0x72, 0x72, 0x6f,
+	0x72, 0x12, 0x21, 0x0a, 0x0c, 0x6d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x5f, 0x65, 0x72, 0x72, 0x6f,
+	0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x6d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x45,
+	0x72, 0x72, 0x6f, 0x72, 0x12, 0x14, 0x0a, 0x05, 0x6b, 0x6e, 0x6f, 0x77, 0x6e, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x05, 0x6b, 0x6e, 0x6f, 0x77, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x65,
+	0x69, 0x67, 0x68, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x68, 0x65, 0x69, 0x67,
+	0x68, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x6b, 0x6e, 0x6f,
+	0x77, 0x6e, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74,
+	0x4b, 0x6e, 0x6f, 0x77, 0x6e, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x5f,
+	0x68, 0x65, 0x69, 0x67, 0x68, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x70, 0x61,
+	0x72, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x69, 0x67, 0x68, 0x74, 0x22, 0x19, 0x0a, 0x17, 0x53, 0x75,
+	0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x80, 0x01, 0x0a, 0x0b, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72,
+	0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x2d, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04,
+	0x74, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61, 0x73, 0x68, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x65, 0x69, 0x67,
+	0x68, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x68, 0x65, 0x69, 0x67, 0x68, 0x74,
+	0x12, 0x16, 0x0a, 0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2a, 0xcc, 0x01, 0x0a, 0x09, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1a, 0x0a, 0x16, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f,
+	0x54, 0x59, 0x50, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44,
+	0x10, 0x00, 0x12, 0x13, 0x0a, 0x0f, 0x42, 0x4c, 0x4f, 0x43, 0x4b, 0x5f, 0x43, 0x4f, 0x4e, 0x4e,
+	0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x01, 0x12, 0x16, 0x0a, 0x12, 0x42, 0x4c, 0x4f, 0x43, 0x4b,
+	0x5f, 0x44, 0x49, 0x53, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x02, 0x12,
+	0x19, 0x0a, 0x15, 0x53, 0x55, 0x42, 0x53, 0x43, 0x52, 0x49, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f,
+	0x4f, 0x56, 0x45, 0x52, 0x46, 0x4c, 0x4f, 0x57, 0x10, 0x03, 0x12, 0x11, 0x0a, 0x0d, 0x42, 0x4f,
+	0x44, 0x59, 0x5f, 0x41, 0x54, 0x54, 0x41, 0x43, 0x48, 0x45, 0x44, 0x10, 0x04, 0x12, 0x12, 0x0a,
+	0x0e, 0x4f, 0x52, 0x50, 0x48, 0x41, 0x4e, 0x5f, 0x41, 0x44, 0x4f, 0x50, 0x54, 0x45, 0x44, 0x10,
+	0x05, 0x12, 0x12, 0x0a, 0x0e, 0x4f, 0x52, 0x50, 0x48, 0x41, 0x4e, 0x5f, 0x45, 0x56, 0x49, 0x43,
+	0x54, 0x45, 0x44, 0x10, 0x06, 0x12, 0x20, 0x0a, 0x1c, 0x44, 0x45, 0x4c, 0x45, 0x47, 0x41, 0x54,
+	0x49, 0x4f, 0x4e, 0x5f, 0x43, 0x4f, 0x4e, 0x46, 0x4c, 0x49, 0x43, 0x54, 0x5f, 0x44, 0x45, 0x54,
+	0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x07, 0x32, 0xc9, 0x03, 0x0a, 0x0d, 0x4d, 0x69, 0x72, 0x72,
+	0x6f, 0x72, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x59, 0x0a, 0x0f, 0x47, 0x65, 0x74,
+	0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x42, 0x79, 0x48, 0x61, 0x73, 0x68, 0x12, 0x26, 0x2e, 0x6c,
+	0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x47, 0x65,
+	0x74, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x42, 0x79, 0x48, 0x61, 0x73, 0x68, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1e, 0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72,
+	0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x5d, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x4d, 0x69, 0x72, 0x72, 0x6f,
+	0x72, 0x42, 0x79, 0x48, 0x65, 0x69, 0x67, 0x68, 0x74, 0x12, 0x28, 0x2e, 0x6c, 0x69, 0x67, 0x68,
+	0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x47, 0x65, 0x74, 0x4d, 0x69,
+	0x72, 0x72, 0x6f, 0x72, 0x42, 0x79, 0x48, 0x65, 0x69, 0x67, 0x68, 0x74, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x1e, 0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x47, 0x0a, 0x06, 0x47, 0x65, 0x74, 0x54, 0x69, 0x70, 0x12, 0x1d, 0x2e,
+	0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x47,
+	0x65, 0x74, 0x54, 0x69, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1e, 0x2e, 0x6c,
+	0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x69,
+	0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x59, 0x0a, 0x0e,
+	0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x25,
+	0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72,
+	0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x61, 0x6c, 0x69, 0x64, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x5a, 0x0a, 0x10, 0x53, 0x75, 0x62, 0x73, 0x63,
+	0x72, 0x69, 0x62, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x12, 0x27, 0x2e, 0x6c, 0x69,
+	0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x75, 0x62,
+	0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6d, 0x69, 0x72, 0x72,
+	0x6f, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x30, 0x01, 0x42, 0x38, 0x5a, 0x36, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x63, 0x6f, 0x72, 0x65, 0x64, 0x61, 0x6f, 0x2d, 0x6f, 0x72, 0x67, 0x2f, 0x62, 0x74,
+	0x63, 0x70, 0x6f, 0x77, 0x65, 0x72, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2f, 0x6c, 0x69, 0x67,
+	0x68, 0x74, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_mirror_proto_rawDescOnce sync.Once
+	file_mirror_proto_rawDescData = file_mirror_proto_rawDesc
+)
+
+func file_mirror_proto_rawDescGZIP() []byte {
+	file_mirror_proto_rawDescOnce.Do(func() {
+		file_mirror_proto_rawDescData = protoimpl.X.CompressGZIP(file_mirror_proto_rawDescData)
+	})
+	return file_mirror_proto_rawDescData
+}
+
+var file_mirror_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_mirror_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_mirror_proto_goTypes = []interface{}{
+	(EventType)(0),                   // 0: lightmirror.v1.EventType
+	(*GetMirrorByHashRequest)(nil),   // 1: lightmirror.v1.GetMirrorByHashRequest
+	(*GetMirrorByHeightRequest)(nil), // 2: lightmirror.v1.GetMirrorByHeightRequest
+	(*GetTipRequest)(nil),            // 3: lightmirror.v1.GetTipRequest
+	(*MirrorResponse)(nil),           // 4: lightmirror.v1.MirrorResponse
+	(*ValidateMirrorRequest)(nil),    // 5: lightmirror.v1.ValidateMirrorRequest
+	(*ValidationReport)(nil),         // 6: lightmirror.v1.ValidationReport
+	(*SubscribeMirrorsRequest)(nil),  // 7: lightmirror.v1.SubscribeMirrorsRequest
+	(*MirrorEvent)(nil),              // 8: lightmirror.v1.MirrorEvent
+}
+var file_mirror_proto_depIdxs = []int32{
+	0, // 0: lightmirror.v1.MirrorEvent.type:type_name -> lightmirror.v1.EventType
+	1, // 1: lightmirror.v1.MirrorService.GetMirrorByHash:input_type -> lightmirror.v1.GetMirrorByHashRequest
+	2, // 2: lightmirror.v1.MirrorService.GetMirrorByHeight:input_type -> lightmirror.v1.GetMirrorByHeightRequest
+	3, // 3: lightmirror.v1.MirrorService.GetTip:input_type -> lightmirror.v1.GetTipRequest
+	5, // 4: lightmirror.v1.MirrorService.ValidateMirror:input_type -> lightmirror.v1.ValidateMirrorRequest
+	7, // 5: lightmirror.v1.MirrorService.SubscribeMirrors:input_type -> lightmirror.v1.SubscribeMirrorsRequest
+	4, // 6: lightmirror.v1.MirrorService.GetMirrorByHash:output_type -> lightmirror.v1.MirrorResponse
+	4, // 7: lightmirror.v1.MirrorService.GetMirrorByHeight:output_type -> lightmirror.v1.MirrorResponse
+	4, // 8: lightmirror.v1.MirrorService.GetTip:output_type -> lightmirror.v1.MirrorResponse
+	6, // 9: lightmirror.v1.MirrorService.ValidateMirror:output_type -> lightmirror.v1.ValidationReport
+	8, // 10: lightmirror.v1.MirrorService.SubscribeMirrors:output_type -> lightmirror.v1.MirrorEvent
+	6, // [6:11] is the sub-list for method output_type
+	1, // [1:6] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_mirror_proto_init() }
+func file_mirror_proto_init() {
+	if File_mirror_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_mirror_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetMirrorByHashRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetMirrorByHeightRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetTipRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MirrorResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ValidateMirrorRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ValidationReport); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeMirrorsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mirror_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MirrorEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_mirror_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_mirror_proto_goTypes,
+		DependencyIndexes: file_mirror_proto_depIdxs,
+		EnumInfos:         file_mirror_proto_enumTypes,
+		MessageInfos:      file_mirror_proto_msgTypes,
+	}.Build()
+	File_mirror_proto = out.File
+	file_mirror_proto_rawDesc = nil
+	file_mirror_proto_goTypes = nil
+	file_mirror_proto_depIdxs = nil
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: mirror.proto
+
+package grpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	MirrorService_GetMirrorByHash_FullMethodName   = "/lightmirror.v1.MirrorService/GetMirrorByHash"
+	MirrorService_GetMirrorByHeight_FullMethodName = "/lightmirror.v1.MirrorService/GetMirrorByHeight"
+	MirrorService_GetTip_FullMethodName            = "/lightmirror.v1.MirrorService/GetTip"
+	MirrorService_ValidateMirror_FullMethodName    = "/lightmirror.v1.MirrorService/ValidateMirror"
+	MirrorService_SubscribeMirrors_FullMethodName  = "/lightmirror.v1.MirrorService/SubscribeMirrors"
+)
+
+// MirrorServiceClient is the client API for MirrorService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MirrorServiceClient interface {
+	// GetMirrorByHash returns the block with the given hash, on the best
+	// chain or on a side branch.
+	GetMirrorByHash(ctx context.Context, in *GetMirrorByHashRequest, opts ...grpc.CallOption) (*MirrorResponse, error)
+	// GetMirrorByHeight returns the block of the best chain at the given
+	// height.
+	GetMirrorByHeight(ctx context.Context, in *GetMirrorByHeightRequest, opts ...grpc.CallOption) (*MirrorResponse, error)
+	// GetTip returns the tip of the best chain.
+	GetTip(ctx context.Context, in *GetTipRequest, opts ...grpc.CallOption) (*MirrorResponse, error)
+	// ValidateMirror runs the checks of the chain on a mirror, without
+	// appending it.
+	ValidateMirror(ctx context.Context, in *ValidateMirrorRequest, opts ...grpc.CallOption) (*ValidationReport, error)
+	// SubscribeMirrors streams the changes of the best chain from now on.
+	// The stream ends after a SUBSCRIPTION_OVERFLOW event when the client
+	// does not keep up.
+	SubscribeMirrors(ctx context.Context, in *SubscribeMirrorsRequest, opts ...grpc.CallOption) (MirrorService_SubscribeMirrorsClient, error)
+}
+
+type mirrorServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMirrorServiceClient(cc grpc.ClientConnInterface) MirrorServiceClient {
+	return &mirrorServiceClient{cc}
+}
+
+func (c *mirrorServiceClient) GetMirrorByHash(ctx context.Context, in *GetMirrorByHashRequest, opts ...grpc.CallOption) (*MirrorResponse, error) {
+	out := new(MirrorResponse)
+	err := c.cc.Invoke(ctx, MirrorService_GetMirrorByHash_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mirrorServiceClient) GetMirrorByHeight(ctx context.Context, in *GetMirrorByHeightRequest, opts ...grpc.CallOption) (*MirrorResponse, error) {
+	out := new(MirrorResponse)
+	err := c.cc.Invoke(ctx, MirrorService_GetMirrorByHeight_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mirrorServiceClient) GetTip(ctx context.Context, in *GetTipRequest, opts ...grpc.CallOption) (*MirrorResponse, error) {
+	out := new(MirrorResponse)
+	err := c.cc.Invoke(ctx, MirrorService_GetTip_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mirrorServiceClient) ValidateMirror(ctx context.Context, in *ValidateMirrorRequest, opts ...grpc.CallOption) (*ValidationReport, error) {
+	out := new(ValidationReport)
+	err := c.cc.Invoke(ctx, MirrorService_ValidateMirror_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mirrorServiceClient) SubscribeMirrors(ctx context.Context, in *SubscribeMirrorsRequest, opts ...grpc.CallOption) (MirrorService_SubscribeMirrorsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MirrorService_ServiceDesc.Streams[0], MirrorService_SubscribeMirrors_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mirrorServiceSubscribeMirrorsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MirrorService_SubscribeMirrorsClient interface {
+	Recv() (*MirrorEvent, error)
+	grpc.ClientStream
+}
+
+type mirrorServiceSubscribeMirrorsClient struct {
+	grpc.ClientStream
+}
+
+func (x *mirrorServiceSubscribeMirrorsClient) Recv() (*MirrorEvent, error) {
+	m := new(MirrorEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MirrorServiceServer is the server API for MirrorService service.
+// All implementations must embed UnimplementedMirrorServiceServer
+// for forward compatibility
+type MirrorServiceServer interface {
+	// GetMirrorByHash returns the block with the given hash, on the best
+	// chain or on a side branch.
+	GetMirrorByHash(context.Context, *GetMirrorByHashRequest) (*MirrorResponse, error)
+	// GetMirrorByHeight returns the block of the best chain at the given
+	// height.
+	GetMirrorByHeight(context.Context, *GetMirrorByHeightRequest) (*MirrorResponse, error)
+	// GetTip returns the tip of the best chain.
+	GetTip(context.Context, *GetTipRequest) (*MirrorResponse, error)
+	// ValidateMirror runs the checks of the chain on a mirror, without
+	// appending it.
+	ValidateMirror(context.Context, *ValidateMirrorRequest) (*ValidationReport, error)
+	// SubscribeMirrors streams the changes of the best chain from now on.
+	// The stream ends after a SUBSCRIPTION_OVERFLOW event when the client
+	// does not keep up.
+	SubscribeMirrors(*SubscribeMirrorsRequest, MirrorService_SubscribeMirrorsServer) error
+	mustEmbedUnimplementedMirrorServiceServer()
+}
+
+// UnimplementedMirrorServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedMirrorServiceServer struct {
+}
+
+func (UnimplementedMirrorServiceServer) GetMirrorByHash(context.Context, *GetMirrorByHashRequest) (*MirrorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMirrorByHash not implemented")
+}
+func (UnimplementedMirrorServiceServer) GetMirrorByHeight(context.Context, *GetMirrorByHeightRequest) (*MirrorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMirrorByHeight not implemented")
+}
+func (UnimplementedMirrorServiceServer) GetTip(context.Context, *GetTipRequest) (*MirrorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTip not implemented")
+}
+func (UnimplementedMirrorServiceServer) ValidateMirror(context.Context, *ValidateMirrorRequest) (*ValidationReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidateMirror not implemented")
+}
+func (UnimplementedMirrorServiceServer) SubscribeMirrors(*SubscribeMirrorsRequest, MirrorService_SubscribeMirrorsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeMirrors not implemented")
+}
+func (UnimplementedMirrorServiceServer) mustEmbedUnimplementedMirrorServiceServer() {}
+
+// UnsafeMirrorServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MirrorServiceServer will
+// result in compilation errors.
+type UnsafeMirrorServiceServer interface {
+	mustEmbedUnimplementedMirrorServiceServer()
+}
+
+func RegisterMirrorServiceServer(s grpc.ServiceRegistrar, srv MirrorServiceServer) {
+	s.RegisterService(&MirrorService_ServiceDesc, srv)
+}
+
+func _MirrorService_GetMirrorByHash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMirrorByHashRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MirrorServiceServer).GetMirrorByHash(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MirrorService_GetMirrorByHash_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MirrorServiceServer).GetMirrorByHash(ctx, req.(*GetMirrorByHashRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MirrorService_GetMirrorByHeight_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMirrorByHeightRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MirrorServiceServer).GetMirrorByHeight(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MirrorService_GetMirrorByHeight_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MirrorServiceServer).GetMirrorByHeight(ctx, req.(*GetMirrorByHeightRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MirrorService_GetTip_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MirrorServiceServer).GetTip(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MirrorService_GetTip_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MirrorServiceServer).GetTip(ctx, req.(*GetTipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MirrorService_ValidateMirror_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateMirrorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MirrorServiceServer).ValidateMirror(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MirrorService_ValidateMirror_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MirrorServiceServer).ValidateMirror(ctx, req.(*ValidateMirrorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MirrorService_SubscribeMirrors_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeMirrorsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MirrorServiceServer).SubscribeMirrors(m, &mirrorServiceSubscribeMirrorsServer{stream})
+}
+
+type MirrorService_SubscribeMirrorsServer interface {
+	Send(*MirrorEvent) error
+	grpc.ServerStream
+}
+
+type mirrorServiceSubscribeMirrorsServer struct {
+	grpc.ServerStream
+}
+
+func (x *mirrorServiceSubscribeMirrorsServer) Send(m *MirrorEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// MirrorService_ServiceDesc is the grpc.ServiceDesc for MirrorService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MirrorService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lightmirror.v1.MirrorService",
+	HandlerType: (*MirrorServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMirrorByHash",
+			Handler:    _MirrorService_GetMirrorByHash_Handler,
+		},
+		{
+			MethodName: "GetMirrorByHeight",
+			Handler:    _MirrorService_GetMirrorByHeight_Handler,
+		},
+		{
+			MethodName: "GetTip",
+			Handler:    _MirrorService_GetTip_Handler,
+		},
+		{
+			MethodName: "ValidateMirror",
+			Handler:    _MirrorService_ValidateMirror_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeMirrors",
+			Handler:       _MirrorService_SubscribeMirrors_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "mirror.proto",
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements MirrorServiceServer on top of a chain.
+type Server struct {
+	UnimplementedMirrorServiceServer
+
+	chain *lightmirror.MirrorChain
+}
+
+// NewServer returns a server of the mirrors of chain.  Register it with
+// RegisterMirrorServiceServer.
+func NewServer(chain *lightmirror.MirrorChain) *Server {
+	return &Server{chain: chain}
+}
+
+// GetMirrorByHash implements MirrorServiceServer.
+func (s *Server) GetMirrorByHash(ctx context.Context, req *GetMirrorByHashRequest) (*MirrorResponse, error) {
+	hash, err := chainhash.NewHash(req.Hash)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	m, height, err := s.chain.ByHash(*hash)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return mirrorResponse(m, *hash, height)
+}
+
+// GetMirrorByHeight implements MirrorServiceServer.
+func (s *Server) GetMirrorByHeight(ctx context.Context, req *GetMirrorByHeightRequest) (*MirrorResponse, error) {
+	m, err := s.chain.ByHeight(req.Height)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return mirrorResponse(m, m.BtcHeader.BlockHash(), req.Height)
+}
+
+// GetTip implements MirrorServiceServer.  The mirror is empty when the tip is
+// a header-only block.
+func (s *Server) GetTip(ctx context.Context, req *GetTipRequest) (*MirrorResponse, error) {
+	m, height := s.chain.Tip()
+	if m != nil {
+		return mirrorResponse(m, m.BtcHeader.BlockHash(), height)
+	}
+	hash, err := s.chain.HashAtHeight(height)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return mirrorResponse(nil, hash, height)
+}
+
+// ValidateMirror implements MirrorServiceServer.
+func (s *Server) ValidateMirror(ctx context.Context, req *ValidateMirrorRequest) (*ValidationReport, error) {
+	m, err := lightmirror.DeserializeBytes(req.Mirror)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "mirror: %v", err)
+	}
+	r := s.chain.ValidateMirror(m)
+	return &ValidationReport{
+		Hash:            r.Hash[:],
+		Valid:           r.Err() == nil,
+		InvariantsError: errorString(r.InvariantsErr),
+		WorkError:       errorString(r.WorkErr),
+		MerkleError:     errorString(r.MerkleErr),
+		Known:           r.Known,
+		Height:          r.Height,
+		ParentKnown:     r.ParentKnown,
+		ParentHeight:    r.ParentHeight,
+	}, nil
+}
+
+// SubscribeMirrors implements MirrorServiceServer.  The response headers are
+// sent once the subscription is in place, the stream then carrying every
+// change of the chain.  The stream ends when the client cancels it, and
+// after the overflow event when the client does not keep up.
+func (s *Server) SubscribeMirrors(req *SubscribeMirrorsRequest, stream MirrorService_SubscribeMirrorsServer) error {
+	events, cancel := s.chain.Subscribe()
+	defer cancel()
+
+	// The headers tell the client the subscription is in place.
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			msg := &MirrorEvent{
+				Type:   EventType(event.Type + 1),
+				Hash:   event.Hash[:],
+				Height: event.Height,
+			}
+			if event.Mirror != nil {
+				b, err := event.Mirror.ToBytes()
+				if err != nil {
+					return status.Error(codes.Internal, err.Error())
+				}
+				msg.Mirror = b
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mirrorResponse returns the response holding m, which may be nil, with its
+// hash and height.
+func mirrorResponse(m *lightmirror.BtcLightMirrorV2, hash chainhash.Hash, height int64) (*MirrorResponse, error) {
+	resp := &MirrorResponse{Hash: hash[:], Height: height}
+	if m != nil {
+		b, err := m.ToBytes()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Mirror = b
+	}
+	return resp, nil
+}
+
+// chainErrors are the errors of the chain the server reports with their own
+// status code, and with their message for the client to map them back.
+var chainErrors = []struct {
+	err  error
+	code codes.Code
+}{
+	{lightmirror.ErrUnknownBlock, codes.NotFound},
+	{lightmirror.ErrHeightBeyondTip, codes.NotFound},
+	{lightmirror.ErrHeightBeforeAnchor, codes.NotFound},
+	{lightmirror.ErrPruned, codes.FailedPrecondition},
+	{lightmirror.ErrHeaderOnly, codes.FailedPrecondition},
+}
+
+// statusError returns the status of err, an error of the chain.
+func statusError(err error) error {
+	for _, e := range chainErrors {
+		if errors.Is(err, e.err) {
+			return status.Error(e.code, e.err.Error())
+		}
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// errorString returns the message of err, or an empty string if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serve serves chain on an in-process connection, and returns a client of
+// it and the gRPC server, stopped at the end of the test.
+func serve(t *testing.T, chain *lightmirror.MirrorChain) (*Client, *grpc.ClientConn, *grpc.Server) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterMirrorServiceServer(srv, NewServer(chain))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial error %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewClient(conn), conn, srv
+}
+
+func newChain(t *testing.T, mirrors []*lightmirror.BtcLightMirrorV2) *lightmirror.MirrorChain {
+	t.Helper()
+	c, err := lightmirror.NewMirrorChain(mirrors[0], 0,
+		lightmirror.WithChainParams(mirrortest.Params))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	return c
+}
+
+func TestGetMirror(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 5)
+	chain := newChain(t, mirrors[:4])
+	client, conn, _ := serve(t, chain)
+	ctx := context.Background()
+
+	for height, want := range mirrors[:4] {
+		hash := want.BtcHeader.BlockHash()
+		m, gotHeight, err := client.ByHash(ctx, hash)
+		if err != nil {
+			t.Fatalf("ByHash #%d error %v", height, err)
+		}
+		if !m.Equal(want) || gotHeight != int64(height) {
+			t.Errorf("ByHash #%d: got %v at %d", height, m.BtcHeader.BlockHash(), gotHeight)
+		}
+		m, err = client.ByHeight(ctx, int64(height))
+		if err != nil {
+			t.Fatalf("ByHeight #%d error %v", height, err)
+		}
+		if !m.Equal(want) {
+			t.Errorf("ByHeight #%d: got %v", height, m.BtcHeader.BlockHash())
+		}
+	}
+
+	m, hash, height, err := client.Tip(ctx)
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if !m.Equal(mirrors[3]) || hash != mirrors[3].BtcHeader.BlockHash() || height != 3 {
+		t.Errorf("Tip: got %v at %d", hash, height)
+	}
+
+	if _, _, err := client.ByHash(ctx, chainhash.Hash{1}); !errors.Is(err, lightmirror.ErrUnknownBlock) {
+		t.Errorf("ByHash: got error %v, want %v", err, lightmirror.ErrUnknownBlock)
+	}
+	if _, err := client.ByHeight(ctx, 10); !errors.Is(err, lightmirror.ErrHeightBeyondTip) {
+		t.Errorf("ByHeight: got error %v, want %v", err, lightmirror.ErrHeightBeyondTip)
+	}
+	_, err = NewMirrorServiceClient(conn).GetMirrorByHash(ctx, &GetMirrorByHashRequest{Hash: []byte{1}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetMirrorByHash: got error %v, want %v", err, codes.InvalidArgument)
+	}
+
+	// A header-only tip is served without its mirror.
+	if _, err := chain.AppendHeaderOnly(mirrors[4].BtcHeader); err != nil {
+		t.Fatalf("AppendHeaderOnly error %v", err)
+	}
+	m, hash, height, err = client.Tip(ctx)
+	if err != nil || m != nil || hash != mirrors[4].BtcHeader.BlockHash() || height != 4 {
+		t.Errorf("Tip: got %v at %d, mirror %v, error %v", hash, height, m, err)
+	}
+	if _, _, err := client.ByHash(ctx, hash); !errors.Is(err, lightmirror.ErrHeaderOnly) {
+		t.Errorf("ByHash: got error %v, want %v", err, lightmirror.ErrHeaderOnly)
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 4)
+	client, conn, _ := serve(t, newChain(t, mirrors[:3]))
+	ctx := context.Background()
+
+	badMerkle := mirrors[3].Clone()
+	badMerkle.MerkleNodes = append(badMerkle.MerkleNodes, chainhash.Hash{1})
+	tests := []struct {
+		name   string
+		m      *lightmirror.BtcLightMirrorV2
+		valid  bool
+		merkle bool
+		known  bool
+	}{
+		{"next", mirrors[3], true, false, false},
+		{"known", mirrors[1], true, false, true},
+		{"bad merkle", badMerkle, false, true, false},
+	}
+	for _, test := range tests {
+		r, err := client.Validate(ctx, test.m)
+		if err != nil {
+			t.Fatalf("Validate (%s) error %v", test.name, err)
+		}
+		hash := test.m.BtcHeader.BlockHash()
+		if r.Valid != test.valid || (r.MerkleError != "") != test.merkle ||
+			r.Known != test.known || !r.ParentKnown || string(r.Hash) != string(hash[:]) {
+			t.Errorf("Validate (%s): got %v", test.name, r)
+		}
+	}
+	_, err := NewMirrorServiceClient(conn).ValidateMirror(ctx, &ValidateMirrorRequest{Mirror: []byte{1}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ValidateMirror: got error %v, want %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestSubscribeMirrors(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 4)
+	fork := mirrortest.GenerateChain(t, 3, mirrortest.WithSeed(2),
+		mirrortest.WithPrevBlock(mirrors[1].BtcHeader.BlockHash()))
+	chain := newChain(t, mirrors[:2])
+	client, _, srv := serve(t, chain)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe error %v", err)
+	}
+	if _, err := chain.AppendBatch(mirrors[2:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	// The fork outgrows the best chain from height 2.
+	if _, err := chain.AppendBatch(fork); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+
+	type event struct {
+		typ    lightmirror.ChainEventType
+		m      *lightmirror.BtcLightMirrorV2
+		height int64
+	}
+	want := []event{
+		{lightmirror.BlockConnected, mirrors[2], 2},
+		{lightmirror.BlockConnected, mirrors[3], 3},
+		{lightmirror.BlockDisconnected, mirrors[3], 3},
+		{lightmirror.BlockDisconnected, mirrors[2], 2},
+		{lightmirror.BlockConnected, fork[0], 2},
+		{lightmirror.BlockConnected, fork[1], 3},
+		{lightmirror.BlockConnected, fork[2], 4},
+	}
+	for i, w := range want {
+		got, err := sub.Recv()
+		if err != nil {
+			t.Fatalf("Recv #%d error %v", i, err)
+		}
+		if got.Type != w.typ || got.Hash != w.m.BtcHeader.BlockHash() || got.Height != w.height {
+			t.Errorf("Recv #%d: got %v %v at %d, want %v %v at %d", i, got.Type,
+				got.Hash, got.Height, w.typ, w.m.BtcHeader.BlockHash(), w.height)
+		}
+		if connected := w.typ == lightmirror.BlockConnected; connected != (got.Mirror != nil) ||
+			connected && !got.Mirror.Equal(w.m) {
+			t.Errorf("Recv #%d: got mirror %v", i, got.Mirror)
+		}
+	}
+
+	// Cancelling the stream ends it on both sides, so the server stops.
+	cancel()
+	if _, err := sub.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("Recv: got error %v, want %v", err, codes.Canceled)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GracefulStop: stream still running")
+	}
+}
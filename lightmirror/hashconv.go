@@ -0,0 +1,64 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// A chainhash.Hash holds the double SHA-256 digest as computed, which
+// Bitcoin treats as a little-endian number: block explorers and bitcoind
+// print its bytes in reverse order.  A common.Hash holds bytes32 values
+// which Ethereum tooling prints in order.  The helpers below convert
+// between the two so that both sides print the same hex.
+
+// ToCommonHash returns the hash with the bytes of h reversed, whose Hex is
+// the display form of h as printed by block explorers.  It is not the
+// bytes32 which Solidity computes with sha256(abi.encodePacked(sha256(x))):
+// that one is h without reversal, common.Hash(h).
+func ToCommonHash(h chainhash.Hash) common.Hash {
+	var res common.Hash
+	for i, b := range h {
+		res[chainhash.HashSize-1-i] = b
+	}
+	return res
+}
+
+// FromCommonHash returns the chainhash.Hash whose display form is the hex of
+// h, reversing the bytes of h.  It is the inverse of ToCommonHash.
+func FromCommonHash(h common.Hash) chainhash.Hash {
+	var res chainhash.Hash
+	for i, b := range h {
+		res[chainhash.HashSize-1-i] = b
+	}
+	return res
+}
+
+// HashToDisplayHex returns the hash as block explorers print it: the 64 hex
+// digits of its bytes in reverse order, without prefix.
+func HashToDisplayHex(h chainhash.Hash) string {
+	return h.String()
+}
+
+// ParseDisplayHex parses a hash printed as by HashToDisplayHex, with or
+// without a 0x prefix.  Unlike chainhash.NewHashFromStr it requires the 64
+// digits.
+func ParseDisplayHex(s string) (chainhash.Hash, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(digits) != 2*chainhash.HashSize {
+		return chainhash.Hash{}, fmt.Errorf("hash %q has %d hex digits, "+
+			"want %d", s, len(digits), 2*chainhash.HashSize)
+	}
+	var reversed common.Hash
+	if _, err := hex.Decode(reversed[:], []byte(digits)); err != nil {
+		return chainhash.Hash{}, fmt.Errorf("hash %q: %w", s, err)
+	}
+	return FromCommonHash(reversed), nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestHashConversionRoundTrip(t *testing.T) {
+	toCommon := func(b [chainhash.HashSize]byte) bool {
+		h := chainhash.Hash(b)
+		return FromCommonHash(ToCommonHash(h)) == h
+	}
+	fromCommon := func(b [common.HashLength]byte) bool {
+		h := common.Hash(b)
+		return ToCommonHash(FromCommonHash(h)) == h
+	}
+	display := func(b [chainhash.HashSize]byte) bool {
+		h := chainhash.Hash(b)
+		s := HashToDisplayHex(h)
+		parsed, err := ParseDisplayHex(s)
+		if err != nil || parsed != h {
+			return false
+		}
+		parsed, err = ParseDisplayHex(ToCommonHash(h).Hex())
+		return err == nil && parsed == h && "0x"+s == ToCommonHash(h).Hex()
+	}
+	for name, f := range map[string]interface{}{
+		"ToCommonHash":    toCommon,
+		"FromCommonHash":  fromCommon,
+		"ParseDisplayHex": display,
+	} {
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("%s round trip: %v", name, err)
+		}
+	}
+}
+
+func TestHashDisplay(t *testing.T) {
+	// The hashes as block explorers print them.
+	tests := []struct {
+		name string
+		hash chainhash.Hash
+		want string
+	}{
+		{
+			"main network genesis block",
+			*chaincfg.MainNetParams.GenesisHash,
+			"000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		},
+		{
+			"main network genesis merkle root",
+			chaincfg.MainNetParams.GenesisBlock.Header.MerkleRoot,
+			"4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+		},
+		{
+			"main network block 1",
+			mainNetBlock1(t).BtcHeader.BlockHash(),
+			"00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+		},
+	}
+
+	for _, test := range tests {
+		if got := HashToDisplayHex(test.hash); got != test.want {
+			t.Errorf("HashToDisplayHex (%s): got %s, want %s", test.name, got,
+				test.want)
+		}
+		if got := ToCommonHash(test.hash).Hex(); got != "0x"+test.want {
+			t.Errorf("ToCommonHash (%s): got %s, want 0x%s", test.name, got,
+				test.want)
+		}
+		// The last displayed byte is the first one in memory.
+		if got := common.Bytes2Hex(test.hash[:1]); got != test.want[62:] {
+			t.Errorf("%s: first byte %s, want %s", test.name, got,
+				test.want[62:])
+		}
+		for _, s := range []string{test.want, "0x" + test.want, strings.ToUpper(test.want)} {
+			got, err := ParseDisplayHex(s)
+			if err != nil || got != test.hash {
+				t.Errorf("ParseDisplayHex (%s, %s): got %v, error %v", test.name,
+					s, got, err)
+			}
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"19d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		"000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f00",
+		"zz0000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+	} {
+		if _, err := ParseDisplayHex(s); err == nil {
+			t.Errorf("ParseDisplayHex(%q): expected error", s)
+		}
+	}
+}
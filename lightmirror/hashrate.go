@@ -0,0 +1,167 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+)
+
+// hashrateMedianBlocks is the most timestamps EstimateHashrate takes the
+// median of at each end of a range, as many as the median time past of the
+// consensus rules.
+const hashrateMedianBlocks = 11
+
+// EstimateHashrate returns the hashes per second the network implied by
+// mirrors, the mirrors of consecutive blocks in height order, spent mining
+// them: the expected work of the blocks, from their bits, over the time
+// they took.
+//
+// Block timestamps need not increase, so the time span is not taken between
+// the first and the last mirror but between the medians of the timestamps
+// of the up to 11 mirrors at each end of the range, and the work counted is
+// that of the blocks after the middle of the first median window up to the
+// middle of the last one.  Ranges of fewer than 22 mirrors take windows of
+// at most half of them, down to the first and the last timestamp for 2 or 3
+// mirrors.
+//
+// It fails for fewer than 2 mirrors, with an error wrapping
+// ErrHeadersNotLinked when a mirror does not build on the one before it,
+// and when the time span is not positive.
+func EstimateHashrate(mirrors []*BtcLightMirrorV2) (float64, error) {
+	if len(mirrors) < 2 {
+		return 0, fmt.Errorf("hashrate of %d mirrors: at least 2 are needed",
+			len(mirrors))
+	}
+	for i := 1; i < len(mirrors); i++ {
+		if hash := mirrors[i-1].BtcHeader.BlockHash(); mirrors[i].BtcHeader.PrevBlock != hash {
+			return 0, fmt.Errorf("mirror %d builds on %v, not on %v: %w", i,
+				mirrors[i].BtcHeader.PrevBlock, hash, ErrHeadersNotLinked)
+		}
+	}
+
+	n := len(mirrors)
+	k := n / 2
+	if k > hashrateMedianBlocks {
+		k = hashrateMedianBlocks
+	}
+	if k%2 == 0 {
+		k--
+	}
+	first, last := k/2, n-1-k/2
+	span := medianTimestamp(mirrors[n-k:]) - medianTimestamp(mirrors[:k])
+	if span <= 0 {
+		return 0, fmt.Errorf("hashrate of blocks %v to %v: time span of %ds",
+			mirrors[0].BtcHeader.BlockHash(), mirrors[n-1].BtcHeader.BlockHash(), span)
+	}
+
+	work := new(big.Int)
+	for _, m := range mirrors[first+1 : last+1] {
+		work.Add(work, blockchain.CalcWork(m.BtcHeader.Bits))
+	}
+	rate, _ := new(big.Float).Quo(new(big.Float).SetInt(work),
+		new(big.Float).SetInt64(span)).Float64()
+	return rate, nil
+}
+
+// medianTimestamp returns the median of the Unix timestamps of mirrors, of
+// odd length.
+func medianTimestamp(mirrors []*BtcLightMirrorV2) int64 {
+	times := make([]int64, len(mirrors))
+	for i, m := range mirrors {
+		times[i] = m.BtcHeader.Timestamp.Unix()
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// HashrateSample is the hashrate EstimateHashrate implies for the mirrors
+// at the heights [StartHeight, EndHeight], Time being the timestamp of the
+// last of them.
+type HashrateSample struct {
+	StartHeight int64
+	EndHeight   int64
+	Time        time.Time
+	Hashrate    float64
+}
+
+// HashrateSeries returns the hashrate of the mirrors of store at the heights
+// [startHeight, endHeight] over windows of window blocks, in height order,
+// for charting.  A window starting at height h holds the mirrors at the
+// heights [h, h+window], so that consecutive windows share a mirror and
+// the time between them is counted once; the last window is cut to the
+// range.  Windows with a height missing from the store, such as a pruned
+// one, or whose hashrate can not be estimated are left out of the series.
+func HashrateSeries(store Store, startHeight, endHeight, window int64) ([]HashrateSample, error) {
+	if err := checkStatsRange(startHeight, endHeight); err != nil {
+		return nil, err
+	}
+	if window < 1 {
+		return nil, fmt.Errorf("invalid hashrate window of %d blocks", window)
+	}
+
+	windowEnd := func(start int64) int64 {
+		if end := start + window; end < endHeight {
+			return end
+		}
+		return endHeight
+	}
+
+	var (
+		series []HashrateSample
+		cur    []*BtcLightMirrorV2
+		start  = startHeight
+		last   = startHeight - 1
+		gap    bool
+	)
+	// add appends the window at start to series if it holds every height.
+	add := func() {
+		end := windowEnd(start)
+		if gap || int64(len(cur)) != end-start+1 {
+			return
+		}
+		rate, err := EstimateHashrate(cur)
+		if err != nil {
+			return
+		}
+		series = append(series, HashrateSample{
+			StartHeight: start,
+			EndHeight:   end,
+			Time:        cur[len(cur)-1].BtcHeader.Timestamp,
+			Hashrate:    rate,
+		})
+	}
+	err := store.Iterate(startHeight, endHeight, func(height int64, m *BtcLightMirrorV2) error {
+		for height > windowEnd(start) {
+			add()
+			// The last mirror of a window is the first of the next one.
+			end := windowEnd(start)
+			start += window
+			if n := len(cur); n > 0 && last == end {
+				cur = append(cur[:0], cur[n-1])
+			} else {
+				cur = cur[:0]
+			}
+			gap = false
+		}
+		if height != start+int64(len(cur)) {
+			gap = true
+		}
+		cur = append(cur, m)
+		last = height
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if start < endHeight {
+		add()
+	}
+	return series, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// headerMirrors returns linked mirrors, holding only a header, of the given
+// bits and timestamps.
+func headerMirrors(bits uint32, times []int64) []*BtcLightMirrorV2 {
+	mirrors := make([]*BtcLightMirrorV2, len(times))
+	var prev chainhash.Hash
+	for i, ts := range times {
+		mirrors[i] = &BtcLightMirrorV2{BtcHeader: wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev,
+			Timestamp: time.Unix(ts, 0),
+			Bits:      bits,
+		}}
+		prev = mirrors[i].BtcHeader.BlockHash()
+	}
+	return mirrors
+}
+
+func TestEstimateHashrate(t *testing.T) {
+	// Every regression test block is expected to take 2 hashes.
+	mirrors := newTestMirrors(30)
+	for _, n := range []int{2, 3, 5, 22, 30} {
+		got, err := EstimateHashrate(mirrors[:n])
+		if err != nil {
+			t.Fatalf("EstimateHashrate (%d) error %v", n, err)
+		}
+		if want := 2.0 / 600; math.Abs(got-want) > want*1e-9 {
+			t.Errorf("EstimateHashrate (%d): got %g, want %g", n, got, want)
+		}
+	}
+
+	// A timestamp out of order at either end leaves the median alone.
+	times := make([]int64, 30)
+	for i := range times {
+		times[i] = 1600000000 + int64(i)*600
+	}
+	times[0] += 3000
+	times[29] -= 3000
+	got, err := EstimateHashrate(headerMirrors(0x207fffff, times))
+	if want := 2.0 / 600; err != nil || math.Abs(got-want) > want*1e-9 {
+		t.Errorf("EstimateHashrate out of order: got %g, error %v, want %g", got, err, want)
+	}
+
+	tests := []struct {
+		name    string
+		mirrors []*BtcLightMirrorV2
+	}{
+		{"none", nil},
+		{"single", mirrors[:1]},
+		{"unlinked", []*BtcLightMirrorV2{mirrors[0], mirrors[2], mirrors[3]}},
+		{"no time span", headerMirrors(0x207fffff, []int64{1600000000, 1600000000, 1600000000})},
+	}
+	for _, test := range tests {
+		if _, err := EstimateHashrate(test.mirrors); err == nil {
+			t.Errorf("EstimateHashrate (%s): expected error", test.name)
+		}
+	}
+	if _, err := EstimateHashrate(tests[2].mirrors); !errors.Is(err, ErrHeadersNotLinked) {
+		t.Errorf("EstimateHashrate (unlinked): got error %v, want %v", err, ErrHeadersNotLinked)
+	}
+}
+
+func TestEstimateHashrateMainNetEpoch(t *testing.T) {
+	// The main network epoch of the blocks 30240 to 32255 was mined at
+	// difficulty 1 in the time the first retarget, of block 32256 to the
+	// bits 1d00d86a, difficulty 1.18289953, tells: the network mined
+	// 1.18289953 blocks of difficulty 1 every 10 minutes.  The timestamps
+	// are spread over that time, jittered out of order by up to 25
+	// minutes.
+	oldTarget := blockchain.CompactToBig(0x1d00ffff)
+	newTarget := blockchain.CompactToBig(0x1d00d86a)
+	span := new(big.Int).Mul(big.NewInt(14*24*60*60), newTarget)
+	span.Quo(span, oldTarget)
+
+	r := rand.New(rand.NewSource(1))
+	const start = 1261000000
+	times := make([]int64, 2016)
+	for i := range times {
+		times[i] = start + span.Int64()*int64(i)/2015
+		if i > 0 && i < 2015 {
+			times[i] += r.Int63n(3000) - 1500
+		}
+	}
+	got, err := EstimateHashrate(headerMirrors(0x1d00ffff, times))
+	if err != nil {
+		t.Fatalf("EstimateHashrate error %v", err)
+	}
+	want := 1.18289953 * (1 << 32) / 600
+	if math.Abs(got-want) > want*0.03 {
+		t.Errorf("EstimateHashrate: got %.4g H/s, want %.4g H/s within 3%%", got, want)
+	}
+}
+
+func TestHashrateSeries(t *testing.T) {
+	mirrors := newTestMirrors(25)
+	store := newMemStore()
+	for i, m := range mirrors {
+		if err := store.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put error %v", err)
+		}
+	}
+
+	series, err := HashrateSeries(store, 0, 24, 10)
+	if err != nil {
+		t.Fatalf("HashrateSeries error %v", err)
+	}
+	want := []HashrateSample{
+		{StartHeight: 0, EndHeight: 10},
+		{StartHeight: 10, EndHeight: 20},
+		{StartHeight: 20, EndHeight: 24},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("HashrateSeries: got %+v, want %d samples", series, len(want))
+	}
+	for i, s := range series {
+		if s.StartHeight != want[i].StartHeight || s.EndHeight != want[i].EndHeight ||
+			!s.Time.Equal(mirrors[s.EndHeight].BtcHeader.Timestamp) || math.Abs(s.Hashrate-2.0/600) > 1e-12 {
+			t.Errorf("sample #%d: got %+v, want %+v", i, s, want[i])
+		}
+	}
+
+	// A window missing a mirror is left out.
+	if err := store.Delete(mirrors[15].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	series, err = HashrateSeries(store, 0, 24, 10)
+	if err != nil || len(series) != 2 || series[1].StartHeight != 20 {
+		t.Errorf("HashrateSeries with a gap: got %+v, error %v", series, err)
+	}
+
+	if _, err := HashrateSeries(store, 0, 24, 0); err == nil {
+		t.Errorf("HashrateSeries: expected error for an empty window")
+	}
+	if _, err := HashrateSeries(store, 5, 4, 10); err == nil {
+		t.Errorf("HashrateSeries: expected error for an empty range")
+	}
+}
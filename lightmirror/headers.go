@@ -0,0 +1,101 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrHeaderOnly is returned when the mirror of a block appended by
+// AppendHeaderOnly is needed before its body is attached.
+var ErrHeaderOnly = errors.New("block body is not attached")
+
+// AppendHeaderOnly adds the block with the given header to the chain without
+// its coinbase and merkle branch, which AttachBody adds later.  The header
+// is validated and takes part in the best chain selection as a full mirror
+// does; the result is the one of Append.
+//
+// Header-only blocks are not written to the store.  Since a chain reloaded
+// from its store stops at the first missing block, the mirrors stored above
+// a header-only block of the best chain are lost on reload until its body
+// is attached.  Pruning does not go past header-only blocks either.
+func (c *MirrorChain) AppendHeaderOnly(header wire.BlockHeader) (*ReorgEvent, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.appendHeader(&header, nil)
+}
+
+// AttachBody upgrades the header-only block with the given hash to a full
+// mirror built from its coinbase transaction and merkle branch.  txCount is
+// the number of transactions of the block, which sets the length of the
+// branch.  The mirror must pass the merkle check.
+//
+// It returns ErrUnknownBlock for blocks the chain does not know,
+// ErrDuplicateBlock for blocks that already have a body and ErrPruned for
+// pruned blocks.  When the block is on the best chain, the mirror is
+// written to the store and a BodyAttached event is sent to subscribers.
+func (c *MirrorChain) AttachBody(hash chainhash.Hash, coinBaseTx *wire.MsgTx, merkleNodes []chainhash.Hash, txCount int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return ErrUnknownBlock
+	}
+	if e.pruned {
+		return ErrPruned
+	}
+	if !e.headerOnly {
+		return ErrDuplicateBlock
+	}
+
+	if txCount < 1 || len(merkleNodes) != getExponent(txCount) {
+		return fmt.Errorf("merkle branch of %d nodes does not match a block "+
+			"of %d transactions", len(merkleNodes), txCount)
+	}
+	m := &BtcLightMirrorV2{
+		BtcHeader:   e.header,
+		CoinBaseTx:  *coinBaseTx.Copy(),
+		MerkleNodes: append([]chainhash.Hash(nil), merkleNodes...),
+	}
+	if err := m.CheckMerkle(); err != nil {
+		return err
+	}
+
+	inBest := c.inBestChain(e)
+	if store := c.cfg.store; store != nil && inBest {
+		if err := store.Put(m, e.height); err != nil {
+			return err
+		}
+	}
+	e.mirror = m
+	e.headerOnly = false
+
+	if inBest {
+		c.subs.notify([]ChainEvent{{
+			Type:   BodyAttached,
+			Hash:   e.hash,
+			Height: e.height,
+			Mirror: m,
+		}})
+	}
+	return c.prune()
+}
+
+// HeaderOnly reports whether the block with the given hash was appended by
+// AppendHeaderOnly and still waits for its body.  It returns
+// ErrUnknownBlock for blocks the chain does not know.
+func (c *MirrorChain) HeaderOnly(hash chainhash.Hash) (bool, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return false, ErrUnknownBlock
+	}
+	return e.headerOnly, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// attachBody attaches the body of m to its header-only block in c.
+func attachBody(c *MirrorChain, m *BtcLightMirrorV2) error {
+	return c.AttachBody(m.BtcHeader.BlockHash(), &m.CoinBaseTx, m.MerkleNodes,
+		1<<len(m.MerkleNodes))
+}
+
+func TestAppendHeaderOnly(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	store := newMemStore()
+	c := newTestChain(t, mirrors[:1], WithStore(store))
+	ch, cancel := c.Subscribe()
+	defer cancel()
+
+	bad := mirrors[1].BtcHeader
+	bad.Bits = 0x1d00ffff
+	if _, err := c.AppendHeaderOnly(bad); err == nil {
+		t.Errorf("AppendHeaderOnly: expected proof of work error")
+	}
+	for i, m := range mirrors[1:] {
+		if _, err := c.AppendHeaderOnly(m.BtcHeader); err != nil {
+			t.Fatalf("AppendHeaderOnly #%d error %v", i+1, err)
+		}
+	}
+	if _, err := c.AppendHeaderOnly(mirrors[1].BtcHeader); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("AppendHeaderOnly duplicate: got error %v, want %v", err,
+			ErrDuplicateBlock)
+	}
+	if _, err := c.Append(mirrors[1]); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("Append over header: got error %v, want %v", err,
+			ErrDuplicateBlock)
+	}
+
+	if tip, height := c.Tip(); tip != nil || height != testAnchorHeight+4 {
+		t.Errorf("Tip: got %v at height %d, want no mirror at %d", tip,
+			height, testAnchorHeight+4)
+	}
+	for i, m := range mirrors {
+		hash := m.BtcHeader.BlockHash()
+		headerOnly, err := c.HeaderOnly(hash)
+		if err != nil || headerOnly != (i > 0) {
+			t.Errorf("HeaderOnly #%d: got %v, error %v", i, headerOnly, err)
+		}
+		if header, err := c.HeaderByHeight(testAnchorHeight + int64(i)); err != nil ||
+			header.BlockHash() != hash {
+
+			t.Errorf("HeaderByHeight #%d: got error %v or wrong header", i, err)
+		}
+	}
+	if _, height, err := c.ByHash(mirrors[2].BtcHeader.BlockHash()); !errors.Is(err, ErrHeaderOnly) ||
+		height != testAnchorHeight+2 {
+
+		t.Errorf("ByHash: got height %d, error %v, want %v", height, err,
+			ErrHeaderOnly)
+	}
+	if _, err := c.ByHeight(testAnchorHeight + 2); !errors.Is(err, ErrHeaderOnly) {
+		t.Errorf("ByHeight: got error %v, want %v", err, ErrHeaderOnly)
+	}
+	if _, height, _ := store.Tip(); height != testAnchorHeight {
+		t.Errorf("store.Tip: got height %d, want %d", height, testAnchorHeight)
+	}
+	if _, err := c.HeaderOnly(chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("HeaderOnly unknown: got error %v, want %v", err,
+			ErrUnknownBlock)
+	}
+
+	events := drain(ch)
+	if len(events) != 4 {
+		t.Fatalf("AppendHeaderOnly: got %d events, want 4", len(events))
+	}
+	for i, event := range events {
+		if event.Type != BlockConnected || event.Mirror != nil ||
+			event.Hash != mirrors[i+1].BtcHeader.BlockHash() {
+
+			t.Errorf("AppendHeaderOnly event #%d: got %v %v with mirror %v",
+				i, event.Type, event.Hash, event.Mirror)
+		}
+	}
+
+	// Bodies are checked against the header.
+	m := mirrors[3]
+	hash := m.BtcHeader.BlockHash()
+	other := mirrors[2]
+	tests := []struct {
+		name        string
+		hash        chainhash.Hash
+		coinBaseTx  *wire.MsgTx
+		merkleNodes []chainhash.Hash
+		txCount     int
+		want        error
+	}{
+		{"unknown block", chainhash.Hash{1}, &m.CoinBaseTx, m.MerkleNodes, 4, ErrUnknownBlock},
+		{"full block", mirrors[0].BtcHeader.BlockHash(), &m.CoinBaseTx, m.MerkleNodes, 4, ErrDuplicateBlock},
+		{"wrong coinbase", hash, &other.CoinBaseTx, m.MerkleNodes, 4, nil},
+		{"wrong branch", hash, &m.CoinBaseTx, other.MerkleNodes[:2], 4, nil},
+		{"short branch", hash, &m.CoinBaseTx, m.MerkleNodes[:1], 4, nil},
+		{"no transactions", hash, &m.CoinBaseTx, nil, 0, nil},
+	}
+	for _, test := range tests {
+		err := c.AttachBody(test.hash, test.coinBaseTx, test.merkleNodes, test.txCount)
+		if err == nil || (test.want != nil && !errors.Is(err, test.want)) {
+			t.Errorf("AttachBody (%s): got error %v, want %v", test.name, err,
+				test.want)
+		}
+	}
+	if headerOnly, _ := c.HeaderOnly(hash); !headerOnly {
+		t.Errorf("HeaderOnly: failed attach upgraded the block")
+	}
+
+	if err := attachBody(c, m); err != nil {
+		t.Fatalf("AttachBody error %v", err)
+	}
+	if err := attachBody(c, m); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("AttachBody twice: got error %v, want %v", err,
+			ErrDuplicateBlock)
+	}
+	got, err := c.ByHeight(testAnchorHeight + 3)
+	if err != nil || got.BtcHeader.BlockHash() != hash || got.CheckMerkle() != nil {
+		t.Errorf("ByHeight: got error %v or wrong mirror", err)
+	}
+	if _, err := store.ByHeight(testAnchorHeight + 3); err != nil {
+		t.Errorf("store.ByHeight: got error %v", err)
+	}
+	checkEvents(t, "AttachBody", drain(ch), []wantEvent{
+		{BodyAttached, hash, testAnchorHeight + 3},
+	})
+}
+
+func TestAppendHeaderOnlyReorg(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors)
+
+	// A longer branch of headers takes over.
+	branch := newTestBranch(mirrors[0], 1000, 3)
+	var event *ReorgEvent
+	for i, m := range branch {
+		var err error
+		if event, err = c.AppendHeaderOnly(m.BtcHeader); err != nil {
+			t.Fatalf("AppendHeaderOnly #%d error %v", i, err)
+		}
+		if i < 2 && event != nil {
+			t.Errorf("AppendHeaderOnly #%d: unexpected reorg", i)
+		}
+	}
+	if event == nil || event.ForkHeight != testAnchorHeight ||
+		len(event.Disconnected) != 2 || len(event.Connected) != 3 {
+
+		t.Fatalf("AppendHeaderOnly: got event %v", event)
+	}
+	for i, m := range event.Connected {
+		if m != nil {
+			t.Errorf("Connected #%d: got %v, want nil for a header-only block", i, m)
+		}
+	}
+
+	// Bodies of side branch blocks can be attached too, silently.
+	ch, cancel := c.Subscribe()
+	defer cancel()
+	side := newTestMirror(branch[0].BtcHeader.BlockHash(), 2000, 1)
+	if _, err := c.AppendHeaderOnly(side.BtcHeader); err != nil {
+		t.Fatalf("AppendHeaderOnly error %v", err)
+	}
+	drain(ch)
+	if err := attachBody(c, side); err != nil {
+		t.Fatalf("AttachBody side branch error %v", err)
+	}
+	if events := drain(ch); len(events) != 0 {
+		t.Errorf("AttachBody side branch: got %d events, want 0", len(events))
+	}
+
+	// Header-only blocks roll back as nil.
+	rolled, err := c.Rollback(1)
+	if err != nil || len(rolled) != 1 || rolled[0] != nil {
+		t.Errorf("Rollback: got %v, error %v", rolled, err)
+	}
+}
+
+func TestAppendHeaderOnlyPrune(t *testing.T) {
+	const depth = 2
+	mirrors := newTestMirrors(6)
+	store := newMemStore()
+	c := newTestChain(t, mirrors[:1], WithStore(store), WithPruneDepth(depth))
+
+	for _, m := range mirrors[1:] {
+		if _, err := c.AppendHeaderOnly(m.BtcHeader); err != nil {
+			t.Fatalf("AppendHeaderOnly error %v", err)
+		}
+	}
+	for _, m := range mirrors[2:] {
+		if err := attachBody(c, m); err != nil {
+			t.Fatalf("AttachBody error %v", err)
+		}
+	}
+
+	// Pruning waits for the body of the first block.
+	if _, err := c.ByHeight(testAnchorHeight + 1); !errors.Is(err, ErrHeaderOnly) {
+		t.Errorf("ByHeight: got error %v, want %v", err, ErrHeaderOnly)
+	}
+	if _, err := c.ByHeight(testAnchorHeight + 2); err != nil {
+		t.Errorf("ByHeight: got error %v", err)
+	}
+
+	if err := attachBody(c, mirrors[1]); err != nil {
+		t.Fatalf("AttachBody error %v", err)
+	}
+	for i := 1; i < len(mirrors); i++ {
+		_, err := c.ByHeight(testAnchorHeight + int64(i))
+		if wantPruned := i <= len(mirrors)-1-depth; wantPruned != errors.Is(err, ErrPruned) {
+			t.Errorf("ByHeight #%d: got error %v", i, err)
+		}
+	}
+	checkStorePruned(t, c, store)
+}
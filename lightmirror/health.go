@@ -0,0 +1,249 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoRecentBlock is reported by CompositeHealth for a component which
+// received no block for longer than the maximum block age.
+var ErrNoRecentBlock = errors.New("no recent block")
+
+// HealthChecker is implemented by the fetchers and subscribers of the
+// package so that probes can tell whether their upstream connection is
+// alive and how stale their view of the chain is.
+type HealthChecker interface {
+	// Ping makes a lightweight call to the upstream source, or checks the
+	// component still runs when it has none of its own.
+	Ping(ctx context.Context) error
+
+	// LastBlockAge returns the time elapsed since the component last
+	// received a block, or since it was created if it received none.
+	LastBlockAge() time.Duration
+
+	// LastError returns the last error the component met and when, nil
+	// if it met none.
+	LastError() (error, time.Time)
+}
+
+// pinger is implemented by the fetchers which can reach their upstream
+// source cheaply.  The fetchers wrapping another one ping it through
+// pingFetcher.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// pingFetcher pings f if it can be pinged.
+func pingFetcher(ctx context.Context, f Fetcher) error {
+	if p, ok := f.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// healthState records the blocks and errors of a component, for its
+// LastBlockAge and LastError methods.
+type healthState struct {
+	// now returns the current time, time.Now outside of the tests.
+	now func() time.Time
+
+	mtx       sync.Mutex
+	lastBlock time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func newHealthState() *healthState {
+	return &healthState{now: time.Now, lastBlock: time.Now()}
+}
+
+// block records a block received.
+func (h *healthState) block() {
+	now := h.now()
+	h.mtx.Lock()
+	h.lastBlock = now
+	h.mtx.Unlock()
+}
+
+// fail records err.
+func (h *healthState) fail(err error) {
+	now := h.now()
+	h.mtx.Lock()
+	h.lastErr, h.lastErrAt = err, now
+	h.mtx.Unlock()
+}
+
+// fetched records the outcome of an upstream fetch.  A block the upstream
+// source does not have, or a cancelled fetch, is neither a block nor an
+// error.
+func (h *healthState) fetched(err error) {
+	switch {
+	case err == nil:
+		h.block()
+	case !errors.Is(err, ErrNotFound) && !errors.Is(err, context.Canceled):
+		h.fail(err)
+	}
+}
+
+// LastBlockAge returns the time elapsed since the last block received.
+func (h *healthState) LastBlockAge() time.Duration {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.now().Sub(h.lastBlock)
+}
+
+// LastError returns the last error recorded and when.
+func (h *healthState) LastError() (error, time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.lastErr, h.lastErrAt
+}
+
+// ComponentHealth is the state of a component of a CompositeHealth.
+type ComponentHealth struct {
+	Name string
+
+	// PingErr is the error of the ping of the component, nil if it
+	// answered.
+	PingErr error
+
+	// LastBlockAge, LastError and LastErrorAt are what the component
+	// reports.  Stale is set when LastBlockAge is over the maximum block
+	// age.
+	LastBlockAge time.Duration
+	LastError    error
+	LastErrorAt  time.Time
+	Stale        bool
+}
+
+// HealthReport is the state of every component of a CompositeHealth, in the
+// order they were added.
+type HealthReport struct {
+	Components []ComponentHealth
+}
+
+// Live returns the ping error of the first component which did not answer,
+// nil if all did.
+func (r *HealthReport) Live() error {
+	for _, c := range r.Components {
+		if c.PingErr != nil {
+			return fmt.Errorf("%s: %w", c.Name, c.PingErr)
+		}
+	}
+	return nil
+}
+
+// Ready returns the error of Live, or ErrNoRecentBlock for the first stale
+// component, nil if every component answered and is fresh.
+func (r *HealthReport) Ready() error {
+	if err := r.Live(); err != nil {
+		return err
+	}
+	for _, c := range r.Components {
+		if c.Stale {
+			return fmt.Errorf("%s: last block %v ago: %w", c.Name,
+				c.LastBlockAge, ErrNoRecentBlock)
+		}
+	}
+	return nil
+}
+
+// namedChecker is a component of a CompositeHealth.
+type namedChecker struct {
+	name    string
+	checker HealthChecker
+}
+
+// CompositeHealth aggregates the health of a set of components.  It is a
+// HealthChecker itself: it pings every component, its last block is the
+// most recent of the components and its last error the latest.
+type CompositeHealth struct {
+	maxBlockAge time.Duration
+
+	mtx        sync.RWMutex
+	components []namedChecker
+}
+
+// NewCompositeHealth returns a CompositeHealth whose components are stale
+// when they received no block for more than maxBlockAge.  A zero
+// maxBlockAge never makes them stale.
+func NewCompositeHealth(maxBlockAge time.Duration) *CompositeHealth {
+	return &CompositeHealth{maxBlockAge: maxBlockAge}
+}
+
+// Add adds the component c under name.
+func (h *CompositeHealth) Add(name string, c HealthChecker) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.components = append(h.components, namedChecker{name, c})
+}
+
+func (h *CompositeHealth) snapshot() []namedChecker {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return append([]namedChecker(nil), h.components...)
+}
+
+// Check pings every component and returns their state.
+func (h *CompositeHealth) Check(ctx context.Context) *HealthReport {
+	components := h.snapshot()
+	report := &HealthReport{Components: make([]ComponentHealth, len(components))}
+	for i, c := range components {
+		age := c.checker.LastBlockAge()
+		lastErr, lastErrAt := c.checker.LastError()
+		report.Components[i] = ComponentHealth{
+			Name:         c.name,
+			PingErr:      c.checker.Ping(ctx),
+			LastBlockAge: age,
+			LastError:    lastErr,
+			LastErrorAt:  lastErrAt,
+			Stale:        h.maxBlockAge > 0 && age > h.maxBlockAge,
+		}
+	}
+	return report
+}
+
+// Ping pings every component and returns the error of the first which did
+// not answer.
+func (h *CompositeHealth) Ping(ctx context.Context) error {
+	for _, c := range h.snapshot() {
+		if err := c.checker.Ping(ctx); err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// LastBlockAge returns the smallest block age of the components, zero
+// without components.
+func (h *CompositeHealth) LastBlockAge() time.Duration {
+	var age time.Duration
+	for i, c := range h.snapshot() {
+		if a := c.checker.LastBlockAge(); i == 0 || a < age {
+			age = a
+		}
+	}
+	return age
+}
+
+// LastError returns the latest error of the components, prefixed with the
+// name of its component.
+func (h *CompositeHealth) LastError() (error, time.Time) {
+	var (
+		last   error
+		lastAt time.Time
+	)
+	for _, c := range h.snapshot() {
+		if err, at := c.checker.LastError(); err != nil && at.After(lastAt) {
+			last, lastAt = fmt.Errorf("%s: %w", c.name, err), at
+		}
+	}
+	return last, lastAt
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubHealth is a HealthChecker reporting its fields.
+type stubHealth struct {
+	pingErr   error
+	age       time.Duration
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func (h *stubHealth) Ping(ctx context.Context) error { return h.pingErr }
+
+func (h *stubHealth) LastBlockAge() time.Duration { return h.age }
+
+func (h *stubHealth) LastError() (error, time.Time) { return h.lastErr, h.lastErrAt }
+
+// pingingFetcher is a countingFetcher which can be pinged.
+type pingingFetcher struct {
+	*countingFetcher
+	pingErr error
+	fail    error
+}
+
+func (f *pingingFetcher) Ping(ctx context.Context) error { return f.pingErr }
+
+func (f *pingingFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	if f.fail != nil {
+		return nil, f.fail
+	}
+	return f.countingFetcher.FetchByHeight(ctx, height)
+}
+
+func TestCompositeHealth(t *testing.T) {
+	errDown := errors.New("connection refused")
+	at := time.Unix(1231006505, 0)
+	tests := []struct {
+		name       string
+		components []*stubHealth
+		live       error
+		ready      error
+	}{
+		{"none", nil, nil, nil},
+		{"healthy", []*stubHealth{{age: time.Minute}, {age: time.Second}}, nil, nil},
+		{"stale", []*stubHealth{{age: time.Minute}, {age: time.Hour}}, nil, ErrNoRecentBlock},
+		{"down", []*stubHealth{{age: time.Hour}, {pingErr: errDown}}, errDown, errDown},
+	}
+	for _, test := range tests {
+		h := NewCompositeHealth(10 * time.Minute)
+		for _, c := range test.components {
+			h.Add(test.name, c)
+		}
+		report := h.Check(context.Background())
+		if err := report.Live(); !errors.Is(err, test.live) || (err == nil) != (test.live == nil) {
+			t.Errorf("Live (%s): got error %v, want %v", test.name, err, test.live)
+		}
+		if err := report.Ready(); !errors.Is(err, test.ready) || (err == nil) != (test.ready == nil) {
+			t.Errorf("Ready (%s): got error %v, want %v", test.name, err, test.ready)
+		}
+		if err := h.Ping(context.Background()); !errors.Is(err, test.live) || (err == nil) != (test.live == nil) {
+			t.Errorf("Ping (%s): got error %v, want %v", test.name, err, test.live)
+		}
+	}
+
+	// The composite reports its freshest block and latest error.
+	h := NewCompositeHealth(0)
+	h.Add("a", &stubHealth{age: time.Hour, lastErr: errDown, lastErrAt: at.Add(time.Second)})
+	h.Add("b", &stubHealth{age: time.Minute, lastErr: ErrNotFound, lastErrAt: at})
+	if age := h.LastBlockAge(); age != time.Minute {
+		t.Errorf("LastBlockAge: got %v, want %v", age, time.Minute)
+	}
+	if err, errAt := h.LastError(); !errors.Is(err, errDown) || !errAt.Equal(at.Add(time.Second)) {
+		t.Errorf("LastError: got %v at %v, want %v", err, errAt, errDown)
+	}
+	if err := h.Check(context.Background()).Ready(); err != nil {
+		t.Errorf("Ready without a maximum block age: got error %v", err)
+	}
+}
+
+func TestFetcherHealth(t *testing.T) {
+	errDown := errors.New("connection refused")
+	upstream := &pingingFetcher{countingFetcher: newCountingFetcher(newTestMirrors(2))}
+	cache := NewCachingFetcher(upstream, 10)
+	dedup := NewDedupFetcher(upstream)
+	tests := []struct {
+		name string
+		f    interface {
+			Fetcher
+			HealthChecker
+		}
+		health **healthState
+	}{
+		{"CachingFetcher", cache, &cache.health},
+		{"DedupFetcher", dedup, &dedup.health},
+	}
+	ctx := context.Background()
+
+	for _, test := range tests {
+		name, f := test.name, test.f
+		clock := &testClock{now: time.Unix(1231006505, 0)}
+		*test.health = &healthState{now: clock.Now, lastBlock: clock.Now()}
+		clock.Advance(time.Hour)
+		if age := f.LastBlockAge(); age != time.Hour {
+			t.Errorf("LastBlockAge (%s): got %v, want %v", name, age, time.Hour)
+		}
+		if _, err := f.FetchByHeight(ctx, 1); err != nil {
+			t.Fatalf("FetchByHeight (%s) error %v", name, err)
+		}
+		if age := f.LastBlockAge(); age != 0 {
+			t.Errorf("LastBlockAge after a fetch (%s): got %v, want 0", name, age)
+		}
+
+		// A height beyond the tip of the upstream source is no error.
+		if _, err := f.FetchByHeight(ctx, 5); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("FetchByHeight (%s): got error %v, want %v", name, err, ErrNotFound)
+		}
+		if err, _ := f.LastError(); err != nil {
+			t.Errorf("LastError (%s): got %v, want none", name, err)
+		}
+
+		upstream.fail, upstream.pingErr = errDown, errDown
+		clock.Advance(time.Minute)
+		if _, err := f.FetchByHeight(ctx, 1); !errors.Is(err, errDown) {
+			t.Fatalf("FetchByHeight (%s): got error %v, want %v", name, err, errDown)
+		}
+		if err, at := f.LastError(); !errors.Is(err, errDown) || !at.Equal(clock.Now()) {
+			t.Errorf("LastError (%s): got %v at %v, want %v at %v", name, err, at, errDown, clock.Now())
+		}
+		if age := f.LastBlockAge(); age != time.Minute {
+			t.Errorf("LastBlockAge after a failure (%s): got %v, want %v", name, age, time.Minute)
+		}
+		if err := f.Ping(ctx); !errors.Is(err, errDown) {
+			t.Errorf("Ping (%s): got error %v, want %v", name, err, errDown)
+		}
+		upstream.fail, upstream.pingErr = nil, nil
+	}
+}
+
+func TestHealthStalledSubscriber(t *testing.T) {
+	mirrors := newTestMirrors(2)
+	c := newTestChain(t, mirrors[:1])
+	sub, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	clock := &testClock{now: time.Unix(1231006505, 0)}
+	w := NewWatcher(sub)
+	w.health = &healthState{now: clock.Now, lastBlock: clock.Now()}
+	h := NewCompositeHealth(10 * time.Minute)
+	h.Add("watcher", w)
+	ready := func() error {
+		t.Helper()
+		return h.Check(context.Background()).Ready()
+	}
+
+	// A watcher not started is not live.
+	if err := h.Check(context.Background()).Live(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Live before Start: got error %v, want %v", err, ErrNotRunning)
+	}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	defer w.Stop(context.Background())
+	if err := ready(); err != nil {
+		t.Errorf("Ready: got error %v", err)
+	}
+
+	// The subscription stalls: readiness flips, liveness does not.
+	clock.Advance(time.Hour)
+	if err := ready(); !errors.Is(err, ErrNoRecentBlock) {
+		t.Errorf("Ready stalled: got error %v, want %v", err, ErrNoRecentBlock)
+	}
+	if err := h.Check(context.Background()).Live(); err != nil {
+		t.Errorf("Live stalled: got error %v", err)
+	}
+
+	// A new block makes the watcher ready again.
+	if _, err := c.Append(mirrors[1]); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.LastBlockAge() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("LastBlockAge: got %v after a block", w.LastBlockAge())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ready(); err != nil {
+		t.Errorf("Ready after a block: got error %v", err)
+	}
+
+	// A watcher whose subscription is closed is no longer live.
+	unsubscribe()
+	deadline = time.Now().Add(5 * time.Second)
+	for w.Ping(context.Background()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Ping: got no error after the subscription closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ready(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Ready closed: got error %v, want %v", err, ErrNotRunning)
+	}
+}
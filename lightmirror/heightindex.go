@@ -0,0 +1,103 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+var (
+	// ErrUnknownBlock is returned when a block hash is not known at all.
+	ErrUnknownBlock = errors.New("unknown block")
+
+	// ErrNotInBestChain is returned when a block is known, but only on a
+	// side branch.
+	ErrNotInBestChain = errors.New("block is not in the best chain")
+
+	// ErrHeightBeyondTip is returned when a height above the tip of the
+	// best chain is queried.
+	ErrHeightBeyondTip = errors.New("height is beyond the chain tip")
+
+	// ErrHeightBeforeAnchor is returned when a height below the anchor of
+	// the chain is queried.
+	ErrHeightBeforeAnchor = errors.New("height is before the chain anchor")
+)
+
+// HeightIndex maps the heights of the best chain to block hashes and back.
+// It covers the heights from the anchor of the chain to its tip.
+//
+// A HeightIndex is owned by a MirrorChain, which updates it as blocks are
+// connected and disconnected.  MirrorChain.HeightIndex hands out copies.
+type HeightIndex struct {
+	base    int64
+	hashes  []chainhash.Hash
+	heights map[chainhash.Hash]int64
+}
+
+func newHeightIndex(base int64) *HeightIndex {
+	return &HeightIndex{
+		base:    base,
+		heights: make(map[chainhash.Hash]int64),
+	}
+}
+
+// TipHeight returns the height of the highest indexed block, or one below the
+// anchor height when the index is empty.
+func (idx *HeightIndex) TipHeight() int64 {
+	return idx.base + int64(len(idx.hashes)) - 1
+}
+
+// HashAtHeight returns the hash of the best chain block at height h.
+func (idx *HeightIndex) HashAtHeight(h int64) (chainhash.Hash, error) {
+	switch {
+	case h < idx.base:
+		return chainhash.Hash{}, ErrHeightBeforeAnchor
+	case h > idx.TipHeight():
+		return chainhash.Hash{}, ErrHeightBeyondTip
+	}
+	return idx.hashes[h-idx.base], nil
+}
+
+// HeightOfHash returns the height of the best chain block with the given
+// hash.  It returns ErrUnknownBlock when the hash is not indexed; the chain
+// refines that into ErrNotInBestChain for blocks it knows on side branches.
+func (idx *HeightIndex) HeightOfHash(hash chainhash.Hash) (int64, error) {
+	h, ok := idx.heights[hash]
+	if !ok {
+		return 0, ErrUnknownBlock
+	}
+	return h, nil
+}
+
+// clone returns a copy of the index, which later changes of idx do not
+// affect.
+func (idx *HeightIndex) clone() *HeightIndex {
+	c := &HeightIndex{
+		base:    idx.base,
+		hashes:  append([]chainhash.Hash(nil), idx.hashes...),
+		heights: make(map[chainhash.Hash]int64, len(idx.heights)),
+	}
+	for hash, h := range idx.heights {
+		c.heights[hash] = h
+	}
+	return c
+}
+
+// connect adds hash at the height following the tip.
+func (idx *HeightIndex) connect(hash chainhash.Hash) {
+	idx.heights[hash] = idx.base + int64(len(idx.hashes))
+	idx.hashes = append(idx.hashes, hash)
+}
+
+// disconnect removes the tip and returns its hash.
+func (idx *HeightIndex) disconnect() chainhash.Hash {
+	last := len(idx.hashes) - 1
+	hash := idx.hashes[last]
+	idx.hashes = idx.hashes[:last]
+	delete(idx.heights, hash)
+	return hash
+}
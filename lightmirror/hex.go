@@ -0,0 +1,76 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// SerializeToHex returns the serialization of the mirror as a string of
+// lowercase hex digits without prefix, the form bitcoind exchanges raw
+// transactions in.
+func (light *BtcLightMirrorV2) SerializeToHex() (string, error) {
+	b, err := light.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// DeserializeFromHex decodes the mirror serialized in the hex string s into
+// the receiver, as DeserializeBytes decodes it.  The digits may be upper or
+// lowercase, with a 0x prefix and surrounding white space.
+func (light *BtcLightMirrorV2) DeserializeFromHex(s string) error {
+	b, err := decodeMirrorHex(s)
+	if err != nil {
+		return err
+	}
+	m, err := DeserializeBytes(b)
+	if err != nil {
+		return err
+	}
+	*light = *m
+	return nil
+}
+
+// SerializeToHex returns the serialization of the V3 mirror in hex, as
+// BtcLightMirrorV2.SerializeToHex does.
+func (light *BtcLightMirrorV3) SerializeToHex() (string, error) {
+	b, err := light.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// DeserializeFromHex decodes the V3 mirror serialized in the hex string s
+// into the receiver, rejecting trailing bytes, as
+// BtcLightMirrorV2.DeserializeFromHex does.
+func (light *BtcLightMirrorV3) DeserializeFromHex(s string) error {
+	b, err := decodeMirrorHex(s)
+	if err != nil {
+		return err
+	}
+	var m BtcLightMirrorV3
+	if err := m.DeserializeWith(bytes.NewReader(b), DeserializeOptions{RejectTrailingBytes: true}); err != nil {
+		return noEOF(err)
+	}
+	*light = m
+	return nil
+}
+
+// decodeMirrorHex returns the bytes of the hex string s of a mirror.
+func decodeMirrorHex(s string) ([]byte, error) {
+	digits := strings.TrimSpace(s)
+	digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("mirror hex: %w", err)
+	}
+	return b, nil
+}
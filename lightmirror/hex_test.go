@@ -0,0 +1,81 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestMirrorHex(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	s, err := m.SerializeToHex()
+	if err != nil {
+		t.Fatalf("SerializeToHex error %v", err)
+	}
+	b, _ := m.ToBytes()
+	if s != hex.EncodeToString(b) {
+		t.Errorf("SerializeToHex: got %s, want the hex of ToBytes", s)
+	}
+
+	for _, in := range []string{s, strings.ToUpper(s), "0x" + s, " \n" + s + "\n"} {
+		var decoded BtcLightMirrorV2
+		if err := decoded.DeserializeFromHex(in); err != nil || !decoded.Equal(m) {
+			t.Errorf("DeserializeFromHex (%.10q): got error %v", in, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		in     string
+		target error
+	}{
+		{"empty", "", io.ErrUnexpectedEOF},
+		{"truncated", s[:len(s)-2], io.ErrUnexpectedEOF},
+		{"trailing", s + "00", ErrTrailingData},
+		{"odd length", s + "0", hex.ErrLength},
+		{"not hex", s[:len(s)-2] + "zz", nil},
+	}
+	for _, test := range tests {
+		decoded := *m.Clone()
+		err := decoded.DeserializeFromHex(test.in)
+		if err == nil || (test.target != nil && !errors.Is(err, test.target)) {
+			t.Errorf("DeserializeFromHex (%s): got error %v, want %v", test.name, err, test.target)
+		}
+		if !decoded.Equal(m) {
+			t.Errorf("DeserializeFromHex (%s): modified the receiver", test.name)
+		}
+	}
+}
+
+func TestMirrorHexV3(t *testing.T) {
+	header, coinBaseTx, txids, wtxids := newTestBlock(5)
+	m, err := NewV3(header, coinBaseTx, txids, wtxids)
+	if err != nil {
+		t.Fatalf("NewV3 error %v", err)
+	}
+	s, err := m.SerializeToHex()
+	if err != nil {
+		t.Fatalf("SerializeToHex error %v", err)
+	}
+	var decoded BtcLightMirrorV3
+	if err := decoded.DeserializeFromHex(s); err != nil || !decoded.Equal(m) {
+		t.Errorf("DeserializeFromHex: got %v, error %v", &decoded, err)
+	}
+	if err := decoded.DeserializeFromHex(s[:len(s)-2]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DeserializeFromHex of a truncated mirror: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// A V2 decoder refuses the witness branch as trailing bytes.
+	var v2 BtcLightMirrorV2
+	if err := v2.DeserializeFromHex(s); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("BtcLightMirrorV2.DeserializeFromHex: got error %v, want %v", err, ErrTrailingData)
+	}
+}
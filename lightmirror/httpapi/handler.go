@@ -0,0 +1,440 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package httpapi serves stored mirrors as JSON over HTTP, for dashboards
+// and debugging.  The handler answers
+//
+//	GET /mirror/hash/{hash}        the mirror with the block hash
+//	GET /mirror/height/{n}         the mirror at height n
+//	GET /mirror/{hash}/powerparams the power parameters of the mirror
+//	GET /tip                       the mirror at the tip
+//	GET /range?start=&end=         the mirrors at heights [start, end]
+//	GET /healthz                   whether the components answer
+//	GET /readyz                    whether they also received recent blocks
+//
+// Mirrors are written in the JSON form of lightmirror.BtcLightMirrorV2, with
+// their height and their serialization in hex, and hashes as block explorers
+// print them.  The range is streamed
+// as newline-delimited JSON, a mirror per line.  The health routes, served
+// with WithHealth, answer 503 Service Unavailable when the check fails.
+package httpapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// DefaultMaxRange is the most mirrors a range request returns unless
+// WithMaxRange sets otherwise.
+const DefaultMaxRange = 1000
+
+// Source holds the mirrors the handler serves.  A lightmirror.Store is a
+// Source, and ChainSource adapts a lightmirror.MirrorChain.
+type Source interface {
+	ByHash(hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, int64, error)
+	ByHeight(height int64) (*lightmirror.BtcLightMirrorV2, error)
+	Tip() (*lightmirror.BtcLightMirrorV2, int64, error)
+	Iterate(start, end int64, fn func(height int64, m *lightmirror.BtcLightMirrorV2) error) error
+}
+
+// chainSource is the Source of the best chain of a MirrorChain.
+type chainSource struct {
+	*lightmirror.MirrorChain
+}
+
+// ChainSource returns the Source of the blocks of chain.  Its tip is not
+// found while it is a header-only block.
+func ChainSource(chain *lightmirror.MirrorChain) Source {
+	return chainSource{chain}
+}
+
+func (c chainSource) Tip() (*lightmirror.BtcLightMirrorV2, int64, error) {
+	m, height := c.MirrorChain.Tip()
+	if m == nil {
+		return nil, height, lightmirror.ErrHeaderOnly
+	}
+	return m, height, nil
+}
+
+// Option configures a handler.
+type Option func(*handler)
+
+// WithMaxRange sets the most mirrors a range request may span, heights
+// without a mirror included.  Wider ranges are bad requests.
+func WithMaxRange(n int64) Option {
+	return func(h *handler) {
+		h.maxRange = n
+	}
+}
+
+// WithHealth serves the /healthz and /readyz routes from the state of the
+// components of health, the one of contract.Relayer.Health for instance.
+func WithHealth(health *lightmirror.CompositeHealth) Option {
+	return func(h *handler) {
+		h.health = health
+	}
+}
+
+// handler serves the mirrors of src.
+type handler struct {
+	src      Source
+	maxRange int64
+	health   *lightmirror.CompositeHealth
+}
+
+// NewHandler returns the handler of the API serving the mirrors of src.
+func NewHandler(src Source, opts ...Option) http.Handler {
+	h := &handler{src: src, maxRange: DefaultMaxRange}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// httpError is an error with the status code of its response.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+// notFoundErrors are the errors of a Source which mean the mirror asked for
+// is not there.
+var notFoundErrors = []error{
+	lightmirror.ErrNotFound,
+	lightmirror.ErrUnknownBlock,
+	lightmirror.ErrHeightBeyondTip,
+	lightmirror.ErrHeightBeforeAnchor,
+	lightmirror.ErrPruned,
+	lightmirror.ErrHeaderOnly,
+	lightmirror.ErrNoPowerParams,
+	lightmirror.ErrWitnessStripped,
+}
+
+// statusCode returns the status code of err.
+func statusCode(err error) int {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		return herr.code
+	}
+	for _, e := range notFoundErrors {
+		if errors.Is(err, e) {
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, &httpError{http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method)})
+		return
+	}
+
+	var err error
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "mirror" && parts[1] == "hash":
+		err = h.byHash(w, parts[2])
+	case len(parts) == 3 && parts[0] == "mirror" && parts[1] == "height":
+		err = h.byHeight(w, parts[2])
+	case len(parts) == 3 && parts[0] == "mirror" && parts[2] == "powerparams":
+		err = h.powerParams(w, parts[1])
+	case len(parts) == 1 && parts[0] == "tip":
+		err = h.tip(w)
+	case len(parts) == 1 && parts[0] == "range":
+		err = h.iterate(w, r)
+	case len(parts) == 1 && parts[0] == "healthz" && h.health != nil:
+		h.check(w, r, (*lightmirror.HealthReport).Live)
+	case len(parts) == 1 && parts[0] == "readyz" && h.health != nil:
+		h.check(w, r, (*lightmirror.HealthReport).Ready)
+	default:
+		err = &httpError{http.StatusNotFound, fmt.Errorf("no route %s", r.URL.Path)}
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func (h *handler) byHash(w http.ResponseWriter, s string) error {
+	hash, err := parseHash(s)
+	if err != nil {
+		return err
+	}
+	m, height, err := h.src.ByHash(hash)
+	if err != nil {
+		return err
+	}
+	return writeMirror(w, m, height)
+}
+
+func (h *handler) byHeight(w http.ResponseWriter, s string) error {
+	height, err := parseHeight("height", s)
+	if err != nil {
+		return err
+	}
+	m, err := h.src.ByHeight(height)
+	if err != nil {
+		return err
+	}
+	return writeMirror(w, m, height)
+}
+
+func (h *handler) tip(w http.ResponseWriter) error {
+	m, height, err := h.src.Tip()
+	if err != nil {
+		return err
+	}
+	return writeMirror(w, m, height)
+}
+
+func (h *handler) powerParams(w http.ResponseWriter, s string) error {
+	hash, err := parseHash(s)
+	if err != nil {
+		return err
+	}
+	m, _, err := h.src.ByHash(hash)
+	if err != nil {
+		return err
+	}
+	d, err := m.ParseDelegation(lightmirror.PreferOutput)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, newPowerParamsJSON(d))
+}
+
+// iterate streams the mirrors of the range of the request, a line each.
+// Once the first line is written, an error is reported in a last line
+// holding it.
+func (h *handler) iterate(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	start, err := parseHeight("start", query.Get("start"))
+	if err != nil {
+		return err
+	}
+	end, err := parseHeight("end", query.Get("end"))
+	if err != nil {
+		return err
+	}
+	if end < start {
+		return badRequest("end %d is before start %d", end, start)
+	}
+	if n := end - start + 1; n > h.maxRange || n <= 0 {
+		return badRequest("range of %d heights is over the maximum of %d",
+			end-start+1, h.maxRange)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	written := false
+	err = h.src.Iterate(start, end, func(height int64, m *lightmirror.BtcLightMirrorV2) error {
+		if err := enc.Encode(&mirrorJSON{m, height}); err != nil {
+			return err
+		}
+		written = true
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && written {
+		enc.Encode(errorJSON{Error: err.Error()})
+		return nil
+	}
+	return err
+}
+
+// check writes the health report of the components, with the status code
+// of the verdict of probe on it.
+func (h *handler) check(w http.ResponseWriter, r *http.Request, probe func(*lightmirror.HealthReport) error) {
+	report := h.health.Check(r.Context())
+	v := healthJSON{
+		Status:     "ok",
+		Components: make([]componentJSON, 0, len(report.Components)),
+	}
+	code := http.StatusOK
+	if err := probe(report); err != nil {
+		v.Status, v.Error = "unavailable", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	for _, c := range report.Components {
+		v.Components = append(v.Components, newComponentJSON(c))
+	}
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+// parseHash parses the hash of a path.
+func parseHash(s string) (chainhash.Hash, error) {
+	hash, err := lightmirror.ParseDisplayHex(s)
+	if err != nil {
+		return chainhash.Hash{}, badRequest("%v", err)
+	}
+	return hash, nil
+}
+
+// parseHeight parses the height of a path or query parameter name.
+func parseHeight(name, s string) (int64, error) {
+	if s == "" {
+		return 0, badRequest("missing %s", name)
+	}
+	height, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || height < 0 {
+		return 0, badRequest("invalid %s %q", name, s)
+	}
+	return height, nil
+}
+
+func writeMirror(w http.ResponseWriter, m *lightmirror.BtcLightMirrorV2, height int64) error {
+	return writeJSON(w, &mirrorJSON{m, height})
+}
+
+// writeJSON writes the response holding v.  It fails without writing if v
+// does not encode.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+	return nil
+}
+
+// writeError writes the response of err.
+func writeError(w http.ResponseWriter, err error) {
+	b, _ := json.Marshal(errorJSON{Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode(err))
+	w.Write(append(b, '\n'))
+}
+
+// errorJSON is the body of an error response.
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// mirrorJSON is the JSON form of a mirror at a height: the JSON form of
+// lightmirror.BtcLightMirrorV2, along with the height of the mirror and, as
+// mirror, the serialized mirror in hex, which
+// lightmirror.BtcLightMirrorV2.Deserialize decodes.
+type mirrorJSON struct {
+	m      *lightmirror.BtcLightMirrorV2
+	height int64
+}
+
+func (v *mirrorJSON) MarshalJSON() ([]byte, error) {
+	b, err := v.m.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := v.m.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	extra, err := json.Marshal(struct {
+		Height int64  `json:"height"`
+		Mirror string `json:"mirror"`
+	}{v.height, hex.EncodeToString(raw)})
+	if err != nil {
+		return nil, err
+	}
+	// Both are objects: the fields of extra go after those of the mirror.
+	b = append(b[:len(b)-1], ',')
+	return append(b, extra[1:]...), nil
+}
+
+// componentJSON is the JSON form of the health of a component.  The block
+// age is in seconds.
+type componentJSON struct {
+	Name         string  `json:"name"`
+	PingError    string  `json:"pingError,omitempty"`
+	LastBlockAge float64 `json:"lastBlockAge"`
+	Stale        bool    `json:"stale"`
+	LastError    string  `json:"lastError,omitempty"`
+	LastErrorAt  int64   `json:"lastErrorAt,omitempty"`
+}
+
+func newComponentJSON(c lightmirror.ComponentHealth) componentJSON {
+	v := componentJSON{
+		Name:         c.Name,
+		LastBlockAge: c.LastBlockAge.Round(time.Millisecond).Seconds(),
+		Stale:        c.Stale,
+	}
+	if c.PingErr != nil {
+		v.PingError = c.PingErr.Error()
+	}
+	if c.LastError != nil {
+		v.LastError = c.LastError.Error()
+		v.LastErrorAt = c.LastErrorAt.Unix()
+	}
+	return v
+}
+
+// healthJSON is the body of the health routes.  Error is the reason of an
+// unavailable status.
+type healthJSON struct {
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	Components []componentJSON `json:"components"`
+}
+
+// rewardJSON is the JSON form of a weighted reward address.
+type rewardJSON struct {
+	Address string `json:"address"`
+	Weight  uint16 `json:"weight"`
+}
+
+// powerParamsJSON is the JSON form of a delegation.  ActivationHeight is
+// only set on delegations which have one.
+type powerParamsJSON struct {
+	Version          byte         `json:"version"`
+	Source           string       `json:"source"`
+	Candidate        string       `json:"candidate"`
+	Reward           string       `json:"reward"`
+	Rewards          []rewardJSON `json:"rewards"`
+	CoreBlockHash    string       `json:"coreBlockHash"`
+	ActivationHeight *uint32      `json:"activationHeight,omitempty"`
+}
+
+func newPowerParamsJSON(d *lightmirror.Delegation) *powerParamsJSON {
+	v := &powerParamsJSON{
+		Version:       d.Version,
+		Source:        d.Source.String(),
+		Candidate:     d.Candidate.Hex(),
+		Reward:        d.Reward.Hex(),
+		Rewards:       make([]rewardJSON, 0, len(d.Rewards)),
+		CoreBlockHash: d.CoreBlockHash.Hex(),
+	}
+	for _, r := range d.Rewards {
+		v.Rewards = append(v.Rewards, rewardJSON{r.Address.Hex(), r.Weight})
+	}
+	if d.HasActivationHeight {
+		height := d.ActivationHeight
+		v.ActivationHeight = &height
+	}
+	return v
+}
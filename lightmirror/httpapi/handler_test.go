@@ -0,0 +1,372 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/filestore"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	testCandidate = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	testReward    = common.HexToAddress("0x2222222222222222222222222222222222222222")
+)
+
+func newChain(t *testing.T, mirrors []*lightmirror.BtcLightMirrorV2) *lightmirror.MirrorChain {
+	t.Helper()
+	c, err := lightmirror.NewMirrorChain(mirrors[0], 0,
+		lightmirror.WithChainParams(mirrortest.Params))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	return c
+}
+
+func newStore(t *testing.T, mirrors []*lightmirror.BtcLightMirrorV2) lightmirror.Store {
+	t.Helper()
+	s, err := filestore.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for height, m := range mirrors {
+		if err := s.Put(m, int64(height)); err != nil {
+			t.Fatalf("Put #%d error %v", height, err)
+		}
+	}
+	return s
+}
+
+// get serves the request of path with h, and returns the response.
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+// mirrorResponse is a decoded mirror response.
+type mirrorResponse struct {
+	Height int64  `json:"height"`
+	Mirror string `json:"mirror"`
+
+	// decoded is the mirror decoded from its JSON form, raw from Mirror.
+	decoded, raw *lightmirror.BtcLightMirrorV2
+}
+
+// decodeMirror decodes the mirror response b.
+func decodeMirror(t *testing.T, b []byte) *mirrorResponse {
+	t.Helper()
+	v := mirrorResponse{decoded: new(lightmirror.BtcLightMirrorV2), raw: new(lightmirror.BtcLightMirrorV2)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("response %s: %v", b, err)
+	}
+	if err := json.Unmarshal(b, v.decoded); err != nil {
+		t.Fatalf("mirror %s: %v", b, err)
+	}
+	raw, err := hex.DecodeString(v.Mirror)
+	if err != nil {
+		t.Fatalf("mirror %q: %v", v.Mirror, err)
+	}
+	if err := v.raw.Deserialize(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("Deserialize error %v", err)
+	}
+	return &v
+}
+
+func TestMirrorRoutes(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 4, mirrortest.WithTxCount(3))
+	sources := []struct {
+		name string
+		src  Source
+	}{
+		{"chain", ChainSource(newChain(t, mirrors))},
+		{"store", newStore(t, mirrors)},
+	}
+
+	for _, s := range sources {
+		h := NewHandler(s.src)
+		for height, want := range mirrors {
+			hash := want.BtcHeader.BlockHash()
+			paths := []string{
+				"/mirror/hash/" + hash.String(),
+				fmt.Sprintf("/mirror/height/%d", height),
+			}
+			if height == len(mirrors)-1 {
+				paths = append(paths, "/tip")
+			}
+			for _, path := range paths {
+				rec := get(h, path)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("GET %s (%s): status %d %s", path, s.name, rec.Code,
+						rec.Body)
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("GET %s (%s): content type %q", path, s.name, ct)
+				}
+				v := decodeMirror(t, rec.Body.Bytes())
+				if v.Height != int64(height) || v.decoded.BtcHeader.BlockHash() != hash {
+					t.Errorf("GET %s (%s): got %v at %d", path, s.name, v.decoded, v.Height)
+				}
+				if !v.decoded.Equal(want) || !v.raw.Equal(want) {
+					t.Errorf("GET %s (%s): mirror %v, serialized %v, want %v", path,
+						s.name, v.decoded, v.raw, want)
+				}
+			}
+		}
+	}
+}
+
+func TestPowerParamsRoute(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 2,
+		mirrortest.WithPowerParams(testCandidate, testReward))
+	plain := mirrortest.GenerateChain(t, 1, mirrortest.WithSeed(2))
+	h := NewHandler(newStore(t, append(mirrors, plain...)))
+
+	hash := mirrors[1].BtcHeader.BlockHash()
+	rec := get(h, "/mirror/"+hash.String()+"/powerparams")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d %s", rec.Code, rec.Body)
+	}
+	var v powerParamsJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	_, _, coreHash := mirrors[1].ParsePowerParams()
+	want := powerParamsJSON{
+		Version:       lightmirror.PowerPayloadV1,
+		Source:        "output",
+		Candidate:     testCandidate.Hex(),
+		Reward:        testReward.Hex(),
+		Rewards:       []rewardJSON{{testReward.Hex(), 1}},
+		CoreBlockHash: coreHash.Hex(),
+	}
+	if fmt.Sprint(v) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", v, want)
+	}
+
+	hash = plain[0].BtcHeader.BlockHash()
+	if rec := get(h, "/mirror/"+hash.String()+"/powerparams"); rec.Code != http.StatusNotFound {
+		t.Errorf("without power params: status %d, want %d", rec.Code,
+			http.StatusNotFound)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 3)
+	unknown := mirrortest.GenerateChain(t, 1, mirrortest.WithSeed(2))[0].BtcHeader.BlockHash()
+	h := NewHandler(ChainSource(newChain(t, mirrors)), WithMaxRange(2))
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/mirror/hash/" + unknown.String(), http.StatusNotFound},
+		{"/mirror/hash/00ff", http.StatusBadRequest},
+		{"/mirror/hash/" + string(bytes.Repeat([]byte("zz"), 32)), http.StatusBadRequest},
+		{"/mirror/height/3", http.StatusNotFound},
+		{"/mirror/height/-1", http.StatusBadRequest},
+		{"/mirror/height/one", http.StatusBadRequest},
+		{"/mirror/" + unknown.String() + "/powerparams", http.StatusNotFound},
+		{"/mirror/nothex/powerparams", http.StatusBadRequest},
+		{"/range?start=0", http.StatusBadRequest},
+		{"/range?end=1", http.StatusBadRequest},
+		{"/range?start=2&end=1", http.StatusBadRequest},
+		{"/range?start=0&end=2", http.StatusBadRequest},
+		{"/range?start=0&end=9223372036854775807", http.StatusBadRequest},
+		{"/mirrors", http.StatusNotFound},
+		{"/mirror/hash", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		rec := get(h, test.path)
+		if rec.Code != test.code {
+			t.Errorf("test #%d (%s): status %d, want %d", i, test.path, rec.Code,
+				test.code)
+			continue
+		}
+		var v errorJSON
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil || v.Error == "" {
+			t.Errorf("test #%d (%s): body %q is not an error", i, test.path, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tip", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// failingSource is a Source failing with err from its mirror at height
+// failAt on.
+type failingSource struct {
+	lightmirror.Store
+	failAt int64
+	err    error
+}
+
+func (s *failingSource) Iterate(start, end int64, fn func(height int64, m *lightmirror.BtcLightMirrorV2) error) error {
+	return s.Store.Iterate(start, end, func(height int64, m *lightmirror.BtcLightMirrorV2) error {
+		if height >= s.failAt {
+			return s.err
+		}
+		return fn(height, m)
+	})
+}
+
+// readLines returns the lines of the streamed response of rec.
+func readLines(t *testing.T, rec *httptest.ResponseRecorder) [][]byte {
+	t.Helper()
+	var lines [][]byte
+	scanner := bufio.NewScanner(rec.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestRangeRoute(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 6)
+	store := newStore(t, mirrors)
+	if err := store.Delete(mirrors[3].BtcHeader.BlockHash()); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(store)
+
+	tests := []struct {
+		start, end int64
+		heights    []int64
+	}{
+		{0, 5, []int64{0, 1, 2, 4, 5}},
+		{1, 2, []int64{1, 2}},
+		{3, 3, nil},
+		{4, 9, []int64{4, 5}},
+	}
+	for i, test := range tests {
+		rec := get(h, fmt.Sprintf("/range?start=%d&end=%d", test.start, test.end))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("test #%d: status %d %s", i, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("test #%d: content type %q", i, ct)
+		}
+		if !rec.Flushed && len(test.heights) > 0 {
+			t.Errorf("test #%d: response not flushed", i)
+		}
+		lines := readLines(t, rec)
+		if len(lines) != len(test.heights) {
+			t.Fatalf("test #%d: got %d lines, want %d", i, len(lines), len(test.heights))
+		}
+		for j, line := range lines {
+			v := decodeMirror(t, line)
+			want := mirrors[test.heights[j]]
+			if v.Height != test.heights[j] || !v.raw.Equal(want) {
+				t.Errorf("test #%d line %d: got %v at %d, want %v at %d", i, j,
+					v.raw.BtcHeader.BlockHash(), v.Height, want.BtcHeader.BlockHash(), test.heights[j])
+			}
+		}
+	}
+
+	// An error past the first line ends the stream with it.
+	errIterate := errors.New("iterate failed")
+	h = NewHandler(&failingSource{store, 2, errIterate})
+	rec := get(h, "/range?start=0&end=5")
+	lines := readLines(t, rec)
+	if rec.Code != http.StatusOK || len(lines) != 3 {
+		t.Fatalf("failing stream: status %d, %d lines", rec.Code, len(lines))
+	}
+	var v errorJSON
+	if err := json.Unmarshal(lines[2], &v); err != nil || v.Error != errIterate.Error() {
+		t.Errorf("failing stream: last line %s", lines[2])
+	}
+
+	// Before it, the response is an error.
+	h = NewHandler(&failingSource{store, 0, errIterate})
+	if rec := get(h, "/range?start=0&end=5"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("failing range: status %d, want %d", rec.Code,
+			http.StatusInternalServerError)
+	}
+}
+
+func TestHeaderOnlyTip(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 3)
+	chain, err := lightmirror.NewChainFromAnchor(mirrors[2].BtcHeader, 2, big.NewInt(1),
+		lightmirror.WithChainParams(mirrortest.Params))
+	if err != nil {
+		t.Fatalf("NewChainFromAnchor error %v", err)
+	}
+	if rec := get(NewHandler(ChainSource(chain)), "/tip"); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// stubHealth is a lightmirror.HealthChecker reporting its fields.
+type stubHealth struct {
+	pingErr error
+	age     time.Duration
+}
+
+func (h *stubHealth) Ping(ctx context.Context) error { return h.pingErr }
+
+func (h *stubHealth) LastBlockAge() time.Duration { return h.age }
+
+func (h *stubHealth) LastError() (error, time.Time) { return h.pingErr, time.Time{} }
+
+func TestHealthRoutes(t *testing.T) {
+	mirrors := mirrortest.GenerateChain(t, 2)
+	src := ChainSource(newChain(t, mirrors))
+	if rec := get(NewHandler(src), "/healthz"); rec.Code != http.StatusNotFound {
+		t.Errorf("/healthz without health: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	subscriber := &stubHealth{age: time.Minute}
+	health := lightmirror.NewCompositeHealth(10 * time.Minute)
+	health.Add("subscriber", subscriber)
+	h := NewHandler(src, WithHealth(health))
+	check := func(path string, code int) {
+		t.Helper()
+		rec := get(h, path)
+		var v healthJSON
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if rec.Code != code || len(v.Components) != 1 || (v.Status == "ok") != (code == http.StatusOK) {
+			t.Errorf("%s: got status %d %+v, want %d", path, rec.Code, v, code)
+		}
+	}
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusOK)
+
+	// A stalled subscriber is live but no longer ready.
+	subscriber.age = time.Hour
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	// A subscriber which does not answer is neither.
+	subscriber.age, subscriber.pingErr = 0, errors.New("connection refused")
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/readyz", http.StatusServiceUnavailable)
+}
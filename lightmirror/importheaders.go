@@ -0,0 +1,141 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrHeadersNotLinked is returned by ImportHeadersFile when a header
+	// does not build on the header before it, or when no header of the
+	// file builds on a block of the chain, and by a ChainVerifier for a
+	// mirror not building on the one before it.
+	ErrHeadersNotLinked = errors.New("headers do not link")
+
+	// ErrPartialHeader is returned by ImportHeadersFile when the file
+	// ends within a header.
+	ErrPartialHeader = errors.New("file ends within a header")
+)
+
+// HeaderImportError is returned by ImportHeadersFile when it stops before
+// the end of the file.
+type HeaderImportError struct {
+	// Offset is the offset in the file of the header the import stopped
+	// at.
+	Offset int64
+
+	// Height and Hash are those of the last header of the file the
+	// chain holds, the one the header the import stopped at should
+	// build on.  Hash is zero when no header of the file linked to the
+	// chain.
+	Height int64
+	Hash   chainhash.Hash
+
+	// Trailing is the number of bytes of a partial header ending the
+	// file, for ErrPartialHeader.
+	Trailing int
+
+	Err error
+}
+
+func (e *HeaderImportError) Error() string {
+	if e.Hash == (chainhash.Hash{}) {
+		return fmt.Sprintf("import headers at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("import headers at offset %d, after block %v at "+
+		"height %d: %v", e.Offset, e.Hash, e.Height, e.Err)
+}
+
+func (e *HeaderImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportHeadersFile appends to chain, header-only, the headers of the flat
+// file of concatenated 80 byte headers read from r, such as Bitcoin Core
+// exports.  Every header must build on the header before it; the chain
+// validates their proof of work as AppendHeaderOnly does.  Leading headers
+// are skipped until one the chain knows or building on a block it knows,
+// so a file starting at the genesis block imports into a chain anchored
+// higher; headers the chain already knows are skipped too.  The coinbases
+// are paired later with AttachBody.
+//
+// It returns the number of headers appended.  When it stops before the end
+// of the file, having appended the complete headers before, the error is a
+// *HeaderImportError telling where; a truncated last header fails it with
+// ErrPartialHeader.
+func ImportHeadersFile(r io.Reader, chain *MirrorChain) (int, error) {
+	br := bufio.NewReader(r)
+	var (
+		buf      [wire.MaxBlockHeaderPayload]byte
+		rd       bytes.Reader
+		header   wire.BlockHeader
+		imported int
+		offset   int64
+		linked   bool
+		last     chainhash.Hash
+		height   int64
+	)
+	fail := func(trailing int, err error) (int, error) {
+		e := &HeaderImportError{Offset: offset, Trailing: trailing, Err: err}
+		if linked {
+			e.Height, e.Hash = height, last
+		}
+		return imported, e
+	}
+
+	for ; ; offset += wire.MaxBlockHeaderPayload {
+		n, err := io.ReadFull(br, buf[:])
+		switch {
+		case err == io.EOF:
+			if !linked {
+				return fail(0, fmt.Errorf("no header builds on the chain: %w",
+					ErrHeadersNotLinked))
+			}
+			return imported, nil
+		case err == io.ErrUnexpectedEOF:
+			return fail(n, fmt.Errorf("%d trailing bytes: %w", n, ErrPartialHeader))
+		case err != nil:
+			return fail(0, err)
+		}
+		rd.Reset(buf[:])
+		if err := header.Deserialize(&rd); err != nil {
+			return fail(0, err)
+		}
+		hash := header.BlockHash()
+
+		if !linked {
+			if _, h, err := chain.HeaderByHash(hash); err == nil {
+				linked, last, height = true, hash, h
+				continue
+			}
+			_, h, err := chain.HeaderByHash(header.PrevBlock)
+			if err != nil {
+				continue
+			}
+			linked, last, height = true, header.PrevBlock, h
+		}
+		if header.PrevBlock != last {
+			return fail(0, fmt.Errorf("header %v builds on %v: %w", hash,
+				header.PrevBlock, ErrHeadersNotLinked))
+		}
+		_, err = chain.AppendHeaderOnly(header)
+		switch {
+		case err == nil:
+			imported++
+		case !errors.Is(err, ErrDuplicateBlock):
+			return fail(0, err)
+		}
+		last = hash
+		height++
+	}
+}
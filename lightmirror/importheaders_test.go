@@ -0,0 +1,100 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// headersFile returns the concatenated headers of mirrors.
+func headersFile(t *testing.T, mirrors []*BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, m := range mirrors {
+		if err := m.BtcHeader.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize error %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestImportHeadersFile(t *testing.T) {
+	// The file starts two blocks below the anchor, at mirrors[2].
+	mirrors := newTestMirrors(8)
+	file := headersFile(t, mirrors)
+	c := newTestChain(t, mirrors[2:4])
+
+	n, err := ImportHeadersFile(bytes.NewReader(file), c)
+	if err != nil || n != 4 {
+		t.Fatalf("ImportHeadersFile: got %d headers, error %v, want 4", n, err)
+	}
+	_, height := c.Tip()
+	if height != testAnchorHeight+5 {
+		t.Errorf("Tip: got height %d, want %d", height, testAnchorHeight+5)
+	}
+	for _, m := range mirrors[4:] {
+		if headerOnly, err := c.HeaderOnly(m.BtcHeader.BlockHash()); err != nil || !headerOnly {
+			t.Errorf("HeaderOnly %v: got %v, error %v", m.BtcHeader.BlockHash(), headerOnly, err)
+		}
+	}
+
+	// Importing again appends nothing.
+	if n, err := ImportHeadersFile(bytes.NewReader(file), c); err != nil || n != 0 {
+		t.Errorf("ImportHeadersFile again: got %d headers, error %v, want 0", n, err)
+	}
+}
+
+func TestImportHeadersFileErrors(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	file := headersFile(t, mirrors)
+	unlinked := headersFile(t, append(append([]*BtcLightMirrorV2(nil), mirrors[:3]...), mirrors[4:]...))
+	badPoW := append([]byte(nil), file...)
+	badPoW[4*wire.MaxBlockHeaderPayload+79]++
+	for {
+		var header wire.BlockHeader
+		if err := header.Deserialize(bytes.NewReader(badPoW[4*wire.MaxBlockHeaderPayload:])); err != nil {
+			t.Fatalf("Deserialize error %v", err)
+		}
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(header.Bits)) > 0 {
+			break
+		}
+		badPoW[4*wire.MaxBlockHeaderPayload+79]++
+	}
+
+	tests := []struct {
+		name     string
+		file     []byte
+		imported int
+		offset   int64
+		height   int64
+		trailing int
+		err      error
+	}{
+		{"partial", file[:len(file)-10], 4, 5 * 80, testAnchorHeight + 4, 70, ErrPartialHeader},
+		{"unlinked", unlinked, 2, 3 * 80, testAnchorHeight + 2, 0, ErrHeadersNotLinked},
+		{"not in chain", file[80*3:], 0, 3 * 80, 0, 0, ErrHeadersNotLinked},
+		{"proof of work", badPoW, 3, 4 * 80, testAnchorHeight + 3, 0, nil},
+	}
+	for _, test := range tests {
+		c := newTestChain(t, mirrors[:1])
+		n, err := ImportHeadersFile(bytes.NewReader(test.file), c)
+		var importErr *HeaderImportError
+		if !errors.As(err, &importErr) {
+			t.Errorf("ImportHeadersFile (%s): got error %v, want a HeaderImportError", test.name, err)
+			continue
+		}
+		if n != test.imported || importErr.Offset != test.offset || importErr.Height != test.height ||
+			importErr.Trailing != test.trailing || test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("ImportHeadersFile (%s): got %d headers, error %+v, want %d at offset %d, "+
+				"height %d", test.name, n, importErr, test.imported, test.offset, test.height)
+		}
+	}
+}
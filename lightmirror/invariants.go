@@ -0,0 +1,92 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrInvalidMirror is returned when a mirror violates one of the invariants
+// VerifyInvariants checks.
+var ErrInvalidMirror = errors.New("invalid mirror")
+
+// VerifyInvariants checks the structure every mirror of a real block has,
+// cheaply enough to run after any decode from untrusted input:
+//
+//   - the merkle branch is no deeper than the tree of a block of the most
+//     transactions that fit a block, so that the transaction count it
+//     implies is within bounds (the mirror does not carry the count itself)
+//   - the coinbase has at least one input and one output, none of them nil
+//   - the header timestamp is after the Unix epoch
+//
+// It does not validate the proof of work or the merkle branch.  Mirrors
+// decoded by Deserialize, DeserializeBatch and MirrorDecoder satisfy it.
+// The errors wrap ErrInvalidMirror.
+func (light *BtcLightMirrorV2) VerifyInvariants() error {
+	return light.VerifyInvariantsWith(DeserializeOptions{})
+}
+
+// VerifyInvariantsWith is VerifyInvariants bounding the merkle branch by the
+// transaction count of opts.  It decodes a coinbase kept undecoded by
+// DeserializeOptions.RetainRawCoinbase, as Coinbase does.
+func (light *BtcLightMirrorV2) VerifyInvariantsWith(opts DeserializeOptions) error {
+	light.Coinbase()
+	return light.verifyInvariants(opts)
+}
+
+// verifyInvariants is VerifyInvariantsWith leaving an undecoded coinbase
+// undecoded, for the decodes, which checked it as they scanned it.
+func (light *BtcLightMirrorV2) verifyInvariants(opts DeserializeOptions) error {
+	if err := verifyHeader(&light.BtcHeader); err != nil {
+		return err
+	}
+	return light.verifyBody(opts)
+}
+
+// verifyHeader checks the invariants of VerifyInvariants on the header.
+func verifyHeader(header *wire.BlockHeader) error {
+	if header.Timestamp.Unix() <= 0 {
+		return fmt.Errorf("header timestamp %d is not after the Unix epoch: %w",
+			header.Timestamp.Unix(), ErrInvalidMirror)
+	}
+	return nil
+}
+
+// verifyBody checks the invariants of VerifyInvariants on the coinbase and
+// the merkle nodes.  An undecoded coinbase is left unchecked, as
+// scanCoinbase checked it.
+func (light *BtcLightMirrorV2) verifyBody(opts DeserializeOptions) error {
+	if n := uint64(len(light.MerkleNodes)); n > opts.maxMerkleNodes() {
+		return fmt.Errorf("merkle branch of %d nodes is deeper than the %d of "+
+			"a block of %d transactions: %w", n, opts.maxMerkleNodes(),
+			opts.maxTxCount(), ErrInvalidMirror)
+	}
+	if light.coinbasePending {
+		return nil
+	}
+	tx := &light.CoinBaseTx
+	if err := verifyTxCounts(uint64(len(tx.TxIn)), uint64(len(tx.TxOut))); err != nil {
+		return err
+	}
+	if !coinbaseComplete(tx) {
+		return fmt.Errorf("coinbase has a nil input or output: %w", ErrInvalidMirror)
+	}
+	return nil
+}
+
+// verifyTxCounts checks that a coinbase has at least one input and one
+// output.
+func verifyTxCounts(inputs, outputs uint64) error {
+	if inputs == 0 {
+		return fmt.Errorf("coinbase has no input: %w", ErrInvalidMirror)
+	}
+	if outputs == 0 {
+		return fmt.Errorf("coinbase has no output: %w", ErrInvalidMirror)
+	}
+	return nil
+}
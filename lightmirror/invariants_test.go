@@ -0,0 +1,310 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMaxMerkleNode(t *testing.T) {
+	if got := getExponent(maxTxPerBlock); got != maxMerkleNode {
+		t.Errorf("getExponent(maxTxPerBlock): got %d, want maxMerkleNode %d",
+			got, maxMerkleNode)
+	}
+}
+
+func TestVerifyInvariants(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *BtcLightMirrorV2)
+		valid  bool
+	}{
+		{"valid", func(m *BtcLightMirrorV2) {}, true},
+		{"deepest branch", func(m *BtcLightMirrorV2) {
+			m.MerkleNodes = make([]chainhash.Hash, maxMerkleNode)
+		}, true},
+		{"too deep branch", func(m *BtcLightMirrorV2) {
+			m.MerkleNodes = make([]chainhash.Hash, maxMerkleNode+1)
+		}, false},
+		{"no input", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxIn = nil
+		}, false},
+		{"no output", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxOut = []*wire.TxOut{}
+		}, false},
+		{"nil output", func(m *BtcLightMirrorV2) {
+			m.CoinBaseTx.TxOut = append(m.CoinBaseTx.TxOut, nil)
+		}, false},
+		{"zero timestamp", func(m *BtcLightMirrorV2) {
+			m.BtcHeader.Timestamp = time.Time{}
+		}, false},
+		{"epoch timestamp", func(m *BtcLightMirrorV2) {
+			m.BtcHeader.Timestamp = time.Unix(0, 0)
+		}, false},
+	}
+	for _, test := range tests {
+		m := newTestMirror(chainhash.Hash{}, 1, 5)
+		test.modify(m)
+		err := m.VerifyInvariants()
+		if test.valid {
+			if err != nil {
+				t.Errorf("VerifyInvariants (%s) error %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidMirror) {
+			t.Errorf("VerifyInvariants (%s): got error %v, want %v", test.name,
+				err, ErrInvalidMirror)
+		}
+
+		// A serializable violation is rejected by the decoders.
+		if !coinbaseComplete(&m.CoinBaseTx) || m.BtcHeader.Timestamp.Unix() < 0 {
+			continue
+		}
+		data, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes (%s) error %v", test.name, err)
+		}
+		if err := new(BtcLightMirrorV2).Deserialize(bytes.NewReader(data)); err == nil {
+			t.Errorf("Deserialize (%s): expected error", test.name)
+		}
+		var d MirrorDecoder
+		if err := d.Decode(bytes.NewReader(data), new(BtcLightMirrorV2)); err == nil {
+			t.Errorf("Decode (%s): expected error", test.name)
+		}
+	}
+}
+
+// fuzzMirrors returns the seed mirrors of the fuzz targets: the first block
+// of the main network, and mirrors with a deep branch, a CORE output and a
+// witness.
+func TestDeserializeMaxTxCount(t *testing.T) {
+	// A block of a million transactions, over the Bitcoin limit, has a
+	// merkle branch of 20 nodes.
+	const txCount = 1000000
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	m.MerkleNodes = make([]chainhash.Hash, getExponent(txCount))
+	for i := range m.MerkleNodes {
+		m.MerkleNodes[i][0] = byte(i)
+	}
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	var batch bytes.Buffer
+	if err := SerializeBatch(&batch, []*BtcLightMirrorV2{m}); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		opts  DeserializeOptions
+		valid bool
+	}{
+		{"default", DeserializeOptions{}, false},
+		{"bitcoin", DeserializeOptions{MaxTxCount: DefaultMaxTxCount}, false},
+		{"too low", DeserializeOptions{MaxTxCount: 1 << 19}, false},
+		{"raised", DeserializeOptions{MaxTxCount: txCount}, true},
+		{"exact", DeserializeOptions{MaxTxCount: 1<<19 + 1}, true},
+	}
+	for _, test := range tests {
+		errs := make(map[string]error)
+		var got BtcLightMirrorV2
+		errs["DeserializeWith"] = got.DeserializeWith(bytes.NewReader(buf.Bytes()), test.opts)
+		d := MirrorDecoder{Options: test.opts}
+		errs["MirrorDecoder"] = d.Decode(bytes.NewReader(buf.Bytes()), new(BtcLightMirrorV2))
+		_, errs["DeserializeBatchWith"] = DeserializeBatchWith(bytes.NewReader(batch.Bytes()), test.opts)
+		errs["VerifyInvariantsWith"] = m.VerifyInvariantsWith(test.opts)
+		for name, err := range errs {
+			if test.valid && err != nil {
+				t.Errorf("%s (%s) error %v", name, test.name, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("%s (%s): no error for a branch of %d nodes", name,
+					test.name, len(m.MerkleNodes))
+			}
+		}
+		if test.valid && !got.Equal(m) {
+			t.Errorf("DeserializeWith (%s): got %v, want %v", test.name, &got, m)
+		}
+	}
+	if err := new(BtcLightMirrorV2).Deserialize(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("Deserialize: no error for a branch of %d nodes", len(m.MerkleNodes))
+	}
+
+	// A chain hands out the options of its network.
+	c := newTestChain(t, newTestMirrors(1), WithMaxTxCount(txCount))
+	if opts := c.DeserializeOptions(); opts.MaxTxCount != txCount {
+		t.Errorf("DeserializeOptions: got %+v, want a maximum of %d", opts, txCount)
+	}
+}
+
+func fuzzMirrors(f *testing.F) []*BtcLightMirrorV2 {
+	core := newTestMirror(chainhash.Hash{}, 2, 1000)
+	core.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	core.CoinBaseTx.AddTxOut(wire.NewTxOut(0, corePkScript(
+		common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4"),
+		common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2"),
+		bytes.Repeat([]byte{0x4f}, 32))))
+	return []*BtcLightMirrorV2{
+		mainNetBlock1(f),
+		newTestMirror(chainhash.Hash{}, 1, 5),
+		core,
+	}
+}
+
+func FuzzDeserialize(f *testing.F) {
+	for _, m := range fuzzMirrors(f) {
+		data, err := m.ToBytes()
+		if err != nil {
+			f.Fatalf("ToBytes error %v", err)
+		}
+		f.Add(data)
+		f.Add(data[:len(data)-1])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := new(BtcLightMirrorV2)
+		err := m.Deserialize(bytes.NewReader(data))
+
+		var d MirrorDecoder
+		decoded := new(BtcLightMirrorV2)
+		decodeErr := d.Decode(bytes.NewReader(data), decoded)
+		if (err == nil) != (decodeErr == nil) {
+			t.Fatalf("Deserialize error %v, but Decode error %v", err, decodeErr)
+		}
+		// Any coinbase kept undecoded by RetainRawCoinbase decodes.
+		retained := new(BtcLightMirrorV2)
+		opts := DeserializeOptions{RetainRawCoinbase: true}
+		if retainErr := retained.DeserializeWith(bytes.NewReader(data), opts); retainErr == nil {
+			if err := retained.VerifyInvariants(); err != nil {
+				t.Fatalf("VerifyInvariants of a retained coinbase error %v", err)
+			}
+		} else if err == nil {
+			t.Fatalf("Deserialize decodes, but RetainRawCoinbase error %v", retainErr)
+		}
+		if err != nil {
+			return
+		}
+		if err := m.VerifyInvariants(); err != nil {
+			t.Fatalf("VerifyInvariants of a decoded mirror error %v", err)
+		}
+		if diff := m.Diff(decoded); diff != nil {
+			t.Fatalf("Decode: got another mirror than Deserialize, diff %v", diff)
+		}
+
+		// The mirror survives a round trip byte for byte, and its
+		// accessors do not panic.
+		again, err := m.ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes error %v", err)
+		}
+		if !bytes.Equal(again, data[:len(again)]) {
+			t.Fatalf("ToBytes: got %x, want %x", again, data[:len(again)])
+		}
+		if err := CheckCanonical(again); err != nil {
+			t.Fatalf("CheckCanonical of a decoded mirror error %v", err)
+		}
+		roundTrip := new(BtcLightMirrorV2)
+		if err := roundTrip.Deserialize(bytes.NewReader(again)); err != nil {
+			t.Fatalf("Deserialize of the serialized mirror error %v", err)
+		}
+		if diff := m.Diff(roundTrip); diff != nil {
+			t.Fatalf("round trip: got another mirror, diff %v", diff)
+		}
+		_ = m.String()
+		_ = m.CheckMerkle()
+		m.ParsePowerParams()
+	})
+}
+
+func FuzzParsePowerScript(f *testing.F) {
+	for _, m := range fuzzMirrors(f) {
+		for _, txOut := range m.CoinBaseTx.TxOut {
+			f.Add(txOut.PkScript)
+		}
+	}
+	f.Add(corePkScript(common.Address{1}, common.Address{2}, nil))
+	f.Add(corePkScript(common.Address{1}, common.Address{2}, make([]byte, 31)))
+	payload, err := NewPowerPayload(common.Address{1}, []WeightedReward{
+		{common.Address{2}, 1}, {common.Address{3}, 0}, {common.Address{4}, 0xffff},
+	}, common.Hash{5})
+	if err != nil {
+		f.Fatalf("NewPowerPayload error %v", err)
+	}
+	f.Add(PowerScript(payload))
+	f.Fuzz(func(t *testing.T, pkScript []byte) {
+		d := parsePowerScript(pkScript, false)
+
+		// A script which is a minimal push of the payload parses the
+		// same in both modes.
+		data, _, pushed := powerPush(pkScript)
+		strict := parsePowerScript(pkScript, true)
+		if strict != nil && bytes.Equal(PowerScript(data), pkScript) && !reflect.DeepEqual(strict, d) {
+			t.Fatalf("parsePowerScript(%x) with minimal pushes: got %+v, want %+v", pkScript, strict, d)
+		}
+
+		// The CORE parameters of a coinbase are looked up past its
+		// first output.
+		m := &BtcLightMirrorV2{CoinBaseTx: wire.MsgTx{TxOut: []*wire.TxOut{
+			{}, {PkScript: pkScript},
+		}}}
+		c, r, h, found := m.powerParams()
+		if found != (d != nil) || d != nil && (c != d.Candidate || r != d.Reward || h != d.CoreBlockHash) {
+			t.Fatalf("powerParams: got %v %v %v %v, parsePowerScript %+v",
+				c, r, h, found, d)
+		}
+		if d == nil {
+			return
+		}
+
+		switch d.Version {
+		case PowerPayloadV1:
+			// The parameters rebuild the script, but for the push
+			// length which is not checked, or the payload of the
+			// push.
+			var coreBlockHash []byte
+			if len(pkScript) >= 47+32 {
+				coreBlockHash = d.CoreBlockHash[:]
+			}
+			want := corePkScript(d.Candidate, d.Reward, coreBlockHash)
+			want[1] = pkScript[1]
+			if bytes.HasPrefix(pkScript, want) {
+				return
+			}
+			payload := corePkScript(d.Candidate, d.Reward, nil)[2:]
+			if !pushed || !bytes.HasPrefix(data, payload) {
+				t.Fatalf("parsePowerScript(%x): got %+v", pkScript, d)
+			}
+		case PowerPayloadV3:
+			// The parameters rebuild the payload, with or without
+			// the Core block hash.
+			payload, err := NewPowerPayload(d.Candidate, d.Rewards, d.CoreBlockHash)
+			if err != nil {
+				t.Fatalf("NewPowerPayload(%+v) error %v", d, err)
+			}
+			short := payload[:len(payload)-common.HashLength]
+			for _, want := range [][]byte{payload, short} {
+				if bytes.HasPrefix(pkScript[2:], want) ||
+					pushed && bytes.HasPrefix(data, want) {
+					return
+				}
+				if d.CoreBlockHash != (common.Hash{}) {
+					break
+				}
+			}
+			t.Fatalf("parsePowerScript(%x): got %+v", pkScript, d)
+		default:
+			t.Fatalf("parsePowerScript(%x): got version %d", pkScript, d.Version)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// The JSON form of a mirror is an object of the fields below, hashes being
+// in display order, as HashToDisplayHex prints them:
+//
+//	{
+//	  "hash": "<block hash>",
+//	  "header": {
+//	    "version": <int32>,
+//	    "prevBlock": "<hash>",
+//	    "merkleRoot": "<hash>",
+//	    "timestamp": <Unix seconds>,
+//	    "bits": "<8 hex digits>",
+//	    "nonce": <uint32>
+//	  },
+//	  "coinbaseTx": "<hex of the coinbase in the witness encoding>",
+//	  "merkleNodes": ["<hash>", ...],
+//	  "witnessMerkleNodes": ["<hash>", ...]
+//	}
+//
+// hash is the hash of the header, for reading: decoding checks it when set.
+// witnessMerkleNodes is only that of a BtcLightMirrorV3.
+
+// headerJSON is the JSON form of a block header.  Its fields are pointers,
+// nil for the fields a decoded header is missing.
+type headerJSON struct {
+	Version    *int32  `json:"version"`
+	PrevBlock  *string `json:"prevBlock"`
+	MerkleRoot *string `json:"merkleRoot"`
+	Timestamp  *int64  `json:"timestamp"`
+	Bits       *string `json:"bits"`
+	Nonce      *uint32 `json:"nonce"`
+}
+
+// mirrorJSON is the JSON form of a mirror.
+type mirrorJSON struct {
+	Hash               string      `json:"hash,omitempty"`
+	Header             *headerJSON `json:"header"`
+	CoinbaseTx         *string     `json:"coinbaseTx"`
+	MerkleNodes        []string    `json:"merkleNodes"`
+	WitnessMerkleNodes []string    `json:"witnessMerkleNodes,omitempty"`
+}
+
+// MarshalJSON encodes the mirror in the JSON form documented above.  The
+// coinbase is hex of the canonical serialization of CoinBaseTx, whatever
+// RawCoinbase returns.  WitnessMerkleNodes, which the V2 serialization
+// leaves out, is left out.
+func (light *BtcLightMirrorV2) MarshalJSON() ([]byte, error) {
+	v, err := light.toJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the JSON form of a mirror into the receiver, which
+// is only modified on success.  Every field but hash is required, a null
+// field counting as missing, and the timestamp must fit the uint32 of the
+// serialized header.  The decoded mirror satisfies VerifyInvariants.  A
+// witnessMerkleNodes field is ignored.
+func (light *BtcLightMirrorV2) UnmarshalJSON(data []byte) error {
+	var v mirrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	m, err := v.mirror()
+	if err != nil {
+		return err
+	}
+	*light = *m
+	return nil
+}
+
+// MarshalJSON encodes the mirror in the JSON form documented above, with its
+// witness branch.
+func (light *BtcLightMirrorV3) MarshalJSON() ([]byte, error) {
+	v, err := light.toJSON()
+	if err != nil {
+		return nil, err
+	}
+	v.WitnessMerkleNodes = hashStrings(light.WitnessMerkleNodes)
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the JSON form of a V3 mirror into the receiver, as
+// BtcLightMirrorV2.UnmarshalJSON does, requiring a witness branch as deep as
+// the merkle branch.
+func (light *BtcLightMirrorV3) UnmarshalJSON(data []byte) error {
+	var v mirrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	m, err := v.mirror()
+	if err != nil {
+		return err
+	}
+	if len(v.WitnessMerkleNodes) != len(m.MerkleNodes) {
+		return fmt.Errorf("witness branch of %d nodes for a merkle branch of "+
+			"%d: %w", len(v.WitnessMerkleNodes), len(m.MerkleNodes), ErrInvalidMirror)
+	}
+	if m.WitnessMerkleNodes, err = parseHashStrings("witnessMerkleNodes", v.WitnessMerkleNodes); err != nil {
+		return err
+	}
+	light.BtcLightMirrorV2 = *m
+	return nil
+}
+
+// toJSON returns the JSON form of the mirror, without its witness branch.
+func (light *BtcLightMirrorV2) toJSON() (*mirrorJSON, error) {
+	var coinbase strings.Builder
+	if err := light.Coinbase().Serialize(hex.NewEncoder(&coinbase)); err != nil {
+		return nil, err
+	}
+	header := light.BtcHeader
+	prevBlock, merkleRoot := header.PrevBlock.String(), header.MerkleRoot.String()
+	timestamp, bits := header.Timestamp.Unix(), fmt.Sprintf("%08x", header.Bits)
+	coinbaseTx := coinbase.String()
+	return &mirrorJSON{
+		Hash: header.BlockHash().String(),
+		Header: &headerJSON{
+			Version:    &header.Version,
+			PrevBlock:  &prevBlock,
+			MerkleRoot: &merkleRoot,
+			Timestamp:  &timestamp,
+			Bits:       &bits,
+			Nonce:      &header.Nonce,
+		},
+		CoinbaseTx:  &coinbaseTx,
+		MerkleNodes: hashStrings(light.MerkleNodes),
+	}, nil
+}
+
+// mirror returns the mirror of the JSON form, without its witness branch.
+func (v *mirrorJSON) mirror() (*BtcLightMirrorV2, error) {
+	if err := v.checkFields(); err != nil {
+		return nil, err
+	}
+	h := v.Header
+	m := new(BtcLightMirrorV2)
+	header := &m.BtcHeader
+	header.Version = *h.Version
+	var err error
+	if header.PrevBlock, err = ParseDisplayHex(*h.PrevBlock); err != nil {
+		return nil, fmt.Errorf("prevBlock: %w", err)
+	}
+	if header.MerkleRoot, err = ParseDisplayHex(*h.MerkleRoot); err != nil {
+		return nil, fmt.Errorf("merkleRoot: %w", err)
+	}
+	if *h.Timestamp < 0 || *h.Timestamp > math.MaxUint32 {
+		return nil, fmt.Errorf("timestamp %d is out of the uint32 range: %w",
+			*h.Timestamp, ErrInvalidMirror)
+	}
+	header.Timestamp = time.Unix(*h.Timestamp, 0)
+	if len(*h.Bits) != 8 {
+		return nil, fmt.Errorf("bits %q has %d hex digits, want 8",
+			*h.Bits, len(*h.Bits))
+	}
+	bits, err := strconv.ParseUint(*h.Bits, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bits %q: %w", *h.Bits, err)
+	}
+	header.Bits = uint32(bits)
+	header.Nonce = *h.Nonce
+	if v.Hash != "" {
+		hash, err := ParseDisplayHex(v.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("hash: %w", err)
+		}
+		if got := header.BlockHash(); got != hash {
+			return nil, fmt.Errorf("header hashes to %v, not to the hash %v: %w",
+				got, hash, ErrInvalidMirror)
+		}
+	}
+
+	raw, err := hex.DecodeString(*v.CoinbaseTx)
+	if err != nil {
+		return nil, fmt.Errorf("coinbaseTx: %w", err)
+	}
+	r := bytes.NewReader(raw)
+	if err := m.CoinBaseTx.Deserialize(r); err != nil {
+		return nil, fmt.Errorf("coinbaseTx: %w", noEOF(err))
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("coinbaseTx: %w", &TrailingDataError{Bytes: int64(r.Len())})
+	}
+
+	if m.MerkleNodes, err = parseHashStrings("merkleNodes", v.MerkleNodes); err != nil {
+		return nil, err
+	}
+	if err := m.VerifyInvariants(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkFields checks that none of the required fields of the JSON form is
+// missing.  The errors wrap ErrInvalidMirror.
+func (v *mirrorJSON) checkFields() error {
+	missing := ""
+	switch h := v.Header; {
+	case h == nil:
+		missing = "header"
+	case h.Version == nil:
+		missing = "header.version"
+	case h.PrevBlock == nil:
+		missing = "header.prevBlock"
+	case h.MerkleRoot == nil:
+		missing = "header.merkleRoot"
+	case h.Timestamp == nil:
+		missing = "header.timestamp"
+	case h.Bits == nil:
+		missing = "header.bits"
+	case h.Nonce == nil:
+		missing = "header.nonce"
+	case v.CoinbaseTx == nil:
+		missing = "coinbaseTx"
+	case v.MerkleNodes == nil:
+		missing = "merkleNodes"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s is missing: %w", missing, ErrInvalidMirror)
+}
+
+// hashStrings returns the display form of the hashes, never nil.
+func hashStrings(hashes []chainhash.Hash) []string {
+	res := make([]string, len(hashes))
+	for i := range hashes {
+		res[i] = hashes[i].String()
+	}
+	return res
+}
+
+// parseHashStrings parses the hashes of the JSON field name.
+func parseHashStrings(name string, s []string) ([]chainhash.Hash, error) {
+	res := make([]chainhash.Hash, len(s))
+	for i := range s {
+		var err error
+		if res[i], err = ParseDisplayHex(s[i]); err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", name, i, err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestMirrorJSON(t *testing.T) {
+	for _, n := range []int{0, 1, 5} {
+		m := newTestMirror(chainhash.Hash{}, uint32(n)+1, n)
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("MarshalJSON #%d error %v", n, err)
+		}
+		var decoded BtcLightMirrorV2
+		if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Equal(m) {
+			t.Errorf("UnmarshalJSON #%d: got error %v, diff %v", n, err, decoded.Diff(m))
+		}
+		if decoded.MerkleNodes == nil {
+			t.Errorf("UnmarshalJSON #%d: got nil merkle nodes", n)
+		}
+	}
+
+	m := newTestMirror(chainhash.Hash{}, 1, 2)
+	data, _ := json.Marshal(m)
+	var v map[string]interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("Unmarshal error %v", err)
+	}
+	header, _ := v["header"].(map[string]interface{})
+	nodes, _ := v["merkleNodes"].([]interface{})
+	if v["hash"] != m.BtcHeader.BlockHash().String() ||
+		header["prevBlock"] != m.BtcHeader.PrevBlock.String() ||
+		header["bits"] != "207fffff" ||
+		header["timestamp"] != float64(m.BtcHeader.Timestamp.Unix()) ||
+		len(nodes) != len(m.MerkleNodes) || nodes[0] != m.MerkleNodes[0].String() {
+		t.Errorf("MarshalJSON: got %s", data)
+	}
+	if _, ok := v["witnessMerkleNodes"]; ok {
+		t.Errorf("MarshalJSON: got a witness branch in %s", data)
+	}
+}
+
+func TestMirrorJSONV3(t *testing.T) {
+	header, coinBaseTx, txids, wtxids := newTestBlock(5)
+	m, err := NewV3(header, coinBaseTx, txids, wtxids)
+	if err != nil {
+		t.Fatalf("NewV3 error %v", err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("MarshalJSON error %v", err)
+	}
+	var decoded BtcLightMirrorV3
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Equal(m) {
+		t.Errorf("UnmarshalJSON: got %v, error %v", &decoded, err)
+	}
+
+	// A V2 decoder ignores the witness branch; a V3 decoder requires it.
+	var v2 BtcLightMirrorV2
+	if err := json.Unmarshal(data, &v2); err != nil || !v2.Equal(&m.BtcLightMirrorV2) {
+		t.Errorf("BtcLightMirrorV2.UnmarshalJSON error %v", err)
+	}
+	data, _ = json.Marshal(&m.BtcLightMirrorV2)
+	if err := json.Unmarshal(data, &decoded); !errors.Is(err, ErrInvalidMirror) {
+		t.Errorf("UnmarshalJSON without a witness branch: got error %v, want %v", err, ErrInvalidMirror)
+	}
+}
+
+func TestMirrorJSONInvalid(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 2)
+	data, _ := json.Marshal(m)
+	valid := string(data)
+	hash := m.BtcHeader.BlockHash().String()
+	bits := `"bits":"207fffff"`
+	// Without the hash, which a zero header field would not match.
+	noHash := strings.Replace(valid, `"hash":"`+hash+`",`, "", 1)
+	if err := json.Unmarshal([]byte(noHash), new(BtcLightMirrorV2)); err != nil || noHash == valid {
+		t.Fatalf("UnmarshalJSON without hash: error %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		data   string
+		target error
+	}{
+		{"not an object", `[]`, nil},
+		{"hash mismatch", strings.Replace(valid, hash, m.MerkleNodes[0].String(), 1), ErrInvalidMirror},
+		{"short hash", strings.Replace(valid, hash, hash[2:], 1), nil},
+		{"short bits", strings.Replace(valid, bits, `"bits":"7fffff"`, 1), nil},
+		{"bits not hex", strings.Replace(valid, bits, `"bits":"207fffzz"`, 1), nil},
+		{"missing prevBlock", strings.Replace(valid, `"prevBlock"`, `"prev"`, 1), ErrInvalidMirror},
+		{"coinbase not hex", strings.Replace(valid, `"coinbaseTx":"`, `"coinbaseTx":"zz`, 1), nil},
+		{"truncated coinbase", strings.Replace(valid, `","merkleNodes"`, `0","merkleNodes"`, 1), nil},
+		{"trailing coinbase", strings.Replace(valid, `","merkleNodes"`, `00","merkleNodes"`, 1), ErrTrailingData},
+		{"missing merkle nodes", strings.Replace(valid, `"merkleNodes"`, `"nodes"`, 1), ErrInvalidMirror},
+		{"merkle node", strings.Replace(valid, m.MerkleNodes[0].String(), "00", 1), nil},
+		{"timestamp", strings.Replace(valid, `"timestamp":`, `"timestamp":-`, 1), ErrInvalidMirror},
+		{"timestamp past uint32", strings.Replace(noHash, `"timestamp":`, `"timestamp":9`, 1), ErrInvalidMirror},
+		{"missing header", strings.Replace(valid, `"header"`, `"head"`, 1), ErrInvalidMirror},
+		{"null header", strings.Replace(valid, `"header":`, `"header":null,"head":`, 1), ErrInvalidMirror},
+		{"missing version", strings.Replace(noHash, `"version"`, `"ver"`, 1), ErrInvalidMirror},
+		{"missing timestamp", strings.Replace(noHash, `"timestamp"`, `"time"`, 1), ErrInvalidMirror},
+		{"missing bits", strings.Replace(noHash, `"bits"`, `"target"`, 1), ErrInvalidMirror},
+		{"missing nonce", strings.Replace(noHash, `"nonce"`, `"n"`, 1), ErrInvalidMirror},
+		{"null nonce", strings.Replace(noHash, `"nonce":`, `"nonce":null,"n":`, 1), ErrInvalidMirror},
+		{"missing coinbase", strings.Replace(valid, `"coinbaseTx"`, `"coinbase"`, 1), ErrInvalidMirror},
+	}
+	for _, test := range tests {
+		decoded := *m.Clone()
+		err := json.Unmarshal([]byte(test.data), &decoded)
+		if err == nil || (test.target != nil && !errors.Is(err, test.target)) {
+			t.Errorf("UnmarshalJSON (%s): got error %v, want %v", test.name, err, test.target)
+		}
+		if !decoded.Equal(m) {
+			t.Errorf("UnmarshalJSON (%s): modified the receiver", test.name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package leaktest checks that the tests of long-running components leave no
+// goroutine running behind them.
+package leaktest
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gracePeriod is the time goroutines are given to return after a test ends.
+const gracePeriod = 2 * time.Second
+
+// ignored holds the functions of the goroutines the runtime and the testing
+// package start on their own.
+var ignored = []string{
+	"os/signal.signal_recv",
+	"os/signal.loop",
+	"runtime.ensureSigM",
+	"testing.(*T).Run",
+	"testing.(*T).Parallel",
+	"testing.runFuzzing",
+}
+
+// Check fails t if goroutines started after Check is called still run once
+// t and its cleanups registered after Check are done, and were given
+// gracePeriod to return.
+func Check(t testing.TB) {
+	t.Helper()
+	before := goroutines()
+	t.Cleanup(func() {
+		t.Helper()
+		deadline := time.Now().Add(gracePeriod)
+		for {
+			leaked := leakedSince(before)
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("leaktest: %d goroutines leaked:\n\n%s", len(leaked),
+					strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// leakedSince returns the stacks of the goroutines which are not in before
+// nor ignored.
+func leakedSince(before map[int64]string) []string {
+	var leaked []string
+	for id, stack := range goroutines() {
+		if _, ok := before[id]; ok || isIgnored(stack) {
+			continue
+		}
+		leaked = append(leaked, stack)
+	}
+	return leaked
+}
+
+func isIgnored(stack string) bool {
+	for _, fn := range ignored {
+		if strings.Contains(stack, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// goroutines returns the stacks of the running goroutines but the calling
+// one, by goroutine id.
+func goroutines() map[int64]string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[int64]string)
+	for i, stack := range strings.Split(string(buf), "\n\n") {
+		// The calling goroutine comes first.
+		if i == 0 {
+			continue
+		}
+		fields := strings.Fields(stack)
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		stacks[id] = stack
+	}
+	return stacks
+}
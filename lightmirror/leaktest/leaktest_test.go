@@ -0,0 +1,62 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package leaktest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recorder is a testing.TB recording the cleanups and errors of Check.
+type recorder struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Cleanup(fn func()) {
+	r.cleanups = append(r.cleanups, fn)
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func blockOn(ch chan struct{}) {
+	<-ch
+}
+
+func TestCheck(t *testing.T) {
+	// A goroutine still blocked at the end is reported.
+	block := make(chan struct{})
+	r := &recorder{TB: t}
+	Check(r)
+	go blockOn(block)
+	r.finish()
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "leaktest.blockOn") {
+		t.Errorf("Check: got errors %q, want the leaked goroutine", r.errors)
+	}
+	close(block)
+
+	// A goroutine returning within the grace period is not.
+	block = make(chan struct{})
+	r = &recorder{TB: t}
+	Check(r)
+	go blockOn(block)
+	r.Cleanup(func() { close(block) })
+	r.finish()
+	if len(r.errors) != 0 {
+		t.Errorf("Check: got errors %q, want none", r.errors)
+	}
+}
@@ -0,0 +1,767 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package leveldbstore implements lightmirror.Store on top of LevelDB.
+package leveldbstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Key layout.  Every key starts with a one byte prefix naming the index it
+// belongs to.  Heights are encoded big endian so that the natural key order
+// of the height index is the height order.
+const (
+	// mirrorPrefix maps a block hash to the serialized mirror, or to the
+	// serialized lightmirror.PrunedMirror once pruned.
+	mirrorPrefix = 'm'
+
+	// hashHeightPrefix maps a block hash to its height.
+	hashHeightPrefix = 'n'
+
+	// heightPrefix maps a height to the block hash stored there.
+	heightPrefix = 'h'
+
+	// candidatePrefix maps a candidate address followed by a height to
+	// the hash of the block delegating to it there.
+	candidatePrefix = 'c'
+
+	// candidateOfPrefix maps the hash of an indexed block to its
+	// candidate address.
+	candidateOfPrefix = 'a'
+
+	// metaPrefix holds single keys describing the database.
+	metaPrefix = 'x'
+)
+
+var (
+	// candidateIndexKey is set once the candidate index covers every
+	// mirror.
+	candidateIndexKey = []byte{metaPrefix, 'c'}
+
+	// migrationKey holds the big endian progress of
+	// lightmirror.MigrateStore.
+	migrationKey = []byte{metaPrefix, 'm'}
+)
+
+// Store is a lightmirror.Store backed by a LevelDB database.  Values are the
+// canonical Serialize bytes of the mirrors.
+type Store struct {
+	db *leveldb.DB
+
+	// writeMtx serializes the read-modify-write sequences of Put,
+	// Delete and WriteBatch.  Reads do not take it.
+	writeMtx sync.Mutex
+}
+
+var (
+	_ lightmirror.PruningStore        = (*Store)(nil)
+	_ lightmirror.CandidateIndexStore = (*Store)(nil)
+	_ lightmirror.MigratableStore     = (*Store)(nil)
+	_ lightmirror.BatchStore          = (*Store)(nil)
+)
+
+// Open opens, creating it if necessary, the LevelDB database at path.  A
+// database holding mirrors put before the candidate index existed needs
+// ReindexCandidates before BlocksByCandidate serves it.
+func Open(path string) (*Store, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	iter := db.NewIterator(util.BytesPrefix([]byte{heightPrefix}), nil)
+	empty := !iter.First()
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if empty {
+		if err := db.Put(candidateIndexKey, []byte{1}, nil); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+func mirrorKey(hash *chainhash.Hash) []byte {
+	return append([]byte{mirrorPrefix}, hash[:]...)
+}
+
+func hashHeightKey(hash *chainhash.Hash) []byte {
+	return append([]byte{hashHeightPrefix}, hash[:]...)
+}
+
+func heightKey(height int64) []byte {
+	key := make([]byte, 9)
+	key[0] = heightPrefix
+	binary.BigEndian.PutUint64(key[1:], uint64(height))
+	return key
+}
+
+func candidateKey(addr common.Address, height int64) []byte {
+	key := make([]byte, 1+common.AddressLength+8)
+	key[0] = candidatePrefix
+	copy(key[1:], addr[:])
+	binary.BigEndian.PutUint64(key[1+common.AddressLength:], uint64(height))
+	return key
+}
+
+func candidateOfKey(hash *chainhash.Hash) []byte {
+	return append([]byte{candidateOfPrefix}, hash[:]...)
+}
+
+// Put stores the mirror at the given height.  The mirror previously stored at
+// that height, and any previous height index entry of the mirror itself, are
+// removed in the same batch, which also updates the candidate index.
+func (s *Store) Put(m *lightmirror.BtcLightMirrorV2, height int64) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	batch := new(leveldb.Batch)
+	if err := putBatch(s.db, batch, m, height); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// putBatch adds to batch the writes storing the mirror at the given height,
+// reading the current state of the indices from r.
+func putBatch(r reader, batch *leveldb.Batch, m *lightmirror.BtcLightMirrorV2, height int64) error {
+	if height < 0 {
+		return fmt.Errorf("invalid height %d", height)
+	}
+
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		return err
+	}
+	hash := m.BtcHeader.BlockHash()
+
+	// Drop whatever currently occupies the height.
+	oldHash, err := hashAtHeight(r, height)
+	switch {
+	case err == nil && oldHash != hash:
+		batch.Delete(mirrorKey(&oldHash))
+		batch.Delete(hashHeightKey(&oldHash))
+		if err := unindexCandidate(r, batch, &oldHash, height); err != nil {
+			return err
+		}
+	case err != nil && !errors.Is(err, lightmirror.ErrNotFound):
+		return err
+	}
+
+	// Drop the height index entry if the mirror moves to a new height.
+	oldHeight, err := heightOfHash(r, &hash)
+	switch {
+	case err == nil:
+		if oldHeight != height {
+			batch.Delete(heightKey(oldHeight))
+		}
+		if err := unindexCandidate(r, batch, &hash, oldHeight); err != nil {
+			return err
+		}
+	case !errors.Is(err, lightmirror.ErrNotFound):
+		return err
+	}
+
+	var heightBytes [8]byte
+	binary.BigEndian.PutUint64(heightBytes[:], uint64(height))
+	batch.Put(mirrorKey(&hash), buf.Bytes())
+	batch.Put(hashHeightKey(&hash), heightBytes[:])
+	batch.Put(heightKey(height), hash[:])
+	if addr, ok := lightmirror.IndexedCandidate(m); ok {
+		indexCandidate(batch, &hash, addr, height)
+	}
+	return nil
+}
+
+// ByHash returns the mirror with the given block hash and its height.
+func (s *Store) ByHash(hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, int64, error) {
+	height, err := heightOfHash(s.db, &hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := s.mirror(&hash)
+	if err != nil {
+		return nil, height, err
+	}
+	return m, height, nil
+}
+
+// ByHeight returns the mirror stored at the given height.
+func (s *Store) ByHeight(height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	if height < 0 {
+		return nil, lightmirror.ErrNotFound
+	}
+	hash, err := hashAtHeight(s.db, height)
+	if err != nil {
+		return nil, err
+	}
+	return s.mirror(&hash)
+}
+
+// Tip returns the mirror with the greatest height and that height.
+func (s *Store) Tip() (*lightmirror.BtcLightMirrorV2, int64, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{heightPrefix}), nil)
+	defer iter.Release()
+
+	if !iter.Last() {
+		if err := iter.Error(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, lightmirror.ErrNotFound
+	}
+
+	key, value := iter.Key(), iter.Value()
+	if len(key) != 9 || len(value) != chainhash.HashSize {
+		return nil, 0, &lightmirror.CorruptRecordError{
+			Key: append([]byte(nil), key...),
+			Err: errors.New("malformed height index entry"),
+		}
+	}
+	height := int64(binary.BigEndian.Uint64(key[1:]))
+	var hash chainhash.Hash
+	copy(hash[:], value)
+
+	m, err := s.mirror(&hash)
+	if err != nil {
+		return nil, height, err
+	}
+	return m, height, nil
+}
+
+// Delete removes the mirror with the given block hash.
+func (s *Store) Delete(hash chainhash.Hash) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	batch := new(leveldb.Batch)
+	if err := deleteBatch(s.db, batch, &hash); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// deleteBatch adds to batch the writes removing the mirror with the given
+// block hash, reading the current state of the indices from r.
+func deleteBatch(r reader, batch *leveldb.Batch, hash *chainhash.Hash) error {
+	height, err := heightOfHash(r, hash)
+	if err != nil {
+		return err
+	}
+	batch.Delete(mirrorKey(hash))
+	batch.Delete(hashHeightKey(hash))
+	batch.Delete(heightKey(height))
+	return unindexCandidate(r, batch, hash, height)
+}
+
+// WriteBatch deletes the mirrors with the block hashes of deletes, skipping
+// those the store does not hold, then puts the mirrors at their heights, all
+// in one transaction.  Every write is applied to the transaction before the
+// next one reads the indices.
+func (s *Store) WriteBatch(deletes []chainhash.Hash, mirrors []*lightmirror.BtcLightMirrorV2, heights []int64) error {
+	if len(mirrors) != len(heights) {
+		return fmt.Errorf("%d mirrors for %d heights", len(mirrors), len(heights))
+	}
+
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	defer tr.Discard()
+
+	for i := range deletes {
+		batch := new(leveldb.Batch)
+		err := deleteBatch(tr, batch, &deletes[i])
+		if errors.Is(err, lightmirror.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tr.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+	for i, m := range mirrors {
+		batch := new(leveldb.Batch)
+		if err := putBatch(tr, batch, m, heights[i]); err != nil {
+			return err
+		}
+		if err := tr.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+	return tr.Commit()
+}
+
+// Iterate calls fn for every mirror stored at a height in [start, end], in
+// height order.  The scan reads from a database snapshot taken when Iterate
+// is called.
+func (s *Store) Iterate(start, end int64, fn func(height int64, m *lightmirror.BtcLightMirrorV2) error) error {
+	if start < 0 {
+		start = 0
+	}
+	if end < start {
+		return nil
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	limit := []byte{heightPrefix + 1}
+	if end < math.MaxInt64 {
+		limit = heightKey(end + 1)
+	}
+	iter := snap.NewIterator(&util.Range{Start: heightKey(start), Limit: limit}, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) != 9 || len(value) != chainhash.HashSize {
+			return &lightmirror.CorruptRecordError{
+				Key: append([]byte(nil), key...),
+				Err: errors.New("malformed height index entry"),
+			}
+		}
+		height := int64(binary.BigEndian.Uint64(key[1:]))
+		var hash chainhash.Hash
+		copy(hash[:], value)
+
+		mkey := mirrorKey(&hash)
+		record, err := snap.Get(mkey, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return &lightmirror.CorruptRecordError{
+				Key: mkey,
+				Err: errors.New("height index entry without record"),
+			}
+		}
+		if err != nil {
+			return err
+		}
+		m, err := decodeMirror(mkey, record, &hash)
+		if errors.Is(err, lightmirror.ErrPruned) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(height, m); err != nil {
+			if errors.Is(err, lightmirror.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Prune replaces the mirror with the given block hash by its header.
+func (s *Store) Prune(hash chainhash.Hash) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	pruned, err := s.pruned(&hash)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := pruned.Serialize(&buf); err != nil {
+		return err
+	}
+	return s.db.Put(mirrorKey(&hash), buf.Bytes(), nil)
+}
+
+// PrunedByHeight returns the header of the mirror stored at the given height.
+func (s *Store) PrunedByHeight(height int64) (*lightmirror.PrunedMirror, error) {
+	if height < 0 {
+		return nil, lightmirror.ErrNotFound
+	}
+	hash, err := hashAtHeight(s.db, height)
+	if err != nil {
+		return nil, err
+	}
+	return s.pruned(&hash)
+}
+
+// BlocksByCandidate returns the hashes of the mirrors delegating to addr
+// stored below beforeHeight, greatest height first, at most limit of them
+// unless limit is not positive.
+func (s *Store) BlocksByCandidate(addr common.Address, limit int, beforeHeight int64) ([]chainhash.Hash, error) {
+	if _, err := s.get(candidateIndexKey); err != nil {
+		if errors.Is(err, lightmirror.ErrNotFound) {
+			return nil, lightmirror.ErrNoCandidateIndex
+		}
+		return nil, err
+	}
+	if beforeHeight <= 0 {
+		return nil, nil
+	}
+
+	iter := s.db.NewIterator(&util.Range{
+		Start: candidateKey(addr, 0),
+		Limit: candidateKey(addr, beforeHeight),
+	}, nil)
+	defer iter.Release()
+
+	var hashes []chainhash.Hash
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if len(iter.Value()) != chainhash.HashSize {
+			return nil, &lightmirror.CorruptRecordError{
+				Key: append([]byte(nil), iter.Key()...),
+				Err: fmt.Errorf("hash of %d bytes", len(iter.Value())),
+			}
+		}
+		var hash chainhash.Hash
+		copy(hash[:], iter.Value())
+		hashes = append(hashes, hash)
+		if len(hashes) == limit {
+			break
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// ReindexCandidates rebuilds the candidate index from the stored mirrors in
+// one batch.  Pruned mirrors keep the candidate they were indexed under, if
+// any.
+func (s *Store) ReindexCandidates() error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	batch := new(leveldb.Batch)
+	for _, prefix := range []byte{candidatePrefix, candidateOfPrefix} {
+		iter := snap.NewIterator(util.BytesPrefix([]byte{prefix}), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	iter := snap.NewIterator(util.BytesPrefix([]byte{heightPrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) != 9 || len(value) != chainhash.HashSize {
+			return &lightmirror.CorruptRecordError{
+				Key: append([]byte(nil), key...),
+				Err: errors.New("malformed height index entry"),
+			}
+		}
+		height := int64(binary.BigEndian.Uint64(key[1:]))
+		var hash chainhash.Hash
+		copy(hash[:], value)
+
+		mkey := mirrorKey(&hash)
+		record, err := snap.Get(mkey, nil)
+		if err != nil {
+			return err
+		}
+		var (
+			addr common.Address
+			ok   bool
+		)
+		m, err := decodeMirror(mkey, record, &hash)
+		switch {
+		case errors.Is(err, lightmirror.ErrPruned):
+			prev, err := snap.Get(candidateOfKey(&hash), nil)
+			if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+				return err
+			}
+			addr, ok = common.BytesToAddress(prev), len(prev) == common.AddressLength
+		case err != nil:
+			return err
+		default:
+			addr, ok = lightmirror.IndexedCandidate(m)
+		}
+		if ok {
+			indexCandidate(batch, &hash, addr, height)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Put(candidateIndexKey, []byte{1})
+	return s.db.Write(batch, nil)
+}
+
+// IterateRecords calls fn with the height, block hash and undecoded record of
+// every mirror stored at a height in [start, end], in height order, pruned
+// mirrors included.  The scan reads from a database snapshot taken when
+// IterateRecords is called.
+func (s *Store) IterateRecords(start, end int64, fn func(height int64, hash chainhash.Hash, record []byte) error) error {
+	if start < 0 {
+		start = 0
+	}
+	if end < start {
+		return nil
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	limit := []byte{heightPrefix + 1}
+	if end < math.MaxInt64 {
+		limit = heightKey(end + 1)
+	}
+	iter := snap.NewIterator(&util.Range{Start: heightKey(start), Limit: limit}, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) != 9 || len(value) != chainhash.HashSize {
+			return &lightmirror.CorruptRecordError{
+				Key: append([]byte(nil), key...),
+				Err: errors.New("malformed height index entry"),
+			}
+		}
+		height := int64(binary.BigEndian.Uint64(key[1:]))
+		var hash chainhash.Hash
+		copy(hash[:], value)
+
+		mkey := mirrorKey(&hash)
+		record, err := snap.Get(mkey, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return &lightmirror.CorruptRecordError{
+				Key: mkey,
+				Err: errors.New("height index entry without record"),
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(height, hash, record); err != nil {
+			if errors.Is(err, lightmirror.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// PutMigrated rewrites the records of the mirrors at their heights and sets
+// the migration progress in one batch, which also indexes the candidates of
+// the mirrors.
+func (s *Store) PutMigrated(mirrors []*lightmirror.BtcLightMirrorV2, heights []int64, progress int64) error {
+	if len(mirrors) != len(heights) {
+		return fmt.Errorf("%d mirrors for %d heights", len(mirrors), len(heights))
+	}
+
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	batch := new(leveldb.Batch)
+	for i, m := range mirrors {
+		hash := m.BtcHeader.BlockHash()
+		stored, err := hashAtHeight(s.db, heights[i])
+		if err != nil {
+			return err
+		}
+		if stored != hash {
+			return fmt.Errorf("block %v is not stored at height %d", hash, heights[i])
+		}
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil {
+			return err
+		}
+		batch.Put(mirrorKey(&hash), buf.Bytes())
+		if err := unindexCandidate(s.db, batch, &hash, heights[i]); err != nil {
+			return err
+		}
+		if addr, ok := lightmirror.IndexedCandidate(m); ok {
+			indexCandidate(batch, &hash, addr, heights[i])
+		}
+	}
+	var progressBytes [8]byte
+	binary.BigEndian.PutUint64(progressBytes[:], uint64(progress))
+	batch.Put(migrationKey, progressBytes[:])
+	return s.db.Write(batch, nil)
+}
+
+// MigrationProgress returns the progress last set by PutMigrated.
+func (s *Store) MigrationProgress() (int64, bool, error) {
+	value, err := s.get(migrationKey)
+	if errors.Is(err, lightmirror.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(value) != 8 {
+		return 0, false, &lightmirror.CorruptRecordError{
+			Key: migrationKey,
+			Err: fmt.Errorf("progress of %d bytes", len(value)),
+		}
+	}
+	return int64(binary.BigEndian.Uint64(value)), true, nil
+}
+
+// indexCandidate adds to batch the candidate index entries of the block hash
+// at height delegating to addr.
+func indexCandidate(batch *leveldb.Batch, hash *chainhash.Hash, addr common.Address, height int64) {
+	batch.Put(candidateKey(addr, height), hash[:])
+	batch.Put(candidateOfKey(hash), addr[:])
+}
+
+// unindexCandidate adds to batch the removal of the candidate index entries
+// of the block hash at height, if it has any.
+func unindexCandidate(r reader, batch *leveldb.Batch, hash *chainhash.Hash, height int64) error {
+	addr, err := get(r, candidateOfKey(hash))
+	if errors.Is(err, lightmirror.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key := candidateKey(common.BytesToAddress(addr), height)
+	indexed, err := get(r, key)
+	switch {
+	case err == nil && bytes.Equal(indexed, hash[:]):
+		batch.Delete(key)
+	case err != nil && !errors.Is(err, lightmirror.ErrNotFound):
+		return err
+	}
+	batch.Delete(candidateOfKey(hash))
+	return nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// reader reads the database, or a transaction open on it.
+type reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+}
+
+func (s *Store) get(key []byte) ([]byte, error) {
+	return get(s.db, key)
+}
+
+func get(r reader, key []byte) ([]byte, error) {
+	value, err := r.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, lightmirror.ErrNotFound
+	}
+	return value, err
+}
+
+func (s *Store) mirror(hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	key := mirrorKey(hash)
+	value, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMirror(key, value, hash)
+}
+
+// decodeMirror decodes the record value stored under key for hash.
+func decodeMirror(key, value []byte, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	if len(value) == lightmirror.PrunedMirrorSize {
+		return nil, lightmirror.ErrPruned
+	}
+
+	m, err := lightmirror.DeserializeBytes(value)
+	if err != nil {
+		return nil, &lightmirror.CorruptRecordError{Key: key, Err: err}
+	}
+	if m.BtcHeader.BlockHash() != *hash {
+		return nil, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("record hashes to %v", m.BtcHeader.BlockHash()),
+		}
+	}
+	return m, nil
+}
+
+// pruned decodes the header at the start of the mirror record of hash.  Both
+// encodings of a record start with the 80 byte header.
+func (s *Store) pruned(hash *chainhash.Hash) (*lightmirror.PrunedMirror, error) {
+	key := mirrorKey(hash)
+	value, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := new(lightmirror.PrunedMirror)
+	if err := pruned.Deserialize(bytes.NewReader(value)); err != nil {
+		return nil, &lightmirror.CorruptRecordError{Key: key, Err: err}
+	}
+	if pruned.BtcHeader.BlockHash() != *hash {
+		return nil, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("record hashes to %v", pruned.BtcHeader.BlockHash()),
+		}
+	}
+	return pruned, nil
+}
+
+func hashAtHeight(r reader, height int64) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	key := heightKey(height)
+	value, err := get(r, key)
+	if err != nil {
+		return hash, err
+	}
+	if len(value) != chainhash.HashSize {
+		return hash, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("hash of %d bytes", len(value)),
+		}
+	}
+	copy(hash[:], value)
+	return hash, nil
+}
+
+func heightOfHash(r reader, hash *chainhash.Hash) (int64, error) {
+	key := hashHeightKey(hash)
+	value, err := get(r, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, &lightmirror.CorruptRecordError{
+			Key: key,
+			Err: fmt.Errorf("height of %d bytes", len(value)),
+		}
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package leveldbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/coredao-org/btcpowermirror/lightmirror/storetest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) lightmirror.Store {
+		s, err := Open(filepath.Join(t.TempDir(), "db"))
+		if err != nil {
+			t.Fatalf("Open error %v", err)
+		}
+		return s
+	})
+}
+
+// TestConformanceCached runs the conformance tests through a CachingStore,
+// which forwards every optional interface of Store but MigratableStore.
+func TestConformanceCached(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) lightmirror.Store {
+		s, err := Open(filepath.Join(t.TempDir(), "db"))
+		if err != nil {
+			t.Fatalf("Open error %v", err)
+		}
+		return lightmirror.NewCachingStore(s, 16)
+	})
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	mirrors := storetest.Mirrors(4)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != 3 || tip.BtcHeader.BlockHash() != mirrors[3].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d, want %v at height 3",
+			tip.BtcHeader.BlockHash(), height, mirrors[3].BtcHeader.BlockHash())
+	}
+}
+
+// TestTruncatedValue simulates a crash that left a torn value behind and
+// checks that reads report it instead of panicking.
+func TestTruncatedValue(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	mirrors := storetest.Mirrors(2)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	hash := mirrors[1].BtcHeader.BlockHash()
+	key := mirrorKey(&hash)
+	value, err := s.db.Get(key, nil)
+	if err != nil {
+		t.Fatalf("Get error %v", err)
+	}
+
+	// Cut the value inside the header, inside the coinbase and inside the
+	// merkle nodes.
+	for _, n := range []int{0, 40, 100, len(value) - 1} {
+		if err := s.db.Put(key, value[:n], nil); err != nil {
+			t.Fatalf("Put error %v", err)
+		}
+
+		checks := []struct {
+			name string
+			fn   func() error
+		}{
+			{"ByHash", func() error { _, _, err := s.ByHash(hash); return err }},
+			{"ByHeight", func() error { _, err := s.ByHeight(1); return err }},
+			{"Tip", func() error { _, _, err := s.Tip(); return err }},
+		}
+		for _, check := range checks {
+			err := check.fn()
+			var corrupt *lightmirror.CorruptRecordError
+			if !errors.As(err, &corrupt) {
+				t.Errorf("%s truncated at %d: got error %v, want CorruptRecordError",
+					check.name, n, err)
+				continue
+			}
+			if string(corrupt.Key) != string(key) {
+				t.Errorf("%s truncated at %d: got key %x, want %x",
+					check.name, n, corrupt.Key, key)
+			}
+		}
+	}
+
+	// The undamaged record is still readable.
+	if _, err := s.ByHeight(0); err != nil {
+		t.Errorf("ByHeight(0) error %v", err)
+	}
+}
+
+// TestReindexCandidates checks that a database written before the candidate
+// index existed is served once reindexed.
+func TestReindexCandidates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	mirrors := mirrortest.GenerateChain(t, 3, mirrortest.WithPowerParams(candidate, candidate))
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// Drop the index as a database of an older version lacks it.
+	batch := new(leveldb.Batch)
+	for _, prefix := range []byte{candidatePrefix, candidateOfPrefix, metaPrefix} {
+		iter := s.db.NewIterator(util.BytesPrefix([]byte{prefix}), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+	}
+	if err := s.db.Write(batch, nil); err != nil {
+		t.Fatalf("Write error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error %v", err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+	if _, err := s.BlocksByCandidate(candidate, 0, 10); !errors.Is(err, lightmirror.ErrNoCandidateIndex) {
+		t.Errorf("BlocksByCandidate: got error %v, want %v", err, lightmirror.ErrNoCandidateIndex)
+	}
+	if err := s.ReindexCandidates(); err != nil {
+		t.Fatalf("ReindexCandidates error %v", err)
+	}
+	hashes, err := s.BlocksByCandidate(candidate, 0, 10)
+	if err != nil || len(hashes) != 3 || hashes[0] != mirrors[2].BtcHeader.BlockHash() {
+		t.Errorf("BlocksByCandidate after ReindexCandidates: got %v, error %v", hashes, err)
+	}
+}
+
+// TestMigrateStore checks that records of the legacy encoding are rewritten
+// as V2 and indexed.
+func TestMigrateStore(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	defer s.Close()
+
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	var (
+		prev    chainhash.Hash
+		mirrors []*lightmirror.BtcLightMirrorV2
+	)
+	for i := 0; i < 5; i++ {
+		header, coinbase, txids := mirrortest.GenerateBlock(t, mirrortest.WithSeed(int64(i+1)),
+			mirrortest.WithPrevBlock(prev), mirrortest.WithTxCount(6),
+			mirrortest.WithPowerParams(candidate, candidate))
+		m, err := lightmirror.New(header, coinbase, txids)
+		if err != nil {
+			t.Fatalf("New #%d error %v", i, err)
+		}
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+
+		// Overwrite the record as a database of an older version holds
+		// it, unindexed.
+		v1 := lightmirror.BtcLightMirror{BtcHeader: *header, CoinBaseTx: *coinbase, TxHashes: txids[1:]}
+		var buf bytes.Buffer
+		if err := v1.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize #%d error %v", i, err)
+		}
+		hash := header.BlockHash()
+		batch := new(leveldb.Batch)
+		batch.Put(mirrorKey(&hash), buf.Bytes())
+		batch.Delete(candidateKey(candidate, int64(i)))
+		batch.Delete(candidateOfKey(&hash))
+		if err := s.db.Write(batch, nil); err != nil {
+			t.Fatalf("Write #%d error %v", i, err)
+		}
+		mirrors = append(mirrors, m)
+		prev = hash
+	}
+
+	report, err := lightmirror.MigrateStore(context.Background(), s, nil, 2)
+	if err != nil || report.Migrated != 5 || len(report.Failed) != 0 {
+		t.Fatalf("MigrateStore: got %+v, error %v", report, err)
+	}
+	if progress, ok, err := s.MigrationProgress(); err != nil || !ok || progress != 4 {
+		t.Errorf("MigrationProgress: got %d %v, error %v, want 4", progress, ok, err)
+	}
+	for i, m := range mirrors {
+		got, err := s.ByHeight(int64(i))
+		if err != nil {
+			t.Fatalf("ByHeight #%d error %v", i, err)
+		}
+		if err := got.CheckMerkle(); err != nil || !got.Equal(m) {
+			t.Errorf("ByHeight #%d: got %+v, merkle error %v, want %+v", i, got, err, m)
+		}
+	}
+	hashes, err := s.BlocksByCandidate(candidate, 0, 10)
+	if err != nil || len(hashes) != 5 {
+		t.Errorf("BlocksByCandidate: got %v, error %v, want 5 blocks", hashes, err)
+	}
+
+	// A completed migration resumes past the last record.
+	report, err = lightmirror.MigrateStore(context.Background(), s, nil, 2)
+	if err != nil || report.Start != 5 || report.Migrated != 0 {
+		t.Errorf("MigrateStore again: got %+v, error %v", report, err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrAlreadyStarted is returned by the Start method of a Service which runs,
+// ran or was stopped.
+var ErrAlreadyStarted = errors.New("already started")
+
+// ErrNotRunning is returned by the Ping method of a Service which is not
+// running.
+var ErrNotRunning = errors.New("not running")
+
+// Service is the lifecycle of the long-running components of the package.
+//
+// Start runs the component in the background until Stop is called or ctx is
+// done, which cancels the work in flight at once.  A component can only be
+// started once.
+//
+// Stop makes the component take no new work, waits for the work in flight
+// until ctx is done, then cancels it, and returns once the goroutines of the
+// component returned.  The channels the component owns are then closed,
+// exactly once, whether or not it was started.  Stop returns the error of
+// ctx if it had to cancel, and nil when called again.
+type Service interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+var (
+	_ Service = (*FetchScheduler)(nil)
+	_ Service = (*ConfirmationTracker)(nil)
+	_ Service = (*Watcher)(nil)
+
+	_ HealthChecker = (*CachingFetcher)(nil)
+	_ HealthChecker = (*DedupFetcher)(nil)
+	_ HealthChecker = (*ConfirmationTracker)(nil)
+	_ HealthChecker = (*Watcher)(nil)
+	_ HealthChecker = (*CompositeHealth)(nil)
+)
+
+// lifecycleState is the state of a lifecycle.
+type lifecycleState int
+
+const (
+	lifecycleNew lifecycleState = iota
+	lifecycleRunning
+	lifecycleStopped
+)
+
+// lifecycle implements Service for a component running a set of
+// goroutines.
+type lifecycle struct {
+	// finish, when set, closes the channels of the component.  It is
+	// called once the goroutines returned, or by stop if the component
+	// was never started.
+	finish func()
+
+	mtx    sync.Mutex
+	state  lifecycleState
+	quit   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs every function of runs in its own goroutine.  Each gets the
+// context of the work, cancelled when the component is force-stopped, and
+// the channel stop closes to have the goroutines return once they finished
+// the work in flight.
+func (l *lifecycle) start(ctx context.Context, runs ...func(ctx context.Context, quit <-chan struct{})) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.state != lifecycleNew {
+		return ErrAlreadyStarted
+	}
+	l.state = lifecycleRunning
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.quit, l.cancel, l.done = make(chan struct{}), cancel, make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(len(runs))
+	for _, run := range runs {
+		go func(run func(context.Context, <-chan struct{})) {
+			defer wg.Done()
+			run(ctx, l.quit)
+		}(run)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		if l.finish != nil {
+			l.finish()
+		}
+		close(l.done)
+	}()
+	return nil
+}
+
+// ping returns ErrNotRunning unless the component was started, is not
+// stopped and its goroutines did not return.
+func (l *lifecycle) ping() error {
+	l.mtx.Lock()
+	state, done := l.state, l.done
+	l.mtx.Unlock()
+	if state != lifecycleRunning {
+		return ErrNotRunning
+	}
+	select {
+	case <-done:
+		return ErrNotRunning
+	default:
+		return nil
+	}
+}
+
+// stop stops the goroutines started by start as Service.Stop tells.
+func (l *lifecycle) stop(ctx context.Context) error {
+	l.mtx.Lock()
+	switch l.state {
+	case lifecycleNew:
+		l.state = lifecycleStopped
+		l.mtx.Unlock()
+		if l.finish != nil {
+			l.finish()
+		}
+		return nil
+	case lifecycleRunning:
+		l.state = lifecycleStopped
+		close(l.quit)
+	}
+	done, cancel := l.done, l.cancel
+	l.mtx.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	cancel()
+	<-done
+	return ctx.Err()
+}
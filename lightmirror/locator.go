@@ -0,0 +1,62 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ErrNoCommonBlock is returned by FindForkPoint when no block of the locator
+// is on the best chain.
+var ErrNoCommonBlock = errors.New("no block of the locator is in the best chain")
+
+// BlockLocator returns hashes of the best chain, starting at the tip and
+// going back towards the anchor, which is always the last entry.  The first
+// ten entries are consecutive blocks, then the distance between entries
+// doubles at every step, so a locator has a logarithmic number of entries
+// while still pinpointing recent forks precisely.
+func (c *MirrorChain) BlockLocator() []chainhash.Hash {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	locator := make([]chainhash.Hash, 0, 32)
+	step := int64(1)
+	height := c.tip.height
+	for {
+		hash, _ := c.best.HashAtHeight(height)
+		locator = append(locator, hash)
+		if height == c.anchor.height {
+			return locator
+		}
+
+		height -= step
+		if height < c.anchor.height {
+			height = c.anchor.height
+		}
+		if len(locator) > 10 {
+			step *= 2
+		}
+	}
+}
+
+// FindForkPoint returns the first block of the locator that is on the best
+// chain, which for a locator built as by BlockLocator is the most recent
+// block the two chains share.  It returns ErrPruned or ErrHeaderOnly if that
+// block is pruned or header-only.
+func (c *MirrorChain) FindForkPoint(locator []chainhash.Hash) (*BtcLightMirrorV2, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, hash := range locator {
+		if _, err := c.best.HeightOfHash(hash); err == nil {
+			e := c.index[hash]
+			if err := e.bodyErr(); err != nil {
+				return nil, err
+			}
+			return e.mirror.Clone(), nil
+		}
+	}
+	return nil, ErrNoCommonBlock
+}
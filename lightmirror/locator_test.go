@@ -0,0 +1,111 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestBlockLocator(t *testing.T) {
+	tests := []struct {
+		blocks int
+		want   []int64 // heights relative to the anchor
+	}{
+		{1, []int64{0}},
+		{5, []int64{4, 3, 2, 1, 0}},
+		{12, []int64{11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{40, []int64{39, 38, 37, 36, 35, 34, 33, 32, 31, 30, 29, 28, 26,
+			22, 14, 0}},
+	}
+
+	for i, test := range tests {
+		mirrors := newTestMirrors(test.blocks)
+		c := newTestChain(t, mirrors)
+		locator := c.BlockLocator()
+		if len(locator) != len(test.want) {
+			t.Errorf("BlockLocator #%d: got %d entries, want %d", i,
+				len(locator), len(test.want))
+			continue
+		}
+		for j, hash := range locator {
+			want := mirrors[test.want[j]].BtcHeader.BlockHash()
+			if hash != want {
+				t.Errorf("BlockLocator #%d: entry %d is not at height %d",
+					i, j, test.want[j])
+			}
+		}
+	}
+}
+
+func TestFindForkPoint(t *testing.T) {
+	// The chains share the first 20 blocks, then each has its own branch.
+	mirrors := newTestMirrors(20)
+	ours := newTestChain(t, append(mirrors, newTestBranch(mirrors[19], 1000, 3)...))
+	short := newTestChain(t, append(mirrors, newTestBranch(mirrors[19], 2000, 5)...))
+	long := newTestChain(t, append(mirrors, newTestBranch(mirrors[19], 3000, 15)...))
+
+	// The locator of a short branch is dense enough to name the fork.
+	fork, err := ours.FindForkPoint(short.BlockLocator())
+	if err != nil {
+		t.Fatalf("FindForkPoint error %v", err)
+	}
+	if fork.BtcHeader.BlockHash() != mirrors[19].BtcHeader.BlockHash() {
+		t.Errorf("FindForkPoint: got %v, want %v", fork.BtcHeader.BlockHash(),
+			mirrors[19].BtcHeader.BlockHash())
+	}
+
+	// Past the first ten entries the locator is sparse, the fork point is
+	// then the most recent shared entry: 34, ..., 24, 23, 21, 17.
+	fork, err = ours.FindForkPoint(long.BlockLocator())
+	if err != nil {
+		t.Fatalf("FindForkPoint error %v", err)
+	}
+	if fork.BtcHeader.BlockHash() != mirrors[17].BtcHeader.BlockHash() {
+		t.Errorf("FindForkPoint: got %v, want %v", fork.BtcHeader.BlockHash(),
+			mirrors[17].BtcHeader.BlockHash())
+	}
+
+	// Our own locator finds our tip.
+	fork, err = ours.FindForkPoint(ours.BlockLocator())
+	if err != nil {
+		t.Fatalf("FindForkPoint error %v", err)
+	}
+	if tip, _ := ours.Tip(); fork.BtcHeader.BlockHash() != tip.BtcHeader.BlockHash() {
+		t.Errorf("FindForkPoint own locator: got %v, want the tip",
+			fork.BtcHeader.BlockHash())
+	}
+
+	_, err = ours.FindForkPoint([]chainhash.Hash{{1}, {2}})
+	if !errors.Is(err, ErrNoCommonBlock) {
+		t.Errorf("FindForkPoint unrelated: got error %v, want %v", err,
+			ErrNoCommonBlock)
+	}
+}
+
+// BenchmarkBlockLocator builds locators of a chain of ten thousand blocks,
+// whose hashes are taken from the chain entries rather than rehashed.
+func BenchmarkBlockLocator(b *testing.B) {
+	mirrors := newTestMirrors(10000)
+	c, err := NewMirrorChain(mirrors[0], testAnchorHeight,
+		WithChainParams(&chaincfg.RegressionNetParams))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if locator := c.BlockLocator(); len(locator) == 0 {
+			b.Fatal("empty locator")
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger receives the events of the package: fetch latencies, chain
+// reorganizations, orphan adoptions and validation failures.  Nothing is
+// logged by default; the types which log accept a Logger through their
+// options or configuration.  Implementations must be safe for concurrent
+// use, and must not call back into the type logging, which may hold a lock.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NopLogger is the Logger discarding everything, used when none is set.
+type NopLogger struct{}
+
+func (NopLogger) Debugf(string, ...interface{}) {}
+func (NopLogger) Infof(string, ...interface{})  {}
+func (NopLogger) Warnf(string, ...interface{})  {}
+func (NopLogger) Errorf(string, ...interface{}) {}
+
+// orNopLogger returns l, or a NopLogger if l is nil.
+func orNopLogger(l Logger) Logger {
+	if l == nil {
+		return NopLogger{}
+	}
+	return l
+}
+
+// stdLogger is a Logger writing to a standard library logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger writing the events to l, each prefixed with
+// its level.
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+func (s stdLogger) logf(level, format string, args []interface{}) {
+	s.l.Printf(level+" "+format, args...)
+}
+
+func (s stdLogger) Debugf(format string, args ...interface{}) { s.logf("DBG", format, args) }
+func (s stdLogger) Infof(format string, args ...interface{})  { s.logf("INF", format, args) }
+func (s stdLogger) Warnf(format string, args ...interface{})  { s.logf("WRN", format, args) }
+func (s stdLogger) Errorf(format string, args ...interface{}) { s.logf("ERR", format, args) }
+
+// WithLogger makes the chain log its reorganizations, orphan adoptions and
+// rejected blocks to l.
+func WithLogger(l Logger) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.logger = l
+	}
+}
+
+// FetcherOption configures the fetchers of the package wrapping another
+// Fetcher.
+type FetcherOption func(*fetcherConfig)
+
+type fetcherConfig struct {
+	logger Logger
+}
+
+func newFetcherConfig(opts []FetcherOption) fetcherConfig {
+	var cfg fetcherConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.logger = orNopLogger(cfg.logger)
+	return cfg
+}
+
+// WithFetcherLogger makes the fetcher log the latency of every upstream
+// fetch, and its failures, to l.
+func WithFetcherLogger(l Logger) FetcherOption {
+	return func(cfg *fetcherConfig) {
+		cfg.logger = l
+	}
+}
+
+// logFetch logs the outcome of an upstream fetch of the block described by
+// block, which started at start.
+func logFetch(l Logger, block string, start time.Time, err error) {
+	if err != nil {
+		l.Warnf("fetching block %s failed after %v: %v", block, time.Since(start), err)
+		return
+	}
+	l.Debugf("fetched block %s in %v", block, time.Since(start))
+}
+
+// heightBlock describes the block at height in the logs.
+func heightBlock(height int64) string {
+	return fmt.Sprintf("at height %d", height)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// captureLogger is a Logger recording the events logged, each formatted and
+// prefixed with its level.
+type captureLogger struct {
+	mtx    sync.Mutex
+	events []string
+}
+
+func (l *captureLogger) logf(level, format string, args []interface{}) {
+	l.mtx.Lock()
+	l.events = append(l.events, level+" "+fmt.Sprintf(format, args...))
+	l.mtx.Unlock()
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.logf("DBG", format, args) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.logf("INF", format, args) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.logf("WRN", format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf("ERR", format, args) }
+
+// count returns the number of events logged at level containing substr.
+func (l *captureLogger) count(level, substr string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for _, event := range l.events {
+		if strings.HasPrefix(event, level+" ") && strings.Contains(event, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+	l.Debugf("a %d", 1)
+	l.Infof("b")
+	l.Warnf("c %s", "d")
+	l.Errorf("e")
+	if got, want := buf.String(), "DBG a 1\nINF b\nWRN c d\nERR e\n"; got != want {
+		t.Errorf("NewStdLogger: got %q, want %q", got, want)
+	}
+}
+
+func TestChainLogger(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	l := &captureLogger{}
+	c := newTestChain(t, mirrors, WithOrphanPool(10, 0), WithLogger(l))
+
+	branch := newTestBranch(mirrors[0], 1000, 3)
+	for _, m := range []*BtcLightMirrorV2{branch[2], branch[1]} {
+		if _, err := c.Append(m); !errors.Is(err, ErrOrphan) {
+			t.Fatalf("Append: got error %v, want %v", err, ErrOrphan)
+		}
+	}
+	if _, err := c.Append(branch[0]); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	bad := newTestBranch(branch[2], 2000, 1)[0]
+	bad.MerkleNodes[0][0] ^= 1
+	if _, err := c.Append(bad); err == nil {
+		t.Fatalf("Append: expected error")
+	}
+
+	tests := []struct {
+		level  string
+		substr string
+		want   int
+	}{
+		{"DBG", "holding orphan", 2},
+		{"INF", "adopted orphan", 2},
+		{"INF", "reorganized 2 blocks at fork height 100", 1},
+		{"WRN", "rejected block " + bad.BtcHeader.BlockHash().String(), 1},
+	}
+	for _, test := range tests {
+		if got := l.count(test.level, test.substr); got != test.want {
+			t.Errorf("%s %q: got %d events, want %d (%q)", test.level,
+				test.substr, got, test.want, l.events)
+		}
+	}
+}
+
+func TestFetcherLogger(t *testing.T) {
+	mirrors := newTestMirrors(2)
+	l := &captureLogger{}
+	fetchers := []struct {
+		name    string
+		fetcher Fetcher
+	}{
+		{"CachingFetcher", NewCachingFetcher(newCountingFetcher(mirrors), 10, WithFetcherLogger(l))},
+		{"DedupFetcher", NewDedupFetcher(newCountingFetcher(mirrors), WithFetcherLogger(l))},
+	}
+	hash := mirrors[1].BtcHeader.BlockHash()
+	for _, f := range fetchers {
+		l.events = nil
+		if _, err := f.fetcher.FetchByHash(context.Background(), hash); err != nil {
+			t.Fatalf("FetchByHash (%s) error %v", f.name, err)
+		}
+		if _, err := f.fetcher.FetchByHeight(context.Background(), 5); err == nil {
+			t.Fatalf("FetchByHeight (%s): expected error", f.name)
+		}
+		if l.count("DBG", "fetched block "+hash.String()+" in ") != 1 {
+			t.Errorf("%s: fetch latency not logged (%q)", f.name, l.events)
+		}
+		if l.count("WRN", "fetching block at height 5 failed") != 1 {
+			t.Errorf("%s: fetch failure not logged (%q)", f.name, l.events)
+		}
+	}
+}
+
+func TestValidationLogger(t *testing.T) {
+	mirrors := newTestMirrors(4)
+	l := &captureLogger{}
+	err := ValidateChainParallel(context.Background(), mirrors,
+		&chaincfg.MainNetParams, 1, WithValidationLogger(l))
+	if err == nil {
+		t.Fatalf("ValidateChainParallel: expected error")
+	}
+	if l.count("WRN", "failed validation: block target difficulty") != 1 {
+		t.Errorf("ValidateChainParallel: failure not logged (%q)", l.events)
+	}
+
+	l.events = nil
+	mirrors[2] = newTestMirror(chainhash.Hash{}, 100, 0)
+	err = ValidateChainParallel(context.Background(), mirrors,
+		&chaincfg.RegressionNetParams, 1, WithValidationLogger(l))
+	if !errors.Is(err, ErrUnknownParent) {
+		t.Fatalf("ValidateChainParallel: got error %v, want %v", err, ErrUnknownParent)
+	}
+	if l.count("WRN", "mirror 2, block") != 1 {
+		t.Errorf("ValidateChainParallel: linkage failure not logged (%q)", l.events)
+	}
+}
+
+func TestPipelineLogger(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	l := &captureLogger{}
+	p, err := NewPipeline(PipelineConfig{
+		Fetcher: newCountingFetcher(mirrors),
+		Store:   newMemStore(),
+		Params:  &chaincfg.RegressionNetParams,
+		Logger:  l,
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline error %v", err)
+	}
+	if _, err := p.Run(context.Background(), 0, 4); err != nil {
+		t.Fatalf("Run error %v", err)
+	}
+	if got := l.count("DBG", "fetched block at height"); got != 5 {
+		t.Errorf("Run: got %d fetch events, want 5 (%q)", got, l.events)
+	}
+	if l.count("INF", "pipeline stored heights 0 to 4") != 1 {
+		t.Errorf("Run: outcome not logged (%q)", l.events)
+	}
+}
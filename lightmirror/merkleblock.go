@@ -0,0 +1,195 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxBlockTransactions bounds the transaction count of a merkle block, the
+// number of the smallest transactions a block holds.
+const maxBlockTransactions = wire.MaxBlockPayload / 60
+
+// ErrInvalidMerkleBlock is wrapped by the errors of NewFromMerkleBlock for a
+// merkle block whose partial merkle tree is malformed, does not lead to the
+// merkle root of its header or does not match the coinbase.
+var ErrInvalidMerkleBlock = errors.New("invalid merkle block")
+
+// partialTree walks the partial merkle tree of a merkle block, as described
+// by BIP 37.
+type partialTree struct {
+	mb         *wire.MsgMerkleBlock
+	bitsUsed   int
+	hashesUsed int
+
+	// coinbase and branch are the hash of the first leaf and its merkle
+	// branch, set when the first leaf is matched.
+	coinbase *chainhash.Hash
+	branch   []chainhash.Hash
+}
+
+// width returns the number of nodes of the tree at height, 0 for the
+// leaves.
+func (t *partialTree) width(height uint) uint32 {
+	return uint32((uint64(t.mb.Transactions) + 1<<height - 1) >> height)
+}
+
+func (t *partialTree) nextBit() (bool, error) {
+	if t.bitsUsed >= 8*len(t.mb.Flags) {
+		return false, fmt.Errorf("flags exhausted: %w", ErrInvalidMerkleBlock)
+	}
+	bit := t.mb.Flags[t.bitsUsed/8]>>(t.bitsUsed%8)&1 == 1
+	t.bitsUsed++
+	return bit, nil
+}
+
+func (t *partialTree) nextHash() (chainhash.Hash, error) {
+	if t.hashesUsed >= len(t.mb.Hashes) {
+		return chainhash.Hash{}, fmt.Errorf("hashes exhausted: %w", ErrInvalidMerkleBlock)
+	}
+	hash := *t.mb.Hashes[t.hashesUsed]
+	t.hashesUsed++
+	return hash, nil
+}
+
+// traverse returns the hash of the node at height and pos, recording the
+// merkle branch of the first leaf on the way.
+func (t *partialTree) traverse(height uint, pos uint32) (chainhash.Hash, error) {
+	parent, err := t.nextBit()
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	if height == 0 || !parent {
+		hash, err := t.nextHash()
+		if err != nil {
+			return chainhash.Hash{}, err
+		}
+		if height == 0 && parent && pos == 0 {
+			t.coinbase = &hash
+			t.branch = make([]chainhash.Hash, 0, t.depth())
+		}
+		return hash, nil
+	}
+
+	left, err := t.traverse(height-1, pos*2)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	right := left
+	if pos*2+1 < t.width(height-1) {
+		if right, err = t.traverse(height-1, pos*2+1); err != nil {
+			return chainhash.Hash{}, err
+		}
+		// Identical siblings would make two trees of different
+		// transactions hash alike (CVE-2012-2459).
+		if right == left {
+			return chainhash.Hash{}, fmt.Errorf("identical siblings: %w", ErrInvalidMerkleBlock)
+		}
+	}
+	if pos == 0 && t.coinbase != nil {
+		t.branch = append(t.branch, right)
+	}
+	var buf [2 * chainhash.HashSize]byte
+	copy(buf[:], left[:])
+	copy(buf[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:]), nil
+}
+
+// depth returns the height of the root of the tree.
+func (t *partialTree) depth() uint {
+	var height uint
+	for t.width(height) > 1 {
+		height++
+	}
+	return height
+}
+
+// NewFromMerkleBlock returns the mirror of the block of mb, a BIP 37
+// merkleblock message, and its coinbase, which a peer sends along with mb
+// when the filter matches it.  As a merkle block proves the transactions
+// its filter matched, the filter must match the coinbase: its input spends
+// the null outpoint, which a filter matches once given
+// wire.OutPoint{Index: math.MaxUint32}.
+//
+// The options are those of New; the merkle branch is always checked against
+// the header, and unless under ValidateNone the coinbase is checked by
+// CheckCoinbase.  WithWitnessBranch is rejected, as a merkle block holds no
+// witness hashes.  Coinbases relayed with filtered blocks carry no witness,
+// so neither does the mirror.
+func NewFromMerkleBlock(mb *wire.MsgMerkleBlock, coinbase *wire.MsgTx, opts ...MirrorOption) (*BtcLightMirrorV2, error) {
+	cfg := mirrorConfig{
+		validation: ValidateMerkle,
+		deepCopy:   true,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.wtxids != nil {
+		return nil, errors.New("merkle block holds no witness branch")
+	}
+
+	txid, branch, err := coinbaseBranch(mb)
+	if err != nil {
+		return nil, err
+	}
+	if got := coinbase.TxHash(); got != txid {
+		return nil, fmt.Errorf("coinbase %v, merkle block has %v: %w", got, txid, ErrBranchMismatch)
+	}
+	light := &BtcLightMirrorV2{
+		BtcHeader:   mb.Header,
+		MerkleNodes: branch,
+	}
+	if cfg.deepCopy {
+		light.CoinBaseTx = *coinbase.Copy()
+	} else {
+		light.CoinBaseTx = *coinbase
+	}
+	if cfg.validation >= ValidateMerkle {
+		if err := light.CheckCoinbase(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.validation >= ValidateFull {
+		if err := light.VerifyInvariantsWith(cfg.invariants); err != nil {
+			return nil, err
+		}
+	}
+	return light, nil
+}
+
+// coinbaseBranch returns the hash of the coinbase of the merkle block mb and
+// its merkle branch, checked against the merkle root of the header.
+func coinbaseBranch(mb *wire.MsgMerkleBlock) (chainhash.Hash, []chainhash.Hash, error) {
+	if mb.Transactions == 0 || mb.Transactions > maxBlockTransactions {
+		return chainhash.Hash{}, nil, fmt.Errorf("merkle block of %d transactions: %w",
+			mb.Transactions, ErrInvalidMerkleBlock)
+	}
+	if uint32(len(mb.Hashes)) > mb.Transactions || 8*len(mb.Flags) < len(mb.Hashes) {
+		return chainhash.Hash{}, nil, fmt.Errorf("merkle block of %d hashes and "+
+			"%d flag bytes for %d transactions: %w", len(mb.Hashes), len(mb.Flags),
+			mb.Transactions, ErrInvalidMerkleBlock)
+	}
+
+	t := &partialTree{mb: mb}
+	root, err := t.traverse(t.depth(), 0)
+	if err != nil {
+		return chainhash.Hash{}, nil, err
+	}
+	if (t.bitsUsed+7)/8 != len(mb.Flags) || t.hashesUsed != len(mb.Hashes) {
+		return chainhash.Hash{}, nil, fmt.Errorf("unused flags or hashes: %w", ErrInvalidMerkleBlock)
+	}
+	if root != mb.Header.MerkleRoot {
+		return chainhash.Hash{}, nil, fmt.Errorf("merkle root %v does not match "+
+			"the header's %v: %w", root, mb.Header.MerkleRoot, ErrInvalidMerkleBlock)
+	}
+	if t.coinbase == nil {
+		return chainhash.Hash{}, nil, fmt.Errorf("coinbase not matched: %w", ErrInvalidMerkleBlock)
+	}
+	return *t.coinbase, t.branch, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newFullTestBlock returns a block of the coinbase of newTestMirror for
+// seed and n more transactions, along with its transaction ids.
+func newFullTestBlock(seed uint32, n int) (*wire.MsgBlock, []chainhash.Hash) {
+	block := &wire.MsgBlock{Header: wire.BlockHeader{
+		Version:   1,
+		Timestamp: time.Unix(1231006505, 0),
+		Bits:      0x207fffff,
+		Nonce:     seed,
+	}}
+	block.AddTransaction(newTestMirror(chainhash.Hash{}, seed, 0).CoinBaseTx.Copy())
+	for i := 1; i <= n; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{byte(seed), byte(i)}}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(i), []byte{0x51}))
+		block.AddTransaction(tx)
+	}
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	merkles := BuildMerkleTreeStore(&txids[0], txids[1:])
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return block, txids
+}
+
+// newMerkleBlock returns the merkle block of b for a filter matching the
+// transactions of b at the given indexes, and the coinbase if coinbase is
+// set.
+func newMerkleBlock(b *wire.MsgBlock, coinbase bool, indexes ...int) *wire.MsgMerkleBlock {
+	filter := bloom.NewFilter(uint32(len(indexes)+1), 0, 0.000001, wire.BloomUpdateNone)
+	if coinbase {
+		filter.AddOutPoint(&wire.OutPoint{Index: math.MaxUint32})
+	}
+	for _, i := range indexes {
+		hash := b.Transactions[i].TxHash()
+		filter.AddHash(&hash)
+	}
+	mb, _ := bloom.NewMerkleBlock(btcutil.NewBlock(b), filter)
+	return mb
+}
+
+func TestNewFromMerkleBlock(t *testing.T) {
+	for n := 0; n < 20; n++ {
+		b, txids := newFullTestBlock(uint32(n), n)
+		want, err := New(&b.Header, b.Transactions[0], txids)
+		if err != nil {
+			t.Fatalf("New error %v", err)
+		}
+		for _, indexes := range [][]int{nil, {n}, {n / 2, n}} {
+			m, err := NewFromMerkleBlock(newMerkleBlock(b, true, indexes...), b.Transactions[0])
+			if err != nil || !m.Equal(want) {
+				t.Errorf("NewFromMerkleBlock (%d transactions, %v): got %v, error %v, want %v",
+					n+1, indexes, m, err, want)
+			}
+		}
+	}
+
+	b, _ := newFullTestBlock(1, 4)
+	mb := newMerkleBlock(b, true)
+	m, err := NewFromMerkleBlock(mb, b.Transactions[0], WithDeepCopy(false), WithValidation(ValidateFull))
+	if err != nil || m.CoinBaseTx.TxIn[0] != b.Transactions[0].TxIn[0] {
+		t.Errorf("NewFromMerkleBlock without a deep copy: got %v, error %v", m, err)
+	}
+	if m, err = NewFromMerkleBlock(mb, b.Transactions[0]); err != nil || m.CoinBaseTx.TxIn[0] == b.Transactions[0].TxIn[0] {
+		t.Errorf("NewFromMerkleBlock: coinbase not copied, error %v", err)
+	}
+	if _, err := NewFromMerkleBlock(mb, b.Transactions[1]); !errors.Is(err, ErrBranchMismatch) {
+		t.Errorf("NewFromMerkleBlock of another transaction: got error %v, want %v", err, ErrBranchMismatch)
+	}
+	if _, err := NewFromMerkleBlock(mb, b.Transactions[0], WithWitnessBranch(make([]chainhash.Hash, 5))); err == nil {
+		t.Errorf("NewFromMerkleBlock with a witness branch: expected error")
+	}
+
+	// A block whose first transaction is not a coinbase yields no mirror,
+	// unless unchecked.
+	b.Transactions[0] = b.Transactions[4]
+	txids := make([]chainhash.Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	merkles := BuildMerkleTreeStore(&txids[0], txids[1:])
+	b.Header.MerkleRoot = *merkles[len(merkles)-1]
+	mb = newMerkleBlock(b, false, 0)
+	if _, err := NewFromMerkleBlock(mb, b.Transactions[0]); !errors.Is(err, ErrNotCoinbase) {
+		t.Errorf("NewFromMerkleBlock of an ordinary transaction: got error %v, want %v", err, ErrNotCoinbase)
+	}
+	if _, err := NewFromMerkleBlock(mb, b.Transactions[0], WithValidation(ValidateNone)); err != nil {
+		t.Errorf("NewFromMerkleBlock of an ordinary transaction under ValidateNone error %v", err)
+	}
+}
+
+func TestNewFromMerkleBlockInvalid(t *testing.T) {
+	b, _ := newFullTestBlock(1, 6)
+	valid := newMerkleBlock(b, true, 3)
+	h := chainhash.Hash{1}
+
+	clone := func(modify func(mb *wire.MsgMerkleBlock)) *wire.MsgMerkleBlock {
+		mb := *valid
+		mb.Hashes = append([]*chainhash.Hash{}, valid.Hashes...)
+		mb.Flags = append([]byte{}, valid.Flags...)
+		modify(&mb)
+		return &mb
+	}
+	tests := []struct {
+		name string
+		mb   *wire.MsgMerkleBlock
+	}{
+		{"coinbase not matched", newMerkleBlock(b, false, 3)},
+		{"no transactions", clone(func(mb *wire.MsgMerkleBlock) { mb.Transactions = 0 })},
+		{"too many transactions", clone(func(mb *wire.MsgMerkleBlock) { mb.Transactions = maxBlockTransactions + 1 })},
+		{"wrong depth", clone(func(mb *wire.MsgMerkleBlock) { mb.Transactions = 16 })},
+		{"wrong hash", clone(func(mb *wire.MsgMerkleBlock) { mb.Hashes[0] = &h })},
+		{"missing hash", clone(func(mb *wire.MsgMerkleBlock) { mb.Hashes = mb.Hashes[:len(mb.Hashes)-1] })},
+		{"extra hash", clone(func(mb *wire.MsgMerkleBlock) { mb.Hashes = append(mb.Hashes, &h) })},
+		{"extra flags", clone(func(mb *wire.MsgMerkleBlock) { mb.Flags = append(mb.Flags, 0) })},
+		{"missing flags", clone(func(mb *wire.MsgMerkleBlock) { mb.Flags = nil })},
+		{"identical siblings", &wire.MsgMerkleBlock{
+			Header:       wire.BlockHeader{MerkleRoot: chainhash.DoubleHashH(append(h[:], h[:]...))},
+			Transactions: 2,
+			Hashes:       []*chainhash.Hash{&h, &h},
+			Flags:        []byte{0x07},
+		}},
+	}
+	for _, test := range tests {
+		if _, err := NewFromMerkleBlock(test.mb, b.Transactions[0]); !errors.Is(err, ErrInvalidMerkleBlock) {
+			t.Errorf("NewFromMerkleBlock (%s): got error %v, want %v", test.name, err, ErrInvalidMerkleBlock)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// defaultMigrationBatch is the number of records MigrateStore rewrites per
+// transaction when given no positive batch size.
+const defaultMigrationBatch = 1000
+
+var (
+	// ErrNotMigratable is returned by MigrateStore for a store which is
+	// not a MigratableStore.
+	ErrNotMigratable = errors.New("store does not support migration")
+
+	// ErrUnknownEncoding is the reason of a failed record which decodes
+	// neither as a BtcLightMirrorV2 nor as a BtcLightMirror matching its
+	// header.
+	ErrUnknownEncoding = errors.New("record is neither a V1 nor a V2 mirror")
+
+	// ErrCoinbaseMismatch is the reason of a failed record whose fetched
+	// coinbase is not the one of its block.
+	ErrCoinbaseMismatch = errors.New("fetched coinbase does not match the block")
+)
+
+// MigratableStore is a Store whose raw records MigrateStore can read and
+// rewrite.
+type MigratableStore interface {
+	Store
+
+	// IterateRecords calls fn with the height, block hash and undecoded
+	// record of every mirror stored at a height in [start, end], in
+	// height order, pruned mirrors included.  It sees the store as
+	// Iterate does and stops as Iterate does.
+	IterateRecords(start, end int64, fn func(height int64, hash chainhash.Hash, record []byte) error) error
+
+	// PutMigrated replaces the records of the mirrors, stored at their
+	// heights, by their canonical encoding, and sets the migration
+	// progress to progress, in one transaction.  It fails for a mirror
+	// the store does not hold at its height.
+	PutMigrated(mirrors []*BtcLightMirrorV2, heights []int64, progress int64) error
+
+	// MigrationProgress returns the progress last set by PutMigrated, and
+	// false if none was.
+	MigrationProgress() (int64, bool, error)
+}
+
+// MigrationFailure tells why MigrateStore left a record as it was.
+type MigrationFailure struct {
+	Height int64
+	Hash   chainhash.Hash
+	Err    error
+}
+
+func (f MigrationFailure) Error() string {
+	return fmt.Sprintf("record of block %v at height %d: %v", f.Hash, f.Height, f.Err)
+}
+
+func (f MigrationFailure) Unwrap() error {
+	return f.Err
+}
+
+// MigrationReport sums up a MigrateStore run.
+type MigrationReport struct {
+	// Start is the height the run resumed from.
+	Start int64
+
+	// Migrated counts the V1 records rewritten as V2.
+	Migrated int
+
+	// Skipped counts the records already V2, and Pruned the pruned ones,
+	// which keep no body to migrate.
+	Skipped int
+	Pruned  int
+
+	// Failed holds the records left as they were, in height order.
+	Failed []MigrationFailure
+}
+
+// MigrateStore rewrites in place the records of store still holding the
+// legacy BtcLightMirror encoding as BtcLightMirrorV2, batchSize records per
+// transaction, or defaultMigrationBatch if batchSize is not positive.  A V1
+// record whose coinbase had its witness stripped, or fails the merkle root
+// of its header, gets it from fetchCoinbase, if not nil, which must return
+// the transaction with the same txid.  The store must be a
+// MigratableStore.
+//
+// Every transaction also records the height below which every record is
+// V2, so a run stopped by ctx or by an error resumes where it stopped.  A
+// record failing to migrate is counted in the report with its reason and
+// holds the progress back, so that the next run retries it.
+func MigrateStore(ctx context.Context, store Store, fetchCoinbase func(chainhash.Hash) (*wire.MsgTx, error),
+	batchSize int) (MigrationReport, error) {
+
+	var report MigrationReport
+	ms, ok := store.(MigratableStore)
+	if !ok {
+		return report, ErrNotMigratable
+	}
+	if batchSize <= 0 {
+		batchSize = defaultMigrationBatch
+	}
+
+	progress, ok, err := ms.MigrationProgress()
+	if err != nil {
+		return report, err
+	}
+	start := int64(0)
+	if ok {
+		start = progress + 1
+	}
+	report.Start = start
+
+	// held is the progress once a record failed: the height before it.
+	held := int64(-1)
+	failed := false
+	type record struct {
+		height int64
+		hash   chainhash.Hash
+		value  []byte
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		var batch []record
+		err := ms.IterateRecords(start, math.MaxInt64, func(height int64, hash chainhash.Hash, value []byte) error {
+			batch = append(batch, record{height, hash, value})
+			if len(batch) == batchSize {
+				return ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			return report, nil
+		}
+
+		var (
+			mirrors []*BtcLightMirrorV2
+			heights []int64
+		)
+		for _, rec := range batch {
+			m, err := migrateRecord(rec.hash, rec.value, fetchCoinbase)
+			switch {
+			case errors.Is(err, ErrPruned):
+				report.Pruned++
+			case err != nil:
+				report.Failed = append(report.Failed, MigrationFailure{rec.height, rec.hash, err})
+				if !failed {
+					failed, held = true, rec.height-1
+				}
+			case m == nil:
+				report.Skipped++
+			default:
+				mirrors = append(mirrors, m)
+				heights = append(heights, rec.height)
+			}
+		}
+
+		last := batch[len(batch)-1].height
+		progress := last
+		if failed {
+			progress = held
+		}
+		if err := ms.PutMigrated(mirrors, heights, progress); err != nil {
+			return report, err
+		}
+		report.Migrated += len(mirrors)
+		start = last + 1
+	}
+}
+
+// migrateRecord returns the V2 mirror of the V1 record value of hash.  It
+// returns nil for a V2 record and ErrPruned for a pruned one.
+func migrateRecord(hash chainhash.Hash, value []byte, fetchCoinbase func(chainhash.Hash) (*wire.MsgTx, error)) (*BtcLightMirrorV2, error) {
+	if len(value) == PrunedMirrorSize {
+		return nil, ErrPruned
+	}
+
+	// With one or two transactions, both encodings are the same bytes.
+	v2 := new(BtcLightMirrorV2)
+	r := bytes.NewReader(value)
+	if err := v2.Deserialize(r); err == nil && r.Len() == 0 &&
+		v2.BtcHeader.BlockHash() == hash && v2.CheckMerkle() == nil {
+		return nil, nil
+	}
+
+	var v1 BtcLightMirror
+	r.Reset(value)
+	if err := v1.Deserialize(r); err != nil || r.Len() != 0 || v1.BtcHeader.BlockHash() != hash {
+		return nil, ErrUnknownEncoding
+	}
+
+	stripped := witnessCommitmentIndex(&v1.CoinBaseTx) >= 0 && !v1.CoinBaseTx.HasWitness()
+	merkleErr := v1.CheckMerkle()
+	if stripped || merkleErr != nil {
+		switch {
+		case fetchCoinbase != nil:
+			coinbase, err := fetchCoinbase(hash)
+			if err != nil {
+				return nil, fmt.Errorf("fetch coinbase: %w", err)
+			}
+			if merkleErr == nil && coinbase.TxHash() != v1.CoinBaseTx.TxHash() {
+				return nil, fmt.Errorf("txid %v, want %v: %w", coinbase.TxHash(),
+					v1.CoinBaseTx.TxHash(), ErrCoinbaseMismatch)
+			}
+			v1.CoinBaseTx = *coinbase
+			if err := v1.CheckMerkle(); err != nil {
+				return nil, fmt.Errorf("%v: %w", err, ErrCoinbaseMismatch)
+			}
+		case merkleErr != nil:
+			return nil, merkleErr
+		}
+	}
+
+	coinbaseHash := v1.CoinBaseTx.TxHash()
+	txids := append([]chainhash.Hash{coinbaseHash}, v1.TxHashes...)
+	return New(&v1.BtcHeader, &v1.CoinBaseTx, txids)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newV1Record returns the legacy BtcLightMirror encoding of a block building
+// on prev with extraTxs transactions besides its coinbase, and the V2 mirror
+// it migrates to.  A witness coinbase commits to its witness, which the
+// record has stripped.
+func newV1Record(t *testing.T, prev chainhash.Hash, seed uint32, extraTxs int, witness bool) ([]byte, *BtcLightMirrorV2) {
+	t.Helper()
+	m := newTestMirror(prev, seed, 0)
+	coinbase := m.CoinBaseTx.Copy()
+	if witness {
+		script := append(append([]byte(nil), witnessCommitmentHeader...), make([]byte, chainhash.HashSize)...)
+		coinbase.AddTxOut(wire.NewTxOut(0, script))
+		coinbase.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	}
+
+	v1 := BtcLightMirror{BtcHeader: m.BtcHeader, CoinBaseTx: *coinbase}
+	for i := 0; i < extraTxs; i++ {
+		var tx chainhash.Hash
+		tx[0] = byte(i + 1)
+		tx[1] = byte(seed)
+		v1.TxHashes = append(v1.TxHashes, tx)
+	}
+	coinbaseHash := coinbase.TxHash()
+	merkles := BuildMerkleTreeStore(&coinbaseHash, v1.TxHashes)
+	v1.BtcHeader.MerkleRoot = *merkles[len(merkles)-1]
+	solveTestHeader(&v1.BtcHeader)
+
+	want, err := New(&v1.BtcHeader, coinbase, append([]chainhash.Hash{coinbaseHash}, v1.TxHashes...))
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+	if witness {
+		v1.CoinBaseTx.TxIn[0].Witness = nil
+	}
+	var buf bytes.Buffer
+	if err := v1.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	return buf.Bytes(), want
+}
+
+func TestMigrateRecord(t *testing.T) {
+	v1, v1Want := newV1Record(t, chainhash.Hash{}, 1, 6, false)
+	stripped, strippedWant := newV1Record(t, chainhash.Hash{}, 2, 3, true)
+	v2 := newTestMirror(chainhash.Hash{}, 3, 6)
+	small, _ := newV1Record(t, chainhash.Hash{}, 4, 1, false)
+	badCoinbase := append([]byte(nil), v1...)
+	badCoinbase[wire.MaxBlockHeaderPayload+50]++
+
+	fetched := map[chainhash.Hash]*wire.MsgTx{
+		v1Want.BtcHeader.BlockHash():       &v1Want.CoinBaseTx,
+		strippedWant.BtcHeader.BlockHash(): &strippedWant.CoinBaseTx,
+	}
+	fetch := func(hash chainhash.Hash) (*wire.MsgTx, error) {
+		if tx, ok := fetched[hash]; ok {
+			return tx, nil
+		}
+		return nil, ErrNotFound
+	}
+	wrongFetch := func(chainhash.Hash) (*wire.MsgTx, error) {
+		return &v2.CoinBaseTx, nil
+	}
+
+	tests := []struct {
+		name   string
+		hash   chainhash.Hash
+		record []byte
+		fetch  func(chainhash.Hash) (*wire.MsgTx, error)
+		want   *BtcLightMirrorV2
+		err    error
+	}{
+		{"v1", v1Want.BtcHeader.BlockHash(), v1, nil, v1Want, nil},
+		{"v1 bad coinbase fetched", v1Want.BtcHeader.BlockHash(), badCoinbase, fetch, v1Want, nil},
+		{"stripped fetched", strippedWant.BtcHeader.BlockHash(), stripped, fetch, strippedWant, nil},
+		{"v2", v2.BtcHeader.BlockHash(), serializeMirror(t, v2), fetch, nil, nil},
+		{"two transactions", mustDecodeHash(t, small), small, nil, nil, nil},
+		{"pruned", v2.BtcHeader.BlockHash(), serializeMirror(t, v2)[:PrunedMirrorSize], nil, nil, ErrPruned},
+		{"garbage", v2.BtcHeader.BlockHash(), []byte{1, 2, 3}, nil, nil, ErrUnknownEncoding},
+		{"other block", v2.BtcHeader.BlockHash(), v1, nil, nil, ErrUnknownEncoding},
+		{"fetch fails", strippedWant.BtcHeader.BlockHash(), stripped, func(chainhash.Hash) (*wire.MsgTx, error) {
+			return nil, ErrNotFound
+		}, nil, ErrNotFound},
+		{"fetch mismatch", strippedWant.BtcHeader.BlockHash(), stripped, wrongFetch, nil, ErrCoinbaseMismatch},
+		{"fetch bad coinbase", v1Want.BtcHeader.BlockHash(), badCoinbase, wrongFetch, nil, ErrCoinbaseMismatch},
+	}
+	for _, test := range tests {
+		m, err := migrateRecord(test.hash, test.record, test.fetch)
+		if !errors.Is(err, test.err) {
+			t.Errorf("migrateRecord (%s): got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if test.want == nil {
+			if m != nil {
+				t.Errorf("migrateRecord (%s): got a mirror, want none", test.name)
+			}
+			continue
+		}
+		if !bytes.Equal(serializeMirror(t, m), serializeMirror(t, test.want)) {
+			t.Errorf("migrateRecord (%s): got %+v, want %+v", test.name, m, test.want)
+		}
+	}
+}
+
+// mustDecodeHash returns the hash of the header starting record.
+func mustDecodeHash(t *testing.T, record []byte) chainhash.Hash {
+	t.Helper()
+	header, err := PeekHeader(bytes.NewReader(record))
+	if err != nil {
+		t.Fatalf("PeekHeader error %v", err)
+	}
+	return header.BlockHash()
+}
+
+// cancellingStore cancels a migration once it rewrote a batch.
+type cancellingStore struct {
+	*memStore
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) PutMigrated(mirrors []*BtcLightMirrorV2, heights []int64, progress int64) error {
+	defer s.cancel()
+	return s.memStore.PutMigrated(mirrors, heights, progress)
+}
+
+func TestMigrateStore(t *testing.T) {
+	s := newMemStore()
+	var (
+		prev  chainhash.Hash
+		wants []*BtcLightMirrorV2
+	)
+	for i := 0; i < 10; i++ {
+		record, want := newV1Record(t, prev, uint32(i+1), 4, false)
+		hash := want.BtcHeader.BlockHash()
+		switch i {
+		case 3:
+			// Already V2.
+			record = serializeMirror(t, want)
+		case 5:
+			record = record[:PrunedMirrorSize]
+		case 7:
+			record = append([]byte(nil), record...)
+			record[wire.MaxBlockHeaderPayload+50]++
+		}
+		s.putRecord(hash, int64(i), record)
+		wants = append(wants, want)
+		prev = hash
+	}
+
+	// The run is cancelled after the first batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	fetch := func(hash chainhash.Hash) (*wire.MsgTx, error) {
+		return nil, ErrNotFound
+	}
+	report, err := MigrateStore(ctx, &cancellingStore{s, cancel}, fetch, 2)
+	if !errors.Is(err, context.Canceled) || report.Migrated != 2 || report.Start != 0 {
+		t.Fatalf("MigrateStore: got %+v, error %v, want 2 migrated and context.Canceled", report, err)
+	}
+
+	report, err = MigrateStore(context.Background(), s, fetch, 2)
+	if err != nil {
+		t.Fatalf("MigrateStore error %v", err)
+	}
+	if report.Start != 2 || report.Migrated != 5 || report.Skipped != 1 || report.Pruned != 1 ||
+		len(report.Failed) != 1 || report.Failed[0].Height != 7 || !errors.Is(report.Failed[0], ErrNotFound) {
+		t.Fatalf("MigrateStore: got %+v", report)
+	}
+	for i, want := range wants {
+		if i == 5 || i == 7 {
+			continue
+		}
+		m, err := s.ByHeight(int64(i))
+		if err != nil || !bytes.Equal(serializeMirror(t, m), serializeMirror(t, want)) {
+			t.Errorf("ByHeight #%d: got %+v, error %v, want %+v", i, m, err, want)
+		}
+	}
+
+	// The failed record holds the progress back: the next run retries it.
+	fetched := func(hash chainhash.Hash) (*wire.MsgTx, error) {
+		return &wants[7].CoinBaseTx, nil
+	}
+	report, err = MigrateStore(context.Background(), s, fetched, 2)
+	if err != nil || report.Start != 7 || report.Migrated != 1 || report.Skipped != 2 || len(report.Failed) != 0 {
+		t.Fatalf("MigrateStore again: got %+v, error %v", report, err)
+	}
+	report, err = MigrateStore(context.Background(), s, fetched, 2)
+	if err != nil || report.Start != 10 || report.Migrated+report.Skipped != 0 {
+		t.Errorf("MigrateStore done: got %+v, error %v", report, err)
+	}
+}
+
+func TestMigrateStoreNotMigratable(t *testing.T) {
+	s := struct{ Store }{newMemStore()}
+	if _, err := MigrateStore(context.Background(), s, nil, 0); !errors.Is(err, ErrNotMigratable) {
+		t.Errorf("MigrateStore: got error %v, want %v", err, ErrNotMigratable)
+	}
+}
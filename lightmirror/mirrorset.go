@@ -0,0 +1,263 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// The prefixes of the hashes of the mirror set tree.  An interior node of
+// Bitcoin's transaction tree hashes the 64 bytes of its children, so a node
+// of the set tree, hashed over 33 or 65 bytes starting with one of these,
+// is never an interior node of a transaction tree, and a leaf of the set
+// tree is never one of its interior nodes.
+const (
+	setLeafPrefix     = 0x00
+	setInteriorPrefix = 0x01
+)
+
+// maxSetSize is the most mirrors MirrorSetCommitment commits to, so that a
+// SetProof holds at most 32 nodes.
+const maxSetSize = 1<<32 - 1
+
+var (
+	// ErrEmptyMirrorSet is returned by MirrorSetCommitment for no
+	// mirrors.
+	ErrEmptyMirrorSet = errors.New("empty mirror set")
+
+	// ErrMirrorSetOrder is returned by MirrorSetCommitment for mirrors
+	// which are not in height order.
+	ErrMirrorSetOrder = errors.New("mirror set not in height order")
+
+	// ErrSetProofMismatch is returned when a SetProof does not lead from
+	// a mirror to the root of a set.
+	ErrSetProofMismatch = errors.New("set proof does not match the root")
+)
+
+// MirrorHash returns the double SHA-256 of the serialization of the mirror,
+// which identifies it in a mirror set.
+func (light *BtcLightMirrorV2) MirrorHash() (chainhash.Hash, error) {
+	data, err := light.ToBytes()
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return chainhash.DoubleHashH(data), nil
+}
+
+// SetProof proves that a mirror is the one at Index of a set of Count
+// mirrors committed to by MirrorSetCommitment.  Branch holds the siblings
+// of the path from the leaf of the mirror to the root, lowest first; the
+// bits of Index, lowest first, tell whether the path goes right at each
+// level, and a node without sibling, last of an odd level, has none.
+type SetProof struct {
+	Index  uint32
+	Count  uint32
+	Branch []chainhash.Hash
+}
+
+// MirrorSetCommitment returns the root of the merkle tree over the
+// MirrorHash of mirrors, given in height order, and the proof of each
+// mirror in the same order.  The tree separates its domains:
+//
+//	leaf     = DoubleSHA256(0x00 || MirrorHash)
+//	interior = DoubleSHA256(0x01 || left || right)
+//
+// A node without sibling, last of a level of odd length, goes up the tree
+// unchanged rather than being paired with itself as in Bitcoin's tree, so
+// no two sets of mirrors share a root.  The root of a single mirror is its
+// leaf.
+//
+// It fails with ErrEmptyMirrorSet for no mirrors, and with
+// ErrMirrorSetOrder when a mirror follows the one it builds on, or when a
+// mirror is repeated.
+func MirrorSetCommitment(mirrors []*BtcLightMirrorV2) (root chainhash.Hash, proofs []SetProof, err error) {
+	if len(mirrors) == 0 {
+		return chainhash.Hash{}, nil, ErrEmptyMirrorSet
+	}
+	if uint64(len(mirrors)) > maxSetSize {
+		return chainhash.Hash{}, nil, fmt.Errorf("set of %d mirrors is larger "+
+			"than %d", len(mirrors), uint64(maxSetSize))
+	}
+
+	index := make(map[chainhash.Hash]int, len(mirrors))
+	for i, m := range mirrors {
+		if m == nil {
+			return chainhash.Hash{}, nil, fmt.Errorf("mirror %d is nil", i)
+		}
+		hash := m.BtcHeader.BlockHash()
+		if j, ok := index[hash]; ok {
+			return chainhash.Hash{}, nil, fmt.Errorf("block %v is at %d "+
+				"and %d: %w", hash, j, i, ErrMirrorSetOrder)
+		}
+		index[hash] = i
+	}
+	for i, m := range mirrors {
+		if j, ok := index[m.BtcHeader.PrevBlock]; ok && j > i {
+			return chainhash.Hash{}, nil, fmt.Errorf("block %v at %d builds "+
+				"on block %v at %d: %w", m.BtcHeader.BlockHash(), i,
+				m.BtcHeader.PrevBlock, j, ErrMirrorSetOrder)
+		}
+	}
+
+	level := make([]chainhash.Hash, len(mirrors))
+	for i, m := range mirrors {
+		hash, err := m.MirrorHash()
+		if err != nil {
+			return chainhash.Hash{}, nil, fmt.Errorf("mirror %d: %v", i, err)
+		}
+		level[i] = setLeaf(hash)
+	}
+	proofs = make([]SetProof, len(mirrors))
+	depth := getExponent(len(mirrors))
+	for i := range proofs {
+		proofs[i] = SetProof{
+			Index:  uint32(i),
+			Count:  uint32(len(mirrors)),
+			Branch: make([]chainhash.Hash, 0, depth),
+		}
+	}
+
+	// pos holds the position of the node of each proof in the level.
+	pos := make([]int, len(mirrors))
+	for i := range pos {
+		pos[i] = i
+	}
+	for len(level) > 1 {
+		for i := range proofs {
+			if sibling := pos[i] ^ 1; sibling < len(level) {
+				proofs[i].Branch = append(proofs[i].Branch, level[sibling])
+			}
+			pos[i] /= 2
+		}
+		next := make([]chainhash.Hash, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = setInterior(&level[2*i], &level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		level = next
+	}
+	return level[0], proofs, nil
+}
+
+// setLeaf returns the leaf of the set tree of the mirror of hash.
+func setLeaf(mirrorHash chainhash.Hash) chainhash.Hash {
+	var buf [1 + chainhash.HashSize]byte
+	buf[0] = setLeafPrefix
+	copy(buf[1:], mirrorHash[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// setInterior returns the parent of left and right in the set tree.
+func setInterior(left, right *chainhash.Hash) chainhash.Hash {
+	var buf [1 + 2*chainhash.HashSize]byte
+	buf[0] = setInteriorPrefix
+	copy(buf[1:], left[:])
+	copy(buf[1+chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// branchLength returns the number of nodes in the branch of the leaf at
+// index of a set of count leaves, or -1 if index is out of range.
+func branchLength(index, count uint32) int {
+	if count == 0 || index >= count {
+		return -1
+	}
+	n := 0
+	for i, size := uint64(index), uint64(count); size > 1; i, size = i/2, (size+1)/2 {
+		if i^1 < size {
+			n++
+		}
+	}
+	return n
+}
+
+// Verify checks that the proof leads from the mirror of mirrorHash to root.
+// The errors wrap ErrSetProofMismatch.
+func (p *SetProof) Verify(root, mirrorHash chainhash.Hash) error {
+	if n := branchLength(p.Index, p.Count); n != len(p.Branch) {
+		return fmt.Errorf("branch of %d nodes for index %d of a set of %d, "+
+			"want %d: %w", len(p.Branch), p.Index, p.Count, n,
+			ErrSetProofMismatch)
+	}
+	node := setLeaf(mirrorHash)
+	branch := p.Branch
+	for i, size := uint64(p.Index), uint64(p.Count); size > 1; i, size = i/2, (size+1)/2 {
+		if i^1 >= size {
+			continue
+		}
+		if i&1 == 0 {
+			node = setInterior(&node, &branch[0])
+		} else {
+			node = setInterior(&branch[0], &node)
+		}
+		branch = branch[1:]
+	}
+	if node != root {
+		return fmt.Errorf("mirror %v at index %d of %d: root %v, want %v: %w",
+			mirrorHash, p.Index, p.Count, node, root, ErrSetProofMismatch)
+	}
+	return nil
+}
+
+// Serialize writes the proof to w: the varint index and count, then the
+// nodes of the branch, whose number they determine.
+func (p *SetProof) Serialize(w io.Writer) error {
+	if n := branchLength(p.Index, p.Count); n != len(p.Branch) {
+		return fmt.Errorf("branch of %d nodes for index %d of a set of %d, "+
+			"want %d", len(p.Branch), p.Index, p.Count, n)
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(p.Index)); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(p.Count)); err != nil {
+		return err
+	}
+	for _, node := range p.Branch {
+		if _, err := w.Write(node[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SerializeSize returns the number of bytes Serialize writes for the proof.
+func (p *SetProof) SerializeSize() int {
+	return wire.VarIntSerializeSize(uint64(p.Index)) +
+		wire.VarIntSerializeSize(uint64(p.Count)) +
+		len(p.Branch)*chainhash.HashSize
+}
+
+// Deserialize reads into the proof a proof written by Serialize.  It does
+// not verify it.
+func (p *SetProof) Deserialize(r io.Reader) error {
+	index, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if count > maxSetSize || index >= count {
+		return fmt.Errorf("SetProof.Deserialize index %d of a set of %d",
+			index, count)
+	}
+	p.Index, p.Count = uint32(index), uint32(count)
+	p.Branch = make([]chainhash.Hash, branchLength(p.Index, p.Count))
+	for i := range p.Branch {
+		if _, err := io.ReadFull(r, p.Branch[i][:]); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// refHash is the double SHA-256 of the concatenation of parts, computed with
+// crypto/sha256.
+func refHash(parts ...[]byte) [32]byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	first := sha256.Sum256(data)
+	return sha256.Sum256(first[:])
+}
+
+// refTree is a second implementation of the set tree, defined recursively
+// as the tree of RFC 6962: the left subtree of n > 1 leaves holds the first
+// k of them, k the largest power of two below n.  refTree returns its root
+// and the audit path of the leaf at index, lowest first.
+func refTree(leaves [][32]byte, index int) (root [32]byte, path [][32]byte) {
+	if len(leaves) == 1 {
+		return refHash([]byte{0x00}, leaves[0][:]), nil
+	}
+	k := 1
+	for 2*k < len(leaves) {
+		k *= 2
+	}
+	left, leftPath := refTree(leaves[:k], index)
+	right, rightPath := refTree(leaves[k:], index-k)
+	root = refHash([]byte{0x01}, left[:], right[:])
+	if index < k {
+		return root, append(leftPath, right)
+	}
+	return root, append(rightPath, left)
+}
+
+func TestMirrorSetCommitment(t *testing.T) {
+	mirrors := newTestMirrors(17)
+	for n := 1; n <= len(mirrors); n++ {
+		set := mirrors[:n]
+		root, proofs, err := MirrorSetCommitment(set)
+		if err != nil {
+			t.Fatalf("MirrorSetCommitment (%d) error %v", n, err)
+		}
+		hashes := make([][32]byte, n)
+		for i, m := range set {
+			if hashes[i], err = m.MirrorHash(); err != nil {
+				t.Fatalf("MirrorHash error %v", err)
+			}
+		}
+
+		for i := range set {
+			wantRoot, wantPath := refTree(hashes, i)
+			if root != chainhash.Hash(wantRoot) {
+				t.Fatalf("MirrorSetCommitment (%d): got root %v, want %x", n, root, wantRoot)
+			}
+			p := proofs[i]
+			if p.Index != uint32(i) || p.Count != uint32(n) || len(p.Branch) != len(wantPath) {
+				t.Fatalf("proof #%d of %d: got %+v, want a path of %d nodes", i, n, p, len(wantPath))
+			}
+			for j := range wantPath {
+				if p.Branch[j] != chainhash.Hash(wantPath[j]) {
+					t.Errorf("proof #%d of %d: node %d is %v, want %x", i, n, j, p.Branch[j], wantPath[j])
+				}
+			}
+			if err := p.Verify(root, hashes[i]); err != nil {
+				t.Errorf("Verify #%d of %d error %v", i, n, err)
+			}
+
+			var buf bytes.Buffer
+			if err := p.Serialize(&buf); err != nil {
+				t.Fatalf("Serialize error %v", err)
+			}
+			if buf.Len() != p.SerializeSize() {
+				t.Errorf("SerializeSize #%d of %d: got %d, wrote %d", i, n, p.SerializeSize(), buf.Len())
+			}
+			var got SetProof
+			if err := got.Deserialize(&buf); err != nil || !reflect.DeepEqual(got, p) {
+				t.Errorf("Deserialize #%d of %d: got %+v, error %v, want %+v", i, n, got, err, p)
+			}
+		}
+	}
+}
+
+func TestSetProofVerify(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	root, proofs, err := MirrorSetCommitment(mirrors)
+	if err != nil {
+		t.Fatalf("MirrorSetCommitment error %v", err)
+	}
+	hash, _ := mirrors[2].MirrorHash()
+	other, _ := mirrors[3].MirrorHash()
+	p := proofs[2]
+
+	// A leaf taken for an interior node, or a proof of the Bitcoin tree,
+	// does not verify.
+	leaf := setLeaf(hash)
+	tests := []struct {
+		name  string
+		proof SetProof
+		root  chainhash.Hash
+		hash  chainhash.Hash
+	}{
+		{"other mirror", p, root, other},
+		{"other root", p, chainhash.Hash{1}, hash},
+		{"other index", SetProof{Index: 3, Count: p.Count, Branch: p.Branch}, root, hash},
+		{"other count", SetProof{Index: p.Index, Count: 4, Branch: p.Branch}, root, hash},
+		{"short branch", SetProof{Index: p.Index, Count: p.Count, Branch: p.Branch[1:]}, root, hash},
+		{"index beyond count", SetProof{Index: 5, Count: 5, Branch: p.Branch}, root, hash},
+		{"leaf for the mirror", SetProof{Index: 0, Count: 1}, leaf, leaf},
+		{"bitcoin tree", SetProof{Index: 0, Count: 2, Branch: []chainhash.Hash{other}},
+			chainhash.DoubleHashH(append(hash[:], other[:]...)), hash},
+	}
+	for _, test := range tests {
+		if err := test.proof.Verify(test.root, test.hash); !errors.Is(err, ErrSetProofMismatch) {
+			t.Errorf("Verify (%s): got error %v, want %v", test.name, err, ErrSetProofMismatch)
+		}
+	}
+
+	var buf bytes.Buffer
+	p.Serialize(&buf)
+	data := buf.Bytes()
+	var got SetProof
+	if err := got.Deserialize(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Errorf("Deserialize of a truncated proof: expected error")
+	}
+	if err := got.Deserialize(bytes.NewReader([]byte{5, 5})); err == nil {
+		t.Errorf("Deserialize of an index beyond the count: expected error")
+	}
+}
+
+func TestMirrorSetCommitmentErrors(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	tests := []struct {
+		name    string
+		mirrors []*BtcLightMirrorV2
+		want    error
+	}{
+		{"empty", nil, ErrEmptyMirrorSet},
+		{"reversed", []*BtcLightMirrorV2{mirrors[1], mirrors[0]}, ErrMirrorSetOrder},
+		{"repeated", []*BtcLightMirrorV2{mirrors[0], mirrors[1], mirrors[0]}, ErrMirrorSetOrder},
+	}
+	for _, test := range tests {
+		if _, _, err := MirrorSetCommitment(test.mirrors); !errors.Is(err, test.want) {
+			t.Errorf("MirrorSetCommitment (%s): got error %v, want %v", test.name, err, test.want)
+		}
+	}
+	if _, _, err := MirrorSetCommitment([]*BtcLightMirrorV2{mirrors[0], nil}); err == nil {
+		t.Errorf("MirrorSetCommitment with a nil mirror: expected error")
+	}
+
+	// Mirrors apart from each other are in order.
+	if _, _, err := MirrorSetCommitment([]*BtcLightMirrorV2{mirrors[0], mirrors[2]}); err != nil {
+		t.Errorf("MirrorSetCommitment error %v", err)
+	}
+}
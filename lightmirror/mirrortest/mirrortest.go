@@ -0,0 +1,201 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package mirrortest generates synthetic blocks and mirrors for tests.  The
+// blocks have valid merkle roots and satisfy the proof of work of the
+// regression test network, and are derived from a seed so that a failing
+// test reproduces.
+package mirrortest
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Params are the chain parameters whose proof of work the generated blocks
+// satisfy.
+var Params = &chaincfg.RegressionNetParams
+
+// startTime is the timestamp of the first generated block, the time of the
+// main network genesis block.
+var startTime = time.Unix(1231006505, 0)
+
+// Option configures the generated blocks.
+type Option func(*config)
+
+type config struct {
+	seed      int64
+	prev      chainhash.Hash
+	txCount   int
+	power     bool
+	candidate common.Address
+	reward    common.Address
+}
+
+// WithSeed sets the seed of the blocks, 1 by default.  The same seed and
+// options generate the same blocks.
+func WithSeed(seed int64) Option {
+	return func(cfg *config) {
+		cfg.seed = seed
+	}
+}
+
+// WithPrevBlock makes the first generated block build on prev rather than
+// on the zero hash.
+func WithPrevBlock(prev chainhash.Hash) Option {
+	return func(cfg *config) {
+		cfg.prev = prev
+	}
+}
+
+// WithTxCount sets the number of transactions of every block, coinbase
+// included.  By default, every block gets between 1 and 8 transactions,
+// picked from the seed.
+func WithTxCount(n int) Option {
+	return func(cfg *config) {
+		cfg.txCount = n
+	}
+}
+
+// WithPowerParams makes the coinbase carry a CORE output delegating the
+// hash power of the block to candidate, the rewards going to reward.
+func WithPowerParams(candidate, reward common.Address) Option {
+	return func(cfg *config) {
+		cfg.power = true
+		cfg.candidate = candidate
+		cfg.reward = reward
+	}
+}
+
+// generator generates the blocks of a chain from its seed.
+type generator struct {
+	cfg  config
+	rand *rand.Rand
+	prev chainhash.Hash
+	time time.Time
+}
+
+func newGenerator(opts []Option) *generator {
+	cfg := config{seed: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &generator{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(cfg.seed)),
+		prev: cfg.prev,
+		time: startTime,
+	}
+}
+
+// next returns the next block of the chain.
+func (g *generator) next(t testing.TB) (*wire.BlockHeader, *wire.MsgTx, []chainhash.Hash) {
+	t.Helper()
+	n := g.cfg.txCount
+	if n == 0 {
+		n = 1 + g.rand.Intn(8)
+	}
+	if n < 1 {
+		t.Fatalf("mirrortest: block of %d transactions", n)
+	}
+
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  make([]byte, 9),
+			Sequence:         0xffffffff,
+		}},
+		TxOut: []*wire.TxOut{{
+			Value:    5000000000,
+			PkScript: []byte{txscript.OP_TRUE},
+		}},
+	}
+	script := coinBaseTx.TxIn[0].SignatureScript
+	script[0] = txscript.OP_DATA_8
+	g.rand.Read(script[1:])
+	if g.cfg.power {
+		coinBaseTx.AddTxOut(wire.NewTxOut(0, powerScript(g.cfg.candidate,
+			g.cfg.reward)))
+	}
+
+	txids := make([]chainhash.Hash, n)
+	txids[0] = coinBaseTx.TxHash()
+	for i := 1; i < n; i++ {
+		g.rand.Read(txids[i][:])
+	}
+	merkles := lightmirror.BuildMerkleTreeStore(&txids[0], txids[1:])
+
+	header := &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  g.prev,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  g.time,
+		Bits:       Params.PowLimitBits,
+	}
+	solve(header)
+	g.prev = header.BlockHash()
+	g.time = g.time.Add(10 * time.Minute)
+	return header, coinBaseTx, txids
+}
+
+// powerScript returns the CORE output script carrying the power parameters.
+func powerScript(candidate, reward common.Address) []byte {
+	script := []byte{txscript.OP_RETURN, byte(5 + 2*common.AddressLength)}
+	script = append(script, "CORE"...)
+	script = append(script, txscript.OP_DATA_1)
+	script = append(script, candidate[:]...)
+	return append(script, reward[:]...)
+}
+
+// solve searches a nonce satisfying the proof of work of header.  At the
+// difficulty of Params, every other nonce does.
+func solve(header *wire.BlockHeader) {
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+		header.Nonce++
+	}
+}
+
+// GenerateBlock returns the header, the coinbase and the hashes of all
+// transactions, coinbase first, of a block building on the zero hash or the
+// block of WithPrevBlock.  The triple is what lightmirror.New takes.  The
+// block is timestamped at the time of the main network genesis block.
+func GenerateBlock(t testing.TB, opts ...Option) (*wire.BlockHeader, *wire.MsgTx, []chainhash.Hash) {
+	t.Helper()
+	return newGenerator(opts).next(t)
+}
+
+// GenerateChain returns the mirrors of n blocks each building on the one
+// before it, the first building on the zero hash or the block of
+// WithPrevBlock, and each ten minutes after the one before it.  The first
+// mirror is that of GenerateBlock with the same options.
+func GenerateChain(t testing.TB, n int, opts ...Option) []*lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	g := newGenerator(opts)
+	mirrors := make([]*lightmirror.BtcLightMirrorV2, 0, n)
+	for i := 0; i < n; i++ {
+		header, coinBaseTx, txids := g.next(t)
+		m, err := lightmirror.New(header, coinBaseTx, txids,
+			lightmirror.WithValidation(lightmirror.ValidateFull))
+		if err != nil {
+			t.Fatalf("mirrortest: New error %v", err)
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mirrortest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func serialize(t *testing.T, mirrors []*lightmirror.BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, m := range mirrors {
+		if err := m.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize error %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestGenerateBlock(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 64} {
+		header, coinBaseTx, txids := GenerateBlock(t, WithTxCount(n))
+		if len(txids) != n || txids[0] != coinBaseTx.TxHash() {
+			t.Fatalf("GenerateBlock #%d: got %d transactions, coinbase %v, "+
+				"want %d, coinbase %v", n, len(txids), txids[0], n,
+				coinBaseTx.TxHash())
+		}
+		m, err := lightmirror.New(header, coinBaseTx, txids,
+			lightmirror.WithValidation(lightmirror.ValidateFull))
+		if err != nil {
+			t.Fatalf("New #%d error %v", n, err)
+		}
+		err = lightmirror.ValidateChainParallel(context.Background(),
+			[]*lightmirror.BtcLightMirrorV2{m}, Params, 1)
+		if err != nil {
+			t.Errorf("ValidateChainParallel #%d error %v", n, err)
+		}
+	}
+
+	prev := chainhash.Hash{0x01}
+	if header, _, _ := GenerateBlock(t, WithPrevBlock(prev)); header.PrevBlock != prev {
+		t.Errorf("GenerateBlock: got prev block %v, want %v", header.PrevBlock, prev)
+	}
+}
+
+func TestGenerateChain(t *testing.T) {
+	prev := chainhash.Hash{0x01}
+	mirrors := GenerateChain(t, 20, WithPrevBlock(prev))
+	if len(mirrors) != 20 || mirrors[0].BtcHeader.PrevBlock != prev {
+		t.Fatalf("GenerateChain: got %d mirrors, want 20 building on %v",
+			len(mirrors), prev)
+	}
+	err := lightmirror.ValidateChainParallel(context.Background(), mirrors, Params, 1)
+	if err != nil {
+		t.Errorf("ValidateChainParallel error %v", err)
+	}
+
+	header, coinBaseTx, txids := GenerateBlock(t, WithPrevBlock(prev))
+	first := lightmirror.CreateBtcLightMirrorV2(header, coinBaseTx, txids)
+	if !first.Equal(mirrors[0]) {
+		t.Errorf("GenerateChain: first mirror differs from GenerateBlock: %v",
+			first.Diff(mirrors[0]))
+	}
+}
+
+func TestSeed(t *testing.T) {
+	a := serialize(t, GenerateChain(t, 5, WithSeed(7)))
+	if b := serialize(t, GenerateChain(t, 5, WithSeed(7))); !bytes.Equal(a, b) {
+		t.Errorf("GenerateChain: the same seed gave different chains")
+	}
+	if b := serialize(t, GenerateChain(t, 5, WithSeed(8))); bytes.Equal(a, b) {
+		t.Errorf("GenerateChain: different seeds gave the same chain")
+	}
+	if b := serialize(t, GenerateChain(t, 5)); !bytes.Equal(b, serialize(t, GenerateChain(t, 5, WithSeed(1)))) {
+		t.Errorf("GenerateChain: the default seed is not 1")
+	}
+}
+
+func TestWithPowerParams(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	for i, m := range GenerateChain(t, 3, WithPowerParams(candidate, reward)) {
+		gotCandidate, gotReward, _ := m.ParsePowerParams()
+		if gotCandidate != candidate || gotReward != reward {
+			t.Errorf("ParsePowerParams #%d: got %v, %v, want %v, %v", i,
+				gotCandidate, gotReward, candidate, reward)
+		}
+	}
+
+	m := GenerateChain(t, 1)[0]
+	if gotCandidate, gotReward, _ := m.ParsePowerParams(); gotCandidate != (common.Address{}) || gotReward != (common.Address{}) {
+		t.Errorf("ParsePowerParams: got %v, %v without WithPowerParams",
+			gotCandidate, gotReward)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ErrOrphan is returned by Append when the parent of the mirror is unknown
+// and the mirror was added to the orphan pool.
+var ErrOrphan = errors.New("parent block is unknown, block held as an orphan")
+
+// WithOrphanPool makes the chain hold up to size mirrors whose parent is
+// unknown, and append them once their parent is.  Orphans older than maxAge
+// are evicted when the next orphan arrives, and the oldest orphan is evicted
+// to make room in a full pool.  A zero maxAge keeps orphans until the pool
+// is full.  A size of zero, the default, disables the pool.
+func WithOrphanPool(size int, maxAge time.Duration) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.orphanPoolSize = size
+		cfg.orphanMaxAge = maxAge
+	}
+}
+
+type orphan struct {
+	mirror *BtcLightMirrorV2
+	hash   chainhash.Hash
+	added  time.Time
+}
+
+// orphanPool holds the orphans of a chain, indexed by hash and by parent.
+type orphanPool struct {
+	size   int
+	maxAge time.Duration
+	now    func() time.Time
+
+	byHash map[chainhash.Hash]*orphan
+	byPrev map[chainhash.Hash][]*orphan
+}
+
+func newOrphanPool(size int, maxAge time.Duration) orphanPool {
+	return orphanPool{
+		size:   size,
+		maxAge: maxAge,
+		now:    time.Now,
+		byHash: make(map[chainhash.Hash]*orphan),
+		byPrev: make(map[chainhash.Hash][]*orphan),
+	}
+}
+
+func (p *orphanPool) enabled() bool {
+	return p.size > 0
+}
+
+// remove removes o from the pool.
+func (p *orphanPool) remove(o *orphan) {
+	delete(p.byHash, o.hash)
+	prev := o.mirror.BtcHeader.PrevBlock
+	siblings := p.byPrev[prev]
+	for i, sibling := range siblings {
+		if sibling == o {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.byPrev, prev)
+	} else {
+		p.byPrev[prev] = siblings
+	}
+}
+
+// oldest returns the orphan added first, or nil if the pool is empty.
+func (p *orphanPool) oldest() *orphan {
+	var res *orphan
+	for _, o := range p.byHash {
+		if res == nil || o.added.Before(res.added) {
+			res = o
+		}
+	}
+	return res
+}
+
+// OrphanCount returns the number of mirrors held in the orphan pool.
+func (c *MirrorChain) OrphanCount() int {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return len(c.orphans.byHash)
+}
+
+// addOrphan validates m, whose block hash is hash, and adds it to the orphan
+// pool, evicting expired orphans and, if the pool is still full, the oldest
+// one.
+func (c *MirrorChain) addOrphan(m *BtcLightMirrorV2, hash chainhash.Hash) error {
+	p := &c.orphans
+	if _, ok := p.byHash[hash]; ok {
+		return ErrDuplicateBlock
+	}
+	if err := c.checkMirror(m, hash); err != nil {
+		c.cfg.logger.Warnf("rejected orphan %v: %v", hash, err)
+		return err
+	}
+
+	now := p.now()
+	var evicted []ChainEvent
+	evict := func(o *orphan) {
+		p.remove(o)
+		evicted = append(evicted, ChainEvent{Type: OrphanEvicted, Hash: o.hash})
+	}
+	if p.maxAge > 0 {
+		for _, o := range p.byHash {
+			if now.Sub(o.added) > p.maxAge {
+				evict(o)
+			}
+		}
+	}
+	for len(p.byHash) >= p.size {
+		evict(p.oldest())
+	}
+
+	o := &orphan{mirror: m.Clone(), hash: hash, added: now}
+	p.byHash[hash] = o
+	prev := m.BtcHeader.PrevBlock
+	p.byPrev[prev] = append(p.byPrev[prev], o)
+	c.subs.notify(evicted)
+	c.cfg.logger.Debugf("holding orphan %v building on unknown block %v, "+
+		"%d evicted", hash, prev, len(evicted))
+	return ErrOrphan
+}
+
+// adoptOrphans appends the orphans building on the block with the given
+// hash, then the orphans building on those, and so on.  Orphans that fail
+// to append are dropped.  It reports whether any orphan was appended.
+func (c *MirrorChain) adoptOrphans(hash chainhash.Hash) bool {
+	p := &c.orphans
+	adopted := false
+	queue := []chainhash.Hash{hash}
+	for len(queue) > 0 {
+		children := p.byPrev[queue[0]]
+		delete(p.byPrev, queue[0])
+		queue = queue[1:]
+		for _, o := range children {
+			delete(p.byHash, o.hash)
+			if _, err := c.connect(&o.mirror.BtcHeader, o.hash, o.mirror); err != nil {
+				c.cfg.logger.Warnf("dropped orphan %v: %v", o.hash, err)
+				c.subs.notify([]ChainEvent{{Type: OrphanEvicted, Hash: o.hash}})
+				continue
+			}
+			adopted = true
+			c.cfg.logger.Infof("adopted orphan %v at height %d", o.hash,
+				c.index[o.hash].height)
+			c.subs.notify([]ChainEvent{{
+				Type:   OrphanAdopted,
+				Hash:   o.hash,
+				Height: c.index[o.hash].height,
+			}})
+			queue = append(queue, o.hash)
+		}
+	}
+	return adopted
+}
+
+// switchEvent returns the ReorgEvent describing the switch of the best chain
+// from the block from to the current tip, or nil if from is an ancestor of
+// the tip.
+func (c *MirrorChain) switchEvent(from *chainEntry) *ReorgEvent {
+	var detach, attach []*chainEntry
+	a, b := from, c.tip
+	for a.height > b.height {
+		detach = append(detach, a)
+		a = a.parent
+	}
+	for b.height > a.height {
+		attach = append(attach, b)
+		b = b.parent
+	}
+	for a != b {
+		detach = append(detach, a)
+		attach = append(attach, b)
+		a, b = a.parent, b.parent
+	}
+	if len(detach) == 0 {
+		return nil
+	}
+
+	event := &ReorgEvent{ForkHeight: a.height}
+	for _, e := range detach {
+		event.Disconnected = append(event.Disconnected, e.mirrorCopy())
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		event.Connected = append(event.Connected, attach[i].mirrorCopy())
+	}
+	return event
+}
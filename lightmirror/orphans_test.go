@@ -0,0 +1,158 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestOrphanPool(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	c := newTestChain(t, mirrors[:2], WithOrphanPool(10, 0))
+	ch, cancel := c.Subscribe()
+	defer cancel()
+
+	// Deliver the last three mirrors in reverse order.
+	for i := 4; i > 2; i-- {
+		if _, err := c.Append(mirrors[i]); !errors.Is(err, ErrOrphan) {
+			t.Fatalf("Append #%d: got error %v, want %v", i, err, ErrOrphan)
+		}
+		if got, want := c.OrphanCount(), 5-i; got != want {
+			t.Errorf("OrphanCount: got %d, want %d", got, want)
+		}
+	}
+	if _, err := c.Append(mirrors[3]); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("Append duplicate orphan: got error %v, want %v", err,
+			ErrDuplicateBlock)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+1 {
+		t.Errorf("Tip: got height %d before the parent arrives", height)
+	}
+
+	event, err := c.Append(mirrors[2])
+	if err != nil || event != nil {
+		t.Fatalf("Append: got %v, error %v", event, err)
+	}
+	if n := c.OrphanCount(); n != 0 {
+		t.Errorf("OrphanCount: got %d after adoption, want 0", n)
+	}
+	for i, m := range mirrors {
+		hash, err := c.HashAtHeight(testAnchorHeight + int64(i))
+		if err != nil || hash != m.BtcHeader.BlockHash() {
+			t.Errorf("HashAtHeight #%d: got %v, error %v", i, hash, err)
+		}
+	}
+
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash {
+		return m.BtcHeader.BlockHash()
+	}
+	checkEvents(t, "Append", drain(ch), []wantEvent{
+		{BlockConnected, hash(mirrors[2]), testAnchorHeight + 2},
+		{BlockConnected, hash(mirrors[3]), testAnchorHeight + 3},
+		{OrphanAdopted, hash(mirrors[3]), testAnchorHeight + 3},
+		{BlockConnected, hash(mirrors[4]), testAnchorHeight + 4},
+		{OrphanAdopted, hash(mirrors[4]), testAnchorHeight + 4},
+	})
+}
+
+func TestOrphanPoolDisabled(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors[:1])
+	if _, err := c.Append(mirrors[2]); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("Append: got error %v, want %v", err, ErrUnknownParent)
+	}
+	if n := c.OrphanCount(); n != 0 {
+		t.Errorf("OrphanCount: got %d, want 0", n)
+	}
+}
+
+func TestOrphanPoolReorg(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors, WithOrphanPool(10, 0))
+
+	// The branch only takes over once its orphans are adopted.
+	branch := newTestBranch(mirrors[0], 1000, 3)
+	for _, m := range []*BtcLightMirrorV2{branch[2], branch[1]} {
+		if _, err := c.Append(m); !errors.Is(err, ErrOrphan) {
+			t.Fatalf("Append: got error %v, want %v", err, ErrOrphan)
+		}
+	}
+	event, err := c.Append(branch[0])
+	if err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if event == nil || event.ForkHeight != testAnchorHeight ||
+		len(event.Disconnected) != 2 || len(event.Connected) != 3 {
+
+		t.Fatalf("Append: got event %v", event)
+	}
+	for i, m := range event.Disconnected {
+		if want := mirrors[2-i]; m.BtcHeader.BlockHash() != want.BtcHeader.BlockHash() {
+			t.Errorf("Disconnected #%d: got %v, want %v", i,
+				m.BtcHeader.BlockHash(), want.BtcHeader.BlockHash())
+		}
+	}
+	for i, m := range event.Connected {
+		if m.BtcHeader.BlockHash() != branch[i].BtcHeader.BlockHash() {
+			t.Errorf("Connected #%d: got %v, want %v", i,
+				m.BtcHeader.BlockHash(), branch[i].BtcHeader.BlockHash())
+		}
+	}
+}
+
+func TestOrphanPoolEviction(t *testing.T) {
+	mirrors := newTestMirrors(1)
+	c := newTestChain(t, mirrors, WithOrphanPool(2, time.Hour))
+	now := time.Unix(1600000000, 0)
+	c.orphans.now = func() time.Time { return now }
+	ch, cancel := c.Subscribe()
+	defer cancel()
+
+	// Orphans of distinct unknown parents.
+	orphans := make([]*BtcLightMirrorV2, 4)
+	for i := range orphans {
+		orphans[i] = newTestMirror(chainhash.Hash{byte(i + 1)}, uint32(1000+i), 1)
+	}
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash {
+		return m.BtcHeader.BlockHash()
+	}
+
+	tests := []struct {
+		advance time.Duration
+		want    []wantEvent
+		count   int
+	}{
+		{0, nil, 1},
+		{time.Minute, nil, 2},
+		// The pool is full: the oldest orphan makes room.
+		{time.Minute, []wantEvent{{OrphanEvicted, hash(orphans[0]), 0}}, 2},
+		// The second orphan expires.
+		{time.Hour, []wantEvent{{OrphanEvicted, hash(orphans[1]), 0}}, 2},
+	}
+	for i, test := range tests {
+		now = now.Add(test.advance)
+		if _, err := c.Append(orphans[i]); !errors.Is(err, ErrOrphan) {
+			t.Fatalf("Append #%d: got error %v, want %v", i, err, ErrOrphan)
+		}
+		checkEvents(t, "Append", drain(ch), test.want)
+		if n := c.OrphanCount(); n != test.count {
+			t.Errorf("OrphanCount #%d: got %d, want %d", i, n, test.count)
+		}
+	}
+
+	// Invalid mirrors are not pooled.
+	bad := newTestMirror(chainhash.Hash{0xff}, 2000, 1)
+	bad.CoinBaseTx.LockTime++
+	if _, err := c.Append(bad); err == nil || errors.Is(err, ErrOrphan) {
+		t.Errorf("Append invalid orphan: got error %v", err)
+	}
+	if n := c.OrphanCount(); n != 2 {
+		t.Errorf("OrphanCount: got %d, want 2", n)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package p2p provides a lightmirror.Fetcher reading block data from a
+// Bitcoin node over the peer-to-peer protocol, so that mirrors can be built
+// without a local bitcoind.
+//
+// The fetcher syncs the headers of the best chain of its node with
+// getheaders, then downloads the blocks with getdata.  A mirror only needs
+// the header, the coinbase and its merkle branch, so from the nodes serving
+// BIP 37 filtered blocks the fetcher asks for the merkle block of a filter
+// matching the coinbase alone, which carries the branch, and the coinbase.
+// From the other nodes it downloads full blocks.
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// defaultTimeout is the default time an exchange with the node may take.
+const defaultTimeout = time.Minute
+
+// Config configures a Fetcher.
+type Config struct {
+	// Address is the host and port of the node.  The default port of the
+	// network is used when it has none.
+	Address string
+
+	// Params are the parameters of the network of the node.  They
+	// default to chaincfg.MainNetParams.
+	Params *chaincfg.Params
+
+	// AnchorHash and AnchorHeight are the block the header sync starts
+	// from, the genesis block of Params when AnchorHash is zero.  The
+	// fetcher only knows the heights above the anchor, so an anchor
+	// close to the tip saves the sync of the whole chain.
+	AnchorHash   chainhash.Hash
+	AnchorHeight int64
+
+	// FullBlocks makes the fetcher download full blocks even from the
+	// nodes serving filtered blocks.
+	FullBlocks bool
+
+	// Timeout bounds every exchange with the node.  It defaults to one
+	// minute.
+	Timeout time.Duration
+
+	// MirrorOptions are passed to lightmirror.New for every mirror built
+	// from a full block, and to lightmirror.NewFromMerkleBlock for those
+	// built from a filtered block.
+	MirrorOptions []lightmirror.MirrorOption
+}
+
+// Fetcher is a lightmirror.Fetcher reading blocks from a Bitcoin node over
+// the peer-to-peer protocol.
+//
+// The heights are those of the headers the fetcher synced, which it syncs
+// again whenever a height above its tip is asked for; the fetcher trusts
+// the node for the best chain, checking only that the headers connect and
+// carry their proof of work.  Blocks the node does not have, or heights
+// above its tip, are reported as lightmirror.ErrNotFound.
+//
+// The mirrors of filtered blocks hold the coinbase without its witness,
+// which filtered blocks do not carry.  Their hashes and merkle branches are
+// those of the mirrors of full blocks.
+//
+// The fetcher holds a single connection to the node, connected on first use
+// and again after a failure, and runs one exchange at a time.  It is a
+// lightmirror.HealthChecker.
+type Fetcher struct {
+	cfg Config
+
+	// mtx serializes the exchanges and guards conn and the header chain:
+	// hashes holds the hashes of the best chain from the anchor on.
+	mtx     sync.Mutex
+	conn    *peerConn
+	hashes  []chainhash.Hash
+	heights map[chainhash.Hash]int64
+
+	healthMtx sync.Mutex
+	lastBlock time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+var (
+	_ lightmirror.Fetcher       = (*Fetcher)(nil)
+	_ lightmirror.HealthChecker = (*Fetcher)(nil)
+)
+
+// NewFetcher returns a fetcher of the blocks of the node of cfg.  It
+// connects on first use.
+func NewFetcher(cfg Config) (*Fetcher, error) {
+	if cfg.Params == nil {
+		cfg.Params = &chaincfg.MainNetParams
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		cfg.Address = net.JoinHostPort(cfg.Address, cfg.Params.DefaultPort)
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, fmt.Errorf("peer address %q: %w", cfg.Address, err)
+		}
+	}
+	if cfg.AnchorHash == (chainhash.Hash{}) {
+		cfg.AnchorHash, cfg.AnchorHeight = *cfg.Params.GenesisHash, 0
+	}
+	if cfg.AnchorHeight < 0 {
+		return nil, fmt.Errorf("negative anchor height %d", cfg.AnchorHeight)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return &Fetcher{
+		cfg:       cfg,
+		hashes:    []chainhash.Hash{cfg.AnchorHash},
+		heights:   map[chainhash.Hash]int64{cfg.AnchorHash: cfg.AnchorHeight},
+		lastBlock: time.Now(),
+	}, nil
+}
+
+// FetchByHash returns the mirror of the block with the given hash.
+func (f *Fetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	m, err := f.fetch(ctx, hash)
+	f.record(err)
+	return m, err
+}
+
+// FetchByHeight returns the mirror of the block at the given height on the
+// best chain of the node.
+func (f *Fetcher) FetchByHeight(ctx context.Context, height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if height < f.cfg.AnchorHeight {
+		return nil, fmt.Errorf("block at height %d below the anchor at height "+
+			"%d: %w", height, f.cfg.AnchorHeight, lightmirror.ErrNotFound)
+	}
+	if height > f.tipHeight() {
+		if err := f.syncHeaders(ctx); err != nil {
+			f.record(err)
+			return nil, err
+		}
+		if height > f.tipHeight() {
+			return nil, fmt.Errorf("block at height %d: %w", height, lightmirror.ErrNotFound)
+		}
+	}
+	m, err := f.fetch(ctx, f.hashes[height-f.cfg.AnchorHeight])
+	f.record(err)
+	return m, err
+}
+
+// Tip returns the hash and the height of the tip of the headers the fetcher
+// synced.
+func (f *Fetcher) Tip() (chainhash.Hash, int64) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.hashes[len(f.hashes)-1], f.tipHeight()
+}
+
+func (f *Fetcher) tipHeight() int64 {
+	return f.cfg.AnchorHeight + int64(len(f.hashes)) - 1
+}
+
+// Ping pings the node, connecting to it if needed.
+func (f *Fetcher) Ping(ctx context.Context) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.exchange(ctx, (*peerConn).ping)
+}
+
+// LastBlockAge returns the time elapsed since the fetcher last fetched a
+// block, or since it was created if it fetched none.
+func (f *Fetcher) LastBlockAge() time.Duration {
+	f.healthMtx.Lock()
+	defer f.healthMtx.Unlock()
+	return time.Since(f.lastBlock)
+}
+
+// LastError returns the last error of a fetch and when.
+func (f *Fetcher) LastError() (error, time.Time) {
+	f.healthMtx.Lock()
+	defer f.healthMtx.Unlock()
+	return f.lastErr, f.lastErrAt
+}
+
+// record records the outcome of a fetch for the health of the fetcher.  A
+// block the node does not have is no failure.
+func (f *Fetcher) record(err error) {
+	if errors.Is(err, lightmirror.ErrNotFound) {
+		return
+	}
+	now := time.Now()
+	f.healthMtx.Lock()
+	defer f.healthMtx.Unlock()
+	if err != nil {
+		f.lastErr, f.lastErrAt = err, now
+		return
+	}
+	f.lastBlock = now
+}
+
+// Close closes the connection to the node, if any.  The fetcher connects
+// again on its next use.
+func (f *Fetcher) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.close()
+	f.conn = nil
+	return err
+}
+
+// exchange runs fn on the connection to the node, connecting first if
+// needed.  A connection on which fn fails is closed, unless the block asked
+// for was not found; fn is retried once on a new connection when the one it
+// failed on was made by an earlier exchange, which the node may have
+// dropped while it was idle.
+func (f *Fetcher) exchange(ctx context.Context, fn func(c *peerConn) error) error {
+	for reused := f.conn != nil; ; reused = false {
+		if f.conn == nil {
+			c, err := dialPeer(ctx, f.cfg.Address, f.cfg.Params, !f.cfg.FullBlocks, f.cfg.Timeout)
+			if err != nil {
+				return err
+			}
+			f.conn = c
+		}
+		c := f.conn
+		err := c.do(ctx, f.cfg.Timeout, func() error { return fn(c) })
+		if err == nil || errors.Is(err, lightmirror.ErrNotFound) {
+			return err
+		}
+		c.close()
+		f.conn = nil
+		if !reused || ctx.Err() != nil {
+			return fmt.Errorf("peer %s: %w", f.cfg.Address, err)
+		}
+	}
+}
+
+// locator returns a block locator of the header chain: the ten last hashes,
+// then hashes twice as far apart at every step, and the anchor.
+func (f *Fetcher) locator() []*chainhash.Hash {
+	var locator []*chainhash.Hash
+	step := 1
+	for i := len(f.hashes) - 1; i > 0; i -= step {
+		locator = append(locator, &f.hashes[i])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, &f.hashes[0])
+}
+
+// syncHeaders extends the header chain with the headers of the best chain
+// of the node, until the node sends a partial batch.
+func (f *Fetcher) syncHeaders(ctx context.Context) error {
+	for {
+		var headers []*wire.BlockHeader
+		err := f.exchange(ctx, func(c *peerConn) error {
+			msg := wire.NewMsgGetHeaders()
+			msg.ProtocolVersion = c.pver
+			for _, hash := range f.locator() {
+				if err := msg.AddBlockLocatorHash(hash); err != nil {
+					return err
+				}
+			}
+			if err := c.write(msg); err != nil {
+				return err
+			}
+			for {
+				msg, err := c.read()
+				if err != nil {
+					return err
+				}
+				if msg, ok := msg.(*wire.MsgHeaders); ok {
+					headers = msg.Headers
+					return nil
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := f.connectHeaders(headers); err != nil {
+			return fmt.Errorf("peer %s: %w", f.cfg.Address, err)
+		}
+		if len(headers) < wire.MaxBlockHeadersPerMsg {
+			return nil
+		}
+	}
+}
+
+// connectHeaders makes headers the best chain from the block they build on,
+// which must be in the header chain.
+func (f *Fetcher) connectHeaders(headers []*wire.BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	prev := headers[0].PrevBlock
+	height, ok := f.heights[prev]
+	if !ok {
+		return fmt.Errorf("headers build on unknown block %v", prev)
+	}
+	hashes := make([]chainhash.Hash, len(headers))
+	for i, header := range headers {
+		if header.PrevBlock != prev {
+			return fmt.Errorf("header %d does not connect to the previous one", i)
+		}
+		hash := header.BlockHash()
+		if err := checkProofOfWork(header, hash, f.cfg.Params.PowLimit); err != nil {
+			return fmt.Errorf("header %v: %w", hash, err)
+		}
+		hashes[i], prev = hash, hash
+	}
+
+	top := height - f.cfg.AnchorHeight + 1
+	for _, hash := range f.hashes[top:] {
+		delete(f.heights, hash)
+	}
+	f.hashes = append(f.hashes[:top], hashes...)
+	for i, hash := range hashes {
+		f.heights[hash] = height + 1 + int64(i)
+	}
+	return nil
+}
+
+// checkProofOfWork checks the hash of header is below the target of its
+// bits, which must not exceed powLimit.
+func checkProofOfWork(header *wire.BlockHeader, hash chainhash.Hash, powLimit *big.Int) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("target of bits %08x out of range", header.Bits)
+	}
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("hash above the target of bits %08x", header.Bits)
+	}
+	return nil
+}
+
+// fetch returns the mirror of the block with the given hash, from the
+// filtered block when the node serves them.
+func (f *Fetcher) fetch(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	var m *lightmirror.BtcLightMirrorV2
+	err := f.exchange(ctx, func(c *peerConn) error {
+		var err error
+		if c.filtered {
+			m, err = fetchFiltered(c, hash, f.cfg.MirrorOptions)
+		} else {
+			m, err = fetchBlock(c, hash, f.cfg.MirrorOptions)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fetchFiltered returns the mirror of the filtered block with the given
+// hash, built with opts.
+func fetchFiltered(c *peerConn, hash chainhash.Hash, opts []lightmirror.MirrorOption) (*lightmirror.BtcLightMirrorV2, error) {
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeFilteredBlock, &hash))
+	nonce, err := c.fence(getData)
+	if err != nil {
+		return nil, err
+	}
+
+	var mb *wire.MsgMerkleBlock
+	var coinbase *wire.MsgTx
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgMerkleBlock:
+			if msg.Header.BlockHash() == hash {
+				mb, coinbase = msg, nil
+			}
+		case *wire.MsgTx:
+			// The node sends the transactions the filter matched
+			// right after the merkle block, the coinbase first.
+			if mb != nil && coinbase == nil && blockchain.IsCoinBaseTx(msg) {
+				coinbase = msg
+			}
+		case *wire.MsgPong:
+			if msg.Nonce != nonce {
+				continue
+			}
+			if mb == nil {
+				return nil, fmt.Errorf("block %v: %w", hash, lightmirror.ErrNotFound)
+			}
+			if coinbase == nil {
+				return nil, fmt.Errorf("block %v: coinbase not sent", hash)
+			}
+			m, err := lightmirror.NewFromMerkleBlock(mb, coinbase, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("block %v: %w", hash, err)
+			}
+			return m, nil
+		}
+	}
+}
+
+// fetchBlock returns the mirror of the full block with the given hash,
+// built with opts.
+func fetchBlock(c *peerConn, hash chainhash.Hash, opts []lightmirror.MirrorOption) (*lightmirror.BtcLightMirrorV2, error) {
+	invType := wire.InvTypeBlock
+	if c.services&wire.SFNodeWitness != 0 {
+		invType = wire.InvTypeWitnessBlock
+	}
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(invType, &hash))
+	nonce, err := c.fence(getData)
+	if err != nil {
+		return nil, err
+	}
+
+	var block *wire.MsgBlock
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgBlock:
+			if msg.BlockHash() == hash {
+				block = msg
+			}
+		case *wire.MsgPong:
+			if msg.Nonce != nonce {
+				continue
+			}
+			if block == nil {
+				return nil, fmt.Errorf("block %v: %w", hash, lightmirror.ErrNotFound)
+			}
+			if len(block.Transactions) == 0 {
+				return nil, fmt.Errorf("block %v has no transactions", hash)
+			}
+			txids := make([]chainhash.Hash, len(block.Transactions))
+			for i, tx := range block.Transactions {
+				txids[i] = tx.TxHash()
+			}
+			m, err := lightmirror.New(&block.Header, block.Transactions[0], txids, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("block %v: %w", hash, err)
+			}
+			return m, nil
+		}
+	}
+}
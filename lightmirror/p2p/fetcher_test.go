@@ -0,0 +1,481 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// testBlock returns a regtest block building on prev, solved, with a
+// coinbase made unique by seed and carrying a witness, and n more
+// transactions.
+func testBlock(prev *wire.BlockHeader, seed uint32, n int) *wire.MsgBlock {
+	block := &wire.MsgBlock{Header: wire.BlockHeader{
+		Version:   1,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Timestamp.Add(10 * time.Minute),
+		Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+	}}
+	for i := 0; i <= n; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{0x04, byte(seed), byte(seed >> 8), byte(i), byte(i >> 8)},
+			Sequence:         0xffffffff,
+		})
+		if i > 0 {
+			tx.TxIn[0].PreviousOutPoint = wire.OutPoint{Hash: chainhash.Hash{byte(seed), byte(i)}}
+		} else {
+			tx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+		}
+		tx.AddTxOut(&wire.TxOut{Value: 5000000000, PkScript: []byte{0x51}})
+		block.AddTransaction(tx)
+	}
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	merkles := lightmirror.BuildMerkleTreeStore(&txids[0], txids[1:])
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	target := blockchain.CompactToBig(block.Header.Bits)
+	for {
+		hash := block.Header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return block
+		}
+		block.Header.Nonce++
+	}
+}
+
+// testChain returns blocks building on the block of prev, block i holding
+// i%7 transactions besides the coinbase.
+func testChain(prev *wire.BlockHeader, seed uint32, n int) []*wire.MsgBlock {
+	blocks := make([]*wire.MsgBlock, n)
+	for i := range blocks {
+		blocks[i] = testBlock(prev, seed+uint32(i), i%7)
+		prev = &blocks[i].Header
+	}
+	return blocks
+}
+
+// node is a fake Bitcoin node of the regression test network serving the
+// blocks of its best chain.
+type node struct {
+	t        *testing.T
+	ln       net.Listener
+	services wire.ServiceFlag
+	version  int32
+
+	mtx    sync.Mutex
+	best   []*wire.MsgBlock
+	byHash map[chainhash.Hash]*wire.MsgBlock
+	conns  []net.Conn
+	dials  int
+}
+
+// newNode returns a node of a best chain of n blocks above the genesis
+// block, serving filtered blocks, and a fetcher of it.
+func newNode(t *testing.T, n int, cfg Config) (*node, *Fetcher) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := &node{
+		t:        t,
+		ln:       ln,
+		services: wire.SFNodeNetwork | wire.SFNodeWitness | wire.SFNodeBloom,
+		version:  int32(wire.ProtocolVersion),
+		byHash:   make(map[chainhash.Hash]*wire.MsgBlock),
+	}
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	nd.setBest(append([]*wire.MsgBlock{genesis}, testChain(&genesis.Header, 0, n)...))
+	go nd.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		nd.drop()
+	})
+
+	cfg.Address = ln.Addr().String()
+	cfg.Params = &chaincfg.RegressionNetParams
+	cfg.Timeout = 5 * time.Second
+	f, err := NewFetcher(cfg)
+	if err != nil {
+		t.Fatalf("NewFetcher error %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return nd, f
+}
+
+// setBest makes best the best chain of the node, from the genesis block on.
+func (n *node) setBest(best []*wire.MsgBlock) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.best = best
+	for _, b := range best {
+		n.byHash[b.BlockHash()] = b
+	}
+}
+
+// announce sets the services and the protocol version the node announces.
+func (n *node) announce(services wire.ServiceFlag, version int32) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.services, n.version = services, version
+}
+
+// dialCount returns the number of connections the node accepted.
+func (n *node) dialCount() int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.dials
+}
+
+// drop closes the connections of the node.
+func (n *node) drop() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.conns = nil
+}
+
+func (n *node) accept() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		n.mtx.Lock()
+		n.conns = append(n.conns, conn)
+		n.dials++
+		n.mtx.Unlock()
+		go n.serve(conn)
+	}
+}
+
+func (n *node) write(conn net.Conn, msg wire.Message) {
+	wire.WriteMessageWithEncodingN(conn, msg, wire.ProtocolVersion,
+		chaincfg.RegressionNetParams.Net, wire.WitnessEncoding)
+}
+
+func (n *node) serve(conn net.Conn) {
+	defer conn.Close()
+	var filter *bloom.Filter
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(conn, wire.ProtocolVersion,
+			chaincfg.RegressionNetParams.Net, wire.WitnessEncoding)
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			n.mtx.Lock()
+			services, pver := n.services, n.version
+			n.mtx.Unlock()
+			addr := wire.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 18444, services)
+			version := wire.NewMsgVersion(addr, addr, 1, 0)
+			version.ProtocolVersion = pver
+			version.Services = services
+			n.write(conn, version)
+			n.write(conn, wire.NewMsgVerAck())
+			// Unsolicited messages are ignored by the fetcher.
+			n.write(conn, wire.NewMsgSendHeaders())
+			n.write(conn, wire.NewMsgPing(7))
+		case *wire.MsgGetHeaders:
+			n.write(conn, n.headers(msg.BlockLocatorHashes))
+		case *wire.MsgFilterLoad:
+			filter = bloom.LoadFilter(msg)
+		case *wire.MsgGetData:
+			for _, inv := range msg.InvList {
+				n.mtx.Lock()
+				b, ok := n.byHash[inv.Hash]
+				n.mtx.Unlock()
+				if !ok {
+					continue
+				}
+				switch {
+				case inv.Type == wire.InvTypeFilteredBlock && filter != nil:
+					mb, matched := bloom.NewMerkleBlock(btcutil.NewBlock(b), filter)
+					n.write(conn, mb)
+					for _, i := range matched {
+						tx := b.Transactions[i].Copy()
+						// Filtered blocks carry the transactions
+						// without their witness.
+						for _, in := range tx.TxIn {
+							in.Witness = nil
+						}
+						n.write(conn, tx)
+					}
+				case inv.Type == wire.InvTypeWitnessBlock || inv.Type == wire.InvTypeBlock:
+					n.write(conn, b)
+				}
+			}
+		case *wire.MsgPing:
+			n.write(conn, wire.NewMsgPong(msg.Nonce))
+		}
+	}
+}
+
+// headers returns the headers of the best chain after the first block of
+// the locator it has.
+func (n *node) headers(locator []*chainhash.Hash) *wire.MsgHeaders {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	start := 0
+search:
+	for _, hash := range locator {
+		for i, b := range n.best {
+			if b.BlockHash() == *hash {
+				start = i + 1
+				break search
+			}
+		}
+	}
+	msg := wire.NewMsgHeaders()
+	for i := start; i < len(n.best) && len(msg.Headers) < wire.MaxBlockHeadersPerMsg; i++ {
+		msg.AddBlockHeader(&n.best[i].Header)
+	}
+	return msg
+}
+
+// fullMirror returns the mirror New builds from the full block b.
+func fullMirror(t *testing.T, b *wire.MsgBlock) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	txids := make([]chainhash.Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	m, err := lightmirror.New(&b.Header, b.Transactions[0], txids)
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+	return m
+}
+
+func TestFetcherFiltered(t *testing.T) {
+	nd, f := newNode(t, 9, Config{})
+	ctx := context.Background()
+	for height, b := range nd.best {
+		m, err := f.FetchByHeight(ctx, int64(height))
+		if err != nil {
+			t.Fatalf("FetchByHeight #%d error %v", height, err)
+		}
+		want := fullMirror(t, b)
+		if m.BtcHeader != want.BtcHeader || m.CoinBaseTx.TxHash() != want.CoinBaseTx.TxHash() ||
+			len(m.MerkleNodes) != len(want.MerkleNodes) {
+			t.Errorf("FetchByHeight #%d: got %v, want %v", height, m, want)
+			continue
+		}
+		for i := range m.MerkleNodes {
+			if m.MerkleNodes[i] != want.MerkleNodes[i] {
+				t.Errorf("FetchByHeight #%d: got merkle node %d %v, want %v", height, i,
+					m.MerkleNodes[i], want.MerkleNodes[i])
+			}
+		}
+		if m.CoinBaseTx.HasWitness() {
+			t.Errorf("FetchByHeight #%d: got a coinbase witness from a filtered block", height)
+		}
+	}
+	if hash, height := f.Tip(); height != 9 || hash != nd.best[9].BlockHash() {
+		t.Errorf("Tip: got %v at height %d", hash, height)
+	}
+
+	if _, err := f.FetchByHeight(ctx, 10); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHeight above the tip: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if _, err := f.FetchByHash(ctx, chainhash.Hash{1}); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHash of an unknown block: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if _, err := f.FetchByHeight(ctx, -1); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHeight below the anchor: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if err, _ := f.LastError(); err != nil {
+		t.Errorf("LastError: got %v after missing blocks", err)
+	}
+	if err := f.Ping(ctx); err != nil {
+		t.Errorf("Ping error %v", err)
+	}
+	if age := f.LastBlockAge(); age > time.Minute {
+		t.Errorf("LastBlockAge: got %v", age)
+	}
+	if n := nd.dialCount(); n != 1 {
+		t.Errorf("node dialed %d times, want once", n)
+	}
+}
+
+func TestFetcherFullBlocks(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cfg      Config
+		services wire.ServiceFlag
+	}{
+		{"FullBlocks", Config{FullBlocks: true}, wire.SFNodeNetwork | wire.SFNodeWitness | wire.SFNodeBloom},
+		{"no bloom", Config{}, wire.SFNodeNetwork | wire.SFNodeWitness},
+	} {
+		nd, f := newNode(t, 3, test.cfg)
+		nd.announce(test.services, int32(wire.ProtocolVersion))
+		for height, b := range nd.best {
+			m, err := f.FetchByHeight(context.Background(), int64(height))
+			if err != nil {
+				t.Fatalf("FetchByHeight (%s) #%d error %v", test.name, height, err)
+			}
+			if want := fullMirror(t, b); !m.Equal(want) || m.CoinBaseTx.HasWitness() != want.CoinBaseTx.HasWitness() {
+				t.Errorf("FetchByHeight (%s) #%d: got %v, want %v", test.name, height, m, want)
+			}
+		}
+	}
+}
+
+func TestFetcherReorg(t *testing.T) {
+	nd, f := newNode(t, 4, Config{})
+	ctx := context.Background()
+	if _, err := f.FetchByHeight(ctx, 4); err != nil {
+		t.Fatalf("FetchByHeight error %v", err)
+	}
+
+	// A height above the tip syncs the headers of the new best chain.
+	disconnected := nd.best[4].BlockHash()
+	fork := append(append([]*wire.MsgBlock{}, nd.best[:3]...), testChain(&nd.best[2].Header, 100, 3)...)
+	nd.setBest(fork)
+	m, err := f.FetchByHeight(ctx, 5)
+	if err != nil || m.BtcHeader.BlockHash() != fork[5].BlockHash() {
+		t.Fatalf("FetchByHeight after the reorg: got %v, error %v", m, err)
+	}
+	for height := 3; height <= 5; height++ {
+		if m, err := f.FetchByHeight(ctx, int64(height)); err != nil || m.BtcHeader.BlockHash() != fork[height].BlockHash() {
+			t.Errorf("FetchByHeight #%d after the reorg: got %v, error %v", height, m, err)
+		}
+	}
+	if _, ok := f.heights[disconnected]; ok {
+		t.Errorf("header chain: disconnected block still has a height")
+	}
+}
+
+func TestFetcherReconnect(t *testing.T) {
+	nd, f := newNode(t, 2, Config{})
+	ctx := context.Background()
+	if _, err := f.FetchByHeight(ctx, 1); err != nil {
+		t.Fatalf("FetchByHeight error %v", err)
+	}
+	// The connection the node dropped while the fetcher was idle is
+	// replaced transparently.
+	nd.drop()
+	if _, err := f.FetchByHeight(ctx, 2); err != nil {
+		t.Fatalf("FetchByHeight after a drop error %v", err)
+	}
+	if n := nd.dialCount(); n != 2 {
+		t.Errorf("node dialed %d times, want twice", n)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := f.FetchByHeight(cancelled, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("FetchByHeight with a cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	if err, _ := f.LastError(); !errors.Is(err, context.Canceled) {
+		t.Errorf("LastError: got %v, want %v", err, context.Canceled)
+	}
+	if _, err := f.FetchByHeight(ctx, 1); err != nil {
+		t.Errorf("FetchByHeight after a cancelled fetch error %v", err)
+	}
+}
+
+func TestFetcherHeaders(t *testing.T) {
+	nd, _ := newNode(t, wire.MaxBlockHeadersPerMsg+60, Config{})
+	f, err := NewFetcher(Config{
+		Address:      nd.ln.Addr().String(),
+		Params:       &chaincfg.RegressionNetParams,
+		AnchorHash:   nd.best[50].BlockHash(),
+		AnchorHeight: 50,
+	})
+	if err != nil {
+		t.Fatalf("NewFetcher error %v", err)
+	}
+	defer f.Close()
+	ctx := context.Background()
+	tip := int64(len(nd.best) - 1)
+	if m, err := f.FetchByHeight(ctx, tip); err != nil || m.BtcHeader.BlockHash() != nd.best[tip].BlockHash() {
+		t.Fatalf("FetchByHeight: got %v, error %v", m, err)
+	}
+	if _, height := f.Tip(); height != tip {
+		t.Errorf("Tip: got height %d, want %d", height, tip)
+	}
+	if _, err := f.FetchByHeight(ctx, 49); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("FetchByHeight below the anchor: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if locator := f.locator(); len(locator) > 30 || *locator[len(locator)-1] != nd.best[50].BlockHash() ||
+		*locator[0] != nd.best[tip].BlockHash() {
+		t.Errorf("locator: got %d hashes", len(locator))
+	}
+
+	headers := []*wire.BlockHeader{&nd.best[1].Header}
+	if err := f.connectHeaders(headers); err == nil {
+		t.Errorf("connectHeaders below the anchor: expected error")
+	}
+	next := testBlock(&nd.best[tip].Header, 1000, 0)
+	unsolved := next.Header
+	for {
+		hash := unsolved.BlockHash()
+		if checkProofOfWork(&unsolved, hash, chaincfg.RegressionNetParams.PowLimit) != nil {
+			break
+		}
+		unsolved.Nonce++
+	}
+	if err := f.connectHeaders([]*wire.BlockHeader{&unsolved}); err == nil {
+		t.Errorf("connectHeaders of an unsolved header: expected error")
+	}
+	gap := testBlock(&next.Header, 1001, 0)
+	if err := f.connectHeaders([]*wire.BlockHeader{&next.Header, &next.Header, &gap.Header}); err == nil {
+		t.Errorf("connectHeaders of headers which do not connect: expected error")
+	}
+	if _, height := f.Tip(); height != tip {
+		t.Errorf("Tip after invalid headers: got height %d, want %d", height, tip)
+	}
+}
+
+func TestFetcherErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		services wire.ServiceFlag
+		version  int32
+	}{
+		{"no blocks", wire.SFNodeWitness, int32(wire.ProtocolVersion)},
+		{"old version", wire.SFNodeNetwork, int32(wire.BIP0037Version)},
+	} {
+		nd, f := newNode(t, 1, Config{})
+		nd.announce(test.services, test.version)
+		if err := f.Ping(context.Background()); err == nil {
+			t.Errorf("Ping (%s): expected error", test.name)
+		}
+	}
+
+	for _, cfg := range []Config{
+		{Address: "[::1"},
+		{Address: "localhost", AnchorHash: chainhash.Hash{1}, AnchorHeight: -1},
+	} {
+		if _, err := NewFetcher(cfg); err == nil {
+			t.Errorf("NewFetcher (%+v): expected error", cfg)
+		}
+	}
+	f, err := NewFetcher(Config{Address: "localhost", Params: &chaincfg.TestNet3Params})
+	if err != nil || f.cfg.Address != "localhost:18333" {
+		t.Errorf("NewFetcher without a port: got address %q, error %v", f.cfg.Address, err)
+	}
+}
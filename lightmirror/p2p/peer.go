@@ -0,0 +1,262 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// userAgentName and userAgentVersion are appended to the user agent
+	// the fetcher announces.
+	userAgentName    = "lightmirror"
+	userAgentVersion = "0.1.0"
+
+	// minPeerVersion is the lowest protocol version of the peers the
+	// fetcher talks to, the one of the nodes announcing new blocks with
+	// headers.
+	minPeerVersion = wire.SendHeadersVersion
+
+	// coinbaseFilterFPRate is the false positive rate of the bloom filter
+	// matching the coinbase, which sets how many transactions besides
+	// the coinbase a filtered block carries.
+	coinbaseFilterFPRate = 0.000001
+)
+
+// peerConn is a connection to a Bitcoin node, used for one exchange at a
+// time.
+type peerConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	params *chaincfg.Params
+
+	// pver and services are the negotiated protocol version and the
+	// services of the node.
+	pver     uint32
+	services wire.ServiceFlag
+
+	// filtered is set once the node was sent the filter of the coinbase,
+	// so that it serves filtered blocks.
+	filtered bool
+}
+
+// dialPeer connects to the node at address and completes the version
+// handshake within timeout.  When filtered is set and the node serves
+// filtered blocks, the filter of the coinbase is loaded.
+func dialPeer(ctx context.Context, address string, params *chaincfg.Params, filtered bool, timeout time.Duration) (*peerConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &peerConn{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		params: params,
+		pver:   wire.ProtocolVersion,
+	}
+	err = c.do(ctx, timeout, func() error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		if filtered && c.services&wire.SFNodeBloom != 0 {
+			filter := bloom.NewFilter(1, 0, coinbaseFilterFPRate, wire.BloomUpdateNone)
+			filter.AddOutPoint(&wire.OutPoint{Index: math.MaxUint32})
+			if err := c.write(filter.MsgFilterLoad()); err != nil {
+				return err
+			}
+			c.filtered = true
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s: %w", address, err)
+	}
+	return c, nil
+}
+
+// handshake exchanges the version and verack messages with the node.
+func (c *peerConn) handshake() error {
+	addr, err := netAddress(c.conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	local, err := netAddress(c.conn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return err
+	}
+	version := wire.NewMsgVersion(local, addr, nonce, 0)
+	version.Services = 0
+	version.DisableRelayTx = true
+	if err := version.AddUserAgent(userAgentName, userAgentVersion); err != nil {
+		return err
+	}
+	if err := c.write(version); err != nil {
+		return err
+	}
+
+	var gotVersion, gotVerAck bool
+	for !gotVersion || !gotVerAck {
+		msg, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			if gotVersion {
+				return errors.New("duplicate version message")
+			}
+			gotVersion = true
+			if msg.Nonce == nonce {
+				return errors.New("connected to self")
+			}
+			if msg.ProtocolVersion < int32(minPeerVersion) {
+				return fmt.Errorf("protocol version %d is older than %d",
+					msg.ProtocolVersion, minPeerVersion)
+			}
+			if msg.Services&(wire.SFNodeNetwork|wire.SFNodeNetworkLimited) == 0 {
+				return fmt.Errorf("node does not serve blocks (services %v)", msg.Services)
+			}
+			if uint32(msg.ProtocolVersion) < c.pver {
+				c.pver = uint32(msg.ProtocolVersion)
+			}
+			c.services = msg.Services
+			if err := c.write(wire.NewMsgVerAck()); err != nil {
+				return err
+			}
+		case *wire.MsgVerAck:
+			if !gotVersion {
+				return errors.New("verack before version")
+			}
+			gotVerAck = true
+		}
+	}
+	return nil
+}
+
+// netAddress returns the wire address of a TCP address.
+func netAddress(addr net.Addr) (*wire.NetAddress, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewNetAddressIPPort(net.ParseIP(host), uint16(port), 0), nil
+}
+
+// aLongTimeAgo is the deadline which interrupts the exchange in progress.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// do runs the exchange fn with the node, interrupting it once timeout
+// elapsed or ctx is done.  The connection is left in an unknown state by an
+// exchange which failed on a read or a write.
+func (c *peerConn) do(ctx context.Context, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	err := fn()
+	close(done)
+	<-exited
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// write sends msg to the node.
+func (c *peerConn) write(msg wire.Message) error {
+	_, err := wire.WriteMessageWithEncodingN(c.conn, msg, c.pver, c.params.Net, wire.WitnessEncoding)
+	return err
+}
+
+// read returns the next message of the node, answering its pings and
+// skipping the messages of unknown commands.
+func (c *peerConn) read() (wire.Message, error) {
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(c.r, c.pver, c.params.Net, wire.WitnessEncoding)
+		if errors.Is(err, wire.ErrUnknownMessage) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ping, ok := msg.(*wire.MsgPing); ok {
+			if err := c.write(wire.NewMsgPong(ping.Nonce)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// fence sends msg followed by a ping and returns its nonce.  Bitcoin Core
+// answers the requests of a peer in order, so the pong tells the answers to
+// msg were all received, and that a block the node does not have was not
+// sent.
+func (c *peerConn) fence(msg wire.Message) (uint64, error) {
+	if err := c.write(msg); err != nil {
+		return 0, err
+	}
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return 0, err
+	}
+	return nonce, c.write(wire.NewMsgPing(nonce))
+}
+
+// ping sends a ping to the node and waits for its pong.
+func (c *peerConn) ping() error {
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return err
+	}
+	if err := c.write(wire.NewMsgPing(nonce)); err != nil {
+		return err
+	}
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return err
+		}
+		if pong, ok := msg.(*wire.MsgPong); ok && pong.Nonce == nonce {
+			return nil
+		}
+	}
+}
+
+func (c *peerConn) close() error {
+	return c.conn.Close()
+}
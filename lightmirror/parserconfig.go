@@ -0,0 +1,101 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PayloadLayout sets how the bytes following the magic tag of a power
+// payload are read.
+type PayloadLayout int
+
+const (
+	// LayoutVersioned reads a version byte, then the fields of a version
+	// 1 or version 3 payload.  It is the layout of CORE payloads.
+	LayoutVersioned PayloadLayout = iota
+
+	// LayoutUnversioned reads the fields of a version 1 payload with no
+	// version byte: the candidate, the reward and the optional Core block
+	// hash.  The delegation is reported as version 1.
+	LayoutUnversioned
+)
+
+func (l PayloadLayout) String() string {
+	switch l {
+	case LayoutVersioned:
+		return "versioned"
+	case LayoutUnversioned:
+		return "unversioned"
+	}
+	return fmt.Sprintf("PayloadLayout(%d)", int(l))
+}
+
+// MagicTag is a tag starting the power payloads of a chain, with the layout
+// of the payloads it starts.
+type MagicTag struct {
+	Tag    string
+	Layout PayloadLayout
+}
+
+// CoreMagicTag is the tag of the power payloads of Core.
+var CoreMagicTag = MagicTag{Tag: powerMagicString, Layout: LayoutVersioned}
+
+// ParserConfig sets which power payloads ParseDelegationWith reads, so that
+// testnets, forks and chains tagging their payloads differently share the
+// parser.  The zero value reads CORE payloads.
+type ParserConfig struct {
+	// Tags are tried in order on every payload.  The first one the
+	// payload starts with and whose layout reads it is reported in
+	// Delegation.Tag.  Tags with an empty Tag are skipped, and no tags
+	// at all means CoreMagicTag.
+	Tags []MagicTag
+}
+
+// defaultParser is the parser of CORE payloads.
+var defaultParser = ParserConfig{Tags: []MagicTag{CoreMagicTag}}
+
+func (c ParserConfig) tags() []MagicTag {
+	if len(c.Tags) == 0 {
+		return defaultParser.Tags
+	}
+	return c.Tags
+}
+
+// hasTag reports whether payload starts with one of the tags of c.
+func (c ParserConfig) hasTag(payload []byte) bool {
+	for _, tag := range c.tags() {
+		if tag.Tag != "" && bytes.HasPrefix(payload, []byte(tag.Tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePayload returns the power parameters of payload under the first tag
+// of c which reads it, or nil if none does.
+func (c ParserConfig) parsePayload(payload []byte) *Delegation {
+	for _, tag := range c.tags() {
+		if tag.Tag == "" || !bytes.HasPrefix(payload, []byte(tag.Tag)) {
+			continue
+		}
+		body := payload[len(tag.Tag):]
+		var d *Delegation
+		switch tag.Layout {
+		case LayoutVersioned:
+			if len(body) > 0 {
+				d = parsePowerFields(body[0], body[1:])
+			}
+		case LayoutUnversioned:
+			d = parsePowerFields(PowerPayloadV1, body)
+		}
+		if d != nil {
+			d.Tag = tag.Tag
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestParserConfig(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	core := (&PowerParams{Candidate: candidate, Reward: reward, RawBlockHash: coreBlockHash}).Payload()
+	// retag returns the payload of core under tag, with the version byte
+	// unless unversioned.
+	retag := func(tag string, unversioned bool) []byte {
+		body := core[len(powerMagicString):]
+		if unversioned {
+			body = body[1:]
+		}
+		return append([]byte(tag), body...)
+	}
+
+	testnet := MagicTag{Tag: "TEST", Layout: LayoutVersioned}
+	fork := MagicTag{Tag: "FORK!", Layout: LayoutUnversioned}
+	tests := []struct {
+		name    string
+		parser  ParserConfig
+		payload []byte
+		tag     string
+	}{
+		{"default", ParserConfig{}, core, "CORE"},
+		{"default other tag", ParserConfig{}, retag("TEST", false), ""},
+		{"custom", ParserConfig{Tags: []MagicTag{testnet}}, retag("TEST", false), "TEST"},
+		{"custom without core", ParserConfig{Tags: []MagicTag{testnet}}, core, ""},
+		{"second tag", ParserConfig{Tags: []MagicTag{testnet, CoreMagicTag}}, core, "CORE"},
+		{"unversioned", ParserConfig{Tags: []MagicTag{fork}}, retag("FORK!", true), "FORK!"},
+		{"layout fallback", ParserConfig{Tags: []MagicTag{{"FORK!", LayoutVersioned}, fork}}, retag("FORK!", true), "FORK!"},
+		{"empty tag", ParserConfig{Tags: []MagicTag{{"", LayoutUnversioned}}}, core, ""},
+		{"unknown layout", ParserConfig{Tags: []MagicTag{{"CORE", PayloadLayout(7)}}}, core, ""},
+	}
+	for _, test := range tests {
+		for _, witness := range []bool{false, true} {
+			m := newTestMirror(chainhash.Hash{}, 1, 0)
+			if witness {
+				m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32), test.payload}
+			} else {
+				m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, PowerScript(test.payload)))
+			}
+			d, err := m.ParseDelegationWith(DelegationOptions{Parser: test.parser})
+			if test.tag == "" {
+				if !errors.Is(err, ErrNoPowerParams) {
+					t.Errorf("ParseDelegationWith (%s, witness %v): got %+v, error %v, want %v",
+						test.name, witness, d, err, ErrNoPowerParams)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("ParseDelegationWith (%s, witness %v) error %v", test.name, witness, err)
+				continue
+			}
+			if d.Tag != test.tag || d.Candidate != candidate || d.Reward != reward ||
+				d.CoreBlockHash != coreBlockHash || d.Version != PowerPayloadV1 {
+				t.Errorf("ParseDelegationWith (%s, witness %v): got %+v, want tag %s",
+					test.name, witness, d, test.tag)
+			}
+		}
+	}
+}
+
+func TestParserConfigMinimalPush(t *testing.T) {
+	payload := append([]byte("TEST"), corePkScript(common.Address{1}, common.Address{2}, nil)[6:]...)
+	parser := ParserConfig{Tags: []MagicTag{{"TEST", LayoutVersioned}}}
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, PowerScript(payload)))
+	d, err := m.ParseDelegationWith(DelegationOptions{MinimalPush: true, Parser: parser})
+	if err != nil || d.Tag != "TEST" || d.Candidate != (common.Address{1}) {
+		t.Errorf("ParseDelegationWith with minimal pushes: got %+v, error %v", d, err)
+	}
+}
+
+func TestPayloadLayoutString(t *testing.T) {
+	tests := []struct {
+		layout PayloadLayout
+		want   string
+	}{
+		{LayoutVersioned, "versioned"},
+		{LayoutUnversioned, "unversioned"},
+		{PayloadLayout(7), "PayloadLayout(7)"},
+	}
+	for _, test := range tests {
+		if got := test.layout.String(); got != test.want {
+			t.Errorf("PayloadLayout(%d).String: got %q, want %q", int(test.layout), got, test.want)
+		}
+	}
+}
+
+func TestParsePowerParamsStrictWith(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	payload := append([]byte("TEST"), corePkScript(candidate, reward, nil)[6:]...)
+	other := append([]byte("TEST"), corePkScript(reward, candidate, nil)[6:]...)
+	parser := ParserConfig{Tags: []MagicTag{{"TEST", LayoutVersioned}}}
+
+	tests := []struct {
+		name     string
+		payloads [][]byte
+		err      error
+	}{
+		{"valid", [][]byte{payload}, nil},
+		{"truncated", [][]byte{payload, payload[:30]}, ErrMalformedPowerParams},
+		{"conflicting", [][]byte{payload, other}, ErrDelegationConflict},
+		{"core ignored", [][]byte{payload, corePkScript(reward, candidate, nil)[2:]}, nil},
+	}
+	for _, test := range tests {
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		for _, payload := range test.payloads {
+			m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, PowerScript(payload)))
+		}
+		gotCandidate, _, _, err := m.ParsePowerParamsStrictWith(parser)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParsePowerParamsStrictWith (%s): got error %v, want %v", test.name, err, test.err)
+		}
+		if test.err == nil && gotCandidate != candidate {
+			t.Errorf("ParsePowerParamsStrictWith (%s): got candidate %v, want %v", test.name, gotCandidate, candidate)
+		}
+		// Under the default parser, the TEST payloads are not CORE ones.
+		if _, _, _, err := m.ParsePowerParamsStrict(); test.name != "core ignored" && !errors.Is(err, ErrNoPowerParams) {
+			t.Errorf("ParsePowerParamsStrict (%s): got error %v, want %v", test.name, err, ErrNoPowerParams)
+		}
+	}
+}
+
+func TestParseAllPowerParamsWith(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	core := corePkScript(candidate, reward, nil)
+	fork := append([]byte("FORK!"), core[7:]...)
+	parser := ParserConfig{Tags: []MagicTag{{"FORK!", LayoutUnversioned}, CoreMagicTag}}
+
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, PowerScript(fork)))
+	m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, core))
+	want := []PowerParams{
+		{Candidate: candidate, Reward: reward, OutputIndex: 1, Version: PowerPayloadV1, Tag: "FORK!"},
+		{Candidate: candidate, Reward: reward, OutputIndex: 2, Version: PowerPayloadV1, Tag: "CORE"},
+	}
+	got := m.ParseAllPowerParamsWith(parser)
+	if len(got) != len(want) {
+		t.Fatalf("ParseAllPowerParamsWith: got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ParseAllPowerParamsWith #%d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := m.ParseAllPowerParams(); len(got) != 1 || got[0] != want[1] {
+		t.Errorf("ParseAllPowerParams: got %+v, want %+v", got, want[1:])
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultPipelineBuffer is the capacity of the channels between the stages
+// of a Pipeline when PipelineConfig.Buffer is not set.
+const defaultPipelineBuffer = 16
+
+// ErrPipelineStopped is returned by a run of a Pipeline which Stop ended
+// before its last height.
+var ErrPipelineStopped = errors.New("pipeline stopped")
+
+// PipelineConfig configures a Pipeline.
+type PipelineConfig struct {
+	// Fetcher and Store are the source and destination of the mirrors.
+	Fetcher Fetcher
+	Store   Store
+
+	// Params selects the proof of work limit the mirrors are validated
+	// against, the main network by default.
+	Params *chaincfg.Params
+
+	// PowHash is the hash function of the proof of work of the default
+	// validation, BitcoinPowHash when nil.
+	PowHash PowHashFunc
+
+	// SignetChallenge is the challenge of a custom signet the default
+	// validation checks the signet solutions against, as
+	// WithSignetChallenge does for a chain.
+	SignetChallenge []byte
+
+	// Validate, when set, replaces the default validation of a mirror, its
+	// proof of work and merkle branch.
+	Validate func(m *BtcLightMirrorV2) error
+
+	// Validators is the number of validation workers, GOMAXPROCS when not
+	// positive.
+	Validators int
+
+	// Buffer is the capacity of the channels between the stages.
+	Buffer int
+
+	// Logger, when set, receives the fetch latencies, the validation
+	// failures and the outcome of every run.
+	Logger Logger
+}
+
+// PipelineStats reports the progress of a Pipeline.
+type PipelineStats struct {
+	Fetched   int64
+	Validated int64
+	Stored    int64
+
+	// Elapsed is the duration of the run, so far if it is still running.
+	Elapsed time.Duration
+}
+
+// Rate returns the stored mirrors per second.
+func (s PipelineStats) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Stored) / s.Elapsed.Seconds()
+}
+
+// Pipeline copies a range of heights from a Fetcher to a Store through three
+// concurrent stages connected by bounded channels: fetching in height order,
+// validation on a pool of workers, and storing in height order.  Each stage
+// works on later heights while the next one handles earlier ones, so the
+// network and the CPU are kept busy at once.
+//
+// A pipeline runs one range at a time.  It follows the lifecycle of a
+// Service, but for Start taking the range of its run.
+type Pipeline struct {
+	cfg PipelineConfig
+
+	fetched   int64
+	validated int64
+	stored    int64
+
+	// started and finished time the last run, finished being zero while
+	// it runs.
+	mtx      sync.Mutex
+	started  time.Time
+	finished time.Time
+
+	// run is the run in progress, or the last one.
+	run *pipelineRun
+}
+
+// pipelineRun is a run of a Pipeline.
+type pipelineRun struct {
+	quit     chan struct{}
+	stopping bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// stats and err are the outcome of the run, set once done is closed.
+	stats PipelineStats
+	err   error
+}
+
+// NewPipeline returns a Pipeline with the given configuration.
+func NewPipeline(cfg PipelineConfig) (*Pipeline, error) {
+	if cfg.Fetcher == nil || cfg.Store == nil {
+		return nil, errors.New("pipeline needs a fetcher and a store")
+	}
+	if cfg.Params == nil {
+		cfg.Params = &chaincfg.MainNetParams
+	}
+	if cfg.Validate == nil {
+		challenge, err := signetChallenge(cfg.Params, cfg.SignetChallenge)
+		if err != nil {
+			return nil, err
+		}
+		params, powHash := cfg.Params, cfg.PowHash
+		cfg.Validate = func(m *BtcLightMirrorV2) error {
+			if err := checkWork(m, params, powHash, challenge); err != nil {
+				return err
+			}
+			return m.CheckMerkle()
+		}
+	}
+	if cfg.Validators <= 0 {
+		cfg.Validators = runtime.GOMAXPROCS(0)
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = defaultPipelineBuffer
+	}
+	cfg.Logger = orNopLogger(cfg.Logger)
+	return &Pipeline{cfg: cfg}, nil
+}
+
+// Stats returns the progress of the last run of the pipeline, which may still
+// be running.
+func (p *Pipeline) Stats() PipelineStats {
+	p.mtx.Lock()
+	started, finished := p.started, p.finished
+	p.mtx.Unlock()
+	s := PipelineStats{
+		Fetched:   atomic.LoadInt64(&p.fetched),
+		Validated: atomic.LoadInt64(&p.validated),
+		Stored:    atomic.LoadInt64(&p.stored),
+	}
+	switch {
+	case !finished.IsZero():
+		s.Elapsed = finished.Sub(started)
+	case !started.IsZero():
+		s.Elapsed = time.Since(started)
+	}
+	return s
+}
+
+// pipelineItem is a mirror moving through the stages.
+type pipelineItem struct {
+	height int64
+	mirror *BtcLightMirrorV2
+}
+
+// Run fetches, validates and stores the mirrors at heights start to end
+// included, and returns the stats of the run.  Every stored mirror must
+// build on the one stored before it.  The first error of any stage cancels
+// the others and is returned; the mirrors below the failing height may then
+// have been stored.  Stop ends the run with ErrPipelineStopped, once the
+// mirrors fetched are stored.
+func (p *Pipeline) Run(ctx context.Context, start, end int64) (PipelineStats, error) {
+	if err := p.Start(ctx, start, end); err != nil {
+		return PipelineStats{}, err
+	}
+	return p.Wait()
+}
+
+// Start runs the heights start to end included in the background, as Run
+// does, until the run completes, Stop is called or ctx is done.  Wait
+// returns the outcome of the run.  It fails with ErrAlreadyStarted while a
+// run is in progress.
+func (p *Pipeline) Start(ctx context.Context, start, end int64) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.run != nil {
+		select {
+		case <-p.run.done:
+		default:
+			return ErrAlreadyStarted
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	run := &pipelineRun{
+		quit:   make(chan struct{}),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	p.run = run
+	p.started, p.finished = time.Now(), time.Time{}
+	atomic.StoreInt64(&p.fetched, 0)
+	atomic.StoreInt64(&p.validated, 0)
+	atomic.StoreInt64(&p.stored, 0)
+	go func() {
+		defer close(run.done)
+		defer cancel()
+		run.stats, run.err = p.runRange(ctx, run.quit, start, end)
+	}()
+	return nil
+}
+
+// Wait waits for the run started last to complete and returns its stats
+// and error.  It returns zero stats when no run was started.
+func (p *Pipeline) Wait() (PipelineStats, error) {
+	p.mtx.Lock()
+	run := p.run
+	p.mtx.Unlock()
+	if run == nil {
+		return PipelineStats{}, nil
+	}
+	<-run.done
+	return run.stats, run.err
+}
+
+// Stop makes the run in progress fetch no new height, then waits until ctx
+// is done for the mirrors fetched to be validated and stored before
+// cancelling them.  It returns the error of ctx if it had to cancel.
+func (p *Pipeline) Stop(ctx context.Context) error {
+	p.mtx.Lock()
+	run := p.run
+	if run != nil && !run.stopping {
+		run.stopping = true
+		close(run.quit)
+	}
+	p.mtx.Unlock()
+	if run == nil {
+		return nil
+	}
+
+	select {
+	case <-run.done:
+		return nil
+	case <-ctx.Done():
+	}
+	run.cancel()
+	<-run.done
+	return ctx.Err()
+}
+
+// runRange is the body of a run, fetching no new height once quit is
+// closed.
+func (p *Pipeline) runRange(ctx context.Context, quit <-chan struct{}, start, end int64) (PipelineStats, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	fetched := make(chan pipelineItem, p.cfg.Buffer)
+	validated := make(chan pipelineItem, p.cfg.Buffer)
+
+	// window bounds the mirrors between the fetch and the store stages,
+	// which the store stage holds back until it has the lower heights.
+	window := make(chan struct{}, 2*p.cfg.Buffer+p.cfg.Validators)
+
+	g.Go(func() error {
+		defer close(fetched)
+		for height := start; height <= end; height++ {
+			select {
+			case window <- struct{}{}:
+			case <-quit:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			// A stop wins over a free slot of the window.
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			fetchStart := time.Now()
+			m, err := p.cfg.Fetcher.FetchByHeight(ctx, height)
+			logFetch(p.cfg.Logger, heightBlock(height), fetchStart, err)
+			if err != nil {
+				return fmt.Errorf("fetching height %d: %w", height, err)
+			}
+			atomic.AddInt64(&p.fetched, 1)
+			select {
+			case fetched <- pipelineItem{height, m}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	var validators sync.WaitGroup
+	for i := 0; i < p.cfg.Validators; i++ {
+		validators.Add(1)
+		g.Go(func() error {
+			defer validators.Done()
+			for item := range fetched {
+				if err := p.cfg.Validate(item.mirror); err != nil {
+					p.cfg.Logger.Warnf("mirror at height %d failed validation: %v",
+						item.height, err)
+					return fmt.Errorf("validating height %d: %w", item.height, err)
+				}
+				atomic.AddInt64(&p.validated, 1)
+				select {
+				case validated <- item:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		validators.Wait()
+		close(validated)
+	}()
+
+	g.Go(func() error {
+		pending := make(map[int64]*BtcLightMirrorV2)
+		next := start
+		var prev chainhash.Hash
+		for item := range validated {
+			pending[item.height] = item.mirror
+			for m, ok := pending[next]; ok; m, ok = pending[next] {
+				if next > start && m.BtcHeader.PrevBlock != prev {
+					return fmt.Errorf("mirror at height %d does not build on "+
+						"%v: %w", next, prev, ErrUnknownParent)
+				}
+				if err := p.cfg.Store.Put(m, next); err != nil {
+					return fmt.Errorf("storing height %d: %w", next, err)
+				}
+				atomic.AddInt64(&p.stored, 1)
+				prev = m.BtcHeader.BlockHash()
+				delete(pending, next)
+				next++
+				<-window
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if next <= end {
+			return fmt.Errorf("at height %d: %w", next, ErrPipelineStopped)
+		}
+		return nil
+	})
+
+	err := g.Wait()
+	p.mtx.Lock()
+	p.finished = time.Now()
+	p.mtx.Unlock()
+	stats := p.Stats()
+	switch {
+	case errors.Is(err, ErrPipelineStopped):
+		p.cfg.Logger.Infof("pipeline run of heights %d to %d stopped after "+
+			"storing %d mirrors", start, end, stats.Stored)
+	case err != nil:
+		p.cfg.Logger.Errorf("pipeline run of heights %d to %d failed after "+
+			"storing %d mirrors: %v", start, end, stats.Stored, err)
+	default:
+		p.cfg.Logger.Infof("pipeline stored heights %d to %d in %v", start, end,
+			stats.Elapsed)
+	}
+	return stats, err
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror/leaktest"
+)
+
+// slowFetcher delays the mirrors of a countingFetcher by delay.
+type slowFetcher struct {
+	*countingFetcher
+	delay time.Duration
+}
+
+func (f *slowFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	time.Sleep(f.delay)
+	return f.countingFetcher.FetchByHeight(ctx, height)
+}
+
+// orderStore is a memStore recording the heights of the mirrors put.
+type orderStore struct {
+	*memStore
+	mtx     sync.Mutex
+	heights []int64
+}
+
+func (s *orderStore) Put(m *BtcLightMirrorV2, height int64) error {
+	s.mtx.Lock()
+	s.heights = append(s.heights, height)
+	s.mtx.Unlock()
+	return s.memStore.Put(m, height)
+}
+
+func TestPipelineOverlap(t *testing.T) {
+	leaktest.Check(t)
+	const n = 20
+	mirrors := newTestMirrors(n)
+	tests := []struct {
+		name       string
+		fetch      time.Duration
+		validate   time.Duration
+		validators int
+	}{
+		{"slow fetcher", 10 * time.Millisecond, 8 * time.Millisecond, 1},
+		{"slow validator", 2 * time.Millisecond, 10 * time.Millisecond, 4},
+	}
+	for _, test := range tests {
+		store := &orderStore{memStore: newMemStore()}
+		validate := test.validate
+		p, err := NewPipeline(PipelineConfig{
+			Fetcher: &slowFetcher{newCountingFetcher(mirrors), test.fetch},
+			Store:   store,
+			Validate: func(m *BtcLightMirrorV2) error {
+				time.Sleep(validate)
+				return m.CheckMerkle()
+			},
+			Validators: test.validators,
+			Buffer:     4,
+		})
+		if err != nil {
+			t.Fatalf("NewPipeline (%s) error %v", test.name, err)
+		}
+		stats, err := p.Run(context.Background(), 0, n-1)
+		if err != nil {
+			t.Fatalf("Run (%s) error %v", test.name, err)
+		}
+		if stats.Fetched != n || stats.Validated != n || stats.Stored != n {
+			t.Errorf("Run (%s): got stats %+v", test.name, stats)
+		}
+		if stats.Rate() <= 0 {
+			t.Errorf("Run (%s): got rate %v", test.name, stats.Rate())
+		}
+
+		// Run one stage after the other, the run would take the sum
+		// of the time of every stage.
+		sequential := n * (test.fetch + test.validate)
+		if stats.Elapsed > sequential*3/4 {
+			t.Errorf("Run (%s): took %v, the stages did not overlap "+
+				"(sequential %v)", test.name, stats.Elapsed, sequential)
+		}
+		for i, height := range store.heights {
+			if height != int64(i) {
+				t.Fatalf("Run (%s): stored height %d at position %d",
+					test.name, height, i)
+			}
+		}
+		for i, m := range mirrors {
+			got, err := store.ByHeight(int64(i))
+			if err != nil || got.BtcHeader.BlockHash() != m.BtcHeader.BlockHash() {
+				t.Errorf("ByHeight(%d) (%s): got %v, error %v", i, test.name,
+					got, err)
+			}
+		}
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	leaktest.Check(t)
+	const n = 40
+	mirrors := newTestMirrors(n)
+	store := &orderStore{memStore: newMemStore()}
+	p, err := NewPipeline(PipelineConfig{
+		Fetcher: newCountingFetcher(mirrors),
+		Store:   store,
+		Params:  &chaincfg.RegressionNetParams,
+		Validate: func(m *BtcLightMirrorV2) error {
+			// The mirrors take varied times to validate, so that
+			// they leave the validators out of order.
+			delay := m.BtcHeader.Timestamp.Unix() / 600 % 4
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+			return nil
+		},
+		Validators: 8,
+		Buffer:     2,
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline error %v", err)
+	}
+	if _, err := p.Run(context.Background(), 0, n-1); err != nil {
+		t.Fatalf("Run error %v", err)
+	}
+	if len(store.heights) != n {
+		t.Fatalf("Run: stored %d mirrors, want %d", len(store.heights), n)
+	}
+	for i, height := range store.heights {
+		if height != int64(i) {
+			t.Fatalf("Run: stored height %d at position %d", height, i)
+		}
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	leaktest.Check(t)
+	mirrors := newTestMirrors(10)
+	unlinked := newCountingFetcher(mirrors)
+	unlinked.byHeight[6] = newTestMirror(chainhash.Hash{}, 100, 0)
+
+	tests := []struct {
+		name    string
+		fetcher Fetcher
+		params  *chaincfg.Params
+		end     int64
+		want    error
+		stored  int64
+	}{
+		{"fetch", newCountingFetcher(mirrors), &chaincfg.RegressionNetParams, 15, ErrNotFound, 10},
+		{"validation", newCountingFetcher(mirrors), &chaincfg.MainNetParams, 9, nil, 0},
+		{"linkage", unlinked, &chaincfg.RegressionNetParams, 9, ErrUnknownParent, 6},
+	}
+	for _, test := range tests {
+		p, err := NewPipeline(PipelineConfig{
+			Fetcher: test.fetcher,
+			Store:   newMemStore(),
+			Params:  test.params,
+		})
+		if err != nil {
+			t.Fatalf("NewPipeline (%s) error %v", test.name, err)
+		}
+		stats, err := p.Run(context.Background(), 0, test.end)
+		if err == nil {
+			t.Errorf("Run (%s): expected error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("Run (%s): got error %v, want %v", test.name, err, test.want)
+		}
+		if stats.Stored > test.stored {
+			t.Errorf("Run (%s): stored %d mirrors, at most %d expected",
+				test.name, stats.Stored, test.stored)
+		}
+	}
+
+	// A cancelled context stops the run.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, err := NewPipeline(PipelineConfig{
+		Fetcher: newCountingFetcher(mirrors),
+		Store:   newMemStore(),
+		Params:  &chaincfg.RegressionNetParams,
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline error %v", err)
+	}
+	if _, err := p.Run(ctx, 0, 9); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run: got error %v, want %v", err, context.Canceled)
+	}
+
+	if _, err := NewPipeline(PipelineConfig{Store: newMemStore()}); err == nil {
+		t.Errorf("NewPipeline: expected error without a fetcher")
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	leaktest.Check(t)
+	const n = 100
+	mirrors := newTestMirrors(n)
+	store := &orderStore{memStore: newMemStore()}
+	p, err := NewPipeline(PipelineConfig{
+		Fetcher: &slowFetcher{newCountingFetcher(mirrors), 2 * time.Millisecond},
+		Store:   store,
+		Params:  &chaincfg.RegressionNetParams,
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline error %v", err)
+	}
+
+	// The mirrors fetched before Stop are stored.
+	if err := p.Start(context.Background(), 0, n-1); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	if err := p.Start(context.Background(), 0, n-1); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("Start twice: got error %v, want %v", err, ErrAlreadyStarted)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Stored < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	stats, err := p.Wait()
+	if !errors.Is(err, ErrPipelineStopped) {
+		t.Errorf("Wait: got error %v, want %v", err, ErrPipelineStopped)
+	}
+	if stats.Stored != stats.Fetched || stats.Stored >= n || int64(len(store.heights)) != stats.Stored {
+		t.Errorf("Wait: got stats %+v and %d mirrors stored", stats, len(store.heights))
+	}
+
+	// A fetch outliving the deadline of Stop is cancelled.
+	f := newOrderFetcher(0)
+	f.gate = make(chan struct{})
+	p, err = NewPipeline(PipelineConfig{
+		Fetcher:  f,
+		Store:    newMemStore(),
+		Validate: func(*BtcLightMirrorV2) error { return nil },
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline error %v", err)
+	}
+	if err := p.Start(context.Background(), 0, 9); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	for len(f.order()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := p.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait: got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrInvalidBits is wrapped by the errors of CheckBitsCanonical.
+	ErrInvalidBits = errors.New("invalid compact target")
+
+	// ErrHashAboveTarget is wrapped by the proof of work errors of headers
+	// whose hash does not satisfy the target of their bits.
+	ErrHashAboveTarget = errors.New("hash above target")
+)
+
+// PowHashFunc returns the hash of a header checked against the target of its
+// bits by the proof of work validation.  Chains mirroring a network whose
+// proof of work hashes the header with another function, such as scrypt for
+// the Litecoin family, supply it through WithPowHash, WithValidationPowHash
+// and PipelineConfig.PowHash.
+//
+// The proof of work hash only decides which headers are valid.  Blocks are
+// still identified and linked by their BlockHash, and their work, from which
+// the cumulative work and the fork choice derive, by their bits.
+type PowHashFunc func(header *wire.BlockHeader) chainhash.Hash
+
+// BitcoinPowHash is the PowHashFunc of Bitcoin, the double SHA-256 of the
+// header, which is also its block hash.  It is the default.
+func BitcoinPowHash(header *wire.BlockHeader) chainhash.Hash {
+	return header.BlockHash()
+}
+
+// WithPowHash sets the hash function of the proof of work the chain checks
+// appended blocks and headers, and the pruned blocks it loads from its store,
+// against.  The default is BitcoinPowHash.
+func WithPowHash(f PowHashFunc) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.powHash = f
+	}
+}
+
+// powHashOf returns the proof of work hash of header under f, or hash, the
+// block hash of header, if f is nil, which stands for BitcoinPowHash.
+func powHashOf(f PowHashFunc, header *wire.BlockHeader, hash chainhash.Hash) chainhash.Hash {
+	if f == nil {
+		return hash
+	}
+	return f(header)
+}
+
+// CheckProofOfWork checks that the header of the mirror satisfies the
+// target of its bits: its block hash, recomputed from the header, must be no
+// higher than the target, failing with an error wrapping ErrHashAboveTarget.
+// The bits are checked by CheckBitsCanonical against powLimit, which may be
+// nil, first.  A header carrying bits it was never mined for does not pass.
+func (light *BtcLightMirrorV2) CheckProofOfWork(powLimit *big.Int) error {
+	return checkProofOfWork(&light.BtcHeader, powLimit, nil)
+}
+
+// CheckBitsCanonical checks that bits is the compact encoding of a target
+// which a header may carry, as Bitcoin Core encodes it: the encoding must
+// not have the sign bit set, must be the shortest one of its target, so that
+// a zero mantissa has a zero exponent and no mantissa is shifted out, and
+// must not encode a target wider than 256 bits.  The target must be
+// positive and, unless powLimit is nil, no higher than powLimit.
+// blockchain.CompactToBig decodes all of these without complaint, to
+// negative, truncated or overflowing targets.  The errors wrap
+// ErrInvalidBits.
+func CheckBitsCanonical(bits uint32, powLimit *big.Int) error {
+	exponent, mantissa := bits>>24, bits&0x007fffff
+	if bits&0x00800000 != 0 {
+		return fmt.Errorf("bits %08x have the sign bit set: %w", bits, ErrInvalidBits)
+	}
+	// The overflow rule of Bitcoin Core's SetCompact.
+	if mantissa != 0 && (exponent > 34 || mantissa > 0xff && exponent > 33 ||
+		mantissa > 0xffff && exponent > 32) {
+		return fmt.Errorf("bits %08x encode a target wider than 256 bits: %w",
+			bits, ErrInvalidBits)
+	}
+	target := blockchain.CompactToBig(bits)
+	if target.Sign() == 0 {
+		return fmt.Errorf("bits %08x encode a zero target: %w", bits, ErrInvalidBits)
+	}
+	if canonical := blockchain.BigToCompact(target); canonical != bits {
+		return fmt.Errorf("bits %08x are not the canonical encoding %08x of "+
+			"their target: %w", bits, canonical, ErrInvalidBits)
+	}
+	if powLimit != nil && target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("block target difficulty of %064x is higher than "+
+			"max of %064x: %w", target, powLimit, ErrInvalidBits)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// stubPowHash is a PowHashFunc under which the headers of even nonce have
+// the lowest hash and the others the highest.
+func stubPowHash(header *wire.BlockHeader) chainhash.Hash {
+	var hash chainhash.Hash
+	if header.Nonce%2 == 1 {
+		for i := range hash {
+			hash[i] = 0xff
+		}
+	}
+	return hash
+}
+
+// newPowBranch returns n linked mirrors building on parent whose proof of
+// work on the regression test network passes with BitcoinPowHash if bitcoin
+// is set, and with stubPowHash if stub is set.
+func newPowBranch(parent *BtcLightMirrorV2, seed uint32, n int, bitcoin, stub bool) []*BtcLightMirrorV2 {
+	powLimit := chaincfg.RegressionNetParams.PowLimit
+	branch := newTestBranch(parent, seed, n)
+	prev := parent.BtcHeader.BlockHash()
+	for _, m := range branch {
+		header := &m.BtcHeader
+		header.PrevBlock = prev
+		for header.Nonce = 0; ; header.Nonce++ {
+			if (checkProofOfWork(header, powLimit, nil) == nil) == bitcoin &&
+				(checkProofOfWork(header, powLimit, stubPowHash) == nil) == stub {
+				break
+			}
+		}
+		prev = header.BlockHash()
+	}
+	return branch
+}
+
+func TestCheckProofOfWorkHash(t *testing.T) {
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	powLimit := chaincfg.RegressionNetParams.PowLimit
+	tests := []struct {
+		bitcoin bool
+		stub    bool
+	}{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	}
+	for i, test := range tests {
+		header := &newPowBranch(anchor, uint32(i), 1, test.bitcoin, test.stub)[0].BtcHeader
+		for _, f := range []struct {
+			name string
+			hash PowHashFunc
+			want bool
+		}{
+			{"nil", nil, test.bitcoin},
+			{"BitcoinPowHash", BitcoinPowHash, test.bitcoin},
+			{"stub", stubPowHash, test.stub},
+		} {
+			if got := checkProofOfWork(header, powLimit, f.hash) == nil; got != f.want {
+				t.Errorf("checkProofOfWork #%d (%s): got valid %v, want %v", i,
+					f.name, got, f.want)
+			}
+		}
+	}
+}
+
+func TestChainPowHash(t *testing.T) {
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	stubOnly := newPowBranch(anchor, 100, 2, false, true)
+	bitcoinOnly := newPowBranch(anchor, 200, 3, true, false)
+
+	// Under the stub, the stub branch is valid and the longer Bitcoin
+	// branch is rejected, so it does not win the fork choice.  By default,
+	// it is the other way around.
+	tests := []struct {
+		name  string
+		opts  []ChainOption
+		valid []*BtcLightMirrorV2
+		tip   *BtcLightMirrorV2
+	}{
+		{"stub", []ChainOption{WithPowHash(stubPowHash)}, stubOnly, stubOnly[1]},
+		{"default", nil, bitcoinOnly, bitcoinOnly[2]},
+	}
+	for _, test := range tests {
+		c := newTestChain(t, []*BtcLightMirrorV2{anchor}, test.opts...)
+		for _, m := range append(append([]*BtcLightMirrorV2(nil), stubOnly...), bitcoinOnly...) {
+			valid := false
+			for _, v := range test.valid {
+				valid = valid || v == m
+			}
+			_, err := c.Append(m)
+			if valid && err != nil {
+				t.Fatalf("Append (%s) error %v", test.name, err)
+			}
+			if !valid && err == nil {
+				t.Fatalf("Append (%s): expected error", test.name)
+			}
+		}
+		if tip, _ := c.Tip(); tip.BtcHeader.BlockHash() != test.tip.BtcHeader.BlockHash() {
+			t.Errorf("Tip (%s): got %v, want %v", test.name,
+				tip.BtcHeader.BlockHash(), test.tip.BtcHeader.BlockHash())
+		}
+
+		// Header-only blocks are checked the same way.
+		h := newTestChain(t, []*BtcLightMirrorV2{anchor}, test.opts...)
+		if _, err := h.AppendHeaderOnly(test.valid[0].BtcHeader); err != nil {
+			t.Errorf("AppendHeaderOnly (%s) error %v", test.name, err)
+		}
+		invalid := stubOnly[0]
+		if invalid == test.valid[0] {
+			invalid = bitcoinOnly[0]
+		}
+		if _, err := h.AppendHeaderOnly(invalid.BtcHeader); err == nil {
+			t.Errorf("AppendHeaderOnly (%s): expected error", test.name)
+		}
+	}
+}
+
+func TestChainPowHashStore(t *testing.T) {
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	mirrors := append([]*BtcLightMirrorV2{anchor}, newPowBranch(anchor, 100, 4, false, true)...)
+	store := newMemStore()
+	opts := []ChainOption{WithPowHash(stubPowHash), WithStore(store)}
+	c := newTestChain(t, mirrors, opts...)
+
+	// A chain reloaded from the store checks the stored mirrors with the
+	// same hash function.
+	reloaded := newTestChain(t, mirrors[:1], opts...)
+	if _, height := reloaded.Tip(); height != testAnchorHeight+4 {
+		t.Errorf("NewMirrorChain: got tip height %d, want %d", height,
+			testAnchorHeight+4)
+	}
+
+	// So does the chain importing a snapshot.
+	var buf bytes.Buffer
+	if err := c.ExportSnapshot(&buf); err != nil {
+		t.Fatalf("ExportSnapshot error %v", err)
+	}
+	imported := newTestChain(t, mirrors[:1], WithPowHash(stubPowHash))
+	if err := imported.ImportSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ImportSnapshot error %v", err)
+	}
+	if _, height := imported.Tip(); height != testAnchorHeight+4 {
+		t.Errorf("ImportSnapshot: got tip height %d, want %d", height,
+			testAnchorHeight+4)
+	}
+	if err := newTestChain(t, mirrors[:1]).ImportSnapshot(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("ImportSnapshot: expected error without the stub")
+	}
+}
+
+func TestValidationPowHash(t *testing.T) {
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	mirrors := newPowBranch(anchor, 100, 4, false, true)
+	params := &chaincfg.RegressionNetParams
+	err := ValidateChainParallel(context.Background(), mirrors, params, 2,
+		WithValidationPowHash(stubPowHash))
+	if err != nil {
+		t.Errorf("ValidateChainParallel error %v", err)
+	}
+	if err := ValidateChainParallel(context.Background(), mirrors, params, 2); err == nil {
+		t.Errorf("ValidateChainParallel: expected error without the stub")
+	}
+
+	for _, powHash := range []PowHashFunc{stubPowHash, nil} {
+		p, err := NewPipeline(PipelineConfig{
+			Fetcher: newCountingFetcher(mirrors),
+			Store:   newMemStore(),
+			Params:  params,
+			PowHash: powHash,
+		})
+		if err != nil {
+			t.Fatalf("NewPipeline error %v", err)
+		}
+		_, err = p.Run(context.Background(), 0, 3)
+		if powHash != nil && err != nil {
+			t.Errorf("Run error %v", err)
+		}
+		if powHash == nil && err == nil {
+			t.Errorf("Run: expected error without the stub")
+		}
+	}
+}
+
+func TestCheckBitsCanonical(t *testing.T) {
+	mainLimit := chaincfg.MainNetParams.PowLimit
+	tests := []struct {
+		name     string
+		bits     uint32
+		powLimit *big.Int
+		valid    bool
+	}{
+		{"main network limit", 0x1d00ffff, mainLimit, true},
+		{"main network block", 0x17034219, mainLimit, true},
+		{"regression test limit", 0x207fffff, chaincfg.RegressionNetParams.PowLimit, true},
+		{"no limit", 0x207fffff, nil, true},
+		{"smallest target", 0x01010000, nil, true},
+		{"widest target", 0x2100ffff, nil, true},
+
+		{"zero", 0x00000000, nil, false},
+		{"mantissa shifted out", 0x01003456, nil, false},
+		{"sign bit", 0x04923456, nil, false},
+		{"negative zero", 0x01800000, nil, false},
+		{"zero mantissa", 0x1d000000, nil, false},
+		{"leading zero byte", 0x1e0000ff, nil, false},
+		{"overflow", 0xff123456, nil, false},
+		{"overflow by a byte", 0x21010000, nil, false},
+		{"overflow by two bytes", 0x22000100, nil, false},
+		{"above the limit", 0x1d01ffff, mainLimit, false},
+		{"regression test bits on the main network", 0x207fffff, mainLimit, false},
+	}
+	for _, test := range tests {
+		err := CheckBitsCanonical(test.bits, test.powLimit)
+		if test.valid && err != nil {
+			t.Errorf("CheckBitsCanonical (%s) error %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidBits) {
+			t.Errorf("CheckBitsCanonical (%s): got error %v, want %v", test.name, err, ErrInvalidBits)
+		}
+	}
+
+	// The proof of work check rejects such bits however low the hash.
+	header := &wire.BlockHeader{Bits: 0x04923456}
+	if err := checkProofOfWork(header, mainLimit, stubPowHash); !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("checkProofOfWork: got error %v, want %v", err, ErrInvalidBits)
+	}
+}
+
+func TestCheckProofOfWork(t *testing.T) {
+	powLimit := chaincfg.RegressionNetParams.PowLimit
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	if err := m.CheckProofOfWork(powLimit); err != nil {
+		t.Fatalf("CheckProofOfWork error %v", err)
+	}
+	if err := m.CheckProofOfWork(nil); err != nil {
+		t.Errorf("CheckProofOfWork without limit error %v", err)
+	}
+	if err := m.CheckProofOfWork(chaincfg.MainNetParams.PowLimit); !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("CheckProofOfWork on the main network: got error %v, want %v", err, ErrInvalidBits)
+	}
+
+	// A header never mined for its bits.
+	bad := m.Clone()
+	for bad.BtcHeader.Nonce = 0; checkProofOfWork(&bad.BtcHeader, powLimit, nil) == nil; {
+		bad.BtcHeader.Nonce++
+	}
+	if err := bad.CheckProofOfWork(powLimit); !errors.Is(err, ErrHashAboveTarget) {
+		t.Errorf("CheckProofOfWork: got error %v, want %v", err, ErrHashAboveTarget)
+	}
+	bad.BtcHeader.Bits = 0x1d00ffff
+	if err := bad.CheckProofOfWork(nil); !errors.Is(err, ErrHashAboveTarget) {
+		t.Errorf("CheckProofOfWork with raised difficulty: got error %v, want %v",
+			err, ErrHashAboveTarget)
+	}
+}
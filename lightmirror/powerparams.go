@@ -0,0 +1,205 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrMalformedPowerParams is returned by ParsePowerParamsStrict when the
+// coinbase has a CORE output or CORE witness item which does not parse,
+// such as a truncated payload.
+var ErrMalformedPowerParams = errors.New("malformed power parameters")
+
+// PowerParamsError is returned by ParsePowerParamsStrict, with the number of
+// CORE outputs and CORE witness items of the coinbase and how many of them
+// do not parse.  Err is ErrNoPowerParams, ErrWitnessStripped,
+// ErrMalformedPowerParams or ErrDelegationConflict.
+type PowerParamsError struct {
+	Err       error
+	Payloads  int
+	Malformed int
+}
+
+func (e *PowerParamsError) Error() string {
+	return fmt.Sprintf("%v (%d CORE payloads, %d malformed)", e.Err, e.Payloads, e.Malformed)
+}
+
+func (e *PowerParamsError) Unwrap() error {
+	return e.Err
+}
+
+// PowerParams are the power parameters of a coinbase, those
+// ParsePowerParams returns, with the Core block hash kept as the payload
+// carries it.
+//
+// The Core block hash is a hash of the Core chain, which, as every Ethereum
+// hash, is carried big-endian: the payload holds its bytes in the order
+// Ethereum tooling prints them.  CoreBlockHash returns it as such, and
+// BtcStyleHash with its bytes reversed, as a chainhash.Hash whose String
+// prints the same hex.  A chainhash.Hash converted to a common.Hash without
+// reversal, or the other way around, is not the same hash.
+type PowerParams struct {
+	Candidate common.Address
+	Reward    common.Address
+
+	// RawBlockHash is the Core block hash as the 32 bytes of the payload,
+	// zero when the payload has none.
+	RawBlockHash [common.HashLength]byte
+
+	// OutputIndex is the index of the coinbase output carrying the
+	// parameters, as ParseAllPowerParams reports it.  It is zero for the
+	// parameters of a Delegation, which may come from the witness.
+	OutputIndex int
+
+	// Version is the version of the payload, PowerPayloadV1 or
+	// PowerPayloadV3.
+	Version byte
+
+	// Tag is the magic tag the payload starts with.
+	Tag string
+}
+
+// CoreBlockHash returns the Core block hash in its canonical form, the one
+// its Hex prints as a Core node does.
+func (p *PowerParams) CoreBlockHash() common.Hash {
+	return common.Hash(p.RawBlockHash)
+}
+
+// BtcStyleHash returns the Core block hash with its bytes reversed, the
+// chainhash.Hash whose String prints the hex of CoreBlockHash without its
+// 0x prefix.  It is FromCommonHash(p.CoreBlockHash()).
+func (p *PowerParams) BtcStyleHash() chainhash.Hash {
+	return FromCommonHash(p.CoreBlockHash())
+}
+
+// SetCoreBlockHash sets the Core block hash from its canonical form, as
+// CoreBlockHash returns it.
+func (p *PowerParams) SetCoreBlockHash(h common.Hash) {
+	p.RawBlockHash = h
+}
+
+// SetBtcStyleHash sets the Core block hash from its reversed form, as
+// BtcStyleHash returns it.
+func (p *PowerParams) SetBtcStyleHash(h chainhash.Hash) {
+	p.RawBlockHash = ToCommonHash(h)
+}
+
+// Payload returns the version 1 power payload of the parameters, for
+// PowerScript or AddWitnessPayload: powerMagicString, the version byte, the
+// candidate, the reward and RawBlockHash.  Version and Tag are not taken
+// into account.
+func (p *PowerParams) Payload() []byte {
+	payload := make([]byte, 0, len(powerMagicString)+1+2*common.AddressLength+common.HashLength)
+	payload = append(payload, powerMagicString...)
+	payload = append(payload, PowerPayloadV1)
+	payload = append(payload, p.Candidate[:]...)
+	payload = append(payload, p.Reward[:]...)
+	payload = append(payload, p.RawBlockHash[:]...)
+	return payload
+}
+
+// PowerParams returns the power parameters of the delegation.
+func (d *Delegation) PowerParams() *PowerParams {
+	return &PowerParams{
+		Candidate:    d.Candidate,
+		Reward:       d.Reward,
+		RawBlockHash: d.CoreBlockHash,
+		Version:      d.Version,
+		Tag:          d.Tag,
+	}
+}
+
+// PowerParams returns the power parameters ParsePowerParams returns, or
+// ErrNoPowerParams when the coinbase has none.
+func (light *BtcLightMirrorV2) PowerParams() (*PowerParams, error) {
+	d, err := light.ParseDelegation(PreferOutput)
+	if err != nil {
+		return nil, err
+	}
+	return d.PowerParams(), nil
+}
+
+// ParsePowerParamsStrict returns the power parameters ParsePowerParams
+// returns, failing with a *PowerParamsError where ParsePowerParams would
+// return zero values or pick one of several payloads: when the coinbase has
+// no CORE output nor CORE witness item, when one of them does not parse, or
+// when they do not all carry the same power parameters.  Payloads repeating
+// the same parameters are accepted.
+func (light *BtcLightMirrorV2) ParsePowerParamsStrict() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, err error) {
+	return light.ParsePowerParamsStrictWith(ParserConfig{})
+}
+
+// ParsePowerParamsStrictWith is ParsePowerParamsStrict for the payloads
+// starting with the tags of parser: a payload starting with one of them
+// which no tag reads is malformed.
+func (light *BtcLightMirrorV2) ParsePowerParamsStrictWith(parser ParserConfig) (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, err error) {
+	e := &PowerParamsError{}
+	var first *Delegation
+	conflict := false
+	light.forEachPowerCandidate(parser, func(d *Delegation) {
+		e.Payloads++
+		switch {
+		case d == nil:
+			e.Malformed++
+		case first == nil:
+			first = d
+		case !first.samePower(d):
+			conflict = true
+		}
+	})
+	switch {
+	case e.Malformed > 0:
+		e.Err = ErrMalformedPowerParams
+	case conflict:
+		e.Err = ErrDelegationConflict
+	case first == nil:
+		e.Err = ErrNoPowerParams
+		_, err := light.ParseDelegationWith(DelegationOptions{Parser: parser})
+		if errors.Is(err, ErrWitnessStripped) {
+			e.Err = ErrWitnessStripped
+		}
+	default:
+		return first.Candidate, first.Reward, first.CoreBlockHash, nil
+	}
+	return common.Address{}, common.Address{}, common.Hash{}, e
+}
+
+// ParseAllPowerParams returns the power parameters of every CORE output of
+// the coinbase following the first output, in output order, so that a
+// consumer can arbitrate between several of them rather than take the first
+// one ParsePowerParams returns.  The CORE outputs which do not parse are
+// left out.  It returns nil when the coinbase has no CORE output which
+// parses.
+//
+// The CORE witness items are left out too: an entry names the output
+// carrying it by OutputIndex, which a witness item has not.  Their
+// parameters are returned by ParseDelegation under PreferWitness, and
+// ParsePowerParamsStrict, which weighs them along with the outputs, tells
+// whether they agree with those of the outputs.
+func (light *BtcLightMirrorV2) ParseAllPowerParams() []PowerParams {
+	return light.ParseAllPowerParamsWith(ParserConfig{})
+}
+
+// ParseAllPowerParamsWith is ParseAllPowerParams for the payloads of the
+// tags of parser.  The Tag of every entry is the tag which read it.
+func (light *BtcLightMirrorV2) ParseAllPowerParamsWith(parser ParserConfig) []PowerParams {
+	var params []PowerParams
+	for i, txout := range light.Coinbase().TxOut {
+		if i == 0 || txout == nil {
+			continue
+		}
+		if d := parser.parseScript(txout.PkScript, false); d != nil {
+			p := d.PowerParams()
+			p.OutputIndex = i
+			params = append(params, *p)
+		}
+	}
+	return params
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPowerParamsByteOrder(t *testing.T) {
+	// The regtest-core vector carries the Core block hash printed below,
+	// in the payload of its second output.
+	const coreHex = "0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f"
+	_, m, err := LoadVector("regtest-core")
+	if err != nil {
+		t.Fatalf("LoadVector error %v", err)
+	}
+	p, err := m.PowerParams()
+	if err != nil {
+		t.Fatalf("PowerParams error %v", err)
+	}
+	script := m.CoinBaseTx.TxOut[1].PkScript
+	if raw := script[len(script)-common.HashLength:]; !bytes.Equal(p.RawBlockHash[:], raw) {
+		t.Errorf("RawBlockHash: got %x, want the payload bytes %x", p.RawBlockHash, raw)
+	}
+	if got := p.CoreBlockHash().Hex(); got != coreHex {
+		t.Errorf("CoreBlockHash: got %s, want %s", got, coreHex)
+	}
+	btcStyle := p.BtcStyleHash()
+	if got := btcStyle.String(); "0x"+got != coreHex {
+		t.Errorf("BtcStyleHash: got %s, want %s", got, coreHex[2:])
+	}
+	if btcStyle[0] != 0x7f || btcStyle[chainhash.HashSize-1] != 0x4f {
+		t.Errorf("BtcStyleHash: got bytes %x, want them reversed", btcStyle[:])
+	}
+	if _, _, blockHash := m.ParsePowerParams(); blockHash != p.CoreBlockHash() {
+		t.Errorf("ParsePowerParams: got %v, want %v", blockHash, p.CoreBlockHash())
+	}
+
+	// Both forms set the hash back to the payload of the vector.
+	payload := script[2:]
+	for i, set := range []func(*PowerParams){
+		func(q *PowerParams) { q.SetCoreBlockHash(common.HexToHash(coreHex)) },
+		func(q *PowerParams) { q.SetBtcStyleHash(btcStyle) },
+	} {
+		q := &PowerParams{Candidate: p.Candidate, Reward: p.Reward, Version: p.Version, Tag: p.Tag}
+		set(q)
+		if *q != *p {
+			t.Errorf("PowerParams #%d: got %+v, want %+v", i, q, p)
+		}
+		if got := q.Payload(); !bytes.Equal(got, payload) {
+			t.Errorf("Payload #%d: got %x, want %x", i, got, payload)
+		}
+	}
+
+	// The witness payload of AddWitnessDelegation parses back the same.
+	coinbase := newTestMirror(chainhash.Hash{}, 1, 0).CoinBaseTx.Copy()
+	coinbase.TxIn[0].Witness = [][]byte{make([]byte, 32)}
+	if err := AddWitnessDelegation(coinbase, p.Candidate, p.Reward, p.CoreBlockHash()); err != nil {
+		t.Fatalf("AddWitnessDelegation error %v", err)
+	}
+	witness := &BtcLightMirrorV2{CoinBaseTx: *coinbase}
+	if got, err := witness.PowerParams(); err != nil || *got != *p {
+		t.Errorf("PowerParams of the witness: got %+v, error %v, want %+v", got, err, p)
+	}
+
+	if _, err := newTestMirror(chainhash.Hash{}, 1, 0).PowerParams(); !errors.Is(err, ErrNoPowerParams) {
+		t.Errorf("PowerParams: got error %v, want %v", err, ErrNoPowerParams)
+	}
+}
+
+func TestParsePowerParamsStrict(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	script := corePkScript(candidate, reward, coreBlockHash[:])
+	other := corePkScript(reward, candidate, coreBlockHash[:])
+	commitment := append(append([]byte(nil), witnessCommitmentHeader...), make([]byte, 32)...)
+
+	// newMirror returns a mirror whose coinbase has outputs of the given
+	// scripts following its first one, and the witness items following
+	// the reserved value.
+	newMirror := func(scripts [][]byte, items ...[]byte) *BtcLightMirrorV2 {
+		m := newTestMirror(chainhash.Hash{}, 1, 0)
+		for _, script := range scripts {
+			m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, script))
+		}
+		if items != nil {
+			m.CoinBaseTx.TxIn[0].Witness = append(wire.TxWitness{make([]byte, 32)}, items...)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name      string
+		m         *BtcLightMirrorV2
+		err       error
+		payloads  int
+		malformed int
+	}{
+		{"output", newMirror([][]byte{script}), nil, 0, 0},
+		{"repeated", newMirror([][]byte{script, script}), nil, 0, 0},
+		{"output and witness", newMirror([][]byte{commitment, script}, script[2:]), nil, 0, 0},
+		{"none", newMirror(nil), ErrNoPowerParams, 0, 0},
+		{"stripped", newMirror([][]byte{commitment}), ErrWitnessStripped, 0, 0},
+		{"truncated", newMirror([][]byte{script[:30]}), ErrMalformedPowerParams, 1, 1},
+		{"truncated and valid", newMirror([][]byte{script, script[:30]}), ErrMalformedPowerParams, 2, 1},
+		{"truncated witness", newMirror([][]byte{commitment}, script[2:40]), ErrMalformedPowerParams, 1, 1},
+		{"conflicting outputs", newMirror([][]byte{script, other}), ErrDelegationConflict, 2, 0},
+		{"conflicting witness", newMirror([][]byte{commitment, script}, other[2:]), ErrDelegationConflict, 2, 0},
+	}
+	for _, test := range tests {
+		gotCandidate, gotReward, gotHash, err := test.m.ParsePowerParamsStrict()
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParsePowerParamsStrict (%s): got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if test.err == nil {
+			if gotCandidate != candidate || gotReward != reward || gotHash != coreBlockHash {
+				t.Errorf("ParsePowerParamsStrict (%s): got %v %v %v, want %v %v %v", test.name,
+					gotCandidate, gotReward, gotHash, candidate, reward, coreBlockHash)
+			}
+			continue
+		}
+		var perr *PowerParamsError
+		if !errors.As(err, &perr) {
+			t.Errorf("ParsePowerParamsStrict (%s): got error %T, want *PowerParamsError", test.name, err)
+			continue
+		}
+		if perr.Payloads != test.payloads || perr.Malformed != test.malformed {
+			t.Errorf("ParsePowerParamsStrict (%s): got %d payloads, %d malformed, want %d, %d",
+				test.name, perr.Payloads, perr.Malformed, test.payloads, test.malformed)
+		}
+		if gotCandidate != (common.Address{}) || gotReward != (common.Address{}) || gotHash != (common.Hash{}) {
+			t.Errorf("ParsePowerParamsStrict (%s): got %v %v %v along with an error",
+				test.name, gotCandidate, gotReward, gotHash)
+		}
+	}
+}
+
+func TestParseAllPowerParams(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.HexToHash("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	v3, err := NewPowerPayload(reward, []WeightedReward{{candidate, 2}, {reward, 1}}, common.Hash{})
+	if err != nil {
+		t.Fatalf("NewPowerPayload error %v", err)
+	}
+	script := corePkScript(candidate, reward, coreBlockHash[:])
+	commitment := append(append([]byte(nil), witnessCommitmentHeader...), make([]byte, 32)...)
+
+	m := newTestMirror(chainhash.Hash{}, 1, 0)
+	if got := m.ParseAllPowerParams(); got != nil {
+		t.Errorf("ParseAllPowerParams of a coinbase without CORE outputs: got %+v", got)
+	}
+	for _, script := range [][]byte{script, commitment, script[:30], PowerScript(v3)} {
+		m.CoinBaseTx.AddTxOut(wire.NewTxOut(0, script))
+	}
+	m.CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32), script[2:]}
+
+	want := []PowerParams{
+		{Candidate: candidate, Reward: reward, RawBlockHash: coreBlockHash, OutputIndex: 1, Version: PowerPayloadV1, Tag: "CORE"},
+		{Candidate: reward, Reward: candidate, OutputIndex: 4, Version: PowerPayloadV3, Tag: "CORE"},
+	}
+	got := m.ParseAllPowerParams()
+	if len(got) != len(want) {
+		t.Fatalf("ParseAllPowerParams: got %d parameters, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ParseAllPowerParams #%d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// The first ones are those of ParsePowerParams.
+	gotCandidate, gotReward, gotHash := m.ParsePowerParams()
+	if gotCandidate != got[0].Candidate || gotReward != got[0].Reward || gotHash != got[0].CoreBlockHash() {
+		t.Errorf("ParsePowerParams: got %v %v %v, want %+v", gotCandidate, gotReward, gotHash, got[0])
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrTxNotInBlock is returned by FetchAndProve when the block does
+	// not hold the transaction.
+	ErrTxNotInBlock = errors.New("transaction not in block")
+
+	// ErrBranchMismatch is returned when the merkle branch of a
+	// transaction does not lead to the merkle root of the header.
+	ErrBranchMismatch = errors.New("merkle branch does not match the header")
+)
+
+// TxIDFetcher returns the transaction ids of the blocks of an upstream
+// source, coinbase first.
+type TxIDFetcher interface {
+	FetchTxIDs(ctx context.Context, hash chainhash.Hash) ([]chainhash.Hash, error)
+}
+
+// TxInclusionProof proves that the transaction TxID is the transaction at
+// Index in the block of Header.  Branch holds the siblings of the path from
+// the transaction to the merkle root, lowest first; the bits of Index, lowest
+// first, tell whether the path goes right at each level.
+type TxInclusionProof struct {
+	TxID   chainhash.Hash
+	Header wire.BlockHeader
+	Index  uint32
+	Branch []chainhash.Hash
+}
+
+// BlockHash returns the hash of the block the proof is about.
+func (p *TxInclusionProof) BlockHash() chainhash.Hash {
+	return p.Header.BlockHash()
+}
+
+// Verify checks that the branch of the proof leads from its transaction to
+// the merkle root of its header.  The errors wrap ErrBranchMismatch.
+func (p *TxInclusionProof) Verify() error {
+	err := VerifyMerkleProof(p.TxID, MerkleProof{Index: p.Index, Branch: p.Branch}, p.Header.MerkleRoot)
+	if err != nil {
+		return fmt.Errorf("block %v: %w", p.BlockHash(), err)
+	}
+	return nil
+}
+
+// MerkleProof is the merkle branch of the transaction at Index in a block.
+// Branch holds the siblings of the path from the transaction to the merkle
+// root, lowest first; the bits of Index, lowest first, tell whether the path
+// goes right at each level, where the sibling is the left node.  The branch
+// of index 0 is the one of the coinbase a mirror holds as its merkle nodes.
+type MerkleProof struct {
+	Index  uint32
+	Branch []chainhash.Hash
+}
+
+// GenerateMerkleProof returns the merkle proof of the transaction at txIndex
+// of txids, the hashes of all transactions of a block, coinbase first.  At
+// the odd end of a level the last node is its own sibling, as Bitcoin pairs
+// it with itself.
+func GenerateMerkleProof(txids []chainhash.Hash, txIndex int) (MerkleProof, error) {
+	if txIndex < 0 || txIndex >= len(txids) {
+		return MerkleProof{}, fmt.Errorf("transaction index %d out of range for "+
+			"a block of %d transactions", txIndex, len(txids))
+	}
+	return MerkleProof{Index: uint32(txIndex), Branch: txBranch(txids, txIndex)}, nil
+}
+
+// VerifyMerkleProof checks that proof leads from the transaction txid to
+// root, hashing the running node as the right node at the levels where the
+// bit of the index is set.  The errors wrap ErrBranchMismatch.
+func VerifyMerkleProof(txid chainhash.Hash, proof MerkleProof, root chainhash.Hash) error {
+	if len(proof.Branch) < 32 && proof.Index>>uint(len(proof.Branch)) != 0 {
+		return fmt.Errorf("index %d is beyond a branch of %d nodes: %w",
+			proof.Index, len(proof.Branch), ErrBranchMismatch)
+	}
+	if got := merkleProofRoot(txid, proof); got != root {
+		return fmt.Errorf("transaction %v at index %d: root %v, want %v: %w",
+			txid, proof.Index, got, root, ErrBranchMismatch)
+	}
+	return nil
+}
+
+// merkleProofRoot returns the merkle root proof leads to from txid.
+func merkleProofRoot(txid chainhash.Hash, proof MerkleProof) chainhash.Hash {
+	var scratch [chainhash.HashSize * 2]byte
+	node := txid
+	for i := range proof.Branch {
+		if proof.Index>>uint(i)&1 == 0 {
+			copy(scratch[:chainhash.HashSize], node[:])
+			copy(scratch[chainhash.HashSize:], proof.Branch[i][:])
+		} else {
+			copy(scratch[:chainhash.HashSize], proof.Branch[i][:])
+			copy(scratch[chainhash.HashSize:], node[:])
+		}
+		node = chainhash.DoubleHashH(scratch[:])
+	}
+	return node
+}
+
+// Serialize writes the proof to w: the 80 bytes of the header, the
+// transaction id, the index in 4 bytes little endian, then the varint
+// count of branch nodes followed by the nodes.
+func (p *TxInclusionProof) Serialize(w io.Writer) error {
+	if err := p.Header.Serialize(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.TxID[:]); err != nil {
+		return err
+	}
+	var index [4]byte
+	binary.LittleEndian.PutUint32(index[:], p.Index)
+	if _, err := w.Write(index[:]); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(p.Branch))); err != nil {
+		return err
+	}
+	for _, node := range p.Branch {
+		if _, err := w.Write(node[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads into the proof a proof written by Serialize.  It does
+// not verify it.
+func (p *TxInclusionProof) Deserialize(r io.Reader) error {
+	if err := p.Header.Deserialize(r); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, p.TxID[:]); err != nil {
+		return err
+	}
+	var index [4]byte
+	if _, err := io.ReadFull(r, index[:]); err != nil {
+		return err
+	}
+	p.Index = binary.LittleEndian.Uint32(index[:])
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if count > maxMerkleNode {
+		return fmt.Errorf("TxInclusionProof.Deserialize too many merkle nodes "+
+			"[count %d, max %d]", count, maxMerkleNode)
+	}
+	p.Branch = make([]chainhash.Hash, count)
+	for i := range p.Branch {
+		if _, err := io.ReadFull(r, p.Branch[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txBranch returns the merkle branch of the leaf at index of leaves, the
+// hashes of the block transactions.  At an odd level end, the last node is
+// its own sibling, as Bitcoin pairs it with itself.
+func txBranch(leaves []chainhash.Hash, index int) []chainhash.Hash {
+	branch := make([]chainhash.Hash, 0, getExponent(len(leaves)))
+	level := leaves
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		branch = append(branch, level[sibling])
+		next := make([]chainhash.Hash, (len(level)+1)/2)
+		for i := range next {
+			left := &level[2*i]
+			right := left
+			if 2*i+1 < len(level) {
+				right = &level[2*i+1]
+			}
+			next[i] = blockchain.HashMerkleBranches(left, right)
+		}
+		level = next
+		index /= 2
+	}
+	return branch
+}
+
+// FetchAndProve returns the proof that the transaction txid is in the block
+// blockHash of store.  The transaction ids of the block are fetched from
+// fetcher; the proof is built from them and verified against the header of
+// the stored mirror, so a lying fetcher can not produce a proof.
+//
+// It fails with ErrNotFound when store has no mirror of the block,
+// ErrTxNotInBlock when the fetched block does not hold the transaction, and
+// ErrBranchMismatch when the fetched transaction ids are not those of the
+// stored header.
+func FetchAndProve(ctx context.Context, fetcher TxIDFetcher, store Store, txid chainhash.Hash, blockHash chainhash.Hash) (TxInclusionProof, error) {
+	m, _, err := store.ByHash(blockHash)
+	if err != nil {
+		return TxInclusionProof{}, fmt.Errorf("block %v: %w", blockHash, err)
+	}
+	txids, err := fetcher.FetchTxIDs(ctx, blockHash)
+	if err != nil {
+		return TxInclusionProof{}, err
+	}
+	index := -1
+	for i := range txids {
+		if txids[i] == txid {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return TxInclusionProof{}, fmt.Errorf("transaction %v, block %v: %w",
+			txid, blockHash, ErrTxNotInBlock)
+	}
+
+	merkleProof, err := GenerateMerkleProof(txids, index)
+	if err != nil {
+		return TxInclusionProof{}, err
+	}
+	proof := TxInclusionProof{
+		TxID:   txid,
+		Header: m.BtcHeader,
+		Index:  merkleProof.Index,
+		Branch: merkleProof.Branch,
+	}
+	if err := proof.Verify(); err != nil {
+		return TxInclusionProof{}, err
+	}
+	return proof, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// txIDFetcher is a TxIDFetcher serving the transaction ids of its blocks.
+type txIDFetcher map[chainhash.Hash][]chainhash.Hash
+
+func (f txIDFetcher) FetchTxIDs(ctx context.Context, hash chainhash.Hash) ([]chainhash.Hash, error) {
+	txids, ok := f[hash]
+	if !ok {
+		return nil, ErrUnknownBlock
+	}
+	return txids, nil
+}
+
+// newProofBlock returns the mirror of a block of n transactions and their
+// ids, coinbase first.
+func newProofBlock(t *testing.T, seed byte, n int) (*BtcLightMirrorV2, []chainhash.Hash) {
+	t.Helper()
+	coinbase := newTestMirror(chainhash.Hash{}, uint32(seed), 0).CoinBaseTx
+	txids := []chainhash.Hash{coinbase.TxHash()}
+	for i := 1; i < n; i++ {
+		txids = append(txids, chainhash.DoubleHashH([]byte{seed, byte(i)}))
+	}
+	merkles := BuildMerkleTreeStore(&txids[0], txids[1:])
+	header := &wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1231006505, 0),
+		Bits:       0x207fffff,
+		Nonce:      uint32(seed),
+	}
+	m, err := New(header, &coinbase, txids)
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+	return m, txids
+}
+
+func TestFetchAndProve(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	fetcher := txIDFetcher{}
+	for i, n := range []int{1, 2, 3, 5, 7, 8, 13} {
+		m, txids := newProofBlock(t, byte(i), n)
+		hash := m.BtcHeader.BlockHash()
+		if err := store.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put error %v", err)
+		}
+		fetcher[hash] = txids
+
+		for index, txid := range txids {
+			proof, err := FetchAndProve(ctx, fetcher, store, txid, hash)
+			if err != nil {
+				t.Fatalf("FetchAndProve (%d txs) #%d error %v", n, index, err)
+			}
+			if proof.Index != uint32(index) || proof.TxID != txid || proof.BlockHash() != hash ||
+				len(proof.Branch) != getExponent(n) {
+				t.Errorf("FetchAndProve (%d txs) #%d: got %+v", n, index, proof)
+			}
+			if index == 0 && !reflect.DeepEqual(proof.Branch, append([]chainhash.Hash{}, m.MerkleNodes...)) {
+				t.Errorf("FetchAndProve (%d txs): coinbase branch %v, mirror has %v", n,
+					proof.Branch, m.MerkleNodes)
+			}
+
+			var buf bytes.Buffer
+			if err := proof.Serialize(&buf); err != nil {
+				t.Fatalf("Serialize error %v", err)
+			}
+			var decoded TxInclusionProof
+			if err := decoded.Deserialize(&buf); err != nil {
+				t.Fatalf("Deserialize error %v", err)
+			}
+			if !reflect.DeepEqual(decoded, proof) || buf.Len() != 0 {
+				t.Errorf("Deserialize (%d txs) #%d: got %+v, want %+v", n, index, decoded, proof)
+			}
+			if err := decoded.Verify(); err != nil {
+				t.Errorf("Verify (%d txs) #%d error %v", n, index, err)
+			}
+		}
+	}
+}
+
+func TestFetchAndProveErrors(t *testing.T) {
+	ctx := context.Background()
+	m, txids := newProofBlock(t, 1, 5)
+	hash := m.BtcHeader.BlockHash()
+	store := newMemStore()
+	if err := store.Put(m, 0); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	other, otherTxids := newProofBlock(t, 2, 5)
+
+	tests := []struct {
+		name    string
+		fetcher txIDFetcher
+		txid    chainhash.Hash
+		hash    chainhash.Hash
+		err     error
+	}{
+		{"not stored", txIDFetcher{other.BtcHeader.BlockHash(): otherTxids}, otherTxids[1],
+			other.BtcHeader.BlockHash(), ErrNotFound},
+		{"not in block", txIDFetcher{hash: txids}, otherTxids[1], hash, ErrTxNotInBlock},
+		{"other block", txIDFetcher{hash: otherTxids}, otherTxids[1], hash, ErrBranchMismatch},
+		{"missing tx", txIDFetcher{hash: txids[:4]}, txids[1], hash, ErrBranchMismatch},
+		{"fetch", txIDFetcher{}, txids[1], hash, ErrUnknownBlock},
+	}
+	for _, test := range tests {
+		_, err := FetchAndProve(ctx, test.fetcher, store, test.txid, test.hash)
+		if !errors.Is(err, test.err) {
+			t.Errorf("FetchAndProve (%s): got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestTxInclusionProofVerify(t *testing.T) {
+	m, txids := newProofBlock(t, 1, 6)
+	proof := TxInclusionProof{
+		TxID:   txids[3],
+		Header: m.BtcHeader,
+		Index:  3,
+		Branch: txBranch(txids, 3),
+	}
+	if err := proof.Verify(); err != nil {
+		t.Fatalf("Verify error %v", err)
+	}
+
+	tamper := []struct {
+		name   string
+		modify func(p *TxInclusionProof)
+	}{
+		{"index", func(p *TxInclusionProof) { p.Index = 2 }},
+		{"index beyond branch", func(p *TxInclusionProof) { p.Index = 3 + 8 }},
+		{"txid", func(p *TxInclusionProof) { p.TxID = txids[2] }},
+		{"branch node", func(p *TxInclusionProof) { p.Branch[1][0] ^= 1 }},
+		{"short branch", func(p *TxInclusionProof) { p.Branch = p.Branch[:2] }},
+		{"header", func(p *TxInclusionProof) { p.Header.MerkleRoot[0] ^= 1 }},
+	}
+	for _, test := range tamper {
+		p := proof
+		p.Branch = append([]chainhash.Hash(nil), proof.Branch...)
+		test.modify(&p)
+		if err := p.Verify(); !errors.Is(err, ErrBranchMismatch) {
+			t.Errorf("Verify (%s): got error %v, want %v", test.name, err, ErrBranchMismatch)
+		}
+	}
+
+	data := bytes.Repeat([]byte{0}, wire.MaxBlockHeaderPayload+chainhash.HashSize+4)
+	data = append(data, maxMerkleNode+1)
+	var decoded TxInclusionProof
+	if err := decoded.Deserialize(bytes.NewReader(data)); err == nil {
+		t.Errorf("Deserialize: no error for %d branch nodes", maxMerkleNode+1)
+	}
+}
+
+func TestGenerateMerkleProof(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		m, txids := newProofBlock(t, byte(n), n)
+		for index := range txids {
+			proof, err := GenerateMerkleProof(txids, index)
+			if err != nil {
+				t.Fatalf("GenerateMerkleProof (%d transactions) #%d error %v", n, index, err)
+			}
+			if len(proof.Branch) != len(m.MerkleNodes) {
+				t.Errorf("GenerateMerkleProof (%d transactions) #%d: got %d nodes, want %d",
+					n, index, len(proof.Branch), len(m.MerkleNodes))
+			}
+			if err := VerifyMerkleProof(txids[index], proof, m.BtcHeader.MerkleRoot); err != nil {
+				t.Errorf("VerifyMerkleProof (%d transactions) #%d error %v", n, index, err)
+			}
+			if index == 0 && !reflect.DeepEqual(proof.Branch, m.MerkleNodes) {
+				t.Errorf("GenerateMerkleProof (%d transactions): got coinbase branch %v, want %v",
+					n, proof.Branch, m.MerkleNodes)
+			}
+		}
+	}
+
+	_, txids := newProofBlock(t, 1, 3)
+	for _, index := range []int{-1, 3} {
+		if _, err := GenerateMerkleProof(txids, index); err == nil {
+			t.Errorf("GenerateMerkleProof #%d of 3 transactions: expected error", index)
+		}
+	}
+	if _, err := GenerateMerkleProof(nil, 0); err == nil {
+		t.Errorf("GenerateMerkleProof of no transactions: expected error")
+	}
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	m, txids := newProofBlock(t, 2, 7)
+	root := m.BtcHeader.MerkleRoot
+
+	// The last transaction is paired with itself at the first level, so
+	// its sibling is its own id.
+	proof, _ := GenerateMerkleProof(txids, 6)
+	if proof.Branch[0] != txids[6] {
+		t.Errorf("GenerateMerkleProof #6: got sibling %v, want the transaction itself", proof.Branch[0])
+	}
+	for i := 1; i < 6; i++ {
+		proof, _ := GenerateMerkleProof(txids, i)
+		for j := i - 1; j <= i+1; j += 2 {
+			wrong := MerkleProof{Index: uint32(j), Branch: proof.Branch}
+			if err := VerifyMerkleProof(txids[i], wrong, root); !errors.Is(err, ErrBranchMismatch) {
+				t.Errorf("VerifyMerkleProof #%d at index %d: got error %v, want %v", i, j, err, ErrBranchMismatch)
+			}
+		}
+		if err := VerifyMerkleProof(txids[i], proof, chainhash.Hash{}); !errors.Is(err, ErrBranchMismatch) {
+			t.Errorf("VerifyMerkleProof #%d against another root: got error %v, want %v", i, err, ErrBranchMismatch)
+		}
+	}
+	if err := VerifyMerkleProof(txids[0], MerkleProof{Index: 8, Branch: m.MerkleNodes}, root); !errors.Is(err, ErrBranchMismatch) {
+		t.Errorf("VerifyMerkleProof of an index beyond the branch: got error %v, want %v", err, ErrBranchMismatch)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrPruned is returned when the coinbase or merkle branch of a mirror that
+// was pruned down to its header is needed.
+var ErrPruned = errors.New("mirror is pruned")
+
+// PrunedMirrorSize is the serialized size of a PrunedMirror.  A serialized
+// BtcLightMirrorV2 is always larger, which lets stores tell both apart.
+const PrunedMirrorSize = wire.MaxBlockHeaderPayload
+
+// PrunedMirror is the header-only form of a mirror, kept for blocks deep
+// enough that only their proof of work still matters.
+type PrunedMirror struct {
+	BtcHeader wire.BlockHeader
+}
+
+// Prune returns the header-only form of the mirror.
+func (light *BtcLightMirrorV2) Prune() *PrunedMirror {
+	return &PrunedMirror{BtcHeader: light.BtcHeader}
+}
+
+func (pruned *PrunedMirror) Deserialize(r io.Reader) error {
+	return pruned.BtcHeader.Deserialize(r)
+}
+
+func (pruned *PrunedMirror) Serialize(w io.Writer) error {
+	return pruned.BtcHeader.Serialize(w)
+}
+
+// ParsePowerParams always fails with ErrPruned: the coinbase holding the
+// power parameters is gone.
+func (pruned *PrunedMirror) ParsePowerParams() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, err error) {
+	return candidateAddr, rewardAddr, blockHash, ErrPruned
+}
+
+// CheckMerkle always fails with ErrPruned: the coinbase and merkle branch
+// are gone.
+func (pruned *PrunedMirror) CheckMerkle() error {
+	return ErrPruned
+}
+
+// PruningStore is a Store able to replace the mirrors it holds by their
+// header.  Its ByHash, ByHeight and Tip methods return ErrPruned for pruned
+// mirrors; ByHash and Tip still return the height of the mirror with it.
+type PruningStore interface {
+	Store
+
+	// Prune replaces the mirror with the given block hash by its
+	// PrunedMirror form.  Pruning a pruned mirror is not an error, and
+	// putting the full mirror again undoes the pruning.
+	Prune(hash chainhash.Hash) error
+
+	// PrunedByHeight returns the header-only form of the mirror stored at
+	// the given height, whether it is pruned or not.
+	PrunedByHeight(height int64) (*PrunedMirror, error)
+}
+
+// WithPruneDepth makes the chain prune the best chain blocks that are at
+// least depth blocks below the tip down to their header.  The anchor is
+// never pruned.  A depth of zero, the default, disables pruning.
+//
+// Pruning requires the store of the chain, if any, to be a PruningStore.
+// Reorganizations and rollbacks can not disconnect pruned blocks.
+func WithPruneDepth(depth int64) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.pruneDepth = depth
+	}
+}
+
+// prune prunes the best chain blocks that went past the pruning depth,
+// lowest first, and records progress after every block.  It stops at the
+// first header-only block, whose body is still expected.  Since pruning is
+// idempotent and the store is only told to prune blocks in height order, an
+// interrupted run is simply resumed by the next one.
+func (c *MirrorChain) prune() error {
+	if c.cfg.pruneDepth == 0 {
+		return nil
+	}
+	store, _ := c.cfg.store.(PruningStore)
+	for height := c.pruneHeight + 1; height <= c.tip.height-c.cfg.pruneDepth; height++ {
+		hash, _ := c.best.HashAtHeight(height)
+		e := c.index[hash]
+		if e.headerOnly {
+			break
+		}
+		if !e.pruned {
+			if store != nil {
+				if err := store.Prune(hash); err != nil {
+					return fmt.Errorf("prune block %v: %w", hash, err)
+				}
+			}
+			e.mirror = nil
+			e.pruned = true
+		}
+		c.pruneHeight = height
+	}
+	return nil
+}
+
+// HeaderByHash returns the header of the block with the given hash and its
+// height.  Unlike ByHash it also serves pruned blocks.
+func (c *MirrorChain) HeaderByHash(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return nil, 0, ErrUnknownBlock
+	}
+	header := e.header
+	return &header, e.height, nil
+}
+
+// HeaderByHeight returns the header of the best chain block at the given
+// height.  Unlike ByHeight it also serves pruned blocks.
+func (c *MirrorChain) HeaderByHeight(height int64) (*wire.BlockHeader, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	hash, err := c.best.HashAtHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	header := c.index[hash].header
+	return &header, nil
+}
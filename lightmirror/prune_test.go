@@ -0,0 +1,189 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestPrunedMirror(t *testing.T) {
+	m := newTestMirror(mainNetGenesisHash, 1, 2)
+	pruned := m.Prune()
+
+	var buf bytes.Buffer
+	if err := pruned.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	if buf.Len() != PrunedMirrorSize {
+		t.Errorf("Serialize: got %d bytes, want %d", buf.Len(), PrunedMirrorSize)
+	}
+	if full := serializeMirror(t, m); len(full) <= PrunedMirrorSize {
+		t.Errorf("Serialize full mirror: got %d bytes, want more than %d",
+			len(full), PrunedMirrorSize)
+	}
+
+	var decoded PrunedMirror
+	if err := decoded.Deserialize(&buf); err != nil {
+		t.Fatalf("Deserialize error %v", err)
+	}
+	if decoded.BtcHeader.BlockHash() != m.BtcHeader.BlockHash() {
+		t.Errorf("Deserialize: got %v, want %v", decoded.BtcHeader.BlockHash(),
+			m.BtcHeader.BlockHash())
+	}
+
+	if err := pruned.CheckMerkle(); !errors.Is(err, ErrPruned) {
+		t.Errorf("CheckMerkle: got error %v, want %v", err, ErrPruned)
+	}
+	if _, _, _, err := pruned.ParsePowerParams(); !errors.Is(err, ErrPruned) {
+		t.Errorf("ParsePowerParams: got error %v, want %v", err, ErrPruned)
+	}
+}
+
+func TestChainPrune(t *testing.T) {
+	const depth = 3
+	mirrors := newTestMirrors(8)
+	store := newMemStore()
+	c := newTestChain(t, mirrors, WithStore(store), WithPruneDepth(depth))
+
+	// Blocks 1 to 4 are at least depth blocks below the tip at 7.
+	for i, m := range mirrors {
+		hash := m.BtcHeader.BlockHash()
+		height := testAnchorHeight + int64(i)
+		wantPruned := i > 0 && i <= len(mirrors)-1-depth
+
+		_, _, chainErr := c.ByHash(hash)
+		_, storeErr := store.ByHeight(height)
+		if wantPruned {
+			if !errors.Is(chainErr, ErrPruned) || !errors.Is(storeErr, ErrPruned) {
+				t.Errorf("block #%d: got errors %v and %v, want %v", i,
+					chainErr, storeErr, ErrPruned)
+			}
+		} else if chainErr != nil || storeErr != nil {
+			t.Errorf("block #%d: got errors %v and %v", i, chainErr, storeErr)
+		}
+
+		header, err := c.HeaderByHeight(height)
+		if err != nil || header.BlockHash() != hash {
+			t.Errorf("HeaderByHeight #%d: got error %v or wrong header", i, err)
+		}
+		if _, got, err := c.HeaderByHash(hash); err != nil || got != height {
+			t.Errorf("HeaderByHash #%d: got height %d, error %v", i, got, err)
+		}
+	}
+
+	// Pruned blocks can not be disconnected.
+	branch := newTestBranch(mirrors[3], 1000, 6)
+	for i, m := range branch[:4] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append branch #%d error %v", i, err)
+		}
+	}
+	if _, err := c.Append(branch[4]); !errors.Is(err, ErrPruned) {
+		t.Errorf("Append reorg past pruned: got error %v, want %v", err,
+			ErrPruned)
+	}
+	if _, err := c.Rollback(depth + 1); !errors.Is(err, ErrPruned) {
+		t.Errorf("Rollback past pruned: got error %v, want %v", err, ErrPruned)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+7 {
+		t.Errorf("Tip: got height %d", height)
+	}
+	checkStorePruned(t, c, store)
+}
+
+// TestChainPruneResume checks that pruning interrupted by a failing store
+// catches up, both on the next Append and when the chain is reloaded.
+func TestChainPruneResume(t *testing.T) {
+	const depth = 2
+	mirrors := newTestMirrors(10)
+	store := newMemStore()
+	c := newTestChain(t, mirrors[:5], WithStore(store), WithPruneDepth(depth))
+
+	store.pruneErr = errors.New("disk full")
+	event, err := c.Append(mirrors[5])
+	if !errors.Is(err, store.pruneErr) || event != nil {
+		t.Fatalf("Append: got %v, %v, want error %v", event, err,
+			store.pruneErr)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+5 {
+		t.Errorf("Tip: got height %d, want the mirror appended", height)
+	}
+	store.pruneErr = nil
+	if _, err := c.Append(mirrors[6]); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	checkStorePruned(t, c, store)
+
+	// The blocks appended while pruning fails are pruned once the chain is
+	// reloaded.
+	store.pruneErr = errors.New("disk full")
+	for _, m := range mirrors[7:] {
+		if _, err := c.Append(m); !errors.Is(err, store.pruneErr) {
+			t.Fatalf("Append: got error %v, want %v", err, store.pruneErr)
+		}
+	}
+	store.pruneErr = nil
+
+	c, err = NewMirrorChain(mirrors[0], testAnchorHeight,
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store),
+		WithPruneDepth(depth))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+9 {
+		t.Errorf("Tip: got height %d after reload", height)
+	}
+	checkStorePruned(t, c, store)
+
+	// The pruned blocks survive a reload without pruning too.
+	c, err = NewMirrorChain(mirrors[0], testAnchorHeight,
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+9 {
+		t.Errorf("Tip: got height %d after reload", height)
+	}
+	if _, err := c.ByHeight(testAnchorHeight + 1); !errors.Is(err, ErrPruned) {
+		t.Errorf("ByHeight pruned: got error %v, want %v", err, ErrPruned)
+	}
+}
+
+func TestChainPruneStore(t *testing.T) {
+	anchor := newTestMirrors(1)[0]
+	_, err := NewMirrorChain(anchor, testAnchorHeight,
+		WithStore(struct{ Store }{newMemStore()}), WithPruneDepth(1))
+	if err == nil {
+		t.Errorf("NewMirrorChain: expected error for a store that can not prune")
+	}
+	if _, err := NewMirrorChain(anchor, testAnchorHeight, WithPruneDepth(-1)); err == nil {
+		t.Errorf("NewMirrorChain: expected error for a negative depth")
+	}
+}
+
+// checkStorePruned asserts that store holds the best chain of c, pruned
+// exactly where c is.
+func checkStorePruned(t *testing.T, c *MirrorChain, store *memStore) {
+	t.Helper()
+	_, tipHeight := c.Tip()
+	for height := int64(testAnchorHeight); height <= tipHeight; height++ {
+		hash, _ := c.HashAtHeight(height)
+		pruned, err := store.PrunedByHeight(height)
+		if err != nil || pruned.BtcHeader.BlockHash() != hash {
+			t.Errorf("store.PrunedByHeight(%d): got error %v or wrong header",
+				height, err)
+		}
+		_, chainErr := c.ByHeight(height)
+		_, storeErr := store.ByHeight(height)
+		if errors.Is(chainErr, ErrPruned) != errors.Is(storeErr, ErrPruned) {
+			t.Errorf("height %d: chain error %v, store error %v", height,
+				chainErr, storeErr)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// maxScanScriptSize and maxScanScriptTotal bound the size of a script
+	// or witness item, and of all of them, as MsgTx.Deserialize does, so
+	// that it decodes whatever scanTx accepts.
+	maxScanScriptSize  = 4000000
+	maxScanScriptTotal = 1 << 22
+)
+
+// txScanner reads the bytes of a transaction without decoding it, keeping
+// them as read and, unless rawOnly is set, with its variable length
+// integers canonically re-encoded.
+type txScanner struct {
+	r         io.Reader
+	raw       []byte
+	canonical []byte
+	rawOnly   bool
+	buf       [8]byte
+
+	inputs, outputs uint64
+	scripts         uint64
+}
+
+// scanTx reads a transaction in the witness encoding of MsgTx.Deserialize
+// from r, accepting variable length integers which are not canonically
+// encoded, as Bitcoin nodes did before they required it.  It returns the
+// bytes read, appended to raw, and the canonical encoding of the same
+// transaction, appended to canonical, which MsgTx.Deserialize decodes
+// without error: anything else MsgTx.Deserialize rejects, scanTx rejects
+// too.
+func scanTx(r io.Reader, raw, canonical []byte) ([]byte, []byte, error) {
+	s := &txScanner{r: r, raw: raw, canonical: canonical}
+	err := s.scan()
+	return s.raw, s.canonical, err
+}
+
+// scanCoinbase reads a coinbase as scanTx does, without its canonical
+// encoding, and checks the invariants of VerifyInvariants on it.  It
+// returns the bytes read, appended to raw.
+func scanCoinbase(r io.Reader, raw []byte) ([]byte, error) {
+	s := &txScanner{r: r, raw: raw, rawOnly: true}
+	if err := s.scan(); err != nil {
+		return s.raw, err
+	}
+	return s.raw, verifyTxCounts(s.inputs, s.outputs)
+}
+
+func (s *txScanner) scan() error {
+	// The version.
+	if err := s.copy(4); err != nil {
+		return err
+	}
+	count, err := s.varInt()
+	if err != nil {
+		return err
+	}
+	witness := false
+	if count == wire.TxFlagMarker {
+		if err := s.copy(1); err != nil {
+			return err
+		}
+		if flag := s.raw[len(s.raw)-1]; wire.TxFlag(flag) != wire.WitnessFlag {
+			return fmt.Errorf("witness coinbase but flag byte is %x", flag)
+		}
+		witness = true
+		if count, err = s.varInt(); err != nil {
+			return err
+		}
+	}
+	if count > maxDecodeTxIn {
+		return fmt.Errorf("coinbase has too many inputs to fit into max "+
+			"message size [count %d, max %d]", count, maxDecodeTxIn)
+	}
+	s.inputs = count
+	for i := uint64(0); i < s.inputs; i++ {
+		// The outpoint, the signature script and the sequence.
+		if err := s.copy(chainhash.HashSize + 4); err != nil {
+			return err
+		}
+		if err := s.script(); err != nil {
+			return err
+		}
+		if err := s.copy(4); err != nil {
+			return err
+		}
+	}
+
+	if count, err = s.varInt(); err != nil {
+		return err
+	}
+	if count > maxDecodeTxOut {
+		return fmt.Errorf("coinbase has too many outputs to fit into max "+
+			"message size [count %d, max %d]", count, maxDecodeTxOut)
+	}
+	s.outputs = count
+	for i := uint64(0); i < count; i++ {
+		// The value and the pkScript.
+		if err := s.copy(8); err != nil {
+			return err
+		}
+		if err := s.script(); err != nil {
+			return err
+		}
+	}
+
+	if witness {
+		witnessed := false
+		for i := uint64(0); i < s.inputs; i++ {
+			items, err := s.varInt()
+			if err != nil {
+				return err
+			}
+			if items > maxDecodeWitnessItems {
+				return fmt.Errorf("coinbase has too many witness items to "+
+					"fit into max message size [count %d, max %d]", items,
+					maxDecodeWitnessItems)
+			}
+			witnessed = witnessed || items > 0
+			for j := uint64(0); j < items; j++ {
+				if err := s.script(); err != nil {
+					return err
+				}
+			}
+		}
+		if !witnessed {
+			return errors.New("witness flag set on a coinbase without witnesses")
+		}
+	}
+
+	// The lock time.
+	return s.copy(4)
+}
+
+// copy reads n bytes, which are the same in both encodings.
+func (s *txScanner) copy(n int) error {
+	start := len(s.raw)
+	s.raw = append(s.raw, make([]byte, n)...)
+	if _, err := io.ReadFull(s.r, s.raw[start:]); err != nil {
+		return noEOF(err)
+	}
+	if !s.rawOnly {
+		s.canonical = append(s.canonical, s.raw[start:]...)
+	}
+	return nil
+}
+
+// script reads a variable length script, read in bounded chunks so that a
+// size larger than what r holds fails before allocating it.
+func (s *txScanner) script() error {
+	size, err := s.varInt()
+	if err != nil {
+		return err
+	}
+	if size > maxScanScriptSize {
+		return fmt.Errorf("coinbase script is larger than the max allowed "+
+			"size [count %d, max %d]", size, maxScanScriptSize)
+	}
+	s.scripts += size
+	if s.scripts > maxScanScriptTotal {
+		return fmt.Errorf("coinbase scripts are larger than the max allowed "+
+			"total [count %d, max %d]", s.scripts, maxScanScriptTotal)
+	}
+	for size > 0 {
+		n := size
+		if n > 4096 {
+			n = 4096
+		}
+		if err := s.copy(int(n)); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+// varInt reads a variable length integer in any of its encodings and writes
+// it canonically.
+func (s *txScanner) varInt() (uint64, error) {
+	start := len(s.raw)
+	if err := s.read(1); err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch discriminant := s.raw[start]; discriminant {
+	case 0xff:
+		if err := s.read(8); err != nil {
+			return 0, err
+		}
+		n = binary.LittleEndian.Uint64(s.raw[start+1:])
+	case 0xfe:
+		if err := s.read(4); err != nil {
+			return 0, err
+		}
+		n = uint64(binary.LittleEndian.Uint32(s.raw[start+1:]))
+	case 0xfd:
+		if err := s.read(2); err != nil {
+			return 0, err
+		}
+		n = uint64(binary.LittleEndian.Uint16(s.raw[start+1:]))
+	default:
+		n = uint64(discriminant)
+	}
+	if s.rawOnly {
+		return n, nil
+	}
+	var size int
+	switch {
+	case n < 0xfd:
+		s.canonical = append(s.canonical, byte(n))
+		return n, nil
+	case n <= 0xffff:
+		s.canonical, size = append(s.canonical, 0xfd), 2
+	case n <= 0xffffffff:
+		s.canonical, size = append(s.canonical, 0xfe), 4
+	default:
+		s.canonical, size = append(s.canonical, 0xff), 8
+	}
+	binary.LittleEndian.PutUint64(s.buf[:], n)
+	s.canonical = append(s.canonical, s.buf[:size]...)
+	return n, nil
+}
+
+// read reads n bytes into raw only.
+func (s *txScanner) read(n int) error {
+	if _, err := io.ReadFull(s.r, s.buf[:n]); err != nil {
+		return noEOF(err)
+	}
+	s.raw = append(s.raw, s.buf[:n]...)
+	return nil
+}
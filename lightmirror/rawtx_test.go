@@ -0,0 +1,224 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// nonCanonicalMirror returns the serialization of a mirror whose coinbase
+// has no witness, and the same serialization with the input count of the
+// coinbase in a three byte encoding, as historical transactions could have
+// it.
+func nonCanonicalMirror(t *testing.T) (canonical, nonCanonical []byte) {
+	t.Helper()
+	m := newTestMirror(chainhash.Hash{0x01}, 1, 5)
+	for _, txIn := range m.CoinBaseTx.TxIn {
+		txIn.Witness = nil
+	}
+	canonical, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	// The input count follows the header and the coinbase version.
+	at := 80 + 4
+	if n := canonical[at]; int(n) != len(m.CoinBaseTx.TxIn) {
+		t.Fatalf("input count: got %d, want %d", n, len(m.CoinBaseTx.TxIn))
+	}
+	nonCanonical = append(nonCanonical, canonical[:at]...)
+	nonCanonical = append(nonCanonical, 0xfd, canonical[at], 0x00)
+	nonCanonical = append(nonCanonical, canonical[at+1:]...)
+	return canonical, nonCanonical
+}
+
+func TestRetainRawCoinbase(t *testing.T) {
+	canonical, nonCanonical := nonCanonicalMirror(t)
+	opts := DeserializeOptions{RetainRawCoinbase: true, RejectTrailingBytes: true}
+
+	// Without the raw bytes the coinbase does not decode.
+	var m BtcLightMirrorV2
+	if err := m.Deserialize(bytes.NewReader(nonCanonical)); err == nil {
+		t.Fatalf("Deserialize: expected error for a non canonical coinbase")
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"canonical", canonical},
+		{"non canonical", nonCanonical},
+	} {
+		m, err := DeserializeBytesWith(test.data, opts)
+		if err != nil {
+			t.Fatalf("DeserializeBytesWith (%s) error %v", test.name, err)
+		}
+		// The coinbase is only decoded when read.
+		if !m.coinbasePending || len(m.CoinBaseTx.TxIn) != 0 {
+			t.Errorf("DeserializeBytesWith (%s): the coinbase is decoded", test.name)
+		}
+		if got, _ := m.ToBytes(); !bytes.Equal(got, test.data) || !m.coinbasePending {
+			t.Errorf("ToBytes (%s) before decoding: got %x, want %x", test.name, got, test.data)
+		}
+		want, _ := DeserializeBytes(canonical)
+		if !m.Equal(want) {
+			t.Errorf("DeserializeBytesWith (%s): got %v", test.name, m.Diff(want))
+		}
+		if m.coinbasePending {
+			t.Errorf("Equal (%s): the coinbase is left undecoded", test.name)
+		}
+		if m.SerializeSize() != len(test.data) {
+			t.Errorf("SerializeSize (%s): got %d, want %d", test.name, m.SerializeSize(), len(test.data))
+		}
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil || !bytes.Equal(buf.Bytes(), test.data) {
+			t.Errorf("Serialize (%s): got %x, error %v, want %x", test.name, buf.Bytes(), err, test.data)
+		}
+		if got, _ := m.Clone().ToBytes(); !bytes.Equal(got, test.data) {
+			t.Errorf("Clone (%s): got %x, want %x", test.name, got, test.data)
+		}
+
+		var d MirrorDecoder
+		d.Options = opts
+		var dst BtcLightMirrorV2
+		if err := d.Decode(bytes.NewReader(test.data), &dst); err != nil {
+			t.Fatalf("Decode (%s) error %v", test.name, err)
+		}
+		if got, _ := dst.ToBytes(); !bytes.Equal(got, test.data) {
+			t.Errorf("Decode (%s): got %x, want %x", test.name, got, test.data)
+		}
+
+		if got, _ := dst.Clone().ToBytes(); !bytes.Equal(got, test.data) {
+			t.Errorf("Decode (%s) clone: got %x, want %x", test.name, got, test.data)
+		}
+		if err := dst.VerifyInvariants(); err != nil || dst.coinbasePending {
+			t.Errorf("VerifyInvariants (%s): error %v, coinbase pending %v", test.name,
+				err, dst.coinbasePending)
+		}
+
+		// A modified coinbase is serialized rather than the raw bytes,
+		// and they are back once the modification is undone.
+		m.CoinBaseTx.LockTime++
+		modified := want.Clone()
+		modified.CoinBaseTx.LockTime++
+		wantModified, _ := modified.ToBytes()
+		if got, _ := m.ToBytes(); !bytes.Equal(got, wantModified) || m.RawCoinbase() != nil {
+			t.Errorf("ToBytes (%s) of a modified coinbase: got %x, want %x", test.name, got, wantModified)
+		}
+		if m.SerializeSize() != len(wantModified) {
+			t.Errorf("SerializeSize (%s) of a modified coinbase: got %d, want %d", test.name,
+				m.SerializeSize(), len(wantModified))
+		}
+		m.CoinBaseTx.LockTime--
+		if got, _ := m.ToBytes(); !bytes.Equal(got, test.data) {
+			t.Errorf("ToBytes (%s) of a restored coinbase: got %x, want %x", test.name, got, test.data)
+		}
+	}
+
+	// A clone owns its raw coinbase.
+	m1, _ := DeserializeBytesWith(nonCanonical, opts)
+	clone := m1.Clone()
+	clone.rawCoinbase[0] ^= 0xff
+	if m1.rawCoinbase[0] == clone.rawCoinbase[0] {
+		t.Errorf("Clone: the raw coinbase is shared")
+	}
+}
+
+func TestScanTxTruncated(t *testing.T) {
+	_, nonCanonical := nonCanonicalMirror(t)
+	m, err := DeserializeBytesWith(nonCanonical, DeserializeOptions{RetainRawCoinbase: true})
+	if err != nil {
+		t.Fatalf("DeserializeBytesWith error %v", err)
+	}
+	raw := m.RawCoinbase()
+	for n := range raw {
+		if _, _, err := scanTx(bytes.NewReader(raw[:n]), nil, nil); err == nil {
+			t.Fatalf("scanTx of %d bytes of %d: expected error", n, len(raw))
+		}
+	}
+	got, canonical, err := scanTx(bytes.NewReader(raw), nil, nil)
+	if err != nil || !bytes.Equal(got, raw) || len(canonical) != len(raw)-2 {
+		t.Errorf("scanTx: got %x and %x, error %v", got, canonical, err)
+	}
+}
+
+// witnessTx returns the serialization of a transaction in the witness
+// encoding, with the flag byte, an input per signature script, each with
+// the witness items, and an output.
+func witnessTx(flag byte, sigScripts [][]byte, witness [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{1, 0, 0, 0, 0, flag})
+	_ = wire.WriteVarInt(&buf, 0, uint64(len(sigScripts)))
+	for _, script := range sigScripts {
+		buf.Write(make([]byte, chainhash.HashSize+4))
+		_ = wire.WriteVarBytes(&buf, 0, script)
+		buf.Write(make([]byte, 4))
+	}
+	buf.Write([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	for range sigScripts {
+		_ = wire.WriteVarInt(&buf, 0, uint64(len(witness)))
+		for _, item := range witness {
+			_ = wire.WriteVarBytes(&buf, 0, item)
+		}
+	}
+	buf.Write(make([]byte, 4))
+	return buf.Bytes()
+}
+
+func TestScanTxRejectsWhatWireRejects(t *testing.T) {
+	// A script length past the limit, with no script following it.
+	oversized := witnessTx(1, [][]byte{{0x51}}, [][]byte{{0x01}})
+	oversized = append(oversized[:6+1+chainhash.HashSize+4:6+1+chainhash.HashSize+4],
+		0xfe, 0x01, 0x09, 0x3d, 0x00)
+
+	tests := []struct {
+		name string
+		data []byte
+		// wire panics on scripts past the total it decodes into.
+		wirePanics bool
+	}{
+		{"flag byte", witnessTx(2, [][]byte{{0x51}}, [][]byte{{0x01}}), false},
+		{"superfluous witness", witnessTx(1, [][]byte{{0x51}, {0x52}}, nil), false},
+		{"script size", oversized, false},
+		{"script total", witnessTx(1, [][]byte{make([]byte, 2200000),
+			make([]byte, 2200000)}, [][]byte{{0x01}}), true},
+	}
+	valid := witnessTx(1, [][]byte{{0x51}}, [][]byte{{0x01}})
+	if _, canonical, err := scanTx(bytes.NewReader(valid), nil, nil); err != nil ||
+		!bytes.Equal(canonical, valid) {
+		t.Fatalf("scanTx: got %x, error %v, want %x", canonical, err, valid)
+	}
+	if err := new(wire.MsgTx).Deserialize(bytes.NewReader(valid)); err != nil {
+		t.Fatalf("Deserialize error %v", err)
+	}
+	for _, test := range tests {
+		if _, _, err := scanTx(bytes.NewReader(test.data), nil, nil); err == nil {
+			t.Errorf("scanTx (%s): expected error", test.name)
+		}
+		if _, err := scanCoinbase(bytes.NewReader(test.data), nil); err == nil {
+			t.Errorf("scanCoinbase (%s): expected error", test.name)
+		}
+		if !test.wirePanics {
+			if err := new(wire.MsgTx).Deserialize(bytes.NewReader(test.data)); err == nil {
+				t.Errorf("Deserialize (%s): expected error", test.name)
+			}
+		}
+	}
+
+	// A coinbase without outputs scans, but is no coinbase.
+	noOutput := append([]byte{}, valid...)
+	at := 6 + 1 + chainhash.HashSize + 4 + 2 + 4
+	noOutput = append(append(noOutput[:at:at], 0), noOutput[at+10:]...)
+	if _, _, err := scanTx(bytes.NewReader(noOutput), nil, nil); err != nil {
+		t.Fatalf("scanTx without outputs error %v", err)
+	}
+	if _, err := scanCoinbase(bytes.NewReader(noOutput), nil); !errors.Is(err, ErrInvalidMirror) {
+		t.Errorf("scanCoinbase without outputs: got %v, want %v", err, ErrInvalidMirror)
+	}
+}
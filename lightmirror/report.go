@@ -0,0 +1,79 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ValidationReport is the outcome of ValidateMirror: the checks a mirror
+// goes through when appended to a chain, and where it would connect.
+type ValidationReport struct {
+	Hash chainhash.Hash
+
+	// InvariantsErr is the error of VerifyInvariants.
+	InvariantsErr error
+
+	// WorkErr is the error of the check of the proof of work of the
+	// header, or of its solution on a signet, as the chain runs it.
+	WorkErr error
+
+	// MerkleErr is the error of CheckMerkle.
+	MerkleErr error
+
+	// DifficultyErr is the error of the check of the bits of the header
+	// against the difficulty adjustment, run when the parent is known.
+	DifficultyErr error
+
+	// Known is set when the chain already knows the block, at Height.
+	Known  bool
+	Height int64
+
+	// ParentKnown is set when the chain knows the parent of the block, at
+	// ParentHeight.  Otherwise, appending the mirror fails with
+	// ErrUnknownParent, or holds it as an orphan.
+	ParentKnown  bool
+	ParentHeight int64
+
+	// CFHeaders is the advisory check of the filter headers at the height
+	// of the block, set by CFHeadersCrossCheck.Annotate.  Err does not
+	// take it into account.
+	CFHeaders *CFHeadersCheck
+}
+
+// Err returns the first error of the checks of the mirror, in the order
+// of the fields of the report, or nil if it passes them all.
+func (r *ValidationReport) Err() error {
+	for _, err := range []error{r.InvariantsErr, r.WorkErr, r.MerkleErr, r.DifficultyErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateMirror runs on m VerifyInvariants and the checks of Append, all of
+// them rather than up to the first failing one, and reports where it stands
+// in the chain, without modifying the chain.
+func (c *MirrorChain) ValidateMirror(m *BtcLightMirrorV2) *ValidationReport {
+	hash := m.BtcHeader.BlockHash()
+	r := &ValidationReport{
+		Hash:          hash,
+		InvariantsErr: m.VerifyInvariants(),
+		WorkErr:       c.checkMirrorWork(m, hash),
+		MerkleErr:     m.CheckMerkle(),
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if e, ok := c.index[hash]; ok {
+		r.Known, r.Height = true, e.height
+	}
+	if parent, ok := c.index[m.BtcHeader.PrevBlock]; ok {
+		r.ParentKnown, r.ParentHeight = true, parent.height
+		r.DifficultyErr = c.checkDifficulty(&m.BtcHeader, parent)
+	}
+	return r
+}
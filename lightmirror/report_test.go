@@ -0,0 +1,70 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestValidateMirror(t *testing.T) {
+	mirrors := newTestMirrors(4)
+	c := newTestChain(t, mirrors[:3])
+
+	badMerkle := mirrors[3].Clone()
+	badMerkle.MerkleNodes[0][0] ^= 1
+	badWork := newPowBranch(mirrors[2], 10, 1, false, false)[0]
+	orphan := newTestMirror(chainhash.Hash{1}, 20, 0)
+	badInvariants := mirrors[3].Clone()
+	badInvariants.CoinBaseTx.TxIn = nil
+
+	tests := []struct {
+		name         string
+		m            *BtcLightMirrorV2
+		invariants   bool
+		work         bool
+		merkle       bool
+		height       int64
+		parentHeight int64
+	}{
+		{"next", mirrors[3], false, false, false, -1, testAnchorHeight + 2},
+		{"known", mirrors[1], false, false, false, testAnchorHeight + 1, testAnchorHeight},
+		{"anchor", mirrors[0], false, false, false, testAnchorHeight, -1},
+		{"bad merkle", badMerkle, false, false, true, -1, testAnchorHeight + 2},
+		{"bad work", badWork, false, true, false, -1, testAnchorHeight + 2},
+		{"bad invariants", badInvariants, true, false, true, -1, testAnchorHeight + 2},
+		{"orphan", orphan, false, false, false, -1, -1},
+	}
+	for _, test := range tests {
+		r := c.ValidateMirror(test.m)
+		if r.Hash != test.m.BtcHeader.BlockHash() {
+			t.Errorf("ValidateMirror (%s): got hash %v, want %v", test.name, r.Hash,
+				test.m.BtcHeader.BlockHash())
+		}
+		if (r.InvariantsErr != nil) != test.invariants || (r.WorkErr != nil) != test.work ||
+			(r.MerkleErr != nil) != test.merkle {
+			t.Errorf("ValidateMirror (%s): got errors %v, %v, %v", test.name,
+				r.InvariantsErr, r.WorkErr, r.MerkleErr)
+		}
+		valid := !test.invariants && !test.work && !test.merkle
+		if (r.Err() == nil) != valid {
+			t.Errorf("ValidateMirror (%s): got error %v, want valid %v", test.name,
+				r.Err(), valid)
+		}
+		if r.Known != (test.height >= 0) || r.Known && r.Height != test.height {
+			t.Errorf("ValidateMirror (%s): got known %v at %d, want height %d",
+				test.name, r.Known, r.Height, test.height)
+		}
+		if r.ParentKnown != (test.parentHeight >= 0) ||
+			r.ParentKnown && r.ParentHeight != test.parentHeight {
+			t.Errorf("ValidateMirror (%s): got parent known %v at %d, want height %d",
+				test.name, r.ParentKnown, r.ParentHeight, test.parentHeight)
+		}
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+2 {
+		t.Errorf("ValidateMirror: tip moved to %d", height)
+	}
+}
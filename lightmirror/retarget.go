@@ -0,0 +1,107 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrUnexpectedBits is returned for a header whose bits are not the ones the
+// difficulty adjustment rules of the network require at its height.
+var ErrUnexpectedBits = errors.New("bits differ from the required difficulty")
+
+// retargetInterval returns the number of blocks of a difficulty epoch of
+// params, 2016 on Bitcoin.
+func retargetInterval(params *chaincfg.Params) int64 {
+	return int64(params.TargetTimespan / params.TargetTimePerBlock)
+}
+
+// retargetBits returns the bits of the first block of an epoch, as the
+// consensus rules compute them from the bits of its parent, the last block
+// of the previous epoch, and span, the seconds from the timestamp of the
+// first block of the previous epoch to that of the last one.  The span is
+// clamped to a factor of RetargetAdjustmentFactor of the target timespan,
+// and the target to the proof of work limit.
+func retargetBits(params *chaincfg.Params, parentBits uint32, span int64) uint32 {
+	targetSpan := int64(params.TargetTimespan / time.Second)
+	factor := params.RetargetAdjustmentFactor
+	if min := targetSpan / factor; span < min {
+		span = min
+	} else if max := targetSpan * factor; span > max {
+		span = max
+	}
+	target := blockchain.CompactToBig(parentBits)
+	target.Mul(target, big.NewInt(span))
+	target.Quo(target, big.NewInt(targetSpan))
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+	return blockchain.BigToCompact(target)
+}
+
+// minDifficultyRequired returns whether a block of a network with the
+// testnet rule of ReduceMinDifficulty must carry the bits of the proof of
+// work limit, its timestamp being more than MinDiffReductionTime past that
+// of its parent.
+func minDifficultyRequired(params *chaincfg.Params, header, parent *wire.BlockHeader) bool {
+	return params.ReduceMinDifficulty &&
+		header.Timestamp.Unix() > parent.Timestamp.Unix()+int64(params.MinDiffReductionTime/time.Second)
+}
+
+// checkBits checks that the bits of header are want, the ones required at
+// height.
+func checkBits(header *wire.BlockHeader, height int64, want uint32) error {
+	if header.Bits != want {
+		return fmt.Errorf("bits %08x at height %d, required %08x: %w",
+			header.Bits, height, want, ErrUnexpectedBits)
+	}
+	return nil
+}
+
+// checkDifficulty checks the bits of header, building on parent, follow the
+// difficulty adjustment of the network: they change only at the first block
+// of an epoch, to the target the timestamps of the previous epoch give.
+// Blocks whose required bits depend on blocks below the anchor, such as the
+// first retarget after an anchor within an epoch, are not checked.
+func (c *MirrorChain) checkDifficulty(header *wire.BlockHeader, parent *chainEntry) error {
+	params := c.cfg.params
+	if params.PoWNoRetargeting {
+		return nil
+	}
+	height, interval := parent.height+1, retargetInterval(params)
+	if height%interval == 0 {
+		first := parent
+		for first != nil && first.height > height-interval {
+			first = first.parent
+		}
+		if first == nil {
+			return nil
+		}
+		span := parent.header.Timestamp.Unix() - first.header.Timestamp.Unix()
+		return checkBits(header, height, retargetBits(params, parent.header.Bits, span))
+	}
+	if !params.ReduceMinDifficulty {
+		return checkBits(header, height, parent.header.Bits)
+	}
+	if minDifficultyRequired(params, header, &parent.header) {
+		return checkBits(header, height, params.PowLimitBits)
+	}
+	// Otherwise the bits are those of the last block not mined under the
+	// reduced difficulty.
+	last := parent
+	for last.height%interval != 0 && last.header.Bits == params.PowLimitBits {
+		if last = last.parent; last == nil {
+			return nil
+		}
+	}
+	return checkBits(header, height, last.header.Bits)
+}
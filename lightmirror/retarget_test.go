@@ -0,0 +1,256 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// retargetTestParams returns the regression test parameters with epochs of
+// 10 blocks, retargeting, without the reduced difficulty of testnets.
+func retargetTestParams() chaincfg.Params {
+	params := chaincfg.RegressionNetParams
+	params.PoWNoRetargeting = false
+	params.ReduceMinDifficulty = false
+	params.TargetTimespan = 10 * params.TargetTimePerBlock
+	return params
+}
+
+// mineBranch links mirrors into a branch building on parent, with blocks
+// spacing seconds apart and the bits of bits(i) for the mirror at index i,
+// and solves their proof of work.
+func mineBranch(params *chaincfg.Params, parent *BtcLightMirrorV2, mirrors []*BtcLightMirrorV2, spacing int64, bits func(i int) uint32) {
+	prev := parent
+	for i, m := range mirrors {
+		header := &m.BtcHeader
+		header.PrevBlock = prev.BtcHeader.BlockHash()
+		header.Timestamp = prev.BtcHeader.Timestamp.Add(time.Duration(spacing) * time.Second)
+		header.Bits = bits(i)
+		for header.Nonce = 0; checkProofOfWork(header, params.PowLimit, nil) != nil; {
+			header.Nonce++
+		}
+		prev = m
+	}
+}
+
+func TestRetargetBits(t *testing.T) {
+	main := &chaincfg.MainNetParams
+	week := int64(7 * 24 * 60 * 60)
+	tests := []struct {
+		name string
+		bits uint32
+		span int64
+		want uint32
+	}{
+		// The first retarget of the main network, of block 32256, from
+		// the timestamps of the blocks 30240 and 32255.
+		{"block 32256", 0x1d00ffff, 1262152739 - 1261130161, 0x1d00d86a},
+		{"target timespan", 0x1b0404cb, 2 * week, 0x1b0404cb},
+		{"clamped low", 0x1c0168fd, 1, 0x1b5a3f40},
+		{"clamped high", 0x1b0404cb, 100 * week, 0x1b10132c},
+		{"power of two", 0x1c0168fd, 4 * week, 0x1c02d1fa},
+		{"proof of work limit", 0x1d00ffff, 4 * week, 0x1d00ffff},
+	}
+	for _, test := range tests {
+		if got := retargetBits(main, test.bits, test.span); got != test.want {
+			t.Errorf("retargetBits (%s): got %08x, want %08x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestChainRetarget(t *testing.T) {
+	params := retargetTestParams()
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	mirrors := newTestBranch(anchor, 1, 25)
+	// The blocks come twice as fast as targeted: the targets of the
+	// epochs starting at heights 110 and 120 halve.
+	limitBits := params.PowLimitBits
+	bits := []uint32{limitBits, retargetBits(&params, limitBits, 9*300)}
+	bits = append(bits, retargetBits(&params, bits[1], 9*300))
+	if bits[1] == limitBits || bits[2] == bits[1] {
+		t.Fatalf("retargetBits: got %08x", bits)
+	}
+	bitsAt := func(i int) uint32 { return bits[(i+1)/10] }
+	mineBranch(&params, anchor, mirrors, 300, bitsAt)
+
+	c, err := NewMirrorChain(anchor, testAnchorHeight, WithChainParams(&params))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	for i, m := range mirrors {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		height int64
+		bits   uint32
+	}{
+		{"no retarget", testAnchorHeight + 10, bits[0]},
+		{"other retarget", testAnchorHeight + 10, bits[2]},
+		{"within an epoch", testAnchorHeight + 5, bits[1]},
+		{"before a retarget", testAnchorHeight + 9, bits[1]},
+	}
+	for k, test := range tests {
+		i := int(test.height - testAnchorHeight - 1)
+		branch := newTestBranch(anchor, 100+uint32(k)*20, i+1)
+		mineBranch(&params, anchor, branch, 300, func(j int) uint32 {
+			if j == i {
+				return test.bits
+			}
+			return bitsAt(j)
+		})
+		// A block of the side branch has no more work than the best
+		// chain, so that only the last one is checked anew.
+		var appendErr error
+		for _, m := range branch {
+			if _, appendErr = c.Append(m); appendErr != nil {
+				break
+			}
+		}
+		if !errors.Is(appendErr, ErrUnexpectedBits) {
+			t.Errorf("Append (%s): got error %v, want %v", test.name, appendErr, ErrUnexpectedBits)
+		}
+	}
+
+	wrong := newTestBranch(anchor, 300, 1)
+	mineBranch(&params, anchor, wrong, 300, func(int) uint32 { return bits[1] })
+	if r := c.ValidateMirror(wrong[0]); !errors.Is(r.DifficultyErr, ErrUnexpectedBits) ||
+		!errors.Is(r.Err(), ErrUnexpectedBits) {
+		t.Errorf("ValidateMirror: got %+v, want %v", r, ErrUnexpectedBits)
+	}
+
+	// The retarget after an anchor within an epoch is not checked.
+	c, err = NewMirrorChain(anchor, testAnchorHeight+5, WithChainParams(&params))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	branch := newTestBranch(anchor, 200, 6)
+	mineBranch(&params, anchor, branch, 300, func(j int) uint32 {
+		if j == 4 {
+			return bits[2]
+		}
+		return bits[j/5*2]
+	})
+	for i, m := range branch {
+		if _, err := c.Append(m); err != nil {
+			t.Errorf("Append #%d above a mid-epoch anchor error %v", i, err)
+		}
+	}
+}
+
+func TestChainRetargetMinDifficulty(t *testing.T) {
+	params := retargetTestParams()
+	params.ReduceMinDifficulty = true
+	params.MinDiffReductionTime = 20 * time.Minute
+	normal := retargetBits(&params, params.PowLimitBits, 1)
+
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	anchor.BtcHeader.Bits = normal
+	for checkProofOfWork(&anchor.BtcHeader, params.PowLimit, nil) != nil {
+		anchor.BtcHeader.Nonce++
+	}
+	c, err := NewMirrorChain(anchor, testAnchorHeight, WithChainParams(&params))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+
+	// A block more than 20 minutes after its parent is mined at the
+	// minimum difficulty, and the next one at the difficulty before it.
+	slow := newTestBranch(anchor, 1, 1)
+	mineBranch(&params, anchor, slow, 1201, func(int) uint32 { return params.PowLimitBits })
+	next := newTestBranch(slow[0], 2, 1)
+	mineBranch(&params, slow[0], next, 600, func(int) uint32 { return normal })
+	for i, m := range append(slow, next...) {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		spacing int64
+		bits    uint32
+	}{
+		{"minimum difficulty too early", 1200, params.PowLimitBits},
+		{"normal difficulty too late", 1201, normal},
+	}
+	for _, test := range tests {
+		m := newTestBranch(next[0], 10, 1)
+		mineBranch(&params, next[0], m, test.spacing, func(int) uint32 { return test.bits })
+		if _, err := c.Append(m[0]); !errors.Is(err, ErrUnexpectedBits) {
+			t.Errorf("Append (%s): got error %v, want %v", test.name, err, ErrUnexpectedBits)
+		}
+	}
+	m := newTestBranch(slow[0], 20, 1)
+	mineBranch(&params, slow[0], m, 600, func(int) uint32 { return params.PowLimitBits })
+	if _, err := c.Append(m[0]); !errors.Is(err, ErrUnexpectedBits) {
+		t.Errorf("Append after a minimum difficulty block: got error %v, want %v", err, ErrUnexpectedBits)
+	}
+}
+
+func TestChainVerifierRetarget(t *testing.T) {
+	params := retargetTestParams()
+	anchor := newTestMirror(chainhash.Hash{}, 0, 0)
+	mirrors := append([]*BtcLightMirrorV2{anchor}, newTestBranch(anchor, 1, 20)...)
+	bits := retargetBits(&params, params.PowLimitBits, 9*300)
+	next := retargetBits(&params, bits, 9*300)
+	mineBranch(&params, anchor, mirrors[1:], 300, func(i int) uint32 {
+		switch {
+		case i+1 >= 20:
+			return next
+		case i+1 >= 10:
+			return bits
+		}
+		return params.PowLimitBits
+	})
+
+	newVerifier := func(start int64) *ChainVerifier {
+		v, err := NewChainVerifier(ChainVerifierConfig{Params: &params, StartHeight: start})
+		if err != nil {
+			t.Fatalf("NewChainVerifier error %v", err)
+		}
+		return v
+	}
+	if err := newVerifier(100).VerifyAll(mirrors); err != nil {
+		t.Errorf("VerifyAll error %v", err)
+	}
+
+	// Without the first block of the epoch, the retarget is not checked,
+	// but the bits within an epoch are.
+	v := newVerifier(101)
+	if err := v.VerifyAll(mirrors[1:10]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	wrong := mirrors[10].Clone()
+	mineBranch(&params, mirrors[9], []*BtcLightMirrorV2{wrong}, 300,
+		func(int) uint32 { return next })
+	if err := v.Verify(wrong); err != nil {
+		t.Errorf("Verify of an unchecked retarget error %v", err)
+	}
+
+	v = newVerifier(100)
+	if err := v.VerifyAll(mirrors[:10]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	if err := v.Verify(wrong); !errors.Is(err, ErrUnexpectedBits) {
+		t.Errorf("Verify: got error %v, want %v", err, ErrUnexpectedBits)
+	}
+	if err := v.VerifyAll(mirrors[10:]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	late := newTestBranch(mirrors[20], 50, 1)
+	mineBranch(&params, mirrors[20], late, 300, func(int) uint32 { return params.PowLimitBits })
+	if err := v.Verify(late[0]); !errors.Is(err, ErrUnexpectedBits) {
+		t.Errorf("Verify within an epoch: got error %v, want %v", err, ErrUnexpectedBits)
+	}
+}
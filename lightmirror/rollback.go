@@ -0,0 +1,169 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+var (
+	// ErrInvalidBlock is returned when appending a block that is marked
+	// invalid or builds on one.
+	ErrInvalidBlock = errors.New("block is marked invalid")
+
+	// ErrRollbackPastAnchor is returned when a rollback would disconnect
+	// the anchor.
+	ErrRollbackPastAnchor = errors.New("rollback past the chain anchor")
+
+	// ErrInvalidateAnchor is returned when trying to invalidate the
+	// anchor.
+	ErrInvalidateAnchor = errors.New("the chain anchor can not be invalidated")
+)
+
+// Rollback disconnects the n most recent blocks of the best chain and returns
+// them, newest first, with nil for header-only blocks.  The disconnected
+// blocks, and the side branches built on them, are forgotten: they may be
+// appended again later.
+func (c *MirrorChain) Rollback(n int) ([]*BtcLightMirrorV2, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if n < 0 {
+		return nil, fmt.Errorf("invalid rollback depth %d", n)
+	}
+	if int64(n) > c.tip.height-c.anchor.height {
+		return nil, ErrRollbackPastAnchor
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	hash, _ := c.best.HashAtHeight(c.tip.height - int64(n))
+	target := c.index[hash]
+	first, _ := c.best.HashAtHeight(target.height + 1)
+
+	event, err := c.setTip(target)
+	if err != nil {
+		return nil, err
+	}
+	c.forget(c.index[first])
+	return event.Disconnected, nil
+}
+
+// forget removes e and all its descendants from the block index.
+func (c *MirrorChain) forget(e *chainEntry) {
+	siblings := e.parent.children
+	for i, sibling := range siblings {
+		if sibling == e {
+			e.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	stack := []*chainEntry{e}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = append(stack[:len(stack)-1], e.children...)
+		delete(c.index, e.hash)
+	}
+}
+
+// subtree returns e and all its descendants.
+func subtree(e *chainEntry) map[*chainEntry]struct{} {
+	res := make(map[*chainEntry]struct{})
+	stack := []*chainEntry{e}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = append(stack[:len(stack)-1], e.children...)
+		res[e] = struct{}{}
+	}
+	return res
+}
+
+// bestValidEntry returns the valid block, not in exclude, ending the chain
+// with the most work.  Ties go to the block seen first.
+func (c *MirrorChain) bestValidEntry(exclude map[*chainEntry]struct{}) *chainEntry {
+	var best *chainEntry
+	for _, e := range c.index {
+		if _, ok := exclude[e]; ok || e.invalid {
+			continue
+		}
+		if best == nil {
+			best = e
+			continue
+		}
+		switch cmp := e.work.Cmp(best.work); {
+		case cmp > 0, cmp == 0 && e.seq < best.seq:
+			best = e
+		}
+	}
+	return best
+}
+
+// InvalidateBlock marks the block with the given hash and all its
+// descendants invalid.  If the best chain contains the block, the chain
+// switches to the valid block with the most work.  Appending the block or
+// any block building on it fails with ErrInvalidBlock until ReconsiderBlock
+// is called.
+func (c *MirrorChain) InvalidateBlock(hash chainhash.Hash) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return ErrUnknownBlock
+	}
+	if e == c.anchor {
+		return ErrInvalidateAnchor
+	}
+
+	invalid := subtree(e)
+	if _, ok := invalid[c.tip]; ok {
+		if _, err := c.setTip(c.bestValidEntry(invalid)); err != nil {
+			return err
+		}
+	}
+	for e := range invalid {
+		e.invalid = true
+	}
+	return nil
+}
+
+// ReconsiderBlock clears the invalid mark of the block with the given hash,
+// of its descendants and of its ancestors, then switches the best chain to
+// the valid block with the most work.
+func (c *MirrorChain) ReconsiderBlock(hash chainhash.Hash) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.index[hash]
+	if !ok {
+		return ErrUnknownBlock
+	}
+
+	reconsidered := make(map[*chainEntry]struct{})
+	for e := range subtree(e) {
+		if e.invalid {
+			reconsidered[e] = struct{}{}
+		}
+	}
+	for a := e.parent; a != nil && a.invalid; a = a.parent {
+		reconsidered[a] = struct{}{}
+	}
+	for e := range reconsidered {
+		e.invalid = false
+	}
+
+	if best := c.bestValidEntry(nil); best.work.Cmp(c.tip.work) > 0 {
+		if _, err := c.setTip(best); err != nil {
+			// Keep the marks consistent with the best chain.
+			for e := range reconsidered {
+				e.invalid = true
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// checkStore asserts that store holds exactly the best chain of c.
+func checkStore(t *testing.T, c *MirrorChain, store *memStore) {
+	t.Helper()
+	_, tipHeight := c.Tip()
+	for height := int64(testAnchorHeight); height <= tipHeight; height++ {
+		hash, err := c.HashAtHeight(height)
+		if err != nil {
+			t.Fatalf("HashAtHeight(%d) error %v", height, err)
+		}
+		m, err := store.ByHeight(height)
+		if err != nil || m.BtcHeader.BlockHash() != hash {
+			t.Errorf("store.ByHeight(%d): got error %v or wrong mirror", height, err)
+		}
+	}
+	if _, height, _ := store.Tip(); height != tipHeight {
+		t.Errorf("store.Tip: got height %d, want %d", height, tipHeight)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	store := newMemStore()
+	c := newTestChain(t, mirrors, WithStore(store))
+
+	// A side branch building on a block about to be rolled back.
+	side := newTestBranch(mirrors[4], 1000, 1)[0]
+	if _, err := c.Append(side); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+
+	disconnected, err := c.Rollback(2)
+	if err != nil {
+		t.Fatalf("Rollback error %v", err)
+	}
+	if len(disconnected) != 2 ||
+		disconnected[0].BtcHeader.BlockHash() != mirrors[5].BtcHeader.BlockHash() ||
+		disconnected[1].BtcHeader.BlockHash() != mirrors[4].BtcHeader.BlockHash() {
+
+		t.Fatalf("Rollback: wrong disconnected mirrors")
+	}
+	if tip, height := c.Tip(); height != testAnchorHeight+3 ||
+		tip.BtcHeader.BlockHash() != mirrors[3].BtcHeader.BlockHash() {
+
+		t.Errorf("Tip: got %v at height %d", tip.BtcHeader.BlockHash(), height)
+	}
+	checkStore(t, c, store)
+
+	for _, m := range []*BtcLightMirrorV2{mirrors[4], mirrors[5], side} {
+		if _, _, err := c.ByHash(m.BtcHeader.BlockHash()); !errors.Is(err, ErrUnknownBlock) {
+			t.Errorf("ByHash rolled back: got error %v, want %v", err,
+				ErrUnknownBlock)
+		}
+	}
+
+	// Rolled back blocks can be appended again.
+	for i, m := range mirrors[4:] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i, err)
+		}
+	}
+	checkStore(t, c, store)
+
+	if _, err := c.Rollback(6); !errors.Is(err, ErrRollbackPastAnchor) {
+		t.Errorf("Rollback past anchor: got error %v, want %v", err,
+			ErrRollbackPastAnchor)
+	}
+	if disconnected, err := c.Rollback(0); err != nil || disconnected != nil {
+		t.Errorf("Rollback(0): got %v, %v", disconnected, err)
+	}
+	if _, err := c.Rollback(5); err != nil {
+		t.Fatalf("Rollback to anchor error %v", err)
+	}
+	checkStore(t, c, store)
+}
+
+func TestInvalidateBlock(t *testing.T) {
+	mirrors := newTestMirrors(15)
+	store := newMemStore()
+	c := newTestChain(t, mirrors, WithStore(store))
+
+	// A side branch forking after mirrors[3], stronger than anything left
+	// of the best chain once mirrors[5] is invalid.
+	side := newTestBranch(mirrors[3], 1000, 2)
+	for _, m := range side {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+
+	if err := c.InvalidateBlock(mirrors[5].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("InvalidateBlock error %v", err)
+	}
+	tip, height := c.Tip()
+	if height != testAnchorHeight+5 || tip.BtcHeader.BlockHash() != side[1].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d, want the side branch",
+			tip.BtcHeader.BlockHash(), height)
+	}
+	checkStore(t, c, store)
+
+	// The invalid branch is rejected.
+	child := newTestBranch(mirrors[14], 2000, 1)[0]
+	tests := []*BtcLightMirrorV2{mirrors[5], mirrors[9], child}
+	for i, m := range tests {
+		if _, err := c.Append(m); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("Append #%d: got error %v, want %v", i, err, ErrInvalidBlock)
+		}
+	}
+	if _, err := c.HeightOfHash(mirrors[9].BtcHeader.BlockHash()); !errors.Is(err, ErrNotInBestChain) {
+		t.Errorf("HeightOfHash invalid: got error %v, want %v", err,
+			ErrNotInBestChain)
+	}
+
+	// Reconsidering a descendant clears the whole branch.
+	if err := c.ReconsiderBlock(mirrors[9].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("ReconsiderBlock error %v", err)
+	}
+	tip, height = c.Tip()
+	if height != testAnchorHeight+14 || tip.BtcHeader.BlockHash() != mirrors[14].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %v at height %d after reconsider",
+			tip.BtcHeader.BlockHash(), height)
+	}
+	checkStore(t, c, store)
+	if _, err := c.Append(child); err != nil {
+		t.Errorf("Append after reconsider error %v", err)
+	}
+
+	// Invalidating a side branch leaves the best chain alone.
+	if err := c.InvalidateBlock(side[0].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("InvalidateBlock error %v", err)
+	}
+	if _, height := c.Tip(); height != testAnchorHeight+15 {
+		t.Errorf("Tip: got height %d", height)
+	}
+
+	anchor, _ := c.Anchor()
+	if err := c.InvalidateBlock(anchor.BtcHeader.BlockHash()); !errors.Is(err, ErrInvalidateAnchor) {
+		t.Errorf("InvalidateBlock anchor: got error %v, want %v", err,
+			ErrInvalidateAnchor)
+	}
+	if err := c.InvalidateBlock(chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("InvalidateBlock unknown: got error %v, want %v", err,
+			ErrUnknownBlock)
+	}
+	if err := c.ReconsiderBlock(chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("ReconsiderBlock unknown: got error %v, want %v", err,
+			ErrUnknownBlock)
+	}
+}
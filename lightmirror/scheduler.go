@@ -0,0 +1,324 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultFetchWorkers is the number of workers of a FetchScheduler when
+// FetchSchedulerConfig.Workers is not set.
+const defaultFetchWorkers = 4
+
+// ErrSchedulerClosed is returned when scheduling heights on a stopped
+// FetchScheduler.
+var ErrSchedulerClosed = errors.New("fetch scheduler closed")
+
+// FetchPriority orders the heights queued on a FetchScheduler: every queued
+// height of a higher priority is fetched before those of a lower one.
+type FetchPriority int
+
+const (
+	// PriorityBackfill is for deep history a catch-up fills in.
+	PriorityBackfill FetchPriority = iota
+
+	// PriorityNormal is for heights needed soon but not urgently.
+	PriorityNormal
+
+	// PriorityTip is for the blocks following the tip of the upstream
+	// source, needed for contract submission.
+	PriorityTip
+)
+
+var fetchPriorityStrings = map[FetchPriority]string{
+	PriorityBackfill: "backfill",
+	PriorityNormal:   "normal",
+	PriorityTip:      "tip",
+}
+
+// String returns the FetchPriority in human-readable form.
+func (p FetchPriority) String() string {
+	if s, ok := fetchPriorityStrings[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown FetchPriority (%d)", int(p))
+}
+
+// FetchSchedulerConfig configures a FetchScheduler.
+type FetchSchedulerConfig struct {
+	// Fetcher is the source of the mirrors.
+	Fetcher Fetcher
+
+	// Handle receives the outcome of every fetch, from the worker which
+	// made it.  Calls for different heights may be concurrent.
+	Handle func(height int64, m *BtcLightMirrorV2, err error)
+
+	// Workers is the number of concurrent fetches, defaultFetchWorkers
+	// when not positive.
+	Workers int
+
+	// Logger, when set, receives the fetch latencies and failures.
+	Logger Logger
+}
+
+// FetchSchedulerStats reports the state of a FetchScheduler.
+type FetchSchedulerStats struct {
+	// Queued is the number of heights waiting for a worker, and InFlight
+	// the number being fetched.
+	Queued   int
+	InFlight int
+
+	// Fetched and Failed count the fetches made, by outcome.
+	Fetched int64
+	Failed  int64
+}
+
+// fetchRequest is a queued height.
+type fetchRequest struct {
+	height   int64
+	priority FetchPriority
+
+	// index is the position of the request in its fetchQueue.
+	index int
+}
+
+// fetchQueue is a heap of requests, highest priority first, then lowest
+// height.
+type fetchQueue []*fetchRequest
+
+func (q fetchQueue) Len() int { return len(q) }
+
+func (q fetchQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].height < q[j].height
+}
+
+func (q fetchQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *fetchQueue) Push(x interface{}) {
+	r := x.(*fetchRequest)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *fetchQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return r
+}
+
+// FetchScheduler fetches heights from a Fetcher on a pool of workers in the
+// order of their priority, so that during a catch-up the blocks following
+// the tip are fetched before deep history.  A height is queued, and
+// fetched, once however many times it is scheduled: scheduling it again
+// only raises its priority.  Once fetched successfully it is never fetched
+// again; a height whose fetch failed may be scheduled anew.
+//
+// Heights may be scheduled before Start runs the workers.  Stop drops the
+// queued heights and lets the fetches in flight complete.
+type FetchScheduler struct {
+	cfg  FetchSchedulerConfig
+	life lifecycle
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	queue    fetchQueue
+	queued   map[int64]*fetchRequest
+	inFlight map[int64]struct{}
+	fetched  map[int64]struct{}
+	failed   int64
+	closed   bool
+}
+
+// NewFetchScheduler returns a FetchScheduler with the given configuration.
+// Start runs its workers.
+func NewFetchScheduler(cfg FetchSchedulerConfig) (*FetchScheduler, error) {
+	if cfg.Fetcher == nil || cfg.Handle == nil {
+		return nil, errors.New("fetch scheduler needs a fetcher and a handler")
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultFetchWorkers
+	}
+	cfg.Logger = orNopLogger(cfg.Logger)
+
+	s := &FetchScheduler{
+		cfg:      cfg,
+		queued:   make(map[int64]*fetchRequest),
+		inFlight: make(map[int64]struct{}),
+		fetched:  make(map[int64]struct{}),
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	return s, nil
+}
+
+// Start runs the workers until Stop is called or ctx is done.
+func (s *FetchScheduler) Start(ctx context.Context) error {
+	runs := make([]func(context.Context, <-chan struct{}), 0, s.cfg.Workers+1)
+	for i := 0; i < s.cfg.Workers; i++ {
+		runs = append(runs, s.work)
+	}
+	// The workers wait on the queue, so their end is signalled there.
+	runs = append(runs, func(ctx context.Context, quit <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			s.close()
+		case <-quit:
+		}
+	})
+	return s.life.start(ctx, runs...)
+}
+
+// Stop drops the queued heights and waits for the fetches in flight, and
+// their handling, until ctx is done, then cancels them.
+func (s *FetchScheduler) Stop(ctx context.Context) error {
+	s.close()
+	return s.life.stop(ctx)
+}
+
+// Schedule queues the heights start to end included at priority.  Heights
+// already queued at a lower priority are raised to it; heights in flight or
+// fetched are left out.  It returns the number of heights queued or raised.
+func (s *FetchScheduler) Schedule(start, end int64, priority FetchPriority) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return 0, ErrSchedulerClosed
+	}
+
+	n := 0
+	for height := start; height <= end; height++ {
+		if r, ok := s.queued[height]; ok {
+			if r.priority < priority {
+				r.priority = priority
+				heap.Fix(&s.queue, r.index)
+				n++
+			}
+			continue
+		}
+		if _, ok := s.inFlight[height]; ok {
+			continue
+		}
+		if _, ok := s.fetched[height]; ok {
+			continue
+		}
+		r := &fetchRequest{height: height, priority: priority}
+		heap.Push(&s.queue, r)
+		s.queued[height] = r
+		n++
+	}
+	if n > 0 {
+		s.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Reprioritize sets the priority of the heights start to end included which
+// are queued, lowering it as well as raising it, as when a new tip makes a
+// backfill less urgent.  It returns the number of heights changed.
+func (s *FetchScheduler) Reprioritize(start, end int64, priority FetchPriority) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := 0
+	change := func(r *fetchRequest) {
+		if r.priority != priority {
+			r.priority = priority
+			heap.Fix(&s.queue, r.index)
+			n++
+		}
+	}
+	// Walk the shorter of the range and the queue.
+	if end-start < int64(len(s.queued)) {
+		for height := start; height <= end; height++ {
+			if r, ok := s.queued[height]; ok {
+				change(r)
+			}
+		}
+		return n
+	}
+	for height, r := range s.queued {
+		if height >= start && height <= end {
+			change(r)
+		}
+	}
+	return n
+}
+
+// Stats returns the queue depth, the fetches in flight and the outcomes of
+// the fetches made so far.
+func (s *FetchScheduler) Stats() FetchSchedulerStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return FetchSchedulerStats{
+		Queued:   len(s.queue),
+		InFlight: len(s.inFlight),
+		Fetched:  int64(len(s.fetched)),
+		Failed:   s.failed,
+	}
+}
+
+// close stops the scheduler taking heights and wakes the workers up.
+func (s *FetchScheduler) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	s.queue = nil
+	s.queued = make(map[int64]*fetchRequest)
+	s.cond.Broadcast()
+}
+
+// next waits for the queued height of greatest priority and moves it in
+// flight.  It returns false once the scheduler is closed.
+func (s *FetchScheduler) next() (int64, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, false
+	}
+	r := heap.Pop(&s.queue).(*fetchRequest)
+	delete(s.queued, r.height)
+	s.inFlight[r.height] = struct{}{}
+	return r.height, true
+}
+
+func (s *FetchScheduler) work(ctx context.Context, _ <-chan struct{}) {
+	for {
+		height, ok := s.next()
+		if !ok {
+			return
+		}
+
+		fetchStart := time.Now()
+		m, err := s.cfg.Fetcher.FetchByHeight(ctx, height)
+		logFetch(s.cfg.Logger, heightBlock(height), fetchStart, err)
+
+		s.mtx.Lock()
+		delete(s.inFlight, height)
+		if err == nil {
+			s.fetched[height] = struct{}{}
+		} else {
+			s.failed++
+		}
+		s.mtx.Unlock()
+
+		s.cfg.Handle(height, m, err)
+	}
+}
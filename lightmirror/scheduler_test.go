@@ -0,0 +1,339 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror/leaktest"
+)
+
+// orderFetcher records the heights it is asked for.  Fetches wait for gate,
+// when set, then for delay; heights in fail fail.
+type orderFetcher struct {
+	mtx     sync.Mutex
+	heights []int64
+	calls   map[int64]int
+
+	m     *BtcLightMirrorV2
+	gate  chan struct{}
+	delay time.Duration
+	fail  map[int64]bool
+}
+
+func newOrderFetcher(delay time.Duration) *orderFetcher {
+	return &orderFetcher{
+		calls: make(map[int64]int),
+		m:     newTestMirror(chainhash.Hash{}, 1, 0),
+		delay: delay,
+	}
+}
+
+func (f *orderFetcher) FetchByHash(ctx context.Context, hash chainhash.Hash) (*BtcLightMirrorV2, error) {
+	return nil, ErrNotFound
+}
+
+func (f *orderFetcher) FetchByHeight(ctx context.Context, height int64) (*BtcLightMirrorV2, error) {
+	f.mtx.Lock()
+	f.heights = append(f.heights, height)
+	f.calls[height]++
+	f.mtx.Unlock()
+	if f.gate != nil {
+		select {
+		case <-f.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	time.Sleep(f.delay)
+	if f.fail[height] {
+		return nil, ErrNotFound
+	}
+	return f.m, nil
+}
+
+func (f *orderFetcher) order() []int64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]int64(nil), f.heights...)
+}
+
+// startScheduler starts a FetchScheduler with cfg, stopped at the end of
+// the test, which checks that it leaves no goroutine behind.
+func startScheduler(t *testing.T, cfg FetchSchedulerConfig) *FetchScheduler {
+	t.Helper()
+	leaktest.Check(t)
+	s, err := NewFetchScheduler(cfg)
+	if err != nil {
+		t.Fatalf("NewFetchScheduler error %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Stop(context.Background()); err != nil {
+			t.Errorf("Stop error %v", err)
+		}
+	})
+	return s
+}
+
+// newTestScheduler starts a FetchScheduler on f whose handled fetches are
+// counted by done.
+func newTestScheduler(t *testing.T, f Fetcher, workers int, done *sync.WaitGroup) *FetchScheduler {
+	t.Helper()
+	return startScheduler(t, FetchSchedulerConfig{
+		Fetcher: f,
+		Workers: workers,
+		Handle: func(int64, *BtcLightMirrorV2, error) {
+			done.Done()
+		},
+	})
+}
+
+// waitStats polls the stats of s until ok accepts them.
+func waitStats(t *testing.T, s *FetchScheduler, ok func(FetchSchedulerStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(s.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats: got %+v", s.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFetchSchedulerPreemption(t *testing.T) {
+	const (
+		workers  = 2
+		backfill = 200
+		burst    = 20
+	)
+	f := newOrderFetcher(time.Millisecond)
+	var done sync.WaitGroup
+	done.Add(backfill + burst)
+	s := newTestScheduler(t, f, workers, &done)
+
+	if _, err := s.Schedule(0, backfill-1, PriorityBackfill); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	waitStats(t, s, func(stats FetchSchedulerStats) bool { return stats.Fetched >= 10 })
+	if _, err := s.Schedule(1000, 1000+burst-1, PriorityTip); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	done.Wait()
+
+	// The burst is fetched at once, but for the backfill fetches already
+	// in flight.
+	order := f.order()
+	first := -1
+	for i, height := range order {
+		if height < 1000 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if i >= first+burst+workers {
+			t.Fatalf("height %d fetched #%d, the burst starting at #%d: %v", height, i, first, order)
+		}
+	}
+	if first < 10 || len(order)-first < backfill/2 {
+		t.Errorf("burst fetched from #%d of %d", first, len(order))
+	}
+	if stats := s.Stats(); stats.Fetched != backfill+burst || stats.Queued != 0 || stats.InFlight != 0 {
+		t.Errorf("Stats: got %+v, want %d fetched", stats, backfill+burst)
+	}
+}
+
+func TestFetchSchedulerOnce(t *testing.T) {
+	f := newOrderFetcher(0)
+	var done sync.WaitGroup
+	s := newTestScheduler(t, f, 4, &done)
+
+	// Overlapping ranges queue every height once.
+	var wg sync.WaitGroup
+	done.Add(100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Schedule(int64(i*5), int64(i*5+50), FetchPriority(i%3)); err != nil {
+				t.Errorf("Schedule error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := s.Schedule(0, 99, PriorityBackfill); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	done.Wait()
+
+	for height := int64(0); height < 100; height++ {
+		if n := f.calls[height]; n != 1 {
+			t.Errorf("height %d fetched %d times, want 1", height, n)
+		}
+	}
+	if n, err := s.Schedule(0, 99, PriorityTip); err != nil || n != 0 {
+		t.Errorf("Schedule fetched heights: got %d, error %v, want 0", n, err)
+	}
+}
+
+func TestFetchSchedulerReprioritize(t *testing.T) {
+	f := newOrderFetcher(0)
+	f.gate = make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(10)
+	s := newTestScheduler(t, f, 1, &done)
+
+	if _, err := s.Schedule(0, 9, PriorityNormal); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	waitStats(t, s, func(stats FetchSchedulerStats) bool {
+		return stats.InFlight == 1 && stats.Queued == 9
+	})
+
+	// A new tip makes heights 5 to 9 urgent and 1 to 2 less so.
+	if n := s.Reprioritize(5, 20, PriorityTip); n != 5 {
+		t.Errorf("Reprioritize: got %d heights, want 5", n)
+	}
+	if n := s.Reprioritize(1, 2, PriorityBackfill); n != 2 {
+		t.Errorf("Reprioritize: got %d heights, want 2", n)
+	}
+	close(f.gate)
+	done.Wait()
+
+	want := []int64{0, 5, 6, 7, 8, 9, 3, 4, 1, 2}
+	order := f.order()
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("fetch order: got %v, want %v", order, want)
+		}
+	}
+}
+
+func TestFetchSchedulerFailure(t *testing.T) {
+	f := newOrderFetcher(0)
+	f.fail = map[int64]bool{3: true}
+	var (
+		mtx  sync.Mutex
+		errs = make(map[int64]error)
+		done sync.WaitGroup
+	)
+	s := startScheduler(t, FetchSchedulerConfig{
+		Fetcher: f,
+		Handle: func(height int64, m *BtcLightMirrorV2, err error) {
+			mtx.Lock()
+			errs[height] = err
+			mtx.Unlock()
+			done.Done()
+		},
+	})
+
+	done.Add(5)
+	if _, err := s.Schedule(0, 4, PriorityNormal); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	done.Wait()
+	if !errors.Is(errs[3], ErrNotFound) || errs[2] != nil {
+		t.Errorf("Handle: got errors %v", errs)
+	}
+	if stats := s.Stats(); stats.Fetched != 4 || stats.Failed != 1 {
+		t.Errorf("Stats: got %+v, want 4 fetched and 1 failed", stats)
+	}
+
+	// The failed height may be scheduled again.
+	done.Add(1)
+	if n, err := s.Schedule(0, 4, PriorityNormal); err != nil || n != 1 {
+		t.Errorf("Schedule again: got %d, error %v, want 1", n, err)
+	}
+	done.Wait()
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	if _, err := s.Schedule(5, 5, PriorityNormal); !errors.Is(err, ErrSchedulerClosed) {
+		t.Errorf("Schedule after Stop: got error %v, want %v", err, ErrSchedulerClosed)
+	}
+	if err := s.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("Start after Stop: got error %v, want %v", err, ErrAlreadyStarted)
+	}
+}
+
+func TestFetchSchedulerStop(t *testing.T) {
+	// The fetch in flight completes, the queued heights are dropped.
+	f := newOrderFetcher(0)
+	f.gate = make(chan struct{})
+	var handled []int64
+	s := startScheduler(t, FetchSchedulerConfig{
+		Fetcher: f,
+		Workers: 1,
+		Handle: func(height int64, m *BtcLightMirrorV2, err error) {
+			if err == nil {
+				handled = append(handled, height)
+			}
+		},
+	})
+	if _, err := s.Schedule(0, 9, PriorityNormal); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	waitStats(t, s, func(stats FetchSchedulerStats) bool { return stats.InFlight == 1 })
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(f.gate)
+	}()
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	if len(handled) != 1 || handled[0] != 0 {
+		t.Errorf("handled: got %v, want [0]", handled)
+	}
+
+	// A fetch outliving the deadline of Stop is cancelled.
+	f = newOrderFetcher(0)
+	f.gate = make(chan struct{})
+	var fetchErr error
+	s = startScheduler(t, FetchSchedulerConfig{
+		Fetcher: f,
+		Workers: 1,
+		Handle: func(height int64, m *BtcLightMirrorV2, err error) {
+			fetchErr = err
+		},
+	})
+	if _, err := s.Schedule(0, 0, PriorityNormal); err != nil {
+		t.Fatalf("Schedule error %v", err)
+	}
+	waitStats(t, s, func(stats FetchSchedulerStats) bool { return stats.InFlight == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !errors.Is(fetchErr, context.Canceled) {
+		t.Errorf("cancelled fetch: got error %v, want %v", fetchErr, context.Canceled)
+	}
+}
+
+func TestFetchPriorityStringer(t *testing.T) {
+	tests := []struct {
+		in   FetchPriority
+		want string
+	}{
+		{PriorityBackfill, "backfill"},
+		{PriorityNormal, "normal"},
+		{PriorityTip, "tip"},
+		{7, "Unknown FetchPriority (7)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d: got %s, want %s", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrSignetSolution is returned when the signet solution of a block does not
+// satisfy the challenge of the network.
+var ErrSignetSolution = errors.New("invalid signet solution")
+
+// signetHeader starts the push of the witness commitment script carrying the
+// signet solution, as BIP 325 defines it.
+var signetHeader = []byte{0xec, 0xc7, 0xda, 0xa2}
+
+// signetVerifyFlags are the script flags the signet solution is verified
+// under, those of Bitcoin Core.
+const signetVerifyFlags = txscript.ScriptBip16 | txscript.ScriptVerifyWitness |
+	txscript.ScriptVerifyDERSignatures | txscript.ScriptStrictMultiSig
+
+// SignetSolution is the solution a signet block carries to the challenge of
+// its network: the signature script and the witness spending the challenge.
+type SignetSolution struct {
+	SignatureScript []byte
+	Witness         wire.TxWitness
+}
+
+// WithSignetChallenge sets the challenge script the blocks of a custom signet
+// are signed for.  On the default signet, chaincfg.SigNetParams, the chain
+// checks chaincfg.DefaultSignetChallenge without it.
+//
+// On a signet, a valid solution satisfies the work requirement of an
+// appended mirror in place of its proof of work hash; its bits must still
+// be within the limit of the network, and set its work.  Header-only blocks
+// and pruned blocks, which have no coinbase, are checked on their proof of
+// work hash, which the blocks of a signet also satisfy.
+func WithSignetChallenge(challenge []byte) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.signetChallenge = challenge
+	}
+}
+
+// WithValidationSignetChallenge sets the challenge script the blocks of a
+// custom signet are validated against, as WithSignetChallenge does for a
+// chain.
+func WithValidationSignetChallenge(challenge []byte) ValidateOption {
+	return func(cfg *validateConfig) {
+		cfg.signetChallenge = challenge
+	}
+}
+
+// signetChallenge returns the challenge blocks of the network of params are
+// signed for, challenge for a custom signet, or nil if the network is not a
+// signet.  It fails for a custom signet without challenge, and for a
+// challenge which is not that of the network, whose magic derives from its
+// challenge.
+func signetChallenge(params *chaincfg.Params, challenge []byte) ([]byte, error) {
+	if params.Name != chaincfg.SigNetParams.Name {
+		if challenge != nil {
+			return nil, fmt.Errorf("signet challenge given for the %s "+
+				"network", params.Name)
+		}
+		return nil, nil
+	}
+	if challenge == nil {
+		if params.Net != chaincfg.SigNetParams.Net {
+			return nil, fmt.Errorf("custom signet %v needs its challenge",
+				params.Net)
+		}
+		return chaincfg.DefaultSignetChallenge, nil
+	}
+	if net := chaincfg.CustomSignetParams(challenge, nil).Net; net != params.Net {
+		return nil, fmt.Errorf("signet challenge is that of network %v, "+
+			"not %v", net, params.Net)
+	}
+	return challenge, nil
+}
+
+// ExtractSignetSolution returns the signet solution of the coinbase of a
+// block, carried in a push of its witness commitment script, and whether
+// the coinbase has one.  A block without solution satisfies a challenge
+// such as OP_TRUE that needs none.  It fails if the coinbase has no witness
+// commitment or the solution does not decode.
+func ExtractSignetSolution(coinbase *wire.MsgTx) (*SignetSolution, bool, error) {
+	i := witnessCommitmentIndex(coinbase)
+	if i < 0 {
+		return nil, false, fmt.Errorf("coinbase has no witness commitment: %w",
+			ErrSignetSolution)
+	}
+	data, _ := splitSignetCommitment(coinbase.TxOut[i].PkScript)
+	if data == nil {
+		return nil, false, nil
+	}
+
+	r := bytes.NewReader(data)
+	var solution SignetSolution
+	var err error
+	solution.SignatureScript, err = wire.ReadVarBytes(r, 0, maxDecodeScriptSize,
+		"signet signature script")
+	if err != nil {
+		return nil, false, fmt.Errorf("signet solution: %v: %w", err, ErrSignetSolution)
+	}
+	count, err := wire.ReadVarInt(r, 0)
+	if err == nil && count > maxDecodeWitnessItems {
+		err = fmt.Errorf("%d witness items", count)
+	}
+	for i := uint64(0); err == nil && i < count; i++ {
+		var item []byte
+		item, err = wire.ReadVarBytes(r, 0, maxDecodeScriptSize, "signet witness item")
+		solution.Witness = append(solution.Witness, item)
+	}
+	if err == nil && r.Len() > 0 {
+		err = fmt.Errorf("%d bytes after the witness", r.Len())
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("signet solution: %v: %w", err, ErrSignetSolution)
+	}
+	return &solution, true, nil
+}
+
+// splitSignetCommitment returns the signet solution in the witness
+// commitment script, the data following signetHeader in the first push
+// starting with it, and the script with that push cut down to signetHeader.
+// Without such a push, the data is nil and the script returned is script.
+// The script is rewritten as Bitcoin Core does, which encodes the pushes
+// with the shortest length prefix.
+func splitSignetCommitment(script []byte) ([]byte, []byte) {
+	var data, stripped []byte
+	found := false
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	for tokenizer.Next() {
+		push := tokenizer.Data()
+		if len(push) == 0 {
+			stripped = append(stripped, tokenizer.Opcode())
+			continue
+		}
+		if !found && len(push) > len(signetHeader) && bytes.HasPrefix(push, signetHeader) {
+			data = append([]byte(nil), push[len(signetHeader):]...)
+			push = signetHeader
+			found = true
+		}
+		stripped = appendPush(stripped, push)
+	}
+	if !found {
+		return nil, script
+	}
+	return data, stripped
+}
+
+// appendPush appends to script the push of data with the length prefix of
+// the CScript serialization of Bitcoin Core.
+func appendPush(script, data []byte) []byte {
+	switch n := len(data); {
+	case n < txscript.OP_PUSHDATA1:
+		script = append(script, byte(n))
+	case n <= 0xff:
+		script = append(script, txscript.OP_PUSHDATA1, byte(n))
+	case n <= 0xffff:
+		script = append(script, txscript.OP_PUSHDATA2, 0, 0)
+		binary.LittleEndian.PutUint16(script[len(script)-2:], uint16(n))
+	default:
+		script = append(script, txscript.OP_PUSHDATA4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(script[len(script)-4:], uint32(n))
+	}
+	return append(script, data...)
+}
+
+// signetTxs returns the virtual transactions of BIP 325 the signet solution
+// of the mirror is checked with: toSpend, paying to challenge and committing
+// to the block without its solution, and toSign, spending it with the
+// solution.
+func (light *BtcLightMirrorV2) signetTxs(challenge []byte) (toSpend, toSign *wire.MsgTx, err error) {
+	solution, ok, err := ExtractSignetSolution(light.Coinbase())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		solution = &SignetSolution{}
+	}
+
+	// The block is committed to with the merkle root it would have
+	// without the solution.
+	modified := light.Coinbase().Copy()
+	i := witnessCommitmentIndex(modified)
+	_, modified.TxOut[i].PkScript = splitSignetCommitment(modified.TxOut[i].PkScript)
+	modifiedHash := modified.TxHash()
+	signetRoot := calculateMerkleRoot(&modifiedHash, light.MerkleNodes)
+
+	header := &light.BtcHeader
+	blockData := make([]byte, 0, 72)
+	blockData = append(blockData, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(blockData, uint32(header.Version))
+	blockData = append(blockData, header.PrevBlock[:]...)
+	blockData = append(blockData, signetRoot[:]...)
+	blockData = append(blockData, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(blockData[68:], uint32(header.Timestamp.Unix()))
+
+	toSpend = &wire.MsgTx{
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript:  appendPush([]byte{txscript.OP_0}, blockData),
+		}},
+		TxOut: []*wire.TxOut{{PkScript: challenge}},
+	}
+	toSign = &wire.MsgTx{
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Hash: toSpend.TxHash()},
+			SignatureScript:  solution.SignatureScript,
+			Witness:          solution.Witness,
+		}},
+		TxOut: []*wire.TxOut{{PkScript: []byte{txscript.OP_RETURN}}},
+	}
+	return toSpend, toSign, nil
+}
+
+// VerifySignetSolution checks the signet solution of the mirror against
+// challenge, running the script engine as BIP 325 specifies.  The errors
+// wrap ErrSignetSolution.
+func (light *BtcLightMirrorV2) VerifySignetSolution(challenge []byte) error {
+	_, toSign, err := light.signetTxs(challenge)
+	if err != nil {
+		return err
+	}
+	fetcher := txscript.NewCannedPrevOutputFetcher(challenge, 0)
+	vm, err := txscript.NewEngine(challenge, toSign, 0, signetVerifyFlags, nil,
+		txscript.NewTxSigHashes(toSign, fetcher), 0, fetcher)
+	if err == nil {
+		err = vm.Execute()
+	}
+	if err != nil {
+		return fmt.Errorf("block %v: %v: %w", light.BtcHeader.BlockHash(), err,
+			ErrSignetSolution)
+	}
+	return nil
+}
+
+// checkSignet is the check of the work of a mirror of hash on a signet whose
+// blocks are signed for challenge: its target must be within the limit of
+// params, and its solution must satisfy challenge, which stands in for the
+// proof of work hash.  The genesis block, which has no solution, passes.
+func checkSignet(m *BtcLightMirrorV2, hash chainhash.Hash, params *chaincfg.Params, challenge []byte) error {
+	if _, err := checkTarget(&m.BtcHeader, params.PowLimit); err != nil {
+		return err
+	}
+	if hash == *params.GenesisHash {
+		return nil
+	}
+	return m.VerifySignetSolution(challenge)
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// signetTestBits are the bits of the test signet blocks, the proof of work
+// limit of the signets.
+const signetTestBits = 0x1e0377ae
+
+// newSignetKey returns a private key derived from seed and its challenge,
+// a pay to public key script.
+func newSignetKey(seed byte) (*btcec.PrivateKey, []byte) {
+	key, pub := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{seed}, 32))
+	challenge := appendPush(nil, pub.SerializeCompressed())
+	return key, append(challenge, txscript.OP_CHECKSIG)
+}
+
+// newSignetMirror returns a mirror building on prev whose coinbase has a
+// witness commitment, but no signet solution.
+func newSignetMirror(t *testing.T, prev chainhash.Hash, seed uint32) *BtcLightMirrorV2 {
+	t.Helper()
+	commitment := append([]byte(nil), witnessCommitmentHeader...)
+	commitment = append(commitment, make([]byte, chainhash.HashSize)...)
+	coinbase := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript:  []byte{0x04, byte(seed), byte(seed >> 8), byte(seed >> 16), byte(seed >> 24)},
+			Sequence:         wire.MaxTxInSequenceNum,
+		}},
+		TxOut: []*wire.TxOut{
+			{Value: 5000000000, PkScript: []byte{txscript.OP_TRUE}},
+			{PkScript: commitment},
+		},
+	}
+	txids := []chainhash.Hash{coinbase.TxHash(), {byte(seed), 1}}
+	root := BuildMerkleTreeStore(&txids[0], txids[1:])
+	header := &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  prev,
+		MerkleRoot: *root[len(root)-1],
+		Timestamp:  time.Unix(1598918400+int64(seed)*600, 0),
+		Bits:       signetTestBits,
+	}
+	m, err := New(header, coinbase, txids)
+	if err != nil {
+		t.Fatalf("New error %v", err)
+	}
+	return m
+}
+
+// signSignetMirror adds to the witness commitment of m the solution to
+// challenge signed by key, followed by extra, and updates the merkle root of
+// its header.
+func signSignetMirror(t *testing.T, m *BtcLightMirrorV2, challenge []byte, key *btcec.PrivateKey, extra []byte) {
+	t.Helper()
+
+	// As the solution is committed to without its data, the signature is
+	// over the block with an empty solution, as in Bitcoin Core.
+	out := m.CoinBaseTx.TxOut[witnessCommitmentIndex(&m.CoinBaseTx)]
+	commitment := out.PkScript
+	out.PkScript = appendPush(commitment, signetHeader)
+	_, toSign, err := m.signetTxs(challenge)
+	if err != nil {
+		t.Fatalf("signetTxs error %v", err)
+	}
+	sig, err := txscript.RawTxInSignature(toSign, 0, challenge, txscript.SigHashAll, key)
+	if err != nil {
+		t.Fatalf("RawTxInSignature error %v", err)
+	}
+
+	var solution bytes.Buffer
+	solution.Write(signetHeader)
+	if err := wire.WriteVarBytes(&solution, 0, appendPush(nil, sig)); err != nil {
+		t.Fatalf("WriteVarBytes error %v", err)
+	}
+	if err := wire.WriteVarInt(&solution, 0, 0); err != nil {
+		t.Fatalf("WriteVarInt error %v", err)
+	}
+	solution.Write(extra)
+
+	out.PkScript = appendPush(commitment, solution.Bytes())
+	hash := m.CoinBaseTx.TxHash()
+	m.BtcHeader.MerkleRoot = calculateMerkleRoot(&hash, m.MerkleNodes)
+}
+
+// newSignetBranch returns n linked mirrors building on parent, signed by key
+// for challenge.
+func newSignetBranch(t *testing.T, parent *BtcLightMirrorV2, seed uint32, n int, challenge []byte, key *btcec.PrivateKey) []*BtcLightMirrorV2 {
+	t.Helper()
+	branch := make([]*BtcLightMirrorV2, 0, n)
+	prev := parent.BtcHeader.BlockHash()
+	for i := 0; i < n; i++ {
+		m := newSignetMirror(t, prev, seed+uint32(i))
+		signSignetMirror(t, m, challenge, key, nil)
+		branch = append(branch, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+	return branch
+}
+
+func TestExtractSignetSolution(t *testing.T) {
+	key, challenge := newSignetKey(1)
+	unsigned := newSignetMirror(t, chainhash.Hash{}, 1)
+	signed := newSignetMirror(t, chainhash.Hash{}, 1)
+	signSignetMirror(t, signed, challenge, key, nil)
+	trailing := newSignetMirror(t, chainhash.Hash{}, 1)
+	signSignetMirror(t, trailing, challenge, key, []byte{0})
+	plain := newTestMirror(chainhash.Hash{}, 1, 0)
+
+	tests := []struct {
+		name string
+		m    *BtcLightMirrorV2
+		ok   bool
+		err  error
+	}{
+		{"unsigned", unsigned, false, nil},
+		{"signed", signed, true, nil},
+		{"trailing", trailing, false, ErrSignetSolution},
+		{"no commitment", plain, false, ErrSignetSolution},
+	}
+	for _, test := range tests {
+		solution, ok, err := ExtractSignetSolution(&test.m.CoinBaseTx)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ExtractSignetSolution (%s): got error %v, want %v", test.name,
+				err, test.err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("ExtractSignetSolution (%s): got solution %v, want %v",
+				test.name, ok, test.ok)
+		}
+		if ok && (len(solution.SignatureScript) == 0 || len(solution.Witness) != 0) {
+			t.Errorf("ExtractSignetSolution (%s): got solution %+v", test.name,
+				solution)
+		}
+	}
+
+	// Stripping the solution gives back the commitment it was added to.
+	i := witnessCommitmentIndex(&signed.CoinBaseTx)
+	_, stripped := splitSignetCommitment(signed.CoinBaseTx.TxOut[i].PkScript)
+	want := appendPush(unsigned.CoinBaseTx.TxOut[i].PkScript, signetHeader)
+	if !bytes.Equal(stripped, want) {
+		t.Errorf("splitSignetCommitment: got %x, want %x", stripped, want)
+	}
+}
+
+func TestVerifySignetSolution(t *testing.T) {
+	key, challenge := newSignetKey(1)
+	otherKey, otherChallenge := newSignetKey(2)
+
+	signed := newSignetMirror(t, chainhash.Hash{}, 1)
+	signSignetMirror(t, signed, challenge, key, nil)
+	wrongKey := newSignetMirror(t, chainhash.Hash{}, 1)
+	signSignetMirror(t, wrongKey, challenge, otherKey, nil)
+	tampered := newSignetMirror(t, chainhash.Hash{}, 1)
+	signSignetMirror(t, tampered, challenge, key, nil)
+	tampered.BtcHeader.Timestamp = tampered.BtcHeader.Timestamp.Add(time.Second)
+	unsigned := newSignetMirror(t, chainhash.Hash{}, 1)
+
+	tests := []struct {
+		name      string
+		m         *BtcLightMirrorV2
+		challenge []byte
+		valid     bool
+	}{
+		{"signed", signed, challenge, true},
+		{"other challenge", signed, otherChallenge, false},
+		{"wrong key", wrongKey, challenge, false},
+		{"tampered", tampered, challenge, false},
+		{"unsigned", unsigned, challenge, false},
+		{"OP_TRUE", unsigned, []byte{txscript.OP_TRUE}, true},
+		{"no commitment", newTestMirror(chainhash.Hash{}, 1, 0), []byte{txscript.OP_TRUE}, false},
+	}
+	for _, test := range tests {
+		err := test.m.VerifySignetSolution(test.challenge)
+		if test.valid && err != nil {
+			t.Errorf("VerifySignetSolution (%s) error %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrSignetSolution) {
+			t.Errorf("VerifySignetSolution (%s): got error %v, want %v", test.name,
+				err, ErrSignetSolution)
+		}
+	}
+}
+
+func TestSignetChallenge(t *testing.T) {
+	_, challenge := newSignetKey(1)
+	_, otherChallenge := newSignetKey(2)
+	custom := chaincfg.CustomSignetParams(challenge, nil)
+
+	tests := []struct {
+		name      string
+		params    *chaincfg.Params
+		challenge []byte
+		want      []byte
+		valid     bool
+	}{
+		{"regtest", &chaincfg.RegressionNetParams, nil, nil, true},
+		{"regtest challenge", &chaincfg.RegressionNetParams, challenge, nil, false},
+		{"default signet", &chaincfg.SigNetParams, nil, chaincfg.DefaultSignetChallenge, true},
+		{"custom signet", &custom, challenge, challenge, true},
+		{"custom signet no challenge", &custom, nil, nil, false},
+		{"custom signet other challenge", &custom, otherChallenge, nil, false},
+	}
+	for _, test := range tests {
+		got, err := signetChallenge(test.params, test.challenge)
+		if test.valid && err != nil {
+			t.Errorf("signetChallenge (%s) error %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("signetChallenge (%s): expected error", test.name)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("signetChallenge (%s): got %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSignetValidation(t *testing.T) {
+	key, challenge := newSignetKey(1)
+	otherKey, _ := newSignetKey(2)
+	params := chaincfg.CustomSignetParams(challenge, nil)
+
+	anchor := newSignetMirror(t, chainhash.Hash{}, 0)
+	mirrors := newSignetBranch(t, anchor, 1, 3, challenge, key)
+	forged := newSignetBranch(t, mirrors[1], 10, 1, challenge, otherKey)[0]
+
+	opts := []ChainOption{WithChainParams(&params), WithSignetChallenge(challenge)}
+	c, err := NewMirrorChain(anchor, testAnchorHeight, opts...)
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	for i, m := range mirrors {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append #%d error %v", i, err)
+		}
+	}
+	if _, err := c.Append(forged); !errors.Is(err, ErrSignetSolution) {
+		t.Errorf("Append: got error %v, want %v", err, ErrSignetSolution)
+	}
+	if _, err := NewMirrorChain(anchor, testAnchorHeight, WithChainParams(&params)); err == nil {
+		t.Errorf("NewMirrorChain: expected error without the challenge")
+	}
+
+	ctx := context.Background()
+	err = ValidateChainParallel(ctx, mirrors, &params, 2, WithValidationSignetChallenge(challenge))
+	if err != nil {
+		t.Errorf("ValidateChainParallel error %v", err)
+	}
+	err = ValidateChainParallel(ctx, append(mirrors[:2:2], forged), &params, 2,
+		WithValidationSignetChallenge(challenge))
+	if !errors.Is(err, ErrSignetSolution) {
+		t.Errorf("ValidateChainParallel: got error %v, want %v", err, ErrSignetSolution)
+	}
+
+	for _, test := range []struct {
+		name    string
+		mirrors []*BtcLightMirrorV2
+		valid   bool
+	}{
+		{"signed", mirrors, true},
+		{"forged", append(mirrors[:2:2], forged), false},
+	} {
+		p, err := NewPipeline(PipelineConfig{
+			Fetcher:         newCountingFetcher(test.mirrors),
+			Store:           newMemStore(),
+			Params:          &params,
+			SignetChallenge: challenge,
+		})
+		if err != nil {
+			t.Fatalf("NewPipeline (%s) error %v", test.name, err)
+		}
+		_, err = p.Run(ctx, 0, 2)
+		if test.valid && err != nil {
+			t.Errorf("Run (%s) error %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrSignetSolution) {
+			t.Errorf("Run (%s): got error %v, want %v", test.name, err, ErrSignetSolution)
+		}
+	}
+}
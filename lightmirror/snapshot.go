@@ -0,0 +1,314 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot layout.  A snapshot holds the best chain of a MirrorChain and
+// does not depend on its store:
+//
+//	magic       4 bytes, "LMSS"
+//	version     uint32 little endian
+//	height      int64 little endian, height of the anchor
+//	compression the Compression tag of the following fields up to the
+//	            checksum, from version 2 on
+//	anchor      the serialized anchor mirror
+//	batches     SerializeBatch batches of the following mirrors in height
+//	            order, ended by an empty batch
+//	checksum    uint32 little endian, CRC-32C of everything before it,
+//	            uncompressed
+//
+// Uncompressed snapshots are written in version 1, which older readers
+// understand.
+const (
+	snapshotMagic   = "LMSS"
+	snapshotVersion = 1
+
+	// snapshotCompressedVersion is the version of compressed snapshots.
+	snapshotCompressedVersion = 2
+
+	// snapshotBatchSize is the number of mirrors per exported batch.
+	snapshotBatchSize = 1000
+)
+
+var (
+	// ErrSnapshotAnchor is returned when importing a snapshot taken from a
+	// chain with another anchor.
+	ErrSnapshotAnchor = errors.New("snapshot anchor does not match the chain anchor")
+
+	// ErrSnapshotChecksum is returned when importing a snapshot whose
+	// checksum does not match its content.
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ExportSnapshot writes the anchor and the best chain to w, compressed as
+// the options tell.  Side branches are not exported.  It returns ErrPruned
+// when the best chain holds pruned blocks, including a header-only anchor,
+// and ErrHeaderOnly when it holds blocks whose body is not attached yet.
+//
+// The chain is only locked while the mirrors to export are collected, not
+// while they are written.
+func (c *MirrorChain) ExportSnapshot(w io.Writer, opts ...CompressionOption) error {
+	cfg := newCompressionConfig(opts)
+	anchor, anchorHeight, mirrors, err := c.snapshotMirrors()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	checksum := crc32.New(castagnoli)
+	mw := io.MultiWriter(bw, checksum)
+
+	header := make([]byte, 16, 17)
+	copy(header[0:4], snapshotMagic)
+	binary.LittleEndian.PutUint32(header[4:8], snapshotVersion)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(anchorHeight))
+	if cfg.compression != CompressionNone {
+		binary.LittleEndian.PutUint32(header[4:8], snapshotCompressedVersion)
+		header = append(header, byte(cfg.compression))
+	}
+	if _, err := mw.Write(header); err != nil {
+		return err
+	}
+	cw, err := cfg.compressor(bw)
+	if err != nil {
+		return err
+	}
+	mw = io.MultiWriter(cw, checksum)
+	if err := anchor.Serialize(mw); err != nil {
+		return err
+	}
+
+	for len(mirrors) > 0 {
+		n := len(mirrors)
+		if n > snapshotBatchSize {
+			n = snapshotBatchSize
+		}
+		if err := SerializeBatch(mw, mirrors[:n]); err != nil {
+			return err
+		}
+		mirrors = mirrors[n:]
+	}
+	if err := SerializeBatch(mw, nil); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], checksum.Sum32())
+	if _, err := bw.Write(sum[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// snapshotMirrors returns the anchor, its height and the following best
+// chain mirrors.  The mirrors of the chain are never modified once added, so
+// they can be used after the lock is released.
+func (c *MirrorChain) snapshotMirrors() (*BtcLightMirrorV2, int64, []*BtcLightMirrorV2, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	if c.anchor.pruned {
+		return nil, 0, nil, ErrPruned
+	}
+	mirrors := make([]*BtcLightMirrorV2, 0, c.tip.height-c.anchor.height)
+	for height := c.anchor.height + 1; height <= c.tip.height; height++ {
+		hash, _ := c.best.HashAtHeight(height)
+		e := c.index[hash]
+		if err := e.bodyErr(); err != nil {
+			return nil, 0, nil, err
+		}
+		mirrors = append(mirrors, e.mirror)
+	}
+	return c.anchor.mirror, c.anchor.height, mirrors, nil
+}
+
+// ImportSnapshot replaces the best chain with the one read from r, which
+// must have been exported from a chain with the same anchor.  Every mirror
+// must build on the previous one and pass the proof of work and merkle
+// checks.  The whole snapshot is read and validated before the chain is
+// touched, so an invalid snapshot leaves it unchanged.  Known side branches
+// are dropped.  A compressed snapshot is decompressed as it is read, and
+// fails with ErrDecompressionLimit if it decompresses to more than 64 times
+// its size plus a megabyte.
+//
+// When the chain has a store, the blocks that differ from the current best
+// chain are then written to it, as a reorganization writes them: in one
+// transaction for a BatchStore, otherwise one at a time, undoing the writes
+// already made when one fails.  Pruned blocks deleted before the failure
+// can not be put back, which NewMirrorChain recovers from.
+//
+// The chain is only locked once the snapshot is validated.
+func (c *MirrorChain) ImportSnapshot(r io.Reader) error {
+	imported, err := c.readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.replace(imported)
+}
+
+// readSnapshot reads and validates a snapshot into a new chain with the same
+// anchor and parameters as c, but neither store nor pruning.
+func (c *MirrorChain) readSnapshot(r io.Reader) (*MirrorChain, error) {
+	// Replacing the best chain keeps the anchor block, so the anchor read
+	// here stays valid after the lock is released.
+	c.mtx.RLock()
+	anchorMirror, anchorHeight := c.anchor.mirror, c.anchor.height
+	c.mtx.RUnlock()
+	if anchorMirror == nil {
+		return nil, ErrPruned
+	}
+
+	br := bufio.NewReader(r)
+	checksum := crc32.New(castagnoli)
+	tr := io.TeeReader(br, checksum)
+
+	var header [16]byte
+	if _, err := io.ReadFull(tr, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:4], []byte(snapshotMagic)) {
+		return nil, fmt.Errorf("invalid snapshot magic %x", header[0:4])
+	}
+	compression := CompressionNone
+	switch version := binary.LittleEndian.Uint32(header[4:8]); version {
+	case snapshotVersion:
+	case snapshotCompressedVersion:
+		var tag [1]byte
+		if _, err := io.ReadFull(tr, tag[:]); err != nil {
+			return nil, err
+		}
+		compression = Compression(tag[0])
+	default:
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	dr, err := decompressor(br, compression)
+	if err != nil {
+		return nil, err
+	}
+	tr = io.TeeReader(dr, checksum)
+
+	anchor := new(BtcLightMirrorV2)
+	if err := anchor.DeserializeWith(tr, c.cfg.decode); err != nil {
+		return nil, err
+	}
+	if int64(binary.LittleEndian.Uint64(header[8:16])) != anchorHeight ||
+		anchor.BtcHeader.BlockHash() != anchorMirror.BtcHeader.BlockHash() {
+
+		return nil, ErrSnapshotAnchor
+	}
+
+	imported, err := NewMirrorChain(anchorMirror, anchorHeight,
+		WithChainParams(c.cfg.params), WithPowHash(c.cfg.powHash),
+		WithSignetChallenge(c.cfg.signetChallenge),
+		WithMaxTxCount(c.cfg.decode.MaxTxCount))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		batch, err := DeserializeBatchWith(tr, c.cfg.decode)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, m := range batch {
+			if m.BtcHeader.PrevBlock != imported.tip.hash {
+				return nil, fmt.Errorf("snapshot mirror %v at height %d does "+
+					"not build on %v", m.BtcHeader.BlockHash(),
+					imported.tip.height+1, imported.tip.hash)
+			}
+			if _, err := imported.Append(m); err != nil {
+				return nil, fmt.Errorf("snapshot mirror %v at height %d: %w",
+					m.BtcHeader.BlockHash(), imported.tip.height+1, err)
+			}
+		}
+	}
+
+	if err := finishDecompressed(dr, compression); err != nil {
+		return nil, err
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != checksum.Sum32() {
+		return nil, ErrSnapshotChecksum
+	}
+	return imported, nil
+}
+
+// replace makes the best chain of imported, which shares the anchor of c, the
+// best chain of c.
+func (c *MirrorChain) replace(imported *MirrorChain) error {
+	if c.cfg.store != nil {
+		var deletes, puts []*chainEntry
+		for height := c.tip.height; height > c.anchor.height; height-- {
+			hash, _ := c.best.HashAtHeight(height)
+			if kept, err := imported.best.HashAtHeight(height); err == nil && kept == hash {
+				continue
+			}
+			deletes = append(deletes, c.index[hash])
+		}
+		for height := c.anchor.height + 1; height <= imported.tip.height; height++ {
+			hash, _ := imported.best.HashAtHeight(height)
+			if old, err := c.best.HashAtHeight(height); err == nil &&
+				old == hash && c.index[old].mirror != nil {
+
+				continue
+			}
+			puts = append(puts, imported.index[hash])
+		}
+		if err := c.switchStore(deletes, puts); err != nil {
+			return err
+		}
+	}
+
+	// The blocks below the first difference are kept.
+	fork := c.anchor.height
+	for ; fork < c.tip.height && fork < imported.tip.height; fork++ {
+		old, _ := c.best.HashAtHeight(fork + 1)
+		hash, _ := imported.best.HashAtHeight(fork + 1)
+		if old != hash {
+			break
+		}
+	}
+	var detach, attach []*chainEntry
+	for height := c.tip.height; height > fork; height-- {
+		hash, _ := c.best.HashAtHeight(height)
+		detach = append(detach, c.index[hash])
+	}
+	for height := fork + 1; height <= imported.tip.height; height++ {
+		hash, _ := imported.best.HashAtHeight(height)
+		attach = append(attach, imported.index[hash])
+	}
+
+	c.anchor = imported.anchor
+	c.tip = imported.tip
+	c.index = imported.index
+	c.best = imported.best
+	c.seq = imported.seq
+	c.pruneHeight = c.anchor.height
+	c.notifyTipChange(detach, attach, c.recordConflicts(detach, attach))
+	return c.prune()
+}
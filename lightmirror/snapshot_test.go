@@ -0,0 +1,258 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func exportSnapshot(t *testing.T, c *MirrorChain) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := c.ExportSnapshot(&buf); err != nil {
+		t.Fatalf("ExportSnapshot error %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshot(t *testing.T) {
+	mirrors := newTestMirrors(8)
+	src := newTestChain(t, mirrors)
+	// Side branches are not exported.
+	if _, err := src.Append(newTestBranch(mirrors[5], 1000, 1)[0]); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	snapshot := exportSnapshot(t, src)
+
+	// Import into a chain holding a competing branch, which is replaced.
+	store := newMemStore()
+	dst := newTestChain(t, mirrors[:4], WithStore(store))
+	for _, m := range newTestBranch(mirrors[3], 2000, 6) {
+		if _, err := dst.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	events, cancel := dst.Subscribe()
+	defer cancel()
+	if err := dst.ImportSnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("ImportSnapshot error %v", err)
+	}
+	// The branch of six blocks is replaced by the four last mirrors.
+	got := drain(events)
+	if len(got) != 10 || got[0].Type != BlockDisconnected ||
+		got[0].Height != testAnchorHeight+9 || got[9].Type != BlockConnected ||
+		got[9].Height != testAnchorHeight+7 {
+
+		t.Errorf("ImportSnapshot: got %d events", len(got))
+	}
+	for i, m := range mirrors {
+		hash, err := dst.HashAtHeight(testAnchorHeight + int64(i))
+		if err != nil || hash != m.BtcHeader.BlockHash() {
+			t.Errorf("HashAtHeight #%d: got %v, %v", i, hash, err)
+		}
+	}
+	if _, height := dst.Tip(); height != testAnchorHeight+7 {
+		t.Errorf("Tip: got height %d", height)
+	}
+	checkStore(t, dst, store)
+
+	// A chain reloaded from the store matches the imported one.
+	reloaded, err := NewMirrorChain(mirrors[0], testAnchorHeight,
+		WithChainParams(&chaincfg.RegressionNetParams), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	if !bytes.Equal(exportSnapshot(t, reloaded), snapshot) {
+		t.Errorf("ExportSnapshot: reloaded chain exports another snapshot")
+	}
+}
+
+func TestSnapshotCompressed(t *testing.T) {
+	mirrors := newTestMirrors(30)
+	src := newTestChain(t, mirrors)
+	plain := exportSnapshot(t, src)
+	var buf bytes.Buffer
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		buf.Reset()
+		if err := src.ExportSnapshot(&buf, WithCompression(c, 0)); err != nil {
+			t.Fatalf("ExportSnapshot (%v) error %v", c, err)
+		}
+		compressed := buf.Bytes()
+		if binary.LittleEndian.Uint32(compressed[4:8]) != snapshotCompressedVersion ||
+			Compression(compressed[16]) != c || len(compressed) >= len(plain) {
+			t.Fatalf("ExportSnapshot (%v): version %d, tag %d, %d bytes, uncompressed %d", c,
+				binary.LittleEndian.Uint32(compressed[4:8]), compressed[16], len(compressed), len(plain))
+		}
+
+		dst := newTestChain(t, mirrors[:1])
+		if err := dst.ImportSnapshot(bytes.NewReader(compressed)); err != nil {
+			t.Fatalf("ImportSnapshot (%v) error %v", c, err)
+		}
+		if !bytes.Equal(exportSnapshot(t, dst), plain) {
+			t.Errorf("ImportSnapshot (%v): imported chain exports another snapshot", c)
+		}
+
+		// The checksum covers the uncompressed content.
+		corrupt := append([]byte(nil), compressed...)
+		corrupt[len(corrupt)-1] ^= 1
+		if err := dst.ImportSnapshot(bytes.NewReader(corrupt)); !errors.Is(err, ErrSnapshotChecksum) {
+			t.Errorf("ImportSnapshot corrupt (%v): got error %v, want %v", c, err, ErrSnapshotChecksum)
+		}
+	}
+	if err := src.ExportSnapshot(&buf, WithCompression(0xff, 0)); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("ExportSnapshot unknown compression: got error %v, want %v", err, ErrUnsupportedCompression)
+	}
+}
+
+// buildSnapshot encodes a snapshot of arbitrary mirrors on top of the anchor.
+func buildSnapshot(t *testing.T, anchor *BtcLightMirrorV2, mirrors []*BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var header [16]byte
+	copy(header[0:4], snapshotMagic)
+	binary.LittleEndian.PutUint32(header[4:8], snapshotVersion)
+	binary.LittleEndian.PutUint64(header[8:16], testAnchorHeight)
+	buf.Write(header[:])
+	if err := anchor.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	if err := SerializeBatch(&buf, mirrors); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+	if err := SerializeBatch(&buf, nil); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(buf.Bytes(), castagnoli))
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	mirrors := newTestMirrors(6)
+	snapshot := exportSnapshot(t, newTestChain(t, mirrors))
+	if !bytes.Equal(buildSnapshot(t, mirrors[0], mirrors[1:]), snapshot) {
+		t.Fatalf("buildSnapshot: differs from ExportSnapshot")
+	}
+
+	badMerkle := newTestMirror(mirrors[4].BtcHeader.BlockHash(), 60, 2)
+	badMerkle.MerkleNodes[0][0] ^= 0xff
+	badPow := newTestMirror(mirrors[4].BtcHeader.BlockHash(), 61, 0)
+	for checkProofOfWork(&badPow.BtcHeader, chaincfg.RegressionNetParams.PowLimit, nil) == nil {
+		badPow.BtcHeader.Nonce++
+	}
+	// A valid block, but on a fork.
+	fork := newTestBranch(mirrors[2], 1000, 1)[0]
+
+	flip := func(b []byte, offset int) []byte {
+		b = append([]byte(nil), b...)
+		b[offset] ^= 0xff
+		return b
+	}
+	withLast := func(m *BtcLightMirrorV2) []byte {
+		return buildSnapshot(t, mirrors[0], append(mirrors[1:5:5], m, mirrors[5]))
+	}
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		err      error
+	}{
+		{"bad magic", flip(snapshot, 0), nil},
+		{"bad version", flip(snapshot, 4), nil},
+		{"bad checksum", flip(snapshot, len(snapshot)-1), ErrSnapshotChecksum},
+		{"corrupt content", flip(snapshot, len(snapshot)-20), nil},
+		{"truncated", snapshot[:len(snapshot)-10], nil},
+		{"empty", nil, nil},
+		{"other anchor", buildSnapshot(t, mirrors[1], nil), ErrSnapshotAnchor},
+		{"bad merkle", withLast(badMerkle), nil},
+		{"bad proof of work", withLast(badPow), nil},
+		{"fork", withLast(fork), nil},
+	}
+	for _, test := range tests {
+		store := newMemStore()
+		c := newTestChain(t, mirrors[:3], WithStore(store))
+		err := c.ImportSnapshot(bytes.NewReader(test.snapshot))
+		if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("ImportSnapshot %s: got error %v, want %v", test.name,
+				err, test.err)
+		}
+		if _, height := c.Tip(); height != testAnchorHeight+2 {
+			t.Errorf("ImportSnapshot %s: tip moved to height %d", test.name,
+				height)
+		}
+		checkStore(t, c, store)
+	}
+}
+
+// TestSnapshotStoreFailure checks that a store failing while a snapshot is
+// imported is left on the previous best chain, as the chain is, and that a
+// BatchStore is written in one batch.
+func TestSnapshotStoreFailure(t *testing.T) {
+	mirrors := newTestMirrors(8)
+	snapshot := exportSnapshot(t, newTestChain(t, mirrors))
+	branch := newTestBranch(mirrors[3], 2000, 6)
+	errPut := errors.New("put failed")
+
+	for _, batch := range []bool{false, true} {
+		store := newMemStore()
+		var dstStore Store = store
+		batchStore := &batchMemStore{memStore: store}
+		if batch {
+			dstStore = batchStore
+		}
+		dst := newTestChain(t, mirrors[:4], WithStore(dstStore))
+		for _, m := range branch {
+			if _, err := dst.Append(m); err != nil {
+				t.Fatalf("Append error %v", err)
+			}
+		}
+
+		batchStore.batches = 0
+		store.putErr, store.putsLeft = errPut, 2
+		if err := dst.ImportSnapshot(bytes.NewReader(snapshot)); !errors.Is(err, errPut) {
+			t.Fatalf("ImportSnapshot (batch %v): got error %v, want %v", batch, err, errPut)
+		}
+		if _, height := dst.Tip(); height != testAnchorHeight+9 {
+			t.Errorf("ImportSnapshot (batch %v): tip moved to height %d", batch, height)
+		}
+		checkStore(t, dst, store)
+
+		if err := dst.ImportSnapshot(bytes.NewReader(snapshot)); err != nil {
+			t.Fatalf("ImportSnapshot (batch %v) error %v", batch, err)
+		}
+		checkStore(t, dst, store)
+		if batch && batchStore.batches != 2 {
+			t.Errorf("ImportSnapshot: got %d batches, want 2", batchStore.batches)
+		}
+	}
+}
+
+func TestSnapshotPruned(t *testing.T) {
+	mirrors := newTestMirrors(5)
+	c := newTestChain(t, mirrors, WithPruneDepth(2))
+	if err := c.ExportSnapshot(new(bytes.Buffer)); !errors.Is(err, ErrPruned) {
+		t.Errorf("ExportSnapshot pruned: got error %v, want %v", err, ErrPruned)
+	}
+
+	// Importing into a pruning chain prunes the imported blocks.
+	snapshot := exportSnapshot(t, newTestChain(t, mirrors))
+	c = newTestChain(t, mirrors[:1], WithPruneDepth(2))
+	if err := c.ImportSnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("ImportSnapshot error %v", err)
+	}
+	if _, err := c.ByHeight(testAnchorHeight + 2); !errors.Is(err, ErrPruned) {
+		t.Errorf("ByHeight: got error %v, want %v", err, ErrPruned)
+	}
+	if _, err := c.ByHeight(testAnchorHeight + 3); err != nil {
+		t.Errorf("ByHeight error %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+// BlockSource pushes the mirrors of the blocks of an upstream source as they
+// arrive, such as the block notifications of a bitcoind node, where a
+// Fetcher is polled.
+//
+// A source gives no guarantee of delivery: notifications can be missed
+// while it is disconnected, so its readers catch up from a Fetcher.
+type BlockSource interface {
+	Service
+
+	// Blocks returns the channel of the mirrors of the blocks announced,
+	// in the order the source announced them.  It is closed once the
+	// source is stopped.
+	Blocks() <-chan *BtcLightMirrorV2
+}
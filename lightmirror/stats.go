@@ -0,0 +1,174 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DelegationStats counts the power delegations of the mirrors stored at the
+// heights [StartHeight, EndHeight].  A block is counted under the power
+// parameters ParsePowerParams returns, and under each reward address of a
+// version 3 payload.
+type DelegationStats struct {
+	StartHeight int64
+	EndHeight   int64
+
+	// Blocks is the number of mirrors in the range, and Missing the
+	// number of heights of the range without mirror in the store, gaps
+	// and pruned mirrors included.
+	Blocks  int
+	Missing int
+
+	// Candidates and Rewards are the number of blocks delegating to each
+	// candidate and paying each reward address.
+	Candidates map[common.Address]int
+	Rewards    map[common.Address]int
+
+	// NoDelegation is the number of blocks without power parameters,
+	// Malformed those of them with a CORE output or witness item which
+	// does not parse, and Stripped those whose witness, which may carry
+	// them, was stripped.
+	NoDelegation int
+	Malformed    int
+	Stripped     int
+}
+
+// AddressCount is the number of blocks counted under an address.
+type AddressCount struct {
+	Address common.Address
+	Blocks  int
+}
+
+func newDelegationStats(start, end int64) DelegationStats {
+	return DelegationStats{
+		StartHeight: start,
+		EndHeight:   end,
+		Candidates:  make(map[common.Address]int),
+		Rewards:     make(map[common.Address]int),
+		Missing:     int(end - start + 1),
+	}
+}
+
+// add counts the mirror m.
+func (s *DelegationStats) add(m *BtcLightMirrorV2) {
+	s.Blocks++
+	s.Missing--
+	d, status := m.powerStatus()
+	switch status {
+	case powerStatusOK, powerStatusMultiple:
+		s.Candidates[d.Candidate]++
+		for _, r := range d.Rewards {
+			s.Rewards[r.Address]++
+		}
+	case powerStatusMalformed:
+		s.NoDelegation++
+		s.Malformed++
+	case powerStatusStripped:
+		s.NoDelegation++
+		s.Stripped++
+	default:
+		s.NoDelegation++
+	}
+}
+
+// TopCandidates returns the n candidates counted in the most blocks, most
+// first, ties in address order.  It returns them all if n is not positive
+// or there are fewer.
+func (s *DelegationStats) TopCandidates(n int) []AddressCount {
+	return topCounts(s.Candidates, n)
+}
+
+// TopRewards returns the n reward addresses counted in the most blocks, as
+// TopCandidates does.
+func (s *DelegationStats) TopRewards(n int) []AddressCount {
+	return topCounts(s.Rewards, n)
+}
+
+func topCounts(counts map[common.Address]int, n int) []AddressCount {
+	top := make([]AddressCount, 0, len(counts))
+	for addr, blocks := range counts {
+		top = append(top, AddressCount{addr, blocks})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Blocks != top[j].Blocks {
+			return top[i].Blocks > top[j].Blocks
+		}
+		return bytes.Compare(top[i].Address[:], top[j].Address[:]) < 0
+	})
+	if n > 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// AggregateDelegations counts the power delegations of the mirrors of store
+// at the heights [startHeight, endHeight], iterating the store once.
+// Heights without mirror are counted as missing.
+func AggregateDelegations(store Store, startHeight, endHeight int64) (DelegationStats, error) {
+	if err := checkStatsRange(startHeight, endHeight); err != nil {
+		return DelegationStats{}, err
+	}
+	stats := newDelegationStats(startHeight, endHeight)
+	err := store.Iterate(startHeight, endHeight, func(height int64, m *BtcLightMirrorV2) error {
+		stats.add(m)
+		return nil
+	})
+	if err != nil {
+		return DelegationStats{}, err
+	}
+	return stats, nil
+}
+
+// RetargetInterval returns the number of blocks of a difficulty retarget
+// period of params, 2016 on the main network.
+func RetargetInterval(params *chaincfg.Params) int64 {
+	return int64(params.TargetTimespan / params.TargetTimePerBlock)
+}
+
+// AggregateDelegationsByPeriod counts the power delegations of the mirrors
+// of store at the heights [startHeight, endHeight] as AggregateDelegations
+// does, separately for every difficulty retarget period of params the range
+// overlaps, in height order.  A period starts at a multiple of
+// RetargetInterval; the first and last periods are cut to the range.
+func AggregateDelegationsByPeriod(store Store, params *chaincfg.Params, startHeight, endHeight int64) ([]DelegationStats, error) {
+	if err := checkStatsRange(startHeight, endHeight); err != nil {
+		return nil, err
+	}
+	interval := RetargetInterval(params)
+	first := startHeight / interval
+	var periods []DelegationStats
+	for p := first; p <= endHeight/interval; p++ {
+		start, end := p*interval, (p+1)*interval-1
+		if start < startHeight {
+			start = startHeight
+		}
+		if end > endHeight {
+			end = endHeight
+		}
+		periods = append(periods, newDelegationStats(start, end))
+	}
+
+	err := store.Iterate(startHeight, endHeight, func(height int64, m *BtcLightMirrorV2) error {
+		periods[height/interval-first].add(m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return periods, nil
+}
+
+func checkStatsRange(start, end int64) error {
+	if start < 0 || end < start {
+		return fmt.Errorf("invalid height range [%d, %d]", start, end)
+	}
+	return nil
+}
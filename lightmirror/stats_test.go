@@ -0,0 +1,164 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/filestore"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// newStatsStore returns a store of 25 generated mirrors: those at heights
+// 0 to 9 delegate to candidateA, 10 to 19 to candidateB, and 20 to 24 do
+// not delegate, the one at 24 carrying a malformed CORE output.  The mirror
+// at height 5 is missing.
+func newStatsStore(t *testing.T) lightmirror.Store {
+	t.Helper()
+	mirrors := mirrortest.GenerateChain(t, 10, mirrortest.WithSeed(1),
+		mirrortest.WithPowerParams(candidateA, rewardA))
+	mirrors = append(mirrors, mirrortest.GenerateChain(t, 10, mirrortest.WithSeed(2),
+		mirrortest.WithPrevBlock(mirrors[9].BtcHeader.BlockHash()),
+		mirrortest.WithPowerParams(candidateB, rewardB))...)
+	mirrors = append(mirrors, mirrortest.GenerateChain(t, 5, mirrortest.WithSeed(3),
+		mirrortest.WithPrevBlock(mirrors[19].BtcHeader.BlockHash()))...)
+	malformed := []byte{0x6a, 0x10, 'C', 'O', 'R', 'E', 0x01, 0xaa}
+	mirrors[24].CoinBaseTx.AddTxOut(wire.NewTxOut(0, malformed))
+
+	store, err := filestore.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open error %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for height, m := range mirrors {
+		if height == 5 {
+			continue
+		}
+		if err := store.Put(m, int64(height)); err != nil {
+			t.Fatalf("Put #%d error %v", height, err)
+		}
+	}
+	return store
+}
+
+var (
+	candidateA = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	candidateB = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	rewardA    = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	rewardB    = common.HexToAddress("0x4444444444444444444444444444444444444444")
+)
+
+func TestAggregateDelegations(t *testing.T) {
+	store := newStatsStore(t)
+
+	tests := []struct {
+		start, end int64
+		want       lightmirror.DelegationStats
+	}{
+		{0, 24, lightmirror.DelegationStats{
+			Blocks: 24, Missing: 1,
+			Candidates:   map[common.Address]int{candidateA: 9, candidateB: 10},
+			Rewards:      map[common.Address]int{rewardA: 9, rewardB: 10},
+			NoDelegation: 5, Malformed: 1,
+		}},
+		{8, 12, lightmirror.DelegationStats{
+			Blocks:     5,
+			Candidates: map[common.Address]int{candidateA: 2, candidateB: 3},
+			Rewards:    map[common.Address]int{rewardA: 2, rewardB: 3},
+		}},
+		{20, 30, lightmirror.DelegationStats{
+			Blocks: 5, Missing: 6,
+			Candidates:   map[common.Address]int{},
+			Rewards:      map[common.Address]int{},
+			NoDelegation: 5, Malformed: 1,
+		}},
+	}
+	for i, test := range tests {
+		got, err := lightmirror.AggregateDelegations(store, test.start, test.end)
+		if err != nil {
+			t.Fatalf("AggregateDelegations #%d error %v", i, err)
+		}
+		test.want.StartHeight, test.want.EndHeight = test.start, test.end
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("AggregateDelegations #%d: got %+v, want %+v", i, got, test.want)
+		}
+	}
+
+	stats, _ := lightmirror.AggregateDelegations(store, 0, 24)
+	want := []lightmirror.AddressCount{{candidateB, 10}, {candidateA, 9}}
+	if top := stats.TopCandidates(0); !reflect.DeepEqual(top, want) {
+		t.Errorf("TopCandidates: got %v, want %v", top, want)
+	}
+	if top := stats.TopCandidates(1); !reflect.DeepEqual(top, want[:1]) {
+		t.Errorf("TopCandidates(1): got %v, want %v", top, want[:1])
+	}
+	if top := stats.TopRewards(5); len(top) != 2 || top[0].Address != rewardB {
+		t.Errorf("TopRewards: got %v", top)
+	}
+
+	if _, err := lightmirror.AggregateDelegations(store, 5, 4); err == nil {
+		t.Errorf("AggregateDelegations: no error for an inverted range")
+	}
+}
+
+func TestAggregateDelegationsByPeriod(t *testing.T) {
+	store := newStatsStore(t)
+
+	// Periods of 8 blocks.
+	params := *mirrortest.Params
+	params.TargetTimespan = 8 * params.TargetTimePerBlock
+	if n := lightmirror.RetargetInterval(&params); n != 8 {
+		t.Fatalf("RetargetInterval: got %d, want 8", n)
+	}
+
+	periods, err := lightmirror.AggregateDelegationsByPeriod(store, &params, 3, 24)
+	if err != nil {
+		t.Fatalf("AggregateDelegationsByPeriod error %v", err)
+	}
+	want := []struct {
+		start, end   int64
+		blocks       int
+		a, b         int
+		noDelegation int
+	}{
+		{3, 7, 4, 4, 0, 0},
+		{8, 15, 8, 2, 6, 0},
+		{16, 23, 8, 0, 4, 4},
+		{24, 24, 1, 0, 0, 1},
+	}
+	if len(periods) != len(want) {
+		t.Fatalf("got %d periods, want %d", len(periods), len(want))
+	}
+	for i, w := range want {
+		p := periods[i]
+		if p.StartHeight != w.start || p.EndHeight != w.end || p.Blocks != w.blocks ||
+			p.Candidates[candidateA] != w.a || p.Candidates[candidateB] != w.b ||
+			p.NoDelegation != w.noDelegation {
+			t.Errorf("period #%d: got %+v", i, p)
+		}
+	}
+
+	// The periods add up to the range.
+	total, _ := lightmirror.AggregateDelegations(store, 3, 24)
+	var blocks, missing int
+	for _, p := range periods {
+		blocks += p.Blocks
+		missing += p.Missing
+	}
+	if blocks != total.Blocks || missing != total.Missing {
+		t.Errorf("periods count %d blocks, %d missing, want %d, %d", blocks,
+			missing, total.Blocks, total.Missing)
+	}
+
+	interval := lightmirror.RetargetInterval(mirrortest.Params)
+	if periods, err := lightmirror.AggregateDelegationsByPeriod(store, mirrortest.Params, 0, 24); err != nil ||
+		len(periods) != 1 || interval != 2016 {
+		t.Errorf("AggregateDelegationsByPeriod: got %d periods, error %v", len(periods), err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the requested mirror does
+	// not exist.
+	ErrNotFound = errors.New("mirror not found")
+
+	// ErrStopIteration can be returned by the function passed to
+	// Store.Iterate to end the scan without an error.
+	ErrStopIteration = errors.New("stop iteration")
+)
+
+// Store persists mirrors keyed both by block hash and by height.  A store
+// holds at most one mirror per height: putting a mirror at a height that is
+// already occupied replaces the previous occupant.  Implementations must
+// update the hash and height indices atomically so a crash can never leave
+// one index pointing at a record the other does not know about.
+type Store interface {
+	// Put stores the mirror at the given height.
+	Put(m *BtcLightMirrorV2, height int64) error
+
+	// ByHash returns the mirror with the given block hash and its height.
+	ByHash(hash chainhash.Hash) (*BtcLightMirrorV2, int64, error)
+
+	// ByHeight returns the mirror stored at the given height.
+	ByHeight(height int64) (*BtcLightMirrorV2, error)
+
+	// Tip returns the mirror with the greatest height and that height.
+	Tip() (*BtcLightMirrorV2, int64, error)
+
+	// Delete removes the mirror with the given block hash.
+	Delete(hash chainhash.Hash) error
+
+	// Iterate calls fn for every mirror stored at a height in [start,
+	// end], in height order, skipping pruned mirrors.  The scan sees the
+	// store as it was when Iterate was called: writes made meanwhile, fn
+	// included, are not reflected.  Iteration stops at the first error
+	// returned by fn, which Iterate returns unless it is
+	// ErrStopIteration.
+	Iterate(start, end int64, fn func(height int64, m *BtcLightMirrorV2) error) error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// BatchStore is a Store able to apply several writes in one transaction.
+// MirrorChain switches its best chain to another branch through it, so that
+// the store never holds part of each branch.
+type BatchStore interface {
+	Store
+
+	// WriteBatch deletes the mirrors with the block hashes of deletes,
+	// skipping those the store does not hold, then puts the mirrors at
+	// their heights, in one transaction: on failure, the store is left as
+	// it was.
+	WriteBatch(deletes []chainhash.Hash, mirrors []*BtcLightMirrorV2, heights []int64) error
+}
+
+// CorruptRecordError is returned by a Store when a stored value can not be
+// decoded.
+type CorruptRecordError struct {
+	Key []byte
+	Err error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at key %x: %v", e.Key, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,717 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package storetest provides a conformance suite for lightmirror.Store
+// implementations.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/lightmirror/mirrortest"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Mirrors returns n linked mirrors, the first one building on the zero hash.
+// The mirrors have valid merkle branches but do not satisfy any proof of work.
+func Mirrors(n int) []*lightmirror.BtcLightMirrorV2 {
+	mirrors := make([]*lightmirror.BtcLightMirrorV2, 0, n)
+	var prev chainhash.Hash
+	for i := 0; i < n; i++ {
+		m := mirror(prev, uint32(i), i%4)
+		mirrors = append(mirrors, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+	return mirrors
+}
+
+// mirror creates a mirror building on prev.  The coinbase is made unique by
+// seed and extra transactions are added to the block so that the mirror
+// carries merkle nodes.
+func mirror(prev chainhash.Hash, seed uint32, extraTxs int) *lightmirror.BtcLightMirrorV2 {
+	coinBaseTx := &wire.MsgTx{
+		Version: 1,
+		TxIn: []*wire.TxIn{
+			{
+				PreviousOutPoint: wire.OutPoint{
+					Index: 0xffffffff,
+				},
+				SignatureScript: []byte{
+					0x04, byte(seed), byte(seed >> 8),
+					byte(seed >> 16), byte(seed >> 24),
+				},
+				Sequence: 0xffffffff,
+			},
+		},
+		TxOut: []*wire.TxOut{
+			{
+				Value:    5000000000,
+				PkScript: []byte{0x51}, // OP_TRUE
+			},
+		},
+	}
+
+	transactions := []chainhash.Hash{coinBaseTx.TxHash()}
+	for i := 0; i < extraTxs; i++ {
+		var tx chainhash.Hash
+		tx[0] = byte(i + 1)
+		tx[1] = byte(seed)
+		transactions = append(transactions, tx)
+	}
+	merkles := lightmirror.BuildMerkleTreeStore(&transactions[0], transactions[1:])
+
+	header := &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  prev,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1231006505+int64(seed)*600, 0),
+		Bits:       0x207fffff,
+		Nonce:      seed,
+	}
+	return lightmirror.CreateBtcLightMirrorV2(header, coinBaseTx, transactions)
+}
+
+func serialize(t *testing.T, m *lightmirror.BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize error %v", err)
+	}
+	return buf.Bytes()
+}
+
+func assertMirror(t *testing.T, desc string, got, want *lightmirror.BtcLightMirrorV2) {
+	t.Helper()
+	if !bytes.Equal(serialize(t, got), serialize(t, want)) {
+		t.Errorf("%s\n got: %s want: %s", desc, spew.Sdump(got),
+			spew.Sdump(want))
+	}
+}
+
+// TestStore runs the conformance suite against the stores returned by open.
+// Every subtest opens its own store, which the suite closes when done.  The
+// pruning tests are skipped for stores that are not a
+// lightmirror.PruningStore, the batch tests for stores that are not a
+// lightmirror.BatchStore, and the candidate index tests for stores that are
+// not a lightmirror.CandidateIndexStore.
+func TestStore(t *testing.T, open func(t *testing.T) lightmirror.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s lightmirror.Store)
+	}{
+		{"Empty", testEmpty},
+		{"RoundTrip", testRoundTrip},
+		{"ReplaceHeight", testReplaceHeight},
+		{"MoveHeight", testMoveHeight},
+		{"Delete", testDelete},
+		{"WriteBatch", testWriteBatch},
+		{"Prune", testPrune},
+		{"Iterate", testIterate},
+		{"IterateSnapshot", testIterateSnapshot},
+		{"CandidateIndex", testCandidateIndex},
+		{"CandidateIndexReorg", testCandidateIndexReorg},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := open(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close error %v", err)
+				}
+			}()
+			test.fn(t, s)
+		})
+	}
+}
+
+func testEmpty(t *testing.T, s lightmirror.Store) {
+	if _, _, err := s.Tip(); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("Tip: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if _, err := s.ByHeight(0); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if _, _, err := s.ByHash(chainhash.Hash{}); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHash: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+	if err := s.Delete(chainhash.Hash{}); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("Delete: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+}
+
+func testRoundTrip(t *testing.T, s lightmirror.Store) {
+	mirrors := Mirrors(16)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+
+		tip, height, err := s.Tip()
+		if err != nil {
+			t.Fatalf("Tip #%d error %v", i, err)
+		}
+		if height != int64(i) {
+			t.Errorf("Tip #%d: got height %d", i, height)
+		}
+		assertMirror(t, "Tip", tip, m)
+	}
+
+	for i, m := range mirrors {
+		got, height, err := s.ByHash(m.BtcHeader.BlockHash())
+		if err != nil {
+			t.Errorf("ByHash #%d error %v", i, err)
+			continue
+		}
+		if height != int64(i) {
+			t.Errorf("ByHash #%d: got height %d", i, height)
+		}
+		assertMirror(t, "ByHash", got, m)
+
+		got, err = s.ByHeight(int64(i))
+		if err != nil {
+			t.Errorf("ByHeight #%d error %v", i, err)
+			continue
+		}
+		assertMirror(t, "ByHeight", got, m)
+	}
+
+	if _, err := s.ByHeight(int64(len(mirrors))); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight past tip: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+	if _, err := s.ByHeight(-1); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight(-1): got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+}
+
+func testReplaceHeight(t *testing.T, s lightmirror.Store) {
+	mirrors := Mirrors(3)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// Replace the tip with a competing block.
+	replacement := mirror(mirrors[1].BtcHeader.BlockHash(), 1000, 1)
+	if err := s.Put(replacement, 2); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+
+	got, err := s.ByHeight(2)
+	if err != nil {
+		t.Fatalf("ByHeight error %v", err)
+	}
+	assertMirror(t, "ByHeight", got, replacement)
+
+	_, _, err = s.ByHash(mirrors[2].BtcHeader.BlockHash())
+	if !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHash replaced: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != 2 {
+		t.Errorf("Tip: got height %d, want 2", height)
+	}
+	assertMirror(t, "Tip", tip, replacement)
+}
+
+func testMoveHeight(t *testing.T, s lightmirror.Store) {
+	m := Mirrors(1)[0]
+	if err := s.Put(m, 5); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	if err := s.Put(m, 3); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+
+	if _, err := s.ByHeight(5); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight old: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+	_, height, err := s.ByHash(m.BtcHeader.BlockHash())
+	if err != nil {
+		t.Fatalf("ByHash error %v", err)
+	}
+	if height != 3 {
+		t.Errorf("ByHash: got height %d, want 3", height)
+	}
+	if _, height, _ := s.Tip(); height != 3 {
+		t.Errorf("Tip: got height %d, want 3", height)
+	}
+}
+
+func testDelete(t *testing.T, s lightmirror.Store) {
+	mirrors := Mirrors(3)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	if err := s.Delete(mirrors[2].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != 1 {
+		t.Errorf("Tip: got height %d, want 1", height)
+	}
+	assertMirror(t, "Tip", tip, mirrors[1])
+
+	if _, err := s.ByHeight(2); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight deleted: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+	err = s.Delete(mirrors[2].BtcHeader.BlockHash())
+	if !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("Delete twice: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+
+	// Deleting below the tip leaves a gap.
+	if err := s.Delete(mirrors[0].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	if _, err := s.ByHeight(0); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHeight gap: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+	if _, height, _ := s.Tip(); height != 1 {
+		t.Errorf("Tip: got height %d, want 1", height)
+	}
+}
+
+func testWriteBatch(t *testing.T, store lightmirror.Store) {
+	s, ok := store.(lightmirror.BatchStore)
+	if !ok {
+		t.Skip("not a BatchStore")
+	}
+
+	mirrors := Mirrors(3)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	// Switch the last block to a branch of two, deleting a block the store
+	// does not hold along the way.
+	first := mirror(mirrors[1].BtcHeader.BlockHash(), 1000, 1)
+	second := mirror(first.BtcHeader.BlockHash(), 1001, 1)
+	deletes := []chainhash.Hash{mirrors[2].BtcHeader.BlockHash(), {1}}
+	err := s.WriteBatch(deletes, []*lightmirror.BtcLightMirrorV2{first, second}, []int64{2, 3})
+	if err != nil {
+		t.Fatalf("WriteBatch error %v", err)
+	}
+	for height, want := range []*lightmirror.BtcLightMirrorV2{mirrors[0], mirrors[1], first, second} {
+		got, err := s.ByHeight(int64(height))
+		if err != nil {
+			t.Fatalf("ByHeight(%d) error %v", height, err)
+		}
+		assertMirror(t, "ByHeight", got, want)
+	}
+	if _, _, err := s.ByHash(mirrors[2].BtcHeader.BlockHash()); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("ByHash deleted: got error %v, want %v", err, lightmirror.ErrNotFound)
+	}
+
+	// A failing write leaves the store as it was.
+	deletes = []chainhash.Hash{second.BtcHeader.BlockHash()}
+	err = s.WriteBatch(deletes, []*lightmirror.BtcLightMirrorV2{mirrors[2]}, []int64{-1})
+	if err == nil {
+		t.Fatalf("WriteBatch at a negative height: expected error")
+	}
+	tip, height, err := s.Tip()
+	if err != nil {
+		t.Fatalf("Tip error %v", err)
+	}
+	if height != 3 {
+		t.Errorf("Tip after a failed batch: got height %d, want 3", height)
+	}
+	assertMirror(t, "Tip after a failed batch", tip, second)
+}
+
+func testPrune(t *testing.T, store lightmirror.Store) {
+	s, ok := store.(lightmirror.PruningStore)
+	if !ok {
+		t.Skip("not a PruningStore")
+	}
+
+	mirrors := Mirrors(3)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	if err := s.Prune(chainhash.Hash{}); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("Prune unknown: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+
+	// Pruning twice is not an error.
+	for _, m := range mirrors[1:] {
+		for i := 0; i < 2; i++ {
+			if err := s.Prune(m.BtcHeader.BlockHash()); err != nil {
+				t.Fatalf("Prune #%d error %v", i, err)
+			}
+		}
+	}
+
+	for i, m := range mirrors {
+		hash := m.BtcHeader.BlockHash()
+		pruned, err := s.PrunedByHeight(int64(i))
+		if err != nil {
+			t.Errorf("PrunedByHeight #%d error %v", i, err)
+		} else if pruned.BtcHeader != m.BtcHeader {
+			t.Errorf("PrunedByHeight #%d\n got: %s want: %s", i,
+				spew.Sdump(pruned.BtcHeader), spew.Sdump(m.BtcHeader))
+		}
+
+		if i == 0 {
+			got, err := s.ByHeight(0)
+			if err != nil {
+				t.Fatalf("ByHeight unpruned error %v", err)
+			}
+			assertMirror(t, "ByHeight unpruned", got, m)
+			continue
+		}
+		_, height, err := s.ByHash(hash)
+		if !errors.Is(err, lightmirror.ErrPruned) || height != int64(i) {
+			t.Errorf("ByHash pruned #%d: got height %d, error %v, want %v",
+				i, height, err, lightmirror.ErrPruned)
+		}
+		if _, err := s.ByHeight(int64(i)); !errors.Is(err, lightmirror.ErrPruned) {
+			t.Errorf("ByHeight pruned #%d: got error %v, want %v", i, err,
+				lightmirror.ErrPruned)
+		}
+	}
+	if _, height, err := s.Tip(); !errors.Is(err, lightmirror.ErrPruned) || height != 2 {
+		t.Errorf("Tip pruned: got height %d, error %v, want %v", height, err,
+			lightmirror.ErrPruned)
+	}
+	if _, err := s.PrunedByHeight(3); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("PrunedByHeight past tip: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+
+	// Putting the full mirror back undoes the pruning, and pruned mirrors
+	// can be deleted.
+	if err := s.Put(mirrors[2], 2); err != nil {
+		t.Fatalf("Put error %v", err)
+	}
+	got, err := s.ByHeight(2)
+	if err != nil {
+		t.Fatalf("ByHeight error %v", err)
+	}
+	assertMirror(t, "ByHeight put again", got, mirrors[2])
+	if err := s.Delete(mirrors[1].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete pruned error %v", err)
+	}
+	if _, err := s.PrunedByHeight(1); !errors.Is(err, lightmirror.ErrNotFound) {
+		t.Errorf("PrunedByHeight deleted: got error %v, want %v", err,
+			lightmirror.ErrNotFound)
+	}
+}
+
+func testIterate(t *testing.T, s lightmirror.Store) {
+	mirrors := Mirrors(10)
+	for i, m := range mirrors {
+		// Leave a gap at height 5.
+		if i == 5 {
+			continue
+		}
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		start, end int64
+		want       []int64
+	}{
+		{0, 9, []int64{0, 1, 2, 3, 4, 6, 7, 8, 9}},
+		{3, 6, []int64{3, 4, 6}},
+		{5, 5, nil},
+		{8, 100, []int64{8, 9}},
+		{-5, 1, []int64{0, 1}},
+		{7, 2, nil},
+		{9, math.MaxInt64, []int64{9}},
+	}
+
+	for i, test := range tests {
+		var got []int64
+		err := s.Iterate(test.start, test.end, func(height int64, m *lightmirror.BtcLightMirrorV2) error {
+			assertMirror(t, fmt.Sprintf("Iterate #%d at height %d", i, height),
+				m, mirrors[height])
+			got = append(got, height)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Iterate #%d error %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Iterate #%d: got heights %v, want %v", i, got, test.want)
+		}
+	}
+
+	// An error from fn ends the scan and is returned, except for
+	// ErrStopIteration.
+	stop := errors.New("stop")
+	for _, fnErr := range []error{stop, lightmirror.ErrStopIteration} {
+		calls := 0
+		err := s.Iterate(0, 9, func(int64, *lightmirror.BtcLightMirrorV2) error {
+			calls++
+			if calls == 2 {
+				return fnErr
+			}
+			return nil
+		})
+		want := fnErr
+		if fnErr == lightmirror.ErrStopIteration {
+			want = nil
+		}
+		if err != want || calls != 2 {
+			t.Errorf("Iterate: got error %v after %d calls, want %v after 2",
+				err, calls, want)
+		}
+	}
+}
+
+// testIterateSnapshot checks that writes made from another goroutine while
+// iterating are not seen by the scan.  Stores may make such writes wait for
+// the scan to end, so the scan only gives them a moment to complete.
+func testIterateSnapshot(t *testing.T, s lightmirror.Store) {
+	mirrors := Mirrors(4)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	replacement := mirror(mirrors[1].BtcHeader.BlockHash(), 1000, 1)
+
+	done := make(chan error, 1)
+	write := func() {
+		if err := s.Delete(mirrors[3].BtcHeader.BlockHash()); err != nil {
+			done <- err
+			return
+		}
+		if err := s.Put(replacement, 2); err != nil {
+			done <- err
+			return
+		}
+		done <- s.Put(mirrors[3], 4)
+	}
+
+	var (
+		got     []*lightmirror.BtcLightMirrorV2
+		written bool
+	)
+	err := s.Iterate(0, 10, func(height int64, m *lightmirror.BtcLightMirrorV2) error {
+		if height == 0 {
+			go write()
+			select {
+			case err := <-done:
+				if err != nil {
+					return err
+				}
+				written = true
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		got = append(got, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate error %v", err)
+	}
+	if !written {
+		if err := <-done; err != nil {
+			t.Fatalf("write error %v", err)
+		}
+	}
+	if len(got) != len(mirrors) {
+		t.Fatalf("Iterate: got %d mirrors, want %d", len(got), len(mirrors))
+	}
+	for i, m := range got {
+		assertMirror(t, fmt.Sprintf("Iterate #%d", i), m, mirrors[i])
+	}
+
+	// The writes did happen.
+	m, err := s.ByHeight(2)
+	if err != nil {
+		t.Fatalf("ByHeight error %v", err)
+	}
+	assertMirror(t, "ByHeight", m, replacement)
+}
+
+var (
+	candidateA = common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	candidateB = common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+)
+
+// delegatingChain returns mirrors building on prev, the one at i delegating
+// to candidates[i] unless it is the zero address.
+func delegatingChain(t *testing.T, prev chainhash.Hash, seed int64, candidates ...common.Address) []*lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	mirrors := make([]*lightmirror.BtcLightMirrorV2, 0, len(candidates))
+	for i, candidate := range candidates {
+		opts := []mirrortest.Option{mirrortest.WithSeed(seed + int64(i)),
+			mirrortest.WithPrevBlock(prev)}
+		if candidate != (common.Address{}) {
+			opts = append(opts, mirrortest.WithPowerParams(candidate, candidate))
+		}
+		m := mirrortest.GenerateChain(t, 1, opts...)[0]
+		mirrors = append(mirrors, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+	return mirrors
+}
+
+// hashes returns the block hashes of mirrors.
+func hashes(mirrors ...*lightmirror.BtcLightMirrorV2) []chainhash.Hash {
+	hashes := make([]chainhash.Hash, 0, len(mirrors))
+	for _, m := range mirrors {
+		hashes = append(hashes, m.BtcHeader.BlockHash())
+	}
+	return hashes
+}
+
+func assertBlocksByCandidate(t *testing.T, desc string, s lightmirror.CandidateIndexStore, addr common.Address, limit int, before int64, want []chainhash.Hash) {
+	t.Helper()
+	got, err := s.BlocksByCandidate(addr, limit, before)
+	if err != nil {
+		t.Fatalf("%s: BlocksByCandidate error %v", desc, err)
+	}
+	if len(got) != 0 || len(want) != 0 {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: BlocksByCandidate(%v, %d, %d)\n got: %v\nwant: %v",
+				desc, addr, limit, before, got, want)
+		}
+	}
+}
+
+func testCandidateIndex(t *testing.T, store lightmirror.Store) {
+	s, ok := store.(lightmirror.CandidateIndexStore)
+	if !ok {
+		t.Skip("not a CandidateIndexStore")
+	}
+
+	none := common.Address{}
+	mirrors := delegatingChain(t, chainhash.Hash{}, 1, candidateA, none, candidateB,
+		candidateA, candidateA)
+	for i, m := range mirrors {
+		if err := s.Put(m, int64(i)); err != nil {
+			t.Fatalf("Put #%d error %v", i, err)
+		}
+	}
+	check := func(desc string) {
+		t.Helper()
+		assertBlocksByCandidate(t, desc, s, candidateA, 0, math.MaxInt64,
+			hashes(mirrors[4], mirrors[3], mirrors[0]))
+		assertBlocksByCandidate(t, desc+" limit", s, candidateA, 2, math.MaxInt64,
+			hashes(mirrors[4], mirrors[3]))
+		assertBlocksByCandidate(t, desc+" before", s, candidateA, 0, 4,
+			hashes(mirrors[3], mirrors[0]))
+		assertBlocksByCandidate(t, desc+" before 0", s, candidateA, 0, 0, nil)
+		assertBlocksByCandidate(t, desc+" B", s, candidateB, 0, 100, hashes(mirrors[2]))
+		assertBlocksByCandidate(t, desc+" no candidate", s, none, 0, 100, nil)
+	}
+	check("Put")
+	if err := s.ReindexCandidates(); err != nil {
+		t.Fatalf("ReindexCandidates error %v", err)
+	}
+	check("ReindexCandidates")
+
+	// Replacing the occupant of a height, moving a mirror to another
+	// height and deleting a mirror update the index.
+	replacement := delegatingChain(t, mirrors[2].BtcHeader.BlockHash(), 100, candidateB)[0]
+	if err := s.Put(replacement, 3); err != nil {
+		t.Fatalf("Put replacement error %v", err)
+	}
+	if err := s.Put(mirrors[4], 6); err != nil {
+		t.Fatalf("Put moved error %v", err)
+	}
+	if err := s.Delete(mirrors[0].BtcHeader.BlockHash()); err != nil {
+		t.Fatalf("Delete error %v", err)
+	}
+	for _, desc := range []string{"updated", "updated and reindexed"} {
+		assertBlocksByCandidate(t, desc, s, candidateA, 0, 100, hashes(mirrors[4]))
+		assertBlocksByCandidate(t, desc+" before", s, candidateA, 0, 6, nil)
+		assertBlocksByCandidate(t, desc+" B", s, candidateB, 0, 100,
+			hashes(replacement, mirrors[2]))
+		if err := s.ReindexCandidates(); err != nil {
+			t.Fatalf("ReindexCandidates error %v", err)
+		}
+	}
+
+	// Pruned mirrors stay indexed, reindexing included.
+	if p, ok := s.(lightmirror.PruningStore); ok {
+		if err := p.Prune(mirrors[2].BtcHeader.BlockHash()); err != nil {
+			t.Fatalf("Prune error %v", err)
+		}
+		if err := s.ReindexCandidates(); err != nil {
+			t.Fatalf("ReindexCandidates error %v", err)
+		}
+		assertBlocksByCandidate(t, "pruned", s, candidateB, 0, 100,
+			hashes(replacement, mirrors[2]))
+	}
+}
+
+// testCandidateIndexReorg checks that the blocks a reorganization of a chain
+// persisting to the store disconnects leave the index.
+func testCandidateIndexReorg(t *testing.T, store lightmirror.Store) {
+	s, ok := store.(lightmirror.CandidateIndexStore)
+	if !ok {
+		t.Skip("not a CandidateIndexStore")
+	}
+
+	const anchorHeight = 100
+	anchor := mirrortest.GenerateChain(t, 1)[0]
+	c, err := lightmirror.NewMirrorChain(anchor, anchorHeight,
+		lightmirror.WithChainParams(mirrortest.Params), lightmirror.WithStore(s))
+	if err != nil {
+		t.Fatalf("NewMirrorChain error %v", err)
+	}
+	main := delegatingChain(t, anchor.BtcHeader.BlockHash(), 10, candidateA,
+		candidateB, candidateA)
+	if _, err := c.AppendBatch(main); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	assertBlocksByCandidate(t, "main chain", s, candidateA, 0, math.MaxInt64,
+		hashes(main[2], main[0]))
+
+	// A longer branch from the first block replaces the other two.
+	branch := delegatingChain(t, main[0].BtcHeader.BlockHash(), 20, common.Address{},
+		candidateB, candidateB)
+	reorgs, err := c.AppendBatch(branch)
+	if err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	if len(reorgs) != 1 {
+		t.Fatalf("AppendBatch: got %d reorganizations, want 1", len(reorgs))
+	}
+	assertBlocksByCandidate(t, "reorg", s, candidateA, 0, math.MaxInt64, hashes(main[0]))
+	assertBlocksByCandidate(t, "reorg B", s, candidateB, 0, math.MaxInt64,
+		hashes(branch[2], branch[1]))
+}
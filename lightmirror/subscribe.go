@@ -0,0 +1,203 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ErrSubscriptionOverflow is the last error of a subscriber whose
+// subscription overflowed.
+var ErrSubscriptionOverflow = errors.New("subscription overflowed")
+
+// defaultSubscriptionBuffer is the number of events buffered for every
+// subscriber unless WithSubscriptionBuffer says otherwise.
+const defaultSubscriptionBuffer = 128
+
+// ChainEventType identifies the kind of a ChainEvent.
+type ChainEventType int
+
+const (
+	// BlockConnected is sent when a block is added to the best chain.
+	BlockConnected ChainEventType = iota
+
+	// BlockDisconnected is sent when a block is removed from the best
+	// chain.
+	BlockDisconnected
+
+	// SubscriptionOverflow is the last event sent to a subscriber that
+	// did not keep up.  Its channel is closed right after, and the
+	// subscriber has to resynchronize from the current tip.
+	SubscriptionOverflow
+
+	// BodyAttached is sent when the body of a header-only block of the
+	// best chain is attached.
+	BodyAttached
+
+	// OrphanAdopted is sent when a mirror of the orphan pool is appended
+	// to the chain, after the events of its append.
+	OrphanAdopted
+
+	// OrphanEvicted is sent when a mirror leaves the orphan pool without
+	// being appended: it expired, made room for another orphan or failed
+	// to append.  Its height is unknown and left zero.
+	OrphanEvicted
+
+	// DelegationConflictDetected is sent after the events of a best chain
+	// switch for each block it replaced with a block delegating
+	// differently, the replacing block being the one of the event.
+	DelegationConflictDetected
+)
+
+var chainEventTypeStrings = map[ChainEventType]string{
+	BlockConnected:       "BlockConnected",
+	BlockDisconnected:    "BlockDisconnected",
+	SubscriptionOverflow: "SubscriptionOverflow",
+	BodyAttached:         "BodyAttached",
+	OrphanAdopted:        "OrphanAdopted",
+	OrphanEvicted:        "OrphanEvicted",
+
+	DelegationConflictDetected: "DelegationConflictDetected",
+}
+
+// String returns the ChainEventType in human-readable form.
+func (t ChainEventType) String() string {
+	if s, ok := chainEventTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ChainEventType (%d)", int(t))
+}
+
+// ChainEvent is a change of the best chain sent to subscribers.  On a
+// reorganization, the blocks leaving the best chain are disconnected newest
+// first, then the blocks replacing them are connected oldest first.
+type ChainEvent struct {
+	Type ChainEventType
+
+	// Hash and Height identify the block the event is about.
+	Hash   chainhash.Hash
+	Height int64
+
+	// Mirror is the connected block, or the block whose body was attached.
+	// It is nil for header-only blocks and for other events.
+	Mirror *BtcLightMirrorV2
+
+	// Conflict is the conflict of a DelegationConflictDetected event.
+	Conflict *DelegationConflict
+}
+
+// WithSubscriptionBuffer sets the number of events buffered for every
+// subscriber.  The default is 128.
+func WithSubscriptionBuffer(n int) ChainOption {
+	return func(cfg *chainConfig) {
+		cfg.subscriptionBuffer = n
+	}
+}
+
+type subscriber struct {
+	ch chan ChainEvent
+}
+
+// subscribers is the set of subscribers of a chain.
+type subscribers struct {
+	mtx  sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+// Subscribe returns a channel receiving the changes of the best chain in the
+// order they happen, and a function detaching the subscriber which closes the
+// channel.
+//
+// Notifying subscribers never blocks the chain.  A subscriber whose buffer
+// is full receives a SubscriptionOverflow event instead of the next event,
+// after which its channel is closed.
+func (c *MirrorChain) Subscribe() (<-chan ChainEvent, func()) {
+	size := c.cfg.subscriptionBuffer
+	if size < 2 {
+		// Leave room for at least one event besides the overflow.
+		size = 2
+	}
+	sub := &subscriber{ch: make(chan ChainEvent, size)}
+
+	s := &c.subs
+	s.mtx.Lock()
+	if s.subs == nil {
+		s.subs = make(map[*subscriber]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	s.mtx.Unlock()
+
+	cancel := func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if _, ok := s.subs[sub]; ok {
+			delete(s.subs, sub)
+			close(sub.ch)
+		}
+	}
+	return sub.ch, cancel
+}
+
+// notify sends the events to every subscriber.  The last slot of a
+// subscriber buffer is kept for the overflow event.  Only notify sends on
+// the channels, under the lock, so the free space it sees can only grow.
+func (s *subscribers) notify(events []ChainEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for sub := range s.subs {
+		for _, event := range events {
+			if len(sub.ch) >= cap(sub.ch)-1 {
+				sub.ch <- ChainEvent{Type: SubscriptionOverflow}
+				delete(s.subs, sub)
+				close(sub.ch)
+				break
+			}
+			if event.Mirror != nil {
+				event.Mirror = event.Mirror.Clone()
+			}
+			if event.Conflict != nil {
+				conflict := *event.Conflict
+				event.Conflict = &conflict
+			}
+			sub.ch <- event
+		}
+	}
+}
+
+// notifyTipChange sends the events of a best chain switch to the
+// subscribers: detach is ordered newest first, attach oldest first, and the
+// conflicts of the switch follow.
+func (c *MirrorChain) notifyTipChange(detach, attach []*chainEntry, conflicts []DelegationConflict) {
+	events := make([]ChainEvent, 0, len(detach)+len(attach)+len(conflicts))
+	for _, e := range detach {
+		events = append(events, ChainEvent{
+			Type:   BlockDisconnected,
+			Hash:   e.hash,
+			Height: e.height,
+		})
+	}
+	for _, e := range attach {
+		events = append(events, ChainEvent{
+			Type:   BlockConnected,
+			Hash:   e.hash,
+			Height: e.height,
+			Mirror: e.mirror,
+		})
+	}
+	for i := range conflicts {
+		conflict := conflicts[i]
+		events = append(events, ChainEvent{
+			Type:     DelegationConflictDetected,
+			Hash:     conflict.Connected.Hash,
+			Height:   conflict.Height,
+			Conflict: &conflict,
+		})
+	}
+	c.subs.notify(events)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+type wantEvent struct {
+	typ    ChainEventType
+	hash   chainhash.Hash
+	height int64
+}
+
+// drain returns the events buffered in ch.
+func drain(ch <-chan ChainEvent) []ChainEvent {
+	var events []ChainEvent
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func checkEvents(t *testing.T, desc string, got []ChainEvent, want []wantEvent) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d events, want %d", desc, len(got), len(want))
+	}
+	for i, event := range got {
+		w := want[i]
+		if event.Type != w.typ || event.Hash != w.hash || event.Height != w.height {
+			t.Errorf("%s #%d: got %v %v at height %d, want %v %v at height %d",
+				desc, i, event.Type, event.Hash, event.Height, w.typ, w.hash,
+				w.height)
+		}
+		hasMirror := event.Type == BlockConnected || event.Type == BodyAttached
+		if hasMirror != (event.Mirror != nil) {
+			t.Errorf("%s #%d: %v event with mirror %v", desc, i, event.Type,
+				event.Mirror)
+		}
+		if event.Mirror != nil && event.Mirror.BtcHeader.BlockHash() != event.Hash {
+			t.Errorf("%s #%d: mirror does not match the hash", desc, i)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	mirrors := newTestMirrors(4)
+	c := newTestChain(t, mirrors[:2])
+	ch, cancel := c.Subscribe()
+	defer cancel()
+
+	for _, m := range mirrors[2:] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	hash := func(m *BtcLightMirrorV2) chainhash.Hash {
+		return m.BtcHeader.BlockHash()
+	}
+	checkEvents(t, "Append", drain(ch), []wantEvent{
+		{BlockConnected, hash(mirrors[2]), testAnchorHeight + 2},
+		{BlockConnected, hash(mirrors[3]), testAnchorHeight + 3},
+	})
+
+	// A side branch is silent until it takes over.
+	branch := newTestBranch(mirrors[1], 1000, 3)
+	for _, m := range branch {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+	}
+	checkEvents(t, "Reorg", drain(ch), []wantEvent{
+		{BlockDisconnected, hash(mirrors[3]), testAnchorHeight + 3},
+		{BlockDisconnected, hash(mirrors[2]), testAnchorHeight + 2},
+		{BlockConnected, hash(branch[0]), testAnchorHeight + 2},
+		{BlockConnected, hash(branch[1]), testAnchorHeight + 3},
+		{BlockConnected, hash(branch[2]), testAnchorHeight + 4},
+	})
+
+	if _, err := c.Rollback(1); err != nil {
+		t.Fatalf("Rollback error %v", err)
+	}
+	checkEvents(t, "Rollback", drain(ch), []wantEvent{
+		{BlockDisconnected, hash(branch[2]), testAnchorHeight + 4},
+	})
+
+	// Every subscriber gets its own copy.
+	other, cancelOther := c.Subscribe()
+	defer cancelOther()
+	if _, err := c.Append(branch[2]); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	first, second := <-ch, <-other
+	first.Mirror.BtcHeader.Nonce++
+	if second.Mirror.BtcHeader.BlockHash() != hash(branch[2]) {
+		t.Errorf("Subscribe: subscribers share mirrors")
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	mirrors := newTestMirrors(8)
+	c := newTestChain(t, mirrors[:1], WithSubscriptionBuffer(4))
+	slow, cancelSlow := c.Subscribe()
+	fast, cancelFast := c.Subscribe()
+	defer cancelFast()
+
+	for i, m := range mirrors[1:] {
+		if _, err := c.Append(m); err != nil {
+			t.Fatalf("Append error %v", err)
+		}
+		if events := drain(fast); len(events) != 1 {
+			t.Fatalf("Append #%d: got %d events for the fast subscriber", i,
+				len(events))
+		}
+	}
+
+	// Three events were buffered, then the overflow, then the channel was
+	// closed.
+	events := drain(slow)
+	if len(events) != 4 || events[3].Type != SubscriptionOverflow {
+		t.Fatalf("got %d events, the last being %v", len(events),
+			events[len(events)-1].Type)
+	}
+	if _, ok := <-slow; ok {
+		t.Errorf("channel still open after overflow")
+	}
+	cancelSlow()
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors[:1])
+	ch, cancel := c.Subscribe()
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel still open after cancel")
+	}
+	if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	c.subs.mtx.Lock()
+	defer c.subs.mtx.Unlock()
+	if len(c.subs.subs) != 0 {
+		t.Errorf("got %d subscribers after cancel", len(c.subs.subs))
+	}
+}
+
+func TestChainEventTypeStringer(t *testing.T) {
+	tests := []struct {
+		in   ChainEventType
+		want string
+	}{
+		{BlockConnected, "BlockConnected"},
+		{BlockDisconnected, "BlockDisconnected"},
+		{SubscriptionOverflow, "SubscriptionOverflow"},
+		{BodyAttached, "BodyAttached"},
+		{OrphanAdopted, "OrphanAdopted"},
+		{OrphanEvicted, "OrphanEvicted"},
+		{DelegationConflictDetected, "DelegationConflictDetected"},
+		{0xff, "Unknown ChainEventType (255)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, got, test.want)
+		}
+	}
+}
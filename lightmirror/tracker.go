@@ -0,0 +1,458 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// trackerCheckInterval is the interval at which a ConfirmationTracker looks
+// for timed out entries between the changes of the chain.
+const trackerCheckInterval = time.Second
+
+// ErrTrackerClosed is returned by ConfirmationTracker.Register once the
+// tracker is stopped.
+var ErrTrackerClosed = errors.New("confirmation tracker closed")
+
+// ConfirmationEventType identifies the kind of a ConfirmationEvent.
+type ConfirmationEventType int
+
+const (
+	// Confirmed is sent when the block of an entry reaches the required
+	// depth in the best chain.  The entry is no longer tracked.
+	Confirmed ConfirmationEventType = iota
+
+	// Reorged is sent when the block of an entry leaves the best chain.
+	// The entry is still tracked: it is confirmed if its block comes
+	// back, or if the relocation callback finds the transaction in a
+	// block of the best chain which reaches the required depth.
+	Reorged
+
+	// TimedOut is sent when an entry is not confirmed within the timeout
+	// of the tracker.  The entry is no longer tracked.
+	TimedOut
+)
+
+var confirmationEventTypeStrings = map[ConfirmationEventType]string{
+	Confirmed: "Confirmed",
+	Reorged:   "Reorged",
+	TimedOut:  "TimedOut",
+}
+
+// String returns the ConfirmationEventType in human-readable form.
+func (t ConfirmationEventType) String() string {
+	if s, ok := confirmationEventTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ConfirmationEventType (%d)", int(t))
+}
+
+// ConfirmationEvent is a change of the state of an entry of a
+// ConfirmationTracker.
+type ConfirmationEvent struct {
+	Type ConfirmationEventType
+	TxID chainhash.Hash
+
+	// BlockHash is the block holding the transaction: the confirmed
+	// block, the block which left the best chain, or the last block the
+	// entry knew of.
+	BlockHash chainhash.Hash
+
+	// Tip and TipHeight are the tip of the best chain when the event was
+	// sent, the tip of the chain which replaced the block for Reorged.
+	Tip       chainhash.Hash
+	TipHeight int64
+}
+
+// RelocateFunc looks up the block of the best chain holding the
+// transaction txid, after the block it was tracked in left the best chain.
+// It returns false if the transaction is in no block.
+type RelocateFunc func(ctx context.Context, txid chainhash.Hash) (chainhash.Hash, bool, error)
+
+// TrackerOption configures a ConfirmationTracker.
+type TrackerOption func(*trackerConfig)
+
+type trackerConfig struct {
+	statePath string
+	relocate  RelocateFunc
+	timeout   time.Duration
+	logger    Logger
+
+	// now returns the current time, time.Now outside of the tests.
+	now func() time.Time
+}
+
+// WithTrackerState makes the tracker keep its entries in the file at path,
+// rewritten on every change, and resume from it when it exists.
+func WithTrackerState(path string) TrackerOption {
+	return func(cfg *trackerConfig) {
+		cfg.statePath = path
+	}
+}
+
+// WithRelocate sets the callback the tracker locates again the
+// transactions of the entries whose block left the best chain with.  It is
+// called for every such entry each time the chain changes, until it finds
+// the transaction in a block of the best chain.  Without it, those entries
+// only confirm if their block comes back.
+func WithRelocate(fn RelocateFunc) TrackerOption {
+	return func(cfg *trackerConfig) {
+		cfg.relocate = fn
+	}
+}
+
+// WithTrackerTimeout sets the time after its registration an entry times
+// out if it is not confirmed.  Entries never time out by default.
+func WithTrackerTimeout(d time.Duration) TrackerOption {
+	return func(cfg *trackerConfig) {
+		cfg.timeout = d
+	}
+}
+
+// WithTrackerLogger sets the logger the tracker reports its errors to.
+func WithTrackerLogger(l Logger) TrackerOption {
+	return func(cfg *trackerConfig) {
+		cfg.logger = l
+	}
+}
+
+// trackedTx is an entry of a ConfirmationTracker, as kept in its state
+// file.
+type trackedTx struct {
+	TxID      chainhash.Hash `json:"txid"`
+	BlockHash chainhash.Hash `json:"block"`
+	Depth     int64          `json:"depth"`
+
+	// Deadline is the Unix time in seconds the entry times out at, zero
+	// for no timeout.
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// Reorged is set once the Reorged event of the block is sent.
+	Reorged bool `json:"reorged,omitempty"`
+}
+
+// ConfirmationTracker follows transactions until the blocks holding them
+// are buried deep enough in the best chain of a MirrorChain.
+type ConfirmationTracker struct {
+	chain  *MirrorChain
+	cfg    trackerConfig
+	events chan ConfirmationEvent
+	wake   chan struct{}
+	life   lifecycle
+	health *healthState
+
+	// mtx protects the fields below.
+	mtx     sync.Mutex
+	entries map[chainhash.Hash]*trackedTx
+	closed  bool
+}
+
+// NewConfirmationTracker returns a tracker following the entries it is
+// given on chain, starting with those of the state file of
+// WithTrackerState.  Start runs it.
+func NewConfirmationTracker(chain *MirrorChain, opts ...TrackerOption) (*ConfirmationTracker, error) {
+	cfg := trackerConfig{now: time.Now}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.logger = orNopLogger(cfg.logger)
+
+	t := &ConfirmationTracker{
+		chain:   chain,
+		cfg:     cfg,
+		events:  make(chan ConfirmationEvent, defaultSubscriptionBuffer),
+		wake:    make(chan struct{}, 1),
+		health:  newHealthState(),
+		entries: make(map[chainhash.Hash]*trackedTx),
+	}
+	t.life.finish = func() { close(t.events) }
+	if cfg.statePath != "" {
+		entries, err := readTrackerState(cfg.statePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			t.entries[e.TxID] = e
+		}
+	}
+	return t, nil
+}
+
+// Start runs the tracker until Stop is called or ctx is done.  It checks
+// the entries at once.
+func (t *ConfirmationTracker) Start(ctx context.Context) error {
+	if err := t.life.start(ctx, t.run); err != nil {
+		return err
+	}
+	t.signal()
+	return nil
+}
+
+// Stop makes Register fail, waits until ctx is done for the events of the
+// check in progress to be received, and closes the events channel.  The
+// entries are kept in the state file.
+func (t *ConfirmationTracker) Stop(ctx context.Context) error {
+	t.mtx.Lock()
+	t.closed = true
+	t.mtx.Unlock()
+	return t.life.stop(ctx)
+}
+
+// Events returns the channel the tracker sends its events on, closed once
+// it is stopped.  The tracker waits for the events to be received.
+func (t *ConfirmationTracker) Events() <-chan ConfirmationEvent {
+	return t.events
+}
+
+// Register starts tracking the transaction txid of the block blockHash
+// until the block has depth confirmations, replacing the entry of txid if
+// there is one.  A block which is not in the best chain is reported
+// Reorged.
+func (t *ConfirmationTracker) Register(txid, blockHash chainhash.Hash, depth int64) error {
+	if depth < 1 {
+		return fmt.Errorf("confirmation depth %d is not positive", depth)
+	}
+	e := &trackedTx{TxID: txid, BlockHash: blockHash, Depth: depth}
+	if t.cfg.timeout > 0 {
+		e.Deadline = t.cfg.now().Add(t.cfg.timeout).Unix()
+	}
+
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		return ErrTrackerClosed
+	}
+	t.entries[txid] = e
+	err := t.saveLocked()
+	t.mtx.Unlock()
+	t.signal()
+	return err
+}
+
+// Ping returns ErrNotRunning unless the tracker runs.
+func (t *ConfirmationTracker) Ping(ctx context.Context) error {
+	return t.life.ping()
+}
+
+// LastBlockAge returns the time elapsed since the chain last sent the
+// tracker an event.
+func (t *ConfirmationTracker) LastBlockAge() time.Duration {
+	return t.health.LastBlockAge()
+}
+
+// LastError returns ErrSubscriptionOverflow, and when, if the subscription
+// of the tracker last overflowed.
+func (t *ConfirmationTracker) LastError() (error, time.Time) {
+	return t.health.LastError()
+}
+
+// Pending returns the number of entries tracked.
+func (t *ConfirmationTracker) Pending() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return len(t.entries)
+}
+
+// signal wakes the tracker goroutine up to check the entries.
+func (t *ConfirmationTracker) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *ConfirmationTracker) run(ctx context.Context, quit <-chan struct{}) {
+	sub, unsubscribe := t.chain.Subscribe()
+	defer func() { unsubscribe() }()
+	ticker := time.NewTicker(trackerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-quit:
+			return
+		case event, ok := <-sub:
+			if ok && event.Type != SubscriptionOverflow {
+				t.health.block()
+			} else {
+				t.health.fail(ErrSubscriptionOverflow)
+				// The entries are checked against the chain
+				// itself, so the lost events do not matter.
+				unsubscribe()
+				sub, unsubscribe = t.chain.Subscribe()
+			}
+		case <-t.wake:
+		case <-ticker.C:
+		}
+		if !t.check(ctx) {
+			return
+		}
+	}
+}
+
+// check updates the entries from the best chain, sending their events.  It
+// returns false if ctx was done meanwhile.
+func (t *ConfirmationTracker) check(ctx context.Context) bool {
+	t.mtx.Lock()
+	entries := make([]trackedTx, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+	t.mtx.Unlock()
+
+	now := t.cfg.now().Unix()
+	for i := range entries {
+		e := &entries[i]
+		event, done := t.checkEntry(ctx, e, now)
+		t.update(e, done)
+		if event == nil {
+			continue
+		}
+		select {
+		case t.events <- *event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// checkEntry updates e from the best chain, and returns the event it sends
+// if any, and whether tracking it is done.
+func (t *ConfirmationTracker) checkEntry(ctx context.Context, e *trackedTx, now int64) (*ConfirmationEvent, bool) {
+	event := t.event(e)
+	confirmations, err := t.chain.Confirmations(e.BlockHash)
+	if err != nil && t.cfg.relocate != nil {
+		if e.Reorged {
+			hash, ok, rerr := t.cfg.relocate(ctx, e.TxID)
+			if rerr != nil {
+				t.cfg.logger.Warnf("confirmation tracker: relocating "+
+					"transaction %v: %v", e.TxID, rerr)
+			}
+			if rerr == nil && ok && hash != e.BlockHash {
+				if n, cerr := t.chain.Confirmations(hash); cerr == nil {
+					e.BlockHash, e.Reorged = hash, false
+					event.BlockHash = hash
+					confirmations, err = n, nil
+				}
+			}
+		}
+	}
+	switch {
+	case err == nil && confirmations >= e.Depth:
+		event.Type = Confirmed
+		return event, true
+	case e.Deadline != 0 && now >= e.Deadline:
+		event.Type = TimedOut
+		return event, true
+	case err == nil:
+		e.Reorged = false
+		return nil, false
+	case !e.Reorged:
+		e.Reorged = true
+		event.Type = Reorged
+		return event, false
+	}
+	return nil, false
+}
+
+// event returns an event of e at the current tip.
+func (t *ConfirmationTracker) event(e *trackedTx) *ConfirmationEvent {
+	_, height := t.chain.Tip()
+	tip, _ := t.chain.HashAtHeight(height)
+	return &ConfirmationEvent{
+		TxID:      e.TxID,
+		BlockHash: e.BlockHash,
+		Tip:       tip,
+		TipHeight: height,
+	}
+}
+
+// update stores e, or deletes it if done, unless its entry was registered
+// again meanwhile.
+func (t *ConfirmationTracker) update(e *trackedTx, done bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	cur, ok := t.entries[e.TxID]
+	if !ok || cur.Depth != e.Depth || cur.Deadline != e.Deadline {
+		return
+	}
+	if *cur == *e && !done {
+		return
+	}
+	if done {
+		delete(t.entries, e.TxID)
+	} else {
+		*cur = *e
+	}
+	if err := t.saveLocked(); err != nil {
+		t.cfg.logger.Errorf("confirmation tracker: %v", err)
+	}
+}
+
+// saveLocked writes the entries to the state file, if there is one.  The
+// tracker must be locked.
+func (t *ConfirmationTracker) saveLocked() error {
+	if t.cfg.statePath == "" {
+		return nil
+	}
+	entries := make([]*trackedTx, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	return writeTrackerState(t.cfg.statePath, entries)
+}
+
+// readTrackerState returns the entries written to path by
+// writeTrackerState.
+func readTrackerState(path string) ([]*trackedTx, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*trackedTx
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("tracker state %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// writeTrackerState replaces the state at path, through a temporary file so
+// that a crash leaves either state.
+func writeTrackerState(path string, entries []*trackedTx) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
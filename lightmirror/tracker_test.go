@@ -0,0 +1,222 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror/leaktest"
+)
+
+// startTracker starts a tracker on c, stopped at the end of the test, which
+// checks that it leaves no goroutine behind.
+func startTracker(t *testing.T, c *MirrorChain, opts ...TrackerOption) *ConfirmationTracker {
+	t.Helper()
+	leaktest.Check(t)
+	tr, err := NewConfirmationTracker(c, opts...)
+	if err != nil {
+		t.Fatalf("NewConfirmationTracker error %v", err)
+	}
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	t.Cleanup(func() {
+		if err := tr.Stop(context.Background()); err != nil {
+			t.Errorf("Stop error %v", err)
+		}
+	})
+	return tr
+}
+
+// nextConfirmationEvent returns the next event of tr, failing the test if
+// none comes.
+func nextConfirmationEvent(t *testing.T, tr *ConfirmationTracker) ConfirmationEvent {
+	t.Helper()
+	select {
+	case event, ok := <-tr.Events():
+		if !ok {
+			t.Fatalf("tracker events closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no tracker event")
+	}
+	return ConfirmationEvent{}
+}
+
+// noConfirmationEvent fails the test if tr sends an event shortly.
+func noConfirmationEvent(t *testing.T, tr *ConfirmationTracker) {
+	t.Helper()
+	select {
+	case event := <-tr.Events():
+		t.Errorf("unexpected tracker event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testClock is a clock of the tests, moved forward by hand.
+type testClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.now = c.now.Add(d)
+	c.mtx.Unlock()
+}
+
+func TestConfirmationTrackerReorg(t *testing.T) {
+	txid := chainhash.DoubleHashH([]byte("tracked"))
+	mirrors := newTestMirrors(3)
+	c := newTestChain(t, mirrors)
+
+	// The relocation callback answers from the blocks holding the
+	// transaction.
+	var mtx sync.Mutex
+	holding := map[chainhash.Hash]chainhash.Hash{}
+	relocate := func(ctx context.Context, id chainhash.Hash) (chainhash.Hash, bool, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		hash, ok := holding[id]
+		return hash, ok, nil
+	}
+	tr := startTracker(t, c, WithRelocate(relocate))
+
+	block := mirrors[1].BtcHeader.BlockHash()
+	if err := tr.Register(txid, block, 3); err != nil {
+		t.Fatalf("Register error %v", err)
+	}
+	noConfirmationEvent(t, tr)
+
+	// A longer branch replaces the block; the transaction is in the
+	// second block of the branch.
+	branch := newTestBranch(mirrors[0], 10, 3)
+	mtx.Lock()
+	holding[txid] = branch[1].BtcHeader.BlockHash()
+	mtx.Unlock()
+	if _, err := c.AppendBatch(branch); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	event := nextConfirmationEvent(t, tr)
+	tip := branch[2].BtcHeader.BlockHash()
+	if event.Type != Reorged || event.TxID != txid || event.BlockHash != block ||
+		event.Tip != tip || event.TipHeight != testAnchorHeight+3 {
+		t.Errorf("reorg: got %+v, want %v of %v at tip %v", event, Reorged, block, tip)
+	}
+
+	// The relocated block has two confirmations, one more confirms it.
+	noConfirmationEvent(t, tr)
+	if tr.Pending() != 1 {
+		t.Errorf("Pending: got %d, want 1", tr.Pending())
+	}
+	next := newTestMirror(tip, 20, 0)
+	if _, err := c.Append(next); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	event = nextConfirmationEvent(t, tr)
+	if event.Type != Confirmed || event.BlockHash != branch[1].BtcHeader.BlockHash() ||
+		event.Tip != next.BtcHeader.BlockHash() {
+		t.Errorf("confirmation: got %+v, want %v of %v", event, Confirmed,
+			branch[1].BtcHeader.BlockHash())
+	}
+	if tr.Pending() != 0 {
+		t.Errorf("Pending after the confirmation: got %d, want 0", tr.Pending())
+	}
+}
+
+func TestConfirmationTrackerTimeout(t *testing.T) {
+	mirrors := newTestMirrors(2)
+	c := newTestChain(t, mirrors)
+	clock := &testClock{now: time.Unix(1231006505, 0)}
+	tr := startTracker(t, c, WithTrackerTimeout(time.Hour),
+		func(cfg *trackerConfig) { cfg.now = clock.Now })
+
+	// The block is unknown, so the entry is reorged until it times out.
+	txid := chainhash.DoubleHashH([]byte("tracked"))
+	unknown := chainhash.DoubleHashH([]byte("block"))
+	if err := tr.Register(txid, unknown, 1); err != nil {
+		t.Fatalf("Register error %v", err)
+	}
+	if event := nextConfirmationEvent(t, tr); event.Type != Reorged || event.BlockHash != unknown {
+		t.Errorf("unknown block: got %+v, want %v", event, Reorged)
+	}
+	clock.Advance(time.Hour)
+	if _, err := c.Append(newTestMirror(mirrors[1].BtcHeader.BlockHash(), 10, 0)); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if event := nextConfirmationEvent(t, tr); event.Type != TimedOut || event.TxID != txid {
+		t.Errorf("timeout: got %+v, want %v", event, TimedOut)
+	}
+	if err := tr.Register(txid, unknown, 0); err == nil {
+		t.Errorf("Register: no error for depth 0")
+	}
+}
+
+func TestConfirmationTrackerState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.json")
+	mirrors := newTestMirrors(2)
+	c := newTestChain(t, mirrors)
+	txid := chainhash.DoubleHashH([]byte("tracked"))
+	block := mirrors[1].BtcHeader.BlockHash()
+
+	tr := startTracker(t, c, WithTrackerState(path))
+	if err := tr.Register(txid, block, 2); err != nil {
+		t.Fatalf("Register error %v", err)
+	}
+	if err := tr.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	if err := tr.Register(txid, block, 2); err != ErrTrackerClosed {
+		t.Errorf("Register after Stop: got error %v, want %v", err, ErrTrackerClosed)
+	}
+	if _, ok := <-tr.Events(); ok {
+		t.Errorf("events not closed by Stop")
+	}
+
+	// A new tracker resumes the entry and confirms it.
+	tr = startTracker(t, c, WithTrackerState(path))
+	if tr.Pending() != 1 {
+		t.Fatalf("Pending after the restart: got %d, want 1", tr.Pending())
+	}
+	if _, err := c.Append(newTestMirror(block, 10, 0)); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	if event := nextConfirmationEvent(t, tr); event.Type != Confirmed || event.BlockHash != block {
+		t.Errorf("resumed: got %+v, want %v of %v", event, Confirmed, block)
+	}
+	entries, err := readTrackerState(path)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("state after the confirmation: got %d entries, error %v", len(entries), err)
+	}
+}
+
+func TestConfirmationEventTypeStringer(t *testing.T) {
+	tests := []struct {
+		in   ConfirmationEventType
+		want string
+	}{
+		{Confirmed, "Confirmed"},
+		{Reorged, "Reorged"},
+		{TimedOut, "TimedOut"},
+		{0xff, "Unknown ConfirmationEventType (255)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrTrailingData is wrapped by the TrailingDataError of a decode which
+// found bytes left after the data it decoded.
+var ErrTrailingData = errors.New("trailing data")
+
+// TrailingDataError is returned by the decoders rejecting trailing bytes,
+// with the number of bytes left after the decoded data.  It wraps
+// ErrTrailingData.
+type TrailingDataError struct {
+	Bytes int64
+}
+
+func (e *TrailingDataError) Error() string {
+	return fmt.Sprintf("%d bytes left after the decoded data: %v", e.Bytes,
+		ErrTrailingData)
+}
+
+func (e *TrailingDataError) Unwrap() error {
+	return ErrTrailingData
+}
+
+// checkTrailing fails with a *TrailingDataError if r holds more bytes.  The
+// bytes of a reader telling its length, such as a *bytes.Reader, are
+// counted without being consumed; other readers are drained.
+func checkTrailing(r io.Reader) error {
+	var n int64
+	if l, ok := r.(interface{ Len() int }); ok {
+		n = int64(l.Len())
+	} else {
+		var err error
+		if n, err = io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		return &TrailingDataError{Bytes: n}
+	}
+	return nil
+}
+
+// DeserializeBytes decodes the mirror serialized in b, with the limits of the
+// zero DeserializeOptions.  Unlike Deserialize, it fails with a
+// *TrailingDataError when b holds more than the mirror.
+func DeserializeBytes(b []byte) (*BtcLightMirrorV2, error) {
+	return DeserializeBytesWith(b, DeserializeOptions{RejectTrailingBytes: true})
+}
+
+// DeserializeBytesWith decodes the mirror serialized in b with the options
+// opts, which only reject trailing bytes with opts.RejectTrailingBytes.  An
+// empty or truncated b fails with io.ErrUnexpectedEOF.
+func DeserializeBytesWith(b []byte, opts DeserializeOptions) (*BtcLightMirrorV2, error) {
+	m := new(BtcLightMirrorV2)
+	if err := m.DeserializeWith(bytes.NewReader(b), opts); err != nil {
+		return nil, noEOF(err)
+	}
+	return m, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// checkTrailingErr checks that err is a *TrailingDataError of n bytes.
+func checkTrailingErr(t *testing.T, desc string, err error, n int64) {
+	t.Helper()
+	var trailing *TrailingDataError
+	if !errors.As(err, &trailing) || trailing.Bytes != n || !errors.Is(err, ErrTrailingData) {
+		t.Errorf("%s: got error %v, want %d trailing bytes", desc, err, n)
+	}
+}
+
+func TestDeserializeBytes(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes error %v", err)
+	}
+	trailing := append(append([]byte(nil), data...), 0xaa, 0xbb, 0xcc)
+
+	got, err := DeserializeBytes(data)
+	if err != nil || !got.Equal(m) {
+		t.Errorf("DeserializeBytes: got %v, error %v, want %v", got, err, m)
+	}
+	_, err = DeserializeBytes(trailing)
+	checkTrailingErr(t, "DeserializeBytes", err, 3)
+	if _, err := DeserializeBytes(nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DeserializeBytes empty: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := DeserializeBytesWith(trailing, DeserializeOptions{}); err != nil {
+		t.Errorf("DeserializeBytesWith allowing trailing bytes error %v", err)
+	}
+
+	// The reader API leaves trailing bytes unread unless told otherwise,
+	// the bytes of a reader not telling its length being drained.
+	if err := new(BtcLightMirrorV2).Deserialize(bytes.NewReader(trailing)); err != nil {
+		t.Errorf("Deserialize error %v", err)
+	}
+	strict := DeserializeOptions{RejectTrailingBytes: true}
+	err = new(BtcLightMirrorV2).DeserializeWith(iotest.OneByteReader(bytes.NewReader(trailing)), strict)
+	checkTrailingErr(t, "DeserializeWith", err, 3)
+
+	d := MirrorDecoder{Options: strict}
+	checkTrailingErr(t, "Decode", d.Decode(bytes.NewReader(trailing), new(BtcLightMirrorV2)), 3)
+	if err := d.Decode(bytes.NewReader(data), new(BtcLightMirrorV2)); err != nil {
+		t.Errorf("Decode error %v", err)
+	}
+}
+
+func TestBatchTrailingBytes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SerializeBatch(&buf, newTestMirrors(3)); err != nil {
+		t.Fatalf("SerializeBatch error %v", err)
+	}
+	buf.WriteByte(0)
+
+	if _, err := DeserializeBatch(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("DeserializeBatch error %v", err)
+	}
+	_, err := DeserializeBatchWith(bytes.NewReader(buf.Bytes()), DeserializeOptions{RejectTrailingBytes: true})
+	checkTrailingErr(t, "DeserializeBatchWith", err, 1)
+}
+
+func TestStreamTrailingBytes(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	var buf bytes.Buffer
+	for _, m := range mirrors {
+		if err := m.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize error %v", err)
+		}
+	}
+	buf.Write([]byte{1, 2, 3, 4, 5})
+
+	// The partial header after the last mirror is reported as such.
+	calls := 0
+	err := DecodeEach(bytes.NewReader(buf.Bytes()), func(int, *BtcLightMirrorV2) error {
+		calls++
+		return nil
+	})
+	var decodeErr *MirrorDecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Index != len(mirrors) || calls != len(mirrors) {
+		t.Errorf("DecodeEach: got error %v after %d calls", err, calls)
+	}
+	checkTrailingErr(t, "DecodeEach", err, 5)
+
+	var d MirrorDecoder
+	err = d.DecodeAll(bytes.NewReader(buf.Bytes()), func(*BtcLightMirrorV2) error { return nil })
+	checkTrailingErr(t, "DecodeAll", err, 5)
+}
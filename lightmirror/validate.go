@@ -0,0 +1,243 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"golang.org/x/sync/errgroup"
+)
+
+// ValidateOption configures ValidateChainParallel.
+type ValidateOption func(*validateConfig)
+
+type validateConfig struct {
+	logger          Logger
+	powHash         PowHashFunc
+	signetChallenge []byte
+}
+
+// WithValidationLogger makes the validation log the reason of its failures
+// to l.
+func WithValidationLogger(l Logger) ValidateOption {
+	return func(cfg *validateConfig) {
+		cfg.logger = l
+	}
+}
+
+// WithValidationPowHash sets the hash function of the proof of work the
+// mirrors are validated against, BitcoinPowHash by default.
+func WithValidationPowHash(f PowHashFunc) ValidateOption {
+	return func(cfg *validateConfig) {
+		cfg.powHash = f
+	}
+}
+
+// ValidateChainParallel validates a batch of mirrors which must form a chain
+// in order.  The context free checks of every mirror, its proof of work
+// against params, or its solution on a signet, and its merkle branch, run on
+// a pool of workers, or of GOMAXPROCS workers when workers is not positive.
+// Then a sequential pass ensures every mirror builds on the one before it,
+// failing with ErrUnknownParent otherwise.  A nil mirror fails with
+// ErrInvalidMirror.
+//
+// Outstanding work is cancelled on the first error, which is returned.  As
+// the workers run concurrently, it is not necessarily the error of the
+// lowest failing mirror.
+func ValidateChainParallel(ctx context.Context, mirrors []*BtcLightMirrorV2, params *chaincfg.Params, workers int, opts ...ValidateOption) error {
+	v, err := newBatchVerifier(params, opts)
+	if err != nil {
+		return err
+	}
+	err = runPool(ctx, len(mirrors), workers, func(i int) error {
+		if err := v.verifyMirror(i, mirrors[i]); err != nil {
+			return fmt.Errorf("mirror %d: %w", i, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i < len(mirrors); i++ {
+		if mirrors[i].BtcHeader.PrevBlock != mirrors[i-1].BtcHeader.BlockHash() {
+			v.logger.Warnf("mirror %d, block %v, does not build on mirror %d",
+				i, mirrors[i].BtcHeader.BlockHash(), i-1)
+			return fmt.Errorf("mirror %d does not build on mirror %d: %w",
+				i, i-1, ErrUnknownParent)
+		}
+	}
+	return nil
+}
+
+// Validate runs the context free checks of the mirror on the network of
+// params, as ValidateChainParallel does: its proof of work, by
+// CheckProofOfWork under the limit of params, or on a signet its solution,
+// then its coinbase and merkle branch, by CheckMerkle.  It returns the first
+// error.
+func (light *BtcLightMirrorV2) Validate(params *chaincfg.Params) error {
+	challenge, err := signetChallenge(params, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkWork(light, params, nil, challenge); err != nil {
+		return err
+	}
+	return light.CheckMerkle()
+}
+
+// checkWork checks the work of a mirror on the network of params: its proof
+// of work under powHash, or on a signet whose blocks are signed for
+// challenge, its signet solution.
+func checkWork(m *BtcLightMirrorV2, params *chaincfg.Params, powHash PowHashFunc, challenge []byte) error {
+	if challenge != nil {
+		return checkSignet(m, m.BtcHeader.BlockHash(), params, challenge)
+	}
+	return checkProofOfWork(&m.BtcHeader, params.PowLimit, powHash)
+}
+
+// batchVerifier runs the context free checks of the mirrors of a batch, for
+// ValidateChainParallel and VerifyBatch.
+type batchVerifier struct {
+	params    *chaincfg.Params
+	powHash   PowHashFunc
+	challenge []byte
+	logger    Logger
+}
+
+func newBatchVerifier(params *chaincfg.Params, opts []ValidateOption) (*batchVerifier, error) {
+	var cfg validateConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	challenge, err := signetChallenge(params, cfg.signetChallenge)
+	if err != nil {
+		return nil, err
+	}
+	return &batchVerifier{
+		params:    params,
+		powHash:   cfg.powHash,
+		challenge: challenge,
+		logger:    orNopLogger(cfg.logger),
+	}, nil
+}
+
+// verifyMirror checks m, the mirror at index i of the batch: its work, then
+// its coinbase and merkle branch.  Failures are logged.
+func (v *batchVerifier) verifyMirror(i int, m *BtcLightMirrorV2) error {
+	if m == nil {
+		v.logger.Warnf("mirror %d is nil", i)
+		return fmt.Errorf("nil mirror: %w", ErrInvalidMirror)
+	}
+	err := checkWork(m, v.params, v.powHash, v.challenge)
+	if err == nil {
+		err = m.CheckMerkle()
+	}
+	if err != nil {
+		v.logger.Warnf("mirror %d, block %v, failed validation: %v",
+			i, m.BtcHeader.BlockHash(), err)
+	}
+	return err
+}
+
+// runPool calls fn for every index in [0, n) on a pool of workers, or of
+// GOMAXPROCS workers when workers is not positive.  It stops at the first
+// error of fn, or once ctx is done, and returns that error.
+func runPool(ctx context.Context, n, workers int, fn func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan int)
+	g.Go(func() error {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	for w := 0; w < workers; w++ {
+		g.Go(func() error {
+			for i := range jobs {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := fn(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// BatchError is returned by VerifyBatch when mirrors of the batch fail
+// verification.  It unwraps to the error of the lowest failing mirror.
+type BatchError struct {
+	// Errs holds the error of every mirror of the batch, in order, nil for
+	// the mirrors which passed.
+	Errs []error
+
+	// Failed holds the indexes of the failing mirrors, in ascending
+	// order.
+	Failed []int
+}
+
+func (e *BatchError) Error() string {
+	first := e.Failed[0]
+	return fmt.Sprintf("%d of %d mirrors failed verification, mirror %d: %v",
+		len(e.Failed), len(e.Errs), first, e.Errs[first])
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Errs[e.Failed[0]]
+}
+
+// VerifyBatch runs the context free checks of ValidateChainParallel on every
+// mirror of a batch, on the same pool of workers.  Unlike
+// ValidateChainParallel, the mirrors need not form a chain, and every mirror
+// is checked: the failures are gathered in a *BatchError rather than the
+// first one cancelling the batch.  A nil mirror fails with ErrInvalidMirror.
+//
+// Once ctx is done, the mirrors left are not checked and VerifyBatch
+// returns the error of ctx.
+func VerifyBatch(ctx context.Context, mirrors []*BtcLightMirrorV2, params *chaincfg.Params, workers int, opts ...ValidateOption) error {
+	v, err := newBatchVerifier(params, opts)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(mirrors))
+	err = runPool(ctx, len(mirrors), workers, func(i int) error {
+		errs[i] = v.verifyMirror(i, mirrors[i])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var batchErr BatchError
+	for i, err := range errs {
+		if err != nil {
+			batchErr.Failed = append(batchErr.Failed, i)
+		}
+	}
+	if len(batchErr.Failed) == 0 {
+		return nil
+	}
+	batchErr.Errs = errs
+	return &batchErr
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestValidateChainParallel(t *testing.T) {
+	mirrors := newTestMirrors(50)
+	for _, workers := range []int{0, 1, 4, 100} {
+		err := ValidateChainParallel(context.Background(), mirrors,
+			&chaincfg.RegressionNetParams, workers)
+		if err != nil {
+			t.Errorf("ValidateChainParallel (%d workers) error %v", workers, err)
+		}
+	}
+	if err := ValidateChainParallel(context.Background(), nil,
+		&chaincfg.RegressionNetParams, 4); err != nil {
+		t.Errorf("ValidateChainParallel (no mirrors) error %v", err)
+	}
+}
+
+func TestValidateChainParallelInvalid(t *testing.T) {
+	badMerkle := newTestMirrors(20)
+	badMerkle[13].CoinBaseTx.LockTime++
+
+	unlinked := newTestMirrors(20)
+	unlinked = append(unlinked[:7], unlinked[8:]...)
+
+	withNil := newTestMirrors(20)
+	withNil[5] = nil
+
+	tests := []struct {
+		name    string
+		mirrors []*BtcLightMirrorV2
+		params  *chaincfg.Params
+		want    error
+	}{
+		{"merkle", badMerkle, &chaincfg.RegressionNetParams, nil},
+		{"proof of work", newTestMirrors(20), &chaincfg.MainNetParams, nil},
+		{"linkage", unlinked, &chaincfg.RegressionNetParams, ErrUnknownParent},
+		{"nil mirror", withNil, &chaincfg.RegressionNetParams, ErrInvalidMirror},
+	}
+	for _, test := range tests {
+		err := ValidateChainParallel(context.Background(), test.mirrors,
+			test.params, 4)
+		if err == nil {
+			t.Errorf("ValidateChainParallel (%s): expected error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("ValidateChainParallel (%s): got error %v, want %v",
+				test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateChainParallelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ValidateChainParallel(ctx, newTestMirrors(20),
+		&chaincfg.RegressionNetParams, 4)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ValidateChainParallel: got error %v, want %v", err,
+			context.Canceled)
+	}
+}
+
+// BenchmarkValidateChainParallel validates a retarget window of mirrors of
+// blocks with a thousand transactions, from one worker up to GOMAXPROCS.
+func BenchmarkValidateChainParallel(b *testing.B) {
+	mirrors := make([]*BtcLightMirrorV2, 0, 2016)
+	var prev chainhash.Hash
+	for i := 0; i < cap(mirrors); i++ {
+		m := newTestMirror(prev, uint32(i), 1000)
+		mirrors = append(mirrors, m)
+		prev = m.BtcHeader.BlockHash()
+	}
+
+	for workers := 1; ; workers *= 2 {
+		if workers > runtime.GOMAXPROCS(0) {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := ValidateChainParallel(context.Background(), mirrors,
+					&chaincfg.RegressionNetParams, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		if workers == runtime.GOMAXPROCS(0) {
+			break
+		}
+	}
+}
+
+func TestBtcLightMirrorV2Validate(t *testing.T) {
+	m := newTestMirror(chainhash.Hash{}, 1, 3)
+	if err := m.Validate(&chaincfg.RegressionNetParams); err != nil {
+		t.Fatalf("Validate error %v", err)
+	}
+
+	badMerkle := m.Clone()
+	badMerkle.CoinBaseTx.LockTime++
+	custom := chaincfg.CustomSignetParams([]byte{0x51}, nil)
+	tests := []struct {
+		name   string
+		mirror *BtcLightMirrorV2
+		params *chaincfg.Params
+		want   error
+	}{
+		{"proof of work", m, &chaincfg.MainNetParams, ErrInvalidBits},
+		{"merkle", badMerkle, &chaincfg.RegressionNetParams, nil},
+		{"signet", m, &chaincfg.SigNetParams, nil},
+		{"custom signet", m, &custom, nil},
+	}
+	for _, test := range tests {
+		err := test.mirror.Validate(test.params)
+		if err == nil {
+			t.Errorf("Validate (%s): expected error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("Validate (%s): got error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestVerifyBatch(t *testing.T) {
+	// The mirrors need not form a chain.
+	mirrors := newTestMirrors(50)
+	mirrors = append(mirrors[:7], mirrors[8:]...)
+	for _, workers := range []int{0, 1, 4, 100} {
+		err := VerifyBatch(context.Background(), mirrors, &chaincfg.RegressionNetParams, workers)
+		if err != nil {
+			t.Errorf("VerifyBatch (%d workers) error %v", workers, err)
+		}
+	}
+	if err := VerifyBatch(context.Background(), nil, &chaincfg.RegressionNetParams, 4); err != nil {
+		t.Errorf("VerifyBatch (no mirrors) error %v", err)
+	}
+
+	// Every failure is reported, not only the first.
+	notCoinbase := mirrors[30].Clone()
+	notCoinbase.CoinBaseTx.TxIn[0].PreviousOutPoint.Index = 0
+	mirrors[3] = mirrors[3].Clone()
+	mirrors[3].CoinBaseTx.LockTime++
+	mirrors[12] = nil
+	mirrors[30] = notCoinbase
+	err := VerifyBatch(context.Background(), mirrors, &chaincfg.RegressionNetParams, 4)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("VerifyBatch: got error %v, want a *BatchError", err)
+	}
+	if len(batchErr.Errs) != len(mirrors) || fmt.Sprint(batchErr.Failed) != "[3 12 30]" {
+		t.Fatalf("VerifyBatch: got %d errors, failed %v, want %d, [3 12 30]",
+			len(batchErr.Errs), batchErr.Failed, len(mirrors))
+	}
+	for i, err := range batchErr.Errs {
+		if (err != nil) != (i == 3 || i == 12 || i == 30) {
+			t.Errorf("VerifyBatch #%d: got error %v", i, err)
+		}
+	}
+	if !errors.Is(batchErr.Errs[12], ErrInvalidMirror) {
+		t.Errorf("VerifyBatch #12: got error %v, want %v", batchErr.Errs[12], ErrInvalidMirror)
+	}
+	if !errors.Is(batchErr.Errs[30], ErrNotCoinbase) {
+		t.Errorf("VerifyBatch #30: got error %v, want %v", batchErr.Errs[30], ErrNotCoinbase)
+	}
+	if !errors.Is(err, batchErr.Errs[3]) {
+		t.Errorf("VerifyBatch: got error %v, want it to unwrap to %v", err, batchErr.Errs[3])
+	}
+
+	err = VerifyBatch(context.Background(), newTestMirrors(20), &chaincfg.MainNetParams, 4)
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 20 || !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("VerifyBatch (proof of work): got error %v, want %v for all mirrors", err, ErrInvalidBits)
+	}
+}
+
+func TestVerifyBatchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := VerifyBatch(ctx, newTestMirrors(20), &chaincfg.RegressionNetParams, 4)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("VerifyBatch: got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//go:generate go run vectors/gen.go
+
+// The test vectors LoadVector loads.  vectors/README.md describes where each
+// comes from and how to regenerate it.
+const (
+	// VectorCoinbaseOnly is main network block 1, whose only transaction
+	// is the coinbase.
+	VectorCoinbaseOnly = "mainnet-1"
+
+	// VectorPreSegwit is main network block 2812, of 6 transactions, mined
+	// before segregated witness.
+	VectorPreSegwit = "mainnet-2812"
+
+	// VectorSegwit is a regression test network block at height 1, mined
+	// by btcd, whose coinbase carries a witness commitment.
+	VectorSegwit = "regtest-segwit"
+
+	// VectorCoreDelegation is a regression test network block at height 1
+	// whose coinbase delegates its hash power with a CORE output and
+	// carries a witness commitment.
+	VectorCoreDelegation = "regtest-core"
+)
+
+// ErrUnknownVector is returned by LoadVector for a name it has no vector of.
+var ErrUnknownVector = errors.New("unknown test vector")
+
+//go:embed vectors/*.hex
+var vectorFiles embed.FS
+
+// VectorNames returns the names of the vectors LoadVector loads, sorted.
+func VectorNames() []string {
+	paths, _ := fs.Glob(vectorFiles, "vectors/*.hex")
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(path, "vectors/"), ".hex"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadVector returns the block of the test vector with the given name, one
+// of VectorNames, and its mirror.  The mirror is built with New under
+// ValidateFull, capturing the witness branch of a block whose coinbase has
+// a witness, so the vectors also check the witness commitment.  The block
+// and the mirror are fresh copies the caller may modify.
+func LoadVector(name string) (*wire.MsgBlock, *BtcLightMirrorV2, error) {
+	data, err := vectorFiles.ReadFile("vectors/" + name + ".hex")
+	if err != nil {
+		return nil, nil, fmt.Errorf("vector %q: %w", name, ErrUnknownVector)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("vector %q: %v", name, err)
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, nil, fmt.Errorf("vector %q: %v", name, err)
+	}
+	if len(block.Transactions) == 0 {
+		return nil, nil, fmt.Errorf("vector %q: block has no transaction", name)
+	}
+
+	coinbase := block.Transactions[0]
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	var wtxids []chainhash.Hash
+	if coinbase.HasWitness() {
+		wtxids = make([]chainhash.Hash, len(block.Transactions))
+	}
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+		if wtxids != nil {
+			wtxids[i] = tx.WitnessHash()
+		}
+	}
+	opts := []MirrorOption{WithValidation(ValidateFull)}
+	if wtxids != nil {
+		opts = append(opts, WithWitnessBranch(wtxids))
+	}
+	m, err := New(&block.Header, coinbase, txids, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("vector %q: %v", name, err)
+	}
+	return &block, m, nil
+}
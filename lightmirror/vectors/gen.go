@@ -0,0 +1,91 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+// gen writes regtest-core.hex, the test vector of a block delegating its hash
+// power.  Run it from the lightmirror directory with go generate.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func main() {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	reward := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	coreBlockHash := common.FromHex("0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f" +
+		"8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	powerScript := []byte{txscript.OP_RETURN, byte(5 + 2*common.AddressLength + len(coreBlockHash))}
+	powerScript = append(powerScript, "CORE"...)
+	powerScript = append(powerScript, txscript.OP_DATA_1)
+	powerScript = append(powerScript, candidate[:]...)
+	powerScript = append(powerScript, reward[:]...)
+	powerScript = append(powerScript, coreBlockHash...)
+
+	// The block has no transaction but the coinbase, whose witness hash
+	// counts as zero, so the witness root is the zero hash.  The witness
+	// nonce is zero too.
+	var witnessNonce, witnessRoot chainhash.Hash
+	commitment := chainhash.DoubleHashH(append(witnessRoot[:], witnessNonce[:]...))
+	commitmentScript := append([]byte{txscript.OP_RETURN, txscript.OP_DATA_36,
+		0xaa, 0x21, 0xa9, 0xed}, commitment[:]...)
+
+	coinbase := &wire.MsgTx{
+		Version: 2,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			// The height of the block, 1, as BIP 34 requires.
+			SignatureScript: []byte{txscript.OP_1, txscript.OP_0},
+			Witness:         wire.TxWitness{witnessNonce[:]},
+			Sequence:        wire.MaxTxInSequenceNum,
+		}},
+		TxOut: []*wire.TxOut{
+			{Value: 50 * 1e8, PkScript: []byte{txscript.OP_TRUE}},
+			{Value: 0, PkScript: powerScript},
+			{Value: 0, PkScript: commitmentScript},
+		},
+	}
+
+	params := &chaincfg.RegressionNetParams
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:    0x20000000,
+		PrevBlock:  *params.GenesisHash,
+		MerkleRoot: coinbase.TxHash(),
+		Timestamp:  time.Unix(1600000000, 0),
+		Bits:       params.PowLimitBits,
+	})
+	if err := block.AddTransaction(coinbase); err != nil {
+		log.Fatal(err)
+	}
+	target := blockchain.CompactToBig(block.Header.Bits)
+	for {
+		hash := block.Header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			break
+		}
+		block.Header.Nonce++
+	}
+
+	var buf bytes.Buffer
+	if err := block.Serialize(&buf); err != nil {
+		log.Fatal(err)
+	}
+	data := []byte(hex.EncodeToString(buf.Bytes()) + "\n")
+	if err := os.WriteFile("vectors/regtest-core.hex", data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
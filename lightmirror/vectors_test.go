@@ -0,0 +1,139 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLoadVector(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    *chaincfg.Params
+		hash      string
+		nodes     int
+		candidate string
+		reward    string
+		coreBlock string
+	}{
+		{
+			name:   VectorCoinbaseOnly,
+			params: &chaincfg.MainNetParams,
+			hash:   "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+		},
+		{
+			name:   VectorPreSegwit,
+			params: &chaincfg.MainNetParams,
+			hash:   "0000000049a63b4dda3a43450c19d085d6c28bfb4cbb2e0576815d7f31919c5d",
+			nodes:  3,
+		},
+		{
+			name:   VectorSegwit,
+			params: &chaincfg.RegressionNetParams,
+			hash:   "36c056247e8c0589f6307995e4e13acf2b2b79cad9ecd5a4eeab2131ed0ecde5",
+		},
+		{
+			name:      VectorCoreDelegation,
+			params:    &chaincfg.RegressionNetParams,
+			candidate: "0x5B38Da6a701c568545dCfcB03FcB875f56beddC4",
+			reward:    "0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2",
+			coreBlock: "0x4fd1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f",
+		},
+	}
+
+	names := make([]string, 0, len(tests))
+	for _, test := range tests {
+		names = append(names, test.name)
+		block, m, err := LoadVector(test.name)
+		if err != nil {
+			t.Fatalf("LoadVector (%s) error %v", test.name, err)
+		}
+		hash := m.BtcHeader.BlockHash()
+		if test.hash != "" && hash.String() != test.hash {
+			t.Errorf("LoadVector (%s): got block %v, want %s", test.name, hash, test.hash)
+		}
+		if hash != block.BlockHash() {
+			t.Errorf("LoadVector (%s): mirror of block %v, not %v", test.name,
+				hash, block.BlockHash())
+		}
+		if err := checkProofOfWork(&m.BtcHeader, test.params.PowLimit, nil); err != nil {
+			t.Errorf("LoadVector (%s): proof of work error %v", test.name, err)
+		}
+		if err := m.CheckMerkle(); err != nil {
+			t.Errorf("CheckMerkle (%s) error %v", test.name, err)
+		}
+		if got := len(m.MerkleNodes); got != test.nodes {
+			t.Errorf("LoadVector (%s): got %d merkle nodes, want %d", test.name,
+				got, test.nodes)
+		}
+		if witness := block.Transactions[0].HasWitness(); witness != (m.WitnessMerkleNodes != nil) {
+			t.Errorf("LoadVector (%s): got witness branch %v, coinbase witness %v",
+				test.name, m.WitnessMerkleNodes, witness)
+		}
+
+		var buf bytes.Buffer
+		if err := m.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize (%s) error %v", test.name, err)
+		}
+		var decoded BtcLightMirrorV2
+		if err := decoded.Deserialize(&buf); err != nil {
+			t.Fatalf("Deserialize (%s) error %v", test.name, err)
+		}
+		if diff := decoded.Diff(m); diff != nil {
+			t.Errorf("Deserialize (%s): differs from the mirror: %v", test.name, diff)
+		}
+
+		candidate, reward, coreBlock := m.ParsePowerParams()
+		if want := common.HexToAddress(test.candidate); candidate != want {
+			t.Errorf("ParsePowerParams (%s): got candidate %v, want %v",
+				test.name, candidate, want)
+		}
+		if want := common.HexToAddress(test.reward); reward != want {
+			t.Errorf("ParsePowerParams (%s): got reward %v, want %v",
+				test.name, reward, want)
+		}
+		if want := common.HexToHash(test.coreBlock); coreBlock != want {
+			t.Errorf("ParsePowerParams (%s): got core block %v, want %v",
+				test.name, coreBlock, want)
+		}
+	}
+
+	sort.Strings(names)
+	if got := VectorNames(); !reflect.DeepEqual(got, names) {
+		t.Errorf("VectorNames: got %v, want %v", got, names)
+	}
+	if _, _, err := LoadVector("mainnet-0"); !errors.Is(err, ErrUnknownVector) {
+		t.Errorf("LoadVector: got error %v, want %v", err, ErrUnknownVector)
+	}
+}
+
+// TestLoadVectorCopies checks every call returns fresh copies.
+func TestLoadVectorCopies(t *testing.T) {
+	block, m, err := LoadVector(VectorPreSegwit)
+	if err != nil {
+		t.Fatalf("LoadVector error %v", err)
+	}
+	block.Header.Nonce++
+	m.MerkleNodes[0][0] ^= 1
+	m.CoinBaseTx.TxIn[0].SignatureScript[0] ^= 1
+
+	block, m, err = LoadVector(VectorPreSegwit)
+	if err != nil {
+		t.Fatalf("LoadVector error %v", err)
+	}
+	if block.BlockHash() != m.BtcHeader.BlockHash() {
+		t.Errorf("LoadVector: block modified by a caller")
+	}
+	if err := m.CheckMerkle(); err != nil {
+		t.Errorf("LoadVector: mirror modified by a caller: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// medianTimeBlocks is the number of blocks whose timestamps the median
+	// time past is taken over.
+	medianTimeBlocks = 11
+
+	// maxFutureBlockTime is how far past the current time a block
+	// timestamp may be.
+	maxFutureBlockTime = 2 * time.Hour
+)
+
+var (
+	// ErrHeightNotMonotonic is returned by a ChainVerifier for a mirror
+	// not at the height after the one before it.
+	ErrHeightNotMonotonic = errors.New("height does not follow the previous block")
+
+	// ErrTimestampTooOld is returned by a ChainVerifier for a block
+	// timestamp no later than the median time past of the blocks before
+	// it.
+	ErrTimestampTooOld = errors.New("timestamp not after the median time past")
+
+	// ErrTimestampTooNew is returned by a ChainVerifier for a block
+	// timestamp more than two hours past the current time.
+	ErrTimestampTooNew = errors.New("timestamp too far in the future")
+)
+
+// ChainVerifierConfig configures a ChainVerifier.
+type ChainVerifierConfig struct {
+	// Params selects the proof of work limit the mirrors are validated
+	// against, the main network by default.
+	Params *chaincfg.Params
+
+	// PowHash is the hash function of the proof of work, BitcoinPowHash
+	// when nil.
+	PowHash PowHashFunc
+
+	// SignetChallenge is the challenge of a custom signet the signet
+	// solutions are checked against, as WithSignetChallenge does for a
+	// chain.
+	SignetChallenge []byte
+
+	// StartHeight is the height of the first mirror Verify is given.
+	StartHeight int64
+
+	// PrevTimestamps holds the timestamps, in Unix seconds, of the blocks
+	// right before StartHeight, oldest first, of which the last 11 count.
+	// Until the verifier knows the timestamps of the 11 blocks before a
+	// mirror, or of all of them for a chain starting at genesis, the
+	// median time past is not checked, as it can not be computed.
+	PrevTimestamps []int64
+
+	// Now returns the current time the block timestamps are checked
+	// against, time.Now when nil.
+	Now func() time.Time
+}
+
+// ChainVerifyError is returned by a ChainVerifier for a mirror failing
+// verification.
+type ChainVerifyError struct {
+	// Height and Hash are those of the mirror.
+	Height int64
+	Hash   chainhash.Hash
+
+	Err error
+}
+
+func (e *ChainVerifyError) Error() string {
+	return fmt.Sprintf("verify block %v at height %d: %v", e.Hash, e.Height, e.Err)
+}
+
+func (e *ChainVerifyError) Unwrap() error {
+	return e.Err
+}
+
+// ChainVerifier verifies a sequence of mirrors, in height order, is a chain
+// of headers: every mirror after the first builds on the one before it, at
+// the next height, with a timestamp after the median time past of the 11
+// blocks before it, when the verifier knows them, no more than two hours past
+// the current time, with the bits the difficulty adjustment requires, as a
+// MirrorChain checks them, and the proof of work of its header, or its
+// signet solution, is valid.  Merkle branches are not checked.
+//
+// The mirrors are fed one by one, as they are streamed from a fetcher or a
+// store, or as a slice.  A mirror failing verification leaves the verifier
+// as it was, expecting the same height, and its error is a *ChainVerifyError
+// wrapping ErrHeadersNotLinked, ErrHeightNotMonotonic, ErrTimestampTooOld,
+// ErrTimestampTooNew, ErrUnexpectedBits or the proof of work error.  A
+// ChainVerifier is not safe for concurrent use.
+type ChainVerifier struct {
+	cfg       ChainVerifierConfig
+	challenge []byte
+
+	// count is the number of mirrors verified, the last of which is at
+	// height with block hash hash.
+	count  int64
+	height int64
+	hash   chainhash.Hash
+
+	// times holds the timestamps of the last blocks verified, up to
+	// medianTimeBlocks of them, oldest first.
+	times []int64
+
+	// last is the header of the last mirror verified.  epochStart is the
+	// timestamp of the first block of its epoch, and normalBits the bits
+	// of the last block not mined under the reduced difficulty of a
+	// testnet, when they were verified.
+	last        wire.BlockHeader
+	epochStart  int64
+	epochKnown  bool
+	normalBits  uint32
+	normalKnown bool
+}
+
+// NewChainVerifier returns a verifier of the chain of mirrors starting at
+// cfg.StartHeight.
+func NewChainVerifier(cfg ChainVerifierConfig) (*ChainVerifier, error) {
+	if cfg.Params == nil {
+		cfg.Params = &chaincfg.MainNetParams
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	challenge, err := signetChallenge(cfg.Params, cfg.SignetChallenge)
+	if err != nil {
+		return nil, err
+	}
+	prev := cfg.PrevTimestamps
+	if int64(len(prev)) > cfg.StartHeight {
+		return nil, fmt.Errorf("%d previous timestamps for the %d blocks "+
+			"before height %d", len(prev), cfg.StartHeight, cfg.StartHeight)
+	}
+	if len(prev) > medianTimeBlocks {
+		prev = prev[len(prev)-medianTimeBlocks:]
+	}
+	return &ChainVerifier{
+		cfg:       cfg,
+		challenge: challenge,
+		height:    cfg.StartHeight - 1,
+		times:     append(make([]int64, 0, medianTimeBlocks), prev...),
+	}, nil
+}
+
+// Verify verifies m, the mirror at the height after the last one verified.
+func (v *ChainVerifier) Verify(m *BtcLightMirrorV2) error {
+	return v.VerifyAt(v.height+1, m)
+}
+
+// VerifyAt verifies m, the mirror at height, which must be the height after
+// the last one verified, such as a store iterates.
+func (v *ChainVerifier) VerifyAt(height int64, m *BtcLightMirrorV2) error {
+	hash := m.BtcHeader.BlockHash()
+	if err := v.check(height, m, hash); err != nil {
+		return &ChainVerifyError{Height: height, Hash: hash, Err: err}
+	}
+	v.count++
+	v.height, v.hash, v.last = height, hash, m.BtcHeader
+	interval := retargetInterval(v.cfg.Params)
+	if height%interval == 0 {
+		v.epochStart, v.epochKnown = m.BtcHeader.Timestamp.Unix(), true
+	}
+	if height%interval == 0 || m.BtcHeader.Bits != v.cfg.Params.PowLimitBits {
+		v.normalBits, v.normalKnown = m.BtcHeader.Bits, true
+	}
+	if len(v.times) == medianTimeBlocks {
+		v.times = append(v.times[:0], v.times[1:]...)
+	}
+	v.times = append(v.times, m.BtcHeader.Timestamp.Unix())
+	return nil
+}
+
+// VerifyAll verifies mirrors, the mirrors following the last one verified
+// in height order, up to the first failing one.
+func (v *ChainVerifier) VerifyAll(mirrors []*BtcLightMirrorV2) error {
+	for _, m := range mirrors {
+		if err := v.Verify(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tip returns the height and block hash of the last mirror verified, and
+// whether there is one.
+func (v *ChainVerifier) Tip() (int64, chainhash.Hash, bool) {
+	return v.height, v.hash, v.count > 0
+}
+
+// check runs the verification of the mirror m at height, whose block hash
+// is hash.
+func (v *ChainVerifier) check(height int64, m *BtcLightMirrorV2, hash chainhash.Hash) error {
+	if height != v.height+1 {
+		return fmt.Errorf("height %d after height %d: %w", height, v.height,
+			ErrHeightNotMonotonic)
+	}
+	header := &m.BtcHeader
+	if v.count > 0 && header.PrevBlock != v.hash {
+		return fmt.Errorf("builds on %v, not on %v: %w", header.PrevBlock, v.hash,
+			ErrHeadersNotLinked)
+	}
+	// The median time past is taken over the 11 blocks before the mirror,
+	// or all of them when there are fewer.
+	if n := int64(len(v.times)); n > 0 && (n == medianTimeBlocks || n == height) {
+		if mtp := pastMedianTime(v.times); header.Timestamp.Unix() <= mtp {
+			return fmt.Errorf("timestamp %v, median time past %v: %w",
+				header.Timestamp.UTC(), time.Unix(mtp, 0).UTC(), ErrTimestampTooOld)
+		}
+	}
+	if limit := v.cfg.Now().Add(maxFutureBlockTime); header.Timestamp.After(limit) {
+		return fmt.Errorf("timestamp %v, limit %v: %w", header.Timestamp.UTC(),
+			limit.UTC(), ErrTimestampTooNew)
+	}
+	if v.count > 0 {
+		if err := v.checkDifficulty(height, header); err != nil {
+			return err
+		}
+	}
+	if v.challenge != nil {
+		return checkSignet(m, hash, v.cfg.Params, v.challenge)
+	}
+	return checkProofOfWorkHash(header, powHashOf(v.cfg.PowHash, header, hash),
+		v.cfg.Params.PowLimit)
+}
+
+// checkDifficulty checks the bits of header, at height after the last
+// mirror verified, as MirrorChain.checkDifficulty does.  Bits depending on
+// blocks before the first one verified are not checked.
+func (v *ChainVerifier) checkDifficulty(height int64, header *wire.BlockHeader) error {
+	params := v.cfg.Params
+	switch {
+	case params.PoWNoRetargeting:
+		return nil
+	case height%retargetInterval(params) == 0:
+		if !v.epochKnown {
+			return nil
+		}
+		span := v.last.Timestamp.Unix() - v.epochStart
+		return checkBits(header, height, retargetBits(params, v.last.Bits, span))
+	case !params.ReduceMinDifficulty:
+		return checkBits(header, height, v.last.Bits)
+	case minDifficultyRequired(params, header, &v.last):
+		return checkBits(header, height, params.PowLimitBits)
+	case !v.normalKnown:
+		return nil
+	}
+	return checkBits(header, height, v.normalBits)
+}
+
+// pastMedianTime returns the median of times, the upper one for an even
+// count, as the consensus rules take it.
+func pastMedianTime(times []int64) int64 {
+	sorted := append([]int64(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
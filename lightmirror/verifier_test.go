@@ -0,0 +1,204 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// newTestVerifier returns a verifier of regression test mirrors starting at
+// height 100.
+func newTestVerifier(t *testing.T) *ChainVerifier {
+	t.Helper()
+	v, err := NewChainVerifier(ChainVerifierConfig{
+		Params:      &chaincfg.RegressionNetParams,
+		StartHeight: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewChainVerifier error %v", err)
+	}
+	return v
+}
+
+// minedHeaderMirrors returns headerMirrors of regression test bits, with
+// the timestamps, whose proof of work is valid.
+func minedHeaderMirrors(times []int64) []*BtcLightMirrorV2 {
+	m := headerMirrors(0x207fffff, times)
+	for i := range m {
+		for checkProofOfWork(&m[i].BtcHeader, chaincfg.RegressionNetParams.PowLimit, nil) != nil {
+			m[i].BtcHeader.Nonce++
+		}
+		if i+1 < len(m) {
+			m[i+1].BtcHeader.PrevBlock = m[i].BtcHeader.BlockHash()
+		}
+	}
+	return m
+}
+
+func TestChainVerifier(t *testing.T) {
+	mirrors := newTestMirrors(30)
+	v := newTestVerifier(t)
+	if _, _, ok := v.Tip(); ok {
+		t.Errorf("Tip: got a tip before any mirror")
+	}
+	if err := v.VerifyAll(mirrors[:20]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	for i, m := range mirrors[20:] {
+		if err := v.VerifyAt(int64(120+i), m); err != nil {
+			t.Fatalf("VerifyAt #%d error %v", i, err)
+		}
+	}
+	height, hash, ok := v.Tip()
+	if !ok || height != 129 || hash != mirrors[29].BtcHeader.BlockHash() {
+		t.Errorf("Tip: got %d %v %v, want height 129", height, hash, ok)
+	}
+
+	// Timestamps need only be after the median time past.
+	m := minedHeaderMirrors([]int64{10, 20, 30, 40, 50, 35, 60, 45})
+	v, _ = NewChainVerifier(ChainVerifierConfig{Params: &chaincfg.RegressionNetParams})
+	if err := v.VerifyAll(m); err != nil {
+		t.Errorf("VerifyAll out of order timestamps error %v", err)
+	}
+}
+
+func TestChainVerifierMedianTimePast(t *testing.T) {
+	// The block after the first one verified is older than it, which the
+	// median time past of the blocks before the start, unknown, allows.
+	times := []int64{1000, 900, 1100, 1200, 950, 1300, 1400, 1500, 1600, 1700,
+		1800, 1900, 2000}
+	m := minedHeaderMirrors(times)
+	v, err := NewChainVerifier(ChainVerifierConfig{
+		Params:      &chaincfg.RegressionNetParams,
+		StartHeight: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewChainVerifier error %v", err)
+	}
+	if err := v.VerifyAll(m); err != nil {
+		t.Errorf("VerifyAll from height 100 error %v", err)
+	}
+
+	// The median time past is checked once 11 blocks are known, and from
+	// genesis.
+	old := minedHeaderMirrors(append(append([]int64{}, times[:11]...), 1100))
+	v, _ = NewChainVerifier(ChainVerifierConfig{
+		Params:      &chaincfg.RegressionNetParams,
+		StartHeight: 100,
+	})
+	if err := v.VerifyAll(old); !errors.Is(err, ErrTimestampTooOld) {
+		t.Errorf("VerifyAll after 11 blocks: got error %v, want %v", err, ErrTimestampTooOld)
+	}
+	v, _ = NewChainVerifier(ChainVerifierConfig{Params: &chaincfg.RegressionNetParams})
+	if err := v.VerifyAll(m[:2]); !errors.Is(err, ErrTimestampTooOld) {
+		t.Errorf("VerifyAll from genesis: got error %v, want %v", err, ErrTimestampTooOld)
+	}
+
+	// The timestamps of the blocks before the start count when given.
+	prev := []int64{7, 1, 2, 3, 4, 5, 990, 995, 996, 997, 998, 999}
+	v, err = NewChainVerifier(ChainVerifierConfig{
+		Params:         &chaincfg.RegressionNetParams,
+		StartHeight:    100,
+		PrevTimestamps: prev,
+	})
+	if err != nil {
+		t.Fatalf("NewChainVerifier with previous timestamps error %v", err)
+	}
+	if err := v.Verify(m[0]); err != nil {
+		t.Fatalf("Verify after previous timestamps error %v", err)
+	}
+	if err := v.Verify(m[1]); !errors.Is(err, ErrTimestampTooOld) {
+		t.Errorf("Verify after previous timestamps: got error %v, want %v", err,
+			ErrTimestampTooOld)
+	}
+	if _, err := NewChainVerifier(ChainVerifierConfig{
+		Params:         &chaincfg.RegressionNetParams,
+		StartHeight:    3,
+		PrevTimestamps: prev[:4],
+	}); err == nil {
+		t.Errorf("NewChainVerifier: expected error for more previous timestamps than blocks")
+	}
+}
+
+func TestChainVerifierInvalid(t *testing.T) {
+	mirrors := newTestMirrors(15)
+
+	old := mirrors[12].Clone()
+	old.BtcHeader.Timestamp = mirrors[6].BtcHeader.Timestamp
+	badPow := mirrors[12].Clone()
+	for checkProofOfWork(&badPow.BtcHeader, chaincfg.RegressionNetParams.PowLimit, nil) == nil {
+		badPow.BtcHeader.Nonce++
+	}
+
+	tests := []struct {
+		name   string
+		height int64
+		mirror *BtcLightMirrorV2
+		want   error
+	}{
+		{"unlinked", 112, mirrors[13], ErrHeadersNotLinked},
+		{"height skipped", 113, mirrors[12], ErrHeightNotMonotonic},
+		{"height repeated", 111, mirrors[12], ErrHeightNotMonotonic},
+		{"timestamp too old", 112, old, ErrTimestampTooOld},
+		{"proof of work", 112, badPow, ErrHashAboveTarget},
+	}
+	v := newTestVerifier(t)
+	if err := v.VerifyAll(mirrors[:12]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	for _, test := range tests {
+		err := v.VerifyAt(test.height, test.mirror)
+		if !errors.Is(err, test.want) {
+			t.Errorf("VerifyAt (%s): got error %v, want %v", test.name, err, test.want)
+		}
+		var verr *ChainVerifyError
+		if !errors.As(err, &verr) || verr.Height != test.height ||
+			verr.Hash != test.mirror.BtcHeader.BlockHash() {
+			t.Errorf("VerifyAt (%s): got error %#v", test.name, err)
+		}
+	}
+
+	// A failure leaves the verifier expecting the same mirror.
+	if err := v.VerifyAll(mirrors[12:]); err != nil {
+		t.Errorf("VerifyAll after failures error %v", err)
+	}
+}
+
+func TestChainVerifierTimeAndParams(t *testing.T) {
+	mirrors := newTestMirrors(3)
+	now := mirrors[1].BtcHeader.Timestamp.Add(-maxFutureBlockTime)
+	v, err := NewChainVerifier(ChainVerifierConfig{
+		Params: &chaincfg.RegressionNetParams,
+		Now:    func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("NewChainVerifier error %v", err)
+	}
+	if err := v.VerifyAll(mirrors[:2]); err != nil {
+		t.Fatalf("VerifyAll error %v", err)
+	}
+	if err := v.Verify(mirrors[2]); !errors.Is(err, ErrTimestampTooNew) {
+		t.Errorf("Verify: got error %v, want %v", err, ErrTimestampTooNew)
+	}
+
+	// The main network is the default, whose limit the regression test
+	// bits exceed.
+	v, err = NewChainVerifier(ChainVerifierConfig{})
+	if err != nil {
+		t.Fatalf("NewChainVerifier error %v", err)
+	}
+	if err := v.Verify(mirrors[0]); !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("Verify: got error %v, want %v", err, ErrInvalidBits)
+	}
+
+	custom := chaincfg.CustomSignetParams([]byte{0x51}, nil)
+	if _, err := NewChainVerifier(ChainVerifierConfig{Params: &custom}); err == nil {
+		t.Errorf("NewChainVerifier: expected error for a custom signet without challenge")
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// watchRetention is the depth below the last connected block past which a
+// Watcher forgets its matches, and can no longer retract them.
+const watchRetention = 1000
+
+// WatchEventType identifies the kind of a WatchEvent.
+type WatchEventType int
+
+const (
+	// WatchMatched is sent when a block delegating to a watched
+	// candidate joins the best chain.
+	WatchMatched WatchEventType = iota
+
+	// WatchRetracted is sent when a block a WatchMatched event was sent
+	// for leaves the best chain, whether or not its candidate is still
+	// watched.
+	WatchRetracted
+
+	// WatchOverflow is the last event of a watcher whose subscription
+	// overflowed: retractions may have been missed.
+	WatchOverflow
+)
+
+var watchEventTypeStrings = map[WatchEventType]string{
+	WatchMatched:   "WatchMatched",
+	WatchRetracted: "WatchRetracted",
+	WatchOverflow:  "WatchOverflow",
+}
+
+// String returns the WatchEventType in human-readable form.
+func (t WatchEventType) String() string {
+	if s, ok := watchEventTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown WatchEventType (%d)", int(t))
+}
+
+// WatchEvent is a match, or the retraction of a match, of a Watcher.
+type WatchEvent struct {
+	Type      WatchEventType
+	Height    int64
+	BlockHash chainhash.Hash
+
+	// PowerParams are the power parameters of the block, those
+	// ParsePowerParams returns.
+	PowerParams *Delegation
+}
+
+// Watcher follows a chain subscription for the blocks delegating their hash
+// power to a set of candidates.
+type Watcher struct {
+	mtx        sync.RWMutex
+	candidates map[common.Address]struct{}
+
+	events chan WatchEvent
+	life   lifecycle
+	health *healthState
+
+	// sub and matched, the events of the matches which can be
+	// retracted, are only used by the watcher goroutine.
+	sub     <-chan ChainEvent
+	matched map[chainhash.Hash]WatchEvent
+}
+
+// NewWatcher returns a watcher of the blocks of the subscription sub, a
+// channel returned by MirrorChain.Subscribe, delegating to one of
+// candidates.  Once started, the watcher runs until sub is closed or it is
+// stopped, then closes its events channel.  It does not drop events: a
+// consumer which does not keep up with it makes the subscription overflow.
+func NewWatcher(sub <-chan ChainEvent, candidates ...common.Address) *Watcher {
+	w := &Watcher{
+		candidates: make(map[common.Address]struct{}),
+		events:     make(chan WatchEvent, defaultSubscriptionBuffer),
+		matched:    make(map[chainhash.Hash]WatchEvent),
+		health:     newHealthState(),
+	}
+	w.life.finish = func() { close(w.events) }
+	w.Add(candidates...)
+	w.sub = sub
+	return w
+}
+
+// Start runs the watcher until sub is closed, Stop is called or ctx is
+// done.
+func (w *Watcher) Start(ctx context.Context) error {
+	return w.life.start(ctx, w.run)
+}
+
+// Stop waits until ctx is done for the event in progress to be received,
+// and closes the events channel.
+func (w *Watcher) Stop(ctx context.Context) error {
+	return w.life.stop(ctx)
+}
+
+// Ping returns ErrNotRunning unless the watcher runs.  A watcher stops
+// running once its subscription is closed.
+func (w *Watcher) Ping(ctx context.Context) error {
+	return w.life.ping()
+}
+
+// LastBlockAge returns the time elapsed since the subscription last sent
+// the watcher a block.
+func (w *Watcher) LastBlockAge() time.Duration {
+	return w.health.LastBlockAge()
+}
+
+// LastError returns ErrSubscriptionOverflow, and when, if the subscription
+// overflowed.
+func (w *Watcher) LastError() (error, time.Time) {
+	return w.health.LastError()
+}
+
+// Events returns the channel the watcher sends its events on.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Add adds candidates to the watched set.  It is safe to call while the
+// watcher runs.  A block is checked against the set when the watcher
+// receives its event, which may come after the block was connected.
+func (w *Watcher) Add(candidates ...common.Address) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, c := range candidates {
+		w.candidates[c] = struct{}{}
+	}
+}
+
+// Remove removes candidates from the watched set.  The matches already sent
+// are still retracted.
+func (w *Watcher) Remove(candidates ...common.Address) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, c := range candidates {
+		delete(w.candidates, c)
+	}
+}
+
+// Watching reports whether candidate is in the watched set.
+func (w *Watcher) Watching(candidate common.Address) bool {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	_, ok := w.candidates[candidate]
+	return ok
+}
+
+func (w *Watcher) run(ctx context.Context, quit <-chan struct{}) {
+	for {
+		var event ChainEvent
+		select {
+		case e, ok := <-w.sub:
+			if !ok {
+				return
+			}
+			event = e
+		case <-quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		switch event.Type {
+		case BlockConnected, BodyAttached, BlockDisconnected:
+			w.health.block()
+		case SubscriptionOverflow:
+			w.health.fail(ErrSubscriptionOverflow)
+		}
+		switch event.Type {
+		case BlockConnected, BodyAttached:
+			w.connect(ctx, event)
+		case BlockDisconnected:
+			if match, ok := w.matched[event.Hash]; ok {
+				delete(w.matched, event.Hash)
+				match.Type = WatchRetracted
+				w.send(ctx, match)
+			}
+		case SubscriptionOverflow:
+			w.send(ctx, WatchEvent{Type: WatchOverflow})
+		}
+	}
+}
+
+// send sends event unless ctx is done first.
+func (w *Watcher) send(ctx context.Context, event WatchEvent) {
+	select {
+	case w.events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// connect sends the match of the block of event, if it delegates to a
+// watched candidate.
+func (w *Watcher) connect(ctx context.Context, event ChainEvent) {
+	for hash, match := range w.matched {
+		if match.Height < event.Height-watchRetention {
+			delete(w.matched, hash)
+		}
+	}
+	if event.Mirror == nil {
+		return
+	}
+	d, err := event.Mirror.ParseDelegation(PreferOutput)
+	if err != nil || !w.Watching(d.Candidate) {
+		return
+	}
+	match := WatchEvent{
+		Type:        WatchMatched,
+		Height:      event.Height,
+		BlockHash:   event.Hash,
+		PowerParams: d,
+	}
+	w.matched[event.Hash] = match
+	w.send(ctx, match)
+}
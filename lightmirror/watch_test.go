@@ -0,0 +1,238 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror/leaktest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// startWatcher starts a watcher of sub, stopped at the end of the test,
+// which checks that it leaves no goroutine behind.
+func startWatcher(t *testing.T, sub <-chan ChainEvent, candidates ...common.Address) *Watcher {
+	t.Helper()
+	leaktest.Check(t)
+	w := NewWatcher(sub, candidates...)
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("Start error %v", err)
+	}
+	t.Cleanup(func() {
+		if err := w.Stop(context.Background()); err != nil {
+			t.Errorf("Stop error %v", err)
+		}
+	})
+	return w
+}
+
+// nextWatchEvent returns the next event of w, failing the test if none
+// comes.
+func nextWatchEvent(t *testing.T, w *Watcher) WatchEvent {
+	t.Helper()
+	select {
+	case event, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("watcher events closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no watcher event")
+	}
+	return WatchEvent{}
+}
+
+func checkWatchEvent(t *testing.T, desc string, got WatchEvent, typ WatchEventType, m *BtcLightMirrorV2, height int64) {
+	t.Helper()
+	candidate, _, _ := m.ParsePowerParams()
+	if got.Type != typ || got.BlockHash != m.BtcHeader.BlockHash() || got.Height != height ||
+		got.PowerParams == nil || got.PowerParams.Candidate != candidate {
+		t.Errorf("%s: got %v %v at height %d, want %v %v at height %d", desc,
+			got.Type, got.BlockHash, got.Height, typ, m.BtcHeader.BlockHash(), height)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	candidateA := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	candidateB := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+
+	// The main chain: anchor, A, plain, B, A.
+	mirrors := newTestMirrors(1)
+	next := func(seed uint32, candidate *common.Address) *BtcLightMirrorV2 {
+		prev := mirrors[len(mirrors)-1].BtcHeader.BlockHash()
+		if candidate == nil {
+			return newTestMirror(prev, seed, 0)
+		}
+		return newDelegatingMirror(prev, seed, *candidate, *candidate)
+	}
+	mirrors = append(mirrors, next(1, &candidateA))
+	mirrors = append(mirrors, next(2, nil))
+	mirrors = append(mirrors, next(3, &candidateB))
+	mirrors = append(mirrors, next(4, &candidateA))
+
+	c := newTestChain(t, mirrors[:1])
+	sub, cancel := c.Subscribe()
+	w := startWatcher(t, sub, candidateA)
+	if !w.Watching(candidateA) || w.Watching(candidateB) {
+		t.Fatalf("Watching: got %v %v, want true false", w.Watching(candidateA),
+			w.Watching(candidateB))
+	}
+	if _, err := c.AppendBatch(mirrors[1:]); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	checkWatchEvent(t, "A", nextWatchEvent(t, w), WatchMatched, mirrors[1], testAnchorHeight+1)
+	checkWatchEvent(t, "A again", nextWatchEvent(t, w), WatchMatched, mirrors[4], testAnchorHeight+4)
+
+	// A longer branch forking after the plain block replaces B and A
+	// with B, plain and A.  The match of the disconnected A is
+	// retracted, B now being watched is matched.
+	w.Add(candidateB)
+	mirrors = mirrors[:3]
+	branch := []*BtcLightMirrorV2{next(10, &candidateB)}
+	mirrors = append(mirrors, branch[0])
+	branch = append(branch, next(11, nil))
+	mirrors = append(mirrors, branch[1])
+	branch = append(branch, next(12, &candidateA))
+	mirrors = append(mirrors, branch[2])
+	if _, err := c.AppendBatch(branch); err != nil {
+		t.Fatalf("AppendBatch error %v", err)
+	}
+	retracted := nextWatchEvent(t, w)
+	if retracted.Type != WatchRetracted || retracted.Height != testAnchorHeight+4 ||
+		retracted.PowerParams.Candidate != candidateA {
+		t.Errorf("retraction: got %+v", retracted)
+	}
+	checkWatchEvent(t, "branch B", nextWatchEvent(t, w), WatchMatched, branch[0], testAnchorHeight+3)
+	checkWatchEvent(t, "branch A", nextWatchEvent(t, w), WatchMatched, branch[2], testAnchorHeight+5)
+
+	// A removed candidate no longer matches.
+	w.Remove(candidateA)
+	if _, err := c.Append(next(13, &candidateA)); err != nil {
+		t.Fatalf("Append error %v", err)
+	}
+	cancel()
+	if event, ok := <-w.Events(); ok {
+		t.Errorf("removed candidate: got event %+v", event)
+	}
+}
+
+func TestWatcherOverflow(t *testing.T) {
+	sub := make(chan ChainEvent, 1)
+	w := startWatcher(t, sub)
+	sub <- ChainEvent{Type: SubscriptionOverflow}
+	close(sub)
+	if event := nextWatchEvent(t, w); event.Type != WatchOverflow {
+		t.Errorf("got %v, want %v", event.Type, WatchOverflow)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("events not closed after the overflow")
+	}
+}
+
+func TestWatcherConcurrentUpdates(t *testing.T) {
+	candidate := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	mirrors := newTestMirrors(1)
+	for i := uint32(1); i <= 50; i++ {
+		mirrors = append(mirrors, newDelegatingMirror(mirrors[len(mirrors)-1].BtcHeader.BlockHash(),
+			i, candidate, candidate))
+	}
+	c := newTestChain(t, mirrors[:1])
+	sub, cancel := c.Subscribe()
+	w := startWatcher(t, sub)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, m := range mirrors[1:] {
+			if _, err := c.Append(m); err != nil {
+				t.Errorf("Append error %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			w.Add(candidate)
+			w.Remove(candidate)
+		}
+		w.Add(candidate)
+	}()
+	wg.Wait()
+	cancel()
+	for event := range w.Events() {
+		if event.Type != WatchMatched || event.PowerParams.Candidate != candidate {
+			t.Errorf("got %+v", event)
+		}
+	}
+}
+
+func TestWatcherStop(t *testing.T) {
+	// Stop closes the events of a watcher whose subscription is open.
+	sub := make(chan ChainEvent)
+	w := startWatcher(t, sub)
+	if err := w.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("events not closed by Stop")
+	}
+	if err := w.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("Start after Stop: got error %v, want %v", err, ErrAlreadyStarted)
+	}
+
+	// A send nobody receives is cancelled at the deadline.
+	full := make(chan ChainEvent, defaultSubscriptionBuffer+2)
+	for i := 0; i < cap(full); i++ {
+		full <- ChainEvent{Type: SubscriptionOverflow}
+	}
+	w = startWatcher(t, full)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(full) > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	n := 0
+	for range w.Events() {
+		n++
+	}
+	if n != defaultSubscriptionBuffer {
+		t.Errorf("got %d events, want %d", n, defaultSubscriptionBuffer)
+	}
+
+	// A watcher stopped before it started closes its events too.
+	w = NewWatcher(sub)
+	if err := w.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error %v", err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("events of an unstarted watcher not closed by Stop")
+	}
+}
+
+func TestWatchEventTypeStringer(t *testing.T) {
+	tests := []struct {
+		in   WatchEventType
+		want string
+	}{
+		{WatchMatched, "WatchMatched"},
+		{WatchRetracted, "WatchRetracted"},
+		{WatchOverflow, "WatchOverflow"},
+		{0xff, "Unknown WatchEventType (255)"},
+	}
+	for i, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String #%d\n got: %s want: %s", i, got, test.want)
+		}
+	}
+}